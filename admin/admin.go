@@ -0,0 +1,86 @@
+// Package admin implements the optional HTTP server used to inspect and operate a
+// running redisbetween process.
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+type Server struct {
+	log    *zap.Logger
+	opts   Options
+	mux    *http.ServeMux
+	audit  *auditor
+	server *http.Server
+}
+
+func New(log *zap.Logger, address string, opts Options) *Server {
+	log = log.With(zap.String("admin", address))
+	s := &Server{
+		log:   log,
+		opts:  opts,
+		mux:   http.NewServeMux(),
+		audit: &auditor{log: log, w: opts.Audit, events: opts.Events},
+	}
+	s.server = &http.Server{Addr: address, Handler: http.HandlerFunc(s.serve)}
+	return s
+}
+
+// Handle registers an arbitrary handler for the given pattern.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandleJSON registers a read-only route that responds with fn's return value
+// encoded as JSON.
+func (s *Server) HandleJSON(pattern string, fn func() interface{}) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, fn())
+	})
+}
+
+// Run serves requests until Shutdown is called.
+func (s *Server) Run() error {
+	li, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(li)
+}
+
+// Serve serves requests on li until Shutdown is called.
+func (s *Server) Serve(li net.Listener) error {
+	s.log.Info("Admin server listening", zap.String("address", li.Addr().String()), zap.Bool("tls", s.opts.TLS != nil))
+	if s.opts.TLS != nil {
+		li = tls.NewListener(li, s.opts.TLS)
+	}
+	err := s.server.Serve(li)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// Close stops the server without waiting for requests in progress.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// WriteJSON writes v as an indented JSON response with the given status code.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,36 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestHandleJSON(t *testing.T) {
+	s := New(zaptest.NewLogger(t), "127.0.0.1:0", Options{})
+	s.HandleJSON("/stats", func() interface{} {
+		return map[string]int{"answer": 42}
+	})
+
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- s.Serve(li) }()
+
+	res, err := http.Get("http://" + li.Addr().String() + "/stats")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	var body map[string]int
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	_ = res.Body.Close()
+	assert.Equal(t, 42, body["answer"])
+
+	assert.NoError(t, s.Shutdown(context.Background()))
+	assert.NoError(t, <-done)
+}
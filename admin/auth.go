@@ -0,0 +1,200 @@
+package admin
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxAuditBody is how much of a mutation's request body is kept in its audit
+// record
+const maxAuditBody = 64 * 1024
+
+// Options configures authenticating the admin server's clients, with a bearer
+// Token, a client certificate verified by TLS, or either, and auditing the
+// mutations made through it. Mutating routes, those of any method but GET,
+// HEAD and OPTIONS, are authenticated once either is set, and read-only routes
+// too with AuthReads.
+type Options struct {
+	Token string
+	// TLS serves the admin server over TLS. Clients whose certificate it
+	// verifies, with ClientAuth VerifyClientCertIfGiven or stricter, are
+	// authenticated as the certificate's common name.
+	TLS       *tls.Config
+	AuthReads bool
+	// Audit, if set, is appended a JSON line for each mutation, on top of the
+	// one logged
+	Audit io.Writer
+	// Events, if set, is sent each mutation's audit record, without blocking:
+	// records are dropped while it is full
+	Events chan<- Audit
+}
+
+// Audit is the record of a mutation made, or attempted, through the admin
+// server
+type Audit struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Body      string    `json:"body,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Status    int       `json:"status"`
+	// Outcome is one of ok, failed or unauthorized
+	Outcome string `json:"outcome"`
+}
+
+// TLSConfig loads the certificate the admin server is served with, and, if
+// clientCA is set, the CAs its clients' certificates are verified with
+func TLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + clientCA)
+		}
+		// clients without one may still authenticate with the token, or read
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// OpenAuditFile opens the file audit records are appended to
+func OpenAuditFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+// auditor writes audit records to the log, the audit file and the events
+// channel
+type auditor struct {
+	log    *zap.Logger
+	mu     sync.Mutex
+	w      io.Writer
+	events chan<- Audit
+}
+
+func (a *auditor) record(rec Audit) {
+	a.log.Info("Admin mutation",
+		zap.String("principal", rec.Principal),
+		zap.String("method", rec.Method),
+		zap.String("route", rec.Route),
+		zap.String("body", rec.Body),
+		zap.Int("status", rec.Status),
+		zap.String("outcome", rec.Outcome),
+	)
+	if a.w != nil {
+		b, _ := json.Marshal(rec)
+		a.mu.Lock()
+		_, err := a.w.Write(append(b, '\n'))
+		a.mu.Unlock()
+		if err != nil {
+			a.log.Error("Failed to write the audit record", zap.Error(err))
+		}
+	}
+	if a.events != nil {
+		select {
+		case a.events <- rec:
+		default:
+		}
+	}
+}
+
+// authenticated says who made the request, if anyone. Without a token or
+// client CAs, everyone is anonymous.
+func (s *Server) authenticated(r *http.Request) (string, bool) {
+	tlsAuth := s.opts.TLS != nil && s.opts.TLS.ClientCAs != nil
+	if s.opts.Token == "" && !tlsAuth {
+		return "anonymous", true
+	}
+	if tlsAuth && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	if s.opts.Token != "" {
+		const prefix = "Bearer "
+		h := r.Header.Get("Authorization")
+		if strings.HasPrefix(h, prefix) && subtle.ConstantTimeCompare([]byte(h[len(prefix):]), []byte(s.opts.Token)) == 1 {
+			return "token", true
+		}
+	}
+	return "", false
+}
+
+// serve authenticates requests before they reach their route, and audits those
+// that mutate
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	mutation := r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+	principal, ok := s.authenticated(r)
+	if !mutation {
+		if !ok && s.opts.AuthReads {
+			unauthorized(w)
+			return
+		}
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+
+	rec := Audit{Time: time.Now(), Principal: principal, Method: r.Method, Route: r.URL.Path}
+	if r.URL.RawQuery != "" {
+		rec.Route += "?" + r.URL.RawQuery
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAuditBody+1))
+	if err == nil {
+		rec.Truncated = len(body) > maxAuditBody
+		if rec.Truncated {
+			rec.Body = string(body[:maxAuditBody])
+		} else {
+			rec.Body = string(body)
+		}
+	}
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+
+	if !ok {
+		unauthorized(w)
+		rec.Status, rec.Outcome = http.StatusUnauthorized, "unauthorized"
+		s.audit.record(rec)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	s.mux.ServeHTTP(sw, r)
+	rec.Status, rec.Outcome = sw.status, "ok"
+	if sw.status >= 400 {
+		rec.Outcome = "failed"
+	}
+	s.audit.record(rec)
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="redisbetween"`)
+	WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+}
+
+// statusWriter remembers the status a route responded with
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,221 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+// serveTest serves s on a local port until the test ends, returning its address
+func serveTest(t *testing.T, s *Server) string {
+	t.Helper()
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- s.Serve(li) }()
+	t.Cleanup(func() {
+		assert.NoError(t, s.Shutdown(context.Background()))
+		assert.NoError(t, <-done)
+	})
+	return li.Addr().String()
+}
+
+// syncBuffer is an audit file safe to read while the server writes it
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestMutationAuth(t *testing.T) {
+	var audit syncBuffer
+	events := make(chan Audit, 10)
+	s := New(zaptest.NewLogger(t), "127.0.0.1:0", Options{Token: "t0ken", Audit: &audit, Events: events})
+	var received []string
+	s.Handle("/pool", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, string(body))
+		if r.Method == http.MethodDelete {
+			WriteJSON(w, http.StatusNotFound, map[string]string{"error": "no override"})
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]string{"size": "10"})
+	}))
+	address := serveTest(t, s)
+
+	do := func(method, token, body string) *http.Response {
+		req, err := http.NewRequest(method, "http://"+address+"/pool?upstream=cache", strings.NewReader(body))
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		_ = res.Body.Close()
+		return res
+	}
+	event := func() Audit {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no audit event")
+			return Audit{}
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "", "").StatusCode, "read-only routes are open")
+	select {
+	case e := <-events:
+		t.Fatalf("reads are not audited, got %+v", e)
+	default:
+	}
+
+	res := do(http.MethodPut, "", `{"size":10}`)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equal(t, `Bearer realm="redisbetween"`, res.Header.Get("WWW-Authenticate"))
+	e := event()
+	assert.Equal(t, Audit{Time: e.Time, Method: "PUT", Route: "/pool?upstream=cache", Body: `{"size":10}`, Status: 401, Outcome: "unauthorized"}, e)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPut, "wrong", `{"size":10}`).StatusCode)
+	event()
+	assert.Equal(t, []string{""}, received, "unauthorized mutations never reach their route")
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "t0ken", `{"size":10}`).StatusCode)
+	e = event()
+	assert.Equal(t, Audit{Time: e.Time, Principal: "token", Method: "PUT", Route: "/pool?upstream=cache", Body: `{"size":10}`, Status: 200, Outcome: "ok"}, e)
+	assert.WithinDuration(t, time.Now(), e.Time, time.Second)
+	assert.Equal(t, `{"size":10}`, received[1], "the route reads the body that was audited")
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "t0ken", "").StatusCode)
+	assert.Equal(t, "failed", event().Outcome)
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	assert.Len(t, lines, 4, "every mutation is written to the audit file, whatever its outcome")
+	var rec Audit
+	assert.NoError(t, json.Unmarshal([]byte(lines[2]), &rec))
+	assert.Equal(t, "token", rec.Principal)
+	assert.Equal(t, `{"size":10}`, rec.Body)
+	assert.Equal(t, 200, rec.Status)
+
+	big := strings.Repeat("x", maxAuditBody+10)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "t0ken", big).StatusCode)
+	e = event()
+	assert.True(t, e.Truncated)
+	assert.Len(t, e.Body, maxAuditBody)
+	assert.Len(t, received[3], len(big), "the route still gets the whole body")
+}
+
+func TestAuthReads(t *testing.T) {
+	s := New(zaptest.NewLogger(t), "127.0.0.1:0", Options{Token: "t0ken", AuthReads: true})
+	s.HandleJSON("/stats", func() interface{} { return map[string]int{"answer": 42} })
+	address := serveTest(t, s)
+
+	res, err := http.Get("http://" + address + "/stats")
+	assert.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+address+"/stats", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer t0ken")
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+// testCert issues a certificate for cn, signed by parent, or self-signed if
+// parent is nil, writing it and its key to dir
+func testCert(t *testing.T, dir, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, cn+".pem"), certPEM, 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, cn+"-key.pem"), keyPEM, 0600))
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+	return cert, key, pair
+}
+
+func TestClientCertAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, _ := testCert(t, dir, "ca", nil, nil)
+	testCert(t, dir, "server", ca, caKey)
+	_, _, client := testCert(t, dir, "ops", ca, caKey)
+
+	tlsConfig, err := TLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	assert.NoError(t, err)
+	events := make(chan Audit, 10)
+	s := New(zaptest.NewLogger(t), "127.0.0.1:0", Options{TLS: tlsConfig, Events: events})
+	s.Handle("/pool", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, map[string]string{})
+	}))
+	address := serveTest(t, s)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	put := func(certs ...tls.Certificate) int {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		req, err := http.NewRequest(http.MethodPut, "https://"+address+"/pool", nil)
+		assert.NoError(t, err)
+		res, err := c.Do(req)
+		assert.NoError(t, err)
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, put(), "a client without a certificate has nothing to authenticate with")
+	assert.Equal(t, "unauthorized", (<-events).Outcome)
+	assert.Equal(t, http.StatusOK, put(client))
+	assert.Equal(t, "cert:ops", (<-events).Principal)
+}
@@ -0,0 +1,57 @@
+// Package auth authenticates the clients of the proxy itself, as opposed to the
+// credentials the proxy uses with its upstreams.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+)
+
+// DefaultUser is the username of an AUTH without one, as in redis
+const DefaultUser = "default"
+
+// ErrInvalidCredentials is returned for a username and credential that don't
+// match. It is the only error a client is told about: any other means the
+// provider couldn't tell.
+var ErrInvalidCredentials = errors.New("invalid username-password pair or user is disabled")
+
+// ClientInfo describes the connection authenticating, for providers that decide
+// on more than the credential
+type ClientInfo struct {
+	Addr     string `json:"addr"`
+	Name     string `json:"name,omitempty"`
+	Library  string `json:"library,omitempty"`
+	Upstream string `json:"upstream"`
+}
+
+// Identity is who a client authenticated as. Tenant, if set, groups identities,
+// for instance every token issued to one service.
+type Identity struct {
+	User   string `json:"user"`
+	Tenant string `json:"tenant,omitempty"`
+	// Unverified is set for identities let through without a verdict, by a
+	// provider that fails open
+	Unverified bool `json:"unverified,omitempty"`
+}
+
+// Provider authenticates a client's AUTH. It returns ErrInvalidCredentials if
+// the credential is wrong, and any other error if it couldn't tell, which the
+// client is answered with a PROXYAUTH error for. Authenticate is called
+// concurrently, and must return once ctx is done.
+type Provider interface {
+	Authenticate(ctx context.Context, username, credential string, client ClientInfo) (Identity, error)
+}
+
+// Static authenticates against a fixed map of usernames to passwords
+type Static map[string]string
+
+func (s Static) Authenticate(_ context.Context, username, credential string, _ ClientInfo) (Identity, error) {
+	password, ok := s[username]
+	// compared even for unknown users, so that timing doesn't tell them apart
+	match := subtle.ConstantTimeCompare([]byte(password), []byte(credential)) == 1
+	if !ok || !match {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{User: username}, nil
+}
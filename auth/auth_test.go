@@ -0,0 +1,20 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatic(t *testing.T) {
+	s := Static{"app": "s3cret"}
+	identity, err := s.Authenticate(context.Background(), "app", "s3cret", ClientInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{User: "app"}, identity)
+
+	_, err = s.Authenticate(context.Background(), "app", "wrong", ClientInfo{})
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, err = s.Authenticate(context.Background(), "nobody", "", ClientInfo{})
+	assert.Equal(t, ErrInvalidCredentials, err, "unknown users don't match an empty password")
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fileCheckInterval is the least time between checks of whether the file has
+// changed
+const fileCheckInterval = time.Second
+
+type fileUser struct {
+	hash   []byte
+	tenant string
+}
+
+// File authenticates against a file of bcrypt hashes, one "user:hash" or
+// "user:hash:tenant" per line, with blank lines and lines starting with # left
+// out. It is reloaded when it changes, keeping the users it had if it no longer
+// parses.
+type File struct {
+	log  *zap.Logger
+	sd   *statsd.Client
+	path string
+
+	mu       sync.RWMutex
+	users    map[string]fileUser
+	modTime  time.Time
+	size     int64
+	checked  time.Time
+	verified map[[sha256.Size]byte]bool
+}
+
+func NewFile(log *zap.Logger, sd *statsd.Client, path string) (*File, error) {
+	f := &File{log: log, sd: sd, path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(info); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) Authenticate(_ context.Context, username, credential string, _ ClientInfo) (Identity, error) {
+	f.reload()
+	f.mu.RLock()
+	u, ok := f.users[username]
+	key := sha256.Sum256([]byte(username + "\x00" + credential))
+	verified := f.verified[key]
+	f.mu.RUnlock()
+	if !ok {
+		return Identity{}, ErrInvalidCredentials
+	}
+	// bcrypt is slow by design, so credentials that matched are remembered until
+	// the file changes
+	if !verified {
+		if bcrypt.CompareHashAndPassword(u.hash, []byte(credential)) != nil {
+			return Identity{}, ErrInvalidCredentials
+		}
+		f.mu.Lock()
+		f.verified[key] = true
+		f.mu.Unlock()
+	}
+	return Identity{User: username, Tenant: u.tenant}, nil
+}
+
+// reload loads the file again if it has changed since it was loaded
+func (f *File) reload() {
+	f.mu.Lock()
+	if time.Since(f.checked) < fileCheckInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.checked = time.Now()
+	modTime, size := f.modTime, f.size
+	f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		metrics.AuthReload.Incr(f.sd, "false")
+		f.log.Error("Error checking auth file, keeping the users already loaded", zap.String("file", f.path), zap.Error(err))
+		return
+	}
+	if info.ModTime().Equal(modTime) && info.Size() == size {
+		return
+	}
+	if err := f.load(info); err != nil {
+		metrics.AuthReload.Incr(f.sd, "false")
+		f.log.Error("Error reloading auth file, keeping the users already loaded", zap.String("file", f.path), zap.Error(err))
+		return
+	}
+	metrics.AuthReload.Incr(f.sd, "true")
+	f.log.Info("Reloaded auth file", zap.String("file", f.path))
+}
+
+func (f *File) load(info os.FileInfo) error {
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseFile(b)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users, f.modTime, f.size = users, info.ModTime(), info.Size()
+	f.verified = make(map[[sha256.Size]byte]bool)
+	return nil
+}
+
+func parseFile(b []byte) (map[string]fileUser, error) {
+	users := make(map[string]fileUser)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash or user:hash:tenant", n)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		u := fileUser{hash: []byte(parts[1])}
+		if len(parts) == 3 {
+			u.tenant = parts[2]
+		}
+		users[parts[0]] = u
+	}
+	return users, s.Err()
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hash(t *testing.T, password string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.NoError(t, err)
+	return string(h)
+}
+
+func writeFile(t *testing.T, path, content string, modTime time.Time) {
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	start := time.Now().Add(-time.Hour)
+	writeFile(t, path, "# users\n\napp:"+hash(t, "s3cret")+":payments\nops:"+hash(t, "pw")+"\n", start)
+	f, err := NewFile(zap.NewNop(), nil, path)
+	assert.NoError(t, err)
+
+	identity, err := f.Authenticate(context.Background(), "app", "s3cret", ClientInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{User: "app", Tenant: "payments"}, identity)
+	identity, err = f.Authenticate(context.Background(), "app", "s3cret", ClientInfo{})
+	assert.NoError(t, err, "verified credentials are remembered")
+	assert.Equal(t, "payments", identity.Tenant)
+	_, err = f.Authenticate(context.Background(), "app", "wrong", ClientInfo{})
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, err = f.Authenticate(context.Background(), "nobody", "s3cret", ClientInfo{})
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	// the file changes: app's password is rotated and ops is removed
+	writeFile(t, path, "app:"+hash(t, "rotated")+"\n", start.Add(time.Minute))
+	f.checked = time.Time{}
+	_, err = f.Authenticate(context.Background(), "app", "s3cret", ClientInfo{})
+	assert.Equal(t, ErrInvalidCredentials, err, "the remembered credential is forgotten on reload")
+	_, err = f.Authenticate(context.Background(), "app", "rotated", ClientInfo{})
+	assert.NoError(t, err)
+	_, err = f.Authenticate(context.Background(), "ops", "pw", ClientInfo{})
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	// a broken file keeps the users already loaded
+	writeFile(t, path, "app:not-a-bcrypt-hash\n", start.Add(2*time.Minute))
+	f.checked = time.Time{}
+	_, err = f.Authenticate(context.Background(), "app", "rotated", ClientInfo{})
+	assert.NoError(t, err)
+}
+
+func TestInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		content  string
+		expected string
+	}{
+		{"app\n", "line 1: expected user:hash or user:hash:tenant"},
+		{"# comment\n:" + hash(t, "pw") + "\n", "line 2: expected user:hash or user:hash:tenant"},
+		{"app:plaintext\n", "line 1: crypto/bcrypt: hashedSecret too short to be a bcrypted password"},
+	} {
+		path := filepath.Join(dir, "users")
+		writeFile(t, path, tc.content, time.Now())
+		_, err := NewFile(zap.NewNop(), nil, path)
+		assert.EqualError(t, err, tc.expected, tc.content)
+	}
+	_, err := NewFile(zap.NewNop(), nil, filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
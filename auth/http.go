@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"go.uber.org/zap"
+)
+
+// maxCacheEntries caps the verdicts an HTTP verifier remembers
+const maxCacheEntries = 10000
+
+// maxResponseBytes caps the body of a verifier's response
+const maxResponseBytes = 64 * 1024
+
+// HTTPOptions configures an HTTP verifier. Each attempt is abandoned after
+// Timeout, and failed ones are retried up to Retries times. Verdicts are
+// cached, for CacheTTL if the credential was accepted and NegativeTTL if it was
+// rejected. If FailOpen is set, a client the verifier couldn't give a verdict
+// for is let in with an Unverified identity rather than turned away.
+type HTTPOptions struct {
+	URL         string
+	Timeout     time.Duration
+	Retries     int
+	CacheTTL    time.Duration
+	NegativeTTL time.Duration
+	FailOpen    bool
+}
+
+// verifyRequest is what is POSTed to the verifier
+type verifyRequest struct {
+	Username   string     `json:"username"`
+	Credential string     `json:"credential"`
+	Client     ClientInfo `json:"client"`
+}
+
+type verdict struct {
+	identity Identity
+	err      error
+	expires  time.Time
+}
+
+type verification struct {
+	done chan struct{}
+	verdict
+}
+
+// HTTP authenticates by POSTing the username and credential as JSON to an
+// external verifier, which answers 200 with the Identity as JSON if the
+// credential is valid and 401 or 403 if it isn't. Anything else is retried, and
+// concurrent AUTHs with the same credential share one verification.
+type HTTP struct {
+	log    *zap.Logger
+	sd     *statsd.Client
+	opts   HTTPOptions
+	client *http.Client
+
+	mu       sync.Mutex
+	cache    map[[sha256.Size]byte]verdict
+	inFlight map[[sha256.Size]byte]*verification
+}
+
+func NewHTTP(log *zap.Logger, sd *statsd.Client, opts HTTPOptions) *HTTP {
+	return &HTTP{
+		log:      log,
+		sd:       sd,
+		opts:     opts,
+		client:   &http.Client{},
+		cache:    make(map[[sha256.Size]byte]verdict),
+		inFlight: make(map[[sha256.Size]byte]*verification),
+	}
+}
+
+func (h *HTTP) Authenticate(ctx context.Context, username, credential string, client ClientInfo) (Identity, error) {
+	key := sha256.Sum256([]byte(username + "\x00" + credential))
+	h.mu.Lock()
+	if v, ok := h.cache[key]; ok && time.Now().Before(v.expires) {
+		h.mu.Unlock()
+		if v.err != nil {
+			metrics.AuthCache.Incr(h.sd, "negative_hit")
+		} else {
+			metrics.AuthCache.Incr(h.sd, "hit")
+		}
+		return v.identity, v.err
+	}
+	metrics.AuthCache.Incr(h.sd, "miss")
+	call, shared := h.inFlight[key]
+	if !shared {
+		call = &verification{done: make(chan struct{})}
+		h.inFlight[key] = call
+	}
+	h.mu.Unlock()
+
+	if !shared {
+		// verified on its own context, so that the client that started it giving
+		// up doesn't fail the others waiting on it
+		go func() {
+			vctx, cancel := context.WithTimeout(context.Background(), time.Duration(h.opts.Retries+1)*h.opts.Timeout)
+			defer cancel()
+			call.identity, call.err = h.verify(vctx, verifyRequest{Username: username, Credential: credential, Client: client})
+			h.mu.Lock()
+			delete(h.inFlight, key)
+			h.store(key, call.verdict)
+			h.mu.Unlock()
+			close(call.done)
+		}()
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return h.failed(username, ctx.Err())
+	}
+	if call.err != nil && call.err != ErrInvalidCredentials {
+		return h.failed(username, call.err)
+	}
+	return call.identity, call.err
+}
+
+// failed applies the fail-open policy to a verification that got no verdict
+func (h *HTTP) failed(username string, err error) (Identity, error) {
+	if h.opts.FailOpen {
+		h.log.Warn("Auth verifier failed, letting the client in unverified", zap.String("user", username), zap.Error(err))
+		return Identity{User: username, Unverified: true}, nil
+	}
+	return Identity{}, err
+}
+
+// store caches a verdict, but not the lack of one. It must be called with mu
+// held.
+func (h *HTTP) store(key [sha256.Size]byte, v verdict) {
+	ttl := h.opts.CacheTTL
+	if v.err == ErrInvalidCredentials {
+		ttl = h.opts.NegativeTTL
+	} else if v.err != nil {
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	if len(h.cache) >= maxCacheEntries {
+		for k, c := range h.cache {
+			if now.After(c.expires) {
+				delete(h.cache, k)
+			}
+		}
+		if len(h.cache) >= maxCacheEntries {
+			return
+		}
+	}
+	v.expires = now.Add(ttl)
+	h.cache[key] = v
+}
+
+// verify asks the verifier, retrying attempts that fail without a verdict
+func (h *HTTP) verify(ctx context.Context, req verifyRequest) (Identity, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		identity, err := h.attempt(ctx, body)
+		result := "ok"
+		if err == ErrInvalidCredentials {
+			result = "invalid"
+		} else if err != nil {
+			result = "error"
+		}
+		metrics.AuthVerify.Record(h.sd, time.Since(start), result)
+		if err == nil {
+			if identity.User == "" {
+				identity.User = req.Username
+			}
+			return identity, nil
+		}
+		if err == ErrInvalidCredentials || attempt >= h.opts.Retries || ctx.Err() != nil {
+			return Identity{}, err
+		}
+		h.log.Debug("Retrying auth verification", zap.Int("attempt", attempt+1), zap.Error(err))
+	}
+}
+
+func (h *HTTP) attempt(ctx context.Context, body []byte) (Identity, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, h.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Identity{}, err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxResponseBytes))
+		_ = res.Body.Close()
+	}()
+	switch res.StatusCode {
+	case http.StatusOK:
+		var identity Identity
+		if err := json.NewDecoder(io.LimitReader(res.Body, maxResponseBytes)).Decode(&identity); err != nil {
+			return Identity{}, fmt.Errorf("invalid verifier response: %v", err)
+		}
+		identity.Unverified = false
+		return identity, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{}, fmt.Errorf("verifier answered %s", res.Status)
+}
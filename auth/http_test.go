@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// verifier accepts s3cret for any user, putting them in the tenant "payments".
+// A credential of "flaky" fails the first attempt, "down" fails all of them, and
+// "slow" answers after delay.
+func verifier(t *testing.T, delay time.Duration) (*httptest.Server, *int32) {
+	var calls int32
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var req verifyRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		mu.Lock()
+		attempts[req.Credential]++
+		n := attempts[req.Credential]
+		mu.Unlock()
+		switch {
+		case req.Credential == "down", req.Credential == "flaky" && n == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case req.Credential == "slow":
+			time.Sleep(delay)
+			fallthrough
+		case req.Credential == "s3cret", req.Credential == "flaky":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"tenant": "payments", "unverified": true})
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s, &calls
+}
+
+func TestHTTP(t *testing.T) {
+	s, calls := verifier(t, 0)
+	h := NewHTTP(zap.NewNop(), nil, HTTPOptions{URL: s.URL, Timeout: time.Second, Retries: 1, CacheTTL: time.Minute, NegativeTTL: time.Minute})
+	ctx := context.Background()
+
+	identity, err := h.Authenticate(ctx, "app", "s3cret", ClientInfo{Addr: "127.0.0.1:1234"})
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{User: "app", Tenant: "payments"}, identity, "the verifier can't mark identities unverified")
+	_, err = h.Authenticate(ctx, "app", "s3cret", ClientInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls), "accepted credentials are cached")
+
+	_, err = h.Authenticate(ctx, "app", "wrong", ClientInfo{})
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, err = h.Authenticate(ctx, "app", "wrong", ClientInfo{})
+	assert.Equal(t, ErrInvalidCredentials, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls), "rejected credentials are cached, and not retried")
+
+	_, err = h.Authenticate(ctx, "app", "flaky", ClientInfo{})
+	assert.NoError(t, err, "failed attempts are retried")
+	assert.Equal(t, int32(4), atomic.LoadInt32(calls))
+
+	_, err = h.Authenticate(ctx, "app", "down", ClientInfo{})
+	assert.EqualError(t, err, "verifier answered 503 Service Unavailable")
+	_, err = h.Authenticate(ctx, "app", "down", ClientInfo{})
+	assert.Error(t, err)
+	assert.Equal(t, int32(8), atomic.LoadInt32(calls), "failures without a verdict aren't cached")
+}
+
+func TestHTTPFailOpen(t *testing.T) {
+	s, _ := verifier(t, 0)
+	h := NewHTTP(zap.NewNop(), nil, HTTPOptions{URL: s.URL, Timeout: time.Second, FailOpen: true})
+
+	identity, err := h.Authenticate(context.Background(), "app", "down", ClientInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, Identity{User: "app", Unverified: true}, identity)
+	_, err = h.Authenticate(context.Background(), "app", "wrong", ClientInfo{})
+	assert.Equal(t, ErrInvalidCredentials, err, "rejections are never let through")
+}
+
+func TestHTTPSlowVerifier(t *testing.T) {
+	s, calls := verifier(t, 200*time.Millisecond)
+	h := NewHTTP(zap.NewNop(), nil, HTTPOptions{URL: s.URL, Timeout: time.Second, CacheTTL: time.Minute})
+
+	// the client gives up before the verifier answers, but the verification
+	// carries on for the others
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := h.Authenticate(ctx, "app", "slow", ClientInfo{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := h.Authenticate(context.Background(), "app", "slow", ClientInfo{})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls), "concurrent AUTHs share one verification")
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	s, _ := verifier(t, 200*time.Millisecond)
+	h := NewHTTP(zap.NewNop(), nil, HTTPOptions{URL: s.URL, Timeout: 20 * time.Millisecond})
+	_, err := h.Authenticate(context.Background(), "app", "slow", ClientInfo{})
+	assert.Error(t, err)
+}
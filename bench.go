@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/coinbase/redisbetween/internal/workload"
+)
+
+// bench implements `redisbetween bench`, which drives a synthetic workload through
+// a running proxy's socket and, given the upstream's address, through the upstream
+// directly for comparison. It returns the process exit code.
+func bench(args []string, stdout, stderr io.Writer) int {
+	cfg := workload.DefaultConfig()
+	var network, socket, upstream, mix string
+	var asJSON bool
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "Usage: redisbetween bench -socket /var/tmp/redisbetween-host-6379.sock [options]\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&network, "network", "unix", "One of: tcp, tcp4, tcp6, unix or unixpacket")
+	fs.StringVar(&socket, "socket", "", "Local socket of the proxy to benchmark")
+	fs.StringVar(&upstream, "upstream", "", "Optional upstream host:port to benchmark directly for comparison")
+	fs.StringVar(&mix, "mix", "get:80,set:20", "Weighted command mix, from get, set, incr, del and ping")
+	fs.IntVar(&cfg.ValueSize, "valuesize", cfg.ValueSize, "Size in bytes of SET values")
+	fs.IntVar(&cfg.Keyspace, "keyspace", cfg.Keyspace, "Number of distinct bench:<n> keys")
+	fs.IntVar(&cfg.Pipeline, "pipeline", cfg.Pipeline, "Commands per round trip")
+	fs.IntVar(&cfg.Concurrency, "concurrency", cfg.Concurrency, "Number of connections")
+	fs.DurationVar(&cfg.Duration, "duration", cfg.Duration, "How long to run against each target")
+	fs.BoolVar(&asJSON, "json", false, "Print results as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if socket == "" {
+		fs.Usage()
+		return 2
+	}
+	var err error
+	if cfg.Mix, err = workload.ParseMix(mix); err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	results := make(map[string]workload.Result)
+	res, err := workload.Run(context.Background(), "proxy", func() (net.Conn, error) { return net.Dial(network, socket) }, cfg)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "proxy: %v\n", err)
+		return 1
+	}
+	results["proxy"] = res
+	if upstream != "" {
+		direct := cfg
+		direct.Signals = false
+		res, err := workload.Run(context.Background(), "upstream", func() (net.Conn, error) { return net.Dial("tcp", upstream) }, direct)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "upstream: %v\n", err)
+			return 1
+		}
+		results["upstream"] = res
+	}
+
+	if asJSON {
+		e := json.NewEncoder(stdout)
+		e.SetIndent("", "  ")
+		if err := e.Encode(results); err != nil {
+			_, _ = fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	}
+	_, _ = fmt.Fprintln(stdout, results["proxy"])
+	if direct, ok := results["upstream"]; ok {
+		proxied := results["proxy"]
+		_, _ = fmt.Fprintln(stdout, direct)
+		_, _ = fmt.Fprintf(stdout, "proxy overhead: p50 %v, p99 %v, throughput %+.1f%%\n",
+			overhead(proxied.P50, direct.P50), overhead(proxied.P99, direct.P99), 100*(proxied.Throughput-direct.Throughput)/direct.Throughput)
+	}
+	return 0
+}
+
+func overhead(proxied, direct time.Duration) string {
+	d := proxied - direct
+	if d >= 0 {
+		return "+" + d.String()
+	}
+	return d.String()
+}
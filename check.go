@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/coinbase/redisbetween/config"
+	"go.uber.org/zap"
+)
+
+// preflight is run by `redisbetween check`, and -check, instead of the proxy: it
+// checks that each upstream answers and passes its identity check, printing a
+// line for each, and returns the status to exit with, 1 if any of them failed
+func preflight(log *zap.Logger, c *config.Config, stdout io.Writer) int {
+	sd, proxies, err := proxies(c, log)
+	if err != nil {
+		_, _ = fmt.Fprintf(stdout, "FAIL %v\n", err)
+		return 1
+	}
+	defer func() { _ = sd.Close() }()
+	status := 0
+	for _, p := range proxies {
+		if err := p.Check(); err != nil {
+			_, _ = fmt.Fprintf(stdout, "FAIL %s: %v\n", p.Name(), err)
+			status = 1
+			continue
+		}
+		_, _ = fmt.Fprintf(stdout, "ok   %s\n", p.Name())
+	}
+	return status
+}
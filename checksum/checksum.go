@@ -0,0 +1,68 @@
+// Package checksum frames values with a CRC32C of their payload, for the
+// client helper to write them framed and the proxy, or the helper itself, to
+// verify them as they are written and read.
+//
+// A frame is a header followed by the payload: the magic bytes, a version and
+// the big-endian CRC32C of the payload. A value that doesn't start with the
+// magic bytes isn't framed, and is a payload as it is, so that the values
+// written before checksums, or without them, are read untouched.
+package checksum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Magic starts every framed value. Its NUL byte never starts text, nor a
+// protobuf message.
+var Magic = []byte{0x00, 'R', 'B', 'C'}
+
+// Version is the version of the frames Wrap makes, and the only one Unwrap reads
+const Version = 1
+
+// HeaderLen is the length of the header of a frame
+const HeaderLen = 4 + 1 + 4
+
+// ErrMismatch is the error of a frame whose payload isn't the one its checksum
+// was computed of
+var ErrMismatch = errors.New("checksum mismatch")
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+// Wrap returns payload framed with its checksum
+func Wrap(payload []byte) []byte {
+	v := make([]byte, HeaderLen+len(payload))
+	copy(v, Magic)
+	v[len(Magic)] = Version
+	binary.BigEndian.PutUint32(v[len(Magic)+1:], crc32.Checksum(payload, table))
+	copy(v[HeaderLen:], payload)
+	return v
+}
+
+// Framed is whether v starts with the magic bytes, and is read as a frame
+func Framed(v []byte) bool {
+	return bytes.HasPrefix(v, Magic)
+}
+
+// Unwrap returns the payload of v, and whether v was framed. A value that
+// isn't is its own payload. A frame cut short, of another version, or whose
+// payload doesn't match its checksum is an error.
+func Unwrap(v []byte) ([]byte, bool, error) {
+	if !Framed(v) {
+		return v, false, nil
+	}
+	if len(v) < HeaderLen {
+		return nil, true, fmt.Errorf("checksum frame of %d bytes is shorter than its header", len(v))
+	}
+	if version := v[len(Magic)]; version != Version {
+		return nil, true, fmt.Errorf("unknown checksum frame version %d", version)
+	}
+	payload := v[HeaderLen:]
+	if binary.BigEndian.Uint32(v[len(Magic)+1:]) != crc32.Checksum(payload, table) {
+		return nil, true, ErrMismatch
+	}
+	return payload, true, nil
+}
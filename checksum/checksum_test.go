@@ -0,0 +1,79 @@
+package checksum
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// randomPayload is a binary payload of a random size, empty one time in ten
+func randomPayload(r *rand.Rand) []byte {
+	if r.Intn(10) == 0 {
+		return []byte{}
+	}
+	p := make([]byte, r.Intn(4096))
+	r.Read(p)
+	return p
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		p := randomPayload(r)
+		v := Wrap(p)
+		assert.Len(t, v, HeaderLen+len(p))
+		assert.True(t, Framed(v))
+		got, framed, err := Unwrap(v)
+		assert.NoError(t, err)
+		assert.True(t, framed)
+		assert.True(t, bytes.Equal(p, got), "payload of %d bytes", len(p))
+
+		// a payload that is itself a frame is framed again, and read back whole
+		got, _, err = Unwrap(Wrap(v))
+		assert.NoError(t, err)
+		assert.Equal(t, v, got)
+	}
+}
+
+func TestUnwrapCorrupt(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 1000; i++ {
+		v := Wrap(randomPayload(r))
+		// a flipped bit of the checksum or payload is always caught, as CRC32C
+		// catches every single-bit error
+		bit := len(Magic)*8 + 8 + r.Intn((len(v)-len(Magic)-1)*8)
+		v[bit/8] ^= 1 << (bit % 8)
+		_, framed, err := Unwrap(v)
+		assert.True(t, framed)
+		assert.Equal(t, ErrMismatch, err, "bit %d of %d bytes", bit, len(v))
+	}
+
+	_, _, err := Unwrap(Wrap([]byte("v"))[:HeaderLen-1])
+	assert.EqualError(t, err, "checksum frame of 8 bytes is shorter than its header")
+	v := Wrap([]byte("v"))
+	v[len(Magic)] = 2
+	_, _, err = Unwrap(v)
+	assert.EqualError(t, err, "unknown checksum frame version 2")
+}
+
+func TestUnwrapUnframed(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 1000; i++ {
+		p := randomPayload(r)
+		if Framed(p) {
+			continue
+		}
+		got, framed, err := Unwrap(p)
+		assert.NoError(t, err)
+		assert.False(t, framed)
+		assert.True(t, bytes.Equal(p, got))
+	}
+	for _, p := range [][]byte{nil, {}, {0x00}, []byte("\x00RB"), []byte("RBC1"), []byte("plain")} {
+		got, framed, err := Unwrap(p)
+		assert.NoError(t, err)
+		assert.False(t, framed, "%q", p)
+		assert.Equal(t, p, got)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/coinbase/redisbetween/config"
+	"go.uber.org/zap"
+)
+
+// subcommand is a command of the redisbetween binary, run with the arguments
+// that follow its name and returning the process exit code
+type subcommand struct {
+	name    string
+	aliases []string
+	summary string
+	run     func(args []string, stdout, stderr io.Writer) int
+}
+
+// subcommands are the commands of the binary, in the order they are listed in
+// its help. serve is run when the first argument names none of them, so that
+// `redisbetween [OPTIONS] uri1 ...` keeps serving.
+var subcommands = []subcommand{
+	{name: "serve", summary: "Proxy the upstreams given as arguments (the default)", run: serve},
+	{name: "check", summary: "Check that each upstream answers and passes its identity check, then exit", run: checkUpstreams},
+	{name: "bench", summary: "Benchmark a running proxy's socket, and optionally its upstream", run: bench},
+	{name: "replay", aliases: []string{"replay-session"}, summary: "Replay a recorded client session against a target", run: replaySession},
+	{name: "config", summary: "Convert the upstreams given as arguments to a config file, checking nothing changes", run: configCommand},
+	{name: "migrate", summary: "Check where keys are placed by twemproxy pool configs before a cutover", run: migrate},
+	{name: "bundle", aliases: []string{"support-bundle"}, summary: "Download a support bundle from a running process's admin server", run: supportBundle},
+	{name: "version", summary: "Print the build and schema versions", run: version},
+}
+
+// runCLI runs the subcommand args start with, or serve with all of them
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	if len(args) > 0 {
+		if args[0] == "help" || args[0] == "-help" || args[0] == "--help" {
+			usage(stdout)
+			return 0
+		}
+		if s, ok := lookupSubcommand(args[0]); ok {
+			return s.run(args[1:], stdout, stderr)
+		}
+	}
+	return serve(args, stdout, stderr)
+}
+
+func lookupSubcommand(name string) (subcommand, bool) {
+	for _, s := range subcommands {
+		if s.name == name {
+			return s, true
+		}
+		for _, a := range s.aliases {
+			if a == name {
+				return s, true
+			}
+		}
+	}
+	return subcommand{}, false
+}
+
+// usage lists the subcommands
+func usage(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Usage: redisbetween [command] [OPTIONS] ...\n\nCommands:\n")
+	for _, s := range subcommands {
+		name := s.name
+		if len(s.aliases) > 0 {
+			name += " (" + strings.Join(s.aliases, ", ") + ")"
+		}
+		_, _ = fmt.Fprintf(w, "  %-28s %s\n", name, s.summary)
+	}
+	_, _ = fmt.Fprintf(w, "\nRun `redisbetween <command> -h` for the options of a command.\n")
+}
+
+// loadConfig parses the config of a subcommand that runs proxies, and sets up
+// logging as it says
+func loadConfig(name string, args []string, stderr io.Writer) (*config.Config, *zap.Logger, zap.AtomicLevel, bool) {
+	c, err := config.ParseArgs(name, args, stderr)
+	if err != nil {
+		return nil, nil, zap.AtomicLevel{}, false
+	}
+	log, level := newLogger(c.Level, c.Pretty)
+	return c, log, level, true
+}
+
+// serve implements `redisbetween serve`, which runs the proxies until the
+// process is signalled to stop. -check still runs the preflight instead.
+func serve(args []string, stdout, stderr io.Writer) int {
+	c, log, level, ok := loadConfig("serve", args, stderr)
+	if !ok {
+		return 2
+	}
+	if c.Check {
+		return preflight(log, c, stdout)
+	}
+	if urls := c.UpstreamArgs(); len(urls) > 0 {
+		log.Warn("Upstreams given as arguments are deprecated, convert them to a -config file with `redisbetween config convert`", zap.Int("upstreams", len(urls)))
+	}
+	if err := run(log, level, c); err != nil {
+		log.Panic("error", zap.Error(err))
+	}
+	return 0
+}
+
+// checkUpstreams implements `redisbetween check`, the preflight run with the
+// flags and upstreams of serve
+func checkUpstreams(args []string, stdout, stderr io.Writer) int {
+	c, log, _, ok := loadConfig("check", args, stderr)
+	if !ok {
+		return 2
+	}
+	return preflight(log, c, stdout)
+}
+
+// version implements `redisbetween version`, printing the build info the
+// support bundle includes
+func version(args []string, stdout, stderr io.Writer) int {
+	if len(args) > 0 {
+		_, _ = fmt.Fprintf(stderr, "Usage: redisbetween version\n")
+		return 2
+	}
+	info := buildInfo()
+	keys := make([]string, 0, len(info))
+	for k := range info {
+		// dependencies are left to the support bundle
+		if k != "deps" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(stdout, "%s: %v\n", k, info[k])
+	}
+	return 0
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"encoding"
+	"strings"
+
+	"github.com/coinbase/redisbetween/checksum"
+	"github.com/go-redis/redis/v8"
+)
+
+// ChecksumHook frames the values written by the SET, SETNX, SETEX, PSETEX,
+// GETSET, MSET and MSETNX run with it, of the keys starting with one of
+// Prefixes, or of every key without Prefixes, with a CRC32C of their payload,
+// for a proxy with those checksumprefixes to verify them on their way in and
+// out. Values that are neither strings, byte slices nor
+// encoding.BinaryMarshalers are written as they are, unframed. It can be added
+// to a client, or to a connection.
+type ChecksumHook struct {
+	Prefixes []string
+}
+
+// NewChecksumHook returns a ChecksumHook framing the values of the keys of
+// prefixes, to be added with AddHook
+func NewChecksumHook(prefixes ...string) *ChecksumHook {
+	return &ChecksumHook{Prefixes: prefixes}
+}
+
+func (h *ChecksumHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	h.wrap(cmd)
+	return ctx, nil
+}
+
+func (h *ChecksumHook) AfterProcess(context.Context, redis.Cmder) error {
+	return nil
+}
+
+func (h *ChecksumHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	for _, cmd := range cmds {
+		h.wrap(cmd)
+	}
+	return ctx, nil
+}
+
+func (h *ChecksumHook) AfterProcessPipeline(context.Context, []redis.Cmder) error {
+	return nil
+}
+
+// wrap frames the values cmd writes, in place
+func (h *ChecksumHook) wrap(cmd redis.Cmder) {
+	args := cmd.Args()
+	for _, kv := range valuePositions(cmd.Name(), len(args)) {
+		key, ok := args[kv[0]].(string)
+		if !ok || !h.matches(key) {
+			continue
+		}
+		if payload, ok := valueBytes(args[kv[1]]); ok {
+			args[kv[1]] = checksum.Wrap(payload)
+		}
+	}
+}
+
+func (h *ChecksumHook) matches(key string) bool {
+	if len(h.Prefixes) == 0 {
+		return true
+	}
+	for _, p := range h.Prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// valuePositions are the positions of the keys written by the command name of
+// n args, each followed by that of its value
+func valuePositions(name string, n int) [][2]int {
+	switch name {
+	case "set", "setnx", "getset":
+		if n >= 3 {
+			return [][2]int{{1, 2}}
+		}
+	case "setex", "psetex":
+		if n >= 4 {
+			return [][2]int{{1, 3}}
+		}
+	case "mset", "msetnx":
+		pairs := make([][2]int, 0, n/2)
+		for i := 1; i+1 < n; i += 2 {
+			pairs = append(pairs, [2]int{i, i + 1})
+		}
+		return pairs
+	}
+	return nil
+}
+
+// valueBytes is the payload of a value being written, if it is one the hook
+// frames
+func valueBytes(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), true
+	case []byte:
+		return v, true
+	case encoding.BinaryMarshaler:
+		b, err := v.MarshalBinary()
+		return b, err == nil
+	}
+	return nil, false
+}
+
+// NegotiateChecksums asks the proxy to relay the values of its checksumprefixes
+// keys to conn with their frames, rather than without, for Verify to verify
+// them once more on the client's side. It suits redis.Options.OnConnect. A
+// proxy that doesn't know PROXY CHECKSUM, or a server that isn't a proxy,
+// answers it with an error.
+func NegotiateChecksums(ctx context.Context, conn *redis.Conn) error {
+	cmd := redis.NewStatusCmd(ctx, "PROXY", "CHECKSUM", "ON")
+	_ = conn.Process(ctx, cmd)
+	return cmd.Err()
+}
+
+// Verify returns the payload of a value read, and verified against its
+// checksum if it is framed, or the value as it is if it isn't. It takes the
+// result of a read as it is given, e.g. Verify(rdb.Get(ctx, key).Bytes()).
+// A value that doesn't match its checksum is an error, checksum.ErrMismatch.
+func Verify(v []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	payload, _, err := checksum.Unwrap(v)
+	return payload, err
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coinbase/redisbetween/checksum"
+	redisproto "github.com/coinbase/redisbetween/redis"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStore keeps the values SET and MSET write, as GET and MGET read them,
+// and answers any other command with OK
+func fakeStore(t *testing.T, values map[string][]byte) string {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = li.Close() })
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				d := redisproto.NewDecoder(conn)
+				for {
+					m, err := d.Decode()
+					if err != nil {
+						return
+					}
+					r := redisproto.NewString([]byte("OK"))
+					mu.Lock()
+					switch strings.ToUpper(string(m.Array[0].Value)) {
+					case "SET":
+						values[string(m.Array[1].Value)] = m.Array[2].Value
+					case "MSET":
+						for i := 1; i+1 < len(m.Array); i += 2 {
+							values[string(m.Array[i].Value)] = m.Array[i+1].Value
+						}
+					case "GET":
+						r = redisproto.NewBulkBytes(values[string(m.Array[1].Value)])
+					}
+					mu.Unlock()
+					if err := redisproto.Encode(conn, r); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return li.Addr().String()
+}
+
+func TestChecksumHook(t *testing.T) {
+	values := make(map[string][]byte)
+	rdb := redis.NewClient(&redis.Options{Addr: fakeStore(t, values)})
+	defer func() { _ = rdb.Close() }()
+	rdb.AddHook(NewChecksumHook("blob:"))
+	ctx := context.Background()
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		payload := make([]byte, r.Intn(2048))
+		r.Read(payload)
+		if i%10 == 0 {
+			payload = []byte{}
+		}
+		assert.NoError(t, rdb.Set(ctx, "blob:a", payload, 0).Err())
+		assert.True(t, checksum.Framed(values["blob:a"]))
+		v, err := Verify(rdb.Get(ctx, "blob:a").Bytes())
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(payload, v), "payload of %d bytes", len(payload))
+	}
+
+	// the values of other keys are written as they are, and read as they are
+	_, err := rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		p.MSet(ctx, "blob:b", "framed", "plain", "as is")
+		p.MSet(ctx, "blob:c", 42)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, checksum.Wrap([]byte("framed")), values["blob:b"])
+	assert.Equal(t, []byte("as is"), values["plain"])
+	assert.Equal(t, []byte("42"), values["blob:c"], "numbers aren't framed")
+	v, err := Verify(rdb.Get(ctx, "plain").Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("as is"), v)
+
+	// a value read that doesn't match its checksum is an error, as is the read
+	values["blob:a"][len(values["blob:a"])-1] ^= 1
+	_, err = Verify(rdb.Get(ctx, "blob:a").Bytes())
+	assert.Equal(t, checksum.ErrMismatch, err)
+	_, err = Verify(rdb.Get(ctx, "missing").Bytes())
+	assert.Equal(t, redis.Nil, err)
+}
@@ -0,0 +1,120 @@
+// Package client helps go-redis applications make use of redisbetween.
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Timings are the proxy's timings of a command, or of a pipeline, as PROXY
+// LASTSTATS replies with them: the time spent in the proxy outside of the round
+// trips to the upstream, the time those took, and the node of the last one
+type Timings struct {
+	ProxyWait   time.Duration
+	UpstreamRTT time.Duration
+	Node        string
+}
+
+type timingsKey struct{}
+
+// lastStatsKey marks the context of the PROXY LASTSTATS a TimingsHook sends, so
+// that it isn't asked for the timings of its own
+type lastStatsKey struct{}
+
+// WithTimings returns a context that the commands run with it on a connection
+// with a TimingsHook record their timings in, along with the Timings they are
+// recorded in
+func WithTimings(ctx context.Context) (context.Context, *Timings) {
+	t := &Timings{}
+	return context.WithValue(ctx, timingsKey{}, t), t
+}
+
+// TimingsHook asks the proxy for the timings of each command and pipeline run
+// on a connection, once answered, with a PROXY LASTSTATS sent over the same
+// one, since the proxy keeps them for each client connection. It must be added
+// to the connection it is made for. The timings are recorded in the Timings of
+// the command's context, if it was made by WithTimings, and passed to
+// OnTimings, if set. A proxy that doesn't know PROXY LASTSTATS, or a server
+// that isn't a proxy, leaves them unrecorded, and the commands unaffected.
+type TimingsHook struct {
+	conn      *redis.Conn
+	OnTimings func(ctx context.Context, cmds []redis.Cmder, t Timings)
+}
+
+// NewTimingsHook returns a TimingsHook for conn, to be added to it with
+// conn.AddHook
+func NewTimingsHook(conn *redis.Conn) *TimingsHook {
+	return &TimingsHook{conn: conn}
+}
+
+func (h *TimingsHook) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *TimingsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.record(ctx, []redis.Cmder{cmd})
+	return nil
+}
+
+func (h *TimingsHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *TimingsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	h.record(ctx, cmds)
+	return nil
+}
+
+// record asks the proxy for the timings of cmds, unless they are its own PROXY
+// LASTSTATS
+func (h *TimingsHook) record(ctx context.Context, cmds []redis.Cmder) {
+	if ctx.Value(lastStatsKey{}) != nil {
+		return
+	}
+	own := context.WithValue(ctx, lastStatsKey{}, true)
+	laststats := redis.NewCmd(own, "PROXY", "LASTSTATS")
+	_ = h.conn.Process(own, laststats)
+	reply, err := laststats.Result()
+	if err != nil {
+		return
+	}
+	t, err := parseLastStats(reply)
+	if err != nil {
+		return
+	}
+	if dst, ok := ctx.Value(timingsKey{}).(*Timings); ok {
+		*dst = t
+	}
+	if h.OnTimings != nil {
+		h.OnTimings(ctx, cmds, t)
+	}
+}
+
+// parseLastStats reads the name value pairs of a PROXY LASTSTATS reply
+func parseLastStats(reply interface{}) (Timings, error) {
+	var t Timings
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields)%2 != 0 {
+		return t, fmt.Errorf("unexpected PROXY LASTSTATS reply %v", reply)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		name, _ := fields[i].(string)
+		switch v := fields[i+1].(type) {
+		case int64:
+			switch name {
+			case "proxy_wait_us":
+				t.ProxyWait = time.Duration(v) * time.Microsecond
+			case "upstream_rtt_us":
+				t.UpstreamRTT = time.Duration(v) * time.Microsecond
+			}
+		case string:
+			if name == "node" {
+				t.Node = v
+			}
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	redisproto "github.com/coinbase/redisbetween/redis"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProxy answers PROXY LASTSTATS with the timings of a request, counting
+// them, and any other command with OK
+func fakeProxy(t *testing.T, laststats *int32) string {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = li.Close() })
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				d := redisproto.NewDecoder(conn)
+				for {
+					m, err := d.Decode()
+					if err != nil {
+						return
+					}
+					r := redisproto.NewString([]byte("OK"))
+					if len(m.Array) == 2 && strings.ToUpper(string(m.Array[1].Value)) == "LASTSTATS" {
+						atomic.AddInt32(laststats, 1)
+						r = redisproto.NewArray([]*redisproto.Message{
+							redisproto.NewBulkBytes([]byte("proxy_wait_us")), redisproto.NewInt([]byte("120")),
+							redisproto.NewBulkBytes([]byte("upstream_rtt_us")), redisproto.NewInt([]byte("850")),
+							redisproto.NewBulkBytes([]byte("node")), redisproto.NewBulkBytes([]byte("10.0.0.1:6379")),
+						})
+					}
+					if err := redisproto.Encode(conn, r); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return li.Addr().String()
+}
+
+func TestTimingsHook(t *testing.T) {
+	var laststats int32
+	rdb := redis.NewClient(&redis.Options{Addr: fakeProxy(t, &laststats)})
+	defer func() { _ = rdb.Close() }()
+	conn := rdb.Conn(context.Background())
+	defer func() { _ = conn.Close() }()
+	hook := NewTimingsHook(conn)
+	var seen []string
+	hook.OnTimings = func(ctx context.Context, cmds []redis.Cmder, t Timings) {
+		seen = append(seen, cmds[0].Name())
+	}
+	conn.AddHook(hook)
+
+	ctx, timings := WithTimings(context.Background())
+	assert.NoError(t, conn.Set(ctx, "k", "v", 0).Err())
+	assert.Equal(t, Timings{ProxyWait: 120000, UpstreamRTT: 850000, Node: "10.0.0.1:6379"}, *timings)
+
+	_, err := conn.Pipelined(context.Background(), func(p redis.Pipeliner) error {
+		p.Set(context.Background(), "a", "1", 0)
+		p.Set(context.Background(), "b", "2", 0)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"set", "set"}, seen, "once for the command and once for the pipeline")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&laststats), "never for its own PROXY LASTSTATS")
+}
+
+func TestTimingsHookWithoutAProxy(t *testing.T) {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = li.Close() }()
+	go func() {
+		conn, err := li.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		d := redisproto.NewDecoder(conn)
+		for {
+			m, err := d.Decode()
+			if err != nil {
+				return
+			}
+			r := redisproto.NewString([]byte("OK"))
+			if strings.ToUpper(string(m.Array[0].Value)) == "PROXY" {
+				r = redisproto.NewError([]byte("ERR unknown command 'PROXY'"))
+			}
+			_ = redisproto.Encode(conn, r)
+		}
+	}()
+	rdb := redis.NewClient(&redis.Options{Addr: li.Addr().String()})
+	defer func() { _ = rdb.Close() }()
+	conn := rdb.Conn(context.Background())
+	defer func() { _ = conn.Close() }()
+	conn.AddHook(NewTimingsHook(conn))
+
+	ctx, timings := WithTimings(context.Background())
+	assert.NoError(t, conn.Set(ctx, "k", "v", 0).Err())
+	assert.Equal(t, Timings{}, *timings)
+}
@@ -6,28 +6,190 @@ import (
 	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/coinbase/redisbetween/memwatch"
+	"github.com/coinbase/redisbetween/netaddr"
+	"github.com/coinbase/redisbetween/session"
 )
 
 const defaultStatsdAddress = "localhost:8125"
 
+// DefaultWarmupConcurrency is the default number of pool warmup dials in flight
+// across all upstreams
+const DefaultWarmupConcurrency = 64
+
+// DefaultShutdownTimeout and DefaultDrainTimeout bound a graceful shutdown as a
+// whole, and the part of it spent waiting for client connections to finish
+const (
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultDrainTimeout    = 10 * time.Second
+)
+
+// DefaultProgressTimeout is how long a client has to send each message of a
+// request once it has started
+const DefaultProgressTimeout = 10 * time.Second
+
+// DefaultReadyTimeout is how long /readyz waits for the upstreams' PINGs
+const DefaultReadyTimeout = time.Second
+
 var validNetworks = []string{"tcp", "tcp4", "tcp6", "unix", "unixpacket"}
 
 type Config struct {
-	Network           string
-	LocalSocketPrefix string
-	LocalSocketSuffix string
-	Unlink            bool
-	MinPoolSize       uint64
-	MaxPoolSize       uint64
-	Pretty            bool
-	Statsd            string
-	Level             zapcore.Level
-	Upstreams         []Upstream
+	Network            string
+	LocalSocketPrefix  string
+	LocalSocketSuffix  string
+	Unlink             bool
+	SocketMode         os.FileMode
+	SocketGroup        string
+	MinPoolSize        uint64
+	MaxPoolSize        uint64
+	Pretty             bool
+	Statsd             string
+	Level              zapcore.Level
+	AdminAddress       string
+	AdminAuth          AdminAuth
+	AdminPprof         bool
+	ReadyTimeout       time.Duration
+	DeprecatedClients  *regexp.Regexp
+	StateFile          string
+	IgnoreRuntimeState bool
+	EnrichACLErrors    bool
+	PlainErrors        bool
+	CrashOnPanic       bool
+	TraceSampleRate    float64
+	AccessLog          AccessLog
+	SessionDir         string
+	SessionMaxBytes    int64
+	SessionMaxFiles    int
+	DiscoveryFile      string
+	WarmupConcurrency  int
+	ShutdownTimeout    time.Duration
+	DrainTimeout       time.Duration
+	DrainNotify        bool
+	FirstByteTimeout   time.Duration
+	ProgressTimeout    time.Duration
+	IdleTimeout        time.Duration
+	MemorySoftLimit    memwatch.Limit
+	MemoryHardLimit    memwatch.Limit
+	MemoryShedBytes    int
+	ClientAuth         ClientAuth
+	AllowSwapDB        bool
+	AllowConfigWrites  bool
+	Check              bool
+	Watchdog           Watchdog
+	StaggeredReload    StaggeredReload
+	Registrar          Registrar
+	ConnectionBudget   ConnectionBudget
+	ConfigFile         string
+	Upstreams          []Upstream
+
+	// args are the upstream URLs given as arguments, for ReloadUpstreams
+	args []string
+}
+
+// Connection budget policies, how the ceiling is shared between pools
+const (
+	BudgetProportional = "proportional"
+	BudgetDemand       = "demand"
+)
+
+// ConnectionBudget caps the upstream connections of the whole process at
+// Ceiling, shared between pools by Policy. A connection that can't get a slot
+// within Wait fails. It is disabled if Ceiling is 0.
+type ConnectionBudget struct {
+	Ceiling int
+	Policy  string
+	Wait    time.Duration
+}
+
+// Registrar backends listeners can be registered with
+const (
+	RegistrarConsul = "consul"
+)
+
+// Registrar configures registering each listener with a service discovery
+// Backend at Address, with a health check of TTL. It is disabled if Backend is
+// empty.
+type Registrar struct {
+	Backend string
+	Address string
+	TTL     time.Duration
+}
+
+// AccessLog configures the access log, which is written to Path, a file or
+// stderr or stdout, unless it is empty: a SampleRate of the requests answered
+// are logged, and with Errors, every one answered with an error, with the first
+// KeyBytes bytes of their first key.
+type AccessLog struct {
+	Path       string
+	SampleRate float64
+	Errors     bool
+	KeyBytes   int
+}
+
+// Watchdog configures the heartbeats the process sends its own sockets to
+// detect that it stopped answering. It is disabled if Interval is 0.
+type Watchdog struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Failures int
+	ExitCode int
+}
+
+// StaggeredReload spreads out the reloads of a fleet of proxies pushed a new
+// config at once. A reload received on SIGHUP is applied after a delay of up
+// to Jitter, derived from the host name with ByHost so that it is the same on
+// every push, and the new proxy of a changed upstream waits up to Prewarm for
+// its pools to open their minpoolsize connections before it takes over. Both
+// are disabled if 0.
+type StaggeredReload struct {
+	Jitter  time.Duration
+	ByHost  bool
+	Prewarm time.Duration
+}
+
+// Auth providers clients can be authenticated with
+const (
+	AuthStatic = "static"
+	AuthFile   = "file"
+	AuthHTTP   = "http"
+)
+
+// ClientAuth configures authenticating the proxy's clients, with the Users
+// given, the bcrypt File, or the verifier at URL. It is disabled if Provider
+// is empty.
+type ClientAuth struct {
+	Provider    string
+	Users       map[string]string
+	File        string
+	URL         string
+	Timeout     time.Duration
+	Retries     int
+	CacheTTL    time.Duration
+	NegativeTTL time.Duration
+	FailOpen    bool
+}
+
+// AdminAuth configures authenticating the admin server's clients, with the
+// bearer Token, a certificate signed by ClientCA, or either, and the file its
+// mutations are audited to. The server is served over TLS with TLSCert.
+type AdminAuth struct {
+	Token     string
+	TLSCert   string
+	TLSKey    string
+	ClientCA  string
+	Reads     bool
+	AuditFile string
 }
 
 type Upstream struct {
@@ -38,6 +200,321 @@ type Upstream struct {
 	Database           int
 	ReadTimeout        time.Duration
 	WriteTimeout       time.Duration
+	Retries            int
+	RetryBudget        float64
+	ReservedPoolSize   int
+	BlockingPoolSize   int
+	PubSubPoolSize     int
+	RESP3PoolSize      int
+	PubSubBuffer       PubSubBuffer
+	PinTransactions    bool
+	TransactionIdle    time.Duration
+	CriticalCommands   []string
+	CriticalPrefixes   []string
+	SplitThreshold     int
+	SplitChunkSize     int
+	SplitParallelism   int
+	ReadOnly           bool
+	ReadOnlyScripts    string
+	BreakerErrorRate   float64
+	BreakerLatency     time.Duration
+	BreakerMinRequests int
+	BreakerWindow      time.Duration
+	BreakerCooldown    time.Duration
+	BreakerFailures    int
+	BreakerPing        bool
+	MaxInFlight        int
+	ConnectRate        float64
+	ConnectBurst       int
+	ConnectWarnAfter   time.Duration
+	WriteBehind        WriteBehind
+	ReadThrough        ReadThrough
+	Topology           Topology
+	StrictValidation   bool
+	SLOs               []SLO
+	SLOMinSamples      int
+	CommandMixTop      int
+	CommandMetrics     []string
+	AllowCommands      []string
+	DenyCommands       []string
+	Segments           Segments
+	DynamicDB          bool
+	MaxDBs             int
+	DBIdleTimeout      time.Duration
+	ServerLatency      time.Duration
+	PoolHealInterval   time.Duration
+	MaxConnIdleTime    time.Duration
+	IdlePingInterval   time.Duration
+	ErrorRewrite       string
+	TopologyRewrite    bool
+	FairCheckout       bool
+	FairHold           int
+	ConfigGetForward   bool
+	AtomicMaxCommands  int
+	PipelineReadahead  int
+	StreamThreshold    int
+	StreamMaxBytes     int
+	ChecksumPrefixes   []string
+	MaxClients         int
+	MaxClientsClose    bool
+	SocketMode         os.FileMode
+	SocketGroup        string
+	Identity           Identity
+	Scripts            Scripts
+	Hotspots           Hotspots
+	SlowLog            SlowLog
+	Credentials        Credentials
+	TLS                TLS
+	ReadFallback       ReadFallback
+	Coalesce           Coalesce
+	TTLPolicy          TTLPolicy
+	NegativeCache      NegativeCache
+	PoolAdvisor        PoolAdvisor
+	Mirror             Mirror
+	Warnings           Warnings
+
+	// IgnorePipelineSignals is set by pipelinesignals=false, so that the zero
+	// value reads the signals
+	IgnorePipelineSignals bool
+}
+
+// TTLPolicy caps the TTLs of the keys of the namespaces of its ttlnamespace
+// params. Persist is what is done with a PERSIST of such a key, reject or
+// expire, and FollowUp is whether the keys created by writes that can't set an
+// expiry are given one with an EXPIRE.
+type TTLPolicy struct {
+	Namespaces []TTLNamespace
+	Persist    string
+	FollowUp   bool
+}
+
+// TTLNamespace is a ttlnamespace param, "prefix,maxttl", the keys starting with
+// the prefix never living longer than maxttl
+type TTLNamespace struct {
+	Prefix string
+	MaxTTL time.Duration
+}
+
+// Coalesce configures the coalescing of identical concurrent reads. At most
+// MaxKeys reads are in flight for others to join at once, and reads encoding to
+// more than MaxBytes are sent on their own.
+type Coalesce struct {
+	Enabled  bool
+	MaxKeys  int
+	MaxBytes int
+}
+
+// NegativeCache remembers, for TTL, the keys starting with one of Prefixes
+// that reads found missing, for the same reads to be answered without a round
+// trip. The keys it remembers take at most MaxBytes. It is only sound if the
+// keys are written through this proxy alone, which Exclusive acknowledges.
+type NegativeCache struct {
+	Prefixes  []string
+	TTL       time.Duration
+	MaxBytes  int
+	Exclusive bool
+}
+
+// Warnings is whether advisory messages are attached to client connections,
+// at most one of a type per Interval, with Signals those of the connections
+// that pipeline with the deprecated signals
+type Warnings struct {
+	Enabled  bool
+	Interval time.Duration
+	Signals  bool
+}
+
+// PoolAdvisor is whether the utilization of the upstream's pools is observed,
+// their connections in use being sampled every Sample, to recommend their
+// sizes, the largest being Headroom above the 99.9th percentile in use
+type PoolAdvisor struct {
+	Enabled  bool
+	Headroom float64
+	Sample   time.Duration
+}
+
+// Mirror is the address of a shadow upstream that the upstream's writes, or
+// All its commands, are copied to in the background, over a pool of its own of
+// up to PoolSize connections for each node, at most Queue requests waiting to
+// be sent. Its connections are authenticated with the Credentials of its
+// mirrorcredentialsfile, if it has one. With Compare, the replies of the
+// mirror are compared with the upstream's.
+type Mirror struct {
+	Address     string
+	All         bool
+	Compare     bool
+	Queue       int
+	PoolSize    int
+	Credentials Credentials
+}
+
+// ReadFallback names the upstream, by label or address, that reads failing on
+// this one are retried against, along with the key prefixes whose nil replies
+// are retried there too
+type ReadFallback struct {
+	Upstream    string
+	NilPrefixes []string
+}
+
+// TLS configures the TLS upstream connections are made over. The upstream's
+// certificate is verified against the CAs of CAFile, or the system's if it is
+// empty, for ServerName, and CertFile and KeyFile are the certificate the proxy
+// authenticates with if the upstream asks for one.
+type TLS struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// Credentials are what the proxy authenticates its upstream connections with,
+// taken from the userinfo of the upstream URL or its credentialsfile. User is empty
+// for the default user, and Password is empty if the proxy doesn't
+// authenticate.
+type Credentials struct {
+	User     string
+	Password string
+}
+
+// Enabled is whether upstream connections are authenticated
+func (c Credentials) Enabled() bool {
+	return c.Password != ""
+}
+
+// Scripts configures the accounting and limits of Lua scripts. Scripts over an
+// in-flight cap wait up to Wait before they are shed, and those that take
+// longer than Slow are logged, unless it is 0.
+type Scripts struct {
+	Limits     []ScriptLimit
+	Wait       time.Duration
+	Slow       time.Duration
+	MaxTracked int
+}
+
+// Hotspots configures the detection of slots that take too much of an
+// upstream's traffic, enabled by setting Sample, and the rejection of writes to
+// keys whose hash tag matches one of Banned
+type Hotspots struct {
+	Sample     int
+	Share      float64
+	Window     time.Duration
+	MinSamples int
+	Banned     []string
+}
+
+// PubSubBuffer configures the messages pushed to a slow subscriber that wait to
+// be written to it: over MaxBytes of them, or one older than MaxAge unless it
+// is 0, and Overflow disconnects the subscriber, drops the oldest, or stops
+// reading its pinned connection until it catches up
+type PubSubBuffer struct {
+	MaxBytes int
+	MaxAge   time.Duration
+	Overflow string
+}
+
+// SlowLog configures logging the upstream round trips that take longer than
+// Threshold, unless it is 0, with the first KeyBytes bytes of their first key,
+// left out for the keys matching one of Redact
+type SlowLog struct {
+	Threshold time.Duration
+	KeyBytes  int
+	Redact    []string
+}
+
+// ScriptLimit is a scriptlimit param, "script,rate,inflight", the script being
+// * for every script, a SHA or the name a script gives itself
+type ScriptLimit struct {
+	Script   string
+	Rate     float64
+	InFlight int
+}
+
+// Segments configures the partitioning of each node's pool between classes of
+// requests. It is enabled by setting List.
+type Segments struct {
+	List   []Segment
+	Borrow bool
+	Wait   time.Duration
+}
+
+// Segment is one of the poolsegments, with the commands and key prefixes of its
+// segmentcommands and segmentprefixes params. Share is a fraction of the pool.
+type Segment struct {
+	Name     string
+	Share    float64
+	Commands []string
+	Prefixes []string
+}
+
+// SLO is an slo param, "name,class,threshold,objective", the objective being a
+// percentage
+type SLO struct {
+	Name      string
+	Class     string
+	Threshold time.Duration
+	Objective float64
+}
+
+// Topology configures sharing cluster topology observations with the other
+// instances in front of the same cluster, through a shared Key, Peers' admin
+// servers, or both. It is disabled if neither is set.
+type Topology struct {
+	Key   string
+	Peers []string
+	Poll  time.Duration
+}
+
+// Identity policies, what the proxy does with an upstream that fails its
+// identity check
+const (
+	IdentityFailFast = "failfast"
+	IdentityDegraded = "degraded"
+)
+
+// Identity configures checking that an upstream is the redis it is meant to be,
+// at startup and every Interval: that its __redisbetween_identity__ key holds
+// Key, that each of its INFO fields in Info starts with the prefix given, and
+// that it is in cluster mode or not, as Mode says. It is disabled if none of
+// them is set.
+type Identity struct {
+	Key      string
+	Info     map[string]string
+	Mode     string
+	Policy   string
+	Interval time.Duration
+}
+
+// Enabled is whether the upstream's identity is checked
+func (i Identity) Enabled() bool {
+	return i.Key != "" || len(i.Info) > 0 || i.Mode != ""
+}
+
+// ReadThrough configures the read-through of GET misses. It is enabled by
+// setting Rules.
+type ReadThrough struct {
+	Rules       []ReadThroughRule
+	Concurrency int
+	Timeout     time.Duration
+	MaxBytes    int64
+}
+
+// ReadThroughRule is a readthrough param, "prefix,endpoint,ttl"
+type ReadThroughRule struct {
+	Prefix   string
+	Endpoint string
+	TTL      time.Duration
+}
+
+// WriteBehind configures the write-behind of counter increments. It is enabled
+// by setting Prefixes.
+type WriteBehind struct {
+	Prefixes   []string
+	Interval   time.Duration
+	FlushKeys  int
+	MaxPending int
+	Reply      string
 }
 
 func ParseFlags() *Config {
@@ -59,28 +536,140 @@ func validNetwork(network string) bool {
 	return false
 }
 
+// parseSocketMode parses the octal file mode of socketmode, 0 if it is empty
+func parseSocketMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid socketmode %s, it must be an octal mode like 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
+
 func parseFlags() (*Config, error) {
 	flag.Usage = func() {
 		fmt.Printf("Usage: %s [OPTIONS] uri1 [uri2] ...\n", os.Args[0])
 		flag.PrintDefaults()
 	}
+	return parseFlagSet(flag.CommandLine, os.Args[1:])
+}
+
+// ParseArgs parses the flags and upstream URIs of the command named name from
+// args, printing its usage to output if they are invalid
+func ParseArgs(name string, args []string, output io.Writer) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	shown := false
+	fs.Usage = func() {
+		shown = true
+		_, _ = fmt.Fprintf(output, "Usage: redisbetween %s [OPTIONS] uri1 [uri2] ...\n", name)
+		fs.PrintDefaults()
+	}
+	c, err := parseFlagSet(fs, args)
+	// the flag set has printed the usage along with flags it couldn't parse
+	if err != nil && !shown {
+		_, _ = fmt.Fprintf(output, "Error: %v\n", err)
+		fs.Usage()
+	}
+	return c, err
+}
+
+// parseFlagSet registers the flags of the proxy on fs and parses args with it
+func parseFlagSet(fs *flag.FlagSet, args []string) (*Config, error) {
 
-	var network, localSocketPrefix, localSocketSuffix, stats, loglevel string
-	var pretty, unlink bool
-	flag.StringVar(&network, "network", "unix", "One of: tcp, tcp4, tcp6, unix or unixpacket")
-	flag.StringVar(&localSocketPrefix, "localsocketprefix", "/var/tmp/redisbetween-", "Prefix to use for unix socket filenames")
-	flag.StringVar(&localSocketSuffix, "localsocketsuffix", ".sock", "Suffix to use for unix socket filenames")
-	flag.BoolVar(&unlink, "unlink", false, "Unlink existing unix sockets before listening")
-	flag.StringVar(&stats, "statsd", defaultStatsdAddress, "Statsd address")
-	flag.BoolVar(&pretty, "pretty", false, "Pretty print logging")
-	flag.StringVar(&loglevel, "loglevel", "info", "One of: debug, info, warn, error, dpanic, panic, fatal")
+	var network, localSocketPrefix, localSocketSuffix, stats, loglevel, adminAddress, deprecatedClients, stateFile, discoveryFile, sessionDir, memorySoftLimit, memoryHardLimit, authUsers, configFile, socketMode, socketGroup string
+	var pretty, unlink, ignoreRuntimeState, enrichACLErrors, plainErrors, allowSwapDB, allowConfigWrites, drainNotify, check, adminPprof, crashOnPanic bool
+	var warmupConcurrency, sessionMaxFiles, memoryShedBytes int
+	var sessionMaxBytes int64
+	var shutdownTimeout, drainTimeout, firstByteTimeout, progressTimeout, idleTimeout, readyTimeout time.Duration
+	var clientAuth ClientAuth
+	var adminAuth AdminAuth
+	var watchdog Watchdog
+	var staggered StaggeredReload
+	var registrar Registrar
+	var budget ConnectionBudget
+	var traceSampleRate float64
+	var accessLog AccessLog
+	fs.StringVar(&network, "network", "unix", "One of: tcp, tcp4, tcp6, unix or unixpacket")
+	fs.StringVar(&localSocketPrefix, "localsocketprefix", "/var/tmp/redisbetween-", "Prefix to use for unix socket filenames")
+	fs.StringVar(&localSocketSuffix, "localsocketsuffix", ".sock", "Suffix to use for unix socket filenames")
+	fs.BoolVar(&unlink, "unlink", false, "Unlink existing unix sockets before listening, or take over those a running instance listens on with PROXY HANDOFF")
+	fs.StringVar(&socketMode, "socketmode", "", "File mode of the unix sockets, in octal, e.g. 0660, set before clients can connect to them. Left world accessible if empty")
+	fs.StringVar(&socketGroup, "socketgroup", "", "Group owning the unix sockets, set before clients can connect to them. Left as the process's if empty")
+	fs.StringVar(&stats, "statsd", defaultStatsdAddress, "Statsd address")
+	fs.BoolVar(&pretty, "pretty", false, "Pretty print logging")
+	fs.StringVar(&loglevel, "loglevel", "info", "One of: debug, info, warn, error, dpanic, panic, fatal")
+	fs.StringVar(&adminAddress, "adminaddr", "", "Address for the admin HTTP server, e.g. localhost:8080. Disabled if empty")
+	fs.StringVar(&adminAuth.Token, "admintoken", "", "Bearer token the admin server's clients authenticate with, required of mutating routes. Disabled if empty")
+	fs.StringVar(&adminAuth.TLSCert, "admintlscert", "", "Certificate the admin server is served over TLS with, along with admintlskey. Plain HTTP if empty")
+	fs.StringVar(&adminAuth.TLSKey, "admintlskey", "", "Private key of admintlscert")
+	fs.StringVar(&adminAuth.ClientCA, "adminclientca", "", "CA certificates the admin server's clients may authenticate with a certificate signed by, instead of admintoken. Needs admintlscert")
+	fs.BoolVar(&adminAuth.Reads, "adminauthreads", false, "Authenticate the admin server's read-only routes too, not only those that mutate")
+	fs.BoolVar(&adminPprof, "adminpprof", false, "Serve the net/http/pprof profiles on the admin server, under /debug/pprof/")
+	fs.DurationVar(&readyTimeout, "readytimeout", DefaultReadyTimeout, "How long the admin server's /readyz waits for each upstream to answer a PING through its pool")
+	fs.StringVar(&adminAuth.AuditFile, "adminauditfile", "", "File a JSON line is appended to for each mutation made through the admin server, on top of the one logged. Disabled if empty")
+	fs.StringVar(&deprecatedClients, "deprecatedclients", "", "Regexp matched against the lib-name/lib-ver clients announce with CLIENT SETINFO. Matching clients are logged as deprecated")
+	fs.StringVar(&configFile, "config", "", "YAML file of upstreams, served along with those given as arguments, which replace the file's for the same address and db")
+	fs.StringVar(&stateFile, "statefile", "", "File that runtime overrides set through the admin server are persisted to, and restored from at startup. Disabled if empty")
+	fs.BoolVar(&ignoreRuntimeState, "ignore-runtime-state", false, "Start from the config alone, discarding overrides in the state file")
+	fs.StringVar(&discoveryFile, "discoveryfile", "", "JSON file listing the socket of each upstream, kept up to date as listeners start and stop. Defaults to <localsocketprefix>sockets.json")
+	fs.IntVar(&budget.Ceiling, "maxupstreamconns", 0, "Maximum number of upstream connections open at once across all pools of the process, shared between them by upstreamconnpolicy. Disabled if 0")
+	fs.StringVar(&budget.Policy, "upstreamconnpolicy", BudgetProportional, "How maxupstreamconns is shared between pools: proportional to their maxpoolsize, or demand, to the connections they hold and wait for")
+	fs.DurationVar(&budget.Wait, "upstreamconnwait", time.Second, "How long a new upstream connection waits for a slot of maxupstreamconns before it fails")
+	fs.IntVar(&warmupConcurrency, "warmupconcurrency", DefaultWarmupConcurrency, "Maximum number of connections being opened at once to warm up pools, across all upstreams")
+	fs.DurationVar(&shutdownTimeout, "shutdowntimeout", DefaultShutdownTimeout, "Hard deadline for a graceful shutdown, after which connections are force closed and the process exits with status 1")
+	fs.DurationVar(&drainTimeout, "draintimeout", DefaultDrainTimeout, "How long a graceful shutdown waits for in-flight commands to finish before force closing client connections")
+	fs.BoolVar(&drainNotify, "drainnotify", false, "Answer clients in the middle of sending a pipeline with PROXYMAINT as a graceful shutdown starts, instead of waiting for the pipeline to complete")
+	fs.DurationVar(&firstByteTimeout, "clientfirstbytetimeout", 0, "How long a new client connection may go without sending anything before it is closed, longer than clientprogresstimeout. Disabled if 0")
+	fs.DurationVar(&progressTimeout, "clientprogresstimeout", DefaultProgressTimeout, "How long a client has to send each message of a command or pipeline once it has started, before it is answered with a protocol error and closed. Disabled if 0")
+	fs.DurationVar(&idleTimeout, "clientidletimeout", 0, "How long a client connection may go without sending a command, once it has sent one, before it is closed. Disabled if 0")
+	fs.BoolVar(&enrichACLErrors, "enrichaclerrors", false, "Add the upstream address and user to NOPERM and WRONGPASS errors returned by upstream ACLs")
+	fs.Float64Var(&traceSampleRate, "tracesamplerate", 0, "Fraction of requests, between 0 and 1, whose routing decisions are traced for the admin server's /traces")
+	fs.StringVar(&accessLog.Path, "accesslog", "", "File each request answered is logged to as a JSON line, or stderr or stdout, apart from the operational log. Disabled if empty")
+	fs.Float64Var(&accessLog.SampleRate, "accesslogsamplerate", 1, "Fraction of requests, between 0 and 1, logged to accesslog")
+	fs.BoolVar(&accessLog.Errors, "accesslogerrors", true, "Log every request answered with an error to accesslog, sampled or not")
+	fs.IntVar(&accessLog.KeyBytes, "accesslogkeybytes", 32, "Bytes of the first key of each request logged to accesslog, the rest being cut")
+	fs.StringVar(&sessionDir, "sessiondir", "", "Directory that client sessions armed through the admin server's /sessions are recorded to. Disabled if empty")
+	fs.Int64Var(&sessionMaxBytes, "sessionmaxbytes", session.DefaultMaxBytes, "Size after which a session recording stops")
+	fs.IntVar(&sessionMaxFiles, "sessionmaxfiles", session.DefaultMaxFiles, "Number of session files kept in sessiondir, the oldest being removed first")
+	fs.BoolVar(&plainErrors, "plainerrors", false, "Answer with plain ERR errors instead of prefixing the errors the proxy returns itself with a PROXY* code, for clients that choke on unknown error prefixes")
+	fs.BoolVar(&crashOnPanic, "crashonpanic", false, "Crash on a panic in a client connection or background task, as without recovery, instead of closing the client connection or skipping the task. For development")
+	fs.BoolVar(&allowSwapDB, "allowswapdb", false, "Forward SWAPDB, which swaps databases under every client of the upstream, instead of rejecting it")
+	fs.BoolVar(&allowConfigWrites, "allowconfigwrites", false, "Forward CONFIG SET, CONFIG REWRITE and CONFIG RESETSTAT, which change the upstream under every client, instead of rejecting them")
+	fs.BoolVar(&check, "check", false, "Check that each upstream can be reached and passes its identity check, then exit with status 0 if they all do, or 1")
+	fs.StringVar(&memorySoftLimit, "memorysoftlimit", "", "Memory usage above which large requests are shed and garbage is collected more aggressively. Bytes, with an optional k, m or g suffix, or a fraction of the cgroup memory limit such as 0.8. Disabled if empty")
+	fs.StringVar(&memoryHardLimit, "memoryhardlimit", "", "Memory usage above which new connections are refused and every request is shed, in the same format as memorysoftlimit. Disabled if empty")
+	fs.IntVar(&memoryShedBytes, "memoryshedbytes", memwatch.DefaultShedBytes, "Size of the requests shed above memorysoftlimit")
+	fs.StringVar(&clientAuth.Provider, "authprovider", "", "How clients are authenticated with AUTH before any other command is accepted. One of: static, file or http. Disabled if empty")
+	fs.StringVar(&authUsers, "authusers", "", "Comma separated user:password pairs the static auth provider accepts")
+	fs.StringVar(&clientAuth.File, "authfile", "", "File of user:bcrypthash[:tenant] lines the file auth provider accepts, reloaded when it changes")
+	fs.StringVar(&clientAuth.URL, "authurl", "", "URL the http auth provider POSTs each username and credential to")
+	fs.DurationVar(&clientAuth.Timeout, "authtimeout", time.Second, "How long an AUTH waits for the auth provider, and each attempt of the http provider's verifier, before failing")
+	fs.IntVar(&clientAuth.Retries, "authretries", 1, "Number of times the http auth provider retries a verification that failed without a verdict")
+	fs.DurationVar(&clientAuth.CacheTTL, "authcachettl", time.Minute, "How long the http auth provider remembers an accepted credential")
+	fs.DurationVar(&clientAuth.NegativeTTL, "authnegativettl", 5*time.Second, "How long the http auth provider remembers a rejected credential")
+	fs.BoolVar(&clientAuth.FailOpen, "authfailopen", false, "Let clients in, unverified, when the http auth provider's verifier can't be reached instead of failing their AUTH")
+	fs.DurationVar(&watchdog.Interval, "watchdoginterval", 5*time.Second, "How often the watchdog sends a heartbeat to each of the proxy's own sockets. Disabled if 0")
+	fs.DurationVar(&watchdog.Timeout, "watchdogtimeout", time.Second, "How long a heartbeat may take before it counts as failed")
+	fs.IntVar(&watchdog.Failures, "watchdogfailures", 3, "Number of heartbeats in a row a socket must fail for the process to be considered stalled")
+	fs.IntVar(&watchdog.ExitCode, "watchdogexitcode", 0, "Status the process exits with once stalled, so that its supervisor restarts it. Keeps running if 0")
+	fs.DurationVar(&staggered.Jitter, "reloadjitter", 0, "Longest delay a reload received on SIGHUP is applied after, for a fleet pushed a config at once not to reload together. Applied at once if 0")
+	fs.BoolVar(&staggered.ByHost, "reloadjitterbyhost", false, "Derive the delay of reloadjitter from the host name, for it to be the same on every push, rather than at random")
+	fs.DurationVar(&staggered.Prewarm, "reloadprewarm", 0, "How long the new proxy of an upstream changed by a reload waits for its pools to open their minpoolsize connections before it takes over, the upstream keeping its running proxy if they don't. Disabled if 0")
+	fs.StringVar(&registrar.Backend, "registrar", "", "Service discovery backend each listener is registered with as it starts, and deregistered from at shutdown. One of: consul. Disabled if empty")
+	fs.StringVar(&registrar.Address, "registraraddr", "http://127.0.0.1:8500", "Address of the registrar, the local agent's HTTP API for consul")
+	fs.DurationVar(&registrar.TTL, "registrarttl", 15*time.Second, "TTL of the health check of each registered listener, which is updated every third of it")
 
 	// todo remove these flags in a follow up, after all envs have updated to the new url-param style of timeout config
 	var obsoleteArg string
-	flag.StringVar(&obsoleteArg, "readtimeout", "unused", "unused. for backwards compatibility only")
-	flag.StringVar(&obsoleteArg, "writetimeout", "unused", "unused. for backwards compatibility only")
+	fs.StringVar(&obsoleteArg, "readtimeout", "unused", "unused. for backwards compatibility only")
+	fs.StringVar(&obsoleteArg, "writetimeout", "unused", "unused. for backwards compatibility only")
 
-	flag.Parse()
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
 
 	level := zap.InfoLevel
 	if loglevel != "" {
@@ -90,56 +679,178 @@ func parseFlags() (*Config, error) {
 		}
 	}
 
+	if discoveryFile == "" {
+		discoveryFile = localSocketPrefix + "sockets.json"
+	}
+
+	if shutdownTimeout <= 0 || drainTimeout <= 0 {
+		return nil, errors.New("shutdowntimeout and draintimeout must be positive")
+	}
+	if drainTimeout > shutdownTimeout {
+		return nil, fmt.Errorf("draintimeout %v is longer than shutdowntimeout %v", drainTimeout, shutdownTimeout)
+	}
+	if progressTimeout < 0 || firstByteTimeout < 0 || (firstByteTimeout > 0 && firstByteTimeout <= progressTimeout) {
+		return nil, fmt.Errorf("invalid clientfirstbytetimeout %v or clientprogresstimeout %v, the first must be longer", firstByteTimeout, progressTimeout)
+	}
+	if idleTimeout < 0 {
+		return nil, fmt.Errorf("invalid clientidletimeout %v", idleTimeout)
+	}
+
+	if budget.Ceiling < 0 || budget.Wait <= 0 {
+		return nil, fmt.Errorf("invalid maxupstreamconns %d or upstreamconnwait %v", budget.Ceiling, budget.Wait)
+	}
+	if budget.Policy != BudgetProportional && budget.Policy != BudgetDemand {
+		return nil, fmt.Errorf("invalid upstreamconnpolicy: %s", budget.Policy)
+	}
+
+	if watchdog.Interval < 0 {
+		return nil, fmt.Errorf("invalid watchdoginterval %v", watchdog.Interval)
+	}
+	if watchdog.Interval > 0 && (watchdog.Timeout <= 0 || watchdog.Failures < 1) {
+		return nil, fmt.Errorf("invalid watchdogtimeout %v or watchdogfailures %d", watchdog.Timeout, watchdog.Failures)
+	}
+	if watchdog.ExitCode < 0 || watchdog.ExitCode > 125 {
+		return nil, fmt.Errorf("invalid watchdogexitcode %d, expected 0 to 125", watchdog.ExitCode)
+	}
+
+	if staggered.Jitter < 0 || staggered.Prewarm < 0 {
+		return nil, fmt.Errorf("invalid reloadjitter %v or reloadprewarm %v", staggered.Jitter, staggered.Prewarm)
+	}
+
+	if registrar.Backend != "" && registrar.Backend != RegistrarConsul {
+		return nil, fmt.Errorf("invalid registrar: %s", registrar.Backend)
+	}
+	if registrar.Backend != "" && registrar.TTL < time.Second {
+		return nil, fmt.Errorf("invalid registrarttl %v, it must be at least 1s", registrar.TTL)
+	}
+
+	if traceSampleRate < 0 || traceSampleRate > 1 {
+		return nil, fmt.Errorf("invalid tracesamplerate: %v", traceSampleRate)
+	}
+
+	if accessLog.SampleRate < 0 || accessLog.SampleRate > 1 || accessLog.KeyBytes < 0 {
+		return nil, fmt.Errorf("invalid accesslogsamplerate %v or accesslogkeybytes %d", accessLog.SampleRate, accessLog.KeyBytes)
+	}
+
+	if sessionMaxBytes <= 0 || sessionMaxFiles <= 0 {
+		return nil, errors.New("sessionmaxbytes and sessionmaxfiles must be positive")
+	}
+
+	soft, err := memwatch.ParseLimit(memorySoftLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memorysoftlimit: %v", err)
+	}
+	hard, err := memwatch.ParseLimit(memoryHardLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memoryhardlimit: %v", err)
+	}
+	if soft.Bytes > 0 && hard.Bytes > 0 && soft.Bytes >= hard.Bytes || soft.Fraction > 0 && hard.Fraction > 0 && soft.Fraction >= hard.Fraction {
+		return nil, fmt.Errorf("memorysoftlimit %v must be below memoryhardlimit %v", soft, hard)
+	}
+	if memoryShedBytes <= 0 {
+		return nil, errors.New("memoryshedbytes must be positive")
+	}
+
+	if err := parseClientAuth(&clientAuth, authUsers); err != nil {
+		return nil, err
+	}
+	if err := checkAdminAuth(adminAuth); err != nil {
+		return nil, err
+	}
+
 	if !validNetwork(network) {
 		return nil, fmt.Errorf("invalid network: %s", network)
 	}
 
-	var upstreams []Upstream
-	for _, arg := range flag.Args() {
-		all := strings.FieldsFunc(arg, func(r rune) bool {
-			return r == '|' || r == '\n'
-		})
-		for _, v := range all {
-			u, err := url.Parse(v)
-			if err != nil {
-				return nil, err
-			}
+	mode, err := parseSocketMode(socketMode)
+	if err != nil {
+		return nil, err
+	}
 
-			db := -1
-			if len(u.Path) > 1 {
-				db, err = strconv.Atoi(u.Path[1:])
-				if err != nil {
-					return nil, errors.New("failed to parse redis db number from path")
-				}
-			}
+	var deprecated *regexp.Regexp
+	if deprecatedClients != "" {
+		var err error
+		deprecated, err = regexp.Compile(deprecatedClients)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deprecatedclients: %v", err)
+		}
+	}
 
-			params, err := url.ParseQuery(u.RawQuery)
-			if err != nil {
-				return nil, err
-			}
+	upstreams, err := upstreamsFrom(configFile, fs.Args())
+	if err != nil {
+		return nil, err
+	}
 
-			rt, err := time.ParseDuration(getStringParam(params, "readtimeout", "5s"))
-			if err != nil {
-				return nil, err
-			}
-			wt, err := time.ParseDuration(getStringParam(params, "writetimeout", "5s"))
+	return &Config{
+		Upstreams:          upstreams,
+		Network:            network,
+		LocalSocketPrefix:  localSocketPrefix,
+		LocalSocketSuffix:  localSocketSuffix,
+		Unlink:             unlink,
+		SocketMode:         mode,
+		SocketGroup:        socketGroup,
+		Pretty:             pretty,
+		Statsd:             stats,
+		Level:              level,
+		AdminAddress:       adminAddress,
+		AdminAuth:          adminAuth,
+		AdminPprof:         adminPprof,
+		ReadyTimeout:       readyTimeout,
+		DeprecatedClients:  deprecated,
+		StateFile:          stateFile,
+		IgnoreRuntimeState: ignoreRuntimeState,
+		EnrichACLErrors:    enrichACLErrors,
+		PlainErrors:        plainErrors,
+		CrashOnPanic:       crashOnPanic,
+		TraceSampleRate:    traceSampleRate,
+		AccessLog:          accessLog,
+		SessionDir:         sessionDir,
+		SessionMaxBytes:    sessionMaxBytes,
+		SessionMaxFiles:    sessionMaxFiles,
+		DiscoveryFile:      discoveryFile,
+		WarmupConcurrency:  warmupConcurrency,
+		ShutdownTimeout:    shutdownTimeout,
+		DrainTimeout:       drainTimeout,
+		DrainNotify:        drainNotify,
+		FirstByteTimeout:   firstByteTimeout,
+		ProgressTimeout:    progressTimeout,
+		IdleTimeout:        idleTimeout,
+		MemorySoftLimit:    soft,
+		MemoryHardLimit:    hard,
+		MemoryShedBytes:    memoryShedBytes,
+		ClientAuth:         clientAuth,
+		AllowSwapDB:        allowSwapDB,
+		AllowConfigWrites:  allowConfigWrites,
+		Check:              check,
+		Watchdog:           watchdog,
+		StaggeredReload:    staggered,
+		Registrar:          registrar,
+		ConnectionBudget:   budget,
+		ConfigFile:         configFile,
+		args:               fs.Args(),
+	}, nil
+}
+
+// upstreamsFrom reads the upstreams of the config file, if there is one, and of
+// the arguments, checking them as a whole
+func upstreamsFrom(configFile string, args []string) ([]Upstream, error) {
+	var fromFile, upstreams []Upstream
+	if configFile != "" {
+		var err error
+		if fromFile, err = loadUpstreams(configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, arg := range args {
+		for _, v := range splitUpstreamArg(arg) {
+			us, err := parseUpstream(v)
 			if err != nil {
 				return nil, err
 			}
-
-			us := Upstream{
-				UpstreamConfigHost: u.Host,
-				Label:              getStringParam(params, "label", ""),
-				MaxPoolSize:        getIntParam(params, "maxpoolsize", 10),
-				MinPoolSize:        getIntParam(params, "minpoolsize", 1),
-				Database:           db,
-				ReadTimeout:        rt,
-				WriteTimeout:       wt,
-			}
-
 			upstreams = append(upstreams, us)
 		}
 	}
+	upstreams = mergeUpstreams(fromFile, upstreams)
 
 	if len(upstreams) == 0 {
 		return nil, errors.New("missing list of upstream hosts")
@@ -154,17 +865,935 @@ func parseFlags() (*Config, error) {
 		}
 		addrMap[key] = true
 	}
+	for _, c := range upstreams {
+		if f := c.ReadFallback.Upstream; f != "" {
+			if i := FindUpstream(upstreams, f); i < 0 || f == c.Label || f == c.UpstreamConfigHost {
+				return nil, fmt.Errorf("invalid readfallback %s of %s, expected the label or address of another upstream", f, c.UpstreamConfigHost)
+			}
+		}
+	}
+	return upstreams, nil
+}
 
-	return &Config{
-		Upstreams:         upstreams,
-		Network:           network,
-		LocalSocketPrefix: localSocketPrefix,
-		LocalSocketSuffix: localSocketSuffix,
-		Unlink:            unlink,
-		Pretty:            pretty,
-		Statsd:            stats,
-		Level:             level,
-	}, nil
+// splitUpstreamArg splits an argument into the upstream URLs it lists, separated
+// by | or newlines
+func splitUpstreamArg(arg string) []string {
+	return strings.FieldsFunc(arg, func(r rune) bool {
+		return r == '|' || r == '\n'
+	})
+}
+
+// UpstreamArgs are the upstream URLs given as arguments, rather than in the
+// config file
+func (c *Config) UpstreamArgs() []string {
+	var urls []string
+	for _, arg := range c.args {
+		urls = append(urls, splitUpstreamArg(arg)...)
+	}
+	return urls
+}
+
+// ReloadUpstreams reads the upstreams again, from the config file as it is now
+// and the arguments the process started with, without changing c
+func (c *Config) ReloadUpstreams() ([]Upstream, error) {
+	return upstreamsFrom(c.ConfigFile, c.args)
+}
+
+// parseUpstream parses an upstream URL, redis://[user:password@]host:port[/db]?params
+func parseUpstream(v string) (Upstream, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return Upstream{}, err
+	}
+	host, err := netaddr.Normalize(u.Host)
+	if err != nil {
+		return Upstream{}, err
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return Upstream{}, fmt.Errorf("invalid port %s", port)
+		}
+	}
+
+	db := -1
+	if len(u.Path) > 1 {
+		db, err = strconv.Atoi(u.Path[1:])
+		if err != nil {
+			return Upstream{}, errors.New("failed to parse redis db number from path")
+		}
+	}
+
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return Upstream{}, err
+	}
+
+	rt, err := time.ParseDuration(getStringParam(params, "readtimeout", "5s"))
+	if err != nil {
+		return Upstream{}, err
+	}
+	wt, err := time.ParseDuration(getStringParam(params, "writetimeout", "5s"))
+	if err != nil {
+		return Upstream{}, err
+	}
+
+	readOnlyScripts := getStringParam(params, "readonlyscripts", "ro")
+	if readOnlyScripts != "ro" && readOnlyScripts != "block" {
+		return Upstream{}, fmt.Errorf("invalid readonlyscripts: %s", readOnlyScripts)
+	}
+	socketMode, err := parseSocketMode(getStringParam(params, "socketmode", ""))
+	if err != nil {
+		return Upstream{}, err
+	}
+	errorRewrite := getStringParam(params, "errorrewrite", "")
+	if errorRewrite != "" && errorRewrite != "redirects" && errorRewrite != "scrub" {
+		return Upstream{}, fmt.Errorf("invalid errorrewrite: %s", errorRewrite)
+	}
+
+	bl, err := getDurationParam(params, "breakerlatency", 0)
+	if err != nil {
+		return Upstream{}, err
+	}
+	bw, err := getDurationParam(params, "breakerwindow", 10*time.Second)
+	if err != nil {
+		return Upstream{}, err
+	}
+	bc, err := getDurationParam(params, "breakercooldown", 5*time.Second)
+	if err != nil {
+		return Upstream{}, err
+	}
+	cw, err := getDurationParam(params, "connectwarnafter", 10*time.Second)
+	if err != nil {
+		return Upstream{}, err
+	}
+	wb, err := parseWriteBehind(params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	rth, err := parseReadThrough(params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	topo, err := parseTopology(params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	slos, err := parseSLOs(params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	segments, err := parseSegments(params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	dbIdle, err := getDurationParam(params, "dbidletimeout", 5*time.Minute)
+	if err != nil {
+		return Upstream{}, err
+	}
+	sl, err := getDurationParam(params, "serverlatency", 0)
+	if err != nil {
+		return Upstream{}, err
+	}
+	heal, err := getDurationParam(params, "poolhealinterval", 10*time.Second)
+	if err != nil {
+		return Upstream{}, err
+	}
+	maxIdle, err := getDurationParam(params, "maxconnectionidletime", 0)
+	if err != nil {
+		return Upstream{}, err
+	}
+	idlePing, err := getDurationParam(params, "healthcheckinterval", 0)
+	if err != nil {
+		return Upstream{}, err
+	}
+	txIdle, err := getDurationParam(params, "transactionidletimeout", 30*time.Second)
+	if err != nil {
+		return Upstream{}, err
+	}
+	identity, err := parseIdentity(params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	scripts, err := parseScripts(params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	hotspots, err := parseHotspots(params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	slowLog, err := parseSlowLog(params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	pubSubBuffer, err := parsePubSubBuffer(params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	credentials, err := parseCredentials(u, params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	tlsConfig, err := parseTLS(u, params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	ttl, err := parseTTLPolicy(params)
+	if err != nil {
+		return Upstream{}, err
+	}
+	negative, err := parseNegativeCache(params, wb, rth)
+	if err != nil {
+		return Upstream{}, err
+	}
+	coalesce := Coalesce{
+		Enabled:  getBoolParam(params, "coalesce", false),
+		MaxKeys:  getIntParam(params, "coalescemaxkeys", 10000),
+		MaxBytes: getIntParam(params, "coalescemaxbytes", 1024),
+	}
+	if coalesce.Enabled && (coalesce.MaxKeys < 1 || coalesce.MaxBytes < 1) {
+		return Upstream{}, fmt.Errorf("invalid coalescemaxkeys %d or coalescemaxbytes %d", coalesce.MaxKeys, coalesce.MaxBytes)
+	}
+	advisor := PoolAdvisor{
+		Enabled:  getBoolParam(params, "pooladvisor", false),
+		Headroom: getFloatParam(params, "pooladvisorheadroom", 0.25),
+	}
+	if advisor.Sample, err = getDurationParam(params, "pooladvisorsample", 10*time.Millisecond); err != nil {
+		return Upstream{}, err
+	}
+	if advisor.Enabled && (advisor.Headroom < 0 || advisor.Sample <= 0 || advisor.Sample > time.Second) {
+		return Upstream{}, fmt.Errorf("invalid pooladvisorheadroom %v or pooladvisorsample %v, it must be at most 1s", advisor.Headroom, advisor.Sample)
+	}
+	warnings := Warnings{
+		Enabled: getBoolParam(params, "warnings", false),
+		Signals: getBoolParam(params, "warnpipelinesignals", false),
+	}
+	if warnings.Interval, err = getDurationParam(params, "warninginterval", time.Minute); err != nil {
+		return Upstream{}, err
+	}
+	if warnings.Interval < 0 || (warnings.Signals && !warnings.Enabled) {
+		return Upstream{}, fmt.Errorf("invalid warninginterval %v or warnpipelinesignals, which needs warnings", warnings.Interval)
+	}
+	mirror := Mirror{
+		Address:  getStringParam(params, "mirror", ""),
+		Compare:  getBoolParam(params, "mirrorcompare", false),
+		Queue:    getIntParam(params, "mirrorqueue", 1000),
+		PoolSize: getIntParam(params, "mirrorpoolsize", 4),
+	}
+	if mirror.Credentials, err = readCredentialsFile("mirrorcredentialsfile", getStringParam(params, "mirrorcredentialsfile", "")); err != nil {
+		return Upstream{}, err
+	}
+	switch mc := getStringParam(params, "mirrorcommands", "writes"); mc {
+	case "writes":
+	case "all":
+		mirror.All = true
+	default:
+		return Upstream{}, fmt.Errorf("invalid mirrorcommands %s, expected writes or all", mc)
+	}
+	if mirror.Address, err = netaddr.Normalize(mirror.Address); err != nil {
+		return Upstream{}, fmt.Errorf("invalid mirror: %v", err)
+	}
+	if mirror.Address == host {
+		return Upstream{}, fmt.Errorf("invalid mirror %s, it is the upstream itself", mirror.Address)
+	}
+	if mirror.Address != "" && (mirror.Queue < 1 || mirror.PoolSize < 1) {
+		return Upstream{}, fmt.Errorf("invalid mirrorqueue %d or mirrorpoolsize %d", mirror.Queue, mirror.PoolSize)
+	}
+
+	us := Upstream{
+		UpstreamConfigHost: host,
+		Label:              getStringParam(params, "label", ""),
+		MaxPoolSize:        getIntParam(params, "maxpoolsize", 10),
+		MinPoolSize:        getIntParam(params, "minpoolsize", 1),
+		Database:           db,
+		ReadTimeout:        rt,
+		WriteTimeout:       wt,
+		Retries:            getIntParam(params, "retries", 0),
+		RetryBudget:        getFloatParam(params, "retrybudget", 0.1),
+		ReservedPoolSize:   getIntParam(params, "reservedpoolsize", 0),
+		BlockingPoolSize:   getIntParam(params, "blockingpoolsize", 0),
+		PubSubPoolSize:     getIntParam(params, "pubsubpoolsize", 0),
+		RESP3PoolSize:      getIntParam(params, "resp3poolsize", 0),
+		PubSubBuffer:       pubSubBuffer,
+		PinTransactions:    getBoolParam(params, "pintransactions", false),
+		TransactionIdle:    txIdle,
+		CriticalCommands:   getListParam(params, "criticalcommands"),
+		CriticalPrefixes:   getListParam(params, "criticalprefixes"),
+		SplitThreshold:     getIntParam(params, "splitthreshold", 0),
+		SplitChunkSize:     getIntParam(params, "splitchunksize", 100),
+		SplitParallelism:   getIntParam(params, "splitparallelism", 1),
+		ReadOnly:           getBoolParam(params, "readonly", false),
+		ReadOnlyScripts:    readOnlyScripts,
+		BreakerErrorRate:   getFloatParam(params, "breakererrorrate", 0),
+		BreakerLatency:     bl,
+		BreakerMinRequests: getIntParam(params, "breakerminrequests", 20),
+		BreakerWindow:      bw,
+		BreakerCooldown:    bc,
+		BreakerFailures:    getIntParam(params, "breakerfailures", 0),
+		BreakerPing:        getBoolParam(params, "breakerping", false),
+		MaxInFlight:        getIntParam(params, "maxinflight", 0),
+		ConnectRate:        getFloatParam(params, "connectrate", 0),
+		ConnectBurst:       getIntParam(params, "connectburst", 1),
+		ConnectWarnAfter:   cw,
+		WriteBehind:        wb,
+		ReadThrough:        rth,
+		Topology:           topo,
+		StrictValidation:   getBoolParam(params, "strictvalidation", false),
+		SLOs:               slos,
+		SLOMinSamples:      getIntParam(params, "slominsamples", 100),
+		CommandMixTop:      getIntParam(params, "commandmixtop", 10),
+		CommandMetrics:     getListParam(params, "commandmetrics"),
+		AllowCommands:      getListParam(params, "allowcommands"),
+		DenyCommands:       getListParam(params, "denycommands"),
+		Segments:           segments,
+		DynamicDB:          getBoolParam(params, "dynamicdb", false),
+		MaxDBs:             getIntParam(params, "maxdbs", 16),
+		DBIdleTimeout:      dbIdle,
+		ServerLatency:      sl,
+		PoolHealInterval:   heal,
+		MaxConnIdleTime:    maxIdle,
+		IdlePingInterval:   idlePing,
+		ErrorRewrite:       errorRewrite,
+		TopologyRewrite:    getBoolParam(params, "topologyrewrite", false),
+		FairCheckout:       getBoolParam(params, "faircheckout", false),
+		FairHold:           getIntParam(params, "fairhold", 0),
+		ConfigGetForward:   getBoolParam(params, "configgetforward", false),
+		AtomicMaxCommands:  getIntParam(params, "atomicmaxcommands", 100),
+		PipelineReadahead:  getIntParam(params, "pipelinereadahead", 0),
+		StreamThreshold:    getIntParam(params, "streamthreshold", 0),
+		StreamMaxBytes:     getIntParam(params, "streammaxbytes", 0),
+		ChecksumPrefixes:   getListParam(params, "checksumprefixes"),
+		MaxClients:         getIntParam(params, "maxclients", 0),
+		MaxClientsClose:    getBoolParam(params, "maxclientsclose", false),
+		SocketMode:         socketMode,
+		SocketGroup:        getStringParam(params, "socketgroup", ""),
+		Identity:           identity,
+		Scripts:            scripts,
+		Hotspots:           hotspots,
+		SlowLog:            slowLog,
+		Credentials:        credentials,
+		TLS:                tlsConfig,
+		ReadFallback:       ReadFallback{Upstream: getStringParam(params, "readfallback", ""), NilPrefixes: getListParam(params, "readfallbacknilprefixes")},
+		Coalesce:           coalesce,
+		TTLPolicy:          ttl,
+		NegativeCache:      negative,
+		PoolAdvisor:        advisor,
+		Warnings:           warnings,
+		Mirror:             mirror,
+
+		IgnorePipelineSignals: !getBoolParam(params, "pipelinesignals", true),
+	}
+	if us.DynamicDB && us.Database >= 0 {
+		return Upstream{}, fmt.Errorf("dynamicdb can't be combined with the database %d in the path", us.Database)
+	}
+	if us.DynamicDB && (us.MaxDBs < 1 || us.DBIdleTimeout <= 0) {
+		return Upstream{}, fmt.Errorf("invalid maxdbs %d or dbidletimeout %v", us.MaxDBs, us.DBIdleTimeout)
+	}
+	if us.ServerLatency < 0 || (us.ServerLatency > 0 && us.ServerLatency < time.Second) {
+		return Upstream{}, fmt.Errorf("invalid serverlatency %v, it must be at least 1s", us.ServerLatency)
+	}
+	if us.PoolHealInterval < 0 || (us.PoolHealInterval > 0 && us.PoolHealInterval < time.Second) {
+		return Upstream{}, fmt.Errorf("invalid poolhealinterval %v, it must be at least 1s", us.PoolHealInterval)
+	}
+	if us.MaxConnIdleTime < 0 || (us.MaxConnIdleTime > 0 && us.MaxConnIdleTime < time.Second) {
+		return Upstream{}, fmt.Errorf("invalid maxconnectionidletime %v, it must be at least 1s", us.MaxConnIdleTime)
+	}
+	if us.IdlePingInterval < 0 || (us.IdlePingInterval > 0 && us.IdlePingInterval < time.Second) {
+		return Upstream{}, fmt.Errorf("invalid healthcheckinterval %v, it must be at least 1s", us.IdlePingInterval)
+	}
+	if us.BreakerFailures < 0 {
+		return Upstream{}, fmt.Errorf("invalid breakerfailures %d", us.BreakerFailures)
+	}
+	if us.BreakerPing && us.BreakerErrorRate <= 0 && us.BreakerFailures == 0 {
+		return Upstream{}, fmt.Errorf("breakerping requires breakererrorrate or breakerfailures")
+	}
+	if us.FairHold < 0 || (us.FairHold > 0 && !us.FairCheckout) {
+		return Upstream{}, fmt.Errorf("invalid fairhold %d, it must be positive and needs faircheckout", us.FairHold)
+	}
+	if us.BlockingPoolSize < 0 {
+		return Upstream{}, fmt.Errorf("invalid blockingpoolsize %d", us.BlockingPoolSize)
+	}
+	if us.PubSubPoolSize < 0 {
+		return Upstream{}, fmt.Errorf("invalid pubsubpoolsize %d", us.PubSubPoolSize)
+	}
+	if us.RESP3PoolSize < 0 {
+		return Upstream{}, fmt.Errorf("invalid resp3poolsize %d", us.RESP3PoolSize)
+	}
+	if us.PipelineReadahead < 0 {
+		return Upstream{}, fmt.Errorf("invalid pipelinereadahead %d", us.PipelineReadahead)
+	}
+	if us.StreamThreshold < 0 || us.StreamMaxBytes < 0 || (us.StreamMaxBytes > 0 && us.StreamMaxBytes < us.StreamThreshold) {
+		return Upstream{}, fmt.Errorf("invalid streamthreshold %d or streammaxbytes %d, it must be at least streamthreshold", us.StreamThreshold, us.StreamMaxBytes)
+	}
+	if us.MaxClients < 0 || (us.MaxClientsClose && us.MaxClients == 0) {
+		return Upstream{}, fmt.Errorf("invalid maxclients %d or maxclientsclose, which needs maxclients", us.MaxClients)
+	}
+	if us.TransactionIdle <= 0 {
+		return Upstream{}, fmt.Errorf("invalid transactionidletimeout %v", us.TransactionIdle)
+	}
+	if us.SLOMinSamples < 1 {
+		return Upstream{}, fmt.Errorf("invalid slominsamples %d", us.SLOMinSamples)
+	}
+	if us.CommandMixTop < 0 {
+		return Upstream{}, fmt.Errorf("invalid commandmixtop %d", us.CommandMixTop)
+	}
+	if len(us.ReadFallback.NilPrefixes) > 0 && us.ReadFallback.Upstream == "" {
+		return Upstream{}, errors.New("readfallbacknilprefixes needs readfallback")
+	}
+	if us.ConnectRate < 0 || us.ConnectBurst < 1 {
+		return Upstream{}, fmt.Errorf("invalid connectrate %v or connectburst %d", us.ConnectRate, us.ConnectBurst)
+	}
+	return us, nil
+}
+
+// FindUpstream returns the index of the upstream of a label or address, or -1
+func FindUpstream(upstreams []Upstream, name string) int {
+	for i, u := range upstreams {
+		if u.Label == name || u.UpstreamConfigHost == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseClientAuth checks that the auth provider chosen has what it needs, and
+// parses the authusers flag into the static provider's users
+func parseClientAuth(a *ClientAuth, users string) error {
+	if a.Timeout <= 0 || a.Retries < 0 || a.CacheTTL < 0 || a.NegativeTTL < 0 {
+		return errors.New("authtimeout must be positive, and authretries, authcachettl and authnegativettl not negative")
+	}
+	switch a.Provider {
+	case "":
+		return nil
+	case AuthStatic:
+		a.Users = make(map[string]string)
+		for _, pair := range strings.Split(users, ",") {
+			i := strings.Index(pair, ":")
+			if i <= 0 {
+				return fmt.Errorf("invalid authusers: expected user:password, got %q", redactPair(pair))
+			}
+			a.Users[pair[:i]] = pair[i+1:]
+		}
+	case AuthFile:
+		if a.File == "" {
+			return errors.New("the file auth provider needs authfile")
+		}
+	case AuthHTTP:
+		u, err := url.Parse(a.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("the http auth provider needs an http(s) authurl, got %q", redactURL(a.URL))
+		}
+	default:
+		return fmt.Errorf("invalid authprovider: %s", a.Provider)
+	}
+	return nil
+}
+
+// checkAdminAuth checks that the admin TLS and authentication flags given go
+// together
+func checkAdminAuth(a AdminAuth) error {
+	if (a.TLSCert == "") != (a.TLSKey == "") {
+		return errors.New("admintlscert and admintlskey go together")
+	}
+	if a.ClientCA != "" && a.TLSCert == "" {
+		return errors.New("adminclientca needs admintlscert")
+	}
+	if a.Reads && a.Token == "" && a.ClientCA == "" {
+		return errors.New("adminauthreads needs admintoken or adminclientca")
+	}
+	return nil
+}
+
+// redactPair leaves the password out of a user:password pair that is quoted
+// in an error
+func redactPair(pair string) string {
+	if i := strings.Index(pair, ":"); i >= 0 {
+		return pair[:i] + ":..."
+	}
+	return pair
+}
+
+// parseWriteBehind reads the writebehind* params. Since absorbed increments are
+// not visible to reads until they are flushed, there is no default reply mode:
+// enabling write-behind requires choosing one.
+func parseWriteBehind(params url.Values) (WriteBehind, error) {
+	wb := WriteBehind{
+		Prefixes:   getListParam(params, "writebehindprefixes"),
+		FlushKeys:  getIntParam(params, "writebehindkeys", 1000),
+		MaxPending: getIntParam(params, "writebehindmaxpending", 100000),
+		Reply:      getStringParam(params, "writebehindreply", ""),
+	}
+	var err error
+	if wb.Interval, err = getDurationParam(params, "writebehindinterval", 100*time.Millisecond); err != nil {
+		return wb, err
+	}
+	if len(wb.Prefixes) == 0 {
+		return wb, nil
+	}
+	for _, prefix := range wb.Prefixes {
+		if prefix == "" {
+			return wb, errors.New("writebehindprefixes must not contain an empty prefix, which would match every key")
+		}
+	}
+	if wb.Reply != "queued" && wb.Reply != "total" {
+		return wb, fmt.Errorf("writebehindprefixes requires writebehindreply=queued or writebehindreply=total, got %q", wb.Reply)
+	}
+	if wb.Interval <= 0 || wb.FlushKeys < 1 || wb.MaxPending < wb.FlushKeys {
+		return wb, fmt.Errorf("invalid writebehindinterval %v, writebehindkeys %d or writebehindmaxpending %d", wb.Interval, wb.FlushKeys, wb.MaxPending)
+	}
+	return wb, nil
+}
+
+// parseReadThrough reads the readthrough* params. There is one readthrough param
+// per rule, whose endpoint may itself contain commas since the prefix is
+// everything before the first and the TTL everything after the last.
+func parseReadThrough(params url.Values) (ReadThrough, error) {
+	rt := ReadThrough{
+		Concurrency: getIntParam(params, "readthroughconcurrency", 10),
+		MaxBytes:    int64(getIntParam(params, "readthroughmaxbytes", 1<<20)),
+	}
+	var err error
+	if rt.Timeout, err = getDurationParam(params, "readthroughtimeout", 100*time.Millisecond); err != nil {
+		return rt, err
+	}
+	for _, v := range params["readthrough"] {
+		first, last := strings.Index(v, ","), strings.LastIndex(v, ",")
+		if first <= 0 || first == last {
+			return rt, fmt.Errorf("invalid readthrough %q, expected prefix,endpoint,ttl", v)
+		}
+		rule := ReadThroughRule{Prefix: v[:first], Endpoint: v[first+1 : last]}
+		if rule.TTL, err = time.ParseDuration(v[last+1:]); err != nil || rule.TTL < time.Millisecond {
+			return rt, fmt.Errorf("invalid readthrough ttl in %q", v)
+		}
+		if u, err := url.Parse(rule.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return rt, fmt.Errorf("invalid readthrough endpoint in %q, expected an http or https URL", v)
+		}
+		rt.Rules = append(rt.Rules, rule)
+	}
+	if len(rt.Rules) > 0 && (rt.Concurrency < 1 || rt.Timeout <= 0 || rt.MaxBytes < 1) {
+		return rt, fmt.Errorf("invalid readthroughconcurrency %d, readthroughtimeout %v or readthroughmaxbytes %d", rt.Concurrency, rt.Timeout, rt.MaxBytes)
+	}
+	return rt, nil
+}
+
+func parseIdentity(params url.Values) (Identity, error) {
+	id := Identity{
+		Key:    getStringParam(params, "identity", ""),
+		Mode:   getStringParam(params, "identitymode", ""),
+		Policy: getStringParam(params, "identitypolicy", IdentityFailFast),
+	}
+	var err error
+	if id.Interval, err = getDurationParam(params, "identityinterval", time.Minute); err != nil {
+		return id, err
+	}
+	for _, v := range getListParam(params, "identityinfo") {
+		i := strings.Index(v, ":")
+		if i <= 0 {
+			return id, fmt.Errorf("invalid identityinfo %q, expected field:prefix", v)
+		}
+		if id.Info == nil {
+			id.Info = make(map[string]string)
+		}
+		id.Info[v[:i]] = v[i+1:]
+	}
+	if id.Mode != "" && id.Mode != "cluster" && id.Mode != "standalone" {
+		return id, fmt.Errorf("invalid identitymode: %s", id.Mode)
+	}
+	if id.Policy != IdentityFailFast && id.Policy != IdentityDegraded {
+		return id, fmt.Errorf("invalid identitypolicy: %s", id.Policy)
+	}
+	if id.Interval < time.Second {
+		return id, fmt.Errorf("invalid identityinterval %v, it must be at least 1s", id.Interval)
+	}
+	return id, nil
+}
+
+// parseCredentials reads the upstream credentials from the userinfo of its URL,
+// user:password or :password for the default user, or from the file of its
+// credentialsfile param, which holds what would follow AUTH, "[user] password", so
+// that the password needn't be on the command line
+func parseCredentials(u *url.URL, params url.Values) (Credentials, error) {
+	file := getStringParam(params, "credentialsfile", "")
+	if u.User != nil {
+		if file != "" {
+			return Credentials{}, errors.New("credentialsfile can't be combined with credentials in the upstream URL")
+		}
+		password, ok := u.User.Password()
+		if !ok || password == "" {
+			return Credentials{}, fmt.Errorf("missing password for upstream user %q", u.User.Username())
+		}
+		return Credentials{User: u.User.Username(), Password: password}, nil
+	}
+	return readCredentialsFile("credentialsfile", file)
+}
+
+// readCredentialsFile reads the credentials in the file of the param key, none
+// if it is empty
+func readCredentialsFile(key, file string) (Credentials, error) {
+	if file == "" {
+		return Credentials{}, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	switch fields := strings.Fields(string(b)); len(fields) {
+	case 1:
+		return Credentials{Password: fields[0]}, nil
+	case 2:
+		return Credentials{User: fields[0], Password: fields[1]}, nil
+	default:
+		return Credentials{}, fmt.Errorf("invalid %s %s, expected [user] password", key, file)
+	}
+}
+
+// parseTLS reads the tls* params, TLS being enabled by the tls param or a
+// rediss:// upstream URL. The files are checked to be readable here, so that a
+// missing one fails at startup rather than every connection to the upstream.
+func parseTLS(u *url.URL, params url.Values) (TLS, error) {
+	t := TLS{
+		Enabled:            u.Scheme == "rediss" || getBoolParam(params, "tls", false),
+		CAFile:             getStringParam(params, "tlscafile", ""),
+		CertFile:           getStringParam(params, "tlscertfile", ""),
+		KeyFile:            getStringParam(params, "tlskeyfile", ""),
+		ServerName:         getStringParam(params, "tlsservername", ""),
+		InsecureSkipVerify: getBoolParam(params, "tlsinsecureskipverify", false),
+	}
+	if !t.Enabled {
+		if t != (TLS{}) {
+			return t, errors.New("tlscafile, tlscertfile, tlskeyfile, tlsservername and tlsinsecureskipverify need tls")
+		}
+		return t, nil
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return t, errors.New("tlscertfile and tlskeyfile go together")
+	}
+	for i, file := range []string{t.CAFile, t.CertFile, t.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := ioutil.ReadFile(file); err != nil {
+			return t, fmt.Errorf("invalid %s: %v", []string{"tlscafile", "tlscertfile", "tlskeyfile"}[i], err)
+		}
+	}
+	return t, nil
+}
+
+// parseHotspots reads the hotspot* params and bannedhashtags
+func parseHotspots(params url.Values) (Hotspots, error) {
+	h := Hotspots{
+		Sample:     getIntParam(params, "hotspotsample", 0),
+		Share:      getFloatParam(params, "hotspotshare", 0.2),
+		MinSamples: getIntParam(params, "hotspotminsamples", 100),
+		Banned:     getListParam(params, "bannedhashtags"),
+	}
+	var err error
+	if h.Window, err = getDurationParam(params, "hotspotwindow", time.Minute); err != nil {
+		return h, err
+	}
+	if h.Sample < 0 || h.Share <= 0 || h.Share > 1 || h.Window < time.Second || h.MinSamples < 1 {
+		return h, fmt.Errorf("invalid hotspotsample %d, hotspotshare %v, hotspotwindow %v or hotspotminsamples %d", h.Sample, h.Share, h.Window, h.MinSamples)
+	}
+	for _, p := range h.Banned {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return h, fmt.Errorf("invalid bannedhashtags pattern %q", p)
+		}
+	}
+	return h, nil
+}
+
+// parsePubSubBuffer reads pubsubmaxbytes, pubsubmaxage and pubsuboverflow
+func parsePubSubBuffer(params url.Values) (PubSubBuffer, error) {
+	b := PubSubBuffer{
+		MaxBytes: getIntParam(params, "pubsubmaxbytes", 8<<20),
+		Overflow: getStringParam(params, "pubsuboverflow", "backpressure"),
+	}
+	var err error
+	if b.MaxAge, err = getDurationParam(params, "pubsubmaxage", 0); err != nil {
+		return b, err
+	}
+	if b.MaxBytes < 1 || b.MaxAge < 0 {
+		return b, fmt.Errorf("invalid pubsubmaxbytes %d or pubsubmaxage %v", b.MaxBytes, b.MaxAge)
+	}
+	switch b.Overflow {
+	case "disconnect", "drop-oldest", "backpressure":
+	default:
+		return b, fmt.Errorf("invalid pubsuboverflow %q, expected disconnect, drop-oldest or backpressure", b.Overflow)
+	}
+	return b, nil
+}
+
+// parseSlowLog reads the slowlog* params
+func parseSlowLog(params url.Values) (SlowLog, error) {
+	s := SlowLog{
+		KeyBytes: getIntParam(params, "slowlogkeybytes", 32),
+		Redact:   getListParam(params, "slowlogredact"),
+	}
+	var err error
+	if s.Threshold, err = getDurationParam(params, "slowlog", 0); err != nil {
+		return s, err
+	}
+	if s.Threshold < 0 || s.KeyBytes < 0 {
+		return s, fmt.Errorf("invalid slowlog %v or slowlogkeybytes %d", s.Threshold, s.KeyBytes)
+	}
+	for _, p := range s.Redact {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return s, fmt.Errorf("invalid slowlogredact pattern %q", p)
+		}
+	}
+	return s, nil
+}
+
+var scriptLimitName = regexp.MustCompile(`^(\*|[a-zA-Z0-9_.:-]+)$`)
+
+// parseScripts reads the script* params, with a scriptlimit param per limit
+func parseScripts(params url.Values) (Scripts, error) {
+	s := Scripts{MaxTracked: getIntParam(params, "scriptmaxtracked", 1000)}
+	var err error
+	if s.Wait, err = getDurationParam(params, "scriptwait", 100*time.Millisecond); err != nil {
+		return s, err
+	}
+	if s.Slow, err = getDurationParam(params, "scriptslow", time.Second); err != nil {
+		return s, err
+	}
+	if s.Wait < 0 || s.Slow < 0 || s.MaxTracked < 1 {
+		return s, fmt.Errorf("invalid scriptwait %v, scriptslow %v or scriptmaxtracked %d", s.Wait, s.Slow, s.MaxTracked)
+	}
+	for _, v := range params["scriptlimit"] {
+		parts := strings.Split(v, ",")
+		if len(parts) != 3 {
+			return s, fmt.Errorf("invalid scriptlimit %q, expected script,rate,inflight", v)
+		}
+		l := ScriptLimit{Script: parts[0]}
+		if !scriptLimitName.MatchString(l.Script) {
+			return s, fmt.Errorf("invalid scriptlimit script in %q, expected *, a SHA or a script name", v)
+		}
+		if l.Rate, err = strconv.ParseFloat(parts[1], 64); err != nil || l.Rate < 0 {
+			return s, fmt.Errorf("invalid scriptlimit rate in %q", v)
+		}
+		if l.InFlight, err = strconv.Atoi(parts[2]); err != nil || l.InFlight < 0 {
+			return s, fmt.Errorf("invalid scriptlimit inflight in %q", v)
+		}
+		if l.Rate == 0 && l.InFlight == 0 {
+			return s, fmt.Errorf("invalid scriptlimit %q, it limits nothing", v)
+		}
+		s.Limits = append(s.Limits, l)
+	}
+	return s, nil
+}
+
+// parseTTLPolicy reads the ttlnamespace params, one per namespace, and the
+// ttlpersist and ttlfollowup params that apply to all of them
+func parseTTLPolicy(params url.Values) (TTLPolicy, error) {
+	t := TTLPolicy{
+		Persist:  getStringParam(params, "ttlpersist", "reject"),
+		FollowUp: getBoolParam(params, "ttlfollowup", true),
+	}
+	if t.Persist != "reject" && t.Persist != "expire" {
+		return t, fmt.Errorf("invalid ttlpersist %s, expected reject or expire", t.Persist)
+	}
+	for _, v := range params["ttlnamespace"] {
+		i := strings.LastIndex(v, ",")
+		if i <= 0 {
+			return t, fmt.Errorf("invalid ttlnamespace %q, expected prefix,maxttl", v)
+		}
+		ns := TTLNamespace{Prefix: v[:i]}
+		var err error
+		if ns.MaxTTL, err = time.ParseDuration(v[i+1:]); err != nil || ns.MaxTTL < time.Second || ns.MaxTTL%time.Second != 0 {
+			return t, fmt.Errorf("invalid ttlnamespace maxttl in %q, expected a whole number of seconds", v)
+		}
+		t.Namespaces = append(t.Namespaces, ns)
+	}
+	return t, nil
+}
+
+// negativeCacheMaxTTL is the longest negcachettl, since a key written other
+// than through the proxy goes unseen for that long
+const negativeCacheMaxTTL = time.Second
+
+// parseNegativeCache reads the negcache* params. The negative cache isn't told
+// of the keys that write-behind flushes or read-through populates, so its
+// prefixes can't overlap theirs.
+func parseNegativeCache(params url.Values, wb WriteBehind, rt ReadThrough) (NegativeCache, error) {
+	n := NegativeCache{
+		Prefixes:  getListParam(params, "negcacheprefixes"),
+		MaxBytes:  getIntParam(params, "negcachemaxbytes", 1<<20),
+		Exclusive: getBoolParam(params, "negcacheexclusive", false),
+	}
+	var err error
+	if n.TTL, err = getDurationParam(params, "negcachettl", 50*time.Millisecond); err != nil {
+		return n, err
+	}
+	if len(n.Prefixes) == 0 {
+		return n, nil
+	}
+	if !n.Exclusive {
+		return n, errors.New("negcacheprefixes requires negcacheexclusive=true, acknowledging that the keys are only written through this proxy")
+	}
+	if n.TTL <= 0 || n.TTL > negativeCacheMaxTTL {
+		return n, fmt.Errorf("invalid negcachettl %v, it must be at most %v", n.TTL, negativeCacheMaxTTL)
+	}
+	if n.MaxBytes < 1 {
+		return n, fmt.Errorf("invalid negcachemaxbytes %d", n.MaxBytes)
+	}
+	others := append([]string(nil), wb.Prefixes...)
+	for _, r := range rt.Rules {
+		others = append(others, r.Prefix)
+	}
+	for _, p := range n.Prefixes {
+		if p == "" {
+			return n, errors.New("negcacheprefixes must not contain an empty prefix, which would match every key")
+		}
+		for _, o := range others {
+			if strings.HasPrefix(p, o) || strings.HasPrefix(o, p) {
+				return n, fmt.Errorf("negcacheprefixes %q overlaps the writebehindprefixes or readthrough prefix %q", p, o)
+			}
+		}
+	}
+	return n, nil
+}
+
+var sloName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// parseSLOs reads the slo params, one per SLO
+func parseSLOs(params url.Values) ([]SLO, error) {
+	var slos []SLO
+	names := make(map[string]bool)
+	for _, v := range params["slo"] {
+		parts := strings.Split(v, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid slo %q, expected name,class,threshold,objective", v)
+		}
+		slo := SLO{Name: parts[0], Class: parts[1]}
+		if !sloName.MatchString(slo.Name) || names[slo.Name] {
+			return nil, fmt.Errorf("invalid slo name in %q, expected a unique name of letters, digits, _, . or -", v)
+		}
+		names[slo.Name] = true
+		if slo.Class == "" {
+			return nil, fmt.Errorf("invalid slo class in %q, expected read, write, all or a command", v)
+		}
+		var err error
+		if slo.Threshold, err = time.ParseDuration(parts[2]); err != nil || slo.Threshold <= 0 {
+			return nil, fmt.Errorf("invalid slo threshold in %q", v)
+		}
+		percent, err := strconv.ParseFloat(parts[3], 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return nil, fmt.Errorf("invalid slo objective in %q, expected a percentage between 0 and 100", v)
+		}
+		slo.Objective = percent / 100
+		slos = append(slos, slo)
+	}
+	return slos, nil
+}
+
+var segmentName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// parseSegments reads the poolsegments param, "name:percent,...", and the
+// segmentcommands and segmentprefixes params, "name:item,...", one per segment
+// with a rule
+func parseSegments(params url.Values) (Segments, error) {
+	s := Segments{Borrow: getBoolParam(params, "segmentborrow", false)}
+	var err error
+	if s.Wait, err = getDurationParam(params, "segmentwait", 100*time.Millisecond); err != nil {
+		return s, err
+	}
+	if s.Wait < 0 {
+		return s, fmt.Errorf("invalid segmentwait %v", s.Wait)
+	}
+	v := getStringParam(params, "poolsegments", "")
+	if v == "" {
+		if len(params["segmentcommands"]) > 0 || len(params["segmentprefixes"]) > 0 {
+			return s, errors.New("segmentcommands and segmentprefixes need poolsegments")
+		}
+		return s, nil
+	}
+	shares, err := ParseSegmentShares(v)
+	if err != nil {
+		return s, err
+	}
+	for _, name := range strings.Split(v, ",") {
+		name = name[:strings.Index(name, ":")]
+		s.List = append(s.List, Segment{Name: name, Share: shares[name]})
+	}
+	rule := func(key string, add func(*Segment, []string)) error {
+		for _, r := range params[key] {
+			i := strings.Index(r, ":")
+			if i < 0 || i == len(r)-1 {
+				return fmt.Errorf("invalid %s %q, expected name:item,...", key, r)
+			}
+			seg := s.find(r[:i])
+			if seg == nil {
+				return fmt.Errorf("invalid %s %q, %s is not one of the poolsegments", key, r, r[:i])
+			}
+			add(seg, strings.Split(r[i+1:], ","))
+		}
+		return nil
+	}
+	if err := rule("segmentcommands", func(seg *Segment, items []string) { seg.Commands = append(seg.Commands, items...) }); err != nil {
+		return s, err
+	}
+	if err := rule("segmentprefixes", func(seg *Segment, items []string) { seg.Prefixes = append(seg.Prefixes, items...) }); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+func (s *Segments) find(name string) *Segment {
+	for i := range s.List {
+		if s.List[i].Name == name {
+			return &s.List[i]
+		}
+	}
+	return nil
+}
+
+// ParseSegmentShares parses "name:percent,...", the shares of pool segments,
+// into fractions of the pool. The percentages can't add up to more than 100.
+func ParseSegmentShares(v string) (map[string]float64, error) {
+	shares := make(map[string]float64)
+	var total float64
+	for _, part := range strings.Split(v, ",") {
+		i := strings.Index(part, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid pool segment %q, expected name:percent", part)
+		}
+		name := part[:i]
+		if !segmentName.MatchString(name) || shares[name] > 0 {
+			return nil, fmt.Errorf("invalid pool segment name in %q, expected a unique name of letters, digits, _ or -", part)
+		}
+		percent, err := strconv.ParseFloat(part[i+1:], 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid pool segment share in %q, expected a percentage between 0 and 100", part)
+		}
+		total += percent
+		shares[name] = percent / 100
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("invalid pool segments %q, the shares add up to more than 100%%", v)
+	}
+	return shares, nil
+}
+
+// parseTopology reads the topology* params. Peers are the admin addresses of
+// the other instances, which must be started with -adminaddr to receive them.
+func parseTopology(params url.Values) (Topology, error) {
+	t := Topology{
+		Key:   getStringParam(params, "topologykey", ""),
+		Peers: getListParam(params, "topologypeers"),
+	}
+	var err error
+	if t.Poll, err = getDurationParam(params, "topologypoll", time.Second); err != nil {
+		return t, err
+	}
+	if t.Key != "" && t.Poll <= 0 {
+		return t, fmt.Errorf("invalid topologypoll %v", t.Poll)
+	}
+	for _, peer := range t.Peers {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return t, fmt.Errorf("invalid topologypeers address %q, expected host:port", peer)
+		}
+	}
+	return t, nil
 }
 
 func getStringParam(v url.Values, key, def string) string {
@@ -186,3 +1815,48 @@ func getIntParam(v url.Values, key string, def int) int {
 	}
 	return i
 }
+
+func getFloatParam(v url.Values, key string, def float64) float64 {
+	cl, ok := v[key]
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(cl[0], 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+func getDurationParam(v url.Values, key string, def time.Duration) (time.Duration, error) {
+	cl, ok := v[key]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(cl[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return d, nil
+}
+
+func getBoolParam(v url.Values, key string, def bool) bool {
+	cl, ok := v[key]
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(cl[0])
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// getListParam splits a comma separated param, returning nil if it is absent
+func getListParam(v url.Values, key string) []string {
+	cl, ok := v[key]
+	if !ok || cl[0] == "" {
+		return nil
+	}
+	return strings.Split(cl[0], ",")
+}
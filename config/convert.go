@@ -0,0 +1,185 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Conversion is a legacy invocation, whose upstreams are URLs given as
+// arguments, converted to a config file listing them and the flags to give
+// alongside it
+type Conversion struct {
+	// Config is the config of the legacy invocation
+	Config *Config
+	Flags  []string
+	File   []byte
+}
+
+// Convert converts a legacy invocation of serve, printing its usage to output
+// if its flags or upstreams are invalid. comment, if set, is the comment of
+// each upstream of the file, like the socket path it is served on.
+func Convert(args []string, output io.Writer, comment func(c *Config, u Upstream) string) (*Conversion, error) {
+	c, err := ParseArgs("serve", args, output)
+	if err != nil {
+		return nil, err
+	}
+	if c.ConfigFile != "" {
+		return nil, errors.New("the invocation has a -config file already, only upstreams given as arguments alone are converted")
+	}
+	flags := args[:len(args)-len(c.args)]
+	if n := len(flags); n > 0 && flags[n-1] == "--" {
+		flags = flags[:n-1]
+	}
+
+	entries := &yaml.Node{Kind: yaml.SequenceNode}
+	for i, v := range c.UpstreamArgs() {
+		f, err := fileEntry(v)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %d: %v", i+1, err)
+		}
+		out, err := yaml.Marshal(f)
+		if err != nil {
+			return nil, err
+		}
+		var doc yaml.Node
+		if err := yaml.Unmarshal(out, &doc); err != nil {
+			return nil, err
+		}
+		n := doc.Content[0]
+		if comment != nil {
+			n.HeadComment = comment(c, c.Upstreams[i])
+		}
+		entries.Content = append(entries.Content, n)
+	}
+	root := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{{Kind: yaml.ScalarNode, Value: "upstreams"}, entries}}
+	var b bytes.Buffer
+	e := yaml.NewEncoder(&b)
+	e.SetIndent(2)
+	if err := e.Encode(root); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return &Conversion{Config: c, Flags: append([]string(nil), flags...), File: b.Bytes()}, nil
+}
+
+// fileEntry is the config file entry of an upstream URL, its params having
+// fields of their own set in those unless the URL repeats them or leaves them
+// empty, and a rediss:// URL being given the tls param. URLs with credentials
+// aren't converted, as the file would hold them in clear.
+func fileEntry(v string) (fileUpstream, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return fileUpstream{}, err
+	}
+	if u.User != nil {
+		return fileUpstream{}, fmt.Errorf("%s has credentials in its URL, which the config file would hold in clear, move them to a credentialsfile first", u.Host)
+	}
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return fileUpstream{}, err
+	}
+	f := fileUpstream{Address: u.Host}
+	if len(u.Path) > 1 {
+		db, err := strconv.Atoi(u.Path[1:])
+		if err != nil {
+			return fileUpstream{}, errors.New("failed to parse redis db number from path")
+		}
+		f.DB = &db
+	}
+	if u.Scheme == "rediss" {
+		params.Set("tls", "true")
+	}
+
+	// take removes a param the entry has a field for, unless it can't be set in
+	// the field as is
+	take := func(key string, set func(v string) bool) {
+		if values := params[key]; len(values) == 1 && values[0] != "" && set(values[0]) {
+			params.Del(key)
+		}
+	}
+	take("label", func(v string) bool { f.Label = v; return true })
+	take("identitymode", func(v string) bool { f.Mode = v; return true })
+	take("minpoolsize", func(v string) bool { return setInt(&f.MinPoolSize, v) })
+	take("maxpoolsize", func(v string) bool { return setInt(&f.MaxPoolSize, v) })
+	take("readtimeout", func(v string) bool { return setDuration(&f.ReadTimeout, v) })
+	take("writetimeout", func(v string) bool { return setDuration(&f.WriteTimeout, v) })
+	if len(params) > 0 {
+		f.Params = make(map[string]paramValues, len(params))
+		for k, values := range params {
+			f.Params[k] = values
+		}
+	}
+	return f, nil
+}
+
+func setInt(field **int, v string) bool {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return false
+	}
+	*field = &n
+	return true
+}
+
+// setDuration sets a timeout field, but for 0, which the file reads as unset
+func setDuration(field *time.Duration, v string) bool {
+	d, err := time.ParseDuration(v)
+	if err != nil || d == 0 {
+		return false
+	}
+	*field = d
+	return true
+}
+
+// Diff lists the settings a and b differ in, as "setting: a != b" with the
+// values that may hold credentials left out, upstreams being compared by
+// position. The config file they were read from isn't compared.
+func Diff(a, b *Config) []string {
+	ra, rb := a.redacted(), b.redacted()
+	diffs := diffFields("", reflect.ValueOf(*a), reflect.ValueOf(*b), reflect.ValueOf(ra), reflect.ValueOf(rb), "ConfigFile", "Upstreams")
+	if len(a.Upstreams) != len(b.Upstreams) {
+		return append(diffs, fmt.Sprintf("upstreams: %d != %d", len(a.Upstreams), len(b.Upstreams)))
+	}
+	for i, u := range a.Upstreams {
+		name := u.Label
+		if name == "" {
+			name = u.UpstreamConfigHost
+		}
+		prefix := fmt.Sprintf("upstream %d (%s) ", i+1, name)
+		diffs = append(diffs, diffFields(prefix, reflect.ValueOf(u), reflect.ValueOf(b.Upstreams[i]), reflect.ValueOf(ra.Upstreams[i]), reflect.ValueOf(rb.Upstreams[i]))...)
+	}
+	return diffs
+}
+
+// diffFields compares the exported fields of the structs a and b but those
+// skipped, printing those that differ as they are in ra and rb
+func diffFields(prefix string, a, b, ra, rb reflect.Value, skip ...string) []string {
+	var diffs []string
+	t := a.Type()
+fields:
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		for _, s := range skip {
+			if field.Name == s {
+				continue fields
+			}
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			diffs = append(diffs, fmt.Sprintf("%s%s: %v != %v", prefix, field.Name, ra.Field(i).Interface(), rb.Field(i).Interface()))
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// file is the config file given with -config, which lists upstreams for proxies
+// fronting more of them than are practical to give on the command line
+type file struct {
+	Upstreams []fileUpstream `yaml:"upstreams"`
+}
+
+// fileUpstream is an upstream of the config file. Its settings are those of an
+// upstream URL, the ones most upstreams set having fields of their own, and
+// Params holding any other URL param. Mode is the identitymode the upstream is
+// checked for, cluster or standalone.
+type fileUpstream struct {
+	Address      string                 `yaml:"address"`
+	DB           *int                   `yaml:"db,omitempty"`
+	Label        string                 `yaml:"label,omitempty"`
+	Mode         string                 `yaml:"mode,omitempty"`
+	MinPoolSize  *int                   `yaml:"minpoolsize,omitempty"`
+	MaxPoolSize  *int                   `yaml:"maxpoolsize,omitempty"`
+	ReadTimeout  time.Duration          `yaml:"readtimeout,omitempty"`
+	WriteTimeout time.Duration          `yaml:"writetimeout,omitempty"`
+	Params       map[string]paramValues `yaml:"params,omitempty"`
+}
+
+// paramValues are the values of a param of the config file, a string, or a
+// list of them for the params a URL may repeat, like scriptlimit
+type paramValues []string
+
+func (p *paramValues) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*p = paramValues{value.Value}
+		return nil
+	}
+	var values []string
+	if err := value.Decode(&values); err != nil {
+		return err
+	}
+	*p = values
+	return nil
+}
+
+func (p paramValues) MarshalYAML() (interface{}, error) {
+	if len(p) == 1 {
+		return p[0], nil
+	}
+	return []string(p), nil
+}
+
+// url is the upstream URL the entry stands for, which is parsed like those
+// given on the command line
+func (f fileUpstream) url() (string, error) {
+	if f.Address == "" {
+		return "", errors.New("missing address")
+	}
+	if _, port, err := net.SplitHostPort(f.Address); err != nil || port == "" {
+		return "", fmt.Errorf("invalid address %s, expected host:port", f.Address)
+	}
+	params := url.Values{}
+	for k, values := range f.Params {
+		for _, v := range values {
+			params.Add(k, v)
+		}
+	}
+	set := func(key, value string) error {
+		if _, ok := f.Params[key]; ok {
+			return fmt.Errorf("%s is set both as a field and a param", key)
+		}
+		params.Set(key, value)
+		return nil
+	}
+	fields := []struct {
+		key, value string
+		set        bool
+	}{
+		{"label", f.Label, f.Label != ""},
+		{"identitymode", f.Mode, f.Mode != ""},
+		{"minpoolsize", intString(f.MinPoolSize), f.MinPoolSize != nil},
+		{"maxpoolsize", intString(f.MaxPoolSize), f.MaxPoolSize != nil},
+		{"readtimeout", f.ReadTimeout.String(), f.ReadTimeout != 0},
+		{"writetimeout", f.WriteTimeout.String(), f.WriteTimeout != 0},
+	}
+	for _, field := range fields {
+		if !field.set {
+			continue
+		}
+		if err := set(field.key, field.value); err != nil {
+			return "", err
+		}
+	}
+	u := url.URL{Scheme: "redis", Host: f.Address, RawQuery: params.Encode()}
+	if f.DB != nil {
+		u.Path = "/" + strconv.Itoa(*f.DB)
+	}
+	return u.String(), nil
+}
+
+func intString(i *int) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.Itoa(*i)
+}
+
+// loadUpstreams reads the upstreams of a config file, unknown fields failing it
+// like unknown flags do. An invalid entry is reported with its position in the
+// file and its label or address.
+func loadUpstreams(path string) ([]Upstream, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	defer func() { _ = r.Close() }()
+	d := yaml.NewDecoder(r)
+	d.KnownFields(true)
+	var f file
+	if err := d.Decode(&f); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+
+	upstreams := make([]Upstream, 0, len(f.Upstreams))
+	labels := make(map[string]int)
+	for i, entry := range f.Upstreams {
+		name := entry.Label
+		if name == "" {
+			name = entry.Address
+		}
+		invalid := func(err error) error {
+			return fmt.Errorf("invalid config %s, upstream %d (%s): %v", path, i+1, name, err)
+		}
+		v, err := entry.url()
+		if err != nil {
+			return nil, invalid(err)
+		}
+		us, err := parseUpstream(v)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		if us.Label != "" {
+			if first, ok := labels[us.Label]; ok {
+				return nil, invalid(fmt.Errorf("duplicate label, upstream %d has it too", first))
+			}
+			labels[us.Label] = i + 1
+		}
+		upstreams = append(upstreams, us)
+	}
+	return upstreams, nil
+}
+
+// mergeUpstreams adds the upstreams given on the command line to those of the
+// config file, one for the same address and db replacing the file's
+func mergeUpstreams(fromFile, fromFlags []Upstream) []Upstream {
+	key := func(u Upstream) string { return u.UpstreamConfigHost + "/" + strconv.Itoa(u.Database) }
+	merged := append([]Upstream(nil), fromFile...)
+	index := make(map[string]int, len(merged))
+	for i, u := range merged {
+		index[key(u)] = i
+	}
+	for _, u := range fromFlags {
+		if i, ok := index[key(u)]; ok {
+			merged[i] = u
+			continue
+		}
+		merged = append(merged, u)
+	}
+	return merged
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	path := writeConfig(t, `
+upstreams:
+  - address: cache-a:6379
+    label: cache-a
+    mode: cluster
+    minpoolsize: 2
+    maxpoolsize: 20
+    readtimeout: 2s
+    writetimeout: 3s
+  - address: cache-b:6379
+    db: 3
+    params:
+      retries: "2"
+      readonly: "true"
+      scriptlimit:
+        - checkout,50,2
+        - "*,0,8"
+  - address: cache-c:6379
+`)
+	os.Args = []string{"redisbetween", "-config", path, "redis://cache-c:6379?maxpoolsize=5", "redis://cache-d:6379"}
+	resetFlags()
+	c, err := parseFlags()
+	assert.NoError(t, err)
+	assert.Equal(t, path, c.ConfigFile)
+	assert.Len(t, c.Upstreams, 4)
+
+	a := c.Upstreams[0]
+	assert.Equal(t, "cache-a:6379", a.UpstreamConfigHost)
+	assert.Equal(t, "cache-a", a.Label)
+	assert.Equal(t, "cluster", a.Identity.Mode)
+	assert.Equal(t, -1, a.Database)
+	assert.Equal(t, 2, a.MinPoolSize)
+	assert.Equal(t, 20, a.MaxPoolSize)
+	assert.Equal(t, 2*time.Second, a.ReadTimeout)
+	assert.Equal(t, 3*time.Second, a.WriteTimeout)
+
+	b := c.Upstreams[1]
+	assert.Equal(t, 3, b.Database)
+	assert.Equal(t, 2, b.Retries)
+	assert.True(t, b.ReadOnly)
+	assert.Equal(t, 10, b.MaxPoolSize, "defaults are those of an upstream URL")
+	assert.Equal(t, 5*time.Second, b.ReadTimeout)
+	assert.Len(t, b.Scripts.Limits, 2, "a param a URL repeats is a list")
+
+	// an upstream given as an argument replaces the file's for the same address
+	assert.Equal(t, "cache-c:6379", c.Upstreams[2].UpstreamConfigHost)
+	assert.Equal(t, 5, c.Upstreams[2].MaxPoolSize)
+	assert.Equal(t, "cache-d:6379", c.Upstreams[3].UpstreamConfigHost)
+}
+
+func TestInvalidConfigFile(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	for contents, expected := range map[string]string{
+		"upstreams:\n  - address: cache-a:6379\n    label: cache\n  - address: cache-b:6379\n    label: cache\n": "upstream 2 (cache): duplicate label, upstream 1 has it too",
+		"upstreams:\n  - address: cache-a:6379\n  - address: cache-b:99999\n":                                    "upstream 2 (cache-b:99999): invalid port 99999",
+		"upstreams:\n  - address: cache-a\n":                                                                     "upstream 1 (cache-a): invalid address cache-a, expected host:port",
+		"upstreams:\n  - label: cache\n":                                                                         "upstream 1 (cache): missing address",
+		"upstreams:\n  - address: cache-a:6379\n    label: cache\n    params:\n      label: other\n":             "upstream 1 (cache): label is set both as a field and a param",
+		"upstreams:\n  - address: cache-a:6379\n    mode: sentinel\n":                                            "upstream 1 (cache-a:6379): invalid identitymode: sentinel",
+	} {
+		path := writeConfig(t, contents)
+		os.Args = []string{"redisbetween", "-config", path}
+		resetFlags()
+		_, err := parseFlags()
+		assert.EqualError(t, err, "invalid config "+path+", "+expected)
+	}
+
+	path := writeConfig(t, "upstreams:\n  - address: cache-a:6379\n    maxpoolsise: 10\n")
+	os.Args = []string{"redisbetween", "-config", path}
+	resetFlags()
+	_, err := parseFlags()
+	assert.EqualError(t, err, "invalid config "+path+": yaml: unmarshal errors:\n  line 3: field maxpoolsise not found in type config.fileUpstream")
+
+	os.Args = []string{"redisbetween", "-config", filepath.Join(t.TempDir(), "missing.yaml")}
+	resetFlags()
+	_, err = parseFlags()
+	assert.Contains(t, err.Error(), "invalid config: open ")
+
+	path = writeConfig(t, "upstreams:\n  - address: cache-a:6379\n")
+	os.Args = []string{"redisbetween", "-config", path, "redis://cache-b:6379|redis://cache-b:6379"}
+	resetFlags()
+	_, err = parseFlags()
+	assert.EqualError(t, err, "duplicate entry for address: cache-b:6379")
+}
+
+func TestReloadUpstreams(t *testing.T) {
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+	path := writeConfig(t, "upstreams:\n  - address: cache-a:6379\n  - address: cache-b:6379\n")
+	os.Args = []string{"redisbetween", "-config", path, "redis://cache-c:6379"}
+	resetFlags()
+	c, err := parseFlags()
+	assert.NoError(t, err)
+	assert.Len(t, c.Upstreams, 3)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("upstreams:\n  - address: cache-a:6379\n    maxpoolsize: 20\n  - address: cache-d:6379\n"), 0600))
+	upstreams, err := c.ReloadUpstreams()
+	assert.NoError(t, err)
+	hosts := make([]string, len(upstreams))
+	for i, u := range upstreams {
+		hosts[i] = u.UpstreamConfigHost
+	}
+	assert.Equal(t, []string{"cache-a:6379", "cache-d:6379", "cache-c:6379"}, hosts, "the arguments are read again along with the file")
+	assert.Equal(t, 20, upstreams[0].MaxPoolSize)
+	assert.Len(t, c.Upstreams, 3, "the config is left as it was")
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("upstreams:\n  - address: cache-a\n"), 0600))
+	_, err = c.ReloadUpstreams()
+	assert.EqualError(t, err, "invalid config "+path+", upstream 1 (cache-a): invalid address cache-a, expected host:port")
+}
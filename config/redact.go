@@ -0,0 +1,87 @@
+package config
+
+import "net/url"
+
+// Redacted returns the config as included in support bundles. Values that may
+// hold credentials, which are the userinfo and query of read-through endpoints
+// and the auth verifier, the static auth provider's passwords, the upstream
+// and mirror passwords and the admin token, are left out, and the
+// deprecatedclients regexp is given as its source.
+func (c *Config) Redacted() interface{} {
+	cp := c.redacted()
+	var deprecated string
+	if c.DeprecatedClients != nil {
+		deprecated = c.DeprecatedClients.String()
+	}
+	return struct {
+		*Config
+		DeprecatedClients string
+	}{&cp, deprecated}
+}
+
+// redacted is a copy of the config with the values that may hold credentials
+// left out
+func (c *Config) redacted() Config {
+	cp := *c
+	cp.ClientAuth.URL = redactURL(c.ClientAuth.URL)
+	if c.AdminAuth.Token != "" {
+		cp.AdminAuth.Token = "(redacted)"
+	}
+	if c.ClientAuth.Users != nil {
+		cp.ClientAuth.Users = make(map[string]string, len(c.ClientAuth.Users))
+		for user := range c.ClientAuth.Users {
+			cp.ClientAuth.Users[user] = "(redacted)"
+		}
+	}
+	cp.Upstreams = make([]Upstream, len(c.Upstreams))
+	for i, u := range c.Upstreams {
+		rules := make([]ReadThroughRule, len(u.ReadThrough.Rules))
+		for j, r := range u.ReadThrough.Rules {
+			r.Endpoint = redactURL(r.Endpoint)
+			rules[j] = r
+		}
+		u.ReadThrough.Rules = rules
+		if u.Credentials.Password != "" {
+			u.Credentials.Password = "(redacted)"
+		}
+		if u.Mirror.Credentials.Password != "" {
+			u.Mirror.Credentials.Password = "(redacted)"
+		}
+		cp.Upstreams[i] = u
+	}
+	return cp
+}
+
+// Hosts returns the hosts the config refers to, for support bundles to hash
+func (c *Config) Hosts() []string {
+	hosts := []string{c.Statsd}
+	if c.ClientAuth.URL != "" {
+		if e, err := url.Parse(c.ClientAuth.URL); err == nil {
+			hosts = append(hosts, e.Host)
+		}
+	}
+	for _, u := range c.Upstreams {
+		hosts = append(hosts, u.UpstreamConfigHost)
+		hosts = append(hosts, u.Topology.Peers...)
+		if u.Mirror.Address != "" {
+			hosts = append(hosts, u.Mirror.Address)
+		}
+		for _, r := range u.ReadThrough.Rules {
+			if e, err := url.Parse(r.Endpoint); err == nil {
+				hosts = append(hosts, e.Host)
+			}
+		}
+	}
+	return hosts
+}
+
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "(unparseable)"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
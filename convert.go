@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/proxy"
+)
+
+// configCommand implements `redisbetween config`, whose only subcommand so far
+// is convert
+func configCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "convert" {
+		_, _ = fmt.Fprintf(stderr, "Usage: redisbetween config convert [-out upstreams.yaml] [-compare upstreams.yaml] -- [OPTIONS] uri1 [uri2] ...\n")
+		return 2
+	}
+	return convertConfig(args[1:], stdout, stderr)
+}
+
+// convertConfig implements `redisbetween config convert`, which converts the
+// upstream URLs of a legacy invocation of serve, given after --, to a config
+// file, and prints the invocation using it. The config of the converted
+// invocation is compared to that of the legacy one, socket paths included, or
+// with -compare that of an existing file is instead. It returns the process
+// exit code: 1 if the two configs differ in anything.
+func convertConfig(args []string, stdout, stderr io.Writer) int {
+	var out, compare string
+	fs := flag.NewFlagSet("config convert", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "Usage: redisbetween config convert [-out upstreams.yaml] [-compare upstreams.yaml] -- [OPTIONS] uri1 [uri2] ...\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&out, "out", "", "File to write the config file to. Defaults to stdout")
+	fs.StringVar(&compare, "compare", "", "Existing config file to compare with the legacy invocation, instead of converting it")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	legacy := fs.Args()
+	if len(legacy) > 0 && legacy[0] == "serve" {
+		legacy = legacy[1:]
+	}
+	if len(legacy) == 0 || (out != "" && compare != "") {
+		fs.Usage()
+		return 2
+	}
+
+	conv, err := config.Convert(legacy, stderr, func(c *config.Config, u config.Upstream) string {
+		return "socket " + proxy.LocalSocketPath(c, u)
+	})
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 2
+	}
+	path := compare
+	switch {
+	case compare != "":
+	case out != "":
+		if err := ioutil.WriteFile(out, conv.File, 0644); err != nil {
+			_, _ = fmt.Fprintln(stderr, err)
+			return 2
+		}
+		path = out
+	default:
+		_, _ = stdout.Write(conv.File)
+		// the converted invocation is still loaded from a file to be compared
+		f, err := ioutil.TempFile("", "redisbetween-convert-*.yaml")
+		if err == nil {
+			_, err = f.Write(conv.File)
+			_ = f.Close()
+			defer func() { _ = os.Remove(f.Name()) }()
+		}
+		if err != nil {
+			_, _ = fmt.Fprintln(stderr, err)
+			return 2
+		}
+		path = f.Name()
+	}
+
+	flags := append(append([]string(nil), conv.Flags...), "-config", path)
+	converted, err := config.ParseArgs("serve", flags, stderr)
+	if err != nil {
+		return 1
+	}
+	diffs := config.Diff(conv.Config, converted)
+	for i, u := range conv.Config.Upstreams {
+		if i >= len(converted.Upstreams) {
+			break
+		}
+		if a, b := proxy.LocalSocketPath(conv.Config, u), proxy.LocalSocketPath(converted, converted.Upstreams[i]); a != b {
+			diffs = append(diffs, fmt.Sprintf("upstream %d socket: %s != %s", i+1, a, b))
+		}
+	}
+	if compare == "" && out == "" {
+		// the file is the one printed to stdout
+		flags[len(flags)-1] = "<file>"
+	}
+	_, _ = fmt.Fprintf(stderr, "redisbetween %s\n", shellJoin(flags))
+	if len(diffs) > 0 {
+		_, _ = fmt.Fprintf(stderr, "%d differences with the legacy invocation:\n", len(diffs))
+		for _, d := range diffs {
+			_, _ = fmt.Fprintf(stderr, "  %s\n", d)
+		}
+		return 1
+	}
+	_, _ = fmt.Fprintf(stderr, "identical to the legacy invocation, %d upstreams\n", len(converted.Upstreams))
+	return 0
+}
+
+// shellJoin joins args into a command line, quoting those the shell would split
+// or expand
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\n\"'\\|&;<>()$`*?[]#~{}!") {
+			a = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+		}
+		quoted[i] = a
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,117 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// minDeregisterAfter is the shortest time Consul accepts before it removes a
+// service whose check is critical
+const minDeregisterAfter = time.Minute
+
+// Consul registers listeners as services of the local Consul agent at Address,
+// e.g. http://127.0.0.1:8500, each with a TTL check. The agent removes a service
+// whose check has been critical for ten TTLs, or a minute, so that a proxy that
+// crashed without deregistering is dropped eventually.
+type Consul struct {
+	Address string
+	// Token is the ACL token sent with every request, if any
+	Token  string
+	Client *http.Client
+}
+
+// NewConsul makes a registrar for the agent at address
+func NewConsul(address, token string) *Consul {
+	return &Consul{Address: strings.TrimSuffix(address, "/"), Token: token, Client: &http.Client{}}
+}
+
+type consulService struct {
+	ID      string
+	Name    string
+	Address string
+	Port    int               `json:",omitempty"`
+	Tags    []string          `json:",omitempty"`
+	Meta    map[string]string `json:",omitempty"`
+	Check   consulCheck
+}
+
+type consulCheck struct {
+	CheckID                        string
+	Name                           string
+	TTL                            string
+	DeregisterCriticalServiceAfter string
+}
+
+func checkID(id string) string {
+	return "service:" + id
+}
+
+func (c *Consul) Register(ctx context.Context, r Registration, ttl time.Duration) error {
+	deregisterAfter := 10 * ttl
+	if deregisterAfter < minDeregisterAfter {
+		deregisterAfter = minDeregisterAfter
+	}
+	return c.put(ctx, "/v1/agent/service/register", consulService{
+		ID:      r.ID,
+		Name:    r.Name,
+		Address: r.Address,
+		Port:    r.Port,
+		Tags:    r.Tags,
+		Meta:    r.Meta,
+		Check: consulCheck{
+			CheckID:                        checkID(r.ID),
+			Name:                           "redisbetween health",
+			TTL:                            ttl.String(),
+			DeregisterCriticalServiceAfter: deregisterAfter.String(),
+		},
+	})
+}
+
+func (c *Consul) Heartbeat(ctx context.Context, id string, healthy bool, output string) error {
+	status := "passing"
+	if !healthy {
+		status = "critical"
+	}
+	return c.put(ctx, "/v1/agent/check/update/"+url.PathEscape(checkID(id)), map[string]string{"Status": status, "Output": output})
+}
+
+func (c *Consul) Deregister(ctx context.Context, id string) error {
+	return c.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(id), nil)
+}
+
+func (c *Consul) put(ctx context.Context, path string, body interface{}) error {
+	var b io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		b = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(http.MethodPut, c.Address+path, b)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("consul %s: %s: %s", path, res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
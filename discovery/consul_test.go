@@ -0,0 +1,67 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsul(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	var bodies []map[string]interface{}
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath()+" "+r.Header.Get("X-Consul-Token"))
+		var body map[string]interface{}
+		b, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(b, &body)
+		bodies = append(bodies, body)
+		if r.URL.Path == "/v1/agent/check/update/service:missing" {
+			http.Error(w, `Unknown check ID "service:missing"`, http.StatusNotFound)
+		}
+	}))
+	defer agent.Close()
+
+	c := NewConsul(agent.URL+"/", "t0ken")
+	ctx := context.Background()
+	assert.NoError(t, c.Register(ctx, Registration{
+		ID:      "redisbetween-var-tmp-redisbetween-10.0.0.1-6379.sock",
+		Name:    "sessions",
+		Address: "/var/tmp/redisbetween-10.0.0.1-6379.sock",
+		Tags:    []string{"redisbetween", "unix"},
+		Meta:    map[string]string{"upstream": "10.0.0.1:6379", "db": "-1", "version": "v1.2.0"},
+	}, 15*time.Second))
+	assert.NoError(t, c.Heartbeat(ctx, "redisbetween-var-tmp-redisbetween-10.0.0.1-6379.sock", false, "draining"))
+	assert.EqualError(t, c.Heartbeat(ctx, "missing", true, "ok"), `consul /v1/agent/check/update/service:missing: 404 Not Found: Unknown check ID "service:missing"`)
+	assert.NoError(t, c.Deregister(ctx, "redisbetween-var-tmp-redisbetween-10.0.0.1-6379.sock"))
+
+	assert.Equal(t, []string{
+		"PUT /v1/agent/service/register t0ken",
+		"PUT /v1/agent/check/update/service:redisbetween-var-tmp-redisbetween-10.0.0.1-6379.sock t0ken",
+		"PUT /v1/agent/check/update/service:missing t0ken",
+		"PUT /v1/agent/service/deregister/redisbetween-var-tmp-redisbetween-10.0.0.1-6379.sock t0ken",
+	}, requests)
+	assert.Equal(t, map[string]interface{}{
+		"ID":      "redisbetween-var-tmp-redisbetween-10.0.0.1-6379.sock",
+		"Name":    "sessions",
+		"Address": "/var/tmp/redisbetween-10.0.0.1-6379.sock",
+		"Tags":    []interface{}{"redisbetween", "unix"},
+		"Meta":    map[string]interface{}{"upstream": "10.0.0.1:6379", "db": "-1", "version": "v1.2.0"},
+		"Check": map[string]interface{}{
+			"CheckID":                        "service:redisbetween-var-tmp-redisbetween-10.0.0.1-6379.sock",
+			"Name":                           "redisbetween health",
+			"TTL":                            "15s",
+			"DeregisterCriticalServiceAfter": "2m30s",
+		},
+	}, bodies[0])
+	assert.Equal(t, map[string]interface{}{"Status": "critical", "Output": "draining"}, bodies[1])
+}
@@ -0,0 +1,187 @@
+// Package discovery registers the proxy's listeners with a service discovery
+// backend, so that clients that look their endpoints up there find the proxy's
+// sockets without a second copy of the mapping to maintain.
+package discovery
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"go.uber.org/zap"
+)
+
+// requestTimeout bounds each call to the backend
+const requestTimeout = 5 * time.Second
+
+// Registration is one listener as a backend knows it. Address is the socket
+// path of unix listeners, with no Port, or the host of tcp ones.
+type Registration struct {
+	ID      string
+	Name    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+}
+
+// Registrar is a service discovery backend. Register registers a listener with
+// a health check that fails unless it is updated by Heartbeat at least every
+// ttl, and Deregister removes it along with its check.
+type Registrar interface {
+	Register(ctx context.Context, r Registration, ttl time.Duration) error
+	Heartbeat(ctx context.Context, id string, healthy bool, output string) error
+	Deregister(ctx context.Context, id string) error
+}
+
+// Publisher keeps a Registrar in step with the listeners of the process: it
+// registers those that start, heartbeats those registered with the health of
+// the process, and deregisters those that stop, and every listener left on
+// Close. A failed call is logged and counted, and tried again on the next tick,
+// a third of the TTL later, so that the backend being down never holds the
+// proxy up.
+type Publisher struct {
+	log           *zap.Logger
+	statsd        *statsd.Client
+	registrar     Registrar
+	ttl           time.Duration
+	registrations func() []Registration
+	health        func() (bool, string)
+
+	mu         sync.Mutex
+	registered map[string]Registration
+	refresh    chan struct{}
+	quit       chan struct{}
+	done       chan struct{}
+}
+
+// NewPublisher makes a publisher of the listeners registrations returns, whose
+// checks pass while health does
+func NewPublisher(log *zap.Logger, sd *statsd.Client, registrar Registrar, ttl time.Duration, registrations func() []Registration, health func() (bool, string)) *Publisher {
+	return &Publisher{
+		log:           log,
+		statsd:        sd,
+		registrar:     registrar,
+		ttl:           ttl,
+		registrations: registrations,
+		health:        health,
+		registered:    make(map[string]Registration),
+		refresh:       make(chan struct{}, 1),
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// Run syncs the registrations until Close
+func (p *Publisher) Run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.ttl / 3)
+	defer ticker.Stop()
+	for {
+		p.sync()
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+		case <-p.refresh:
+		}
+	}
+}
+
+// Refresh syncs the registrations right away, as listeners start or stop,
+// rather than on the next tick
+func (p *Publisher) Refresh() {
+	select {
+	case p.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Publisher) sync() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	healthy, output := p.health()
+	want := make(map[string]Registration)
+	for _, r := range p.registrations() {
+		want[r.ID] = r
+	}
+	for id := range p.registered {
+		if _, ok := want[id]; !ok {
+			p.deregister(id)
+		}
+	}
+	for id, r := range want {
+		if registered, ok := p.registered[id]; !ok || !reflect.DeepEqual(registered, r) {
+			if !p.register(r) {
+				continue
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		err := p.registrar.Heartbeat(ctx, id, healthy, output)
+		cancel()
+		if err != nil {
+			// the backend may have lost it, e.g. to a restart, so it is
+			// registered again on the next tick
+			p.log.Warn("Failed to update listener health check", zap.String("id", id), zap.Error(err))
+			metrics.DiscoveryHeartbeats.Incr(p.statsd, "failed")
+			delete(p.registered, id)
+			continue
+		}
+		metrics.DiscoveryHeartbeats.Incr(p.statsd, "ok")
+	}
+	metrics.DiscoveryRegistered.Set(p.statsd, float64(len(p.registered)))
+}
+
+// register must be called with mu held
+func (p *Publisher) register(r Registration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := p.registrar.Register(ctx, r, p.ttl); err != nil {
+		p.log.Warn("Failed to register listener, retrying", zap.String("id", r.ID), zap.String("name", r.Name), zap.Error(err))
+		metrics.DiscoveryRegistrations.Incr(p.statsd, "failed")
+		return false
+	}
+	p.log.Info("Registered listener", zap.String("id", r.ID), zap.String("name", r.Name), zap.String("address", r.Address), zap.Int("port", r.Port))
+	metrics.DiscoveryRegistrations.Incr(p.statsd, "ok")
+	p.registered[r.ID] = r
+	return true
+}
+
+// deregister must be called with mu held
+func (p *Publisher) deregister(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := p.registrar.Deregister(ctx, id); err != nil {
+		// its check stops passing, and the backend drops it eventually
+		p.log.Warn("Failed to deregister listener", zap.String("id", id), zap.Error(err))
+		metrics.DiscoveryRegistrations.Incr(p.statsd, "deregister_failed")
+	} else {
+		metrics.DiscoveryRegistrations.Incr(p.statsd, "deregistered")
+	}
+	delete(p.registered, id)
+}
+
+// Close stops syncing and deregisters every listener, before clients are told
+// to go elsewhere by the listeners closing
+func (p *Publisher) Close(ctx context.Context) error {
+	select {
+	case <-p.quit:
+	default:
+		close(p.quit)
+	}
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id := range p.registered {
+		p.deregister(id)
+	}
+	metrics.DiscoveryRegistered.Set(p.statsd, 0)
+	return nil
+}
@@ -0,0 +1,122 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeRegistrar keeps registrations in memory, failing the first failRegisters
+// calls to Register
+type fakeRegistrar struct {
+	sync.Mutex
+	services      map[string]Registration
+	checks        map[string]string
+	ttls          map[string]time.Duration
+	failRegisters int
+	registers     int
+}
+
+func newFakeRegistrar(failRegisters int) *fakeRegistrar {
+	return &fakeRegistrar{services: make(map[string]Registration), checks: make(map[string]string), ttls: make(map[string]time.Duration), failRegisters: failRegisters}
+}
+
+func (f *fakeRegistrar) Register(_ context.Context, r Registration, ttl time.Duration) error {
+	f.Lock()
+	defer f.Unlock()
+	f.registers++
+	if f.registers <= f.failRegisters {
+		return errors.New("connection refused")
+	}
+	f.services[r.ID] = r
+	f.checks[r.ID] = "critical"
+	f.ttls[r.ID] = ttl
+	return nil
+}
+
+func (f *fakeRegistrar) Heartbeat(_ context.Context, id string, healthy bool, output string) error {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.services[id]; !ok {
+		return fmt.Errorf("unknown check %s", id)
+	}
+	f.checks[id] = "critical: " + output
+	if healthy {
+		f.checks[id] = "passing: " + output
+	}
+	return nil
+}
+
+func (f *fakeRegistrar) Deregister(_ context.Context, id string) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.services, id)
+	delete(f.checks, id)
+	return nil
+}
+
+func (f *fakeRegistrar) snapshot() map[string]string {
+	f.Lock()
+	defer f.Unlock()
+	checks := make(map[string]string, len(f.checks))
+	for id, c := range f.checks {
+		checks[id] = c
+	}
+	return checks
+}
+
+func TestPublisher(t *testing.T) {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	registrar := newFakeRegistrar(2)
+
+	var mu sync.Mutex
+	listeners := []Registration{
+		{ID: "a", Name: "sessions", Address: "/var/tmp/redisbetween-a.sock", Meta: map[string]string{"upstream": "10.0.0.1:6379"}},
+		{ID: "b", Name: "sessions", Address: "/var/tmp/redisbetween-b.sock", Meta: map[string]string{"upstream": "10.0.0.2:6379"}},
+	}
+	healthy, status := true, "ok"
+	p := NewPublisher(zap.NewNop(), sd, registrar, 30*time.Millisecond, func() []Registration {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Registration(nil), listeners...)
+	}, func() (bool, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return healthy, status
+	})
+	go p.Run()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(map[string]string{"a": "passing: ok", "b": "passing: ok"}, registrar.snapshot())
+	}, time.Second, time.Millisecond, "failed registrations are retried")
+	assert.Equal(t, 30*time.Millisecond, registrar.ttls["a"])
+
+	mu.Lock()
+	healthy, status = false, "draining"
+	mu.Unlock()
+	assert.Eventually(t, func() bool {
+		return registrar.snapshot()["a"] == "critical: draining"
+	}, time.Second, time.Millisecond, "checks follow the health of the process")
+
+	// a listener stopped on a reload, and the agent restarted and forgot the other
+	mu.Lock()
+	listeners = listeners[1:]
+	healthy, status = true, "ok"
+	mu.Unlock()
+	_ = registrar.Deregister(context.Background(), "b")
+	p.Refresh()
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(map[string]string{"b": "passing: ok"}, registrar.snapshot())
+	}, time.Second, time.Millisecond, "stopped listeners are deregistered, and lost ones registered again")
+
+	assert.NoError(t, p.Close(context.Background()))
+	assert.Empty(t, registrar.snapshot(), "every listener is deregistered on close")
+}
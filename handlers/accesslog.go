@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// AccessLogOptions configure the access log: a SampleRate of the requests
+// answered are logged, and with Errors, every one answered with an error, with
+// the first KeyBytes bytes of their first key
+type AccessLogOptions struct {
+	SampleRate float64
+	Errors     bool
+	KeyBytes   int
+}
+
+// AccessLog logs the requests answered by an upstream's listeners to a logger
+// of their own: the socket and client a request came from, its first command
+// and key, the kind of its reply and how long it took. Only names and the
+// first key are logged, never the values a request writes. A nil AccessLog
+// logs nothing, and costs a request nothing either.
+type AccessLog struct {
+	log         *zap.Logger
+	opts        AccessLogOptions
+	sampleEvery uint64
+	requests    uint64
+}
+
+// NewAccessLog returns an access log writing to log
+func NewAccessLog(log *zap.Logger, opts AccessLogOptions) *AccessLog {
+	a := &AccessLog{log: log, opts: opts}
+	if opts.SampleRate > 0 {
+		a.sampleEvery = uint64(1 / opts.SampleRate)
+		if a.sampleEvery < 1 {
+			a.sampleEvery = 1
+		}
+	}
+	return a
+}
+
+// observe logs the request wm of the commands cmds, answered with replies
+// elapsed after it was read, if it is sampled or answered with an error
+func (a *AccessLog) observe(c *connection, wm []*redis.Message, cmds []string, replies []*redis.Message, elapsed time.Duration) {
+	if a == nil || len(cmds) == 0 || len(wm) == 0 {
+		return
+	}
+	reply := replyKind(replies)
+	sampled := a.sampleEvery > 0 && atomic.AddUint64(&a.requests, 1)%a.sampleEvery == 0
+	if !sampled && !(a.opts.Errors && reply == "error") {
+		return
+	}
+	fields := make([]zap.Field, 0, 10)
+	fields = append(fields, zap.String("socket", c.address), zap.Uint64("client", c.id))
+	fields = append(fields, c.peer()...)
+	fields = append(fields, zap.String("upstream", c.opts.Upstream), zap.String("command", cmds[0]), zap.Int("commands", len(cmds)))
+	if m := wm[0]; m.IsArray() && len(m.Array) > 0 {
+		if key, ok := c.opts.Keys.FirstKey(cmds[0], m); ok {
+			fields = append(fields, zap.String("key", a.key(key)), zap.Int("key_length", len(key)))
+		}
+	}
+	fields = append(fields, zap.String("reply", reply), zap.Duration("duration", elapsed))
+	a.log.Info("Request", fields...)
+}
+
+// key is what is logged of a key: its first KeyBytes bytes
+func (a *AccessLog) key(key []byte) string {
+	if len(key) > a.opts.KeyBytes {
+		key = key[:a.opts.KeyBytes]
+	}
+	return string(key)
+}
+
+// replyKind is error if a reply of a request is an error, nil if its first is
+// nil, and ok otherwise
+func replyKind(replies []*redis.Message) string {
+	for _, r := range replies {
+		if r != nil && r.IsError() {
+			return "error"
+		}
+	}
+	if len(replies) > 0 {
+		if r := replies[0]; r != nil && (r.Type == redis.TypeNull || (r.IsBulkBytes() && r.Value == nil) || (r.IsArray() && r.Array == nil && !r.Unparsed())) {
+			return "nil"
+		}
+	}
+	return "ok"
+}
+
+// peer is who the client is, in the access log: the pid and uid of its process,
+// if the socket tells them, or its address
+func (c *connection) peer() []zap.Field {
+	if !c.peerRead {
+		c.peerRead = true
+		c.peerPID, c.peerUID, c.peerKnown = peerCred(c.conn)
+	}
+	if c.peerKnown {
+		return []zap.Field{zap.Int32("peer_pid", c.peerPID), zap.Uint32("peer_uid", c.peerUID)}
+	}
+	if addr := c.clientAddr(); addr != "" {
+		return []zap.Field{zap.String("peer", addr)}
+	}
+	return nil
+}
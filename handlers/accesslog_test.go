@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAccessLog(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		switch {
+		case strings.ToUpper(args[0]) == "FAIL":
+			return redis.NewErrorf("ERR failed")
+		case len(args) > 1 && args[1] == "missing":
+			return redis.NewBulkBytes(nil)
+		}
+		return echoKey(args)
+	})
+	t.Cleanup(upstream.Close)
+	core, logs := observer.New(zapcore.InfoLevel)
+	client := closingTestConnection(t, upstream.Address(), Options{
+		Upstream:  upstream.Address(),
+		AccessLog: NewAccessLog(zap.New(core), AccessLogOptions{SampleRate: 0.5, Errors: true, KeyBytes: 8}),
+	})
+
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	roundTripStrings(t, client, 1, respCommand("GET", "a"))
+	roundTripStrings(t, client, 1, respCommand("SET", "averyveryverylongkey", "s3cret"))
+	roundTripStrings(t, client, 1, respCommand("FAIL", "x"))
+	roundTripStrings(t, client, 1, respCommand("GET", "missing"))
+	roundTripStrings(t, client, 4, start, respCommand("GET", "a"), respCommand("GET", "b"), end)
+	roundTripStrings(t, client, 1, respCommand("PING"))
+
+	// one in two requests is sampled, and the error is logged anyway
+	// the request is logged once its reply is written
+	if !assert.Eventually(t, func() bool { return logs.Len() == 4 }, time.Second, time.Millisecond) {
+		return
+	}
+	entries := logs.All()
+	for i, want := range []map[string]interface{}{
+		{"command": "SET", "commands": int64(1), "key": "averyver", "key_length": int64(20), "reply": "ok"},
+		{"command": "FAIL", "commands": int64(1), "key": "x", "key_length": int64(1), "reply": "error"},
+		{"command": "GET", "commands": int64(1), "key": "missing", "key_length": int64(7), "reply": "nil"},
+		{"command": "PING", "commands": int64(1), "reply": "ok"},
+	} {
+		fields := entries[i].ContextMap()
+		assert.Equal(t, "Request", entries[i].Message)
+		assert.Equal(t, "test", fields["socket"])
+		assert.Equal(t, uint64(1), fields["client"])
+		assert.Equal(t, "pipe", fields["peer"])
+		assert.Equal(t, upstream.Address(), fields["upstream"])
+		assert.IsType(t, time.Duration(0), fields["duration"])
+		for k, v := range want {
+			assert.Equal(t, v, fields[k], "%d %s", i, k)
+		}
+		if _, ok := want["key"]; !ok {
+			assert.NotContains(t, fields, "key")
+		}
+		for _, v := range fields {
+			assert.NotEqual(t, "s3cret", v, "values are never logged")
+		}
+	}
+}
+
+func TestReplyKind(t *testing.T) {
+	assert.Equal(t, "ok", replyKind(nil))
+	assert.Equal(t, "nil", replyKind([]*redis.Message{redis.NewBulkBytes(nil), redis.NewString([]byte("OK"))}))
+	assert.Equal(t, "nil", replyKind([]*redis.Message{{Type: redis.TypeNull}}))
+	assert.Equal(t, "error", replyKind([]*redis.Message{redis.NewBulkBytes(nil), redis.NewErrorf("ERR x")}), "an error anywhere makes the request's")
+	assert.Equal(t, "ok", replyKind([]*redis.Message{redis.NewBulkBytes([]byte{}), nil}))
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"bytes"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// DefaultUpstreamUser is the ACL user of upstream connections that never AUTH
+const DefaultUpstreamUser = "default"
+
+var aclErrorCodes = [][]byte{[]byte("NOPERM"), []byte("WRONGPASS")}
+
+// aclErrorCode returns the error code of an upstream ACL rejection, or nil if m
+// is not one
+func aclErrorCode(m *redis.Message) []byte {
+	if !m.IsError() {
+		return nil
+	}
+	for _, code := range aclErrorCodes {
+		if bytes.HasPrefix(m.Value, code) && (len(m.Value) == len(code) || m.Value[len(code)] == ' ') {
+			return code
+		}
+	}
+	return nil
+}
+
+// checkACLErrors counts upstream ACL rejections by command, and if enabled adds
+// proxy context to their text. The error code stays first, so client libraries
+// still classify the error correctly.
+func (c *connection) checkACLErrors(cmds []string, res []*redis.Message) {
+	for i, m := range res {
+		code := aclErrorCode(m)
+		if code == nil {
+			continue
+		}
+		metrics.UpstreamACLErrors.Incr(c.statsd, string(code), cmds[i])
+		if c.opts.EnrichACLErrors {
+			res[i] = redis.NewErrorf("%s (redisbetween: rejected by upstream %s for user '%s'; this is a server-side redis ACL, not a proxy rule)",
+				m.Value, c.opts.Upstream, c.upstreamUser())
+		}
+	}
+}
+
+func (c *connection) upstreamUser() string {
+	if c.opts.UpstreamUser != "" {
+		return c.opts.UpstreamUser
+	}
+	return DefaultUpstreamUser
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLErrorCode(t *testing.T) {
+	assert.Equal(t, []byte("NOPERM"), aclErrorCode(redis.NewErrorf("NOPERM this user has no permissions to run the 'get' command")))
+	assert.Equal(t, []byte("WRONGPASS"), aclErrorCode(redis.NewErrorf("WRONGPASS invalid username-password pair")))
+	assert.Nil(t, aclErrorCode(redis.NewErrorf("NOPERMS something else")))
+	assert.Nil(t, aclErrorCode(redis.NewErrorf("ERR wrong number of arguments")))
+	assert.Nil(t, aclErrorCode(redis.NewString([]byte("NOPERM"))))
+}
+
+func TestEnrichACLErrors(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "FLUSHALL" {
+			return redis.NewErrorf("NOPERM this user has no permissions to run the 'flushall' command")
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+
+	for _, enrich := range []bool{false, true} {
+		client := runTestConnection(t, upstream.Address(), Options{Upstream: "10.0.0.1:6379", EnrichACLErrors: enrich})
+		actual := roundTripStrings(t, client, 4,
+			respCommand("GET", string(PipelineSignalStartKey)),
+			respCommand("GET", "a"),
+			respCommand("FLUSHALL"),
+			respCommand("GET", string(PipelineSignalEndKey)),
+		)
+		expected := "-NOPERM this user has no permissions to run the 'flushall' command \\r\\n "
+		if enrich {
+			expected = "-NOPERM this user has no permissions to run the 'flushall' command (redisbetween: rejected by upstream 10.0.0.1:6379 " +
+				"for user 'default'; this is a server-side redis ACL, not a proxy rule) \\r\\n "
+		}
+		assert.Equal(t, []string{"$-1 \\r\\n ", "$7 \\r\\n a-value \\r\\n ", expected, "$-1 \\r\\n "}, actual)
+		_ = client.Close()
+	}
+}
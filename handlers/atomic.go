@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// DefaultAtomicMaxCommands is the most commands a PROXY ATOMIC group may enclose
+// when AtomicMaxCommands isn't set
+const DefaultAtomicMaxCommands = 100
+
+// atomicLocal are the commands a PROXY ATOMIC group can't enclose, since the
+// proxy answers them itself or they would change the pooled connection the
+// transaction is sent on
+var atomicLocal = map[string]bool{
+	"AUTH":           true,
+	"CLIENT GETNAME": true,
+	"CLIENT ID":      true,
+	"CLIENT INFO":    true,
+	"CLIENT SETINFO": true,
+	"CLIENT SETNAME": true,
+	"HELLO":          true,
+	"SELECT":         true,
+}
+
+// atomicGroup is a PROXY ATOMIC START at start and its END at end, in the
+// messages of a request
+type atomicGroup struct {
+	start, end int
+	discarded  bool
+}
+
+func atomicMarker(cmd string, m *redis.Message) string {
+	if cmd != "PROXY ATOMIC" || len(m.Array) != 3 {
+		return ""
+	}
+	switch marker := strings.ToUpper(string(m.Array[2].Value)); marker {
+	case "START", "END":
+		return marker
+	}
+	return ""
+}
+
+// atomicGroups finds the PROXY ATOMIC groups of a request, which have to be
+// whole in it, not nested nor inside a transaction, of at most
+// AtomicMaxCommands commands, none of them a transaction command or one the
+// proxy answers itself, and, in cluster mode, of keys in one slot
+func (c *connection) atomicGroups(cmds []string, wm []*redis.Message) ([]*atomicGroup, error) {
+	var groups []*atomicGroup
+	var open *atomicGroup
+	var transactionOpen bool
+	for i, m := range wm {
+		switch atomicMarker(cmds[i], m) {
+		case "START":
+			if open != nil {
+				return nil, fmt.Errorf("PROXY ATOMIC groups can't be nested")
+			}
+			if transactionOpen {
+				return nil, fmt.Errorf("PROXY ATOMIC START inside a transaction")
+			}
+			open = &atomicGroup{start: i}
+			continue
+		case "END":
+			if open == nil {
+				return nil, fmt.Errorf("PROXY ATOMIC END without START")
+			}
+			open.end = i
+			if err := c.checkAtomicGroup(cmds[open.start+1:i], wm[open.start+1:i]); err != nil {
+				return nil, err
+			}
+			groups, open = append(groups, open), nil
+			continue
+		}
+		if t, ok := TransactionCommands[cmds[i]]; ok {
+			if open != nil {
+				return nil, fmt.Errorf("%s inside a PROXY ATOMIC group, which is sent as a transaction already", cmds[i])
+			}
+			switch t {
+			case TransactionOpen:
+				transactionOpen = true
+			case TransactionClose:
+				transactionOpen = false
+			}
+		}
+		if open != nil && (atomicLocal[cmds[i]] || isProxyCommand(cmds[i])) {
+			return nil, fmt.Errorf("%s inside a PROXY ATOMIC group, which can't be part of a transaction through the proxy", cmds[i])
+		}
+	}
+	if open != nil {
+		return nil, fmt.Errorf("PROXY ATOMIC START without END, a group has to be sent whole in one pipeline")
+	}
+	return groups, nil
+}
+
+func (c *connection) checkAtomicGroup(cmds []string, wm []*redis.Message) error {
+	max := c.opts.AtomicMaxCommands
+	if max <= 0 {
+		max = DefaultAtomicMaxCommands
+	}
+	if len(wm) > max {
+		return fmt.Errorf("PROXY ATOMIC group of %d commands, more than the %d allowed", len(wm), max)
+	}
+	// the proxy only sees the slots of a cluster's nodes
+	if c.opts.Slots == nil || c.opts.Slots() == "" {
+		return nil
+	}
+	var first []byte
+	slot := -1
+	for i, m := range wm {
+		for _, key := range c.opts.Keys.Keys(cmds[i], m) {
+			s := redis.KeySlot(key)
+			if slot < 0 {
+				first, slot = key, s
+			} else if s != slot {
+				return fmt.Errorf("PROXY ATOMIC group keys have to be in one slot, %s is in slot %d and %s in slot %d", first, slot, key, s)
+			}
+		}
+	}
+	return nil
+}
+
+// startAtomic turns each group into the transaction it stands for, replacing
+// START with MULTI and END with EXEC in a copy of the request. A group with a
+// command the proxy would reject is discarded: nothing of it is sent, and
+// every one of its commands is answered with why.
+func (c *connection) startAtomic(groups []*atomicGroup, replies []*redis.Message, cmds []string, wm []*redis.Message) ([]string, []*redis.Message) {
+	sent, sentCmds := append([]*redis.Message(nil), wm...), append([]string(nil), cmds...)
+	var transactions int
+	for _, g := range groups {
+		for i := g.start + 1; i < g.end; i++ {
+			// unsupported commands have their reply already
+			r := replies[i]
+			if r == nil {
+				r = c.validate(cmds[i], wm[i])
+			}
+			if r == nil {
+				r = c.rejectInTransaction(cmds[i], wm[i])
+			}
+			if r == nil {
+				continue
+			}
+			g.discarded = true
+			metrics.AtomicGroups.Incr(c.statsd, "discarded")
+			if c.trace != nil {
+				c.trace.add("atomic", fmt.Sprintf("group of %d commands discarded, %s was rejected", g.end-g.start-1, cmds[i]))
+			}
+			discard := c.proxyError(proxyerr.Blocked, "PROXY ATOMIC group discarded, %s rejected: %s", cmds[i], r.Value)
+			for j := g.start; j <= g.end; j++ {
+				replies[j] = discard
+			}
+			break
+		}
+		if g.discarded {
+			continue
+		}
+		sent[g.start], sentCmds[g.start] = redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("MULTI"))}), "MULTI"
+		sent[g.end], sentCmds[g.end] = redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("EXEC"))}), "EXEC"
+		transactions++
+	}
+	if c.trace != nil && transactions > 0 {
+		c.trace.add("atomic", fmt.Sprintf("%d PROXY ATOMIC groups sent as transactions", transactions))
+	}
+	return sentCmds, sent
+}
+
+// finishAtomic maps the results of each group's EXEC back to its commands, in
+// place of their QUEUED, and answers END with OK. If the transaction failed,
+// EXECABORT for instance, each of them gets its error instead.
+func (c *connection) finishAtomic(groups []*atomicGroup, replies []*redis.Message) {
+	for _, g := range groups {
+		if g.discarded {
+			continue
+		}
+		exec, n := replies[g.end], g.end-g.start-1
+		if exec.IsArray() && len(exec.Array) == n {
+			copy(replies[g.start+1:g.end], exec.Array)
+			replies[g.end] = redis.NewString([]byte("OK"))
+			metrics.AtomicGroups.Incr(c.statsd, "ok")
+			continue
+		}
+		for i := g.start + 1; i < g.end; i++ {
+			replies[i] = exec
+		}
+		metrics.AtomicGroups.Incr(c.statsd, "aborted")
+	}
+}
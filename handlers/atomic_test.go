@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// transactionUpstream queues the commands between MULTI and EXEC, answering
+// EXEC with their replies, or EXECABORT if one of them was BAD, and records
+// every command it receives
+type transactionUpstream struct {
+	mu       sync.Mutex
+	received []string
+	queued   []*redis.Message
+	multi    bool
+	aborted  bool
+}
+
+func (u *transactionUpstream) handle(args []string) *redis.Message {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	cmd := strings.ToUpper(args[0])
+	u.received = append(u.received, strings.Join(args, " "))
+	switch {
+	case cmd == "MULTI":
+		u.multi, u.aborted, u.queued = true, false, nil
+		return redis.NewString([]byte("OK"))
+	case cmd == "EXEC":
+		u.multi = false
+		if u.aborted {
+			return redis.NewErrorf("EXECABORT Transaction discarded because of previous errors.")
+		}
+		return redis.NewArray(u.queued)
+	case u.multi && cmd == "BAD":
+		u.aborted = true
+		return redis.NewErrorf("ERR unknown command 'BAD'")
+	case u.multi:
+		u.queued = append(u.queued, redis.NewInt([]byte("9")))
+		return redis.NewString([]byte("QUEUED"))
+	}
+	return echoKey(args)
+}
+
+func (u *transactionUpstream) commands() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.received...)
+}
+
+func TestAtomicGroup(t *testing.T) {
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	atomicStart, atomicEnd := respCommand("PROXY", "ATOMIC", "START"), respCommand("proxy", "atomic", "end")
+	for name, tc := range map[string]struct {
+		opts     Options
+		commands []string
+		replies  []string
+		received []string
+	}{
+		"run": {
+			commands: []string{start, atomicStart, respCommand("DECR", "stock"), respCommand("RPUSH", "ledger", "-1"), atomicEnd, respCommand("GET", "a"), end},
+			replies:  []string{"$-1 \\r\\n ", "+OK \\r\\n ", ":9 \\r\\n ", ":9 \\r\\n ", "+OK \\r\\n ", "$7 \\r\\n a-value \\r\\n ", "$-1 \\r\\n "},
+			received: []string{"MULTI", "DECR stock", "RPUSH ledger -1", "EXEC", "GET a"},
+		},
+		"aborted by the upstream": {
+			commands: []string{start, atomicStart, respCommand("DECR", "stock"), respCommand("BAD"), atomicEnd, end},
+			replies: []string{"$-1 \\r\\n ", "+OK \\r\\n ",
+				"-EXECABORT Transaction discarded because of previous errors. \\r\\n ",
+				"-EXECABORT Transaction discarded because of previous errors. \\r\\n ",
+				"-EXECABORT Transaction discarded because of previous errors. \\r\\n ",
+				"$-1 \\r\\n "},
+			received: []string{"MULTI", "DECR stock", "BAD", "EXEC"},
+		},
+		"discarded by the proxy": {
+			opts:     Options{ReadOnly: NewReadOnly(true)},
+			commands: []string{start, respCommand("GET", "a"), atomicStart, respCommand("GET", "stock"), respCommand("DECR", "stock"), atomicEnd, end},
+			replies: []string{"$-1 \\r\\n ", "$7 \\r\\n a-value \\r\\n ",
+				"-PROXYBLOCKED PROXY ATOMIC group discarded, DECR rejected: PROXYMAINT upstream is in read-only mode \\r\\n ",
+				"-PROXYBLOCKED PROXY ATOMIC group discarded, DECR rejected: PROXYMAINT upstream is in read-only mode \\r\\n ",
+				"-PROXYBLOCKED PROXY ATOMIC group discarded, DECR rejected: PROXYMAINT upstream is in read-only mode \\r\\n ",
+				"-PROXYBLOCKED PROXY ATOMIC group discarded, DECR rejected: PROXYMAINT upstream is in read-only mode \\r\\n ",
+				"$-1 \\r\\n "},
+			received: []string{"GET a"},
+		},
+		"malformed": {
+			commands: []string{respCommand("PROXY", "ATOMIC")},
+			replies:  []string{"-ERR PROXY ATOMIC takes START or END \\r\\n "},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u := &transactionUpstream{}
+			upstream := newFakeUpstream(t, u.handle)
+			defer upstream.Close()
+			client := runTestConnection(t, upstream.Address(), tc.opts)
+			defer func() { _ = client.Close() }()
+
+			assert.Equal(t, tc.replies, roundTripStrings(t, client, len(tc.replies), tc.commands...))
+			assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("QUIT")))
+			assert.Empty(t, readUntilClosed(t, client))
+			assert.Equal(t, tc.received, u.commands())
+		})
+	}
+}
+
+func TestAtomicGroupRejected(t *testing.T) {
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	atomicStart, atomicEnd := respCommand("PROXY", "ATOMIC", "START"), respCommand("PROXY", "ATOMIC", "END")
+	for name, tc := range map[string]struct {
+		opts     Options
+		commands []string
+		reply    string
+	}{
+		"nested": {
+			commands: []string{start, atomicStart, atomicStart, respCommand("DECR", "stock"), atomicEnd, atomicEnd, end},
+			reply:    "PROXY ATOMIC groups can't be nested",
+		},
+		"without END": {
+			commands: []string{start, atomicStart, respCommand("DECR", "stock"), end},
+			reply:    "PROXY ATOMIC START without END, a group has to be sent whole in one pipeline",
+		},
+		"without START": {
+			commands: []string{atomicEnd},
+			reply:    "PROXY ATOMIC END without START",
+		},
+		"in a transaction": {
+			commands: []string{start, respCommand("MULTI"), atomicStart, respCommand("DECR", "stock"), atomicEnd, respCommand("EXEC"), end},
+			reply:    "PROXY ATOMIC START inside a transaction",
+		},
+		"enclosing a transaction": {
+			commands: []string{start, atomicStart, respCommand("MULTI"), respCommand("DECR", "stock"), respCommand("EXEC"), atomicEnd, end},
+			reply:    "MULTI inside a PROXY ATOMIC group, which is sent as a transaction already",
+		},
+		"enclosing a command the proxy answers": {
+			commands: []string{start, atomicStart, respCommand("HELLO", "2"), atomicEnd, end},
+			reply:    "HELLO inside a PROXY ATOMIC group, which can't be part of a transaction through the proxy",
+		},
+		"too large": {
+			opts:     Options{AtomicMaxCommands: 1},
+			commands: []string{start, atomicStart, respCommand("DECR", "stock"), respCommand("RPUSH", "ledger", "-1"), atomicEnd, end},
+			reply:    "PROXY ATOMIC group of 2 commands, more than the 1 allowed",
+		},
+		"across slots": {
+			opts:     Options{Slots: func() string { return "0-16383" }},
+			commands: []string{start, atomicStart, respCommand("DECR", "{item:1}:stock"), respCommand("RPUSH", "{item:1}:ledger", "-1"), respCommand("DECR", "stock"), atomicEnd, end},
+			reply:    "PROXY ATOMIC group keys have to be in one slot, {item:1}:stock is in slot 13307 and stock in slot 3902",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u := &transactionUpstream{}
+			upstream := newFakeUpstream(t, u.handle)
+			defer upstream.Close()
+			client := runTestConnection(t, upstream.Address(), tc.opts)
+			defer func() { _ = client.Close() }()
+
+			// every command is answered in its position, the pipeline signals
+			// with a nil as always
+			expected := make([]string, len(tc.commands))
+			for i, cmd := range tc.commands {
+				expected[i] = "-PROXYBLOCKED " + tc.reply + " \\r\\n "
+				if cmd == start || cmd == end {
+					expected[i] = "$-1 \\r\\n "
+				}
+			}
+			assert.Equal(t, expected, roundTripStrings(t, client, len(tc.commands), tc.commands...))
+			assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("QUIT")))
+			assert.Empty(t, readUntilClosed(t, client))
+			assert.Empty(t, u.commands(), "nothing of the request is sent")
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/coinbase/redisbetween/auth"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// DefaultAuthTimeout bounds an AUTH if Options.AuthTimeout isn't set
+const DefaultAuthTimeout = time.Second
+
+// requireAuth answers AUTH from the auth provider, and every other command but
+// HELLO, which can authenticate too, with NOAUTH until the client has
+// authenticated. Without a provider, AUTH is only answered with LocalAuth. It
+// returns nil for commands that go on as usual.
+func (c *connection) requireAuth(cmd string, m *redis.Message) *redis.Message {
+	if c.opts.Auth == nil {
+		if cmd == "AUTH" && c.opts.LocalAuth {
+			return c.localAuth(m.Array[1:])
+		}
+		return nil
+	}
+	switch {
+	case cmd == "AUTH":
+		return c.auth(m.Array[1:])
+	case cmd == "HELLO":
+		return nil
+	}
+	return c.unauthenticated()
+}
+
+func (c *connection) unauthenticated() *redis.Message {
+	if c.opts.Auth == nil || c.identity != nil {
+		return nil
+	}
+	return redis.NewErrorf("NOAUTH Authentication required.")
+}
+
+// auth answers AUTH [username] credential, the username defaulting to
+// auth.DefaultUser
+func (c *connection) auth(args []*redis.Message) *redis.Message {
+	switch len(args) {
+	case 1:
+		return c.authenticate(auth.DefaultUser, string(args[0].Value))
+	case 2:
+		return c.authenticate(string(args[0].Value), string(args[1].Value))
+	}
+	return redis.NewErrorf("ERR wrong number of arguments for 'auth' command")
+}
+
+// localAuth acknowledges AUTH [username] credential without checking it, the
+// upstream connections being authenticated by the proxy with its own
+func (c *connection) localAuth(args []*redis.Message) *redis.Message {
+	switch len(args) {
+	case 1:
+	case 2:
+		c.client.authUser = string(args[0].Value)
+	default:
+		return redis.NewErrorf("ERR wrong number of arguments for 'auth' command")
+	}
+	if c.trace != nil {
+		c.trace.add("auth", "acknowledged, the proxy authenticates upstream connections itself")
+	}
+	return redis.NewString([]byte("OK"))
+}
+
+// authenticate asks the auth provider, for no longer than the auth timeout, and
+// makes the identity it returns the connection's. Wrong credentials are answered
+// with WRONGPASS, as redis does, and a provider that couldn't tell with a
+// retryable error. A failed AUTH leaves the identity of an earlier one in place.
+func (c *connection) authenticate(username, credential string) *redis.Message {
+	timeout := c.opts.AuthTimeout
+	if timeout <= 0 {
+		timeout = DefaultAuthTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	identity, err := c.opts.Auth.Authenticate(ctx, username, credential, auth.ClientInfo{
+		Addr:     c.clientAddr(),
+		Name:     c.client.name,
+		Library:  c.client.library(),
+		Upstream: c.opts.Upstream,
+	})
+	if c.trace != nil {
+		c.trace.add("auth", authResult(identity, err))
+	}
+	metrics.AuthAttempts.Incr(c.statsd, authResult(identity, err))
+	switch {
+	case err == auth.ErrInvalidCredentials:
+		c.log.Info("Client authentication failed", zap.String("user", username))
+		return redis.NewErrorf("WRONGPASS %v.", err)
+	case errors.Is(err, context.DeadlineExceeded):
+		c.log.Warn("Client authentication timed out", zap.String("user", username), zap.Duration("timeout", timeout))
+		return c.proxyError(proxyerr.Timeout, "authentication timed out after %v", timeout)
+	case err != nil:
+		c.log.Warn("Client authentication failed", zap.String("user", username), zap.Error(err))
+		return c.proxyError(proxyerr.Overloaded, "authentication unavailable: %v", err)
+	}
+
+	c.identity = &identity
+	c.client.authUser = identity.User
+	fields := []zap.Field{zap.String("auth_user", identity.User)}
+	if identity.Tenant != "" {
+		fields = append(fields, zap.String("tenant", identity.Tenant))
+	}
+	c.log = c.connLog.With(fields...)
+	if identity.Unverified {
+		c.log.Warn("Client let in unverified")
+	} else {
+		c.log.Debug("Client authenticated")
+	}
+	return redis.NewString([]byte("OK"))
+}
+
+func authResult(identity auth.Identity, err error) string {
+	switch {
+	case err == auth.ErrInvalidCredentials:
+		return "invalid"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case err != nil:
+		return "error"
+	case identity.Unverified:
+		return "unverified"
+	}
+	return "ok"
+}
+
+// helloAuth authenticates the username and password of HELLO's AUTH option, or
+// refuses a HELLO without one from a client that hasn't authenticated yet
+func (c *connection) helloAuth(user, password string) *redis.Message {
+	if c.opts.Auth == nil {
+		return nil
+	}
+	if user == "" {
+		if c.identity == nil {
+			return redis.NewErrorf("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		}
+		return nil
+	}
+	if r := c.authenticate(user, password); r.IsError() {
+		return r
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowProvider never answers before ctx is done
+type slowProvider struct{}
+
+func (slowProvider) Authenticate(ctx context.Context, _, _ string, _ auth.ClientInfo) (auth.Identity, error) {
+	<-ctx.Done()
+	return auth.Identity{}, ctx.Err()
+}
+
+func TestAuthRequired(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{Auth: auth.Static{"app": "s3cret", auth.DefaultUser: "pw"}})
+	defer func() { _ = client.Close() }()
+
+	noauth := "-NOAUTH Authentication required. \\r\\n "
+	assert.Equal(t, []string{noauth}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+	actual := roundTripStrings(t, client, 5,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("MULTI"),
+		respCommand("GET", "a"),
+		respCommand("EXEC"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	)
+	assert.Equal(t, []string{"$-1 \\r\\n ", noauth, noauth, noauth, "$-1 \\r\\n "}, actual, "transactions are rejected whole")
+
+	r := roundTripStrings(t, client, 1, respCommand("AUTH", "app", "wrong"))
+	assert.True(t, strings.HasPrefix(r[0], "-WRONGPASS invalid username-password pair"), r[0])
+	assert.Equal(t, []string{"-ERR wrong number of arguments for 'auth' command \\r\\n "}, roundTripStrings(t, client, 1, respCommand("AUTH")))
+	assert.Equal(t, []string{noauth}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+	assert.Equal(t, int64(0), upstream.Commands(), "nothing is forwarded before AUTH")
+
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("AUTH", "app", "s3cret")))
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+	r = roundTripStrings(t, client, 1, respCommand("AUTH", "nobody", "s3cret"))
+	assert.True(t, strings.HasPrefix(r[0], "-WRONGPASS"), r[0])
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")), "a failed AUTH keeps the earlier identity")
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("AUTH", "pw")), "AUTH without a username is the default user's")
+	assert.Equal(t, int64(2), upstream.Commands())
+}
+
+func TestHelloAuth(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{Auth: auth.Static{"app": "s3cret"}})
+	defer func() { _ = client.Close() }()
+
+	r := roundTripStrings(t, client, 1, respCommand("HELLO", "2"))
+	assert.True(t, strings.HasPrefix(r[0], "-NOAUTH HELLO must be called with the client already authenticated"), r[0])
+	r = roundTripStrings(t, client, 1, respCommand("HELLO", "2", "AUTH", "app", "wrong"))
+	assert.True(t, strings.HasPrefix(r[0], "-WRONGPASS"), r[0])
+	r = roundTripStrings(t, client, 1, respCommand("HELLO", "2", "AUTH", "app", "s3cret"))
+	assert.True(t, strings.HasPrefix(r[0], "*"), r[0])
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+}
+
+func TestAuthTimeout(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{Auth: slowProvider{}, AuthTimeout: 50 * time.Millisecond})
+	defer func() { _ = client.Close() }()
+
+	start := time.Now()
+	r := roundTripStrings(t, client, 1, respCommand("AUTH", "app", "s3cret"))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "a slow provider doesn't stall the client")
+	assert.True(t, strings.HasPrefix(r[0], "-PROXYTIMEOUT authentication timed out after 50ms"), r[0])
+	assert.Equal(t, []string{"-NOAUTH Authentication required. \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+}
+
+func TestNoAuthProvider(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = client.Close() }()
+
+	r := roundTripStrings(t, client, 1, respCommand("AUTH", "app", "s3cret"))
+	assert.True(t, strings.HasPrefix(r[0], "-PROXYBLOCKED AUTH is unsupported"), r[0])
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+}
+
+func TestLocalAuth(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{LocalAuth: true})
+	defer func() { _ = client.Close() }()
+
+	ok := "+OK \\r\\n "
+	assert.Equal(t, []string{ok}, roundTripStrings(t, client, 1, respCommand("AUTH", "app", "anything")))
+	assert.Equal(t, []string{ok}, roundTripStrings(t, client, 1, respCommand("AUTH", "pw")))
+	assert.Equal(t, []string{"-ERR wrong number of arguments for 'auth' command \\r\\n "}, roundTripStrings(t, client, 1, respCommand("AUTH")))
+	assert.Equal(t, int64(0), upstream.Commands(), "AUTH is never forwarded to the shared upstream connections")
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+
+	client = runTestConnection(t, upstream.Address(), Options{LocalAuth: true, Auth: auth.Static{"app": "s3cret"}})
+	defer func() { _ = client.Close() }()
+	r := roundTripStrings(t, client, 1, respCommand("AUTH", "app", "wrong"))
+	assert.True(t, strings.HasPrefix(r[0], "-WRONGPASS"), "an auth provider still checks AUTH: %s", r[0])
+}
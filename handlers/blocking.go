@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// where the timeout of a blocking command is: its last argument, or its
+// first, in seconds, or the value of its BLOCK option, in milliseconds
+const (
+	blockTimeoutLast = iota
+	blockTimeoutFirst
+	blockTimeoutOption
+)
+
+// BlockingCommands are the commands that can block waiting for data, with
+// where their timeout is. XREAD and XREADGROUP only block with their BLOCK
+// option, in milliseconds.
+var BlockingCommands = map[string]int{
+	"BLMOVE":     blockTimeoutLast,
+	"BLMPOP":     blockTimeoutFirst,
+	"BLPOP":      blockTimeoutLast,
+	"BRPOP":      blockTimeoutLast,
+	"BRPOPLPUSH": blockTimeoutLast,
+	"BZMPOP":     blockTimeoutFirst,
+	"BZPOPMAX":   blockTimeoutLast,
+	"BZPOPMIN":   blockTimeoutLast,
+	"XREAD":      blockTimeoutOption,
+	"XREADGROUP": blockTimeoutOption,
+}
+
+// isBlockingCommand is whether a command is one of BlockingCommands
+func isBlockingCommand(cmd string) bool {
+	_, ok := BlockingCommands[cmd]
+	return ok
+}
+
+// Blocking is the pool of the upstream connections that requests with blocking
+// commands are sent over, so that clients waiting on them hold none of the
+// shared pool. Such a request is read with its block timeout added to the read
+// timeout, or without a deadline if it blocks forever.
+type Blocking struct {
+	Server *pool.Server
+
+	blocked int64
+}
+
+// Blocked is the number of requests waiting on a blocking command
+func (b *Blocking) Blocked() int64 {
+	return atomic.LoadInt64(&b.blocked)
+}
+
+// block counts a request as blocked until the function it returns is called
+func (b *Blocking) block() func() {
+	atomic.AddInt64(&b.blocked, 1)
+	return func() { atomic.AddInt64(&b.blocked, -1) }
+}
+
+// blockTimeout is how long a command may block for, 0 being forever, and
+// whether it blocks at all
+func blockTimeout(cmd string, m *redis.Message) (time.Duration, bool) {
+	where, ok := BlockingCommands[cmd]
+	if !ok || !m.IsArray() || len(m.Array) < 2 {
+		return 0, false
+	}
+	var arg []byte
+	unit := time.Second
+	switch where {
+	case blockTimeoutLast:
+		arg = m.Array[len(m.Array)-1].Value
+	case blockTimeoutFirst:
+		arg = m.Array[1].Value
+	case blockTimeoutOption:
+		for i := 1; i+1 < len(m.Array); i++ {
+			if strings.EqualFold(string(m.Array[i].Value), "STREAMS") {
+				break
+			}
+			if strings.EqualFold(string(m.Array[i].Value), "BLOCK") {
+				arg = m.Array[i+1].Value
+			}
+		}
+		if arg == nil {
+			return 0, false
+		}
+		unit = time.Millisecond
+	}
+	// a timeout redis rejects doesn't block, and so is read as any other
+	v, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, false
+	}
+	return time.Duration(v * float64(unit)), true
+}
+
+// blocks is whether a request outside a transaction, inside of which commands
+// never block, has a blocking command, and how long it may block for, 0 being
+// forever
+func (c *connection) blocks(wm []*redis.Message) (time.Duration, bool) {
+	if c.opts.Blocking == nil {
+		return 0, false
+	}
+	cmds := make([]string, len(wm))
+	for i, m := range wm {
+		if m.IsArray() && len(m.Array) > 0 {
+			cmds[i] = strings.ToUpper(string(m.Array[0].Value))
+		}
+	}
+	if hasTransaction(cmds) {
+		return 0, false
+	}
+	var longest time.Duration
+	blocking := false
+	for i, m := range wm {
+		d, ok := blockTimeout(cmds[i], m)
+		if !ok {
+			continue
+		}
+		if d == 0 {
+			return 0, true
+		}
+		blocking = true
+		if d > longest {
+			longest = d
+		}
+	}
+	return longest, blocking
+}
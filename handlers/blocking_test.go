@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestBlockTimeout(t *testing.T) {
+	for cmd, expected := range map[string]time.Duration{
+		"BLPOP a b 1.5":                            1500 * time.Millisecond,
+		"BRPOP a 0":                                0,
+		"BLMOVE a b LEFT RIGHT 2":                  2 * time.Second,
+		"BZMPOP 3 1 z MIN":                         3 * time.Second,
+		"XREAD COUNT 2 BLOCK 250 STREAMS s 0":      250 * time.Millisecond,
+		"XREADGROUP GROUP g c BLOCK 0 STREAMS s >": 0,
+	} {
+		d, ok := blockTimeout(strings.Fields(cmd)[0], command(cmd))
+		assert.True(t, ok, cmd)
+		assert.Equal(t, expected, d, cmd)
+	}
+	for _, cmd := range []string{"XREAD STREAMS BLOCK 0", "XREAD COUNT 2 STREAMS s 0", "BLPOP a -1", "BLPOP a x", "GET a"} {
+		_, ok := blockTimeout(strings.Fields(cmd)[0], command(cmd))
+		assert.False(t, ok, cmd)
+	}
+}
+
+func command(s string) *redis.Message {
+	var args []*redis.Message
+	for _, a := range strings.Fields(s) {
+		args = append(args, redis.NewBulkBytes([]byte(a)))
+	}
+	return redis.NewArray(args)
+}
+
+func TestBlockingPool(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "BLPOP" {
+			time.Sleep(300 * time.Millisecond)
+			return redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte(args[1])), redis.NewBulkBytes([]byte("v"))})
+		}
+		return redis.NewString([]byte("OK"))
+	})
+	defer upstream.Close()
+	shared, blocking := newTestServer(t, upstream.Address(), 1), newTestServer(t, upstream.Address(), 2)
+	defer func() { _ = shared.Disconnect(context.Background()) }()
+	defer func() { _ = blocking.Disconnect(context.Background()) }()
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	b := &Blocking{Server: blocking}
+	c := &connection{log: zaptest.NewLogger(t), statsd: sd, ctx: context.Background(), server: shared,
+		readTimeout: 100 * time.Millisecond, writeTimeout: time.Second, opts: Options{Blocking: b}}
+
+	done := make(chan []*redis.Message, 1)
+	go func() {
+		res, _, err := c.guardedForward(0, []string{"BLPOP"}, []*redis.Message{command("BLPOP q 1")})
+		assert.NoError(t, err, "the read deadline is pushed back by the block timeout")
+		done <- res
+	}()
+	assert.Eventually(t, func() bool { return b.Blocked() == 1 }, time.Second, time.Millisecond)
+	res, _, err := c.guardedForward(0, []string{"SET"}, []*redis.Message{command("SET k v")})
+	assert.NoError(t, err, "the shared pool's only connection is free while the client blocks")
+	assert.Equal(t, "+OK \\r\\n ", res[0].String())
+	select {
+	case res := <-done:
+		assert.Equal(t, "*2 \\r\\n $1 \\r\\n q \\r\\n $1 \\r\\n v \\r\\n ", res[0].String())
+	case <-time.After(2 * time.Second):
+		t.Fatal("BLPOP never answered")
+	}
+	assert.Equal(t, int64(0), b.Blocked())
+
+	// a reply that takes longer than the block timeout and the read timeout
+	_, _, err = c.guardedForward(0, []string{"BLPOP"}, []*redis.Message{command("BLPOP q 0.1")})
+	assert.True(t, isTimeout(err), "%v", err)
+}
+
+func TestBlockingCommandsSupported(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewBulkBytes(nil) })
+	defer upstream.Close()
+	client := closingTestConnection(t, upstream.Address(), Options{})
+	assert.Equal(t, []string{"-PROXYBLOCKED BLPOP is unsupported \\r\\n "}, roundTripStrings(t, client, 1, respCommand("BLPOP", "q", "1")))
+
+	blocking := newTestServer(t, upstream.Address(), 1)
+	defer func() { _ = blocking.Disconnect(context.Background()) }()
+	client = closingTestConnection(t, upstream.Address(), Options{Blocking: &Blocking{Server: blocking}})
+	assert.Equal(t, []string{"$-1 \\r\\n ", "$-1 \\r\\n "}, roundTripStrings(t, client, 2, respCommand("BLPOP", "q", "1"), respCommand("XREAD", "STREAMS", "s", "0")),
+		"and XREAD without BLOCK is sent over the shared pool")
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// errQuit ends the connection of a client that sent QUIT, once its reply is
+// written
+var errQuit = errors.New("client quit")
+
+// errProtocol ends the connection of a client that sent bytes that aren't valid
+// RESP, once the replies of the messages before them and the protocol error are
+// written
+var errProtocol = errors.New("client protocol error")
+
+func isQuit(m *redis.Message) bool {
+	return m.IsArray() && len(m.Array) > 0 && strings.EqualFold(string(m.Array[0].Value), "QUIT")
+}
+
+// requestBoundaries split the messages of a request into those answered as
+// usual, the first received ones, those read after a drain began, answered with
+// PROXYMAINT, and a QUIT or bytes that aren't valid RESP. Like redis, which
+// stops reading a client's commands at QUIT, the proxy neither forwards nor
+// answers what follows it in the request, and never forwards QUIT itself,
+// which would close a pooled connection.
+type requestBoundaries struct {
+	received int
+	late     int
+	quit     bool
+	// cut is whether a drain stopped the pipeline being read before its end
+	// signal, and pipelined whether the replies are padded for the signals
+	cut       bool
+	pipelined bool
+	// invalid is the error decoding what followed the received messages
+	invalid error
+}
+
+// boundaries finds the boundaries of the messages of a request, of which those
+// from late on were read after the drain began, and which was wrapped in
+// signals if signaled. A transaction is received with its EXEC: one still open
+// at the drain is read after it, all of it.
+func boundaries(wm []*redis.Message, late int, cut, signaled bool) requestBoundaries {
+	b := requestBoundaries{received: len(wm), cut: cut, pipelined: (signaled && len(wm) > 1) || cut}
+	for i, m := range wm {
+		if isQuit(m) {
+			b.received, b.quit = i, true
+			break
+		}
+	}
+	if late >= b.received {
+		return b
+	}
+	open := -1
+	for i, m := range wm[:late] {
+		if !m.IsArray() || len(m.Array) == 0 {
+			continue
+		}
+		switch t, ok := TransactionCommands[strings.ToUpper(string(m.Array[0].Value))]; {
+		case ok && t == TransactionOpen && open < 0:
+			open = i
+		case ok && t == TransactionClose:
+			open = -1
+		}
+	}
+	if open >= 0 {
+		late = open
+	}
+	b.received, b.late = late, b.received-late
+	return b
+}
+
+// writeReplies writes the replies of the received messages of a request, then
+// PROXYMAINT for each one read after the drain began, and the reply to QUIT or
+// the protocol error, which is the last thing written. A pipeline's replies are
+// padded for its signals, but for the end one if QUIT, a drain or a protocol
+// error cut it short.
+func (c *connection) writeReplies(l *zap.Logger, b requestBoundaries, replies []*redis.Message, pipelined bool) error {
+	// a reply streamed is already written
+	if streamed(replies) {
+		replies = replies[:0:0]
+	}
+	for i := 0; i < b.late; i++ {
+		replies = append(replies, c.proxyError(proxyerr.Maintenance, "shutting down"))
+	}
+	if b.quit {
+		replies = append(replies, redis.NewString([]byte("OK")))
+	}
+	if b.invalid != nil {
+		replies = append(replies, redis.NewErrorf("ERR Protocol error: %v", b.invalid))
+	}
+	replies = append(replies, c.warningPushes(pipelined)...)
+	if pipelined && (b.quit || b.cut || b.invalid != nil) {
+		replies = append([]*redis.Message{redis.NewBulkBytes(nil)}, replies...)
+		pipelined = false
+	}
+	return WriteWireMessages(c.ctx, l, replies, c.conn, c.address, c.id, 0, pipelined, c.conn.Close)
+}
+
+// end is what handleMessage returns once the replies are written: an error
+// writing them, errQuit after a QUIT, errProtocol after a protocol error, or
+// the error that cut the pipeline short
+func (b requestBoundaries) end(err, cutErr error) error {
+	if err != nil {
+		return err
+	}
+	if b.quit {
+		return errQuit
+	}
+	if b.invalid != nil {
+		return errProtocol
+	}
+	return cutErr
+}
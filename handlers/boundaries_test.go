@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// readUntilClosed decodes the replies on client until the proxy closes it
+func readUntilClosed(t *testing.T, client net.Conn) []string {
+	t.Helper()
+	d := redis.NewDecoder(client)
+	var actual []string
+	for {
+		m, err := d.Decode()
+		if err != nil {
+			return actual
+		}
+		actual = append(actual, m.String())
+	}
+}
+
+func TestQuit(t *testing.T) {
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	for name, tc := range map[string]struct {
+		commands  []string
+		replies   []string
+		forwarded int64
+	}{
+		"alone": {
+			commands: []string{respCommand("QUIT")},
+			replies:  []string{"+OK \\r\\n "},
+		},
+		"in a pipeline": {
+			commands:  []string{start, respCommand("SET", "a", "1"), respCommand("quit"), respCommand("GET", "a"), end},
+			replies:   []string{"$-1 \\r\\n ", "+OK \\r\\n ", "+OK \\r\\n "},
+			forwarded: 1,
+		},
+		"first in a pipeline": {
+			commands: []string{start, respCommand("QUIT"), respCommand("FLUSHALL"), end},
+			replies:  []string{"$-1 \\r\\n ", "+OK \\r\\n "},
+		},
+		"in a transaction": {
+			commands: []string{start, respCommand("MULTI"), respCommand("SET", "a", "1"), respCommand("QUIT"), respCommand("EXEC"), end},
+			replies:  []string{"$-1 \\r\\n ", "-PROXYBLOCKED cannot leave an open transaction \\r\\n ", "-PROXYBLOCKED cannot leave an open transaction \\r\\n ", "+OK \\r\\n "},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			upstream := newFakeUpstream(t, echoKey)
+			defer upstream.Close()
+			client := runTestConnection(t, upstream.Address(), Options{})
+			defer func() { _ = client.Close() }()
+
+			go func() {
+				for _, c := range tc.commands {
+					_, _ = client.Write([]byte(c))
+				}
+			}()
+			assert.Equal(t, tc.replies, readUntilClosed(t, client), "the reply to QUIT is the last thing written before the connection closes")
+			assert.Equal(t, tc.forwarded, atomic.LoadInt64(&upstream.commands), "nothing after QUIT, nor QUIT, is forwarded")
+		})
+	}
+}
+
+func TestDrainBoundary(t *testing.T) {
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	maint := "-PROXYMAINT shutting down \\r\\n "
+	for name, tc := range map[string]struct {
+		notify        bool
+		before, after []string
+		replies       []string
+		forwarded     int64
+	}{
+		"pipeline read to its end": {
+			before:    []string{start, respCommand("SET", "a", "1"), respCommand("GET", "a")},
+			after:     []string{respCommand("GET", "b"), respCommand("QUIT"), respCommand("GET", "c"), end},
+			replies:   []string{"$-1 \\r\\n ", "+OK \\r\\n ", "$7 \\r\\n a-value \\r\\n ", maint, "+OK \\r\\n "},
+			forwarded: 2,
+		},
+		"transaction spanning the drain": {
+			before:    []string{start, respCommand("SET", "a", "1"), respCommand("MULTI"), respCommand("SET", "b", "1")},
+			after:     []string{respCommand("EXEC"), end},
+			replies:   []string{"$-1 \\r\\n ", "+OK \\r\\n ", maint, maint, maint, "$-1 \\r\\n "},
+			forwarded: 1,
+		},
+		"pipeline cut short with drainnotify": {
+			notify:    true,
+			before:    []string{start, respCommand("SET", "a", "1"), respCommand("GET", "a")},
+			replies:   []string{"$-1 \\r\\n ", "+OK \\r\\n ", "$7 \\r\\n a-value \\r\\n ", maint},
+			forwarded: 2,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			upstream := newFakeUpstream(t, echoKey)
+			defer upstream.Close()
+			s := newTestServer(t, upstream.Address(), 2)
+			defer func() { _ = s.Disconnect(context.Background()) }()
+			draining := make(chan interface{})
+			activity := &Activity{}
+			client := serveTestConnection(t, s, Options{Draining: draining, DrainNotify: tc.notify, Activity: activity}, nil)
+			defer func() { _ = client.Close() }()
+
+			// each write returns once the proxy has read it, and what it read is
+			// decoded before the drain begins
+			for _, c := range tc.before {
+				_, err := client.Write([]byte(c))
+				assert.NoError(t, err)
+			}
+			assert.Eventually(t, func() bool { return atomic.LoadInt64(&activity.pipelines) == 1 }, time.Second, time.Millisecond)
+			time.Sleep(20 * time.Millisecond)
+			close(draining)
+			go func() {
+				for _, c := range tc.after {
+					_, _ = client.Write([]byte(c))
+				}
+			}()
+			assert.Equal(t, tc.replies, readUntilClosed(t, client), "what was read before the drain is answered, and what came after gets PROXYMAINT")
+			assert.Equal(t, tc.forwarded, atomic.LoadInt64(&upstream.commands))
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	BreakerClosed = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+var breakerStates = map[int]string{BreakerClosed: "closed", BreakerHalfOpen: "half-open", BreakerOpen: "open"}
+
+// BreakerOptions configures a circuit breaker. A request fails if its round trip
+// errors or takes longer than Latency (when positive). Once MinRequests requests
+// in a Window have failed at ErrorRate or more (when positive), or Failures
+// requests in a row have (when positive), the circuit opens for Cooldown, then
+// lets a single probe request through to decide whether to close again. With
+// Ping, no request is let through as the probe: the proxy PINGs the node every
+// Cooldown instead, see PingDue, so that no client waits on a node that hangs.
+type BreakerOptions struct {
+	ErrorRate   float64
+	Latency     time.Duration
+	MinRequests int
+	Window      time.Duration
+	Cooldown    time.Duration
+	Failures    int
+	Ping        bool
+}
+
+// Breaker is the circuit breaker of a single upstream node. In cluster mode
+// every node has its own, so one failing node fails fast without affecting the
+// others.
+type Breaker struct {
+	opts BreakerOptions
+	now  func() time.Time
+
+	mu          sync.Mutex
+	state       int
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+}
+
+func NewBreaker(opts BreakerOptions) *Breaker {
+	return &Breaker{opts: opts, now: time.Now}
+}
+
+// Allow reports whether a request may be sent, and whether it is the probe of a
+// half-open circuit. Every allowed request must be followed by Record.
+func (b *Breaker) Allow() (allowed, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.opts.Ping || b.now().Sub(b.openedAt) < b.opts.Cooldown {
+			return false, false
+		}
+		b.state = BreakerHalfOpen
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	}
+	return true, false
+}
+
+// PingDue reports whether the cooldown of an open circuit probed by PINGs has
+// passed, in which case the caller sends the PING and must follow it with
+// Record as the probe
+func (b *Breaker) PingDue() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.opts.Ping || b.state != BreakerOpen || b.now().Sub(b.openedAt) < b.opts.Cooldown {
+		return false
+	}
+	b.state, b.probing = BreakerHalfOpen, true
+	return true
+}
+
+// Record reports the outcome of an allowed request, returning the new state if
+// it changed
+func (b *Breaker) Record(probe bool, elapsed time.Duration, err error) (state int, changed bool) {
+	failed := err != nil || (b.opts.Latency > 0 && elapsed > b.opts.Latency)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if probe {
+		b.probing = false
+		if failed {
+			b.state, b.openedAt = BreakerOpen, now
+		} else {
+			b.state = BreakerClosed
+			b.windowStart, b.requests, b.failures, b.consecutive = now, 0, 0, 0
+		}
+		return b.state, true
+	}
+	if b.state != BreakerClosed {
+		return b.state, false
+	}
+	if now.Sub(b.windowStart) > b.opts.Window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	b.consecutive++
+	if failed {
+		b.failures++
+	} else {
+		b.consecutive = 0
+	}
+	rate := b.opts.ErrorRate > 0 && b.requests >= b.opts.MinRequests && float64(b.failures) >= b.opts.ErrorRate*float64(b.requests) && b.failures > 0
+	inRow := b.opts.Failures > 0 && b.consecutive >= b.opts.Failures
+	if rate || inRow {
+		b.state, b.openedAt = BreakerOpen, now
+		return b.state, true
+	}
+	return b.state, false
+}
+
+// State is BreakerClosed, BreakerHalfOpen or BreakerOpen. An open circuit whose
+// cooldown has passed reports half-open, since the next request probes it.
+func (b *Breaker) State() int {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.opts.Cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// BreakerStateName is the name of a breaker state, for logs and stats
+func BreakerStateName(state int) string {
+	return breakerStates[state]
+}
+
+// BreakerChanged logs the new state of the circuit of an upstream node, which
+// err, if set, opened, and emits it as a statsd event
+func BreakerChanged(log *zap.Logger, sd *statsd.Client, upstream string, state int, probe bool, err error) {
+	name := BreakerStateName(state)
+	log = log.With(zap.String("upstream", upstream), zap.String("state", name))
+	metrics.CircuitTransitions.Incr(sd, name)
+	event := &statsd.Event{Title: "redisbetween circuit " + name + " for " + upstream, Tags: []string{"state:" + name}}
+	if state == BreakerOpen {
+		log.Warn("Upstream node circuit opened", zap.Bool("probe", probe), zap.Error(err))
+		event.AlertType = statsd.Warning
+		if err != nil {
+			event.Text = err.Error()
+		}
+	} else {
+		log.Info("Upstream node circuit closed")
+		event.AlertType = statsd.Success
+	}
+	_ = sd.Event(event)
+}
+
+// InFlight caps the requests in flight to a single upstream node, so a node that
+// has stopped replying can't tie up every client connection.
+type InFlight struct {
+	limit int
+	slots chan struct{}
+}
+
+func NewInFlight(limit int) *InFlight {
+	return &InFlight{limit: limit, slots: make(chan struct{}, limit)}
+}
+
+// Acquire takes a slot without waiting, returning false if the node is at its limit
+func (f *InFlight) Acquire() bool {
+	select {
+	case f.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *InFlight) Release() {
+	<-f.slots
+}
+
+// FailFastError is returned instead of forwarding a request to a node that is
+// unhealthy or overloaded, naming the node and the slots it serves
+type FailFastError struct {
+	Node   string
+	Slots  string
+	Reason string
+}
+
+func (e FailFastError) Error() string {
+	node := e.Node
+	if e.Slots != "" {
+		node += " (slots " + e.Slots + ")"
+	}
+	return fmt.Sprintf("%s for upstream node %s, failing fast", e.Reason, node)
+}
+
+// guardedForward forwards wm unless the node's circuit is open, it has too many
+// requests in flight or the request's pool segment is exhausted, recording the
+// outcome with the node's breaker. Requests for a database other than the
+// default go to its own pool, outside of the reserved lane and the segments.
+// On an error, the replies read before it are returned with it.
+func (c *connection) guardedForward(db int, cmds []string, wm []*redis.Message) ([]*redis.Message, *zap.Logger, error) {
+	if c.trace != nil {
+		c.traceSlots(cmds, wm)
+	}
+	if m := c.opts.Identity.refused(); m != "" {
+		if c.trace != nil {
+			c.trace.add("identity", "upstream mismatched, refused")
+		}
+		return nil, c.log, IdentityError{Upstream: c.opts.Upstream, Mismatch: m}
+	}
+	if err := c.shedMemory(cmds, wm); err != nil {
+		return nil, c.log, err
+	}
+	// a blocking request waits on a pool of its own, for as long as it blocks,
+	// which neither the in-flight limit nor the breaker's latency would make
+	// sense of
+	_, blocking := c.blocks(wm)
+	blocking = blocking && db == c.opts.Database
+	if c.opts.InFlight != nil && !blocking {
+		if !c.opts.InFlight.Acquire() {
+			metrics.InFlightRejected.Incr(c.statsd)
+			if c.trace != nil {
+				c.trace.add("in-flight", fmt.Sprintf("limit of %d reached, failing fast", c.opts.InFlight.limit))
+			}
+			return nil, c.log, c.failFast(fmt.Sprintf("%d requests already in flight", c.opts.InFlight.limit))
+		}
+		defer c.opts.InFlight.Release()
+	}
+	if c.opts.DBPools != nil {
+		metrics.DBRequests.Incr(c.statsd, strconv.Itoa(db))
+	}
+	var server *pool.Server
+	if db != c.opts.Database {
+		s, release, err := c.dbServer(db)
+		if err != nil {
+			return nil, c.log, err
+		}
+		defer release()
+		server = s
+	} else {
+		// the reserved lane is a pool of its own, outside of the segments
+		server = c.serverFor(cmds, wm)
+	}
+	if c.opts.Segments != nil && server == c.server {
+		release, err := c.acquireSegment(cmds, wm)
+		if err != nil {
+			return nil, c.log, err
+		}
+		defer release()
+	}
+
+	if blocking {
+		defer c.opts.Blocking.block()()
+	}
+
+	b := c.opts.Breaker
+	if b == nil || blocking {
+		return c.forward(server, cmds, wm)
+	}
+	allowed, probe := b.Allow()
+	if !allowed {
+		metrics.CircuitRejected.Incr(c.statsd)
+		if c.trace != nil {
+			c.trace.add("circuit", "open, failing fast")
+		}
+		return nil, c.log, c.failFast("circuit open")
+	}
+	if probe && c.trace != nil {
+		c.trace.add("circuit", "half-open, sent as the probe")
+	}
+	start := time.Now()
+	res, l, err := c.forward(server, cmds, wm)
+	// the time a reply was streamed for, and its client failing it, are the
+	// client's rather than the upstream's
+	recorded := err
+	if se, ok := err.(StreamError); ok && se.Client {
+		recorded = nil
+	}
+	if state, changed := b.Record(probe, time.Since(start)-c.streamHeld, recorded); changed {
+		BreakerChanged(c.log, c.statsd, c.opts.Upstream, state, probe, err)
+	}
+	return res, l, err
+}
+
+func (c *connection) failFast(reason string) FailFastError {
+	e := FailFastError{Node: c.opts.Upstream, Reason: reason}
+	if c.opts.Slots != nil {
+		e.Slots = c.opts.Slots()
+	}
+	return e
+}
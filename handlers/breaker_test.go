@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBreaker(BreakerOptions{ErrorRate: 0.5, Latency: 100 * time.Millisecond, MinRequests: 4, Window: 10 * time.Second, Cooldown: 5 * time.Second})
+	b.now = func() time.Time { return now }
+	record := func(elapsed time.Duration, err error) (int, bool) {
+		allowed, probe := b.Allow()
+		assert.True(t, allowed)
+		return b.Record(probe, elapsed, err)
+	}
+
+	// a failure rate under the threshold, or too few requests, keeps it closed
+	record(time.Millisecond, nil)
+	record(time.Millisecond, nil)
+	record(time.Millisecond, errors.New("boom"))
+	assert.Equal(t, BreakerClosed, b.State())
+
+	// the window restarts, so old successes don't dilute new failures
+	now = now.Add(11 * time.Second)
+	record(time.Millisecond, errors.New("boom"))
+	record(time.Second, nil)
+	record(time.Millisecond, nil)
+	state, changed := record(time.Millisecond, errors.New("boom"))
+	assert.True(t, changed)
+	assert.Equal(t, BreakerOpen, state, "3 of 4 failed, counting the slow one")
+
+	allowed, _ := b.Allow()
+	assert.False(t, allowed, "an open circuit fails fast")
+
+	// after the cooldown a single probe is let through
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, BreakerHalfOpen, b.State())
+	allowed, probe := b.Allow()
+	assert.True(t, allowed && probe)
+	allowed, _ = b.Allow()
+	assert.False(t, allowed, "only one probe at a time")
+	state, _ = b.Record(true, time.Second, nil)
+	assert.Equal(t, BreakerOpen, state, "a slow probe reopens the circuit")
+
+	now = now.Add(5 * time.Second)
+	allowed, probe = b.Allow()
+	assert.True(t, allowed && probe)
+	state, changed = b.Record(true, time.Millisecond, nil)
+	assert.True(t, changed)
+	assert.Equal(t, BreakerClosed, state)
+	record(time.Millisecond, errors.New("boom"))
+	assert.Equal(t, BreakerClosed, b.State(), "a closed circuit starts counting afresh")
+}
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBreaker(BreakerOptions{Failures: 3, Window: 10 * time.Second, Cooldown: 5 * time.Second, Ping: true})
+	b.now = func() time.Time { return now }
+	record := func(err error) (int, bool) {
+		allowed, probe := b.Allow()
+		assert.True(t, allowed)
+		return b.Record(probe, time.Millisecond, err)
+	}
+
+	record(errors.New("timeout"))
+	record(errors.New("timeout"))
+	record(nil)
+	record(errors.New("timeout"))
+	record(errors.New("timeout"))
+	assert.Equal(t, BreakerClosed, b.State(), "a success starts the count over")
+	state, changed := record(errors.New("timeout"))
+	assert.True(t, changed)
+	assert.Equal(t, BreakerOpen, state, "3 in a row")
+
+	// no request is let through as the probe, the proxy PINGs instead
+	assert.False(t, b.PingDue())
+	now = now.Add(5 * time.Second)
+	allowed, _ := b.Allow()
+	assert.False(t, allowed)
+	assert.True(t, b.PingDue())
+	assert.False(t, b.PingDue(), "a single PING at a time")
+	state, _ = b.Record(true, time.Millisecond, errors.New("timeout"))
+	assert.Equal(t, BreakerOpen, state)
+	assert.False(t, b.PingDue(), "a failed PING starts the cooldown over")
+
+	now = now.Add(5 * time.Second)
+	assert.True(t, b.PingDue())
+	state, changed = b.Record(true, time.Millisecond, nil)
+	assert.True(t, changed)
+	assert.Equal(t, BreakerClosed, state)
+	allowed, _ = b.Allow()
+	assert.True(t, allowed)
+	assert.False(t, b.PingDue(), "a closed circuit isn't PINGed")
+}
+
+func TestCircuitOpensPerNode(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if len(args) > 1 && args[1] == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+
+	breaker := NewBreaker(BreakerOptions{ErrorRate: 0.5, Latency: 50 * time.Millisecond, MinRequests: 2, Window: time.Minute, Cooldown: 200 * time.Millisecond})
+	client := runTestConnection(t, upstream.Address(), Options{
+		Upstream: "10.0.0.1:7001",
+		Breaker:  breaker,
+		Slots:    func() string { return "0-5460" },
+	})
+	defer func() { _ = client.Close() }()
+
+	get := func(key string) string {
+		return roundTripStrings(t, client, 1, respCommand("GET", key))[0]
+	}
+	assert.Equal(t, "$10 \\r\\n slow-value \\r\\n ", get("slow"))
+	assert.Equal(t, "$10 \\r\\n slow-value \\r\\n ", get("slow"))
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	commands := upstream.Commands()
+	assert.Equal(t, "-PROXYOVERLOADED circuit open for upstream node 10.0.0.1:7001 (slots 0-5460), failing fast \\r\\n ", get("a"))
+	assert.Equal(t, commands, upstream.Commands(), "nothing is sent to an open node")
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, "$7 \\r\\n a-value \\r\\n ", get("a"), "the probe succeeds")
+	assert.Equal(t, BreakerClosed, breaker.State())
+	assert.Equal(t, "$7 \\r\\n b-value \\r\\n ", get("b"))
+}
+
+func TestInFlightLimit(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if len(args) > 1 && args[1] == "slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+
+	s := newTestServer(t, upstream.Address(), 2)
+	defer func() { _ = s.Disconnect(context.Background()) }()
+	opts := Options{Upstream: "10.0.0.1:7001", InFlight: NewInFlight(1)}
+	slow := serveTestConnection(t, s, opts, nil)
+	defer func() { _ = slow.Close() }()
+	other := serveTestConnection(t, s, opts, nil)
+	defer func() { _ = other.Close() }()
+
+	done := make(chan []string)
+	go func() { done <- roundTripStrings(t, slow, 1, respCommand("GET", "slow")) }()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"-PROXYOVERLOADED 1 requests already in flight for upstream node 10.0.0.1:7001, failing fast \\r\\n "},
+		roundTripStrings(t, other, 1, respCommand("GET", "a")))
+	assert.Equal(t, []string{"$10 \\r\\n slow-value \\r\\n "}, <-done)
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, other, 1, respCommand("GET", "a")))
+}
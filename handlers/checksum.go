@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/coinbase/redisbetween/checksum"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// ChecksumReads are the reads whose bulk string reply, the value of their key,
+// a Checksums verifies. A SET's is the old value its GET option asks for.
+var ChecksumReads = map[string]bool{
+	"GET":    true,
+	"GETDEL": true,
+	"GETEX":  true,
+	"GETSET": true,
+	"SET":    true,
+}
+
+// The directions of a checksum verification, as tagged in the checksum metrics
+const (
+	ChecksumWrite = "write"
+	ChecksumRead  = "read"
+)
+
+// Checksums verifies the checksum frames of the values of the keys starting
+// with one of its prefixes: those written, before they are forwarded, a
+// mismatch being answered with PROXYCHECKSUM, and those read from the upstream,
+// a mismatch replacing the value by PROXYCHECKSUM. A value read is relayed
+// without its frame, unless the client asked for frames with PROXY CHECKSUM ON,
+// to verify them itself. Values that aren't framed are left as they are, and so
+// are those read inside a transaction.
+type Checksums struct {
+	prefixes []string
+}
+
+func NewChecksums(prefixes []string) *Checksums {
+	return &Checksums{prefixes: prefixes}
+}
+
+func (k *Checksums) matches(key []byte) bool {
+	if k == nil {
+		return false
+	}
+	for _, p := range k.prefixes {
+		if strings.HasPrefix(string(key), p) {
+			return true
+		}
+	}
+	return false
+}
+
+// checksumPairs are the positions of the keys of the values cmd writes, each
+// followed by that of its value
+func checksumPairs(cmd string, m *redis.Message) [][2]int {
+	n := len(m.Array)
+	switch cmd {
+	case "SET", "SETNX", "GETSET":
+		if n >= 3 {
+			return [][2]int{{1, 2}}
+		}
+	case "SETEX", "PSETEX":
+		if n >= 4 {
+			return [][2]int{{1, 3}}
+		}
+	case "MSET", "MSETNX":
+		pairs := make([][2]int, 0, n/2)
+		for i := 1; i+1 < n; i += 2 {
+			pairs = append(pairs, [2]int{i, i + 1})
+		}
+		return pairs
+	}
+	return nil
+}
+
+// rejectCorruptWrite answers a write of a framed value of a checksummed key
+// that doesn't match its checksum with an error. The values that do are
+// forwarded framed, for the readers that verify them too.
+func (c *connection) rejectCorruptWrite(cmd string, m *redis.Message) *redis.Message {
+	if c.opts.Checksums == nil {
+		return nil
+	}
+	for _, kv := range checksumPairs(cmd, m) {
+		key := m.Array[kv[0]].Value
+		if !c.opts.Checksums.matches(key) {
+			continue
+		}
+		if _, framed, err := checksum.Unwrap(m.Array[kv[1]].Value); framed && !c.checksumVerified(key, ChecksumWrite, err) {
+			return c.proxyError(proxyerr.Checksum, "value written to %s doesn't match its checksum: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// verifyChecksums verifies the values of the checksummed keys in the replies
+// res of cmds, replacing those that don't match their checksum by an error,
+// and those that do by their payload for a client that didn't ask for frames.
+// The replies are shared with the reads coalesced with them, so they are
+// replaced rather than changed.
+func (c *connection) verifyChecksums(cmds []string, wm []*redis.Message, res []*redis.Message) {
+	if c.opts.Checksums == nil {
+		return
+	}
+	for i, r := range res {
+		m := wm[i]
+		if r == nil || len(m.Array) < 2 {
+			continue
+		}
+		switch {
+		case cmds[i] == "MGET" && r.IsArray():
+			var values []*redis.Message
+			for j, v := range r.Array {
+				if j+1 >= len(m.Array) {
+					break
+				}
+				if checked := c.checkRead(m.Array[j+1].Value, v); checked != v {
+					if values == nil {
+						values = append([]*redis.Message(nil), r.Array...)
+					}
+					values[j] = checked
+				}
+			}
+			if values != nil {
+				res[i] = &redis.Message{Type: r.Type, Array: values}
+			}
+		case ChecksumReads[cmds[i]]:
+			res[i] = c.checkRead(m.Array[1].Value, r)
+		}
+	}
+}
+
+// checkRead returns the value v of key as it is relayed to the client
+func (c *connection) checkRead(key []byte, v *redis.Message) *redis.Message {
+	if !v.IsBulkBytes() || v.Value == nil || !c.opts.Checksums.matches(key) {
+		return v
+	}
+	payload, framed, err := checksum.Unwrap(v.Value)
+	if !framed {
+		return v
+	}
+	if !c.checksumVerified(key, ChecksumRead, err) {
+		return c.proxyError(proxyerr.Checksum, "value read from %s doesn't match its checksum: %v", key, err)
+	}
+	if c.checksumFrames {
+		return v
+	}
+	return redis.NewBulkBytes(payload)
+}
+
+// checksumVerified counts the verification of a value of key, logging it if
+// it failed with err, and returns whether it passed
+func (c *connection) checksumVerified(key []byte, direction string, err error) bool {
+	if err == nil {
+		metrics.ChecksumVerified.Incr(c.statsd, direction)
+		return true
+	}
+	metrics.ChecksumFailures.Incr(c.statsd, direction)
+	c.log.Warn("Checksum mismatch", zap.ByteString("key", key), zap.String("direction", direction), zap.Error(err))
+	if c.trace != nil {
+		c.trace.add("checksum", direction+" of "+string(key)+" failed: "+err.Error())
+	}
+	return false
+}
+
+// proxyChecksum has the values of checksummed keys relayed with their frames,
+// for a client that verifies them itself, with PROXY CHECKSUM ON, or without,
+// with OFF
+func (c *connection) proxyChecksum(args []*redis.Message) *redis.Message {
+	if len(args) != 1 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'proxy|checksum' command")
+	}
+	switch strings.ToUpper(string(args[0].Value)) {
+	case "ON":
+		c.checksumFrames = true
+	case "OFF":
+		c.checksumFrames = false
+	default:
+		return redis.NewErrorf("ERR unknown PROXY CHECKSUM option '%s'", string(args[0].Value))
+	}
+	return redis.NewString([]byte("OK"))
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coinbase/redisbetween/checksum"
+	"github.com/coinbase/redisbetween/client"
+	"github.com/coinbase/redisbetween/redis"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+// storeKeys has an upstream keep the values SET writes, as GET and MGET read
+// them
+func storeKeys() (func(args []string) *redis.Message, map[string]string) {
+	var mu sync.Mutex
+	values := make(map[string]string)
+	get := func(key string) *redis.Message {
+		v, ok := values[key]
+		if !ok {
+			return redis.NewBulkBytes(nil)
+		}
+		return redis.NewBulkBytes([]byte(v))
+	}
+	return func(args []string) *redis.Message {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "SET":
+			values[args[1]] = args[2]
+		case "GET":
+			return get(args[1])
+		case "MGET":
+			r := make([]*redis.Message, len(args)-1)
+			for i, key := range args[1:] {
+				r[i] = get(key)
+			}
+			return redis.NewArray(r)
+		}
+		return redis.NewString([]byte("OK"))
+	}, values
+}
+
+// checksumClient is a go-redis client of one connection served by the proxy
+func checksumClient(t *testing.T, upstream string, opts Options, onConnect func(context.Context, *goredis.Conn) error) *goredis.Client {
+	rdb := goredis.NewClient(&goredis.Options{
+		PoolSize:  1,
+		OnConnect: onConnect,
+		Dialer: func(context.Context, string, string) (net.Conn, error) {
+			return closingTestConnection(t, upstream, opts), nil
+		},
+	})
+	t.Cleanup(func() { _ = rdb.Close() })
+	rdb.AddHook(client.NewChecksumHook("blob:"))
+	return rdb
+}
+
+func TestChecksumsRoundTrip(t *testing.T) {
+	handler, values := storeKeys()
+	upstream := newFakeUpstream(t, handler)
+	t.Cleanup(upstream.Close)
+	opts := Options{Checksums: NewChecksums([]string{"blob:"})}
+	unaware := checksumClient(t, upstream.Address(), opts, nil)
+	aware := checksumClient(t, upstream.Address(), opts, client.NegotiateChecksums)
+	ctx := context.Background()
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		payload := make([]byte, r.Intn(4096))
+		r.Read(payload)
+		if i%10 == 0 {
+			payload = []byte{}
+		}
+		assert.NoError(t, unaware.Set(ctx, "blob:a", payload, 0).Err())
+		assert.True(t, checksum.Framed([]byte(values["blob:a"])), "written framed")
+
+		// a reader that didn't negotiate checksums reads the payload alone,
+		// and one that did the frame, which it verifies itself
+		v, err := unaware.Get(ctx, "blob:a").Bytes()
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(payload, v), "payload of %d bytes", len(payload))
+		framed, err := aware.Get(ctx, "blob:a").Bytes()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(values["blob:a"]), framed)
+		v, err = client.Verify(framed, nil)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(payload, v), "payload of %d bytes", len(payload))
+	}
+
+	// legacy values, unframed, are read as they are
+	values["blob:legacy"] = "\x00RB"
+	v, err := unaware.Get(ctx, "blob:legacy").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, "\x00RB", v)
+	mget, err := unaware.MGet(ctx, "blob:a", "blob:legacy", "blob:missing").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{values["blob:a"][checksum.HeaderLen:], "\x00RB", nil}, mget)
+}
+
+func TestChecksumsCorrupt(t *testing.T) {
+	handler, values := storeKeys()
+	upstream := newFakeUpstream(t, handler)
+	t.Cleanup(upstream.Close)
+	c := closingTestConnection(t, upstream.Address(), Options{Checksums: NewChecksums([]string{"blob:"})})
+	corrupt := checksum.Wrap([]byte("payload"))
+	corrupt[len(corrupt)-1] ^= 1
+
+	// a corrupt write is refused, alone or in a transaction
+	assert.Equal(t, []string{"-PROXYCHECKSUM value written to blob:a doesn't match its checksum: checksum mismatch \\r\\n "},
+		roundTripStrings(t, c, 1, respCommand("SET", "blob:a", string(corrupt))))
+	assert.Equal(t, []string{"-PROXYCHECKSUM value written to blob:b doesn't match its checksum: checksum mismatch \\r\\n "},
+		roundTripStrings(t, c, 1, respCommand("MSET", "other", "v", "blob:b", string(corrupt))))
+	replies := roundTripStrings(t, c, 5,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("MULTI"),
+		respCommand("SETEX", "blob:c", "10", string(corrupt)),
+		respCommand("EXEC"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	)
+	assert.True(t, strings.HasPrefix(replies[3], "-PROXYCHECKSUM value written to blob:c"), replies[3])
+	assert.Zero(t, upstream.Commands(), "none of them forwarded")
+
+	// as is a corrupt value read, in its position
+	values["blob:d"] = string(corrupt)
+	values["blob:e"] = string(checksum.Wrap([]byte("good")))
+	values["other"] = string(corrupt)
+	assert.Equal(t, []string{
+		"-PROXYCHECKSUM value read from blob:d doesn't match its checksum: checksum mismatch \\r\\n ",
+		"*3 \\r\\n -PROXYCHECKSUM value read from blob:d doesn't match its checksum: checksum mismatch \\r\\n $4 \\r\\n good \\r\\n $16 \\r\\n " + string(corrupt) + " \\r\\n ",
+	}, roundTripStrings(t, c, 2, respCommand("GET", "blob:d"), respCommand("MGET", "blob:d", "blob:e", "other")))
+
+	// and a frame passed through if asked for, once verified
+	assert.Equal(t, []string{"+OK \\r\\n ", "$13 \\r\\n " + values["blob:e"] + " \\r\\n "},
+		roundTripStrings(t, c, 2, respCommand("PROXY", "CHECKSUM", "ON"), respCommand("GET", "blob:e")))
+	assert.Equal(t, []string{"-ERR unknown PROXY CHECKSUM option 'MAYBE' \\r\\n "}, roundTripStrings(t, c, 1, respCommand("PROXY", "CHECKSUM", "MAYBE")))
+}
+
+func TestChecksumsNotStreamed(t *testing.T) {
+	c := connection{opts: Options{StreamThreshold: 1024, Checksums: NewChecksums([]string{"blob:"})}}
+	// the values of checksummed keys are read whole, to be verified
+	assert.False(t, c.streams(requestBoundaries{}, false, []string{"GET"}, []*redis.Message{redis.NewArray(bulks("GET", "blob:a"))}))
+	assert.True(t, c.streams(requestBoundaries{}, false, []string{"GET"}, []*redis.Message{redis.NewArray(bulks("GET", "other"))}))
+}
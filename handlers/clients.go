@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"sync"
+)
+
+// MaxClientLibraries bounds the number of distinct client libraries tracked per
+// listener. Libraries seen after the table is full are counted under
+// OtherClientLibrary so that neither memory nor metric cardinality can grow
+// without bound.
+const MaxClientLibraries = 32
+
+const (
+	OtherClientLibrary   = "other"
+	UnknownClientLibrary = "unknown"
+)
+
+// ClientLibraries counts client connections by the library name and version they
+// announce via CLIENT SETINFO.
+type ClientLibraries struct {
+	mu     sync.Mutex
+	max    int
+	counts map[string]int64
+}
+
+func NewClientLibraries(max int) *ClientLibraries {
+	return &ClientLibraries{
+		max:    max,
+		counts: make(map[string]int64),
+	}
+}
+
+// Add counts one connection for lib and returns the bucket it was counted in.
+func (c *ClientLibraries) Add(lib string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.counts[lib]; !ok && len(c.counts) >= c.max {
+		lib = OtherClientLibrary
+	}
+	c.counts[lib]++
+	return lib
+}
+
+// Snapshot returns a copy of the per-library connection counts.
+func (c *ClientLibraries) Snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := make(map[string]int64, len(c.counts))
+	for k, v := range c.counts {
+		s[k] = v
+	}
+	return s
+}
+
+// clientInfo is what a client has told us about itself via HELLO and CLIENT SETINFO
+type clientInfo struct {
+	libName  string
+	libVer   string
+	protocol int
+	name     string
+	authUser string
+	recorded bool
+}
+
+func (ci *clientInfo) library() string {
+	if ci.libName == "" && ci.libVer == "" {
+		return UnknownClientLibrary
+	}
+	return ci.libName + "/" + ci.libVer
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestClientLibrariesBounded(t *testing.T) {
+	c := NewClientLibraries(2)
+	assert.Equal(t, "a/1", c.Add("a/1"))
+	assert.Equal(t, "b/1", c.Add("b/1"))
+	assert.Equal(t, "a/1", c.Add("a/1"))
+	assert.Equal(t, OtherClientLibrary, c.Add("c/1"))
+	assert.Equal(t, OtherClientLibrary, c.Add("d/1"))
+	assert.Equal(t, map[string]int64{"a/1": 2, "b/1": 1, OtherClientLibrary: 2}, c.Snapshot())
+}
+
+func TestHello(t *testing.T) {
+	c := connection{log: zap.NewNop(), id: 7}
+	assert.Equal(t, "*6 \\r\\n $6 \\r\\n server \\r\\n $12 \\r\\n redisbetween \\r\\n $5 \\r\\n proto \\r\\n :2 \\r\\n $2 \\r\\n id \\r\\n :7 \\r\\n ",
+		c.hello(bulks("2", "AUTH", "app", "secret", "SETNAME", "worker-1")).String())
+	assert.Equal(t, 2, c.client.protocol)
+	assert.Equal(t, "app", c.client.authUser)
+	assert.Equal(t, "worker-1", c.client.name)
+
+	assert.Equal(t, "-NOPROTO sorry, this protocol version is not supported \\r\\n ", c.hello(bulks("3")).String(),
+		"without a RESP3 pool")
+	assert.Equal(t, "-ERR Protocol version is not an integer or out of range \\r\\n ", c.hello(bulks("x")).String())
+	assert.Equal(t, "-ERR Syntax error in HELLO option 'AUTH' \\r\\n ", c.hello(bulks("2", "AUTH", "app")).String())
+
+	c.opts.RESP3 = &pool.Server{}
+	assert.Equal(t, "%3 \\r\\n $6 \\r\\n server \\r\\n $12 \\r\\n redisbetween \\r\\n $5 \\r\\n proto \\r\\n :3 \\r\\n $2 \\r\\n id \\r\\n :7 \\r\\n ",
+		c.hello(bulks("3")).String())
+	assert.True(t, c.speaksRESP3())
+	assert.Equal(t, c.opts.RESP3, c.general())
+	assert.Contains(t, c.hello(nil).String(), "proto \\r\\n :3", "HELLO alone keeps the protocol")
+	c.hello(bulks("2"))
+	assert.False(t, c.speaksRESP3())
+	c.db = 1
+	assert.Equal(t, "-NOPROTO sorry, this protocol version is not supported \\r\\n ", c.hello(bulks("3")).String(),
+		"the RESP3 pool is of the default database")
+}
+
+// roundTripFrames is roundTripStrings for replies of every RESP3 type
+func roundTripFrames(t *testing.T, client net.Conn, n int, commands ...string) []string {
+	t.Helper()
+	go func() {
+		for _, c := range commands {
+			_, _ = client.Write([]byte(c))
+		}
+	}()
+	d := redis.NewDecoder(client)
+	actual := make([]string, n)
+	for i := range actual {
+		m, err := d.DecodeFrame()
+		if !assert.NoError(t, err) {
+			return actual
+		}
+		actual[i] = m.String()
+	}
+	return actual
+}
+
+func TestRESP3Sessions(t *testing.T) {
+	resp2 := newFakeUpstream(t, echoKey)
+	defer resp2.Close()
+	// the RESP3 upstream answers HGETALL with a map holding a set and a double
+	nested := "%2\r\n+tags\r\n~2\r\n+a\r\n+b\r\n+score\r\n,1.5\r\n"
+	resp3 := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "HGETALL" {
+			m, _ := redis.DecodeFrameFromBytes([]byte(nested))
+			return m
+		}
+		return echoKey(args)
+	})
+	defer resp3.Close()
+	s := newTestServer(t, resp3.Address(), 2)
+	defer func() { _ = s.Disconnect(context.Background()) }()
+	client := closingTestConnection(t, resp2.Address(), Options{RESP3: s, Blocking: &Blocking{Server: s}, DBPools: &DBPools{}})
+
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripFrames(t, client, 1, respCommand("GET", "a")))
+	assert.EqualValues(t, 1, resp2.Commands())
+	r := roundTripFrames(t, client, 1, respCommand("HELLO", "3"))
+	assert.True(t, strings.HasPrefix(r[0], "%3 "), r[0])
+
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	assert.Equal(t, []string{"$-1 \\r\\n ", strings.ReplaceAll(nested, "\r\n", " \\r\\n "), "$7 \\r\\n b-value \\r\\n ", "$-1 \\r\\n "},
+		roundTripFrames(t, client, 4, start, respCommand("HGETALL", "h"), respCommand("GET", "b"), end),
+		"the RESP3 replies of a pipeline are relayed intact")
+	assert.EqualValues(t, 2, resp3.Commands())
+	assert.EqualValues(t, 1, resp2.Commands())
+
+	for _, cmd := range [][]string{{"BLPOP", "q", "1"}, {"SUBSCRIBE", "c"}, {"SELECT", "1"}} {
+		r := roundTripFrames(t, client, 1, respCommand(cmd...))
+		assert.Equal(t, "-PROXYBLOCKED "+cmd[0]+" is unsupported \\r\\n ", r[0], "the pools of %s speak RESP2", cmd[0])
+	}
+
+	roundTripFrames(t, client, 1, respCommand("HELLO", "2"))
+	assert.Equal(t, []string{"$7 \\r\\n c-value \\r\\n "}, roundTripFrames(t, client, 1, respCommand("GET", "c")))
+	assert.EqualValues(t, 2, resp2.Commands(), "back on the RESP2 pool")
+}
+
+func TestClientSetInfo(t *testing.T) {
+	c := connection{}
+	assert.Equal(t, "+OK \\r\\n ", c.clientSetInfo(bulks("lib-name", "go-redis")).String())
+	assert.Equal(t, "+OK \\r\\n ", c.clientSetInfo(bulks("LIB-VER", "9.0.5")).String())
+	assert.Equal(t, "go-redis/9.0.5", c.client.library())
+	assert.Equal(t, "-ERR Unrecognized option 'foo' \\r\\n ", c.clientSetInfo(bulks("foo", "bar")).String())
+	assert.True(t, c.clientSetInfo(bulks("lib-name")).IsError())
+}
+
+func TestClientInfo(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	defer func() { _ = server.Close() }()
+	connected := time.Now()
+	c := connection{log: zap.NewNop(), id: 42, conn: server, address: "/var/tmp/redisbetween-cache.sock", db: 3, connected: connected, opts: Options{ProxyVersion: "v1.2.3"}}
+
+	assert.Equal(t, "id=42 addr=pipe laddr=/var/tmp/redisbetween-cache.sock name= age=5 idle=0 flags=N db=3 sub=0 psub=0 multi=-1 cmd=client|info user=default resp=2 lib-name= lib-ver= proxy=redisbetween proxy_ver=v1.2.3\n",
+		c.clientInfoLine(connected.Add(5*time.Second)))
+
+	assert.Equal(t, "+OK \\r\\n ", c.clientSetName(bulks("worker-1")).String())
+	assert.Equal(t, "-ERR Client names cannot contain spaces, newlines or special characters. \\r\\n ", c.clientSetName(bulks("worker 1")).String())
+	assert.True(t, c.clientSetName(bulks()).IsError())
+	c.client.authUser, c.client.libName, c.client.libVer = "app", "go-redis", "9.0.5"
+	assert.Equal(t, "id=42 addr=pipe laddr=/var/tmp/redisbetween-cache.sock name=worker-1 age=0 idle=0 flags=N db=3 sub=0 psub=0 multi=-1 cmd=client|info user=app resp=2 lib-name=go-redis lib-ver=9.0.5 proxy=redisbetween proxy_ver=v1.2.3\n",
+		c.clientInfoLine(connected))
+}
+
+func TestClientCommandsAnsweredLocally(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = client.Close() }()
+
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		":1 \\r\\n ",
+		"$-1 \\r\\n ",
+		"+OK \\r\\n ",
+		"$8 \\r\\n worker-1 \\r\\n ",
+		"$-1 \\r\\n ",
+	}, roundTripStrings(t, client, 6,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("CLIENT", "ID"),
+		respCommand("CLIENT", "GETNAME"),
+		respCommand("CLIENT", "SETNAME", "worker-1"),
+		respCommand("CLIENT", "GETNAME"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	))
+	r := roundTripStrings(t, client, 1, respCommand("CLIENT", "INFO"))
+	assert.Contains(t, r[0], "id=1 ", r[0])
+	assert.Contains(t, r[0], " name=worker-1 ", r[0])
+	assert.Contains(t, r[0], " proxy=redisbetween ", r[0])
+	assert.Equal(t, int64(0), upstream.Commands(), "the client commands are about the client's own connection, not a pooled one")
+}
+
+func TestClientLibraryFingerprintThroughPipeline(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	libraries := NewClientLibraries(MaxClientLibraries)
+	client := runTestConnection(t, upstream.Address(), Options{
+		ClientLibraries:   libraries,
+		DeprecatedClients: regexp.MustCompile(`^redis-rb/4\.`),
+	})
+	c := connection{log: zap.New(core), opts: Options{ClientLibraries: libraries, DeprecatedClients: regexp.MustCompile(`^redis-rb/4\.`)}}
+
+	actual := roundTripStrings(t, client, 5,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("CLIENT", "SETINFO", "LIB-NAME", "go-redis"),
+		respCommand("GET", "a"),
+		respCommand("CLIENT", "SETINFO", "LIB-VER", "9.0.5"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	)
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"+OK \\r\\n ",
+		"$7 \\r\\n a-value \\r\\n ",
+		"+OK \\r\\n ",
+		"$-1 \\r\\n ",
+	}, actual)
+	assert.Equal(t, int64(1), upstream.Commands(), "CLIENT SETINFO is answered locally")
+	_ = client.Close()
+
+	assert.Eventually(t, func() bool {
+		return libraries.Snapshot()["go-redis/9.0.5"] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// deprecated libraries are logged once per connection
+	c.client = clientInfo{libName: "redis-rb", libVer: "4.2.5"}
+	c.recordClientLibrary(false)
+	c.recordClientLibrary(true)
+	assert.Equal(t, 1, logs.FilterMessage("Deprecated client library").Len())
+	assert.Equal(t, int64(1), libraries.Snapshot()["redis-rb/4.2.5"])
+}
+
+func TestUnidentifiedClientCountedOnDisconnect(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+
+	libraries := NewClientLibraries(MaxClientLibraries)
+	client := runTestConnection(t, upstream.Address(), Options{ClientLibraries: libraries})
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+	assert.Empty(t, libraries.Snapshot())
+	_ = client.Close()
+
+	assert.Eventually(t, func() bool {
+		return libraries.Snapshot()[UnknownClientLibrary] == 1
+	}, time.Second, 10*time.Millisecond)
+}
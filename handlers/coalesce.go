@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// CoalesceCommands are the reads a Coalescer shares, those whose reply is the
+// same for every client sending them at the same time
+var CoalesceCommands = map[string]bool{
+	"EXISTS":        true,
+	"GET":           true,
+	"GETRANGE":      true,
+	"HEXISTS":       true,
+	"HGET":          true,
+	"HGETALL":       true,
+	"HKEYS":         true,
+	"HLEN":          true,
+	"HMGET":         true,
+	"HVALS":         true,
+	"LINDEX":        true,
+	"LLEN":          true,
+	"LRANGE":        true,
+	"MGET":          true,
+	"SCARD":         true,
+	"SISMEMBER":     true,
+	"SMEMBERS":      true,
+	"STRLEN":        true,
+	"TYPE":          true,
+	"ZCARD":         true,
+	"ZRANGE":        true,
+	"ZRANGEBYSCORE": true,
+	"ZRANK":         true,
+	"ZREVRANGE":     true,
+	"ZREVRANK":      true,
+	"ZSCORE":        true,
+}
+
+// CoalesceOptions configures a Coalescer: at most MaxKeys reads are in flight
+// for others to join, and reads encoding to more than MaxBytes aren't shared
+type CoalesceOptions struct {
+	MaxKeys  int
+	MaxBytes int
+}
+
+// coalesced is a read in flight, which identical reads wait on rather than
+// sending their own. abandoned is set if it ended without a reply because its
+// own client went away, which the others don't share. key is its key in the
+// flights, and reads those of the keys it reads, "db/key".
+type coalesced struct {
+	key       string
+	db        int
+	reads     []string
+	done      chan struct{}
+	res       []*redis.Message
+	err       error
+	abandoned bool
+	joined    int
+}
+
+// Coalescer shares one upstream read between the identical reads clients send
+// at the same time, such as those of a hot key that just expired. A request
+// that is a lone read of CoalesceCommands joins the read of the same command
+// and database in flight, if there is one, until its reply arrives; those
+// sent after it start another. A write forwarded while a read of one of its keys
+// is in flight, GETDEL and the other ReadWriteCommands included, detaches that
+// read, so that the reads sent after the write start another rather than being
+// answered with what it changed.
+type Coalescer struct {
+	opts CoalesceOptions
+
+	mu        sync.Mutex
+	flights   map[string]*coalesced
+	reading   map[string]map[*coalesced]bool
+	maxFanout int
+}
+
+func NewCoalescer(opts CoalesceOptions) *Coalescer {
+	return &Coalescer{opts: opts, flights: make(map[string]*coalesced), reading: make(map[string]map[*coalesced]bool)}
+}
+
+func readKey(db int, key string) string {
+	return strconv.Itoa(db) + "/" + key
+}
+
+// join returns the read in flight for key and false, or one started for the
+// caller to send and true, reading keys of db. It returns nil if
+// coalescemaxkeys reads are in flight already.
+func (co *Coalescer) join(key string, db int, keys [][]byte) (*coalesced, bool) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if f, ok := co.flights[key]; ok {
+		f.joined++
+		return f, false
+	}
+	if len(co.flights) >= co.opts.MaxKeys {
+		return nil, false
+	}
+	f := &coalesced{key: key, db: db, done: make(chan struct{})}
+	for _, k := range keys {
+		r := readKey(db, string(k))
+		if co.reading[r] == nil {
+			co.reading[r] = make(map[*coalesced]bool)
+		}
+		co.reading[r][f] = true
+		f.reads = append(f.reads, r)
+	}
+	co.flights[key] = f
+	return f, true
+}
+
+// detach stops a read in flight from being joined, the reads after it starting
+// another. Those that joined it already still get its reply.
+func (co *Coalescer) detach(f *coalesced) {
+	if co.flights[f.key] == f {
+		delete(co.flights, f.key)
+	}
+}
+
+// forget detaches the reads in flight of the data inv invalidates, of a write
+// sent on db
+func (co *Coalescer) forget(db int, inv Invalidation) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	for _, f := range co.flights {
+		if inv.clears(db, f.db) {
+			co.detach(f)
+		}
+	}
+	for _, k := range inv.Keys {
+		kdb := k.DB
+		if kdb < 0 {
+			kdb = db
+		}
+		for f := range co.reading[readKey(kdb, k.Key)] {
+			co.detach(f)
+		}
+	}
+}
+
+// finish hands the reply of a read to those that joined it, and lets the next
+// identical read start another
+func (co *Coalescer) finish(f *coalesced, res []*redis.Message, err error, abandoned bool) {
+	co.mu.Lock()
+	co.detach(f)
+	for _, r := range f.reads {
+		delete(co.reading[r], f)
+		if len(co.reading[r]) == 0 {
+			delete(co.reading, r)
+		}
+	}
+	if f.joined+1 > co.maxFanout {
+		co.maxFanout = f.joined + 1
+	}
+	co.mu.Unlock()
+	// the caller goes on with res, so those that joined get a copy of their own
+	f.res, f.err, f.abandoned = append([]*redis.Message(nil), res...), err, abandoned
+	close(f.done)
+}
+
+// Report emits the most reads answered by one upstream read since the last
+// report, and the reads in flight
+func (co *Coalescer) Report(sd *statsd.Client) {
+	co.mu.Lock()
+	fanout, inFlight := co.maxFanout, len(co.flights)
+	co.maxFanout = 0
+	co.mu.Unlock()
+	metrics.CoalesceMaxFanout.Set(sd, float64(fanout))
+	metrics.CoalesceInFlight.Set(sd, float64(inFlight))
+}
+
+// coalescedForward forwards a run of commands, sharing the upstream read of a
+// lone read with the identical ones of other clients in flight
+func (c *connection) coalescedForward(db int, cmds []string, wm []*redis.Message) ([]*redis.Message, *zap.Logger, error) {
+	co := c.opts.Coalescer
+	if co == nil {
+		return c.guardedForward(db, cmds, wm)
+	}
+	if len(cmds) != 1 || !CoalesceCommands[cmds[0]] {
+		c.forgetReads(db, cmds, wm)
+		return c.guardedForward(db, cmds, wm)
+	}
+	encoded, err := redis.EncodeToBytes(wm[0])
+	if err != nil {
+		return c.guardedForward(db, cmds, wm)
+	}
+	if len(encoded) > co.opts.MaxBytes {
+		metrics.CoalesceSkipped.Incr(c.statsd, "too_large")
+		return c.guardedForward(db, cmds, wm)
+	}
+	key := readKey(db, string(encoded))
+	if c.speaksRESP3() {
+		key = "resp3/" + key
+	}
+	f, leader := co.join(key, db, c.opts.Keys.Keys(cmds[0], wm[0]))
+	if f == nil {
+		metrics.CoalesceSkipped.Incr(c.statsd, "full")
+		return c.guardedForward(db, cmds, wm)
+	}
+	if leader {
+		res, l, err := c.guardedForward(db, cmds, wm)
+		co.finish(f, res, err, err != nil && c.ctx.Err() != nil)
+		return res, l, err
+	}
+
+	<-f.done
+	if f.abandoned {
+		return c.guardedForward(db, cmds, wm)
+	}
+	metrics.CoalesceJoined.Incr(c.statsd)
+	if c.trace != nil {
+		c.trace.add("coalesce", fmt.Sprintf("answered by an identical %s in flight", cmds[0]))
+	}
+	return append([]*redis.Message(nil), f.res...), c.log, f.err
+}
+
+// forgetReads detaches the reads in flight of the keys the writes of a run of
+// commands change, before the writes are forwarded
+func (c *connection) forgetReads(db int, cmds []string, wm []*redis.Message) {
+	co := c.opts.Coalescer
+	if co == nil {
+		return
+	}
+	for i, cmd := range cmds {
+		if inv, ok := Invalidates(cmd, wm[i]); ok {
+			co.forget(db, inv)
+		}
+	}
+}
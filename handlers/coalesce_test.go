@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// joinedFor is the number of reads that joined the one in flight for key
+func (co *Coalescer) joinedFor(key string) int {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if f, ok := co.flights[key]; ok {
+		return f.joined
+	}
+	return -1
+}
+
+func TestCoalesceIdenticalReads(t *testing.T) {
+	release := make(chan struct{})
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if len(args) > 1 && args[1] == "hot" {
+			<-release
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	co := NewCoalescer(CoalesceOptions{MaxKeys: 10, MaxBytes: 1024})
+
+	const clients = 5
+	conns := make([]net.Conn, clients)
+	for i := range conns {
+		conns[i] = closingTestConnection(t, upstream.Address(), Options{Coalescer: co})
+	}
+	var wg sync.WaitGroup
+	replies := make([][]string, clients)
+	for i, client := range conns {
+		wg.Add(1)
+		go func(i int, client net.Conn) {
+			defer wg.Done()
+			replies[i] = roundTripStrings(t, client, 1, respCommand("GET", "hot"))
+		}(i, client)
+	}
+	key := "0/" + respCommand("GET", "hot")
+	assert.Eventually(t, func() bool { return co.joinedFor(key) == clients-1 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, r := range replies {
+		assert.Equal(t, []string{"$9 \\r\\n hot-value \\r\\n "}, r)
+	}
+	assert.EqualValues(t, 1, upstream.Commands(), "one read shared by every client")
+	assert.Equal(t, clients, co.maxFanout)
+	assert.Empty(t, co.flights)
+
+	// once the reply arrived, the next read is sent again
+	assert.Equal(t, []string{"$9 \\r\\n hot-value \\r\\n "}, roundTripStrings(t, conns[0], 1, respCommand("GET", "hot")))
+	assert.EqualValues(t, 2, upstream.Commands())
+}
+
+func TestCoalesceOnlyLoneReads(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	co := NewCoalescer(CoalesceOptions{MaxKeys: 10, MaxBytes: 32})
+	client := closingTestConnection(t, upstream.Address(), Options{Coalescer: co})
+
+	// writes, pipelines, reads too large to share and reads past the table's
+	// capacity are sent on their own
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SET", "a", "1")))
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	assert.Equal(t, []string{"$-1 \\r\\n ", "$7 \\r\\n a-value \\r\\n ", "$7 \\r\\n b-value \\r\\n ", "$-1 \\r\\n "},
+		roundTripStrings(t, client, 4, start, respCommand("GET", "a"), respCommand("GET", "b"), end))
+	long := strings.Repeat("k", 40)
+	assert.Equal(t, []string{"$46 \\r\\n " + long + "-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", long)))
+	assert.Equal(t, 0, co.maxFanout)
+
+	co.opts.MaxKeys = 0
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+	assert.Equal(t, 0, co.maxFanout)
+	assert.EqualValues(t, 5, upstream.Commands())
+
+	co.opts.MaxKeys = 10
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+	assert.Equal(t, 1, co.maxFanout, "a lone read not joined is a fan-out of one")
+}
+
+func TestCoalesceDetachedByWrites(t *testing.T) {
+	var gets int64
+	release := make(chan struct{})
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "GET" && atomic.AddInt64(&gets, 1) == 1 {
+			<-release
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	co := NewCoalescer(CoalesceOptions{MaxKeys: 10, MaxBytes: 1024})
+	first := closingTestConnection(t, upstream.Address(), Options{Coalescer: co})
+	second := closingTestConnection(t, upstream.Address(), Options{Coalescer: co})
+
+	for _, write := range readWriteCommands {
+		atomic.StoreInt64(&gets, 0)
+		done := make(chan []string)
+		go func() { done <- roundTripStrings(t, first, 1, respCommand("GET", "k")) }()
+		key := "0/" + respCommand("GET", "k")
+		assert.Eventually(t, func() bool { return co.joinedFor(key) == 0 }, time.Second, time.Millisecond)
+
+		assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, second, 1, respCommand(write...)))
+		assert.Equal(t, -1, co.joinedFor(key), "%v detached the read in flight", write)
+		assert.Equal(t, []string{"$7 \\r\\n k-value \\r\\n "}, roundTripStrings(t, second, 1, respCommand("GET", "k")),
+			"read again rather than answered by the read sent before %v", write)
+		release <- struct{}{}
+		assert.Equal(t, []string{"$7 \\r\\n k-value \\r\\n "}, <-done)
+	}
+	assert.Empty(t, co.flights)
+	assert.Empty(t, co.reading)
+
+	// writes of other keys leave it be
+	atomic.StoreInt64(&gets, 0)
+	done := make(chan []string)
+	go func() { done <- roundTripStrings(t, first, 1, respCommand("GET", "k")) }()
+	key := "0/" + respCommand("GET", "k")
+	assert.Eventually(t, func() bool { return co.joinedFor(key) == 0 }, time.Second, time.Millisecond)
+	roundTripStrings(t, second, 1, respCommand("GETDEL", "other"))
+	assert.Equal(t, 0, co.joinedFor(key))
+	release <- struct{}{}
+	<-done
+}
+
+func TestCoalesceSharesErrors(t *testing.T) {
+	// the error of a read that failed is the answer of those that joined it
+	upstream := newFakeUpstream(t, echoKey)
+	upstream.Close()
+	co := NewCoalescer(CoalesceOptions{MaxKeys: 10, MaxBytes: 1024})
+	key := "0/" + respCommand("GET", "a")
+	f, leader := co.join(key, 0, nil)
+	assert.True(t, leader)
+
+	client := closingTestConnection(t, upstream.Address(), Options{Coalescer: co})
+	done := make(chan []string)
+	go func() { done <- roundTripStrings(t, client, 1, respCommand("GET", "a")) }()
+	assert.Eventually(t, func() bool { return co.joinedFor(key) == 1 }, time.Second, time.Millisecond)
+	co.finish(f, nil, errors.New("gone"), false)
+	assert.Equal(t, []string{"-PROXYUNAVAILABLE gone \\r\\n "}, <-done)
+
+	// and one abandoned by its client is sent again
+	f, _ = co.join(key, 0, nil)
+	go func() { done <- roundTripStrings(t, client, 1, respCommand("GET", "a")) }()
+	assert.Eventually(t, func() bool { return co.joinedFor(key) == 1 }, time.Second, time.Millisecond)
+	co.finish(f, nil, nil, true)
+	assert.True(t, strings.HasPrefix((<-done)[0], "-PROXYUNAVAILABLE connection("))
+}
@@ -3,13 +3,23 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/auth"
+	"github.com/coinbase/redisbetween/internal/workload"
+	"github.com/coinbase/redisbetween/memwatch"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
 	"github.com/coinbase/redisbetween/redis"
+	"github.com/coinbase/redisbetween/sanitize"
+	"github.com/coinbase/redisbetween/session"
 	"io"
 	"net"
-	"runtime/debug"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
@@ -18,48 +28,369 @@ import (
 
 type connection struct {
 	log          *zap.Logger
+	connLog      *zap.Logger // log without the fields of the client's identity
 	statsd       *statsd.Client
 	ctx          context.Context
+	readCtx      context.Context
 	readTimeout  time.Duration
 	writeTimeout time.Duration
 	conn         net.Conn
 	address      string
 	id           uint64
+	connected    time.Time
 	server       *pool.Server
-	kill         chan interface{}
-	interceptor  MessageInterceptor
+	db           int // the database selected, in dynamic database mode
+	pipelineOpen int32
+	// signaled is whether the request read last was a pipeline wrapped in its
+	// signals, whose replies are padded for them
+	signaled bool
+	// signalStarted is when the start signal of the pipeline open was read, and
+	// signalBefore the messages of its request read before it
+	signalStarted time.Time
+	signalBefore  int
+	// reader is conn, with the reads of requests timed, and dec decodes them,
+	// keeping what it buffered past one request for the next. requested is
+	// whether the client has sent a first request, and requestStarted whether
+	// part of the one being read has arrived.
+	reader         net.Conn
+	dec            *redis.Decoder
+	requested      bool
+	requestStarted bool
+	kill           chan interface{}
+	interceptor    MessageInterceptor
+	opts           Options
+	client         clientInfo
+	tracing        bool
+	trace          *trace
+	// checksumFrames is whether the client asked for the values of checksummed
+	// keys with their frames, with PROXY CHECKSUM ON
+	checksumFrames bool
+	lastTrace      uint64
+	session        *session.Writer
+	identity       *auth.Identity
+	// unread is the request read once a subscription ended, to be handled next
+	// rather than read, with the index of its first message read after a
+	// drain began
+	unread     []*redis.Message
+	unreadLate int
+	// tx is the transaction the client is pinned for, if any
+	tx *pinnedTransaction
+	// timings are those of the request being handled, and last those of the
+	// last one answered, for PROXY LASTSTATS
+	timings requestTimings
+	last    LastStats
+	// streaming is whether the reply of the request being handled may be
+	// streamed, and streamHeld how long an upstream connection was held
+	// streaming it
+	streaming  bool
+	streamHeld time.Duration
+	// unparsed are the commands of the request being handled whose replies
+	// are read unparsed
+	unparsed map[*redis.Message]bool
+	// warnings are those attached to the connection
+	warnings connWarnings
+	// peerPID and peerUID are those of the client's process, if peerKnown, read
+	// once peerRead for the access log
+	peerPID   int32
+	peerUID   uint32
+	peerKnown bool
+	peerRead  bool
+	// request is the last one read, for a panic handling it to be logged with
+	request []*redis.Message
 }
 type MessageInterceptor func(incomingCmds []string, m []*redis.Message)
 
+// Options carries the per-upstream settings that shape how client connections are
+// handled. The zero value reproduces the proxy's default behavior.
+type Options struct {
+	// Retries is the number of times a failed connection checkout is retried. A
+	// failed checkout never reached the upstream, so it is safe to retry any command.
+	// A failed write is retried as often if none of it was written, or if
+	// its commands are idempotent.
+	Retries int
+	// RetryBudget, if set, caps retries across all client connections of the upstream.
+	RetryBudget *RetryBudget
+	// ClientLibraries, if set, counts connections by announced client library.
+	ClientLibraries *ClientLibraries
+	// DeprecatedClients, if set, logs a warning for each connection whose
+	// "lib-name/lib-ver" matches.
+	DeprecatedClients *regexp.Regexp
+	// Reserved, if set, is a small pool used only by batches made up entirely of
+	// critical commands, which are those named in CriticalCommands or whose first
+	// key starts with one of CriticalPrefixes.
+	Reserved         *pool.Server
+	CriticalCommands map[string]bool
+	CriticalPrefixes []string
+	// SplitThreshold, if positive, splits SplittableCommands with more keys than
+	// this into chunks of SplitChunkSize keys. A lone split command is fanned out
+	// over up to SplitParallelism pooled connections.
+	SplitThreshold   int
+	SplitChunkSize   int
+	SplitParallelism int
+	// AtomicMaxCommands caps the commands a PROXY ATOMIC group may enclose,
+	// DefaultAtomicMaxCommands if unset
+	AtomicMaxCommands int
+	// Upstream is the address of the upstream, and UpstreamUser the ACL user the
+	// proxy connects as. If EnrichACLErrors is set, they are added to NOPERM and
+	// WRONGPASS errors so clients can tell a server-side ACL from a proxy rule.
+	Upstream        string
+	UpstreamUser    string
+	EnrichACLErrors bool
+	// ReadOnly, while enabled, rejects WriteCommands. ReadOnlyScripts is either
+	// ReadOnlyScriptsBlock or ReadOnlyScriptsAllowRO.
+	ReadOnly        *ReadOnly
+	ReadOnlyScripts string
+	// Sockets, if set, lists the sockets of the whole process for PROXY SOCKETS
+	Sockets func() []Socket
+	// Bench, if set, runs a PROXY BENCH workload through the proxy's own socket
+	Bench func(cfg workload.Config) (workload.Result, error)
+	// Schema, if set, describes the metrics and admin stats for PROXY SCHEMA
+	Schema func() interface{}
+	// HandOff, if set, stops accepting on the socket at a path for PROXY
+	// HANDOFF, for a successor about to take its place to be told once it has
+	HandOff func(local string) error
+	// Breaker and InFlight, if set, guard the upstream node: requests fail fast
+	// while its circuit is open or it has too many requests in flight. Slots, if
+	// set, describes the cluster slots the node serves for those errors.
+	Breaker  *Breaker
+	InFlight *InFlight
+	Slots    func() string
+	// Segments, if set, partitions the node's pool between classes of requests,
+	// each capped at its share of the connections. Requests on the reserved lane
+	// are outside of them.
+	Segments *Segments
+	// Memory, if set, sheds requests while the process is over its memory
+	// limits: large ones over the soft limit, and all of them over the hard
+	// limit, except those made up entirely of critical commands
+	Memory *memwatch.Watchdog
+	// Keys, if set, locates the keys of commands, including those of modules,
+	// for CriticalPrefixes
+	Keys *KeyTable
+	// ErrorRewriter, if set, rewrites the upstream addresses in error replies
+	ErrorRewriter *ErrorRewriter
+	// TopologyRewriter, if set, rewrites the node addresses in the replies of
+	// ClusterTopologyCommands
+	TopologyRewriter *TopologyRewriter
+	// StrictValidation, if set, answers commands with the wrong number of
+	// arguments or a malformed integer argument with the error redis would
+	// return, without forwarding them. It needs Keys to know each command's arity.
+	StrictValidation bool
+	// Auth, if set, authenticates clients with AUTH, or HELLO's AUTH option,
+	// answering everything else with NOAUTH until they have. An AUTH waits for
+	// the provider for no longer than AuthTimeout.
+	Auth        auth.Provider
+	AuthTimeout time.Duration
+	// LocalAuth, without Auth, answers AUTH with OK rather than rejecting it, for
+	// upstreams the proxy authenticates its own connections to: they are shared
+	// by every client, so a client's AUTH can't be forwarded to them
+	LocalAuth bool
+	// PlainErrors, if set, leaves the proxyerr code out of the errors the proxy
+	// answers with itself, for clients that only understand ERR
+	PlainErrors bool
+	// Tracer, if set, records the routing decisions of the requests it samples,
+	// and of those of connections that ask for it with PROXY TRACE ON
+	Tracer *Tracer
+	// Sessions, if set, records the sessions of the clients its rules are armed
+	// for
+	Sessions *session.Recorder
+	// WriteBehind, if set, acknowledges the increments of counters it matches
+	// right away and flushes them to the upstream in the background
+	WriteBehind *WriteBehind
+	// Mirror, if set, is sent a copy of the commands forwarded in the
+	// background
+	Mirror *Mirror
+	// Warnings, if set, attaches advisory messages to the connection, for the
+	// policies it runs into and the operator's broadcasts
+	Warnings *Warnings
+	// SLOs, if set, counts every request as good or bad against the latency
+	// objectives its commands match
+	SLOs *SLOs
+	// Mix, if set, counts the commands of every request by class and name
+	Mix *CommandMix
+	// Database is the database the upstream connections are on, and Databases,
+	// if set, the caches of every database, cleared by FLUSHDB, FLUSHALL and
+	// SWAPDB. SWAPDB is rejected unless AllowSwapDB is set.
+	Database    int
+	Databases   *Databases
+	AllowSwapDB bool
+	// ConfigCache, if set, answers the CONFIG GET of ConfigParams, and that of
+	// other parameters too unless ConfigGetForward is set. CONFIG SET, REWRITE
+	// and RESETSTAT are rejected unless AllowConfigWrites is set.
+	ConfigCache       *ConfigCache
+	ConfigGetForward  bool
+	AllowConfigWrites bool
+	// DBPools, if set, lets clients SELECT other databases, each served by a
+	// pool of its own. Database is then the default database of new clients.
+	DBPools *DBPools
+	// ReadThrough, if set, answers the GET misses of keys its rules match from
+	// their fallbacks, populating the upstream along the way
+	ReadThrough *ReadThrough
+	// ReadFallback, if set, answers the reads the upstream fails from a
+	// secondary upstream
+	ReadFallback *ReadFallback
+	// Coalescer, if set, shares the upstream read of a lone read with the
+	// identical ones other clients send while it is in flight
+	Coalescer *Coalescer
+	// NegativeCache, if set, answers the reads of the keys of its prefixes that
+	// it knows missing, and must be registered with Databases, which has it
+	// forget the keys written
+	NegativeCache *NegativeCache
+	// TTLPolicy, if set, caps the TTLs of the keys of its namespaces
+	TTLPolicy *TTLPolicy
+	// Blocking, if set, lets clients send BlockingCommands, over a pool of
+	// their own rather than being rejected as unsupported
+	Blocking *Blocking
+	// PubSub, if set, lets clients subscribe, each pinning a connection of its
+	// pool for as long as it is subscribed
+	PubSub *PubSub
+	// RESP3, if set, is a pool whose connections speak RESP3, which the clients
+	// that negotiate it with HELLO 3 are served over. The other pools speak
+	// RESP2, so the blocking commands, subscribes and SELECTs they serve are
+	// unsupported for those clients.
+	RESP3 *pool.Server
+	// Transactions, if set, pins a connection of the pool to a client whose
+	// request leaves a transaction open, until it is closed
+	Transactions *Transactions
+	// CommandMetrics, if set, names the commands timed and counted under their
+	// own name, each command of a request getting its own timing
+	CommandMetrics CommandMetrics
+	// CommandFilter, if set, answers the commands it blocks with an error in
+	// their position, without forwarding them
+	CommandFilter *CommandFilter
+	// Hotspots, if set, samples the slots of commands, and rejects writes to
+	// keys with a banned hash tag
+	Hotspots *Hotspots
+	// Draining, once closed, closes the connection as soon as it is idle: a
+	// command being handled is still answered, but no further ones are read. A
+	// pipeline being read is let complete, with PROXYMAINT for the commands read
+	// after Draining closed, or if DrainNotify is set, cut short with one
+	// PROXYMAINT after the replies of those read before.
+	Draining    <-chan interface{}
+	DrainNotify bool
+	// Activity, if set, counts the connections, their requests in flight and the
+	// connections pinned by a pipeline, for the drain report
+	Activity *Activity
+	// Traffic, if set, counts the requests and commands of the connections
+	Traffic *Traffic
+	// Signals, if set, counts the pipelines wrapped in signals, and the signals
+	// that don't balance, which are logged
+	Signals *Signals
+	// FairQueue, if set, has checkouts of the pool wait their turn in the order
+	// they started waiting, with a cap on the connections each client holds
+	FairQueue *FairQueue
+	// FirstByteTimeout, if set, closes a connection whose client sends nothing
+	// for that long after it connects, ProgressTimeout one whose request has
+	// started arriving but whose next message isn't read whole within it, and
+	// IdleTimeout one that sends no request for that long after its last
+	FirstByteTimeout time.Duration
+	ProgressTimeout  time.Duration
+	IdleTimeout      time.Duration
+	// Identity, if set, is the last check that the upstream is the one
+	// configured, which refuses every command while it mismatches if it fails
+	// fast
+	Identity *Identity
+	// ProxyVersion is the version of the proxy, given in CLIENT INFO
+	ProxyVersion string
+	// Scripts, if set, accounts for the Lua scripts clients run, by SHA, and
+	// sheds the calls over its limits
+	Scripts *Scripts
+	// SlowLog, if set, logs and keeps the upstream round trips slower than its
+	// threshold
+	SlowLog *SlowLog
+	// AccessLog, if set, logs a sample of the requests answered, and those
+	// answered with an error
+	AccessLog *AccessLog
+	// IgnorePipelineSignals has the GET 🔜 and GET 🔚 pipeline signals forwarded
+	// as the reads they look like, rather than read as the start and end of a
+	// pipeline
+	IgnorePipelineSignals bool
+	// Readahead, if set, has the read of a request that isn't wrapped in signals
+	// go on with the commands its client has already sent whole, up to Readahead
+	// commands in all, which are forwarded upstream as one batch
+	Readahead int
+
+	// StreamThreshold, if set, has the bulk string replies of lone
+	// StreamCommands reads longer than it copied to the client as they arrive,
+	// rather than read whole, those over StreamMaxBytes, if set, being refused
+	StreamThreshold int
+	StreamMaxBytes  int
+	// Checksums, if set, verifies the checksum frames of the values of the keys
+	// of its prefixes, both written and read
+	Checksums *Checksums
+}
+
 var PipelineSignalStartKey = []byte("🔜")
 var PipelineSignalEndKey = []byte("🔚")
 
-func CommandConnection(log *zap.Logger, sd *statsd.Client, conn net.Conn, address string, readTimeout, writeTimeout time.Duration, id uint64, server *pool.Server, kill chan interface{}, interceptor MessageInterceptor) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Error("Connection crashed", zap.String("panic", fmt.Sprintf("%v", r)), zap.String("stack", string(debug.Stack())))
-		}
-	}()
-
+func CommandConnection(log *zap.Logger, sd *statsd.Client, conn net.Conn, address string, readTimeout, writeTimeout time.Duration, id uint64, server *pool.Server, kill chan interface{}, interceptor MessageInterceptor, opts Options) {
 	c := connection{
-		log:         log,
-		statsd:      sd,
-		ctx:         context.Background(),
-		conn:        conn,
-		address:     address,
-		id:          id,
-		server:      server,
-		kill:        kill,
-		interceptor: interceptor,
+		log:          log,
+		connLog:      log,
+		statsd:       sd,
+		ctx:          context.Background(),
+		conn:         conn,
+		address:      address,
+		id:           id,
+		connected:    time.Now(),
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+		server:       server,
+		db:           opts.Database,
+		kill:         kill,
+		interceptor:  interceptor,
+		opts:         opts,
 	}
+	defer c.recoverPanic()
+	c.reader = &progressConn{Conn: conn, c: &c}
+	c.dec = redis.NewPooledDecoder(c.reader)
+	defer c.dec.Release()
 	c.processMessages()
 }
 
 func (c *connection) processMessages() {
+	defer c.recordClientLibrary(true)
+	defer c.stopSession("client disconnected")
+	// readCtx is cancelled when the proxy starts draining, so that no further
+	// commands are read from the client
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.readCtx = ctx
+	if c.opts.Draining != nil {
+		go func() {
+			select {
+			case <-c.opts.Draining:
+				// cancelling first means a read that starts after this sees the
+				// cancellation, and one already waiting is woken by the deadline.
+				// A pipeline being read is let complete, unless its client is to
+				// be told to release it.
+				cancel()
+				if atomic.LoadInt32(&c.pipelineOpen) == 0 || c.opts.DrainNotify {
+					_ = c.conn.SetReadDeadline(time.Now())
+				}
+			case <-ctx.Done():
+			}
+		}()
+	}
+	if a := c.opts.Activity; a != nil {
+		atomic.AddInt64(&a.clients, 1)
+		defer atomic.AddInt64(&a.clients, -1)
+	}
+	c.countConnection()
+	defer c.pipelineEnded()
+
 	for {
 		l, err := c.handleMessage()
+		var se StreamError
+		if err == errQuit || err == errReadTimeout || errors.As(err, &se) {
+			return
+		}
+		if err == errProtocol {
+			l.Debug("Closed client connection that sent a message that isn't valid RESP")
+			return
+		}
 		if err != nil {
-			if err != io.EOF {
+			c.notifyDrain(l)
+			if err != io.EOF && c.readCtx.Err() == nil {
 				select {
 				case <-c.kill:
 					// ignore errors from force shutdown
@@ -72,117 +403,575 @@ func (c *connection) processMessages() {
 	}
 }
 
+// recordRequest records a request answered whole, elapsed from it being read to
+// its replies being written, as the request latency, in the SLOs, in the
+// command metrics, in the errors of the listener's traffic, in the last stats
+// of the connection and in the access log
+func (c *connection) recordRequest(wm []*redis.Message, cmds []string, replies []*redis.Message, elapsed time.Duration) {
+	c.opts.AccessLog.observe(c, wm, cmds, replies, elapsed)
+	c.countErrors(replies)
+	c.recordLastStats(cmds, elapsed)
+	metrics.RequestLatency.Record(c.statsd, elapsed, requestClass(cmds))
+	c.opts.SLOs.Observe(c.statsd, cmds, elapsed)
+	c.recordCommands(cmds, replies, elapsed)
+}
+
 func (c *connection) handleMessage() (*zap.Logger, error) {
 	var err error
 
 	defer func(start time.Time) {
-		_ = c.statsd.Timing("handle_message", time.Since(start), []string{
-			fmt.Sprintf("success:%v", err == nil),
-		}, 1)
+		metrics.HandleMessage.Record(c.statsd, time.Since(start), strconv.FormatBool(err == nil))
 	}(time.Now())
 
 	l := c.log
 
 	var wm []*redis.Message
-	if wm, err = ReadWireMessages(c.ctx, l, c.conn, c.address, c.id, 0, 1, true, c.conn.Close); err != nil {
+	var late int
+	if c.unread != nil {
+		wm, late = c.unread, c.unreadLate
+		c.unread = nil
+	} else {
+		c.signaled = false
+		wm, late, err = readWireMessages(c.readCtx, l, c.reader, c.address, c.id, c.firstByteTimeout(), 1, c.checksSignals(), c.opts.Readahead, c.conn.Close, c, nil)
+	}
+	// a pipeline cut short by a drain still has the messages read before it
+	// answered, and its client is told of the rest by notifyDrain. So does one
+	// cut short by a message that isn't valid RESP, followed by the protocol
+	// error redis would close the connection with.
+	cutErr := err
+	invalid := err != nil && redis.IsProtocolError(err)
+	if err != nil && !invalid && !c.cutByDrain() {
+		return l, c.readTimedOut(l, err)
+	}
+	err = nil
+	c.request = wm
+	c.requested, c.requestStarted = true, false
+	read := time.Now()
+	c.timings.reset()
+	c.countRequest(wm)
+	c.receiveBroadcasts()
+	if c.signaled && c.opts.Warnings != nil && c.opts.Warnings.opts.Signals {
+		c.warn(WarningPipelineSignals, "the GET 🔜 and GET 🔚 pipeline signals are deprecated, pipeline without them")
+	}
+	if len(wm) > 1 && !c.signaled {
+		metrics.ReadaheadCommands.Record(c.statsd, float64(len(wm)))
+	}
+	if a := c.opts.Activity; a != nil {
+		atomic.AddInt64(&a.requests, 1)
+		defer atomic.AddInt64(&a.requests, -1)
+	}
+	b := boundaries(wm, late, cutErr != nil && !invalid, c.signaled)
+	if invalid && !b.quit {
+		b.invalid, b.pipelined = cutErr, atomic.LoadInt32(&c.pipelineOpen) == 1
+	}
+	wm = wm[:b.received]
+	if c.isSubscribe(wm, b) {
+		err = c.pinSubscription(l, wm[0])
+		return l, err
+	}
+	if c.opensTransaction(wm, b) {
+		err = c.pinTransaction(l, wm, b)
 		return l, err
 	}
 
-	incomingCmds, err := c.validateCommands(wm)
+	// every command of a request gets a reply in its position, whatever happens
+	// to the others
+	replies := make([]*redis.Message, len(wm))
+	incomingCmds := c.validateCommands(wm, replies)
+	c.opts.Mix.Observe(incomingCmds)
+	c.sampleSlots(incomingCmds, wm)
+	groups, err := c.atomicGroups(incomingCmds, wm)
+	// one measurement, from the request being read to its reply being written,
+	// feeds the latency timing, the SLOs and the command metrics
+	defer func() {
+		if err != nil {
+			return
+		}
+		c.recordRequest(wm, incomingCmds, replies, time.Since(read))
+	}()
+	c.startTrace(incomingCmds)
+	defer c.finishTrace()
+	if b.late > 0 && c.trace != nil {
+		c.trace.add("drain", fmt.Sprintf("%d commands read after the drain began answered with PROXYMAINT", b.late))
+	}
 	if err != nil {
-		mm := []*redis.Message{redis.NewError([]byte(fmt.Sprintf("redisbetween: %v", err.Error())))}
+		// PROXY ATOMIC groups that don't hold together leave nothing of the
+		// request to send, but each of its commands is still answered
+		if c.trace != nil {
+			c.trace.add("blocked", err.Error())
+		}
+		r := c.proxyError(proxyerr.Blocked, "%v", err)
+		for i := range replies {
+			replies[i] = r
+		}
 		c.log.Debug("invalid commands", zap.Strings("commands", incomingCmds), zap.Error(err))
-		err = WriteWireMessages(c.ctx, l, mm, c.conn, c.address, c.id, 0, false, c.conn.Close)
-		return l, err
+		err = c.writeReplies(l, b, replies, b.pipelined)
+		c.recordSession(read, wm, replies)
+		return l, b.end(err, cutErr)
 	}
 
-	if wm, l, err = c.roundTrip(wm); err != nil {
-		return l, err
+	// commands the proxy answers itself get their reply in place, and the rest are
+	// forwarded upstream together. transactions are always forwarded untouched,
+	// and PROXY ATOMIC groups sent as the transactions they stand for.
+	sentCmds, sent := incomingCmds, wm
+	if len(groups) > 0 {
+		sentCmds, sent = c.startAtomic(groups, replies, incomingCmds, wm)
+	}
+	var forward []*redis.Message
+	var forwardCmds []string
+	var positions, dbs []int
+	transaction := false
+	for i, cmd := range sentCmds {
+		if _, ok := TransactionCommands[cmd]; ok && replies[i] == nil {
+			transaction = true
+		}
+	}
+	for i, m := range sent {
+		// rejected commands and discarded atomic groups and transactions have
+		// their replies already
+		if replies[i] != nil {
+			continue
+		}
+		if !transaction {
+			if r := c.localReply(sentCmds[i], m); r != nil {
+				replies[i] = r
+				continue
+			}
+			m = c.enforceTTL(sentCmds[i], m)
+		}
+		forward = append(forward, m)
+		forwardCmds = append(forwardCmds, sentCmds[i])
+		positions = append(positions, i)
+		dbs = append(dbs, c.db)
+	}
+	if transaction {
+		if r := c.rejectTransaction(forwardCmds, forward); r != nil {
+			for _, i := range positions {
+				replies[i] = r
+			}
+			forward, forwardCmds, positions, dbs = nil, nil, nil, nil
+		} else {
+			// the expiries of the commands queued are capped as those of
+			// any others
+			for j := range forward {
+				forward[j] = c.enforceTTL(forwardCmds[j], forward[j])
+			}
+			if c.trace != nil {
+				c.trace.add("transaction", "forwarded whole")
+			}
+		}
 	}
 
-	c.interceptor(incomingCmds, wm)
+	// scripts over their limits are answered in their position, and the rest
+	// hold their in-flight slots until the request has been forwarded
+	shed, releaseScripts := c.admitScripts(transaction, forward)
+	defer releaseScripts()
+	if len(shed) > 0 {
+		n := 0
+		for j := range forward {
+			if r, ok := shed[j]; ok {
+				replies[positions[j]] = r
+				continue
+			}
+			forward[n], forwardCmds[n], positions[n], dbs[n] = forward[j], forwardCmds[j], positions[j], dbs[j]
+			n++
+		}
+		forward, forwardCmds, positions, dbs = forward[:n], forwardCmds[:n], positions[:n], dbs[:n]
+	}
 
-	err = WriteWireMessages(c.ctx, l, wm, c.conn, c.address, c.id, 0, len(wm) > 1, c.conn.Close)
-	return l, err
+	c.streaming, c.streamHeld = c.streams(b, transaction, forwardCmds, wm), 0
+	defer func() { c.streaming = false }()
+	c.unparsed = c.passesThrough(transaction, forwardCmds, forward)
+	defer func() { c.unparsed = nil }()
+	// commands after a SELECT go to the database it selected, so each run of
+	// commands for one database is forwarded on its own, in order
+	for _, run := range c.dbRuns(dbs) {
+		runCmds, runForward := forwardCmds[run.start:run.end], forward[run.start:run.end]
+		c.forgetWritten(run.db, runCmds, runForward)
+		res, runL, runErr := c.negativeForward(run.db, runCmds, runForward)
+		// the writes forwarded may have changed their keys even if they went
+		// unanswered
+		c.forgetWritten(run.db, runCmds, runForward)
+		c.mirror(run.db, transaction, runCmds, runForward, res)
+		l = runL
+		// on an error, res has the replies read before it, which are relayed as
+		// usual, and the rest are lost
+		answered := len(res)
+		if len(res) > 0 {
+			n := len(res)
+			c.checkACLErrors(runCmds[:n], res)
+			if !transaction {
+				c.expireCreated(run.db, runCmds[:n], runForward[:n], res)
+			}
+			c.invalidateDatabases(run.db, runCmds[:n], runForward[:n], res)
+			// what the proxy caches is of the default database
+			if run.db == c.opts.Database {
+				c.opts.WriteBehind.Observe(runCmds[:n], runForward[:n], res)
+				c.readThrough(runCmds[:n], runForward[:n], res)
+			}
+			c.interceptor(runCmds[:n], res)
+			// after the interceptor, which makes the listeners of the nodes
+			// redirected to
+			c.rewriteErrors(res)
+			c.rewriteTopology(runCmds[:n], res)
+		}
+		// a client sent part of a reply stream is closed, as it can't be
+		// answered
+		var se StreamError
+		if errors.As(runErr, &se) {
+			return l, runErr
+		}
+		if runErr != nil {
+			code, ok := forwardErrorCode(runErr)
+			if !ok {
+				// a client being disconnected, by a kill or the end of a
+				// drain, isn't answered
+				if c.ctx.Err() != nil {
+					return l, runErr
+				}
+				code = proxyerr.Unavailable
+				l.Warn("Upstream connection failed mid-request", zap.Int("replies_read", len(res)), zap.Int("replies_lost", len(runForward)-len(res)), zap.Error(runErr))
+			}
+			if c.trace != nil {
+				c.trace.add("error", string(code)+" "+runErr.Error())
+			}
+			r := c.proxyError(code, "%v", runErr)
+			for len(res) < len(runForward) {
+				res = append(res, r)
+			}
+		}
+		// the secondary is a copy of the default database, read over RESP2
+		if run.db == c.opts.Database && !transaction && !c.speaksRESP3() {
+			c.readFallback(runCmds, runForward, res, answered, runErr)
+		}
+		if !transaction {
+			c.verifyChecksums(runCmds, runForward, res)
+		}
+		for i, r := range res {
+			replies[positions[run.start+i]] = r
+		}
+	}
+	releaseScripts()
+	c.finishAtomic(groups, replies)
+	c.recordClientLibrary(false)
+
+	err = c.writeReplies(l, b, replies, b.pipelined)
+	c.recordSession(read, wm, replies)
+	return l, b.end(err, cutErr)
+}
+
+// serverFor picks the blocking pool for batches with a blocking command, the
+// reserved lane for those that consist only of critical commands, and the
+// general pool for everything else
+func (c *connection) serverFor(cmds []string, wm []*redis.Message) *pool.Server {
+	if _, ok := c.blocks(wm); ok {
+		if c.trace != nil {
+			c.trace.add("lane", "blocking pool, the request has a blocking command")
+		}
+		return c.opts.Blocking.Server
+	}
+	if c.opts.Reserved == nil || c.speaksRESP3() {
+		return c.general()
+	}
+	for i, m := range wm {
+		if !c.isCritical(cmds[i], m) {
+			if c.trace != nil {
+				c.trace.add("lane", "general pool, "+cmds[i]+" is not critical")
+			}
+			return c.server
+		}
+	}
+	if c.trace != nil {
+		c.trace.add("lane", "reserved pool, every command is critical")
+	}
+	metrics.ReservedLaneRequests.Incr(c.statsd)
+	return c.opts.Reserved
+}
+
+func (c *connection) isCritical(cmd string, m *redis.Message) bool {
+	return c.matches(Rule{Commands: c.opts.CriticalCommands, Prefixes: c.opts.CriticalPrefixes}, cmd, m)
+}
+
+// Rule matches commands by name, or by a prefix of their first key
+type Rule struct {
+	Commands map[string]bool
+	Prefixes []string
 }
 
-func (c *connection) validateCommands(wm []*redis.Message) ([]string, error) {
-	var transactionOpen bool
+func (c *connection) matches(r Rule, cmd string, m *redis.Message) bool {
+	if r.Commands[cmd] {
+		return true
+	}
+	if len(r.Prefixes) == 0 {
+		return false
+	}
+	key, ok := c.opts.Keys.FirstKey(cmd, m)
+	if !ok {
+		return false
+	}
+	for _, prefix := range r.Prefixes {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTransaction(cmds []string) bool {
+	for _, cmd := range cmds {
+		if _, ok := TransactionCommands[cmd]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dbRun is the forwarded commands start to end, all of them for db
+type dbRun struct {
+	db, start, end int
+}
+
+// dbRuns splits the forwarded commands into runs of consecutive commands for the
+// same database
+func (c *connection) dbRuns(dbs []int) []dbRun {
+	var runs []dbRun
+	for i, db := range dbs {
+		if len(runs) > 0 && runs[len(runs)-1].db == db {
+			runs[len(runs)-1].end = i + 1
+			continue
+		}
+		runs = append(runs, dbRun{db: db, start: i, end: i + 1})
+	}
+	return runs
+}
+
+// validateCommands names the commands of a request, answering those the proxy
+// doesn't support or the command filter blocks in their position of replies, so
+// that the rest of the request is still forwarded. A transaction with one of
+// them is discarded whole, as redis would abort it at EXEC, and so is one the
+// request leaves open, unless the client is pinned for it.
+func (c *connection) validateCommands(wm []*redis.Message, replies []*redis.Message) []string {
 	incomingCmds := make([]string, len(wm))
+	open := -1
+	var discard *redis.Message
 
 	for i, m := range wm {
 		var incomingCmd string
 		if m.IsArray() {
 			incomingCmd = strings.ToUpper(string(m.Array[0].Value))
 
-			if t, ok := TransactionCommands[incomingCmd]; ok {
-				switch t {
-				case TransactionOpen:
-					transactionOpen = true
-				case TransactionClose:
-					transactionOpen = false
+			if _, ok := UnsupportedCommands[incomingCmd]; ok && !(incomingCmd == "AUTH" && (c.opts.Auth != nil || c.opts.LocalAuth)) && !(incomingCmd == "SELECT" && c.opts.DBPools != nil && !c.speaksRESP3()) && !(c.opts.Blocking != nil && isBlockingCommand(incomingCmd) && !c.speaksRESP3()) {
+				replies[i] = c.proxyError(proxyerr.Blocked, "%v is unsupported", incomingCmd)
+				if open >= 0 && discard == nil {
+					discard = c.proxyError(proxyerr.Blocked, "transaction discarded, %v is unsupported", incomingCmd)
 				}
 			}
 
-			if _, ok := UnsupportedCommands[incomingCmd]; ok {
-				return nil, fmt.Errorf("%v is unsupported", incomingCmd)
+			if t, ok := TransactionCommands[incomingCmd]; ok {
+				switch {
+				case t == TransactionOpen && open < 0:
+					open = i
+				case t == TransactionClose && open >= 0:
+					for j := open; discard != nil && j <= i; j++ {
+						replies[j] = discard
+					}
+					open, discard = -1, nil
+				}
 			}
 
-			if incomingCmd == "CLUSTER" && len(m.Array) > 1 {
-				// we only need to parse the next element if this is a CLUSTER command, for the
-				// CLUSTER SLOTS and CLUSTER NODES cases
+			if _, ok := SubcommandCommands[incomingCmd]; ok && len(m.Array) > 1 {
+				// we only need to parse the next element for commands whose subcommands we
+				// treat differently, like CLUSTER SLOTS or CLIENT SETINFO
 				incomingCmd += " " + strings.ToUpper(string(m.Array[1].Value))
 			}
 
+			if r := c.filterCommand(incomingCmd); r != nil && replies[i] == nil {
+				replies[i] = r
+				if open >= 0 && discard == nil {
+					discard = c.proxyError(proxyerr.Blocked, "transaction discarded, %s is blocked by proxy", incomingCmd)
+				}
+			}
+
 			incomingCmds[i] = incomingCmd
 		}
 	}
 
-	if transactionOpen {
-		return incomingCmds, fmt.Errorf("cannot leave an open transaction")
+	if open >= 0 && c.tx == nil {
+		r := c.proxyError(proxyerr.Blocked, "cannot leave an open transaction")
+		for j := open; j < len(wm); j++ {
+			replies[j] = r
+		}
 	}
 
-	return incomingCmds, nil
-
+	return incomingCmds
 }
 
-func (c *connection) roundTrip(wm []*redis.Message) ([]*redis.Message, *zap.Logger, error) {
-	l := c.log
-	var err error
+func (c *connection) roundTrip(server *pool.Server, wm []*redis.Message) (res []*redis.Message, l *zap.Logger, err error) {
+	l = c.log
 
 	var conn *pool.Connection
-	if conn, err = c.checkoutConnection(); err != nil {
-		return nil, l, err
+	var retried bool
+	defer func() {
+		if b := c.opts.RetryBudget; b != nil {
+			if err == nil && !retried {
+				b.Success()
+			} else {
+				b.Failure()
+			}
+		}
+	}()
+	// the reserved lane and the pools of other databases are left out of the
+	// fair queue, which shares the default pool
+	if c.opts.FairQueue != nil && server == c.server {
+		var release func()
+		if release, err = c.acquireFairTurn(); err != nil {
+			return nil, l, err
+		}
+		defer release()
+	}
+	// a blocking command is given as long as it may block on top of the read
+	// timeout
+	readTimeout := c.readTimeout
+	if d, ok := c.blocks(wm); ok {
+		if d == 0 || readTimeout == 0 {
+			readTimeout = 0
+		} else {
+			readTimeout += d
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		var checkoutRetried bool
+		if conn, checkoutRetried, err = c.checkoutConnectionWithRetries(server); err != nil {
+			return nil, l, err
+		}
+		retried = retried || checkoutRetried
+		res, l, err = c.exchange(conn, wm, readTimeout)
+		var we WriteError
+		if !errors.As(err, &we) || !c.retryWrite(we, wm, attempt) {
+			return res, l, err
+		}
+		retried = true
 	}
+}
+
+// exchange writes wm over conn and reads their replies, returning conn to its
+// pool after
+func (c *connection) exchange(conn *pool.Connection, wm []*redis.Message, readTimeout time.Duration) (res []*redis.Message, l *zap.Logger, err error) {
 	defer func() {
+		// a connection that failed mid-reply may still have part of it unread
+		if err != nil {
+			_ = conn.Close()
+		}
 		_ = conn.Return()
 	}()
+	defer destroyOnPanic(func() { _ = conn.Close() })
 
 	l = c.log.With(zap.Uint64("upstream_id", conn.ID()))
 	l.Debug("Connection checked out")
+	if c.trace != nil {
+		c.trace.add("node", fmt.Sprintf("%s, upstream connection %d", conn.Address(), conn.ID()))
+	}
 
+	sent := time.Now()
 	if err = WriteWireMessages(c.ctx, l, wm, conn.Conn(), conn.Address().String(), conn.ID(), c.writeTimeout, false, conn.Close); err != nil {
 		return nil, l, err
 	}
 
-	res, err := ReadWireMessages(c.ctx, l, conn.Conn(), conn.Address().String(), conn.ID(), c.readTimeout, len(wm), false, conn.Close)
+	// the replies read before an error are kept, for the commands they answer
+	var held time.Duration
+	if c.streaming {
+		res, held, err = c.readStreaming(l, conn, readTimeout)
+		c.streamHeld += held
+	} else {
+		res, _, err = readWireMessages(c.ctx, l, conn.Conn(), conn.Address().String(), conn.ID(), readTimeout, len(wm), false, 0, conn.Close, nil, c.unparsedReplies(wm))
+	}
+	elapsed := time.Since(sent) - held
+	c.opts.Scripts.observe(wm, res, elapsed)
+	c.opts.SlowLog.observe(c, conn.Address().String(), wm, elapsed)
+	c.timings.roundTrip(conn.Address().String(), elapsed)
 
 	return res, l, err
 }
 
-func (c *connection) checkoutConnection() (conn *pool.Connection, err error) {
+// retryWrite is whether a request whose write failed is sent again, over
+// another connection, as a failed checkout is: a request that never reached the
+// upstream always can be, while one that may have only if running it twice
+// leaves the same as once, and in either case up to opts.Retries times, as long
+// as the upstream's retry budget allows it.
+func (c *connection) retryWrite(we WriteError, wm []*redis.Message, attempt int) bool {
+	delivery := "not_delivered"
+	if we.MaybeDelivered() {
+		delivery = "maybe_delivered"
+	}
+	retry := attempt < c.opts.Retries && c.ctx.Err() == nil && (!we.MaybeDelivered() || idempotent(wm))
+	if retry && c.opts.RetryBudget != nil && !c.opts.RetryBudget.Withdraw() {
+		metrics.RetryBudgetExhausted.Incr(c.statsd)
+		retry = false
+	}
+	metrics.UpstreamWriteFailures.Incr(c.statsd, delivery, strconv.FormatBool(retry))
+	if c.trace != nil {
+		if retry {
+			c.trace.add("write", "failed, retrying: "+we.Error())
+		} else {
+			c.trace.add("write", "failed: "+we.Error())
+		}
+	}
+	return retry
+}
+
+// Exchange sends the requests the proxy makes on its own over a connection
+// checked out of server, and reads their replies
+func Exchange(ctx context.Context, log *zap.Logger, server *pool.Server, wm []*redis.Message, readTimeout, writeTimeout time.Duration) (res []*redis.Message, err error) {
+	conn, err := server.Connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = conn.Close()
+		}
+		_ = conn.Return()
+	}()
+	defer destroyOnPanic(func() { _ = conn.Close() })
+	addr := conn.Address().String()
+	if err = WriteWireMessages(ctx, log, wm, conn.Conn(), addr, conn.ID(), writeTimeout, false, conn.Close); err != nil {
+		return nil, err
+	}
+	return ReadWireMessages(ctx, log, conn.Conn(), addr, conn.ID(), readTimeout, len(wm), false, conn.Close)
+}
+
+// checkoutConnectionWithRetries retries failed checkouts up to opts.Retries times,
+// as long as the upstream's retry budget allows it.
+func (c *connection) checkoutConnectionWithRetries(server *pool.Server) (conn *pool.Connection, retried bool, err error) {
+	conn, err = c.checkoutConnection(server)
+	for attempt := 0; err != nil && attempt < c.opts.Retries; attempt++ {
+		if c.opts.RetryBudget != nil && !c.opts.RetryBudget.Withdraw() {
+			metrics.RetryBudgetExhausted.Incr(c.statsd)
+			if c.trace != nil {
+				c.trace.add("checkout", "failed, retry budget exhausted: "+err.Error())
+			}
+			return nil, retried, RetryBudgetError{Wrapped: err}
+		}
+		if c.trace != nil {
+			c.trace.add("checkout", "failed, retrying: "+err.Error())
+		}
+		retried = true
+		metrics.CheckoutRetry.Incr(c.statsd)
+		conn, err = c.checkoutConnection(server)
+	}
+	return conn, retried, err
+}
+
+func (c *connection) checkoutConnection(server *pool.Server) (conn *pool.Connection, err error) {
 	defer func(start time.Time) {
 		addr := ""
 		if conn != nil {
 			addr = conn.Address().String()
 		}
-		_ = c.statsd.Timing("checkout_connection", time.Since(start), []string{
-			fmt.Sprintf("address:%s", addr),
-			fmt.Sprintf("success:%v", err == nil),
-		}, 1)
+		metrics.CheckoutConnection.Record(c.statsd, time.Since(start), sanitize.TagValue(addr), strconv.FormatBool(err == nil))
 	}(time.Now())
 
-	conn, err = c.server.Connection(c.ctx)
+	conn, err = server.Connection(c.ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -190,11 +979,36 @@ func (c *connection) checkoutConnection() (conn *pool.Connection, err error) {
 	return conn, nil
 }
 
+// countingWriter counts the bytes its writer took
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += n
+	return n, err
+}
+
+// WriteWireMessages writes wm to nc. A failure is a WriteError telling how much
+// of wm was written, and closes the connection, part of a message it took
+// leaving it unusable.
 func WriteWireMessages(ctx context.Context, log *zap.Logger, wm []*redis.Message, nc net.Conn, address string, id uint64, writeTimeout time.Duration, wrapPipeline bool, close func() error) error {
 	var err error
+	failed := func(written int, err error) error {
+		_ = close()
+		size := 0
+		for _, m := range wm {
+			if b, err := redis.EncodeToBytes(m); err == nil {
+				size += len(b)
+			}
+		}
+		return WriteError{Address: address, ID: id, Written: written, Size: size, Wrapped: err}
+	}
 	select {
 	case <-ctx.Done():
-		return pool.ConnectionError{Address: address, ID: id, Wrapped: ctx.Err(), Message: "failed to write"}
+		return failed(0, ctx.Err())
 	default:
 	}
 
@@ -208,7 +1022,7 @@ func WriteWireMessages(ctx context.Context, log *zap.Logger, wm []*redis.Message
 	}
 
 	if err := nc.SetWriteDeadline(deadline); err != nil {
-		return pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "failed to set write deadline"}
+		return failed(0, fmt.Errorf("failed to set write deadline: %w", err))
 	}
 
 	if wrapPipeline { // make dummy messages to pad out the pipeline signal responses
@@ -217,27 +1031,84 @@ func WriteWireMessages(ctx context.Context, log *zap.Logger, wm []*redis.Message
 		wm = append(append([]*redis.Message{s}, wm...), e)
 	}
 
+	// the messages are written through one pooled buffer, in as few writes as
+	// it takes, rather than each flushed on its own
+	w := &countingWriter{w: nc}
+	enc := redis.NewPooledEncoder(w)
+	defer enc.Release()
 	for _, m := range wm {
-		err = redis.Encode(nc, m)
-		if err != nil {
-			_ = close()
-			return pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "unable to write wire message to network"}
+		if err = enc.Encode(m, false); err != nil {
+			return failed(w.n, err)
 		}
 	}
+	if err = enc.Flush(); err != nil {
+		return failed(w.n, err)
+	}
 
 	log.Debug("Write", zap.String("address", address))
 	return nil
 }
 
 func ReadWireMessages(ctx context.Context, log *zap.Logger, nc net.Conn, address string, id uint64, readTimeout time.Duration, readMin int, checkPipelineSignals bool, close func() error) ([]*redis.Message, error) {
-	select {
-	case <-ctx.Done():
-		// We closeConnection the connection because we don't know if there is an unread message on the wire.
-		_ = close()
-		return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: ctx.Err(), Message: "failed to read"}
-	default:
+	wm, _, err := readWireMessages(ctx, log, nc, address, id, readTimeout, readMin, checkPipelineSignals, 0, close, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return wm, nil
+}
+
+// clientRead is what a read of a client's request tells the connection of, and
+// asks it, beyond a read of replies
+type clientRead interface {
+	// pipelineRead is called as the start and end signals of a pipeline are
+	// read, after read messages
+	pipelineRead(open bool, read int)
+	// framed is called as each message is read whole
+	framed(pipelineOpen bool)
+	// drained is whether the proxy has started draining
+	drained() bool
+	// decoder is the decoder of the client's requests, which are read whole
+	// however many of them the client sent at once
+	decoder() *redis.Decoder
+}
+
+func (c *connection) decoder() *redis.Decoder {
+	return c.dec
+}
+
+// checksSignals is whether the client's requests are read as pipelines between
+// the signals
+func (c *connection) checksSignals() bool {
+	return !c.opts.IgnorePipelineSignals
+}
+
+// readaheadStops are the commands a read ahead doesn't go past, nor starts
+// from, since the client is served differently once they are answered
+var readaheadStops = map[string]bool{
+	"HELLO":      true,
+	"PSUBSCRIBE": true,
+	"SSUBSCRIBE": true,
+	"SUBSCRIBE":  true,
+}
+
+// readsAhead is whether the read of a request may go on past m, with next
+func readsAhead(m, next *redis.Message, checkPipelineSignals bool) bool {
+	for _, m := range []*redis.Message{m, next} {
+		if !m.IsArray() || len(m.Array) == 0 || readaheadStops[strings.ToUpper(string(m.Array[0].Value))] {
+			return false
+		}
 	}
+	return !checkPipelineSignals || !(isSignalMessage(next, PipelineSignalStartKey) || isSignalMessage(next, PipelineSignalEndKey))
+}
 
+// readWireMessages is ReadWireMessages, telling client, if set, of what it
+// reads. A request that isn't wrapped in signals is then read on, up to
+// readahead messages in all, with those the client has already sent whole, so
+// that the read never waits for more of them. It also returns the index of the
+// first message read whole once client was drained, len(wm) if there is none,
+// and on an error, the messages read before it. The messages in the positions
+// set in unparsed are decoded with DecodeFrameUnparsed.
+func readWireMessages(ctx context.Context, log *zap.Logger, nc net.Conn, address string, id uint64, readTimeout time.Duration, readMin int, checkPipelineSignals bool, readahead int, close func() error, client clientRead, unparsed []bool) ([]*redis.Message, int, error) {
 	var deadline time.Time
 	if readTimeout != 0 {
 		deadline = time.Now().Add(readTimeout)
@@ -248,27 +1119,84 @@ func ReadWireMessages(ctx context.Context, log *zap.Logger, nc net.Conn, address
 	}
 
 	if err := nc.SetReadDeadline(deadline); err != nil {
-		return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "failed to set read deadline"}
+		return nil, 0, pool.ConnectionError{Address: address, ID: id, Wrapped: err, Message: "failed to set read deadline"}
 	}
 
-	d := redis.NewDecoder(nc)
-	var pipelineOpen bool
+	// checked after setting the deadline, so that a deadline set by whoever cancels
+	// ctx can't be overwritten by the one above
+	select {
+	case <-ctx.Done():
+		// We closeConnection the connection because we don't know if there is an unread message on the wire.
+		_ = close()
+		return nil, 0, pool.ConnectionError{Address: address, ID: id, Wrapped: ctx.Err(), Message: "failed to read"}
+	default:
+	}
+
+	var d *redis.Decoder
+	if client != nil {
+		d = client.decoder()
+	} else {
+		d = redis.NewPooledDecoder(nc)
+		defer d.Release()
+	}
+	var pipelineOpen, signaled bool
 	wm := make([]*redis.Message, 0)
+	late := -1
 	for i := 0; i < readMin || (pipelineOpen && checkPipelineSignals); i++ {
-		m, err := d.Decode()
+		var m *redis.Message
+		var err error
+		if i < len(unparsed) && unparsed[i] {
+			m, err = d.DecodeFrameUnparsed()
+		} else {
+			m, err = d.DecodeFrame()
+		}
+		if late < 0 && client != nil && client.drained() {
+			late = len(wm)
+		}
 		if err != nil {
-			return nil, err
+			if late < 0 {
+				late = len(wm)
+			}
+			return wm, late, err
 		}
 		if checkPipelineSignals && isSignalMessage(m, PipelineSignalStartKey) {
-			pipelineOpen = true
-			continue
+			pipelineOpen, signaled = true, true
+			if client != nil {
+				client.pipelineRead(true, len(wm))
+			}
 		} else if checkPipelineSignals && isSignalMessage(m, PipelineSignalEndKey) {
 			pipelineOpen = false
-			continue
+			if client != nil {
+				client.pipelineRead(false, len(wm))
+			}
+		} else if client != nil && m.IsArray() && len(m.Array) == 0 {
+			// like redis, a request of no arguments is skipped rather than answered
+			i--
+		} else {
+			wm = appendMessage(wm, m)
+		}
+		if client != nil {
+			client.framed(pipelineOpen)
+		}
+	}
+	for n := len(wm); !signaled && n > 0 && n < readahead && client != nil && !client.drained(); n++ {
+		next, ok := d.PeekFrame()
+		if !ok || !readsAhead(wm[n-1], next, checkPipelineSignals) {
+			break
+		}
+		m, err := d.DecodeFrame()
+		if err != nil {
+			if late < 0 {
+				late = len(wm)
+			}
+			return wm, late, err
 		}
 		wm = appendMessage(wm, m)
 	}
-	return wm, nil
+	if late < 0 {
+		late = len(wm)
+	}
+	return wm, late, nil
 }
 
 // any message of length 2 (GET, for example) that passes the signal as its only argument
@@ -1,12 +1,23 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
 	"github.com/coinbase/redisbetween/redis"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+	"io"
+	"io/ioutil"
 	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -19,21 +30,29 @@ func TestValidateCommands(t *testing.T) {
 			redis.NewBulkBytes([]byte("hi")),
 		}),
 	}
-	incomingCmds, err := c.validateCommands(wm)
-	assert.NoError(t, err)
+	replies := make([]*redis.Message, len(wm))
+	incomingCmds := c.validateCommands(wm, replies)
 	assert.Equal(t, []string{"GET"}, incomingCmds)
+	assert.Equal(t, []*redis.Message{nil}, replies)
 }
 
 func TestValidateCommandsUnsupported(t *testing.T) {
 	c := connection{}
 	wm := []*redis.Message{
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("GET")),
+			redis.NewBulkBytes([]byte("hi")),
+		}),
 		redis.NewArray([]*redis.Message{
 			redis.NewBulkBytes([]byte("SUBSCRIBE")),
 			redis.NewBulkBytes([]byte("hi")),
 		}),
 	}
-	_, err := c.validateCommands(wm)
-	assert.Error(t, err)
+	replies := make([]*redis.Message, len(wm))
+	incomingCmds := c.validateCommands(wm, replies)
+	assert.Equal(t, []string{"GET", "SUBSCRIBE"}, incomingCmds)
+	assert.Nil(t, replies[0], "the rest of the request is still forwarded")
+	assert.Equal(t, "-PROXYBLOCKED SUBSCRIBE is unsupported \\r\\n ", replies[1].String())
 }
 
 func TestValidateCommandsClosedTransaction(t *testing.T) {
@@ -50,29 +69,59 @@ func TestValidateCommandsClosedTransaction(t *testing.T) {
 			redis.NewBulkBytes([]byte("EXEC")),
 		}),
 	}
-	incomingCmds, err := c.validateCommands(wm)
-	assert.NoError(t, err)
+	replies := make([]*redis.Message, len(wm))
+	incomingCmds := c.validateCommands(wm, replies)
 	assert.Equal(t, []string{"MULTI", "GET", "EXEC"}, incomingCmds)
+	assert.Equal(t, []*redis.Message{nil, nil, nil}, replies)
 }
 
-func TestValidateCommandsOpenTransaction(t *testing.T) {
+func TestValidateCommandsTransactionDiscarded(t *testing.T) {
 	c := connection{}
 	wm := []*redis.Message{
 		redis.NewArray([]*redis.Message{
-			redis.NewBulkBytes([]byte("WATCH")),
+			redis.NewBulkBytes([]byte("GET")),
 			redis.NewBulkBytes([]byte("hi")),
 		}),
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("MULTI")),
+		}),
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("SUBSCRIBE")),
+			redis.NewBulkBytes([]byte("hi")),
+		}),
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("EXEC")),
+		}),
+	}
+	replies := make([]*redis.Message, len(wm))
+	c.validateCommands(wm, replies)
+	assert.Nil(t, replies[0])
+	for _, r := range replies[1:] {
+		assert.Equal(t, "-PROXYBLOCKED transaction discarded, SUBSCRIBE is unsupported \\r\\n ", r.String())
+	}
+}
+
+func TestValidateCommandsOpenTransaction(t *testing.T) {
+	c := connection{}
+	wm := []*redis.Message{
 		redis.NewArray([]*redis.Message{
 			redis.NewBulkBytes([]byte("GET")),
 			redis.NewBulkBytes([]byte("hi")),
 		}),
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("WATCH")),
+			redis.NewBulkBytes([]byte("hi")),
+		}),
 		redis.NewArray([]*redis.Message{
 			redis.NewBulkBytes([]byte("MULTI")),
 		}),
 	}
-	incomingCmds, err := c.validateCommands(wm)
-	assert.Error(t, err)
-	assert.Equal(t, []string{"WATCH", "GET", "MULTI"}, incomingCmds)
+	replies := make([]*redis.Message, len(wm))
+	incomingCmds := c.validateCommands(wm, replies)
+	assert.Equal(t, []string{"GET", "WATCH", "MULTI"}, incomingCmds)
+	assert.Nil(t, replies[0])
+	assert.Equal(t, "-PROXYBLOCKED cannot leave an open transaction \\r\\n ", replies[1].String())
+	assert.Equal(t, replies[1], replies[2])
 }
 
 func TestReadWireMessagesPipeline(t *testing.T) {
@@ -204,8 +253,10 @@ func testWriteWireMessagesHelper(t *testing.T, wrapPipeline bool, wm []*redis.Me
 	_ = reader.SetDeadline(time.Now().Add(1 * time.Second))
 	go func(l int, t *testing.T) {
 		actuals := make([]string, l)
+		// the messages may arrive in a single write, so one decoder reads them all
+		d := redis.NewDecoder(reader)
 		for i := 0; i < l; i++ {
-			m, err := redis.Decode(reader)
+			m, err := d.Decode()
 			assert.NoError(t, err)
 			actuals[i] = m.String()
 		}
@@ -219,3 +270,582 @@ func testWriteWireMessagesHelper(t *testing.T, wrapPipeline bool, wm []*redis.Me
 	assert.NoError(t, err)
 	wg.Wait()
 }
+
+// poolCounts follows a test connection's pool through its monitor, which
+// must never count more connections closed than opened, or returned than
+// checked out
+type poolCounts struct {
+	open, checkedOut, negative int64
+}
+
+func (c *poolCounts) add(n *int64, delta int64) {
+	if atomic.AddInt64(n, delta) < 0 {
+		atomic.StoreInt64(&c.negative, 1)
+	}
+}
+
+func (c *poolCounts) monitor() *pool.Monitor {
+	return &pool.Monitor{Event: func(e *pool.Event) {
+		switch e.Type {
+		case pool.ConnectionCreated:
+			c.add(&c.open, 1)
+		case pool.ConnectionClosed:
+			c.add(&c.open, -1)
+		case pool.GetSucceeded:
+			c.add(&c.checkedOut, 1)
+		case pool.ConnectionReturned:
+			c.add(&c.checkedOut, -1)
+		}
+	}}
+}
+
+// fakeUpstream is a minimal redis server for tests, answering each command with
+// the reply returned by handler
+type fakeUpstream struct {
+	li       net.Listener
+	handler  func(args []string) *redis.Message
+	commands int64
+}
+
+func newFakeUpstream(t testing.TB, handler func(args []string) *redis.Message) *fakeUpstream {
+	t.Helper()
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	f := &fakeUpstream{li: li, handler: handler}
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeUpstream) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	d := redis.NewDecoder(conn)
+	for {
+		m, err := d.Decode()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&f.commands, 1)
+		args := make([]string, len(m.Array))
+		for i, a := range m.Array {
+			args[i] = string(a.Value)
+		}
+		// a handler closes the connection by answering nil
+		r := f.handler(args)
+		if r == nil {
+			return
+		}
+		if err := redis.Encode(conn, r); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeUpstream) Address() string {
+	return f.li.Addr().String()
+}
+
+func (f *fakeUpstream) Close() {
+	_ = f.li.Close()
+}
+
+func (f *fakeUpstream) Commands() int64 {
+	return atomic.LoadInt64(&f.commands)
+}
+
+// echoKey replies to GET with "<key>-value" and to everything else with +OK
+func echoKey(args []string) *redis.Message {
+	if strings.ToUpper(args[0]) == "GET" && len(args) > 1 {
+		return redis.NewBulkBytes([]byte(args[1] + "-value"))
+	}
+	return redis.NewString([]byte("OK"))
+}
+
+// runTestConnection serves a client connection against upstream with the given
+// options, returning the client side of the connection
+func runTestConnection(t *testing.T, upstream string, opts Options) net.Conn {
+	t.Helper()
+	s := newTestServer(t, upstream, 2)
+	return serveTestConnection(t, s, opts, func() { _ = s.Disconnect(context.Background()) })
+}
+
+func newTestServer(t *testing.T, upstream string, maxPoolSize uint64) *pool.Server {
+	t.Helper()
+	s, err := pool.ConnectServer(pool.Address(upstream), pool.WithMaxConnections(func(uint64) uint64 { return maxPoolSize }))
+	assert.NoError(t, err)
+	return s
+}
+
+// serveTestConnection serves one client connection using the given pool, calling
+// done after the connection handler returns
+func serveTestConnection(t *testing.T, s *pool.Server, opts Options, done func()) net.Conn {
+	t.Helper()
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+
+	client, server := net.Pipe()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		CommandConnection(zaptest.NewLogger(t), sd, server, "test", 5*time.Second, time.Second, 1, s, make(chan interface{}), func([]string, []*redis.Message) {}, opts)
+		_ = server.Close()
+		if done != nil {
+			done()
+		}
+	}()
+	return client
+}
+
+// roundTripStrings writes commands to the client connection and returns the
+// string form of the next n replies
+func roundTripStrings(t *testing.T, client net.Conn, n int, commands ...string) []string {
+	t.Helper()
+	go func() {
+		for _, c := range commands {
+			_, _ = client.Write([]byte(c))
+		}
+	}()
+	d := redis.NewDecoder(client)
+	actual := make([]string, n)
+	for i := range actual {
+		m, err := d.Decode()
+		if !assert.NoError(t, err) {
+			return actual
+		}
+		actual[i] = m.String()
+	}
+	return actual
+}
+
+func respCommand(args ...string) string {
+	s := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, a := range args {
+		s += "$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n"
+	}
+	return s
+}
+
+func TestReservedLaneUnaffectedBySaturatedPool(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if len(args) > 1 && args[1] == "slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+
+	general := newTestServer(t, upstream.Address(), 1)
+	defer func() { _ = general.Disconnect(context.Background()) }()
+	reserved := newTestServer(t, upstream.Address(), 1)
+	defer func() { _ = reserved.Disconnect(context.Background()) }()
+	opts := Options{
+		Reserved:         reserved,
+		CriticalCommands: map[string]bool{"PING": true},
+		CriticalPrefixes: []string{"health:"},
+	}
+	c := connection{opts: opts}
+	assert.True(t, c.isCritical("PING", redis.NewArray(bulks("PING"))))
+	assert.True(t, c.isCritical("GET", redis.NewArray(bulks("GET", "health:check"))))
+	assert.False(t, c.isCritical("GET", redis.NewArray(bulks("GET", "user:1"))))
+
+	// tie up the only general connection with a queue of slow requests
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := serveTestConnection(t, general, opts, nil)
+			defer func() { _ = client.Close() }()
+			assert.Equal(t, []string{"$10 \\r\\n slow-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "slow")))
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	client := serveTestConnection(t, general, opts, nil)
+	defer func() { _ = client.Close() }()
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PING")))
+		assert.Equal(t, []string{"$18 \\r\\n health:check-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "health:check")))
+		assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond), "critical commands must not wait for the general pool")
+	}
+	wg.Wait()
+}
+
+func TestDrainingClosesIdleConnections(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if len(args) > 1 && args[1] == "slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	s := newTestServer(t, upstream.Address(), 2)
+	defer func() { _ = s.Disconnect(context.Background()) }()
+
+	draining := make(chan interface{})
+	opts := Options{Draining: draining}
+	idleDone, busyDone := make(chan struct{}), make(chan struct{})
+	idle := serveTestConnection(t, s, opts, func() { close(idleDone) })
+	defer func() { _ = idle.Close() }()
+	busy := serveTestConnection(t, s, opts, func() { close(busyDone) })
+	defer func() { _ = busy.Close() }()
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, idle, 1, respCommand("PING")))
+
+	replies := make(chan []string)
+	go func() { replies <- roundTripStrings(t, busy, 1, respCommand("GET", "slow")) }()
+	time.Sleep(50 * time.Millisecond)
+	close(draining)
+
+	select {
+	case <-idleDone:
+	case <-time.After(time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+	assert.Equal(t, []string{"$10 \\r\\n slow-value \\r\\n "}, <-replies, "the command in flight is still answered")
+	select {
+	case <-busyDone:
+	case <-time.After(time.Second):
+		t.Fatal("busy connection was not closed after its reply")
+	}
+}
+
+// moduleReplies loads the corpus of module replies in testdata/modules. Each file
+// is the exact reply to the command named before the underscore in its name.
+func moduleReplies(t *testing.T) map[string][]byte {
+	t.Helper()
+	files, err := filepath.Glob("testdata/modules/*.resp")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, files)
+	replies := make(map[string][]byte)
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		assert.NoError(t, err)
+		replies[strings.TrimSuffix(filepath.Base(f), ".resp")] = b
+	}
+	return replies
+}
+
+// newRawUpstream writes the bytes in replies keyed by the last argument of each
+// command, and sends the raw bytes of every command it receives on received
+func newRawUpstream(t *testing.T, replies map[string][]byte, received chan<- []byte) net.Listener {
+	t.Helper()
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				d := redis.NewDecoder(conn)
+				for {
+					m, err := d.DecodeFrame()
+					if err != nil {
+						return
+					}
+					received <- m.Raw
+					if _, err := conn.Write(replies[string(m.Array[len(m.Array)-1].Value)]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return li
+}
+
+func TestModuleRepliesByteIdentical(t *testing.T) {
+	replies := moduleReplies(t)
+	received := make(chan []byte, 100)
+	upstream := newRawUpstream(t, replies, received)
+	defer func() { _ = upstream.Close() }()
+	client := runTestConnection(t, upstream.Addr().String(), Options{})
+	defer func() { _ = client.Close() }()
+	d := redis.NewDecoder(client)
+
+	names := make([]string, 0, len(replies))
+	for name := range replies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// the key's length has a leading zero, which re-encoding would drop
+		cmd := name[:strings.Index(name, "_")]
+		command := "*3\r\n$" + strconv.Itoa(len(cmd)) + "\r\n" + cmd + "\r\n$03\r\nkey\r\n$" + strconv.Itoa(len(name)) + "\r\n" + name + "\r\n"
+		_, err := client.Write([]byte(command))
+		assert.NoError(t, err)
+		assert.Equal(t, command, string(<-received), "%s is forwarded byte for byte", name)
+		m, err := d.DecodeFrame()
+		if !assert.NoError(t, err, name) {
+			return
+		}
+		assert.Equal(t, replies[name], m.Raw, "%s is relayed byte for byte", name)
+	}
+
+	// and the same as one pipeline
+	var pipeline, expected bytes.Buffer
+	pipeline.WriteString(respCommand("GET", "🔜"))
+	expected.WriteString("$-1\r\n")
+	for _, name := range names {
+		pipeline.WriteString(respCommand(name[:strings.Index(name, "_")], name))
+		expected.Write(replies[name])
+	}
+	pipeline.WriteString(respCommand("GET", "🔚"))
+	expected.WriteString("$-1\r\n")
+	_, err := client.Write(pipeline.Bytes())
+	assert.NoError(t, err)
+	var got bytes.Buffer
+	for range names {
+		<-received
+	}
+	for i := 0; i < len(names)+2; i++ {
+		m, err := d.DecodeFrame()
+		if !assert.NoError(t, err) {
+			return
+		}
+		got.Write(m.Raw)
+	}
+	assert.Equal(t, expected.String(), got.String())
+}
+
+func TestReadahead(t *testing.T) {
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	get := func(keys ...string) string {
+		var s string
+		for _, k := range keys {
+			s += respCommand("GET", k)
+		}
+		return s
+	}
+	for name, tc := range map[string]struct {
+		opts     Options
+		sent     string
+		replies  []string
+		requests int64
+		signals  int
+	}{
+		"off": {
+			sent:     get("a", "b", "c"),
+			replies:  []string{"$7 \\r\\n a-value \\r\\n ", "$7 \\r\\n b-value \\r\\n ", "$7 \\r\\n c-value \\r\\n "},
+			requests: 3,
+		},
+		"one batch": {
+			opts:     Options{Readahead: 8},
+			sent:     get("a", "b", "c"),
+			replies:  []string{"$7 \\r\\n a-value \\r\\n ", "$7 \\r\\n b-value \\r\\n ", "$7 \\r\\n c-value \\r\\n "},
+			requests: 1,
+		},
+		"batches of at most readahead": {
+			opts:     Options{Readahead: 2},
+			sent:     get("a", "b", "c"),
+			replies:  []string{"$7 \\r\\n a-value \\r\\n ", "$7 \\r\\n b-value \\r\\n ", "$7 \\r\\n c-value \\r\\n "},
+			requests: 2,
+		},
+		"stopped by HELLO": {
+			opts:     Options{Readahead: 8},
+			sent:     get("a") + respCommand("HELLO", "2") + get("b"),
+			replies:  []string{"$7 \\r\\n a-value \\r\\n ", "", "$7 \\r\\n b-value \\r\\n "},
+			requests: 3,
+		},
+		"signaled pipeline then commands": {
+			opts:     Options{Readahead: 8},
+			sent:     get("a") + start + get("b", "c") + end + get("d", "e"),
+			replies:  []string{"$7 \\r\\n a-value \\r\\n ", "$-1 \\r\\n ", "$7 \\r\\n b-value \\r\\n ", "$7 \\r\\n c-value \\r\\n ", "$-1 \\r\\n ", "$7 \\r\\n d-value \\r\\n ", "$7 \\r\\n e-value \\r\\n "},
+			requests: 3,
+			signals:  2,
+		},
+		"signals ignored": {
+			opts:     Options{Readahead: 8, IgnorePipelineSignals: true},
+			sent:     start + get("a") + end,
+			replies:  []string{"$10 \\r\\n 🔜-value \\r\\n ", "$7 \\r\\n a-value \\r\\n ", "$10 \\r\\n 🔚-value \\r\\n "},
+			requests: 1,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			upstream := newFakeUpstream(t, echoKey)
+			defer upstream.Close()
+			tc.opts.Traffic = &Traffic{}
+			client := closingTestConnection(t, upstream.Address(), tc.opts)
+
+			replies := roundTripStrings(t, client, len(tc.replies), tc.sent)
+			for i, r := range tc.replies {
+				if r != "" {
+					assert.Equal(t, r, replies[i])
+				}
+			}
+			assert.Equal(t, tc.requests, atomic.LoadInt64(&tc.opts.Traffic.requests))
+			assert.Equal(t, int64(len(tc.replies)-tc.signals), atomic.LoadInt64(&tc.opts.Traffic.commands), "signals aren't commands")
+		})
+	}
+}
+
+func TestReadaheadMixedClients(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	// both clients share the one upstream connection
+	s := newTestServer(t, upstream.Address(), 1)
+	defer func() { _ = s.Disconnect(context.Background()) }()
+	var closed sync.WaitGroup
+	serve := func() net.Conn {
+		closed.Add(1)
+		return serveTestConnection(t, s, Options{Readahead: 8}, closed.Done)
+	}
+	signaled, plain := serve(), serve()
+	defer closed.Wait()
+	defer func() { _ = signaled.Close() }()
+	defer func() { _ = plain.Close() }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			replies := roundTripStrings(t, signaled, 4, respCommand("GET", string(PipelineSignalStartKey))+respCommand("GET", "a")+respCommand("GET", "b")+respCommand("GET", string(PipelineSignalEndKey)))
+			assert.Equal(t, []string{"$-1 \\r\\n ", "$7 \\r\\n a-value \\r\\n ", "$7 \\r\\n b-value \\r\\n ", "$-1 \\r\\n "}, replies)
+		}()
+		go func() {
+			defer wg.Done()
+			replies := roundTripStrings(t, plain, 2, respCommand("GET", "c")+respCommand("GET", "d"))
+			assert.Equal(t, []string{"$7 \\r\\n c-value \\r\\n ", "$7 \\r\\n d-value \\r\\n "}, replies)
+		}()
+		wg.Wait()
+	}
+}
+
+// benchmarkPipeline sends pipelines of 16 GETs without signals, which are
+// forwarded one command at a time, or read ahead and forwarded in batches of
+// at most readahead
+func benchmarkPipeline(b *testing.B, readahead int) {
+	upstream := newFakeUpstream(b, echoKey)
+	defer upstream.Close()
+	s, err := pool.ConnectServer(pool.Address(upstream.Address()), pool.WithMaxConnections(func(uint64) uint64 { return 2 }))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = s.Disconnect(context.Background()) }()
+	sd, err := statsd.New("localhost:8125")
+	if err != nil {
+		b.Fatal(err)
+	}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		CommandConnection(zap.NewNop(), sd, server, "bench", 5*time.Second, time.Second, 1, s, make(chan interface{}), func([]string, []*redis.Message) {}, Options{Readahead: readahead})
+		close(done)
+	}()
+	defer func() { <-done }()
+	defer func() { _ = client.Close() }()
+
+	var pipeline bytes.Buffer
+	for i := 0; i < 16; i++ {
+		pipeline.WriteString(respCommand("GET", "key"+strconv.Itoa(i)))
+	}
+	d := redis.NewDecoder(client)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(pipeline.Bytes()); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 16; j++ {
+			if _, err := d.Decode(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkPipelinePerCommand(b *testing.B) { benchmarkPipeline(b, 0) }
+func BenchmarkPipelineReadahead(b *testing.B)  { benchmarkPipeline(b, 16) }
+
+// benchmarkReply sends request through a connection, whose upstream answers
+// it with reply as it is, and reads the reply back whole. The upstream and the
+// client neither parse nor build replies, so that what is measured is the
+// proxy's forwarding of them.
+func benchmarkReply(b *testing.B, request string, reply []byte) {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = li.Close() }()
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				d := redis.NewDecoder(conn)
+				for {
+					if _, err := d.DecodeFrame(); err != nil {
+						return
+					}
+					if _, err := conn.Write(reply); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	s, err := pool.ConnectServer(pool.Address(li.Addr().String()), pool.WithMaxConnections(func(uint64) uint64 { return 2 }))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = s.Disconnect(context.Background()) }()
+	sd, err := statsd.New("localhost:8125")
+	if err != nil {
+		b.Fatal(err)
+	}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		CommandConnection(zap.NewNop(), sd, server, "bench", 5*time.Second, time.Second, 1, s, make(chan interface{}), func([]string, []*redis.Message) {}, Options{})
+		close(done)
+	}()
+	defer func() { <-done }()
+	defer func() { _ = client.Close() }()
+
+	read := make([]byte, len(reply))
+	b.SetBytes(int64(len(reply)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.WriteString(client, request); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, read); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if !bytes.Equal(read, reply) {
+		b.Fatal("the reply wasn't relayed as it is")
+	}
+}
+
+// BenchmarkReplyGet1K forwards a GET answered with a 1KB value
+func BenchmarkReplyGet1K(b *testing.B) {
+	reply, _ := redis.EncodeToBytes(redis.NewBulkBytes(bytes.Repeat([]byte("v"), 1024)))
+	benchmarkReply(b, respCommand("GET", "key"), reply)
+}
+
+// BenchmarkReplyMGet1M forwards an MGET of 1024 keys answered with 1KB values
+func BenchmarkReplyMGet1M(b *testing.B) {
+	args := []string{"MGET"}
+	values := make([]*redis.Message, 1024)
+	for i := range values {
+		args = append(args, "key"+strconv.Itoa(i))
+		values[i] = redis.NewBulkBytes(bytes.Repeat([]byte("v"), 1024))
+	}
+	reply, _ := redis.EncodeToBytes(redis.NewArray(values))
+	benchmarkReply(b, respCommand(args...), reply)
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// CommandFilter is the allowcommands and denycommands of an upstream. A command
+// is blocked if Allow is set and doesn't name it, or if Deny does. Either may
+// name a command, which covers each of its subcommands, or a subcommand on its
+// own, e.g. "config get". The proxy's own PROXY commands are never blocked for
+// missing from Allow.
+type CommandFilter struct {
+	allow, deny map[string]bool
+}
+
+// NewCommandFilter returns the filter of the allow and deny lists, or nil if
+// both are empty, which lets every command through
+func NewCommandFilter(allow, deny []string) *CommandFilter {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	f := &CommandFilter{deny: commandSet(deny)}
+	if len(allow) > 0 {
+		f.allow = commandSet(allow)
+	}
+	return f
+}
+
+func commandSet(cmds []string) map[string]bool {
+	s := make(map[string]bool, len(cmds))
+	for _, cmd := range cmds {
+		s[strings.ToUpper(strings.TrimSpace(cmd))] = true
+	}
+	return s
+}
+
+// named is whether set names cmd, a command named as validateCommands does, or
+// the command of its subcommand
+func named(set map[string]bool, cmd string) bool {
+	if set[cmd] {
+		return true
+	}
+	i := strings.IndexByte(cmd, ' ')
+	return i >= 0 && set[cmd[:i]]
+}
+
+// blocked is whether the filter blocks cmd
+func (f *CommandFilter) blocked(cmd string) bool {
+	if f == nil {
+		return false
+	}
+	if named(f.deny, cmd) {
+		return true
+	}
+	return f.allow != nil && !named(f.allow, cmd) && !strings.HasPrefix(cmd, "PROXY")
+}
+
+// filterCommand answers cmd with an error if the upstream's command filter
+// blocks it, counting it by its command. Commands neither denied nor known to
+// the key table are counted as CommandMetricsOther, which bounds the tags a
+// client can make with the names it sends.
+func (c *connection) filterCommand(cmd string) *redis.Message {
+	f := c.opts.CommandFilter
+	if !f.blocked(cmd) {
+		return nil
+	}
+	name := cmd
+	if i := strings.IndexByte(cmd, ' '); i >= 0 {
+		name = cmd[:i]
+	}
+	tag := CommandMetricsOther
+	if _, known := c.opts.Keys.arity(name); known || named(f.deny, cmd) {
+		tag = strings.ToLower(name)
+	}
+	metrics.BlockedCommands.Incr(c.statsd, tag)
+	return c.proxyError(proxyerr.Blocked, "command '%s' is blocked by proxy", strings.ToLower(name))
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandFilterBlocked(t *testing.T) {
+	assert.Nil(t, NewCommandFilter(nil, nil), "empty lists allow everything")
+	assert.False(t, (*CommandFilter)(nil).blocked("FLUSHALL"))
+
+	deny := NewCommandFilter(nil, []string{"flushall", "Config", "client kill"})
+	assert.True(t, deny.blocked("FLUSHALL"))
+	assert.True(t, deny.blocked("CONFIG GET"), "a command covers its subcommands")
+	assert.True(t, deny.blocked("CLIENT KILL"))
+	assert.False(t, deny.blocked("CLIENT SETNAME"), "a subcommand only covers itself")
+	assert.False(t, deny.blocked("GET"))
+
+	allow := NewCommandFilter([]string{"get", "set", "config get"}, []string{"set"})
+	assert.False(t, allow.blocked("GET"))
+	assert.False(t, allow.blocked("CONFIG GET"))
+	assert.True(t, allow.blocked("CONFIG SET"))
+	assert.True(t, allow.blocked("SET"), "denied even though allowed")
+	assert.True(t, allow.blocked("KEYS"))
+	assert.False(t, allow.blocked("PROXY PING"), "the proxy's own commands")
+}
+
+func TestCommandFilterPipeline(t *testing.T) {
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{CommandFilter: NewCommandFilter(nil, []string{"flushall", "keys"})})
+	defer func() { _ = client.Close() }()
+
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"$7 \\r\\n a-value \\r\\n ",
+		"-PROXYBLOCKED command 'flushall' is blocked by proxy \\r\\n ",
+		"-PROXYBLOCKED transaction discarded, FLUSHALL is blocked by proxy \\r\\n ",
+		"-PROXYBLOCKED transaction discarded, FLUSHALL is blocked by proxy \\r\\n ",
+		"-PROXYBLOCKED transaction discarded, FLUSHALL is blocked by proxy \\r\\n ",
+		"$7 \\r\\n b-value \\r\\n ",
+		"$-1 \\r\\n ",
+	}, roundTripStrings(t, client, 8,
+		start,
+		respCommand("GET", "a"),
+		respCommand("flushall"),
+		respCommand("MULTI"),
+		respCommand("FLUSHALL"),
+		respCommand("EXEC"),
+		respCommand("GET", "b"),
+		end,
+	), "the blocked commands are answered in their position")
+	assert.Equal(t, int64(2), upstream.Commands(), "the blocked commands and the transaction aren't sent")
+
+	assert.Equal(t, []string{"-PROXYBLOCKED command 'keys' is blocked by proxy \\r\\n "}, roundTripStrings(t, client, 1, respCommand("KEYS", "*")))
+	assert.Equal(t, int64(2), upstream.Commands(), "a lone blocked command takes no upstream connection")
+
+	plain := runTestConnection(t, upstream.Address(), Options{PlainErrors: true, CommandFilter: NewCommandFilter([]string{"get"}, nil)})
+	defer func() { _ = plain.Close() }()
+	assert.Equal(t, []string{"-ERR redisbetween: command 'set' is blocked by proxy \\r\\n "}, roundTripStrings(t, plain, 1, respCommand("set", "a", "1")))
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, plain, 1, respCommand("GET", "a")))
+}
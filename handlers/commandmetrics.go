@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"strings"
+	"time"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// CommandMetricsOther is the command tag of the commands that aren't timed
+// under their own name
+const CommandMetricsOther = "other"
+
+// CommandMetricsPipeline is the command tag of the timing of a request of more
+// than one command, whose commands share its round trip
+const CommandMetricsPipeline = "pipeline"
+
+// DefaultCommandMetrics are the commands timed under their own name unless the
+// upstream names others
+var DefaultCommandMetrics = []string{
+	"APPEND", "DECR", "DECRBY", "DEL", "EVAL", "EVALSHA", "EXEC", "EXISTS", "EXPIRE", "EXPIREAT", "GET", "GETDEL",
+	"GETEX", "GETSET", "HDEL", "HEXISTS", "HGET", "HGETALL", "HINCRBY", "HKEYS", "HLEN", "HMGET", "HMSET", "HSET",
+	"INCR", "INCRBY", "LLEN", "LPOP", "LPUSH", "LRANGE", "LREM", "MGET", "MSET", "MULTI", "PEXPIRE", "PING", "PTTL",
+	"RPOP", "RPUSH", "SADD", "SCAN", "SCARD", "SET", "SETEX", "SETNX", "SISMEMBER", "SMEMBERS", "SREM", "TTL",
+	"UNLINK", "ZADD", "ZCARD", "ZINCRBY", "ZRANGE", "ZRANGEBYSCORE", "ZREM", "ZREVRANGE", "ZSCORE",
+}
+
+// CommandMetrics names the commands timed and counted under their own name in
+// the command metrics, every other one, unknown commands included, being
+// tagged CommandMetricsOther, which bounds the tags a client can make
+type CommandMetrics map[string]bool
+
+func NewCommandMetrics(cmds []string) CommandMetrics {
+	m := make(CommandMetrics, len(cmds))
+	for _, cmd := range cmds {
+		m[strings.ToUpper(cmd)] = true
+	}
+	return m
+}
+
+// tag is the command tag of a command named as validateCommands does. A
+// subcommand is tagged with its command, unless it is named on its own.
+func (m CommandMetrics) tag(cmd string) string {
+	if !m[cmd] {
+		if i := strings.IndexByte(cmd, ' '); i >= 0 {
+			cmd = cmd[:i]
+		}
+		if !m[cmd] {
+			return CommandMetricsOther
+		}
+	}
+	return strings.ReplaceAll(strings.ToLower(cmd), " ", "_")
+}
+
+// recordCommands times a request, from it being read to its replies being
+// written, and counts each of its commands answered with an error. A lone
+// command is timed by its own tag, and a pipeline once, as the commands of one
+// share its round trip and can't be timed apart.
+func (c *connection) recordCommands(cmds []string, replies []*redis.Message, elapsed time.Duration) {
+	m := c.opts.CommandMetrics
+	if m == nil || len(cmds) == 0 {
+		return
+	}
+	if len(cmds) == 1 {
+		metrics.CommandLatency.Record(c.statsd, elapsed, m.tag(cmds[0]))
+	} else {
+		metrics.CommandLatency.Record(c.statsd, elapsed, CommandMetricsPipeline)
+	}
+	for i, cmd := range cmds {
+		if i < len(replies) && replies[i] != nil && replies[i].IsError() {
+			metrics.CommandErrors.Incr(c.statsd, m.tag(cmd))
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandMetricsTag(t *testing.T) {
+	m := NewCommandMetrics([]string{"get", "EVALSHA", "CLIENT SETNAME", "CONFIG"})
+	assert.Equal(t, "get", m.tag("GET"))
+	assert.Equal(t, "evalsha", m.tag("EVALSHA"), "the script is never part of the name")
+	assert.Equal(t, "client_setname", m.tag("CLIENT SETNAME"))
+	assert.Equal(t, CommandMetricsOther, m.tag("CLIENT LIST"))
+	assert.Equal(t, "config", m.tag("CONFIG GET"), "tagged with its command")
+	assert.Equal(t, CommandMetricsOther, m.tag("SET"))
+	assert.Equal(t, CommandMetricsOther, m.tag("MADEUP"))
+	assert.Equal(t, CommandMetricsOther, m.tag(""))
+}
+
+func TestRecordCommands(t *testing.T) {
+	li, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = li.Close() }()
+	sd, err := statsd.New(li.LocalAddr().String(), statsd.WithoutTelemetry())
+	assert.NoError(t, err)
+
+	c := &connection{statsd: sd, opts: Options{CommandMetrics: NewCommandMetrics([]string{"GET", "SET"})}}
+	replies := []*redis.Message{redis.NewBulkBytes([]byte("v")), redis.NewErrorf("ERR wrong"), redis.NewErrorf("ERR unknown")}
+	c.recordCommands([]string{"GET", "SET", "MADEUP"}, replies, 5*time.Millisecond)
+	c.recordCommands([]string{"GET"}, replies[:1], time.Millisecond)
+	assert.NoError(t, sd.Flush())
+
+	var lines []string
+	buf := make([]byte, 65536)
+	_ = li.SetReadDeadline(time.Now().Add(time.Second))
+	for len(lines) < 4 {
+		n, _, err := li.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			break
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(buf[:n])), "\n") {
+			// name:value|type|#tags, less the value
+			parts := strings.Split(line, "|")
+			lines = append(lines, parts[0][:strings.LastIndex(parts[0], ":")]+"|"+strings.Join(parts[1:], "|"))
+		}
+	}
+	sort.Strings(lines)
+	assert.Equal(t, []string{
+		"command.errors|c|#command:other",
+		"command.errors|c|#command:set",
+		"command|ms|#command:get",
+		"command|ms|#command:pipeline",
+	}, lines, "a pipeline is timed once, its errors counted by command")
+}
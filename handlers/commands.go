@@ -1,5 +1,11 @@
 package handlers
 
+import (
+	"strings"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
 var UnsupportedCommands = map[string]bool{
 	// blocking commands cause clients to hold a connection open and wait for data to
 	// appear. these monopolize a connection from the pool, so don't make sense to
@@ -41,3 +47,169 @@ var TransactionCommands = map[string]int{
 	"UNWATCH": TransactionInner,
 	"WATCH":   TransactionOpen,
 }
+
+// SubcommandCommands are commands whose first argument is a subcommand that the
+// proxy needs to tell apart, so the subcommand is included in the command name.
+var SubcommandCommands = map[string]bool{
+	"CLIENT":   true,
+	"CLUSTER":  true,
+	"CONFIG":   true,
+	"FUNCTION": true,
+	"PROXY":    true,
+	"XGROUP":   true,
+}
+
+// WriteCommands are the commands that can modify data, rejected in read-only mode.
+// Commands like SORT and GEORADIUS are included because of their STORE options.
+var WriteCommands = map[string]bool{
+	"APPEND":                true,
+	"BITFIELD":              true,
+	"BITOP":                 true,
+	"BLMOVE":                true,
+	"BLMPOP":                true,
+	"BLPOP":                 true,
+	"BRPOP":                 true,
+	"BRPOPLPUSH":            true,
+	"BZMPOP":                true,
+	"BZPOPMAX":              true,
+	"BZPOPMIN":              true,
+	"COPY":                  true,
+	"DECR":                  true,
+	"DECRBY":                true,
+	"DEL":                   true,
+	"EXPIRE":                true,
+	"EXPIREAT":              true,
+	"FLUSHALL":              true,
+	"FLUSHDB":               true,
+	"FUNCTION DELETE":       true,
+	"FUNCTION FLUSH":        true,
+	"FUNCTION LOAD":         true,
+	"FUNCTION RESTORE":      true,
+	"GEOADD":                true,
+	"GEORADIUS":             true,
+	"GEORADIUSBYMEMBER":     true,
+	"GEOSEARCHSTORE":        true,
+	"GETDEL":                true,
+	"GETEX":                 true,
+	"GETSET":                true,
+	"HDEL":                  true,
+	"HINCRBY":               true,
+	"HINCRBYFLOAT":          true,
+	"HMSET":                 true,
+	"HSET":                  true,
+	"HSETNX":                true,
+	"INCR":                  true,
+	"INCRBY":                true,
+	"INCRBYFLOAT":           true,
+	"LINSERT":               true,
+	"LMOVE":                 true,
+	"LMPOP":                 true,
+	"LPOP":                  true,
+	"LPUSH":                 true,
+	"LPUSHX":                true,
+	"LREM":                  true,
+	"LSET":                  true,
+	"LTRIM":                 true,
+	"MIGRATE":               true,
+	"MOVE":                  true,
+	"MSET":                  true,
+	"MSETNX":                true,
+	"PERSIST":               true,
+	"PEXPIRE":               true,
+	"PEXPIREAT":             true,
+	"PFADD":                 true,
+	"PFDEBUG":               true,
+	"PFMERGE":               true,
+	"PSETEX":                true,
+	"RENAME":                true,
+	"RENAMENX":              true,
+	"RESTORE":               true,
+	"RESTORE-ASKING":        true,
+	"RPOP":                  true,
+	"RPOPLPUSH":             true,
+	"RPUSH":                 true,
+	"RPUSHX":                true,
+	"SADD":                  true,
+	"SDIFFSTORE":            true,
+	"SET":                   true,
+	"SETBIT":                true,
+	"SETEX":                 true,
+	"SETNX":                 true,
+	"SETRANGE":              true,
+	"SINTERSTORE":           true,
+	"SMOVE":                 true,
+	"SORT":                  true,
+	"SPOP":                  true,
+	"SREM":                  true,
+	"SUNIONSTORE":           true,
+	"SWAPDB":                true,
+	"UNLINK":                true,
+	"XACK":                  true,
+	"XADD":                  true,
+	"XAUTOCLAIM":            true,
+	"XCLAIM":                true,
+	"XDEL":                  true,
+	"XGROUP CREATE":         true,
+	"XGROUP CREATECONSUMER": true,
+	"XGROUP DELCONSUMER":    true,
+	"XGROUP DESTROY":        true,
+	"XGROUP SETID":          true,
+	"XREADGROUP":            true,
+	"XSETID":                true,
+	"XTRIM":                 true,
+	"ZADD":                  true,
+	"ZDIFFSTORE":            true,
+	"ZINCRBY":               true,
+	"ZINTERSTORE":           true,
+	"ZMPOP":                 true,
+	"ZPOPMAX":               true,
+	"ZPOPMIN":               true,
+	"ZRANGESTORE":           true,
+	"ZREM":                  true,
+	"ZREMRANGEBYLEX":        true,
+	"ZREMRANGEBYRANK":       true,
+	"ZREMRANGEBYSCORE":      true,
+	"ZUNIONSTORE":           true,
+
+	// scripts can run any command
+	"EVAL":    true,
+	"EVALSHA": true,
+	"FCALL":   true,
+}
+
+// ReadWriteCommands read a key and write it in one command, so that their reply
+// is a value the command itself may have just changed or deleted. They are
+// writes to every table: rejected in read-only mode, never answered by a read
+// fallback or a read in flight, invalidating rather than populating what the
+// proxy shares, never sent again once they may have been delivered, and counted
+// as writes in the command mix. SET is one with its GET option, see readWrite.
+var ReadWriteCommands = map[string]bool{
+	"GETDEL": true,
+	"GETEX":  true,
+	"GETSET": true,
+}
+
+// readWrite is whether command m, whose name is cmd, is one of
+// ReadWriteCommands or a SET with the GET option
+func readWrite(cmd string, m *redis.Message) bool {
+	if ReadWriteCommands[cmd] {
+		return true
+	}
+	if cmd != "SET" || len(m.Array) <= 3 {
+		return false
+	}
+	for _, a := range m.Array[3:] {
+		if strings.EqualFold(string(a.Value), "GET") {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadOnlyScriptCommands can only run read-only commands, enforced by redis, so
+// they may optionally be allowed in read-only mode
+var ReadOnlyScriptCommands = map[string]bool{
+	"EVAL_RO":    true,
+	"EVALSHA_RO": true,
+	"FCALL_RO":   true,
+}
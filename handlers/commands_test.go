@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// readWriteCommands are GETDEL, GETEX and GETSET, and SET with its GET option
+var readWriteCommands = [][]string{
+	{"GETDEL", "k"},
+	{"GETEX", "k", "EX", "10"},
+	{"GETSET", "k", "v"},
+	{"SET", "k", "v", "GET"},
+	{"SET", "k", "v", "EX", "10", "get"},
+}
+
+func commandMessage(args ...string) *redis.Message {
+	m := redis.NewArray(nil)
+	for _, a := range args {
+		m.Array = append(m.Array, redis.NewBulkBytes([]byte(a)))
+	}
+	return m
+}
+
+func TestReadWriteCommands(t *testing.T) {
+	for _, args := range readWriteCommands {
+		cmd, m := args[0], commandMessage(args...)
+		name := strings.Join(args, " ")
+		assert.True(t, readWrite(cmd, m), name)
+		assert.True(t, WriteCommands[cmd], "%s is rejected in read-only mode", name)
+		assert.False(t, FallbackReadCommands[cmd], "%s never falls back", name)
+		assert.False(t, CoalesceCommands[cmd], "%s never shares a read in flight", name)
+		assert.Equal(t, mixWrite, mixClass(cmd), "%s is counted as a write", name)
+		assert.False(t, idempotent([]*redis.Message{m}), "%s is never sent again", name)
+		inv, ok := Invalidates(cmd, m)
+		assert.True(t, ok, name)
+		assert.Equal(t, []InvalidatedKey{{Key: "k", DB: -1}}, inv.Keys, "%s invalidates its key", name)
+	}
+	assert.False(t, readWrite("SET", commandMessage("SET", "k", "GET")), "GET is the value")
+	assert.False(t, readWrite("GET", commandMessage("GET", "k")))
+}
+
+func TestReadWriteCommandsAcrossFeatures(t *testing.T) {
+	for _, readOnly := range []bool{false, true} {
+		for _, fallback := range []bool{false, true} {
+			for _, coalesce := range []bool{false, true} {
+				for _, retries := range []int{0, 1} {
+					name := fmt.Sprintf("readonly=%v,fallback=%v,coalesce=%v,retries=%d", readOnly, fallback, coalesce, retries)
+					t.Run(name, func(t *testing.T) {
+						primary := newFakeUpstream(t, nilGets)
+						defer primary.Close()
+						secondary := newFakeUpstream(t, echoKey)
+						defer secondary.Close()
+						opts := Options{ReadOnly: NewReadOnly(readOnly), Retries: retries}
+						if fallback {
+							opts.ReadFallback = readFallbackTo(t, secondary.Address(), "")
+						}
+						if coalesce {
+							opts.Coalescer = NewCoalescer(CoalesceOptions{MaxKeys: 10, MaxBytes: 1024})
+						}
+						client := closingTestConnection(t, primary.Address(), opts)
+
+						for _, args := range readWriteCommands {
+							expected := "+OK \\r\\n "
+							if readOnly {
+								expected = "-PROXYMAINT upstream is in read-only mode \\r\\n "
+							}
+							assert.Equal(t, []string{expected}, roundTripStrings(t, client, 1, respCommand(args...)), args)
+						}
+						sent := int64(len(readWriteCommands))
+						if readOnly {
+							sent = 0
+						}
+						assert.Equal(t, sent, primary.Commands(), "sent once each, to the primary")
+						assert.EqualValues(t, 0, secondary.Commands())
+					})
+				}
+			}
+		}
+	}
+
+	// with the primary down, they fail rather than being answered by the
+	// secondary
+	primary := newFakeUpstream(t, echoKey)
+	primary.Close()
+	secondary := newFakeUpstream(t, echoKey)
+	defer secondary.Close()
+	client := closingTestConnection(t, primary.Address(), Options{ReadFallback: readFallbackTo(t, secondary.Address(), ""), Retries: 1})
+	for _, args := range readWriteCommands {
+		reply := roundTripStrings(t, client, 1, respCommand(args...))[0]
+		assert.True(t, strings.HasPrefix(reply, "-PROXYUNAVAILABLE"), "%v: %s", args, reply)
+	}
+	assert.EqualValues(t, 0, secondary.Commands())
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// ConfigParams are the read-only parameters whose CONFIG GET the proxy answers
+// from its cache of the upstream's configuration: those client libraries and
+// tools read to adapt to the server, none of which reveal credentials
+var ConfigParams = []string{
+	"appendonly",
+	"busy-reply-threshold",
+	"cluster-enabled",
+	"databases",
+	"hz",
+	"lua-time-limit",
+	"maxclients",
+	"maxmemory",
+	"maxmemory-policy",
+	"notify-keyspace-events",
+	"proto-max-bulk-len",
+	"save",
+	"slowlog-log-slower-than",
+	"slowlog-max-len",
+	"tcp-keepalive",
+	"timeout",
+}
+
+// ConfigWriteCommands change the upstream's configuration, or its statistics,
+// for every client sharing it through the pool
+var ConfigWriteCommands = map[string]bool{
+	"CONFIG RESETSTAT": true,
+	"CONFIG REWRITE":   true,
+	"CONFIG SET":       true,
+}
+
+// ConfigCache is the last known value of each of ConfigParams on an upstream,
+// refreshed by the proxy in the background, so that the CONFIG GET clients send
+// on every connection don't each take a round trip to the upstream.
+type ConfigCache struct {
+	mu        sync.RWMutex
+	values    map[string]string
+	refreshed time.Time
+	err       string
+}
+
+// ConfigCacheStats is the state of a ConfigCache, served under each listener in
+// /stats
+type ConfigCacheStats struct {
+	Params    int       `json:"params"`
+	Refreshed time.Time `json:"refreshed,omitempty"`
+	// Error is why the last refresh failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// NewConfigCache makes an empty cache, which answers nothing until it is Set
+func NewConfigCache() *ConfigCache {
+	return &ConfigCache{}
+}
+
+// Set replaces the cached values with those of a refresh. A parameter missing
+// from values is one the upstream doesn't have, which CONFIG GET leaves out.
+func (cc *ConfigCache) Set(values map[string]string, at time.Time) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.values = values
+	cc.refreshed = at
+	cc.err = ""
+}
+
+// Fail records a failed refresh, keeping the values of the last one
+func (cc *ConfigCache) Fail(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.err = err.Error()
+}
+
+// Stats returns the state of the cache, or nil if there is none
+func (cc *ConfigCache) Stats() *ConfigCacheStats {
+	if cc == nil {
+		return nil
+	}
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return &ConfigCacheStats{Params: len(cc.values), Refreshed: cc.refreshed, Error: cc.err}
+}
+
+// get returns the cached name and value pairs of the parameters the patterns
+// match, each a name or a glob, whether every pattern is the name of one of
+// ConfigParams, and whether the cache has been refreshed yet
+func (cc *ConfigCache) get(patterns []*redis.Message) (pairs []*redis.Message, safe, loaded bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	safe = true
+	seen := make(map[string]bool)
+	for _, m := range patterns {
+		pattern := strings.ToLower(string(m.Value))
+		known := false
+		for _, p := range ConfigParams {
+			if ok, _ := path.Match(pattern, p); !ok {
+				continue
+			}
+			known = known || p == pattern
+			// redis answers a parameter once, however many patterns match it
+			if v, ok := cc.values[p]; ok && !seen[p] {
+				seen[p] = true
+				pairs = append(pairs, redis.NewBulkBytes([]byte(p)), redis.NewBulkBytes([]byte(v)))
+			}
+		}
+		// a glob, or an unknown name, may match parameters outside the cached set
+		safe = safe && known
+	}
+	return pairs, safe, cc.values != nil
+}
+
+// configGet answers a CONFIG GET from the cache if each of its parameters is one
+// of ConfigParams, or forwards it if the cache has yet to be refreshed. Any other
+// CONFIG GET is forwarded if ConfigGetForward is set, or answered with the cached
+// parameters its patterns match, leaving out the rest as redis does the
+// parameters it doesn't have.
+func (c *connection) configGet(args []*redis.Message) *redis.Message {
+	if c.opts.ConfigCache == nil || len(args) == 0 {
+		return nil
+	}
+	pairs, safe, loaded := c.opts.ConfigCache.get(args)
+	if (!safe && c.opts.ConfigGetForward) || (safe && !loaded) {
+		metrics.ConfigGets.Incr(c.statsd, "forwarded")
+		return nil
+	}
+	metrics.ConfigGets.Incr(c.statsd, "cached")
+	if pairs == nil {
+		pairs = []*redis.Message{}
+	}
+	r := redis.NewArray(pairs)
+	if c.speaksRESP3() {
+		r.Type = redis.TypeMap
+	}
+	return r
+}
+
+// rejectConfigWrite refuses CONFIG SET, REWRITE and RESETSTAT unless they are
+// allowed: the upstream they change is shared by every client through the pool
+func (c *connection) rejectConfigWrite(cmd string) *redis.Message {
+	if !ConfigWriteCommands[cmd] || c.opts.AllowConfigWrites {
+		return nil
+	}
+	if c.trace != nil {
+		c.trace.add("config", "rejected")
+	}
+	return c.proxyError(proxyerr.Blocked, "%s would change the upstream under every client sharing it through the proxy's pool. Start the proxy with -allowconfigwrites to allow it", cmd)
+}
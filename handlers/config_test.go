@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigGet(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		return redis.NewArray(bulks("requirepass", "hunter2"))
+	})
+	defer upstream.Close()
+	cache := NewConfigCache()
+	client := runTestConnection(t, upstream.Address(), Options{ConfigCache: cache})
+	defer func() { _ = client.Close() }()
+
+	assert.Equal(t, []string{"*2 \\r\\n $11 \\r\\n requirepass \\r\\n $7 \\r\\n hunter2 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("CONFIG", "GET", "maxmemory")), "forwarded until the cache is refreshed")
+	assert.EqualValues(t, 1, atomic.LoadInt64(&upstream.commands))
+
+	cache.Set(map[string]string{"maxmemory": "1073741824", "maxmemory-policy": "allkeys-lru", "save": ""}, time.Now())
+	actual := roundTripStrings(t, client, 5,
+		respCommand("CONFIG", "GET", "MAXMEMORY"),
+		respCommand("config", "get", "maxmemory", "save"),
+		respCommand("CONFIG", "GET", "maxmemory*"),
+		respCommand("CONFIG", "GET", "hz"),
+		respCommand("CONFIG", "GET", "requirepass"),
+	)
+	assert.Equal(t, []string{
+		"*2 \\r\\n $9 \\r\\n maxmemory \\r\\n $10 \\r\\n 1073741824 \\r\\n ",
+		"*4 \\r\\n $9 \\r\\n maxmemory \\r\\n $10 \\r\\n 1073741824 \\r\\n $4 \\r\\n save \\r\\n $0 \\r\\n  \\r\\n ",
+		"*4 \\r\\n $9 \\r\\n maxmemory \\r\\n $10 \\r\\n 1073741824 \\r\\n $16 \\r\\n maxmemory-policy \\r\\n $11 \\r\\n allkeys-lru \\r\\n ",
+		"*0 \\r\\n ",
+		"*0 \\r\\n ",
+	}, actual, "the cached parameters are answered, and those the upstream doesn't have or that aren't cached left out")
+	assert.EqualValues(t, 1, atomic.LoadInt64(&upstream.commands), "nothing more is forwarded")
+	assert.Equal(t, ConfigCacheStats{Params: 3, Refreshed: cache.Stats().Refreshed}, *cache.Stats())
+}
+
+func TestConfigGetForward(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		return redis.NewArray(bulks("notify-keyspace-events", "Ex", "lazyfree-lazy-eviction", "no"))
+	})
+	defer upstream.Close()
+	cache := NewConfigCache()
+	cache.Set(map[string]string{"notify-keyspace-events": ""}, time.Now())
+	client := runTestConnection(t, upstream.Address(), Options{ConfigCache: cache, ConfigGetForward: true})
+	defer func() { _ = client.Close() }()
+
+	actual := roundTripStrings(t, client, 2,
+		respCommand("CONFIG", "GET", "notify-keyspace-events"),
+		respCommand("CONFIG", "GET", "notify-keyspace-events", "lazyfree-lazy-eviction"),
+	)
+	assert.Equal(t, []string{
+		"*2 \\r\\n $22 \\r\\n notify-keyspace-events \\r\\n $0 \\r\\n  \\r\\n ",
+		"*4 \\r\\n $22 \\r\\n notify-keyspace-events \\r\\n $2 \\r\\n Ex \\r\\n $22 \\r\\n lazyfree-lazy-eviction \\r\\n $2 \\r\\n no \\r\\n ",
+	}, actual, "a parameter outside the cached set is forwarded, along with the rest of its command")
+	assert.EqualValues(t, 1, atomic.LoadInt64(&upstream.commands))
+}
+
+func TestConfigWriteRejected(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		return redis.NewString([]byte("OK"))
+	})
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = client.Close() }()
+
+	actual := roundTripStrings(t, client, 4,
+		respCommand("CONFIG", "SET", "maxmemory", "0"),
+		respCommand("CONFIG", "REWRITE"),
+		respCommand("CONFIG", "RESETSTAT"),
+		respCommand("CONFIG", "GET", "maxmemory"),
+	)
+	assert.Equal(t, []string{
+		"-PROXYBLOCKED CONFIG SET would change the upstream under every client sharing it through the proxy's pool. Start the proxy with -allowconfigwrites to allow it \\r\\n ",
+		"-PROXYBLOCKED CONFIG REWRITE would change the upstream under every client sharing it through the proxy's pool. Start the proxy with -allowconfigwrites to allow it \\r\\n ",
+		"-PROXYBLOCKED CONFIG RESETSTAT would change the upstream under every client sharing it through the proxy's pool. Start the proxy with -allowconfigwrites to allow it \\r\\n ",
+		"+OK \\r\\n ",
+	}, actual, "without a cache, CONFIG GET is forwarded")
+
+	allowed := runTestConnection(t, upstream.Address(), Options{AllowConfigWrites: true})
+	defer func() { _ = allowed.Close() }()
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, allowed, 1, respCommand("CONFIG", "SET", "maxmemory", "0")))
+}
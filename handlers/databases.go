@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// DatabaseCommands change whole databases, invalidating what the proxy caches of
+// their data
+var DatabaseCommands = map[string]bool{
+	"FLUSHALL": true,
+	"FLUSHDB":  true,
+	"SWAPDB":   true,
+}
+
+// DBCache is something the proxy keeps about the data of one upstream database
+type DBCache interface {
+	// ClearDB forgets the cached data, because the database was flushed or
+	// swapped with another one
+	ClearDB()
+}
+
+// KeyCache is a DBCache that also forgets single keys, which writes change
+type KeyCache interface {
+	DBCache
+	// ForgetKey forgets what is cached of key, returning whether there was
+	// anything
+	ForgetKey(key string) bool
+}
+
+type upstreamDB struct {
+	upstream string
+	db       int
+}
+
+// Databases tracks the caches of each upstream database across the listeners of
+// a process, so that a FLUSHDB, FLUSHALL or SWAPDB forwarded through the listener
+// of one database clears the caches of every database it changed, whichever
+// listener they belong to.
+type Databases struct {
+	mu     sync.Mutex
+	caches map[upstreamDB][]DBCache
+	// keyCaches counts the KeyCaches registered, for writes to skip Forget
+	// while there are none
+	keyCaches int32
+}
+
+func NewDatabases() *Databases {
+	return &Databases{caches: make(map[upstreamDB][]DBCache)}
+}
+
+// Register adds the cache of a database, until the function it returns is
+// called. The cache must be comparable, a pointer for instance.
+func (d *Databases) Register(upstream string, db int, cache DBCache) func() {
+	k := upstreamDB{upstream, db}
+	_, keyed := cache.(KeyCache)
+	d.mu.Lock()
+	d.caches[k] = append(d.caches[k], cache)
+	d.mu.Unlock()
+	if keyed {
+		atomic.AddInt32(&d.keyCaches, 1)
+	}
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		caches := d.caches[k]
+		for i, c := range caches {
+			if c == cache {
+				d.caches[k] = append(caches[:i:i], caches[i+1:]...)
+				if keyed {
+					atomic.AddInt32(&d.keyCaches, -1)
+				}
+				break
+			}
+		}
+		if len(d.caches[k]) == 0 {
+			delete(d.caches, k)
+		}
+	}
+}
+
+// Invalidate clears the caches of the databases inv clears, db being the one of
+// the connection the command was sent on
+func (d *Databases) Invalidate(upstream string, db int, inv Invalidation) {
+	if d == nil {
+		return
+	}
+	var clear []DBCache
+	d.mu.Lock()
+	for k, caches := range d.caches {
+		if k.upstream != upstream || !inv.clears(db, k.db) {
+			continue
+		}
+		clear = append(clear, caches...)
+	}
+	d.mu.Unlock()
+	for _, c := range clear {
+		c.ClearDB()
+	}
+}
+
+func (d *Databases) hasKeyCaches() bool {
+	return d != nil && atomic.LoadInt32(&d.keyCaches) > 0
+}
+
+// Forget has the KeyCaches of the databases forget the data inv invalidates,
+// which a write sent on db changed, clearing those of the databases it clears
+// whole. It returns the number of keys forgotten.
+func (d *Databases) Forget(upstream string, db int, inv Invalidation) int {
+	if !d.hasKeyCaches() {
+		return 0
+	}
+	type forget struct {
+		cache KeyCache
+		key   string
+	}
+	var clear []KeyCache
+	var keys []forget
+	d.mu.Lock()
+	for k, caches := range d.caches {
+		if k.upstream != upstream {
+			continue
+		}
+		for _, c := range caches {
+			kc, ok := c.(KeyCache)
+			if !ok {
+				continue
+			}
+			if inv.clears(db, k.db) {
+				clear = append(clear, kc)
+				continue
+			}
+			for _, ik := range inv.Keys {
+				if ik.DB == k.db || ik.DB < 0 && db == k.db {
+					keys = append(keys, forget{kc, ik.Key})
+				}
+			}
+		}
+	}
+	d.mu.Unlock()
+	for _, c := range clear {
+		c.ClearDB()
+	}
+	n := 0
+	for _, f := range keys {
+		if f.cache.ForgetKey(f.key) {
+			n++
+		}
+	}
+	return n
+}
+
+// clears is whether the invalidation, of a command sent on connDB, clears all of
+// db
+func (inv Invalidation) clears(connDB, db int) bool {
+	if inv.ClearAll || inv.ClearDB && db == connDB {
+		return true
+	}
+	for _, d := range inv.ClearDBs {
+		if d == db {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectSwapDB refuses SWAPDB unless it is allowed: the databases it swaps are
+// shared by every client of the upstream, through the pool, so one client
+// swapping them changes the data of all the others
+func (c *connection) rejectSwapDB(cmd string) *redis.Message {
+	if cmd != "SWAPDB" || c.opts.AllowSwapDB {
+		return nil
+	}
+	if c.trace != nil {
+		c.trace.add("swapdb", "rejected")
+	}
+	return c.proxyError(proxyerr.Blocked, "SWAPDB would swap databases under every client sharing the upstream through the proxy's pool. Start the proxy with -allowswapdb to allow it")
+}
+
+// invalidateDatabases clears the caches of the databases that the commands
+// forwarded to db changed
+func (c *connection) invalidateDatabases(db int, cmds []string, wm, res []*redis.Message) {
+	for i, cmd := range cmds {
+		if !DatabaseCommands[cmd] || i >= len(res) || res[i].IsError() {
+			continue
+		}
+		inv, _ := Invalidates(cmd, wm[i])
+		c.opts.Databases.Invalidate(c.opts.Upstream, db, inv)
+		metrics.DatabaseInvalidations.Incr(c.statsd, cmd)
+		c.log.Info("Cleared caches of the databases changed", zap.String("command", cmd), zap.Int("db", db))
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDBCache struct {
+	cleared int
+}
+
+func (f *fakeDBCache) ClearDB() {
+	f.cleared++
+}
+
+func TestDatabasesInvalidate(t *testing.T) {
+	d := NewDatabases()
+	zero, two, three, other := &fakeDBCache{}, &fakeDBCache{}, &fakeDBCache{}, &fakeDBCache{}
+	d.Register("a:6379", 0, zero)
+	d.Register("a:6379", 2, two)
+	unregister := d.Register("a:6379", 3, three)
+	d.Register("b:6379", 2, other)
+	invalidate := func(db int, args ...string) {
+		inv, ok := Invalidates(strings.ToUpper(args[0]), redis.NewArray(bulks(args...)))
+		assert.True(t, ok)
+		d.Invalidate("a:6379", db, inv)
+	}
+
+	invalidate(2, "FLUSHDB")
+	assert.Equal(t, []int{0, 1, 0, 0}, []int{zero.cleared, two.cleared, three.cleared, other.cleared}, "FLUSHDB clears the connection's database only")
+	invalidate(0, "SWAPDB", "2", "3")
+	assert.Equal(t, []int{0, 2, 1, 0}, []int{zero.cleared, two.cleared, three.cleared, other.cleared}, "SWAPDB clears both databases, whichever the connection is on")
+	invalidate(0, "FLUSHALL")
+	assert.Equal(t, []int{1, 3, 2, 0}, []int{zero.cleared, two.cleared, three.cleared, other.cleared}, "FLUSHALL clears every database of the upstream")
+
+	unregister()
+	invalidate(3, "FLUSHDB")
+	assert.Equal(t, 2, three.cleared)
+}
+
+func TestSwapDBRejected(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = client.Close() }()
+
+	rejected := "-PROXYBLOCKED SWAPDB would swap databases under every client sharing the upstream through the proxy's pool. Start the proxy with -allowswapdb to allow it \\r\\n "
+	assert.Equal(t, []string{rejected}, roundTripStrings(t, client, 1, respCommand("SWAPDB", "0", "1")))
+	actual := roundTripStrings(t, client, 5,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("MULTI"),
+		respCommand("SWAPDB", "0", "1"),
+		respCommand("EXEC"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	)
+	assert.Equal(t, []string{"$-1 \\r\\n ", rejected, rejected, rejected, "$-1 \\r\\n "}, actual)
+	assert.Equal(t, int64(0), upstream.Commands())
+}
+
+func TestFlushDBClearsWriteBehind(t *testing.T) {
+	c, upstream := newWriteBehindUpstream(t, map[string]int64{"metrics:a": 10})
+	c.reply = func(args []string) *redis.Message {
+		switch strings.ToUpper(args[0]) {
+		case "FLUSHDB", "SWAPDB":
+			c.values = map[string]int64{}
+			return redis.NewString([]byte("OK"))
+		}
+		return nil
+	}
+	w := startWriteBehind(t, upstream.Address(), writeBehindOptions(WriteBehindReplyTotal))
+	defer func() { _ = w.Close(context.Background()) }()
+	d := NewDatabases()
+	d.Register(upstream.Address(), 2, w)
+
+	client := runTestConnection(t, upstream.Address(), Options{WriteBehind: w, Upstream: upstream.Address(), Database: 2, Databases: d, AllowSwapDB: true})
+	defer func() { _ = client.Close() }()
+	assert.Equal(t, []string{intReply(11)}, roundTripStrings(t, client, 1, respCommand("INCR", "metrics:a")))
+	assert.Equal(t, []string{intReply(12)}, roundTripStrings(t, client, 1, respCommand("INCR", "metrics:a")), "absorbed")
+	assert.NoError(t, w.flush(context.Background()))
+
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("FLUSHDB")))
+	assert.Equal(t, []string{intReply(1)}, roundTripStrings(t, client, 1, respCommand("INCR", "metrics:a")), "the total is learnt again after the flush")
+
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SWAPDB", "2", "5")))
+	assert.Equal(t, []string{intReply(1)}, roundTripStrings(t, client, 1, respCommand("INCR", "metrics:a")), "and after a swap")
+	assert.Equal(t, []string{"INCR metrics:a", "INCRBY metrics:a 1", "FLUSHDB", "INCR metrics:a", "SWAPDB 2 5", "INCR metrics:a"}, c.Received())
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// TooManyDBsError is returned for a database that would be one more than the
+// DBPools can have pools for
+type TooManyDBsError struct {
+	Max int
+}
+
+func (e TooManyDBsError) Error() string {
+	return fmt.Sprintf("at most %d databases can be in use at once", e.Max)
+}
+
+type dbPool struct {
+	server   *pool.Server
+	refs     int
+	lastUsed time.Time
+}
+
+// DBPools are the pools of the databases clients SELECT in dynamic database
+// mode, each created on first use against the same upstream and disconnected
+// once it has been idle for a while. The default database is served by the
+// listener's own pool, and counts towards the maximum.
+type DBPools struct {
+	log     *zap.Logger
+	max     int
+	idle    time.Duration
+	connect func(db int) (*pool.Server, error)
+	now     func() time.Time
+
+	mu    sync.Mutex
+	pools map[int]*dbPool
+}
+
+func NewDBPools(log *zap.Logger, max int, idle time.Duration, connect func(db int) (*pool.Server, error)) *DBPools {
+	return &DBPools{log: log, max: max, idle: idle, connect: connect, now: time.Now, pools: make(map[int]*dbPool)}
+}
+
+// Acquire returns the pool of a database, creating it if it has none, and the
+// function to call once done with it, until which it isn't reaped
+func (d *DBPools) Acquire(db int) (*pool.Server, func(), error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.pools[db]
+	if !ok {
+		if len(d.pools)+1 >= d.max {
+			return nil, nil, TooManyDBsError{Max: d.max}
+		}
+		server, err := d.connect(db)
+		if err != nil {
+			return nil, nil, err
+		}
+		p = &dbPool{server: server}
+		d.pools[db] = p
+		d.log.Info("Created database pool", zap.Int("db", db))
+	}
+	p.refs++
+	var once sync.Once
+	return p.server, func() {
+		once.Do(func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			p.refs--
+			p.lastUsed = d.now()
+		})
+	}, nil
+}
+
+// Has is whether a database has a pool, or could get one without going over the
+// maximum
+func (d *DBPools) Has(db int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.pools[db]
+	return ok || len(d.pools)+1 < d.max
+}
+
+// Reap disconnects the pools that have been idle for longer than the idle
+// timeout
+func (d *DBPools) Reap(ctx context.Context) {
+	d.mu.Lock()
+	var reaped []*pool.Server
+	for db, p := range d.pools {
+		if p.refs == 0 && d.now().Sub(p.lastUsed) > d.idle {
+			delete(d.pools, db)
+			reaped = append(reaped, p.server)
+			d.log.Info("Reaped idle database pool", zap.Int("db", db))
+		}
+	}
+	d.mu.Unlock()
+	for _, s := range reaped {
+		_ = s.Disconnect(ctx)
+	}
+}
+
+// DBs returns the databases that have a pool, in order
+func (d *DBPools) DBs() []int {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dbs := make([]int, 0, len(d.pools))
+	for db := range d.pools {
+		dbs = append(dbs, db)
+	}
+	sort.Ints(dbs)
+	return dbs
+}
+
+// Close disconnects every pool
+func (d *DBPools) Close(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	pools := d.pools
+	d.pools = make(map[int]*dbPool)
+	d.mu.Unlock()
+	for _, p := range pools {
+		_ = p.server.Disconnect(ctx)
+	}
+}
+
+// Report emits how many databases have a pool of their own
+func (d *DBPools) Report(sd *statsd.Client) {
+	metrics.DBPools.Set(sd, float64(len(d.DBs())))
+}
+
+// selectDB answers SELECT in dynamic database mode by moving the client to the
+// database, whose pool its next commands are sent to. The database is checked
+// with the upstream first, on a connection of the default pool that is moved
+// back right after, so that a database the server doesn't have gets the
+// server's own error.
+func (c *connection) selectDB(args []*redis.Message) *redis.Message {
+	if len(args) != 1 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'select' command")
+	}
+	db, err := strconv.Atoi(string(args[0].Value))
+	if err != nil {
+		return redis.NewErrorf("ERR value is not an integer or out of range")
+	}
+	if db == c.db {
+		return redis.NewString([]byte("OK"))
+	}
+	if db != c.opts.Database && !c.opts.DBPools.Has(db) {
+		return c.proxyError(proxyerr.Overloaded, "%v", TooManyDBsError{Max: c.opts.DBPools.max})
+	}
+	res, err := Exchange(c.ctx, c.log, c.server, []*redis.Message{
+		redis.NewArray(bulks("SELECT", strconv.Itoa(db))),
+		redis.NewArray(bulks("SELECT", strconv.Itoa(c.opts.Database))),
+	}, c.readTimeout, c.writeTimeout)
+	if err != nil {
+		return c.proxyError(proxyerr.Overloaded, "checking database %d: %v", db, err)
+	}
+	if res[0].IsError() {
+		return res[0]
+	}
+	c.db = db
+	if c.trace != nil {
+		c.trace.add("db", "selected "+strconv.Itoa(db))
+	}
+	return res[0]
+}
+
+// dbServer returns the pool of a database other than the default, and the
+// function to call once done with it
+func (c *connection) dbServer(db int) (*pool.Server, func(), error) {
+	s, release, err := c.opts.DBPools.Acquire(db)
+	if err != nil {
+		if _, ok := err.(TooManyDBsError); ok {
+			return nil, nil, c.failFast(err.Error())
+		}
+		return nil, nil, err
+	}
+	return s, release, nil
+}
+
+// bulks makes the arguments of a command
+func bulks(args ...string) []*redis.Message {
+	mm := make([]*redis.Message, len(args))
+	for i, a := range args {
+		mm[i] = redis.NewBulkBytes([]byte(a))
+	}
+	return mm
+}
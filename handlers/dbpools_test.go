@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDBPoolsReap(t *testing.T) {
+	connects := 0
+	d := NewDBPools(zap.NewNop(), 3, time.Minute, func(db int) (*pool.Server, error) {
+		connects++
+		if db == 13 {
+			return nil, errors.New("unreachable")
+		}
+		return pool.ConnectServer(pool.Address("127.0.0.1:1"))
+	})
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	_, release, err := d.Acquire(1)
+	assert.NoError(t, err)
+	_, _, err = d.Acquire(13)
+	assert.EqualError(t, err, "unreachable")
+	_, release2, err := d.Acquire(2)
+	assert.NoError(t, err)
+	_, _, err = d.Acquire(3)
+	assert.Equal(t, TooManyDBsError{Max: 3}, err, "the default database counts towards the maximum")
+	assert.True(t, d.Has(1))
+	assert.False(t, d.Has(3))
+	assert.Equal(t, []int{1, 2}, d.DBs())
+
+	release()
+	release()
+	now = now.Add(2 * time.Minute)
+	d.Reap(context.Background())
+	assert.Equal(t, []int{2}, d.DBs(), "a pool in use is never reaped")
+
+	release2()
+	d.Reap(context.Background())
+	assert.Equal(t, []int{2}, d.DBs(), "a pool is reaped once idle for the idle timeout")
+	now = now.Add(2 * time.Minute)
+	d.Reap(context.Background())
+	assert.Empty(t, d.DBs())
+
+	_, _, err = d.Acquire(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, connects, "a reaped database gets a new pool")
+	d.Close(context.Background())
+	assert.Empty(t, d.DBs())
+}
+
+func TestDynamicDatabases(t *testing.T) {
+	// the default pool's upstream checks SELECTs the way a server with 16
+	// databases would, and the other databases' answer with their number
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if strings.ToUpper(args[0]) == "SELECT" {
+			if db, _ := strconv.Atoi(args[1]); db > 15 {
+				return redis.NewErrorf("ERR DB index is out of range")
+			}
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	dbUpstreams := make(map[int]*fakeUpstream)
+	defer func() {
+		for _, u := range dbUpstreams {
+			u.Close()
+		}
+	}()
+	dbs := NewDBPools(zap.NewNop(), 3, time.Minute, func(db int) (*pool.Server, error) {
+		u := newFakeUpstream(t, func(args []string) *redis.Message {
+			if len(args) < 2 {
+				return echoKey(args)
+			}
+			return redis.NewBulkBytes([]byte(args[1] + "-db" + strconv.Itoa(db)))
+		})
+		dbUpstreams[db] = u
+		return newTestServer(t, u.Address(), 2), nil
+	})
+	defer dbs.Close(context.Background())
+
+	client := runTestConnection(t, upstream.Address(), Options{DBPools: dbs})
+	defer func() { _ = client.Close() }()
+	assert.Equal(t, []string{
+		"$7 \\r\\n a-value \\r\\n ",
+		"+OK \\r\\n ",
+		"$5 \\r\\n a-db3 \\r\\n ",
+		"+OK \\r\\n ",
+		"$7 \\r\\n b-value \\r\\n ",
+	}, roundTripStrings(t, client, 5, respCommand("GET", "a"), respCommand("SELECT", "3"), respCommand("GET", "a"), respCommand("SELECT", "0"), respCommand("GET", "b")))
+	assert.Equal(t, []int{3}, dbs.DBs())
+
+	assert.Equal(t, []string{
+		"-ERR DB index is out of range \\r\\n ",
+		"$7 \\r\\n c-value \\r\\n ",
+	}, roundTripStrings(t, client, 2, respCommand("SELECT", "16"), respCommand("GET", "c")), "the server's error, on the database selected before")
+
+	assert.Equal(t, []string{"+OK \\r\\n ", "$5 \\r\\n d-db4 \\r\\n "}, roundTripStrings(t, client, 2, respCommand("SELECT", "4"), respCommand("GET", "d")))
+	assert.Equal(t, []string{"-PROXYOVERLOADED at most 3 databases can be in use at once \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SELECT", "5")))
+	assert.Equal(t, []int{3, 4}, dbs.DBs())
+
+	blocked := "-PROXYBLOCKED SELECT is not allowed inside a transaction in dynamic database mode, select the database before MULTI \\r\\n "
+	assert.Equal(t, []string{"$-1 \\r\\n ", blocked, blocked, blocked, "$-1 \\r\\n "}, roundTripStrings(t, client, 5,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("MULTI"),
+		respCommand("SELECT", "3"),
+		respCommand("EXEC"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	))
+
+	// the databases one socket serves are still shared with every client
+	rejected := "-PROXYBLOCKED SWAPDB would swap databases under every client sharing the upstream through the proxy's pool. Start the proxy with -allowswapdb to allow it \\r\\n "
+	assert.Equal(t, []string{rejected, "$5 \\r\\n e-db4 \\r\\n "}, roundTripStrings(t, client, 2, respCommand("SWAPDB", "3", "4"), respCommand("GET", "e")))
+}
+
+func TestSelectRejectedOutsideDynamicMode(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = client.Close() }()
+	assert.Equal(t, []string{"-PROXYBLOCKED SELECT is unsupported \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SELECT", "3")))
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"sync/atomic"
+
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// Activity counts what the client connections of a listener are doing, so
+// that a drain can report what it is still waiting for. Transactions are
+// forwarded whole, and subscriptions and blocking commands are unsupported, so
+// the only connections that can't drain as soon as they are idle are those
+// pinned by a pipeline their client is still sending.
+type Activity struct {
+	clients, requests, pipelines int64
+}
+
+// ActivityStats describe a listener's Activity for the drain report
+type ActivityStats struct {
+	Clients  int64            `json:"clients"`
+	InFlight int64            `json:"in_flight"`
+	Pinned   map[string]int64 `json:"pinned"`
+}
+
+// Stats returns the counts of the activity, which are all zero once every
+// connection has drained
+func (a *Activity) Stats() ActivityStats {
+	if a == nil {
+		return ActivityStats{Pinned: map[string]int64{}}
+	}
+	return ActivityStats{
+		Clients:  atomic.LoadInt64(&a.clients),
+		InFlight: atomic.LoadInt64(&a.requests),
+		Pinned:   map[string]int64{"pipeline": atomic.LoadInt64(&a.pipelines)},
+	}
+}
+
+// pipelineRead records whether the client is in the middle of sending a
+// pipeline, as a signal is read after read messages of the request
+func (c *connection) pipelineRead(open bool, read int) {
+	var v int32
+	if open {
+		v = 1
+		c.signaled = true
+	}
+	was := atomic.SwapInt32(&c.pipelineOpen, v)
+	c.signalRead(open, was == 1, read)
+	if was == v || c.opts.Activity == nil {
+		return
+	}
+	if open {
+		atomic.AddInt64(&c.opts.Activity.pipelines, 1)
+	} else {
+		atomic.AddInt64(&c.opts.Activity.pipelines, -1)
+	}
+}
+
+// pipelineEnded releases the pipeline the client was in the middle of sending
+// as its connection ends, if any
+func (c *connection) pipelineEnded() {
+	if atomic.SwapInt32(&c.pipelineOpen, 0) == 0 {
+		return
+	}
+	c.signalAbandoned()
+	if c.opts.Activity != nil {
+		atomic.AddInt64(&c.opts.Activity.pipelines, -1)
+	}
+}
+
+// drained is whether the proxy has started draining. It is checked as each
+// message is read, rather than readCtx, which is cancelled a moment later.
+func (c *connection) drained() bool {
+	select {
+	case <-c.opts.Draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// cutByDrain is whether a drain interrupted the pipeline the client was sending,
+// which only happens with DrainNotify: otherwise it is read to its end
+func (c *connection) cutByDrain() bool {
+	return c.opts.DrainNotify && c.readCtx.Err() != nil && atomic.LoadInt32(&c.pipelineOpen) == 1
+}
+
+// notifyDrain answers a client whose pipeline was interrupted by a drain with
+// PROXYMAINT, after the replies of the commands it sent before the drain, so
+// that it retries the rest elsewhere rather than waiting for replies
+func (c *connection) notifyDrain(l *zap.Logger) {
+	if !c.cutByDrain() {
+		return
+	}
+	mm := []*redis.Message{c.proxyError(proxyerr.Maintenance, "shutting down")}
+	_ = WriteWireMessages(c.ctx, l, mm, c.conn, c.address, c.id, 0, false, c.conn.Close)
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// proxyError is an error the proxy answers a command with itself, prefixed with
+// its code unless the connection's clients only understand ERR
+func (c *connection) proxyError(code proxyerr.Code, format string, args ...interface{}) *redis.Message {
+	metrics.ProxyErrors.Incr(c.statsd, string(code))
+	return redis.NewError([]byte(proxyerr.Format(code, c.opts.PlainErrors, fmt.Sprintf(format, args...))))
+}
+
+// forwardErrorCode returns the code of a forwarding error that clients should be
+// answered with rather than disconnected for
+func forwardErrorCode(err error) (proxyerr.Code, bool) {
+	var ffe FailFastError
+	if errors.As(err, &ffe) {
+		return proxyerr.Overloaded, true
+	}
+	var ie IdentityError
+	if errors.As(err, &ie) {
+		return proxyerr.Blocked, true
+	}
+	if isTimeout(err) {
+		return proxyerr.Timeout, true
+	}
+	var rbe RetryBudgetError
+	if errors.As(err, &rbe) {
+		return proxyerr.Overloaded, true
+	}
+	return "", false
+}
+
+func isTimeout(err error) bool {
+	// pool.ConnectionError doesn't unwrap
+	var ce pool.ConnectionError
+	if errors.As(err, &ce) {
+		err = ce.Wrapped
+	}
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// WriteError is a failure to write a request to an upstream connection, which
+// is closed. Written is the number of bytes of the request's Size that the
+// connection took before it failed: with none, the request never reached the
+// upstream, and can be sent again whatever it does, while otherwise any of its
+// commands may have run.
+type WriteError struct {
+	Address string
+	ID      uint64
+	Written int
+	Size    int
+	Wrapped error
+}
+
+func (e WriteError) Error() string {
+	delivery := "not delivered"
+	if e.MaybeDelivered() {
+		delivery = "possibly delivered"
+	}
+	return fmt.Sprintf("connection(%s[%d]) failed to write request, %s (%d of %d bytes written): %v", e.Address, e.ID, delivery, e.Written, e.Size, e.Wrapped)
+}
+
+func (e WriteError) Unwrap() error {
+	return e.Wrapped
+}
+
+// MaybeDelivered is whether any of the request reached the upstream
+func (e WriteError) MaybeDelivered() bool {
+	return e.Written > 0
+}
+
+// IdempotentWriteCommands are the writes that leave the data and their reply as
+// they were if they run again, which a request that may have reached the
+// upstream can be sent again with. SET is only so without its NX and XX
+// options, and without GET, which makes it one of the ReadWriteCommands.
+var IdempotentWriteCommands = map[string]bool{
+	"EXPIREAT":  true,
+	"HMSET":     true,
+	"LSET":      true,
+	"MSET":      true,
+	"PEXPIREAT": true,
+	"SET":       true,
+}
+
+// idempotent is whether every command of a request can run twice, the reads
+// a copy answers the same and IdempotentWriteCommands
+func idempotent(wm []*redis.Message) bool {
+	for _, m := range wm {
+		if !m.IsArray() || len(m.Array) == 0 {
+			return false
+		}
+		cmd := strings.ToUpper(string(m.Array[0].Value))
+		if FallbackReadCommands[cmd] || cmd == "PING" {
+			continue
+		}
+		if !IdempotentWriteCommands[cmd] || readWrite(cmd, m) {
+			return false
+		}
+		if cmd == "SET" && len(m.Array) > 3 {
+			for _, a := range m.Array[3:] {
+				switch strings.ToUpper(string(a.Value)) {
+				case "NX", "XX":
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestProxyErrorCodes(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if len(args) > 1 && args[1] == "slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+
+	serve := func(opts Options) net.Conn {
+		s := newTestServer(t, upstream.Address(), 1)
+		sd, err := statsd.New("localhost:8125")
+		assert.NoError(t, err)
+		client, server := net.Pipe()
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		go func() {
+			CommandConnection(zap.NewNop(), sd, server, "test", 100*time.Millisecond, time.Second, 1, s, make(chan interface{}), func([]string, []*redis.Message) {}, opts)
+			_ = server.Close()
+			_ = s.Disconnect(context.Background())
+		}()
+		return client
+	}
+
+	client := serve(Options{})
+	defer func() { _ = client.Close() }()
+	assert.Equal(t, []string{"-PROXYBLOCKED SUBSCRIBE is unsupported \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SUBSCRIBE", "c")))
+
+	res := roundTripStrings(t, client, 1, respCommand("GET", "slow"))
+	assert.True(t, strings.HasPrefix(res[0], "-PROXYTIMEOUT "), res[0])
+	// the late reply to the timed out command is never read as the reply to the next
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+
+	plain := serve(Options{PlainErrors: true})
+	defer func() { _ = plain.Close() }()
+	assert.Equal(t, []string{"-ERR redisbetween: SUBSCRIBE is unsupported \\r\\n "}, roundTripStrings(t, plain, 1, respCommand("SUBSCRIBE", "c")))
+	res = roundTripStrings(t, plain, 1, respCommand("GET", "slow"))
+	assert.True(t, strings.HasPrefix(res[0], "-ERR redisbetween: "), res[0])
+}
+
+func TestForwardErrorCode(t *testing.T) {
+	code, ok := forwardErrorCode(FailFastError{Node: "n", Reason: "circuit open"})
+	assert.True(t, ok)
+	assert.Equal(t, "PROXYOVERLOADED", string(code))
+	code, ok = forwardErrorCode(RetryBudgetError{Wrapped: context.DeadlineExceeded})
+	assert.True(t, ok)
+	assert.Equal(t, "PROXYTIMEOUT", string(code))
+	code, ok = forwardErrorCode(RetryBudgetError{Wrapped: assert.AnError})
+	assert.True(t, ok)
+	assert.Equal(t, "PROXYOVERLOADED", string(code))
+	_, ok = forwardErrorCode(assert.AnError)
+	assert.False(t, ok, "other errors close the client connection")
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+)
+
+// FairQueue hands the connections of a pool of Size to the requests waiting for
+// one in the order they started waiting, rather than to whichever goroutine
+// wakes first. With Hold, a client connection holds at most Hold connections at
+// once, so that one fanning split commands out can't keep the whole pool to
+// itself: its requests over the cap wait, and are passed over by requests of
+// other clients until one of its connections is given back.
+type FairQueue struct {
+	size, hold int
+
+	mu      sync.Mutex
+	inUse   int
+	held    map[uint64]int
+	waiters []*fairWaiter
+	// maxWait is the longest wait since the last Report, and maxWaitEver since
+	// the queue was made
+	maxWait, maxWaitEver time.Duration
+}
+
+type fairWaiter struct {
+	client uint64
+	since  time.Time
+	ready  chan struct{}
+}
+
+// FairQueueStats describe a FairQueue for the admin stats. Holds are the
+// connections held by each client connection holding any, by its ID.
+type FairQueueStats struct {
+	Size         int            `json:"size"`
+	Hold         int            `json:"hold"`
+	InUse        int            `json:"in_use"`
+	Waiting      int            `json:"waiting"`
+	OldestWaitMs float64        `json:"oldest_wait_ms"`
+	MaxWaitMs    float64        `json:"max_wait_ms"`
+	Holds        map[string]int `json:"holds"`
+}
+
+// NewFairQueue makes a queue for a pool of size connections, with a cap of hold
+// per client connection, or none if hold is 0
+func NewFairQueue(size, hold int) *FairQueue {
+	return &FairQueue{size: size, hold: hold, held: make(map[uint64]int)}
+}
+
+// eligible is whether a client may take one more connection. It must be called
+// with mu held.
+func (q *FairQueue) eligible(client uint64) bool {
+	return q.inUse < q.size && (q.hold <= 0 || q.held[client] < q.hold)
+}
+
+// acquire takes a turn for a request of client, waiting behind the requests
+// that started waiting before it, and returns the function that gives it back
+// and how long it waited
+func (q *FairQueue) acquire(ctx context.Context, client uint64) (func(), time.Duration, error) {
+	q.mu.Lock()
+	// whenever a turn is free, the requests still waiting are all of clients at
+	// their cap, so taking it passes over nobody who could have had it
+	if q.eligible(client) {
+		q.take(client)
+		q.mu.Unlock()
+		return q.releaser(client), 0, nil
+	}
+	w := &fairWaiter{client: client, since: time.Now(), ready: make(chan struct{})}
+	q.waiters = append(q.waiters, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return q.releaser(client), time.Since(w.since), nil
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	for i, other := range q.waiters {
+		if other == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			q.mu.Unlock()
+			return nil, time.Since(w.since), ctx.Err()
+		}
+	}
+	q.mu.Unlock()
+	// handed a turn as the context ended
+	q.releaser(client)()
+	return nil, time.Since(w.since), ctx.Err()
+}
+
+// take counts a turn for client. It must be called with mu held.
+func (q *FairQueue) take(client uint64) {
+	q.inUse++
+	q.held[client]++
+}
+
+func (q *FairQueue) releaser(client uint64) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.inUse--
+			if q.held[client]--; q.held[client] == 0 {
+				delete(q.held, client)
+			}
+			q.dispatch()
+		})
+	}
+}
+
+// dispatch hands the free turns to the first waiters whose clients are under
+// their cap. It must be called with mu held.
+func (q *FairQueue) dispatch() {
+	for i := 0; i < len(q.waiters) && q.inUse < q.size; {
+		w := q.waiters[i]
+		if !q.eligible(w.client) {
+			i++
+			continue
+		}
+		q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+		q.take(w.client)
+		if waited := time.Since(w.since); waited > q.maxWait {
+			q.maxWait = waited
+			if waited > q.maxWaitEver {
+				q.maxWaitEver = waited
+			}
+		}
+		close(w.ready)
+	}
+}
+
+// Stats returns the occupancy of the queue and the longest wait so far
+func (q *FairQueue) Stats() *FairQueueStats {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := &FairQueueStats{
+		Size:      q.size,
+		Hold:      q.hold,
+		InUse:     q.inUse,
+		Waiting:   len(q.waiters),
+		MaxWaitMs: float64(q.maxWaitEver) / float64(time.Millisecond),
+		Holds:     make(map[string]int, len(q.held)),
+	}
+	if len(q.waiters) > 0 {
+		s.OldestWaitMs = float64(time.Since(q.waiters[0].since)) / float64(time.Millisecond)
+	}
+	for client, n := range q.held {
+		s.Holds[strconv.FormatUint(client, 10)] = n
+	}
+	return s
+}
+
+// Report emits the longest wait since the last report, counting the requests
+// still waiting, and the most connections held by one client connection
+func (q *FairQueue) Report(sd *statsd.Client) {
+	q.mu.Lock()
+	longest := q.maxWait
+	if len(q.waiters) > 0 {
+		if oldest := time.Since(q.waiters[0].since); oldest > longest {
+			longest = oldest
+		}
+	}
+	q.maxWait = 0
+	most := 0
+	for _, n := range q.held {
+		if n > most {
+			most = n
+		}
+	}
+	q.mu.Unlock()
+	metrics.FairQueueMaxWait.Set(sd, float64(longest)/float64(time.Millisecond))
+	metrics.FairQueueMaxHeld.Set(sd, float64(most))
+}
+
+// acquireFairTurn waits for the connection's turn to check out a connection,
+// the returned function giving it back
+func (c *connection) acquireFairTurn() (func(), error) {
+	release, waited, err := c.opts.FairQueue.acquire(c.ctx, c.id)
+	metrics.FairQueueWait.Record(c.statsd, waited, strconv.FormatBool(err == nil))
+	if c.trace != nil && waited > 0 {
+		c.trace.add("fair queue", "waited "+waited.String())
+	}
+	return release, err
+}
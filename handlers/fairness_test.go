@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFairQueueOrder(t *testing.T) {
+	q := NewFairQueue(1, 0)
+	release, _, err := q.acquire(context.Background(), 1)
+	assert.NoError(t, err)
+
+	var order []uint64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for client := uint64(2); client <= 6; client++ {
+		wg.Add(1)
+		go func(client uint64) {
+			defer wg.Done()
+			r, _, err := q.acquire(context.Background(), client)
+			assert.NoError(t, err)
+			mu.Lock()
+			order = append(order, client)
+			mu.Unlock()
+			r()
+		}(client)
+		// each waits before the next
+		assert.Eventually(t, func() bool { return q.Stats().Waiting == int(client-1) }, time.Second, time.Millisecond)
+	}
+	release()
+	wg.Wait()
+	assert.Equal(t, []uint64{2, 3, 4, 5, 6}, order, "turns are handed out in the order they were waited for")
+	assert.Greater(t, q.Stats().MaxWaitMs, float64(0))
+}
+
+func TestFairQueueHold(t *testing.T) {
+	q := NewFairQueue(3, 2)
+	first, _, _ := q.acquire(context.Background(), 1)
+	_, _, _ = q.acquire(context.Background(), 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, _, err := q.acquire(ctx, 1)
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err, "a client at its cap waits, though the pool has a connection free")
+
+	over := make(chan struct{})
+	go func() {
+		r, _, _ := q.acquire(context.Background(), 1)
+		close(over)
+		r()
+	}()
+	assert.Eventually(t, func() bool { return q.Stats().Waiting == 1 }, time.Second, time.Millisecond)
+	_, waited, err := q.acquire(context.Background(), 2)
+	assert.NoError(t, err)
+	assert.Zero(t, waited, "a client under its cap passes over one at it")
+	s := q.Stats()
+	assert.Equal(t, map[string]int{"1": 2, "2": 1}, s.Holds)
+	assert.Equal(t, 3, s.InUse)
+
+	first()
+	<-over
+	assert.Equal(t, 0, q.Stats().Waiting)
+}
+
+func TestFairQueueContention(t *testing.T) {
+	q := NewFairQueue(2, 1)
+	const work = 2 * time.Millisecond
+	stop := make(chan struct{})
+	var aggressive sync.WaitGroup
+	var held, maxHeld int64
+	// one client fans out over 16 goroutines, as a split command would
+	for i := 0; i < 16; i++ {
+		aggressive.Add(1)
+		go func() {
+			defer aggressive.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				release, _, err := q.acquire(context.Background(), 1)
+				assert.NoError(t, err)
+				if n := atomic.AddInt64(&held, 1); n > atomic.LoadInt64(&maxHeld) {
+					atomic.StoreInt64(&maxHeld, n)
+				}
+				time.Sleep(work)
+				atomic.AddInt64(&held, -1)
+				release()
+			}
+		}()
+	}
+
+	var mu sync.Mutex
+	var waits []time.Duration
+	var light sync.WaitGroup
+	for client := uint64(2); client < 12; client++ {
+		light.Add(1)
+		go func(client uint64) {
+			defer light.Done()
+			for i := 0; i < 20; i++ {
+				start := time.Now()
+				release, _, err := q.acquire(context.Background(), client)
+				assert.NoError(t, err)
+				mu.Lock()
+				waits = append(waits, time.Since(start))
+				mu.Unlock()
+				time.Sleep(work)
+				release()
+				time.Sleep(time.Millisecond)
+			}
+		}(client)
+	}
+	light.Wait()
+	close(stop)
+	aggressive.Wait()
+
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	p99 := waits[len(waits)*99/100]
+	// at worst every light client and the aggressive one are ahead, two at a time
+	assert.Less(t, int64(p99), int64(50*time.Millisecond), "p99 wait of the light clients")
+	assert.EqualValues(t, 1, atomic.LoadInt64(&maxHeld), "the aggressive client never holds more than its cap")
+}
+
+func TestFairQueueConnection(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	q := NewFairQueue(4, 1)
+	client := runTestConnection(t, upstream.Address(), Options{FairQueue: q})
+	defer func() { _ = client.Close() }()
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+	assert.Equal(t, FairQueueStats{Size: 4, Hold: 1, Holds: map[string]int{}}, *q.Stats(), "a turn is given back with its connection")
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// ReadFallback retries the reads the upstream fails against a secondary
+// upstream, a warm copy of its data, once each. Reads that fail for want of a
+// connection, an open circuit or any other failure to forward them, and nil
+// replies to reads of keys starting with one of NilPrefixes, which would be
+// legitimate answers for other keys, are sent to the secondary, and its reply
+// is served if it has one. Writes never fall back.
+type ReadFallback struct {
+	// Name is the secondary upstream, for traces and logs
+	Name string
+	// Server returns the pool of the secondary, nil until it is listening
+	Server      func() *pool.Server
+	NilPrefixes []string
+}
+
+// FallbackReadCommands are the reads a ReadFallback retries, those of keys that
+// a copy of the data answers the same
+var FallbackReadCommands = map[string]bool{
+	"BITCOUNT":         true,
+	"BITPOS":           true,
+	"EXISTS":           true,
+	"GEODIST":          true,
+	"GEOHASH":          true,
+	"GEOPOS":           true,
+	"GET":              true,
+	"GETBIT":           true,
+	"GETRANGE":         true,
+	"HEXISTS":          true,
+	"HGET":             true,
+	"HGETALL":          true,
+	"HKEYS":            true,
+	"HLEN":             true,
+	"HMGET":            true,
+	"HSTRLEN":          true,
+	"HVALS":            true,
+	"LINDEX":           true,
+	"LLEN":             true,
+	"LRANGE":           true,
+	"MGET":             true,
+	"PTTL":             true,
+	"SCARD":            true,
+	"SISMEMBER":        true,
+	"SMEMBERS":         true,
+	"SMISMEMBER":       true,
+	"STRLEN":           true,
+	"TTL":              true,
+	"TYPE":             true,
+	"XLEN":             true,
+	"XRANGE":           true,
+	"XREVRANGE":        true,
+	"ZCARD":            true,
+	"ZCOUNT":           true,
+	"ZLEXCOUNT":        true,
+	"ZMSCORE":          true,
+	"ZRANGE":           true,
+	"ZRANGEBYLEX":      true,
+	"ZRANGEBYSCORE":    true,
+	"ZRANK":            true,
+	"ZREVRANGE":        true,
+	"ZREVRANGEBYLEX":   true,
+	"ZREVRANGEBYSCORE": true,
+	"ZREVRANK":         true,
+	"ZSCORE":           true,
+}
+
+// nilMiss is whether a reply is a nil the secondary is asked about too
+func (f *ReadFallback) nilMiss(c *connection, cmd string, m, res *redis.Message) bool {
+	if len(f.NilPrefixes) == 0 || !res.IsBulkBytes() || res.Value != nil {
+		return false
+	}
+	key, ok := c.opts.Keys.FirstKey(cmd, m)
+	if !ok {
+		return false
+	}
+	for _, prefix := range f.NilPrefixes {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readFallback retries reads of a run of forwarded commands against the
+// secondary: those from answered on, which the upstream failed with runErr, and
+// the nil replies of keys of NilPrefixes before it. res has a reply for every
+// command, the upstream's error for those it failed, which is kept for a read
+// the secondary fails too.
+func (c *connection) readFallback(cmds []string, wm, res []*redis.Message, answered int, runErr error) {
+	f := c.opts.ReadFallback
+	if f == nil {
+		return
+	}
+	var retried []int
+	for i, cmd := range cmds {
+		if !FallbackReadCommands[cmd] {
+			continue
+		}
+		if (i >= answered && runErr != nil) || (i < answered && f.nilMiss(c, cmd, wm[i], res[i])) {
+			retried = append(retried, i)
+		}
+	}
+	if len(retried) == 0 {
+		return
+	}
+	reason := func(i int) string {
+		if i >= answered {
+			return "error"
+		}
+		return "nil"
+	}
+	failed := func(i int) string {
+		if i >= answered {
+			return "none"
+		}
+		return "primary"
+	}
+
+	var server *pool.Server
+	if f.Server != nil {
+		server = f.Server()
+	}
+	err := fmt.Errorf("read fallback %s isn't listening", f.Name)
+	var fres []*redis.Message
+	if server != nil {
+		sent := make([]*redis.Message, len(retried))
+		for j, i := range retried {
+			sent[j] = wm[i]
+		}
+		ctx, cancel := context.WithTimeout(c.ctx, c.readTimeout+c.writeTimeout)
+		fres, err = Exchange(ctx, c.log, server, sent, c.readTimeout, c.writeTimeout)
+		cancel()
+	}
+	var served int
+	for j, i := range retried {
+		if j >= len(fres) || fres[j].IsError() || (i < answered && fres[j].IsBulkBytes() && fres[j].Value == nil) {
+			metrics.ReadFallbacks.Incr(c.statsd, reason(i), failed(i))
+			continue
+		}
+		res[i] = fres[j]
+		served++
+		metrics.ReadFallbacks.Incr(c.statsd, reason(i), "secondary")
+	}
+	if err != nil {
+		c.log.Debug("Read fallback failed", zap.String("fallback", f.Name), zap.Int("replies_read", len(fres)), zap.Error(err))
+	}
+	if c.trace != nil {
+		t := fmt.Sprintf("%d of %d reads served by %s", served, len(retried), f.Name)
+		if err != nil {
+			t += ", which failed: " + err.Error()
+		}
+		c.trace.add("read-fallback", t)
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// nilGets answers GET with nil and everything else with +OK
+func nilGets(args []string) *redis.Message {
+	if strings.ToUpper(args[0]) == "GET" {
+		return redis.NewBulkBytes(nil)
+	}
+	return redis.NewString([]byte("OK"))
+}
+
+func readFallbackTo(t *testing.T, secondary string, nilPrefixes ...string) *ReadFallback {
+	s := newTestServer(t, secondary, 2)
+	t.Cleanup(func() { _ = s.Disconnect(context.Background()) })
+	return &ReadFallback{Name: secondary, Server: func() *pool.Server { return s }, NilPrefixes: nilPrefixes}
+}
+
+// closingTestConnection is runTestConnection, closing the connection and
+// waiting for it to end when the test does, as it logs to the test until then
+func closingTestConnection(t *testing.T, upstream string, opts Options) net.Conn {
+	s := newTestServer(t, upstream, 2)
+	done := make(chan struct{})
+	client := serveTestConnection(t, s, opts, func() {
+		_ = s.Disconnect(context.Background())
+		close(done)
+	})
+	t.Cleanup(func() {
+		_ = client.Close()
+		<-done
+	})
+	return client
+}
+
+func TestReadFallbackPrimaryDown(t *testing.T) {
+	primary := newFakeUpstream(t, echoKey)
+	primary.Close()
+	secondary := newFakeUpstream(t, echoKey)
+	client := closingTestConnection(t, primary.Address(), Options{ReadFallback: readFallbackTo(t, secondary.Address())})
+
+	replies := roundTripStrings(t, client, 3, respCommand("GET", "a"), respCommand("SET", "b", "x"), respCommand("GET", "c"))
+	assert.Equal(t, "$7 \\r\\n a-value \\r\\n ", replies[0])
+	assert.True(t, strings.HasPrefix(replies[1], "-PROXY"), "writes never fall back: %s", replies[1])
+	assert.Equal(t, "$7 \\r\\n c-value \\r\\n ", replies[2])
+	assert.EqualValues(t, 2, secondary.Commands())
+}
+
+func TestReadFallbackPrimaryNil(t *testing.T) {
+	primary := newFakeUpstream(t, nilGets)
+	secondary := newFakeUpstream(t, echoKey)
+	client := closingTestConnection(t, primary.Address(), Options{ReadFallback: readFallbackTo(t, secondary.Address(), "session:")})
+
+	replies := roundTripStrings(t, client, 2, respCommand("GET", "session:1"), respCommand("GET", "user:1"))
+	assert.Equal(t, "$15 \\r\\n session:1-value \\r\\n ", replies[0], "a miss of a nil prefix is looked up on the secondary")
+	assert.Equal(t, "$-1 \\r\\n ", replies[1], "nil is the answer for other keys")
+	assert.EqualValues(t, 1, secondary.Commands())
+
+	// a nil the secondary has too stays nil
+	both := newFakeUpstream(t, nilGets)
+	client = closingTestConnection(t, primary.Address(), Options{ReadFallback: readFallbackTo(t, both.Address(), "session:")})
+	assert.Equal(t, []string{"$-1 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "session:1")))
+	assert.EqualValues(t, 1, both.Commands())
+}
+
+func TestReadFallbackBothDown(t *testing.T) {
+	primary := newFakeUpstream(t, echoKey)
+	primary.Close()
+	primaryError := func(replies []string) {
+		assert.Len(t, replies, 1)
+		assert.True(t, strings.HasPrefix(replies[0], "-PROXYUNAVAILABLE"), "the primary's error is kept: %s", replies[0])
+		assert.Contains(t, replies[0], primary.Address())
+	}
+
+	secondary := newFakeUpstream(t, echoKey)
+	secondary.Close()
+	client := closingTestConnection(t, primary.Address(), Options{ReadFallback: readFallbackTo(t, secondary.Address())})
+	primaryError(roundTripStrings(t, client, 1, respCommand("GET", "a")))
+
+	// and so it is for a secondary not listening yet, or answering with an error
+	client = closingTestConnection(t, primary.Address(), Options{ReadFallback: &ReadFallback{Name: "secondary", Server: func() *pool.Server { return nil }}})
+	primaryError(roundTripStrings(t, client, 1, respCommand("GET", "a")))
+	failing := newFakeUpstream(t, func([]string) *redis.Message {
+		return redis.NewErrorf("LOADING Redis is loading the dataset in memory")
+	})
+	client = closingTestConnection(t, primary.Address(), Options{ReadFallback: readFallbackTo(t, failing.Address())})
+	primaryError(roundTripStrings(t, client, 1, respCommand("GET", "a")))
+	assert.EqualValues(t, 1, failing.Commands())
+}
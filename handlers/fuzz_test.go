@@ -0,0 +1,280 @@
+//go:build go1.18
+// +build go1.18
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fuzzUpstream is the fake upstream of the handler fuzz targets, whose replies
+// follow its mode: echoKey, an error for every command, or closing the
+// connection on every EXEC and SET. Whatever the mode, it closes the connection
+// on a request that isn't an array, which the proxy forwards as it is.
+type fuzzUpstream struct {
+	*fakeUpstream
+	mode int32
+}
+
+func newFuzzUpstream(f *testing.F) *fuzzUpstream {
+	u := &fuzzUpstream{}
+	u.fakeUpstream = newFakeUpstream(f, func(args []string) *redis.Message {
+		if len(args) == 0 {
+			return nil
+		}
+		switch atomic.LoadInt32(&u.mode) {
+		case 1:
+			return redis.NewErrorf("ERR %s failed", args[0])
+		case 2:
+			if cmd := strings.ToUpper(args[0]); cmd == "EXEC" || cmd == "SET" {
+				return nil
+			}
+		}
+		return echoKey(args)
+	})
+	f.Cleanup(u.Close)
+	return u
+}
+
+// fuzzConnection serves one client connection over loopback TCP against the
+// upstream, so that the client can close its side for writing. It returns the
+// client side, and a channel closed once the handler has returned and the
+// pool has been disconnected, failing the test if the handler panicked or the
+// pool counted below zero.
+func fuzzConnection(t *testing.T, sd *statsd.Client, upstream string, opts Options) (*net.TCPConn, chan struct{}) {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = li.Close() }()
+	client, err := net.Dial("tcp", li.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := li.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := &poolCounts{}
+	s, err := pool.ConnectServer(pool.Address(upstream),
+		pool.WithMaxConnections(func(uint64) uint64 { return 2 }),
+		pool.WithConnectionPoolMonitor(func(*pool.Monitor) *pool.Monitor { return counts.monitor() }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	core, logs := observer.New(zapcore.ErrorLevel)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		CommandConnection(zap.New(core), sd, server, "test", time.Second, time.Second, 1, s, make(chan interface{}), func([]string, []*redis.Message) {}, opts)
+		_ = server.Close()
+		checkedOut := atomic.LoadInt64(&counts.checkedOut)
+		_ = s.Disconnect(context.Background())
+		for _, e := range logs.FilterMessage("Connection crashed").All() {
+			t.Errorf("handler panicked: %v", e.ContextMap())
+		}
+		if checkedOut != 0 {
+			t.Errorf("%d connections still checked out once the client is gone", checkedOut)
+		}
+		if atomic.LoadInt64(&counts.negative) != 0 {
+			t.Error("pool counts went below zero")
+		}
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client.(*net.TCPConn), done
+}
+
+// readReplies decodes the replies of client until it is closed, failing the
+// test on a reply that isn't RESP
+func readReplies(t *testing.T, client net.Conn) []*redis.Message {
+	var replies []*redis.Message
+	d := redis.NewDecoder(client)
+	for {
+		m, err := d.DecodeFrame()
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) && !isReset(err) {
+				t.Fatalf("reading replies: %v", err)
+			}
+			return replies
+		}
+		replies = append(replies, m)
+	}
+}
+
+// isReset is whether err is the client's connection reset by a handler that
+// closed it, after a QUIT or a protocol error, with bytes left unread
+func isReset(err error) bool {
+	var ne *net.OpError
+	return errors.As(err, &ne) && strings.Contains(ne.Err.Error(), "connection reset")
+}
+
+// FuzzClientBytes sends arbitrary bytes as a client: the handler must neither
+// panic nor hang, must answer with well formed replies, and must give back every
+// pooled connection it checked out once the client is gone
+func FuzzClientBytes(f *testing.F) {
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	for _, seed := range []string{
+		respCommand("GET", "a"),
+		respCommand("SET", "a", "1") + respCommand("GET", "a"),
+		start + respCommand("GET", "a") + respCommand("SUBSCRIBE", "news") + respCommand("INCR", "a") + end,
+		respCommand("MULTI") + respCommand("SET", "a", "1") + respCommand("EXEC"),
+		respCommand("PROXY", "ATOMIC", "START") + respCommand("SET", "a", "1") + respCommand("PROXY", "ATOMIC", "END"),
+		respCommand("HELLO", "3") + respCommand("GET", "a"),
+		respCommand("CLIENT", "SETINFO", "lib-name", "go-redis") + respCommand("QUIT"),
+		respCommand("GET", "a") + "*1\r\n$3\r\nGE",
+		respCommand("GET", "a") + "*2\r\n$3\r\nGET\r\n$1000000\r\nx",
+		"PING\r\n",
+		start + respCommand("GET", "a"),
+	} {
+		f.Add([]byte(seed), uint8(0))
+	}
+	sd, err := statsd.New("localhost:8125")
+	if err != nil {
+		f.Fatal(err)
+	}
+	upstream := newFuzzUpstream(f)
+	f.Fuzz(func(t *testing.T, data []byte, mode uint8) {
+		atomic.StoreInt32(&upstream.mode, int32(mode%3))
+		client, done := fuzzConnection(t, sd, upstream.Address(), Options{})
+		defer func() { _ = client.Close() }()
+		go func() {
+			_, _ = client.Write(data)
+			_ = client.CloseWrite()
+		}()
+		readReplies(t, client)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the handler didn't return once the client was gone")
+		}
+	})
+}
+
+// fuzzOps are the commands FuzzCommandSequence picks from, valid each on its own
+// but adversarial together. The pipeline signals open and close a pipeline,
+// within which QUIT is left out, and QUIT anywhere else ends the sequence.
+var fuzzOps = [][]string{
+	{"GET", "a"},
+	{"SET", "a", "1"},
+	{"MULTI"},
+	{"EXEC"},
+	{"DISCARD"},
+	{"WATCH", "a"},
+	{"UNWATCH"},
+	{"SUBSCRIBE", "news"},
+	{"PING"},
+	{"PROXY", "PING"},
+	{"PROXY", "ATOMIC", "START"},
+	{"PROXY", "ATOMIC", "END"},
+	{"SELECT", "0"},
+	{"CLIENT", "SETNAME", "fuzz"},
+	{"INCR", "a"},
+	{"MGET", "a", "b"},
+	{"GET", string(PipelineSignalStartKey)},
+	{"GET", string(PipelineSignalEndKey)},
+	{"QUIT"},
+}
+
+// FuzzCommandSequence drives the handler with sequences of commands, each byte
+// of ops picking one, against an upstream that echoes, fails or disconnects
+// depending on mode. Every command gets exactly one reply, which a last PROXY
+// PING, answered after all of them, checks, and the pool is left as it was.
+func FuzzCommandSequence(f *testing.F) {
+	f.Add([]byte{0, 1, 0}, uint8(0))
+	f.Add([]byte{16, 0, 7, 14, 2, 1, 7, 3, 0, 17}, uint8(0))
+	f.Add([]byte{2, 1, 3, 5, 2, 1, 4}, uint8(1))
+	f.Add([]byte{10, 1, 11, 16, 10, 0, 11, 17}, uint8(2))
+	f.Add([]byte{16, 2, 1, 17, 3, 18, 0}, uint8(0))
+	sd, err := statsd.New("localhost:8125")
+	if err != nil {
+		f.Fatal(err)
+	}
+	upstream := newFuzzUpstream(f)
+	f.Fuzz(func(t *testing.T, ops []byte, mode uint8) {
+		if len(ops) > 64 {
+			ops = ops[:64]
+		}
+		atomic.StoreInt32(&upstream.mode, int32(mode%3))
+		var b strings.Builder
+		var pipeline []string
+		sent, quit, open := 0, false, false
+		// like the ruby client, only pipelines of more than one command are sent
+		// between signals, which get a reply each
+		flush := func() {
+			if len(pipeline) > 1 {
+				b.WriteString(respCommand("GET", string(PipelineSignalStartKey)))
+				sent++
+				defer func() {
+					b.WriteString(respCommand("GET", string(PipelineSignalEndKey)))
+					sent++
+				}()
+			}
+			for _, cmd := range pipeline {
+				b.WriteString(cmd)
+				sent++
+			}
+			pipeline = nil
+		}
+		for _, op := range ops {
+			args := fuzzOps[int(op)%len(fuzzOps)]
+			switch {
+			case args[0] == "GET" && args[1] == string(PipelineSignalStartKey):
+				open = true
+			case args[0] == "GET" && args[1] == string(PipelineSignalEndKey):
+				flush()
+				open = false
+			case args[0] == "QUIT" && open:
+			case open:
+				pipeline = append(pipeline, respCommand(args...))
+			default:
+				b.WriteString(respCommand(args...))
+				sent++
+				quit = args[0] == "QUIT"
+			}
+			if quit {
+				break
+			}
+		}
+		flush()
+		if !quit {
+			b.WriteString(respCommand("PROXY", "PING"))
+			sent++
+		}
+
+		client, done := fuzzConnection(t, sd, upstream.Address(), Options{})
+		defer func() { _ = client.Close() }()
+		go func() {
+			_, _ = client.Write([]byte(b.String()))
+			if !quit {
+				// the last PROXY PING is answered before the client goes
+				_ = client.CloseWrite()
+			}
+		}()
+		replies := readReplies(t, client)
+		if len(replies) != sent {
+			t.Fatalf("%d replies to the %d commands of %q", len(replies), sent, b.String())
+		}
+		if !quit && !(replies[sent-1].IsString() && string(replies[sent-1].Value) == "PONG") {
+			t.Fatalf("last reply %s to %q isn't the PONG of its PROXY PING", replies[sent-1], b.String())
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the handler didn't return once the client was gone")
+		}
+	})
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// hotspotMaxKeys caps the distinct hash tags, and key prefixes, a window of
+// samples keeps, so that its memory doesn't grow with the keyspace. Beyond it,
+// keys are still counted in their slot.
+const hotspotMaxKeys = 1024
+
+// hotspotMaxPrefix is how far into a key the ':' ending its prefix may be
+const hotspotMaxPrefix = 64
+
+// hotspotTop is how many hash tags and key prefixes a report names
+const hotspotTop = 5
+
+// HotspotOptions configure the detection of hot slots: one in Sample commands
+// has the slot of its first key counted, and a window of Window is hot if one
+// slot has more than Share of its samples, once it has MinSamples. Writes to
+// keys whose hash tag matches a Banned pattern, as path.Match has them, are
+// rejected.
+type HotspotOptions struct {
+	Sample     int
+	Share      float64
+	Window     time.Duration
+	MinSamples int
+	Banned     []string
+}
+
+// Hotspots samples the slots an upstream's commands go to, in fixed windows,
+// to find those a hash tag concentrates its traffic on
+type Hotspots struct {
+	opts HotspotOptions
+	now  func() time.Time
+	n    uint64
+
+	mu       sync.Mutex
+	start    time.Time
+	samples  int64
+	slots    map[int]int64
+	tags     map[slotKey]int64
+	prefixes map[slotKey]int64
+	last     *HotspotReport
+	lastHot  *HotspotReport
+}
+
+// slotKey is a hash tag or key prefix of a slot
+type slotKey struct {
+	slot int
+	key  string
+}
+
+func NewHotspots(opts HotspotOptions) *Hotspots {
+	h := &Hotspots{opts: opts, now: time.Now}
+	h.reset(h.now())
+	return h
+}
+
+func (h *Hotspots) reset(now time.Time) {
+	h.start, h.samples = now, 0
+	h.slots = make(map[int]int64)
+	h.tags = make(map[slotKey]int64)
+	h.prefixes = make(map[slotKey]int64)
+}
+
+// HotspotReport is a window of samples: the slot with the most of them, its
+// share of the window, and its most frequent hash tags and key prefixes
+type HotspotReport struct {
+	Start    time.Time  `json:"start"`
+	End      time.Time  `json:"end"`
+	Samples  int64      `json:"samples"`
+	Slot     int        `json:"slot"`
+	Share    float64    `json:"share"`
+	Hot      bool       `json:"hot"`
+	HashTags []KeyCount `json:"hash_tags"`
+	Prefixes []KeyCount `json:"prefixes"`
+}
+
+// KeyCount is the number of samples of a hash tag or key prefix
+type KeyCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// HotspotStats are the settings of the detection, and its last window and last
+// hot one
+type HotspotStats struct {
+	Sample  int            `json:"sample"`
+	Share   float64        `json:"share"`
+	Window  string         `json:"window"`
+	Banned  []string       `json:"banned_hash_tags"`
+	Last    *HotspotReport `json:"last,omitempty"`
+	LastHot *HotspotReport `json:"last_hot,omitempty"`
+}
+
+// hashTag is the hash tag of a key, what KeySlot hashes if it has one
+func hashTag(key []byte) ([]byte, bool) {
+	if start := bytes.IndexByte(key, '{'); start >= 0 {
+		if end := bytes.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end], true
+		}
+	}
+	return nil, false
+}
+
+// keyPrefix is a key up to and including its first ':', if that is within its
+// first hotspotMaxPrefix bytes, and otherwise its first 16 bytes, so that a
+// long key without an early ':' doesn't make a prefix of itself
+func keyPrefix(key []byte) string {
+	if i := bytes.IndexByte(key, ':'); i >= 0 && i < hotspotMaxPrefix {
+		return string(key[:i+1])
+	}
+	if len(key) > 16 {
+		key = key[:16]
+	}
+	return string(key)
+}
+
+// sampleSlots counts the slot of the first key of one in Sample commands
+func (c *connection) sampleSlots(cmds []string, wm []*redis.Message) {
+	h := c.opts.Hotspots
+	if h == nil || h.opts.Sample <= 0 {
+		return
+	}
+	for i, m := range wm {
+		if atomic.AddUint64(&h.n, 1)%uint64(h.opts.Sample) != 0 || !m.IsArray() {
+			continue
+		}
+		if key, ok := c.opts.Keys.FirstKey(cmds[i], m); ok {
+			h.observe(key)
+		}
+	}
+}
+
+func (h *Hotspots) observe(key []byte) {
+	slot := redis.KeySlot(key)
+	tag, tagged := hashTag(key)
+	prefix := keyPrefix(key)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples++
+	h.slots[slot]++
+	if tagged {
+		countSlotKey(h.tags, slotKey{slot, string(tag)})
+	}
+	countSlotKey(h.prefixes, slotKey{slot, prefix})
+}
+
+func countSlotKey(counts map[slotKey]int64, k slotKey) {
+	if _, ok := counts[k]; ok || len(counts) < hotspotMaxKeys {
+		counts[k]++
+	}
+}
+
+// Tick ends the window once it is over, logging and counting it as a
+// cluster.slot_hotspot if it is hot
+func (h *Hotspots) Tick(log *zap.Logger, sd *statsd.Client) {
+	if h == nil || h.opts.Sample <= 0 {
+		return
+	}
+	now := h.now()
+	h.mu.Lock()
+	if now.Sub(h.start) < h.opts.Window {
+		h.mu.Unlock()
+		return
+	}
+	r := h.report(now)
+	h.last = r
+	if r.Hot {
+		h.lastHot = r
+	}
+	h.reset(now)
+	h.mu.Unlock()
+	if !r.Hot {
+		return
+	}
+	metrics.SlotHotspot.Incr(sd, strconv.Itoa(r.Slot))
+	fields := []zap.Field{zap.Int("slot", r.Slot), zap.Float64("share", r.Share), zap.Int64("samples", r.Samples)}
+	if len(r.HashTags) > 0 {
+		fields = append(fields, zap.String("hash_tag", r.HashTags[0].Key))
+	}
+	prefixes := make([]string, len(r.Prefixes))
+	for i, p := range r.Prefixes {
+		prefixes[i] = p.Key
+	}
+	log.Warn("One slot is taking too much of the traffic, check the hash tags of its keys", append(fields, zap.Strings("prefixes", prefixes))...)
+}
+
+func (h *Hotspots) report(now time.Time) *HotspotReport {
+	r := &HotspotReport{Start: h.start, End: now, Samples: h.samples, Slot: -1, HashTags: []KeyCount{}, Prefixes: []KeyCount{}}
+	var top int64
+	for slot, n := range h.slots {
+		if n > top || (n == top && slot < r.Slot) {
+			r.Slot, top = slot, n
+		}
+	}
+	if h.samples == 0 {
+		return r
+	}
+	r.Share = float64(top) / float64(h.samples)
+	r.Hot = h.samples >= int64(h.opts.MinSamples) && r.Share > h.opts.Share
+	r.HashTags = topKeys(h.tags, r.Slot)
+	r.Prefixes = topKeys(h.prefixes, r.Slot)
+	return r
+}
+
+// topKeys are the most frequent hash tags or prefixes of a slot
+func topKeys(counts map[slotKey]int64, slot int) []KeyCount {
+	top := []KeyCount{}
+	for k, n := range counts {
+		if k.slot == slot {
+			top = append(top, KeyCount{Key: k.key, Count: n})
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > hotspotTop {
+		top = top[:hotspotTop]
+	}
+	return top
+}
+
+// Stats returns the settings and the last windows
+func (h *Hotspots) Stats() *HotspotStats {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return &HotspotStats{Sample: h.opts.Sample, Share: h.opts.Share, Window: h.opts.Window.String(), Banned: append([]string{}, h.opts.Banned...), Last: h.last, LastHot: h.lastHot}
+}
+
+// banned is the hash tag of a key, if a Banned pattern matches it
+func (h *Hotspots) banned(key []byte) (string, bool) {
+	tag, ok := hashTag(key)
+	if !ok {
+		return "", false
+	}
+	for _, p := range h.opts.Banned {
+		if ok, _ := path.Match(p, string(tag)); ok {
+			return string(tag), true
+		}
+	}
+	return "", false
+}
+
+// rejectBannedHashTag answers a write to a key with a banned hash tag with an
+// error
+func (c *connection) rejectBannedHashTag(cmd string, m *redis.Message) *redis.Message {
+	h := c.opts.Hotspots
+	if h == nil || len(h.opts.Banned) == 0 || !WriteCommands[cmd] || !m.IsArray() {
+		return nil
+	}
+	for _, key := range c.opts.Keys.Keys(cmd, m) {
+		if tag, ok := h.banned(key); ok {
+			metrics.HotspotRejected.Incr(c.statsd, cmd)
+			return c.proxyError(proxyerr.Blocked, "writes to keys with the hash tag {%s} are banned on this upstream, since they all go to one slot", tag)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func hotspotCommands(keys ...string) ([]string, []*redis.Message) {
+	cmds := make([]string, len(keys))
+	wm := make([]*redis.Message, len(keys))
+	for i, k := range keys {
+		cmds[i] = "GET"
+		wm[i] = redis.NewArray(bulks("GET", k))
+	}
+	return cmds, wm
+}
+
+func TestHotspotsDetection(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := NewHotspots(HotspotOptions{Sample: 1, Share: 0.5, Window: time.Minute, MinSamples: 10})
+	h.now = func() time.Time { return now }
+	h.reset(now)
+	c := &connection{opts: Options{Hotspots: h}}
+
+	var keys []string
+	for i := 0; i < 12; i++ {
+		keys = append(keys, "orders:{user}:1", "carts:{user}:2")
+	}
+	keys = append(keys, "a", "b", "c", "d")
+	c.sampleSlots(hotspotCommands(keys...))
+
+	h.Tick(zap.NewNop(), nil)
+	assert.Nil(t, h.Stats().Last, "the window isn't over")
+
+	now = now.Add(time.Minute)
+	h.Tick(zap.NewNop(), nil)
+	s := h.Stats()
+	if assert.NotNil(t, s.Last) {
+		assert.True(t, s.Last.Hot)
+		assert.Equal(t, redis.KeySlot([]byte("{user}")), s.Last.Slot)
+		assert.Equal(t, int64(28), s.Last.Samples)
+		assert.InDelta(t, 24.0/28, s.Last.Share, 0.001)
+		assert.Equal(t, []KeyCount{{Key: "user", Count: 24}}, s.Last.HashTags)
+		assert.Equal(t, []KeyCount{{Key: "carts:", Count: 12}, {Key: "orders:", Count: 12}}, s.Last.Prefixes)
+	}
+	assert.Equal(t, s.Last, s.LastHot)
+
+	// the next window is spread out
+	c.sampleSlots(hotspotCommands("a", "b", "c", "d", "e", "f", "g", "h", "i", "j"))
+	now = now.Add(time.Minute)
+	h.Tick(zap.NewNop(), nil)
+	s = h.Stats()
+	assert.False(t, s.Last.Hot)
+	assert.True(t, s.LastHot.Hot, "the last hot window is kept")
+}
+
+func TestKeyPrefix(t *testing.T) {
+	assert.Equal(t, "orders:", keyPrefix([]byte("orders:{user}:1")))
+	assert.Equal(t, "session", keyPrefix([]byte("session")))
+	assert.Equal(t, "abcdefghijklmnop", keyPrefix([]byte("abcdefghijklmnopqrstuvwxyz")), "the first 16 bytes without a ':'")
+	long := strings.Repeat("k", 70) + ":1"
+	assert.Equal(t, long[:16], keyPrefix([]byte(long)), "or with one too far in")
+}
+
+func TestHotspotsMinSamples(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := NewHotspots(HotspotOptions{Sample: 1, Share: 0.5, Window: time.Minute, MinSamples: 10})
+	h.now = func() time.Time { return now }
+	h.reset(now)
+	(&connection{opts: Options{Hotspots: h}}).sampleSlots(hotspotCommands("{user}:1", "{user}:2"))
+	now = now.Add(time.Minute)
+	h.Tick(zap.NewNop(), nil)
+	assert.False(t, h.Stats().Last.Hot, "too few samples to tell")
+	assert.Nil(t, h.Stats().LastHot)
+}
+
+func TestHotspotsSampling(t *testing.T) {
+	h := NewHotspots(HotspotOptions{Sample: 4, Share: 0.5, Window: time.Minute, MinSamples: 1})
+	c := &connection{opts: Options{Hotspots: h}}
+	c.sampleSlots(hotspotCommands("a", "b", "c", "d", "e", "f", "g", "h", "i"))
+	assert.Equal(t, int64(2), h.samples, "one in four commands")
+}
+
+func TestRejectBannedHashTag(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	h := NewHotspots(HotspotOptions{Banned: []string{"user*"}})
+	client := closingTestConnection(t, upstream.Address(), Options{Hotspots: h})
+
+	banned := "-PROXYBLOCKED writes to keys with the hash tag {user1} are banned on this upstream, since they all go to one slot \\r\\n "
+	assert.Equal(t, []string{banned}, roundTripStrings(t, client, 1, respCommand("SET", "orders:{user1}:1", "v")))
+	assert.Equal(t, []string{"$22 \\r\\n orders:{user1}:1-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "orders:{user1}:1")),
+		"reads are let through")
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SET", "orders:{order1}:1", "v")))
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SET", "user1", "v")), "not a hash tag")
+
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	bannedTx := strings.Replace(banned, "user1", "user2", 1)
+	assert.Equal(t, []string{"$-1 \\r\\n ", bannedTx, bannedTx, bannedTx, "$-1 \\r\\n "},
+		roundTripStrings(t, client, 5, start, respCommand("MULTI"), respCommand("DEL", "{user2}"), respCommand("EXEC"), end))
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Identity is the outcome of the proxy's last check that an upstream is the
+// redis it was configured with, by its canary key, INFO fields or cluster mode.
+// With fail-fast, every command is refused while the upstream mismatches, until
+// a later check matches again.
+type Identity struct {
+	failFast bool
+
+	mu       sync.RWMutex
+	mismatch string
+	checked  time.Time
+	err      string
+}
+
+// IdentityStats is the state of an Identity, served under each listener in
+// /stats
+type IdentityStats struct {
+	Verified bool      `json:"verified"`
+	Mismatch string    `json:"mismatch,omitempty"`
+	Checked  time.Time `json:"checked,omitempty"`
+	// Error is why the last check couldn't be made, if it couldn't
+	Error string `json:"error,omitempty"`
+}
+
+// IdentityError is returned instead of forwarding a request to an upstream that
+// isn't the one configured
+type IdentityError struct {
+	Upstream string
+	Mismatch string
+}
+
+func (e IdentityError) Error() string {
+	return fmt.Sprintf("upstream %s failed its identity check, %s", e.Upstream, e.Mismatch)
+}
+
+// NewIdentity makes an Identity that is unverified, and refuses nothing, until
+// it is Set
+func NewIdentity(failFast bool) *Identity {
+	return &Identity{failFast: failFast}
+}
+
+// Set records the result of a check, mismatch being empty if the upstream is
+// the one configured, or why it isn't
+func (i *Identity) Set(mismatch string, at time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.mismatch = mismatch
+	i.checked = at
+	i.err = ""
+}
+
+// Fail records a check that couldn't be made, keeping the result of the last
+// one
+func (i *Identity) Fail(err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.err = err.Error()
+}
+
+// Mismatch is why the upstream failed its last check, or empty if it passed or
+// hasn't been checked
+func (i *Identity) Mismatch() string {
+	if i == nil {
+		return ""
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.mismatch
+}
+
+// refused is why commands are refused, if they are
+func (i *Identity) refused() string {
+	if i == nil || !i.failFast {
+		return ""
+	}
+	return i.Mismatch()
+}
+
+// Stats returns the state of the identity, or nil if there is none
+func (i *Identity) Stats() *IdentityStats {
+	if i == nil {
+		return nil
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return &IdentityStats{Verified: !i.checked.IsZero() && i.mismatch == "", Mismatch: i.mismatch, Checked: i.checked, Error: i.err}
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityMismatchRefused(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	failFast, degraded := NewIdentity(true), NewIdentity(false)
+	mismatch := `__redisbetween_identity__ is "cache-us-1", expected "cache-eu-1"`
+
+	refused := runTestConnection(t, upstream.Address(), Options{Upstream: "10.0.0.1:6379", Identity: failFast})
+	defer func() { _ = refused.Close() }()
+	logged := runTestConnection(t, upstream.Address(), Options{Upstream: "10.0.0.1:6379", Identity: degraded})
+	defer func() { _ = logged.Close() }()
+
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, refused, 1, respCommand("GET", "a")), "an unchecked upstream is served")
+
+	now := time.Now()
+	failFast.Set(mismatch, now)
+	degraded.Set(mismatch, now)
+	assert.Equal(t, []string{"-PROXYBLOCKED upstream 10.0.0.1:6379 failed its identity check, " + mismatch + " \\r\\n "}, roundTripStrings(t, refused, 1, respCommand("GET", "a")))
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, logged, 1, respCommand("GET", "a")), "a degraded upstream is still served")
+	assert.EqualValues(t, 2, upstream.Commands(), "nothing is forwarded to a mismatched upstream that fails fast")
+
+	failFast.Fail(errors.New("i/o timeout"))
+	assert.Equal(t, &IdentityStats{Mismatch: mismatch, Checked: now, Error: "i/o timeout"}, failFast.Stats(), "a check that couldn't be made keeps the last result")
+	failFast.Set("", now.Add(time.Minute))
+	assert.Equal(t, &IdentityStats{Verified: true, Checked: now.Add(time.Minute)}, failFast.Stats())
+	assert.Equal(t, []string{"$7 \\r\\n b-value \\r\\n "}, roundTripStrings(t, refused, 1, respCommand("GET", "b")), "the upstream is served again once it matches")
+
+	for _, client := range []net.Conn{refused, logged} {
+		_, _ = client.Write([]byte(respCommand("QUIT")))
+		assert.Equal(t, []string{"+OK \\r\\n "}, readUntilClosed(t, client))
+	}
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/coinbase/redisbetween/sanitize"
+	"go.uber.org/zap"
+)
+
+// localReply answers commands that the proxy handles itself instead of forwarding
+// them to a shared upstream connection. It returns nil for commands that should
+// be forwarded.
+func (c *connection) localReply(cmd string, m *redis.Message) *redis.Message {
+	if r := c.requireAuth(cmd, m); r != nil {
+		return r
+	}
+	if r := c.validate(cmd, m); r != nil {
+		return r
+	}
+	if r := c.rejectWrite(cmd); r != nil {
+		return r
+	}
+	if r := c.rejectSwapDB(cmd); r != nil {
+		return r
+	}
+	if r := c.rejectConfigWrite(cmd); r != nil {
+		return r
+	}
+	if r := c.rejectPersist(cmd, m); r != nil {
+		return r
+	}
+	if r := c.rejectBannedHashTag(cmd, m); r != nil {
+		return r
+	}
+	if r := c.rejectCorruptWrite(cmd, m); r != nil {
+		return r
+	}
+	var r *redis.Message
+	switch {
+	case cmd == "HELLO":
+		r = c.hello(m.Array[1:])
+	case cmd == "CLIENT SETINFO":
+		r = c.clientSetInfo(m.Array[2:])
+	case cmd == "CLIENT SETNAME":
+		r = c.clientSetName(m.Array[2:])
+	case cmd == "CLIENT GETNAME" && len(m.Array) == 2:
+		r = redis.NewBulkBytes(nil)
+		if c.client.name != "" {
+			r = redis.NewBulkBytes([]byte(c.client.name))
+		}
+	case cmd == "CLIENT ID" && len(m.Array) == 2:
+		r = redis.NewInt([]byte(strconv.FormatUint(c.id, 10)))
+	case cmd == "CLIENT INFO" && len(m.Array) == 2:
+		r = redis.NewBulkBytes([]byte(c.clientInfoLine(time.Now())))
+	case cmd == "CONFIG GET":
+		r = c.configGet(m.Array[2:])
+	case isProxyCommand(cmd):
+		r = c.proxyCommand(cmd, m)
+	case cmd == "SELECT" && c.opts.DBPools != nil:
+		r = c.selectDB(m.Array[1:])
+	case WriteBehindCommands[cmd] && c.db == c.opts.Database:
+		r = c.opts.WriteBehind.Absorb(cmd, m)
+	}
+	if r != nil && c.trace != nil {
+		c.trace.add("local", cmd+" answered by the proxy")
+	}
+	return r
+}
+
+// hello records the protocol, username and client name a client announces.
+// RESP3 is only spoken with a RESP3 pool to serve the client over, and on the
+// default database, whose pool it is, so a request for it otherwise, or for any
+// other protocol, gets the same NOPROTO error redis itself returns, which
+// clients treat as a signal to fall back to RESP2.
+func (c *connection) hello(args []*redis.Message) *redis.Message {
+	protocol := c.protocol()
+	if len(args) > 0 {
+		p, err := strconv.Atoi(string(args[0].Value))
+		if err != nil {
+			return redis.NewErrorf("ERR Protocol version is not an integer or out of range")
+		}
+		if p != 2 && (p != 3 || c.opts.RESP3 == nil || c.db != c.opts.Database) {
+			return redis.NewErrorf("NOPROTO sorry, this protocol version is not supported")
+		}
+		protocol = p
+		args = args[1:]
+	}
+
+	var user, password, name string
+	for len(args) > 0 {
+		opt := strings.ToUpper(string(args[0].Value))
+		switch {
+		case opt == "AUTH" && len(args) >= 3:
+			user, password = string(args[1].Value), string(args[2].Value)
+			args = args[3:]
+		case opt == "SETNAME" && len(args) >= 2:
+			name = string(args[1].Value)
+			args = args[2:]
+		default:
+			return redis.NewErrorf("ERR Syntax error in HELLO option '%s'", string(args[0].Value))
+		}
+	}
+	if r := c.helloAuth(user, password); r != nil {
+		return r
+	}
+
+	c.client.protocol = protocol
+	if user != "" {
+		c.client.authUser = user
+	}
+	if name != "" {
+		c.client.name = name
+	}
+	c.log.Debug("HELLO", zap.Int("protocol", protocol), zap.String("user", user), zap.String("name", name))
+
+	r := redis.NewArray([]*redis.Message{
+		redis.NewBulkBytes([]byte("server")), redis.NewBulkBytes([]byte("redisbetween")),
+		redis.NewBulkBytes([]byte("proto")), redis.NewInt([]byte(strconv.Itoa(protocol))),
+		redis.NewBulkBytes([]byte("id")), redis.NewInt([]byte(strconv.FormatUint(c.id, 10))),
+	})
+	if protocol == 3 {
+		r.Type = redis.TypeMap
+	}
+	return r
+}
+
+// clientSetInfo records the library name and version announced by a client.
+// Setting them on a pooled upstream connection would mislabel every other
+// client that later uses it, so they are acknowledged locally instead.
+func (c *connection) clientSetInfo(args []*redis.Message) *redis.Message {
+	if len(args) != 2 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'client|setinfo' command")
+	}
+	switch strings.ToUpper(string(args[0].Value)) {
+	case "LIB-NAME":
+		c.client.libName = string(args[1].Value)
+	case "LIB-VER":
+		c.client.libVer = string(args[1].Value)
+	default:
+		return redis.NewErrorf("ERR Unrecognized option '%s'", string(args[0].Value))
+	}
+	return redis.NewString([]byte("OK"))
+}
+
+// clientSetName records the name a client gives its connection, which would
+// name every client of a pooled upstream connection if it were forwarded
+func (c *connection) clientSetName(args []*redis.Message) *redis.Message {
+	if len(args) != 1 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'client|setname' command")
+	}
+	for _, b := range args[0].Value {
+		if b <= ' ' || b > '~' {
+			return redis.NewErrorf("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+	}
+	c.client.name = string(args[0].Value)
+	return redis.NewString([]byte("OK"))
+}
+
+// clientInfoLine describes the client's own connection to the proxy in the
+// key=value layout of redis' CLIENT INFO, rather than the pooled upstream
+// connection that would answer it, with proxy and proxy_ver added. The id is
+// the one the connection is logged with as local_id. Transactions and
+// subscriptions never outlive a request through the proxy, so the connection
+// is never in one between commands.
+func (c *connection) clientInfoLine(now time.Time) string {
+	user := c.client.authUser
+	if user == "" {
+		user = DefaultUpstreamUser
+	}
+	fields := [][2]string{
+		{"id", strconv.FormatUint(c.id, 10)},
+		{"addr", c.clientAddr()},
+		{"laddr", c.address},
+		{"name", c.client.name},
+		{"age", strconv.FormatInt(int64(now.Sub(c.connected)/time.Second), 10)},
+		{"idle", "0"},
+		{"flags", "N"},
+		{"db", strconv.Itoa(c.db)},
+		{"sub", "0"},
+		{"psub", "0"},
+		{"multi", "-1"},
+		{"cmd", "client|info"},
+		{"user", user},
+		{"resp", strconv.Itoa(c.protocol())},
+		{"lib-name", c.client.libName},
+		{"lib-ver", c.client.libVer},
+		{"proxy", "redisbetween"},
+		{"proxy_ver", c.opts.ProxyVersion},
+	}
+	var b strings.Builder
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f[0] + "=" + f[1])
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// protocol is the RESP version the client speaks, 2 unless it said otherwise
+func (c *connection) protocol() int {
+	if c.client.protocol == 0 {
+		return 2
+	}
+	return c.client.protocol
+}
+
+// speaksRESP3 is whether the client negotiated RESP3, which it only can with a
+// RESP3 pool to be served over
+func (c *connection) speaksRESP3() bool {
+	return c.protocol() == 3
+}
+
+// general is the pool the requests of the default database go over, the RESP3
+// pool for a client that negotiated RESP3
+func (c *connection) general() *pool.Server {
+	if c.speaksRESP3() {
+		return c.opts.RESP3
+	}
+	return c.server
+}
+
+// recordClientLibrary counts this connection's library once its name and version
+// are both known, or with whatever is known when final is set (on disconnect).
+func (c *connection) recordClientLibrary(final bool) {
+	if c.client.recorded || c.opts.ClientLibraries == nil {
+		return
+	}
+	if !final && (c.client.libName == "" || c.client.libVer == "") {
+		return
+	}
+	c.client.recorded = true
+
+	lib := c.client.library()
+	bucket := c.opts.ClientLibraries.Add(lib)
+	metrics.ClientLibraryConnections.Incr(c.statsd, sanitize.TagValue(bucket))
+
+	if c.opts.DeprecatedClients != nil && c.opts.DeprecatedClients.MatchString(lib) {
+		c.log.Warn("Deprecated client library", zap.String("library", lib), zap.Int("protocol", c.client.protocol), zap.String("client_name", c.client.name))
+		c.warn(WarningDeprecatedClient, "client library "+lib+" is deprecated, upgrade it")
+	}
+}
@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// Invalidation is the data a write command may have changed, which caches of
+// replies must drop once it is forwarded. Commands that move data, like RENAME or
+// COPY, invalidate every key involved, and commands whose effect can't be pinned
+// to keys clear whole databases.
+type Invalidation struct {
+	Keys []InvalidatedKey
+	// ClearDB clears the connection's database, ClearDBs the databases with these
+	// numbers, and ClearAll every database.
+	ClearDB  bool
+	ClearDBs []int
+	ClearAll bool
+}
+
+// InvalidatedKey is a key in database DB, or in the connection's database if DB
+// is -1
+type InvalidatedKey struct {
+	Key string
+	DB  int
+}
+
+type invalidator func(args [][]byte) Invalidation
+
+// Invalidations maps every one of WriteCommands to the data it invalidates. It is
+// deliberately exhaustive: a write command missing from it would let a cache
+// serve stale data.
+var Invalidations = map[string]invalidator{
+	"APPEND":                firstKey,
+	"BITFIELD":              firstKey,
+	"BITOP":                 keysAt(1),
+	"BLMOVE":                keysAt(0, 1),
+	"BLMPOP":                numKeys(1),
+	"BLPOP":                 allKeysButLast,
+	"BRPOP":                 allKeysButLast,
+	"BRPOPLPUSH":            keysAt(0, 1),
+	"BZMPOP":                numKeys(1),
+	"BZPOPMAX":              allKeysButLast,
+	"BZPOPMIN":              allKeysButLast,
+	"COPY":                  copyKeys,
+	"DECR":                  firstKey,
+	"DECRBY":                firstKey,
+	"DEL":                   allKeys,
+	"EXPIRE":                firstKey,
+	"EXPIREAT":              firstKey,
+	"FLUSHALL":              clearAll,
+	"FLUSHDB":               clearDB,
+	"FUNCTION DELETE":       clearAll,
+	"FUNCTION FLUSH":        clearAll,
+	"FUNCTION LOAD":         clearAll,
+	"FUNCTION RESTORE":      clearAll,
+	"GEOADD":                firstKey,
+	"GEORADIUS":             storeOption,
+	"GEORADIUSBYMEMBER":     storeOption,
+	"GEOSEARCHSTORE":        firstKey,
+	"GETDEL":                firstKey,
+	"GETEX":                 firstKey,
+	"GETSET":                firstKey,
+	"HDEL":                  firstKey,
+	"HINCRBY":               firstKey,
+	"HINCRBYFLOAT":          firstKey,
+	"HMSET":                 firstKey,
+	"HSET":                  firstKey,
+	"HSETNX":                firstKey,
+	"INCR":                  firstKey,
+	"INCRBY":                firstKey,
+	"INCRBYFLOAT":           firstKey,
+	"LINSERT":               firstKey,
+	"LMOVE":                 keysAt(0, 1),
+	"LMPOP":                 numKeys(0),
+	"LPOP":                  firstKey,
+	"LPUSH":                 firstKey,
+	"LPUSHX":                firstKey,
+	"LREM":                  firstKey,
+	"LSET":                  firstKey,
+	"LTRIM":                 firstKey,
+	"MIGRATE":               migrateKeys,
+	"MOVE":                  moveKey,
+	"MSET":                  everyOtherKey,
+	"MSETNX":                everyOtherKey,
+	"PERSIST":               firstKey,
+	"PEXPIRE":               firstKey,
+	"PEXPIREAT":             firstKey,
+	"PFADD":                 firstKey,
+	"PFDEBUG":               keysAt(1),
+	"PFMERGE":               firstKey,
+	"PSETEX":                firstKey,
+	"RENAME":                keysAt(0, 1),
+	"RENAMENX":              keysAt(0, 1),
+	"RESTORE":               firstKey,
+	"RESTORE-ASKING":        firstKey,
+	"RPOP":                  firstKey,
+	"RPOPLPUSH":             keysAt(0, 1),
+	"RPUSH":                 firstKey,
+	"RPUSHX":                firstKey,
+	"SADD":                  firstKey,
+	"SDIFFSTORE":            firstKey,
+	"SET":                   firstKey,
+	"SETBIT":                firstKey,
+	"SETEX":                 firstKey,
+	"SETNX":                 firstKey,
+	"SETRANGE":              firstKey,
+	"SINTERSTORE":           firstKey,
+	"SMOVE":                 keysAt(0, 1),
+	"SORT":                  storeOption,
+	"SPOP":                  firstKey,
+	"SREM":                  firstKey,
+	"SUNIONSTORE":           firstKey,
+	"SWAPDB":                swapDBs,
+	"UNLINK":                allKeys,
+	"XACK":                  firstKey,
+	"XADD":                  firstKey,
+	"XAUTOCLAIM":            firstKey,
+	"XCLAIM":                firstKey,
+	"XDEL":                  firstKey,
+	"XGROUP CREATE":         firstKey,
+	"XGROUP CREATECONSUMER": firstKey,
+	"XGROUP DELCONSUMER":    firstKey,
+	"XGROUP DESTROY":        firstKey,
+	"XGROUP SETID":          firstKey,
+	"XREADGROUP":            streamKeys,
+	"XSETID":                firstKey,
+	"XTRIM":                 firstKey,
+	"ZADD":                  firstKey,
+	"ZDIFFSTORE":            firstKey,
+	"ZINCRBY":               firstKey,
+	"ZINTERSTORE":           firstKey,
+	"ZMPOP":                 numKeys(0),
+	"ZPOPMAX":               firstKey,
+	"ZPOPMIN":               firstKey,
+	"ZRANGESTORE":           firstKey,
+	"ZREM":                  firstKey,
+	"ZREMRANGEBYLEX":        firstKey,
+	"ZREMRANGEBYRANK":       firstKey,
+	"ZREMRANGEBYSCORE":      firstKey,
+	"ZUNIONSTORE":           firstKey,
+
+	// scripts can write keys they weren't given
+	"EVAL":    clearDB,
+	"EVALSHA": clearDB,
+	"FCALL":   clearDB,
+}
+
+// Invalidates returns the data cmd invalidates, and false if it is not a write.
+// m is the whole command, including its name and any subcommand.
+func Invalidates(cmd string, m *redis.Message) (Invalidation, bool) {
+	inv, ok := Invalidations[cmd]
+	if !ok {
+		return Invalidation{}, false
+	}
+	skip := strings.Count(cmd, " ") + 1
+	var args [][]byte
+	if len(m.Array) > skip {
+		args = make([][]byte, 0, len(m.Array)-skip)
+		for _, a := range m.Array[skip:] {
+			args = append(args, a.Value)
+		}
+	}
+	return inv(args), true
+}
+
+func keys(kk ...[]byte) Invalidation {
+	var inv Invalidation
+	for _, k := range kk {
+		inv.Keys = append(inv.Keys, InvalidatedKey{Key: string(k), DB: -1})
+	}
+	return inv
+}
+
+func firstKey(args [][]byte) Invalidation {
+	return keysAt(0)(args)
+}
+
+func keysAt(positions ...int) invalidator {
+	return func(args [][]byte) Invalidation {
+		var kk [][]byte
+		for _, i := range positions {
+			if i < len(args) {
+				kk = append(kk, args[i])
+			}
+		}
+		return keys(kk...)
+	}
+}
+
+func allKeys(args [][]byte) Invalidation {
+	return keys(args...)
+}
+
+// allKeysButLast is for blocking pops, whose last argument is a timeout
+func allKeysButLast(args [][]byte) Invalidation {
+	if len(args) == 0 {
+		return Invalidation{}
+	}
+	return keys(args[:len(args)-1]...)
+}
+
+func everyOtherKey(args [][]byte) Invalidation {
+	var kk [][]byte
+	for i := 0; i < len(args); i += 2 {
+		kk = append(kk, args[i])
+	}
+	return keys(kk...)
+}
+
+// numKeys is for commands with a key count at position i, followed by the keys
+func numKeys(i int) invalidator {
+	return func(args [][]byte) Invalidation {
+		if i >= len(args) {
+			return Invalidation{}
+		}
+		n, err := strconv.Atoi(string(args[i]))
+		if err != nil || n < 0 || i+1+n > len(args) {
+			return Invalidation{}
+		}
+		return keys(args[i+1 : i+1+n]...)
+	}
+}
+
+// storeOption is for read commands that write only the key of a STORE option
+func storeOption(args [][]byte) Invalidation {
+	var kk [][]byte
+	for i := 1; i+1 < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "STORE", "STOREDIST":
+			kk = append(kk, args[i+1])
+			i++
+		}
+	}
+	return keys(kk...)
+}
+
+// copyKeys handles COPY source destination [DB db] [REPLACE]
+func copyKeys(args [][]byte) Invalidation {
+	inv := keysAt(0, 1)(args)
+	for i := 2; i+1 < len(args); i++ {
+		if strings.ToUpper(string(args[i])) == "DB" && len(inv.Keys) == 2 {
+			if db, err := strconv.Atoi(string(args[i+1])); err == nil {
+				inv.Keys[1].DB = db
+			}
+		}
+	}
+	return inv
+}
+
+// moveKey handles MOVE key db, which removes the key in one database and adds it
+// in another
+func moveKey(args [][]byte) Invalidation {
+	inv := firstKey(args)
+	if len(args) > 1 {
+		if db, err := strconv.Atoi(string(args[1])); err == nil {
+			inv.Keys = append(inv.Keys, InvalidatedKey{Key: string(args[0]), DB: db})
+		}
+	}
+	return inv
+}
+
+// migrateKeys handles MIGRATE host port key|"" db timeout [COPY] [REPLACE]
+// [AUTH ...] [KEYS key ...]. The keys are only added on another server, but are
+// removed here unless COPY is given.
+func migrateKeys(args [][]byte) Invalidation {
+	var kk [][]byte
+	if len(args) > 2 && len(args[2]) > 0 {
+		kk = append(kk, args[2])
+	}
+	for i := 5; i < len(args); i++ {
+		if strings.ToUpper(string(args[i])) == "KEYS" {
+			kk = append(kk, args[i+1:]...)
+			break
+		}
+	}
+	return keys(kk...)
+}
+
+// streamKeys handles XREADGROUP ... STREAMS key [key ...] id [id ...], which
+// moves entries into the pending lists of the streams
+func streamKeys(args [][]byte) Invalidation {
+	for i := range args {
+		if strings.ToUpper(string(args[i])) == "STREAMS" {
+			streams := args[i+1:]
+			return keys(streams[:len(streams)/2]...)
+		}
+	}
+	return Invalidation{}
+}
+
+func swapDBs(args [][]byte) Invalidation {
+	var inv Invalidation
+	for _, a := range args {
+		db, err := strconv.Atoi(string(a))
+		if err != nil {
+			// clearing everything is safe when the databases can't be told apart
+			return clearAll(args)
+		}
+		inv.ClearDBs = append(inv.ClearDBs, db)
+	}
+	return inv
+}
+
+func clearDB([][]byte) Invalidation {
+	return Invalidation{ClearDB: true}
+}
+
+func clearAll([][]byte) Invalidation {
+	return Invalidation{ClearAll: true}
+}
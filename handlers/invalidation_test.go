@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidationsCoverWriteCommands(t *testing.T) {
+	for cmd := range WriteCommands {
+		_, ok := Invalidations[cmd]
+		assert.True(t, ok, "%s has no invalidation rule, so caches would serve stale data after it", cmd)
+	}
+	for cmd := range Invalidations {
+		assert.True(t, WriteCommands[cmd], "%s invalidates caches but is not a write command", cmd)
+	}
+}
+
+func TestInvalidates(t *testing.T) {
+	k := func(kk ...string) Invalidation {
+		var inv Invalidation
+		for _, key := range kk {
+			inv.Keys = append(inv.Keys, InvalidatedKey{Key: key, DB: -1})
+		}
+		return inv
+	}
+	cases := []struct {
+		command  string
+		expected Invalidation
+	}{
+		// data moving between keys invalidates both sides
+		{"RENAME a b", k("a", "b")},
+		{"RENAMENX a b", k("a", "b")},
+		{"COPY a b", k("a", "b")},
+		{"COPY a b REPLACE", k("a", "b")},
+		{"COPY a b DB 3 REPLACE", Invalidation{Keys: []InvalidatedKey{{Key: "a", DB: -1}, {Key: "b", DB: 3}}}},
+		{"MOVE a 2", Invalidation{Keys: []InvalidatedKey{{Key: "a", DB: -1}, {Key: "a", DB: 2}}}},
+		{"RESTORE a 0 payload REPLACE", k("a")},
+		{"RESTORE-ASKING a 0 payload", k("a")},
+		{"SMOVE a b m", k("a", "b")},
+		{"LMOVE a b LEFT RIGHT", k("a", "b")},
+		{"BLMOVE a b LEFT RIGHT 0", k("a", "b")},
+		{"RPOPLPUSH a b", k("a", "b")},
+		{"BRPOPLPUSH a b 0", k("a", "b")},
+		{"MIGRATE host 6379 a 0 1000", k("a")},
+
+		// whole databases
+		{"FLUSHDB", Invalidation{ClearDB: true}},
+		{"FLUSHDB ASYNC", Invalidation{ClearDB: true}},
+		{"FLUSHALL", Invalidation{ClearAll: true}},
+		{"SWAPDB 0 1", Invalidation{ClearDBs: []int{0, 1}}},
+		{"SWAPDB 0 x", Invalidation{ClearAll: true}},
+		{"EVAL script 1 a", Invalidation{ClearDB: true}},
+		{"EVALSHA sha 0", Invalidation{ClearDB: true}},
+		{"FCALL f 1 a", Invalidation{ClearDB: true}},
+		{"FUNCTION LOAD code", Invalidation{ClearAll: true}},
+		{"FUNCTION FLUSH", Invalidation{ClearAll: true}},
+
+		// expiry
+		{"EXPIRE a 10", k("a")},
+		{"PEXPIRE a 10", k("a")},
+		{"EXPIREAT a 10", k("a")},
+		{"PEXPIREAT a 10", k("a")},
+		{"PERSIST a", k("a")},
+		{"GETEX a EX 10", k("a")},
+
+		// multiple keys
+		{"DEL a b c", k("a", "b", "c")},
+		{"UNLINK a b", k("a", "b")},
+		{"MSET a 1 b 2", k("a", "b")},
+		{"MSETNX a 1 b 2", k("a", "b")},
+		{"BLPOP a b 0", k("a", "b")},
+		{"BZPOPMIN a 0", k("a")},
+		{"LMPOP 2 a b LEFT COUNT 3", k("a", "b")},
+		{"ZMPOP 1 a MIN", k("a")},
+		{"BLMPOP 0 2 a b LEFT", k("a", "b")},
+		{"BZMPOP 0 1 a MAX", k("a")},
+		{"LMPOP 5 a", Invalidation{}},
+		{"XREADGROUP GROUP g c COUNT 1 STREAMS a b > >", k("a", "b")},
+
+		// only the destination of a store changes
+		{"SUNIONSTORE d a b", k("d")},
+		{"ZUNIONSTORE d 2 a b", k("d")},
+		{"ZRANGESTORE d a 0 -1", k("d")},
+		{"GEOSEARCHSTORE d a FROMMEMBER m BYRADIUS 1 km", k("d")},
+		{"BITOP AND d a b", k("d")},
+		{"PFMERGE d a b", k("d")},
+		{"PFDEBUG GETREG a", k("a")},
+		{"SORT a LIMIT 0 10 STORE d", k("d")},
+		{"SORT a", Invalidation{}},
+		{"GEORADIUS a 0 0 1 km STORE d STOREDIST e", k("d", "e")},
+		{"GEORADIUSBYMEMBER a m 1 km STOREDIST d", k("d")},
+
+		// subcommands
+		{"XGROUP CREATE a g $", k("a")},
+		{"XGROUP DESTROY a g", k("a")},
+
+		// single keys
+		{"SET a 1", k("a")},
+		{"INCR a", k("a")},
+		{"HSET a f v", k("a")},
+		{"ZADD a 1 m", k("a")},
+	}
+	for _, c := range cases {
+		args := strings.Split(c.command, " ")
+		mm := make([]*redis.Message, len(args))
+		for i, a := range args {
+			mm[i] = redis.NewBulkBytes([]byte(a))
+		}
+		cmd := args[0]
+		if SubcommandCommands[cmd] {
+			cmd += " " + args[1]
+		}
+		actual, ok := Invalidates(cmd, redis.NewArray(mm))
+		assert.True(t, ok, c.command)
+		assert.Equal(t, c.expected, actual, c.command)
+	}
+
+	// MIGRATE of several keys has an empty key argument
+	migrate := []*redis.Message{}
+	for _, a := range []string{"MIGRATE", "host", "6379", "", "0", "1000", "REPLACE", "KEYS", "a", "b"} {
+		migrate = append(migrate, redis.NewBulkBytes([]byte(a)))
+	}
+	inv, ok := Invalidates("MIGRATE", redis.NewArray(migrate))
+	assert.True(t, ok)
+	assert.Equal(t, k("a", "b"), inv)
+
+	_, ok = Invalidates("GET", redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("GET")), redis.NewBulkBytes([]byte("a"))}))
+	assert.False(t, ok, "reads invalidate nothing")
+	inv, ok = Invalidates("RENAME", redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("RENAME"))}))
+	assert.True(t, ok)
+	assert.Equal(t, Invalidation{}, inv, "missing arguments are tolerated")
+}
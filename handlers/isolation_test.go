@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineIsolation(t *testing.T) {
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "INCR" {
+			return redis.NewError([]byte("ERR value is not an integer or out of range"))
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = client.Close() }()
+
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"$7 \\r\\n a-value \\r\\n ",
+		"-PROXYBLOCKED SUBSCRIBE is unsupported \\r\\n ",
+		"-ERR value is not an integer or out of range \\r\\n ",
+		"-PROXYBLOCKED transaction discarded, SUBSCRIBE is unsupported \\r\\n ",
+		"-PROXYBLOCKED transaction discarded, SUBSCRIBE is unsupported \\r\\n ",
+		"-PROXYBLOCKED transaction discarded, SUBSCRIBE is unsupported \\r\\n ",
+		"-PROXYBLOCKED transaction discarded, SUBSCRIBE is unsupported \\r\\n ",
+		"$7 \\r\\n b-value \\r\\n ",
+		"$-1 \\r\\n ",
+	}, roundTripStrings(t, client, 10,
+		start,
+		respCommand("GET", "a"),
+		respCommand("SUBSCRIBE", "news"),
+		respCommand("INCR", "a"),
+		respCommand("MULTI"),
+		respCommand("SET", "a", "1"),
+		respCommand("SUBSCRIBE", "news"),
+		respCommand("EXEC"),
+		respCommand("GET", "b"),
+		end,
+	), "each command is answered in its position, whatever happened to the others")
+	assert.Equal(t, int64(3), upstream.Commands(), "the transaction isn't sent")
+
+	assert.Equal(t, []string{"$7 \\r\\n c-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "c")), "the connection stays usable")
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("QUIT")))
+	assert.Empty(t, readUntilClosed(t, client))
+}
+
+func TestPipelineUpstreamFailure(t *testing.T) {
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "DEBUG" {
+			return nil
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = client.Close() }()
+
+	replies := roundTripStrings(t, client, 5, start, respCommand("GET", "a"), respCommand("DEBUG", "SEGFAULT"), respCommand("GET", "b"), end)
+	assert.Equal(t, []string{"$-1 \\r\\n ", "$7 \\r\\n a-value \\r\\n "}, replies[:2], "the replies read before the connection failed are relayed")
+	for _, r := range replies[2:4] {
+		assert.Regexp(t, `^-PROXYUNAVAILABLE `, r, "the rest are answered with why they were lost")
+	}
+	assert.Equal(t, "$-1 \\r\\n ", replies[4])
+
+	assert.Equal(t, []string{"$7 \\r\\n c-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "c")), "the next request gets a connection of its own")
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("QUIT")))
+	assert.Empty(t, readUntilClosed(t, client))
+}
+
+func TestPipelineProtocolError(t *testing.T) {
+	start := respCommand("GET", string(PipelineSignalStartKey))
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = client.Close() }()
+
+	go func() {
+		for _, c := range []string{start, respCommand("GET", "a"), respCommand("SET", "b", "1"), "?garbage\r\n", respCommand("GET", "c")} {
+			_, _ = client.Write([]byte(c))
+		}
+	}()
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"$7 \\r\\n a-value \\r\\n ",
+		"+OK \\r\\n ",
+		"-ERR Protocol error: bad resp type <unknown-0x3f> \\r\\n ",
+	}, readUntilClosed(t, client), "the commands read before the protocol error are answered before it")
+	assert.Equal(t, int64(2), upstream.Commands(), "nothing after it is read")
+}
+
+func TestCommandsSentAtOnce(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = client.Close() }()
+
+	// without the pipeline signals, each command is a request of its own, but
+	// none is lost for arriving with the one before
+	assert.Equal(t, []string{
+		"$7 \\r\\n a-value \\r\\n ",
+		"+OK \\r\\n ",
+		"$7 \\r\\n b-value \\r\\n ",
+	}, roundTripStrings(t, client, 3, respCommand("GET", "a")+respCommand("SET", "b", "1")+respCommand("GET", "b")))
+	assert.Equal(t, int64(3), upstream.Commands())
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// KeySpec is where a command's keys are, as reported by COMMAND: the positions
+// of its first and last key, counting the command name as 0 and negative
+// positions from the end, and the step between keys. A First of 0 means the
+// command has no keys.
+type KeySpec struct {
+	First int
+	Last  int
+	Step  int
+}
+
+// defaultKeySpec is assumed for commands the table knows nothing about
+var defaultKeySpec = KeySpec{First: 1, Last: 1, Step: 1}
+
+// KeyTable locates the keys of commands. Until it is loaded it assumes the first
+// argument of every command is its key. Loading replaces that with the
+// upstream's own COMMAND reply, which also covers the commands of any modules it
+// has loaded, like JSON.GET or FT.SEARCH.
+type KeyTable struct {
+	mu      sync.RWMutex
+	specs   map[string]KeySpec
+	arities map[string]arity
+}
+
+// arity is the number of arguments a command takes, counting its name, as
+// reported by COMMAND: exactly n if positive, at least -n if negative. Name is
+// how redis names the command in errors, like "get" or "client|setinfo".
+type arity struct {
+	n    int
+	name string
+}
+
+func NewKeyTable() *KeyTable {
+	return &KeyTable{}
+}
+
+// Load replaces the table with the commands described by a COMMAND reply,
+// returning how many there are
+func (t *KeyTable) Load(reply *redis.Message) (int, error) {
+	if reply.IsError() {
+		return 0, fmt.Errorf("COMMAND failed: %s", reply.Value)
+	}
+	if !reply.IsArray() {
+		return 0, fmt.Errorf("unexpected COMMAND reply type %s", reply.Type)
+	}
+	specs := make(map[string]KeySpec, len(reply.Array))
+	arities := make(map[string]arity, len(reply.Array))
+	for _, info := range reply.Array {
+		// name, arity, flags, first key, last key, step, ...
+		if len(info.Array) < 6 {
+			continue
+		}
+		var spec KeySpec
+		var err error
+		for i, p := range []*int{&spec.First, &spec.Last, &spec.Step} {
+			var n int64
+			if n, err = redis.Btoi64(info.Array[3+i].Value); err != nil {
+				break
+			}
+			*p = int(n)
+		}
+		if err != nil {
+			continue
+		}
+		specs[strings.ToUpper(string(info.Array[0].Value))] = spec
+		loadArity(arities, info)
+		// since redis 7, the subcommands of a command are its 10th element, named
+		// like "client|setinfo"
+		if len(info.Array) >= 10 {
+			for _, sub := range info.Array[9].Array {
+				loadArity(arities, sub)
+			}
+		}
+	}
+	if len(specs) == 0 {
+		return 0, fmt.Errorf("COMMAND reply lists no commands")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.specs = specs
+	t.arities = arities
+	return len(specs), nil
+}
+
+func loadArity(arities map[string]arity, info *redis.Message) {
+	if len(info.Array) < 2 {
+		return
+	}
+	n, err := redis.Btoi64(info.Array[1].Value)
+	if err != nil || n == 0 {
+		return
+	}
+	name := strings.ToLower(string(info.Array[0].Value))
+	arities[strings.ToUpper(strings.Replace(name, "|", " ", 1))] = arity{n: int(n), name: name}
+}
+
+// Loaded reports whether the table has been loaded from the upstream
+func (t *KeyTable) Loaded() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.specs != nil
+}
+
+func (t *KeyTable) spec(cmd string) KeySpec {
+	if t == nil {
+		return defaultKeySpec
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if spec, ok := t.specs[cmd]; ok {
+		return spec
+	}
+	return defaultKeySpec
+}
+
+// arity returns the arity of cmd, if the table has been loaded and knows it
+func (t *KeyTable) arity(cmd string) (arity, bool) {
+	if t == nil {
+		return arity{}, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	a, ok := t.arities[cmd]
+	return a, ok
+}
+
+// Keys returns the keys of command m, whose name is cmd. A nil table uses the
+// default key positions.
+func (t *KeyTable) Keys(cmd string, m *redis.Message) [][]byte {
+	spec := t.spec(cmd)
+	if spec.First <= 0 {
+		return nil
+	}
+	last := spec.Last
+	if last < 0 {
+		last += len(m.Array)
+	}
+	if last >= len(m.Array) {
+		last = len(m.Array) - 1
+	}
+	step := spec.Step
+	if step < 1 {
+		step = 1
+	}
+	var keys [][]byte
+	for i := spec.First; i <= last; i += step {
+		keys = append(keys, m.Array[i].Value)
+	}
+	return keys
+}
+
+// FirstKey returns the first key of command m, whose name is cmd
+func (t *KeyTable) FirstKey(cmd string, m *redis.Message) ([]byte, bool) {
+	spec := t.spec(cmd)
+	if spec.First <= 0 || spec.First >= len(m.Array) {
+		return nil, false
+	}
+	return m.Array[spec.First].Value, true
+}
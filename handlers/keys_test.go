@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func commandInfo(name string, first, last, step int) *redis.Message {
+	itoa := func(i int) *redis.Message { return redis.NewInt([]byte(strconv.Itoa(i))) }
+	return redis.NewArray([]*redis.Message{
+		redis.NewBulkBytes([]byte(name)), itoa(-1), redis.NewArray(nil), itoa(first), itoa(last), itoa(step),
+	})
+}
+
+func TestKeyTable(t *testing.T) {
+	var unloaded *KeyTable
+	key, ok := unloaded.FirstKey("GET", redis.NewArray(bulks("GET", "k")))
+	assert.True(t, ok)
+	assert.Equal(t, "k", string(key), "an unloaded table assumes the first argument is the key")
+
+	keys := NewKeyTable()
+	assert.False(t, keys.Loaded())
+	n, err := keys.Load(redis.NewArray([]*redis.Message{
+		commandInfo("get", 1, 1, 1),
+		commandInfo("mset", 1, -1, 2),
+		commandInfo("json.get", 1, 1, 1),
+		commandInfo("ft.search", 0, 0, 0),
+		redis.NewArray(bulks("malformed")),
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.True(t, keys.Loaded())
+
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, keys.Keys("MSET", redis.NewArray(bulks("MSET", "a", "1", "b", "2"))))
+	key, ok = keys.FirstKey("JSON.GET", redis.NewArray(bulks("JSON.GET", "doc", "$")))
+	assert.True(t, ok)
+	assert.Equal(t, "doc", string(key))
+	_, ok = keys.FirstKey("FT.SEARCH", redis.NewArray(bulks("FT.SEARCH", "idx", "hello")))
+	assert.False(t, ok, "module commands without keys have none")
+	assert.Nil(t, keys.Keys("FT.SEARCH", redis.NewArray(bulks("FT.SEARCH", "idx", "hello"))))
+	_, ok = keys.FirstKey("GET", redis.NewArray(bulks("GET")))
+	assert.False(t, ok)
+
+	_, err = keys.Load(redis.NewErrorf("ERR unknown command 'COMMAND'"))
+	assert.EqualError(t, err, "COMMAND failed: ERR unknown command 'COMMAND'")
+	assert.True(t, keys.Loaded(), "a failed load keeps the previous table")
+}
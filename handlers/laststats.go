@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// LastStats are the timings of a client connection's last request, for PROXY
+// LASTSTATS: the time spent in the proxy, from the request being read to its
+// replies being written, outside of the round trips to the upstream, the time
+// those took, summed, and the node of the last of them
+type LastStats struct {
+	ProxyWait   time.Duration
+	UpstreamRTT time.Duration
+	Node        string
+}
+
+// requestTimings add up the upstream round trips of the request being handled,
+// which those of a split request make at once
+type requestTimings struct {
+	mu       sync.Mutex
+	upstream time.Duration
+	node     string
+}
+
+// roundTrip adds a round trip to node that took elapsed
+func (t *requestTimings) roundTrip(node string, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.upstream += elapsed
+	t.node = node
+}
+
+// reset starts over, for the next request
+func (t *requestTimings) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.upstream, t.node = 0, ""
+}
+
+// recordLastStats keeps the timings of a request answered whole after elapsed,
+// unless it asks for those of the one before it
+func (c *connection) recordLastStats(cmds []string, elapsed time.Duration) {
+	if len(cmds) == 1 && cmds[0] == "PROXY LASTSTATS" {
+		return
+	}
+	c.timings.mu.Lock()
+	defer c.timings.mu.Unlock()
+	c.last = LastStats{UpstreamRTT: c.timings.upstream, Node: c.timings.node}
+	if wait := elapsed - c.timings.upstream; wait > 0 {
+		c.last.ProxyWait = wait
+	}
+}
+
+// proxyLastStats replies with the timings of the connection's last request, as
+// [proxy_wait_us, <n>, upstream_rtt_us, <n>, node, <address>], the layout of a
+// RESP2 HELLO reply. The node is empty for a request the proxy answered itself.
+func (c *connection) proxyLastStats(args []*redis.Message) *redis.Message {
+	if len(args) != 0 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'proxy|laststats' command")
+	}
+	return redis.NewArray([]*redis.Message{
+		redis.NewBulkBytes([]byte("proxy_wait_us")), redis.NewInt([]byte(strconv.FormatInt(c.last.ProxyWait.Microseconds(), 10))),
+		redis.NewBulkBytes([]byte("upstream_rtt_us")), redis.NewInt([]byte(strconv.FormatInt(c.last.UpstreamRTT.Microseconds(), 10))),
+		redis.NewBulkBytes([]byte("node")), redis.NewBulkBytes([]byte(c.last.Node)),
+	})
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// lastStatsRe picks the values out of a PROXY LASTSTATS reply
+var lastStatsRe = regexp.MustCompile(`proxy_wait_us \\r\\n :(\d+) .* upstream_rtt_us \\r\\n :(\d+) .* node \\r\\n \$\d+ \\r\\n (\S*) `)
+
+func lastStats(t *testing.T, reply string) (time.Duration, time.Duration, string) {
+	t.Helper()
+	m := lastStatsRe.FindStringSubmatch(reply)
+	if !assert.NotNil(t, m, reply) {
+		return 0, 0, ""
+	}
+	wait, _ := strconv.Atoi(m[1])
+	rtt, _ := strconv.Atoi(m[2])
+	return time.Duration(wait) * time.Microsecond, time.Duration(rtt) * time.Microsecond, m[3]
+}
+
+func TestProxyLastStats(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if strings.ToUpper(args[0]) == "GET" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = client.Close() }()
+
+	_, rtt, node := lastStats(t, roundTripStrings(t, client, 1, respCommand("PROXY", "LASTSTATS"))[0])
+	assert.Zero(t, rtt, "before any request")
+	assert.Equal(t, "", node)
+
+	roundTripStrings(t, client, 1, respCommand("GET", "k"))
+	want := roundTripStrings(t, client, 1, respCommand("PROXY", "LASTSTATS"))[0]
+	_, rtt, node = lastStats(t, want)
+	assert.GreaterOrEqual(t, int64(rtt), int64(20*time.Millisecond))
+	assert.Equal(t, upstream.Address(), node)
+	assert.Equal(t, want, roundTripStrings(t, client, 1, respCommand("PROXY", "LASTSTATS"))[0], "of the request before, not of itself")
+
+	roundTripStrings(t, client, 1, respCommand("PROXY", "PING"))
+	_, rtt, node = lastStats(t, roundTripStrings(t, client, 1, respCommand("PROXY", "LASTSTATS"))[0])
+	assert.Zero(t, rtt, "answered by the proxy")
+	assert.Equal(t, "", node)
+
+	assert.Equal(t, []string{"-ERR wrong number of arguments for 'proxy|laststats' command \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "LASTSTATS", "x")))
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/coinbase/redisbetween/memwatch"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// shedMemory fails wm fast if the memory watchdog says it should be shed, which
+// spares the process the upstream connection, and the reply, it would otherwise
+// hold on to
+func (c *connection) shedMemory(cmds []string, wm []*redis.Message) error {
+	state := c.opts.Memory.State()
+	if state == memwatch.Normal {
+		return nil
+	}
+	c.warn(WarningMemoryLimit, fmt.Sprintf("the proxy's memory is over its %s limit, large requests are being shed", state))
+	size, critical := 0, true
+	for i, m := range wm {
+		size += messageSize(m)
+		critical = critical && c.isCritical(cmds[i], m)
+	}
+	if !c.opts.Memory.Shed(size, critical) {
+		return nil
+	}
+	metrics.MemoryShed.Incr(c.statsd, state.String())
+	reason := fmt.Sprintf("memory over its %s limit", state)
+	if c.trace != nil {
+		c.trace.add("memory", fmt.Sprintf("%s, shedding a %d byte request", reason, size))
+	}
+	return c.failFast(reason)
+}
+
+// messageSize approximates the memory m takes, counting its values and a few
+// bytes of framing for each element
+func messageSize(m *redis.Message) int {
+	n := len(m.Value) + 16
+	for _, e := range m.Array {
+		n += messageSize(e)
+	}
+	return n
+}
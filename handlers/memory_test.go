@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/coinbase/redisbetween/memwatch"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// newWatchdog returns a watchdog whose limits are already exceeded, checked once
+// so that it is in the state of the lowest of them
+func newWatchdog(t *testing.T, opts memwatch.Options) *memwatch.Watchdog {
+	w, err := memwatch.New(zap.NewNop(), nil, opts)
+	assert.NoError(t, err)
+	t.Cleanup(func() { debug.SetGCPercent(100) })
+	w.Check()
+	return w
+}
+
+func TestMemorySoftLimit(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	w := newWatchdog(t, memwatch.Options{Soft: memwatch.Limit{Bytes: 1}, ShedBytes: 100})
+	assert.Equal(t, memwatch.Soft, w.State())
+	client := runTestConnection(t, upstream.Address(), Options{Memory: w, CriticalCommands: map[string]bool{"SET": true}})
+	defer func() { _ = client.Close() }()
+
+	large := strings.Repeat("x", 200)
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")), "small requests are forwarded")
+	r := roundTripStrings(t, client, 1, respCommand("GET", large))
+	assert.True(t, strings.HasPrefix(r[0], "-PROXYOVERLOADED memory over its soft limit"), r[0])
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SET", "a", large)), "critical requests are never shed")
+	assert.Equal(t, int64(2), upstream.Commands())
+}
+
+func TestMemoryHardLimit(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	w := newWatchdog(t, memwatch.Options{Hard: memwatch.Limit{Bytes: 1}})
+	assert.True(t, w.Refuse())
+	client := runTestConnection(t, upstream.Address(), Options{Memory: w, CriticalCommands: map[string]bool{"PING": true}})
+	defer func() { _ = client.Close() }()
+
+	r := roundTripStrings(t, client, 1, respCommand("GET", "a"))
+	assert.True(t, strings.HasPrefix(r[0], "-PROXYOVERLOADED memory over its hard limit"), r[0])
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PING")))
+	assert.Equal(t, int64(1), upstream.Commands())
+}
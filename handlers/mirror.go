@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/panics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// MirrorOptions configures a Mirror: the writes forwarded, or All the commands,
+// are copied to it, Workers at a time, at most Queue requests waiting. With
+// Compare, its replies are compared with the upstream's.
+type MirrorOptions struct {
+	All          bool
+	Compare      bool
+	Queue        int
+	Workers      int
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// mirrorRequest is a run of commands forwarded upstream, to be sent to the
+// mirror, along with the upstream's replies to compare the mirror's with
+type mirrorRequest struct {
+	cmds    []string
+	wm      []*redis.Message
+	replies []*redis.Message
+	queued  time.Time
+}
+
+// Mirror copies the commands forwarded to an upstream node to a shadow
+// upstream, to try it out with production traffic. The copies are queued and
+// sent in the background, over a pool of the mirror's own, and its replies are
+// read and discarded, or compared and counted, so that the mirror never holds
+// up or fails a request: those that find the queue full aren't mirrored.
+type Mirror struct {
+	log    *zap.Logger
+	statsd *statsd.Client
+	server *pool.Server
+	opts   MirrorOptions
+
+	queue chan mirrorRequest
+	quit  chan struct{}
+	stop  sync.Once
+	wg    sync.WaitGroup
+
+	mirrored, dropped, failed, mismatches int64
+}
+
+// MirrorStats are the requests of a listener copied to its mirror, by what
+// became of them, and the commands the mirror answered unlike the upstream
+type MirrorStats struct {
+	Mirrored   int64 `json:"mirrored"`
+	Queued     int   `json:"queued"`
+	Dropped    int64 `json:"dropped"`
+	Failed     int64 `json:"failed"`
+	Mismatches int64 `json:"mismatches"`
+}
+
+func NewMirror(log *zap.Logger, sd *statsd.Client, server *pool.Server, opts MirrorOptions) *Mirror {
+	return &Mirror{
+		log:    log,
+		statsd: sd,
+		server: server,
+		opts:   opts,
+		queue:  make(chan mirrorRequest, opts.Queue),
+		quit:   make(chan struct{}),
+	}
+}
+
+// Run starts the Workers sending the queued requests to the mirror, until Close
+func (m *Mirror) Run() {
+	for i := 0; i < m.opts.Workers; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+}
+
+func (m *Mirror) work() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.quit:
+			return
+		case r := <-m.queue:
+			m.sendRecovered(r)
+		}
+	}
+}
+
+// sendRecovered is send, recovering a panic so that the worker goes on with the
+// next request
+func (m *Mirror) sendRecovered(r mirrorRequest) {
+	defer panics.Recover(m.log, m.statsd, "mirror", "Mirror worker crashed")
+	m.send(r)
+}
+
+// send sends a request to the mirror and compares its replies with the
+// upstream's, if they were kept
+func (m *Mirror) send(r mirrorRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.ReadTimeout+m.opts.WriteTimeout)
+	res, err := Exchange(ctx, m.log, m.server, r.wm, m.opts.ReadTimeout, m.opts.WriteTimeout)
+	cancel()
+	metrics.MirrorLag.Record(m.statsd, time.Since(r.queued), strconv.FormatBool(err == nil))
+	if err != nil {
+		atomic.AddInt64(&m.failed, 1)
+		metrics.MirrorFailed.Incr(m.statsd)
+		m.log.Debug("Mirroring failed", zap.Strings("commands", r.cmds), zap.Int("replies_read", len(res)), zap.Error(err))
+		return
+	}
+	atomic.AddInt64(&m.mirrored, 1)
+	metrics.MirrorCommands.Count(m.statsd, int64(len(res)))
+	for i, want := range r.replies {
+		if !equalReplies(res[i], want) {
+			atomic.AddInt64(&m.mismatches, 1)
+			metrics.MirrorMismatches.Incr(m.statsd, r.cmds[i])
+			m.log.Debug("Mirror replied unlike the upstream", zap.String("command", r.cmds[i]), zap.String("upstream", want.String()), zap.String("mirror", res[i].String()))
+		}
+	}
+}
+
+// enqueue queues a request for the mirror, unless the queue is full
+func (m *Mirror) enqueue(r mirrorRequest) {
+	select {
+	case m.queue <- r:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+		metrics.MirrorDropped.Incr(m.statsd, "full")
+	}
+}
+
+// Stats returns what became of the requests copied to the mirror so far, nil
+// without a mirror
+func (m *Mirror) Stats() *MirrorStats {
+	if m == nil {
+		return nil
+	}
+	return &MirrorStats{
+		Mirrored:   atomic.LoadInt64(&m.mirrored),
+		Queued:     len(m.queue),
+		Dropped:    atomic.LoadInt64(&m.dropped),
+		Failed:     atomic.LoadInt64(&m.failed),
+		Mismatches: atomic.LoadInt64(&m.mismatches),
+	}
+}
+
+// Report emits the requests waiting to be mirrored
+func (m *Mirror) Report(sd *statsd.Client) {
+	metrics.MirrorQueued.Set(sd, float64(len(m.queue)))
+}
+
+// Close stops the workers, waiting until ctx is done for the requests being
+// sent to the mirror. Those still queued are dropped.
+func (m *Mirror) Close(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	m.stop.Do(func() { close(m.quit) })
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	for {
+		select {
+		case <-m.queue:
+			atomic.AddInt64(&m.dropped, 1)
+			metrics.MirrorDropped.Incr(m.statsd, "closed")
+		default:
+			return
+		}
+	}
+}
+
+// equalReplies is whether a and b are the same reply, nil bulk strings and
+// arrays being told apart from empty ones
+func equalReplies(a, b *redis.Message) bool {
+	if a.Type != b.Type || string(a.Value) != string(b.Value) || (a.Value == nil) != (b.Value == nil) ||
+		len(a.Array) != len(b.Array) || (a.Array == nil) != (b.Array == nil) {
+		return false
+	}
+	for i := range a.Array {
+		if !equalReplies(a.Array[i], b.Array[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// mirror queues the commands of a run forwarded on db for the mirror: the
+// writes the upstream answered, in res, the whole of a transaction it answered
+// that has one, or every command answered with All, along with the replies to
+// compare the mirror's with. Runs of other databases than the default, and runs
+// with a blocking command, which would hold a connection of the mirror, aren't
+// mirrored.
+func (c *connection) mirror(db int, transaction bool, cmds []string, wm, res []*redis.Message) {
+	m := c.opts.Mirror
+	if m == nil || db != c.opts.Database || (transaction && len(res) < len(cmds)) {
+		return
+	}
+	var positions []int
+	for i, cmd := range cmds {
+		if _, ok := blockTimeout(cmd, wm[i]); ok && !transaction {
+			return
+		}
+		if i < len(res) && (m.opts.All || transaction || WriteCommands[cmd]) {
+			positions = append(positions, i)
+		}
+	}
+	if len(positions) == 0 || (transaction && !m.opts.All && !isWrite(cmds)) {
+		return
+	}
+	r := mirrorRequest{cmds: make([]string, len(positions)), wm: make([]*redis.Message, len(positions)), queued: time.Now()}
+	// RESP3 replies are no match for the mirror's, read over RESP2, and a
+	// streamed reply isn't kept
+	compare := m.opts.Compare && !c.speaksRESP3() && !streamed(res)
+	if compare {
+		r.replies = make([]*redis.Message, len(positions))
+	}
+	for j, i := range positions {
+		r.cmds[j], r.wm[j] = cmds[i], wm[i]
+		if compare {
+			r.replies[j] = res[i]
+		}
+	}
+	m.enqueue(r)
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func mirrorTo(t *testing.T, address string, opts MirrorOptions) *Mirror {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	opts.ReadTimeout, opts.WriteTimeout = time.Second, time.Second
+	s := newTestServer(t, address, uint64(opts.Workers))
+	m := NewMirror(zap.NewNop(), sd, s, opts)
+	m.Run()
+	t.Cleanup(func() {
+		m.Close(context.Background())
+		_ = s.Disconnect(context.Background())
+	})
+	return m
+}
+
+func (s *fakeStore) value(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+func TestMirrorWrites(t *testing.T) {
+	_, primary := newFakeStore(t)
+	shadow, mirror := newFakeStore(t)
+	m := mirrorTo(t, mirror.Address(), MirrorOptions{Compare: true, Queue: 10, Workers: 1})
+	client := closingTestConnection(t, primary.Address(), Options{Mirror: m, Readahead: 10})
+
+	// the commands sent together are read ahead into one request
+	assert.Equal(t, []string{"+OK \\r\\n ", "$1 \\r\\n 1 \\r\\n ", ":1 \\r\\n "},
+		roundTripStrings(t, client, 3, respCommand("SET", "a", "1")+respCommand("GET", "a")+respCommand("DEL", "b")))
+	assert.Eventually(t, func() bool { return m.Stats().Mirrored == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, "1", shadow.value("a"))
+	assert.EqualValues(t, 2, mirror.Commands(), "the GET isn't mirrored")
+
+	// a transaction with a write is mirrored whole, and blocking commands never
+	roundTripStrings(t, client, 3, respCommand("MULTI")+respCommand("SET", "c", "1")+respCommand("EXEC"))
+	roundTripStrings(t, client, 1, respCommand("BLPOP", "list", "1"))
+	roundTripStrings(t, client, 1, respCommand("GET", "c"))
+	assert.Eventually(t, func() bool { return m.Stats().Mirrored == 2 }, time.Second, time.Millisecond)
+	assert.EqualValues(t, 5, mirror.Commands())
+	assert.Equal(t, MirrorStats{Mirrored: 2}, *m.Stats())
+}
+
+func TestMirrorCompare(t *testing.T) {
+	primaryStore, primary := newFakeStore(t)
+	shadow, mirror := newFakeStore(t)
+	primaryStore.values["a"], shadow.values["a"] = "1", "2"
+	m := mirrorTo(t, mirror.Address(), MirrorOptions{All: true, Compare: true, Queue: 10, Workers: 2})
+	client := closingTestConnection(t, primary.Address(), Options{Mirror: m, Readahead: 10})
+
+	roundTripStrings(t, client, 3, respCommand("GET", "a")+respCommand("GET", "b")+respCommand("EXISTS", "a"))
+	assert.Eventually(t, func() bool { return m.Stats().Mirrored == 1 }, time.Second, time.Millisecond)
+	assert.EqualValues(t, 1, m.Stats().Mismatches, "only the values of a differ")
+}
+
+func TestMirrorSlow(t *testing.T) {
+	_, primary := newFakeStore(t)
+	release := make(chan struct{})
+	mirror := newFakeUpstream(t, func([]string) *redis.Message {
+		<-release
+		return redis.NewString([]byte("OK"))
+	})
+	t.Cleanup(mirror.Close)
+	m := mirrorTo(t, mirror.Address(), MirrorOptions{Queue: 1, Workers: 1})
+	client := closingTestConnection(t, primary.Address(), Options{Mirror: m})
+
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SET", "a", "1")))
+		assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond), "the slow mirror doesn't hold up the upstream")
+	}
+	assert.GreaterOrEqual(t, m.Stats().Dropped, int64(3), "one is sent and one queued at most")
+	close(release)
+	assert.Eventually(t, func() bool {
+		s := m.Stats()
+		return s.Mirrored+s.Dropped == 5
+	}, time.Second, time.Millisecond)
+}
+
+func TestMirrorDown(t *testing.T) {
+	_, primary := newFakeStore(t)
+	mirror := newFakeUpstream(t, echoKey)
+	mirror.Close()
+	m := mirrorTo(t, mirror.Address(), MirrorOptions{Queue: 10, Workers: 1})
+	client := closingTestConnection(t, primary.Address(), Options{Mirror: m})
+
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SET", "a", "1")))
+	assert.Eventually(t, func() bool { return m.Stats().Failed == 1 }, time.Second, time.Millisecond)
+}
+
+func TestEqualReplies(t *testing.T) {
+	array := func(ms ...*redis.Message) *redis.Message { return redis.NewArray(ms) }
+	bulk := func(s string) *redis.Message { return redis.NewBulkBytes([]byte(s)) }
+	assert.True(t, equalReplies(array(bulk("a"), redis.NewInt([]byte("1"))), array(bulk("a"), redis.NewInt([]byte("1")))))
+	assert.False(t, equalReplies(array(bulk("a")), array(bulk("b"))))
+	assert.False(t, equalReplies(array(bulk("a")), array(bulk("a"), bulk("a"))))
+	assert.False(t, equalReplies(bulk(""), redis.NewBulkBytes(nil)), "a nil bulk string isn't an empty one")
+	assert.False(t, equalReplies(bulk("1"), redis.NewInt([]byte("1"))))
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+)
+
+// Classes of the commands of a command mix
+const (
+	MixClassRead  = "read"
+	MixClassWrite = "write"
+	MixClassOther = "other"
+)
+
+// DefaultMixTop is the number of individual commands a command mix reports
+const DefaultMixTop = 10
+
+// MixCumulative names the counts since the command mix started among its
+// windows, in its metrics
+const MixCumulative = "total"
+
+// MixWindows are the sliding windows command mixes are reported over
+var MixWindows = []struct {
+	Name   string
+	Length time.Duration
+}{{"1m", time.Minute}, {"5m", 5 * time.Minute}, {"1h", time.Hour}}
+
+// mixInterval is the length of the intervals commands are counted in, and how
+// often the mix is reported
+const mixInterval = 10 * time.Second
+
+// mixIntervals covers the longest window, plus the interval being filled
+const mixIntervals = int(time.Hour/mixInterval) + 1
+
+// mixMaxCommands caps the command names a mix counts individually, so that
+// clients sending made up ones can't grow it. Commands beyond it are still
+// counted in their class.
+const mixMaxCommands = 256
+
+const (
+	mixRead = iota
+	mixWrite
+	mixOther
+)
+
+// mixClass is the class of a command, by the tables routing uses: a write if
+// read-only mode rejects it, a read if a read fallback may answer it, and
+// any other command otherwise
+func mixClass(cmd string) int {
+	switch {
+	case WriteCommands[cmd]:
+		return mixWrite
+	case FallbackReadCommands[cmd]:
+		return mixRead
+	}
+	return mixOther
+}
+
+type mixCount struct {
+	interval int64
+	classes  [3]int64
+	commands map[string]int64
+}
+
+func (m *mixCount) add(o *mixCount) {
+	for i, n := range o.classes {
+		m.classes[i] += n
+	}
+	for cmd, n := range o.commands {
+		m.commands[cmd] += n
+	}
+}
+
+// CommandMix counts the commands of an upstream by class, and the individual
+// commands, since it started and in fixed intervals kept in a ring, so that
+// its memory doesn't grow with the traffic
+type CommandMix struct {
+	top int
+	now func() time.Time
+
+	mu        sync.Mutex
+	total     mixCount
+	intervals [mixIntervals]mixCount
+	names     map[string]bool
+	reported  int64
+}
+
+func NewCommandMix(top int) *CommandMix {
+	return &CommandMix{top: top, now: time.Now, total: mixCount{commands: make(map[string]int64)}, names: make(map[string]bool)}
+}
+
+func (m *CommandMix) bucket(now time.Time) *mixCount {
+	interval := now.UnixNano() / int64(mixInterval)
+	b := &m.intervals[interval%int64(mixIntervals)]
+	if b.interval != interval || b.commands == nil {
+		*b = mixCount{interval: interval, commands: make(map[string]int64)}
+	}
+	return b
+}
+
+// Observe counts the commands of a request
+func (m *CommandMix) Observe(cmds []string) {
+	if m == nil {
+		return
+	}
+	now := m.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.bucket(now)
+	for _, cmd := range cmds {
+		class := mixClass(cmd)
+		m.total.classes[class]++
+		b.classes[class]++
+		if !m.names[cmd] {
+			if cmd == "" || len(m.names) >= mixMaxCommands {
+				continue
+			}
+			m.names[cmd] = true
+		}
+		m.total.commands[cmd]++
+		b.commands[cmd]++
+	}
+}
+
+// MixStats is a command mix since it started, and over each of MixWindows
+type MixStats struct {
+	Cumulative MixCount            `json:"cumulative"`
+	Windows    map[string]MixCount `json:"windows"`
+}
+
+// MixCount is the commands of each class, the fraction of the reads and writes
+// that are reads, left out without either, and the most frequent commands
+type MixCount struct {
+	Reads     int64          `json:"reads"`
+	Writes    int64          `json:"writes"`
+	Other     int64          `json:"other"`
+	ReadRatio *float64       `json:"read_ratio,omitempty"`
+	Top       []CommandCount `json:"top"`
+}
+
+// CommandCount is the number of times a command was sent
+type CommandCount struct {
+	Command string `json:"command"`
+	Count   int64  `json:"count"`
+}
+
+func (m *CommandMix) count(c *mixCount) MixCount {
+	mc := MixCount{Reads: c.classes[mixRead], Writes: c.classes[mixWrite], Other: c.classes[mixOther], Top: []CommandCount{}}
+	if rw := mc.Reads + mc.Writes; rw > 0 {
+		ratio := float64(mc.Reads) / float64(rw)
+		mc.ReadRatio = &ratio
+	}
+	for cmd, n := range c.commands {
+		mc.Top = append(mc.Top, CommandCount{Command: cmd, Count: n})
+	}
+	sort.Slice(mc.Top, func(i, j int) bool {
+		if mc.Top[i].Count != mc.Top[j].Count {
+			return mc.Top[i].Count > mc.Top[j].Count
+		}
+		return mc.Top[i].Command < mc.Top[j].Command
+	})
+	if len(mc.Top) > m.top {
+		mc.Top = mc.Top[:m.top]
+	}
+	return mc
+}
+
+// Stats returns the command mix so far
+func (m *CommandMix) Stats() *MixStats {
+	if m == nil {
+		return nil
+	}
+	now := m.now()
+	interval := now.UnixNano() / int64(mixInterval)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &MixStats{Cumulative: m.count(&m.total), Windows: make(map[string]MixCount, len(MixWindows))}
+	for _, w := range MixWindows {
+		sum := mixCount{commands: make(map[string]int64)}
+		for i := interval - int64(w.Length/mixInterval) + 1; i <= interval; i++ {
+			if b := &m.intervals[i%int64(mixIntervals)]; b.interval == i {
+				sum.add(b)
+			}
+		}
+		s.Windows[w.Name] = m.count(&sum)
+	}
+	return s
+}
+
+// Report emits the command mix as gauges once an interval, the cumulative
+// counts tagged with the MixCumulative window
+func (m *CommandMix) Report(sd *statsd.Client) {
+	if m == nil {
+		return
+	}
+	interval := m.now().UnixNano() / int64(mixInterval)
+	m.mu.Lock()
+	due := interval != m.reported
+	m.reported = interval
+	m.mu.Unlock()
+	if !due {
+		return
+	}
+	s := m.Stats()
+	report := func(window string, c MixCount) {
+		metrics.CommandMix.Set(sd, float64(c.Reads), window, MixClassRead)
+		metrics.CommandMix.Set(sd, float64(c.Writes), window, MixClassWrite)
+		metrics.CommandMix.Set(sd, float64(c.Other), window, MixClassOther)
+		for _, t := range c.Top {
+			metrics.CommandMixTop.Set(sd, float64(t.Count), window, t.Command)
+		}
+	}
+	report(MixCumulative, s.Cumulative)
+	for _, w := range MixWindows {
+		report(w.Name, s.Windows[w.Name])
+	}
+}
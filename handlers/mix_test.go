@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandMixWindows(t *testing.T) {
+	m := NewCommandMix(2)
+	now := time.Unix(1700000000, 0)
+	m.now = func() time.Time { return now }
+
+	m.Observe([]string{"GET", "GET", "SET", "PING"})
+	now = now.Add(2 * time.Minute)
+	m.Observe([]string{"GET", "HSET", "HSET", "HSET"})
+
+	s := m.Stats()
+	assert.Equal(t, int64(3), s.Cumulative.Reads)
+	assert.Equal(t, int64(4), s.Cumulative.Writes)
+	assert.Equal(t, int64(1), s.Cumulative.Other)
+	assert.InDelta(t, 3.0/7, *s.Cumulative.ReadRatio, 0.0001)
+	assert.Equal(t, []CommandCount{{"GET", 3}, {"HSET", 3}}, s.Cumulative.Top, "ties go to the first by name")
+
+	assert.Equal(t, MixCount{Reads: 1, Writes: 3, ReadRatio: s.Windows["1m"].ReadRatio, Top: []CommandCount{{"HSET", 3}, {"GET", 1}}}, s.Windows["1m"],
+		"the first request is out of the last minute")
+	assert.Equal(t, s.Cumulative, s.Windows["5m"])
+
+	now = now.Add(2 * time.Hour)
+	s = m.Stats()
+	assert.Equal(t, MixCount{Top: []CommandCount{}}, s.Windows["1h"], "intervals left over from a lap of the ring are ignored")
+	assert.Equal(t, int64(8), s.Cumulative.Reads+s.Cumulative.Writes+s.Cumulative.Other)
+}
+
+func TestCommandMixBounded(t *testing.T) {
+	m := NewCommandMix(DefaultMixTop)
+	for i := 0; i < 2*mixMaxCommands; i++ {
+		m.Observe([]string{fmt.Sprintf("MADEUP%d", i)})
+	}
+	assert.Len(t, m.names, mixMaxCommands)
+	assert.Len(t, m.total.commands, mixMaxCommands)
+	assert.Equal(t, int64(2*mixMaxCommands), m.Stats().Cumulative.Other, "but every command is counted in its class")
+	assert.Len(t, m.Stats().Cumulative.Top, DefaultMixTop)
+
+	var none *CommandMix
+	none.Observe([]string{"GET"})
+	assert.Nil(t, none.Stats())
+}
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// NegativeCommands are the reads a NegativeCache answers, each with the reply
+// redis gives for a missing key
+var NegativeCommands = map[string]*redis.Message{
+	"EXISTS": redis.NewInt([]byte("0")),
+	"TTL":    redis.NewInt([]byte("-2")),
+	"GET":    redis.NewBulkBytes(nil),
+}
+
+// missingReply is the reply redis gives to cmd, one of NegativeCommands, of a
+// missing key, which is null rather than a nil bulk string over RESP3
+func (c *connection) missingReply(cmd string) *redis.Message {
+	if cmd == "GET" && c.speaksRESP3() {
+		return &redis.Message{Type: redis.TypeNull}
+	}
+	return NegativeCommands[cmd]
+}
+
+// negativeEntryBytes is what a NegativeCache accounts for a key it remembers
+// on top of the key itself, for the map entry and its expiry
+const negativeEntryBytes = 64
+
+// NegativeCacheOptions configures a NegativeCache: the keys starting with one of
+// Prefixes that are found missing are remembered for TTL, taking at most
+// MaxBytes
+type NegativeCacheOptions struct {
+	Prefixes []string
+	TTL      time.Duration
+	MaxBytes int
+}
+
+// negativeRead is a read of a key in flight, which a write of the key, or a
+// flush of the database, makes stale, its reply being no proof the key is
+// still missing
+type negativeRead struct {
+	key   string
+	stale bool
+}
+
+// NegativeCache remembers, for a short while, the keys of its prefixes that
+// reads of the default database found missing, and answers the lone
+// NegativeCommands of those keys without a round trip. It is only sound for
+// keys written through the proxy alone: the NegativeCache is a KeyCache of its
+// database, which has it forget the keys written through every listener of the
+// process, before the write is forwarded and again once it has been answered,
+// along with the reads of them in flight, whose reply the write may have made
+// out of date by the time it arrives.
+type NegativeCache struct {
+	opts NegativeCacheOptions
+
+	mu      sync.Mutex
+	missing map[string]time.Time
+	bytes   int
+	reading map[string]map[*negativeRead]bool
+}
+
+func NewNegativeCache(opts NegativeCacheOptions) *NegativeCache {
+	return &NegativeCache{opts: opts, missing: make(map[string]time.Time), reading: make(map[string]map[*negativeRead]bool)}
+}
+
+func (n *NegativeCache) matches(key string) bool {
+	for _, p := range n.opts.Prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup is whether key is known missing at now, or else the read of it that
+// the caller sends, to pass to done with its reply
+func (n *NegativeCache) lookup(key string, now time.Time) (bool, *negativeRead) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if expires, ok := n.missing[key]; ok {
+		if now.Before(expires) {
+			return true, nil
+		}
+		n.remove(key)
+	}
+	r := &negativeRead{key: key}
+	if n.reading[key] == nil {
+		n.reading[key] = make(map[*negativeRead]bool)
+	}
+	n.reading[key][r] = true
+	return false, r
+}
+
+// done ends the read r, remembering its key missing at now if the reply said
+// so and no write made it stale in the meantime. It returns why the key wasn't
+// remembered, if it was missing.
+func (n *NegativeCache) done(r *negativeRead, missing bool, now time.Time) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.reading[r.key], r)
+	if len(n.reading[r.key]) == 0 {
+		delete(n.reading, r.key)
+	}
+	switch {
+	case !missing:
+		return ""
+	case r.stale:
+		return "written"
+	}
+	if _, ok := n.missing[r.key]; !ok {
+		size := len(r.key) + negativeEntryBytes
+		if n.bytes+size > n.opts.MaxBytes {
+			n.sweep(now)
+		}
+		if n.bytes+size > n.opts.MaxBytes {
+			return "full"
+		}
+		n.bytes += size
+	}
+	n.missing[r.key] = now.Add(n.opts.TTL)
+	return ""
+}
+
+// sweep drops the keys that expired, with mu held
+func (n *NegativeCache) sweep(now time.Time) {
+	for k, expires := range n.missing {
+		if !now.Before(expires) {
+			n.remove(k)
+		}
+	}
+}
+
+func (n *NegativeCache) remove(key string) {
+	delete(n.missing, key)
+	n.bytes -= len(key) + negativeEntryBytes
+}
+
+// ForgetKey forgets that key is missing, and makes the reads of it in flight
+// stale, because it was written
+func (n *NegativeCache) ForgetKey(key string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for r := range n.reading[key] {
+		r.stale = true
+	}
+	_, ok := n.missing[key]
+	if ok {
+		n.remove(key)
+	}
+	return ok
+}
+
+// ClearDB forgets every key, and makes every read in flight stale
+func (n *NegativeCache) ClearDB() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, reads := range n.reading {
+		for r := range reads {
+			r.stale = true
+		}
+	}
+	n.missing, n.bytes = make(map[string]time.Time), 0
+}
+
+// Report sweeps the keys that expired, and emits the keys remembered and the
+// bytes they take
+func (n *NegativeCache) Report(sd *statsd.Client) {
+	n.mu.Lock()
+	n.sweep(time.Now())
+	keys, bytes := len(n.missing), n.bytes
+	n.mu.Unlock()
+	metrics.NegativeCacheKeys.Set(sd, float64(keys))
+	metrics.NegativeCacheBytes.Set(sd, float64(bytes))
+}
+
+// negativeKey is the key of a run of commands that the NegativeCache answers,
+// a lone NegativeCommands of one key of its prefixes, sent on the default
+// database
+func (c *connection) negativeKey(db int, cmds []string, wm []*redis.Message) (string, bool) {
+	n := c.opts.NegativeCache
+	if n == nil || db != c.opts.Database || len(cmds) != 1 || NegativeCommands[cmds[0]] == nil || len(wm[0].Array) != 2 {
+		return "", false
+	}
+	key := string(wm[0].Array[1].Value)
+	return key, n.matches(key)
+}
+
+// negativeForward forwards a run of commands, unless it is a read of a key the
+// NegativeCache knows missing, which is answered as such
+func (c *connection) negativeForward(db int, cmds []string, wm []*redis.Message) ([]*redis.Message, *zap.Logger, error) {
+	key, ok := c.negativeKey(db, cmds, wm)
+	if !ok {
+		return c.coalescedForward(db, cmds, wm)
+	}
+	n := c.opts.NegativeCache
+	hit, r := n.lookup(key, time.Now())
+	if hit {
+		metrics.NegativeCacheHits.Incr(c.statsd)
+		if c.trace != nil {
+			c.trace.add("negcache", cmds[0]+" answered, the key is known missing")
+		}
+		return []*redis.Message{c.missingReply(cmds[0])}, c.log, nil
+	}
+	metrics.NegativeCacheMisses.Incr(c.statsd)
+	res, l, err := c.coalescedForward(db, cmds, wm)
+	missing := err == nil && len(res) == 1 && sameReply(res[0], c.missingReply(cmds[0]))
+	if why := n.done(r, missing, time.Now()); why != "" {
+		metrics.NegativeCacheSkipped.Incr(c.statsd, why)
+	}
+	return res, l, err
+}
+
+// sameReply is whether a is the reply b, a nil bulk string being told apart
+// from an empty one
+func sameReply(a, b *redis.Message) bool {
+	return a.Type == b.Type && string(a.Value) == string(b.Value) && len(a.Array) == 0 &&
+		(a.Type != redis.TypeBulkBytes || (a.Value == nil) == (b.Value == nil))
+}
+
+// forgetWritten has the KeyCaches of the databases forget the keys that the
+// writes of a run of commands change, which is done before the writes are
+// forwarded and again once they have been answered, since a read forwarded
+// in between may still find them missing
+func (c *connection) forgetWritten(db int, cmds []string, wm []*redis.Message) {
+	if !c.opts.Databases.hasKeyCaches() {
+		return
+	}
+	for i, cmd := range cmds {
+		if inv, ok := Invalidates(cmd, wm[i]); ok {
+			c.forgetKeys(db, inv)
+		}
+	}
+}
+
+// forgetKeys has the KeyCaches of the databases forget the data inv, of a write
+// sent on db, invalidates
+func (c *connection) forgetKeys(db int, inv Invalidation) {
+	if n := c.opts.Databases.Forget(c.opts.Upstream, db, inv); n > 0 {
+		metrics.NegativeCacheInvalidations.Count(c.statsd, int64(n))
+	}
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStore is a fake upstream keeping the strings SET, answering EXISTS, TTL
+// and GET from them. A read of the key held is answered as it was when it
+// arrived, once held is released.
+type fakeStore struct {
+	mu     sync.Mutex
+	values map[string]string
+	held   string
+	hold   chan struct{}
+}
+
+func newFakeStore(t *testing.T) (*fakeStore, *fakeUpstream) {
+	s := &fakeStore{values: make(map[string]string)}
+	upstream := newFakeUpstream(t, s.handle)
+	t.Cleanup(upstream.Close)
+	return s, upstream
+}
+
+func (s *fakeStore) handle(args []string) *redis.Message {
+	s.mu.Lock()
+	v, ok := s.values[args[len(args)-1]]
+	var reply *redis.Message
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		s.values[args[1]] = args[2]
+		reply = redis.NewString([]byte("OK"))
+	case "DEL":
+		delete(s.values, args[1])
+		reply = redis.NewInt([]byte("1"))
+	case "EXISTS":
+		reply = redis.NewInt([]byte("0"))
+		if ok {
+			reply = redis.NewInt([]byte("1"))
+		}
+	case "TTL":
+		reply = redis.NewInt([]byte("-2"))
+		if ok {
+			reply = redis.NewInt([]byte("-1"))
+		}
+	case "GET":
+		reply = redis.NewBulkBytes(nil)
+		if ok {
+			reply = redis.NewBulkBytes([]byte(v))
+		}
+	default:
+		reply = redis.NewString([]byte("OK"))
+	}
+	hold := s.hold
+	if args[len(args)-1] != s.held {
+		hold = nil
+	}
+	s.mu.Unlock()
+	if hold != nil {
+		<-hold
+	}
+	return reply
+}
+
+func negativeTestOptions(n *NegativeCache) (Options, func()) {
+	d := NewDatabases()
+	unregister := d.Register("upstream", 0, n)
+	return Options{NegativeCache: n, Databases: d, Upstream: "upstream"}, unregister
+}
+
+func TestNegativeCacheAnswersMisses(t *testing.T) {
+	_, upstream := newFakeStore(t)
+	n := NewNegativeCache(NegativeCacheOptions{Prefixes: []string{"flag:"}, TTL: 50 * time.Millisecond, MaxBytes: 1 << 20})
+	opts, unregister := negativeTestOptions(n)
+	defer unregister()
+	client := closingTestConnection(t, upstream.Address(), opts)
+
+	assert.Equal(t, []string{"$-1 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "flag:a")))
+	assert.EqualValues(t, 1, upstream.Commands())
+	assert.Equal(t, []string{":0 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("EXISTS", "flag:a")))
+	assert.Equal(t, []string{":-2 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("TTL", "flag:a")))
+	assert.Equal(t, []string{"$-1 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "flag:a")))
+	assert.EqualValues(t, 1, upstream.Commands(), "answered as missing without a round trip")
+
+	// other keys and reads of several keys are sent upstream
+	assert.Equal(t, []string{":0 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("EXISTS", "other")))
+	assert.Equal(t, []string{":0 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("EXISTS", "other")))
+	assert.Equal(t, []string{":0 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("EXISTS", "flag:a", "flag:b")))
+	assert.EqualValues(t, 4, upstream.Commands())
+
+	// until the TTL is over
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, []string{":0 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("EXISTS", "flag:a")))
+	assert.EqualValues(t, 5, upstream.Commands())
+}
+
+func TestNegativeCacheWriteThenExists(t *testing.T) {
+	_, upstream := newFakeStore(t)
+	n := NewNegativeCache(NegativeCacheOptions{Prefixes: []string{"flag:"}, TTL: time.Minute, MaxBytes: 1 << 20})
+	opts, unregister := negativeTestOptions(n)
+	defer unregister()
+	reader := closingTestConnection(t, upstream.Address(), opts)
+	writer := closingTestConnection(t, upstream.Address(), opts)
+
+	assert.Equal(t, []string{":0 \\r\\n "}, roundTripStrings(t, reader, 1, respCommand("EXISTS", "flag:a")))
+	roundTripStrings(t, writer, 1, respCommand("SET", "flag:a", "1"))
+	assert.Equal(t, []string{":1 \\r\\n "}, roundTripStrings(t, reader, 1, respCommand("EXISTS", "flag:a")))
+	roundTripStrings(t, writer, 1, respCommand("DEL", "flag:a"))
+
+	for _, write := range [][]string{{"SET", "flag:a", "1"}, {"MSET", "flag:a", "1"}, {"FLUSHDB"}, {"EVAL", "return 1", "0"}} {
+		assert.Equal(t, []string{":0 \\r\\n "}, roundTripStrings(t, reader, 1, respCommand("EXISTS", "flag:a")))
+		assert.Equal(t, []string{":0 \\r\\n "}, roundTripStrings(t, reader, 1, respCommand("EXISTS", "flag:a")))
+		before := upstream.Commands()
+		roundTripStrings(t, writer, 1, respCommand(write...))
+		roundTripStrings(t, reader, 1, respCommand("EXISTS", "flag:a"))
+		assert.EqualValues(t, before+2, upstream.Commands(), "the EXISTS right after %v is sent upstream", write)
+		roundTripStrings(t, writer, 1, respCommand("DEL", "flag:a"))
+	}
+}
+
+func TestNegativeCacheWriteDuringRead(t *testing.T) {
+	s, upstream := newFakeStore(t)
+	n := NewNegativeCache(NegativeCacheOptions{Prefixes: []string{"flag:"}, TTL: time.Minute, MaxBytes: 1 << 20})
+	opts, unregister := negativeTestOptions(n)
+	defer unregister()
+	reader := closingTestConnection(t, upstream.Address(), opts)
+	writer := closingTestConnection(t, upstream.Address(), opts)
+
+	// the EXISTS is answered by the upstream before the SET arrives, and its
+	// reply only once the SET has been
+	s.mu.Lock()
+	s.held, s.hold = "flag:a", make(chan struct{})
+	s.mu.Unlock()
+	done := make(chan []string)
+	go func() { done <- roundTripStrings(t, reader, 1, respCommand("EXISTS", "flag:a")) }()
+	assert.Eventually(t, func() bool { return upstream.Commands() == 1 }, time.Second, time.Millisecond)
+	s.mu.Lock()
+	s.held = ""
+	s.mu.Unlock()
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, writer, 1, respCommand("SET", "flag:a", "1")))
+	close(s.hold)
+	assert.Equal(t, []string{":0 \\r\\n "}, <-done)
+
+	assert.Equal(t, []string{":1 \\r\\n "}, roundTripStrings(t, reader, 1, respCommand("EXISTS", "flag:a")),
+		"the reply the SET made out of date isn't remembered")
+	assert.Empty(t, n.missing)
+}
+
+func TestNegativeCacheMaxBytes(t *testing.T) {
+	n := NewNegativeCache(NegativeCacheOptions{Prefixes: []string{"flag:"}, TTL: time.Second, MaxBytes: 2 * (6 + negativeEntryBytes)})
+	now := time.Now()
+	remember := func(key string, at time.Time) string {
+		_, r := n.lookup(key, at)
+		return n.done(r, true, at)
+	}
+	assert.Equal(t, "", remember("flag:a", now))
+	assert.Equal(t, "", remember("flag:b", now.Add(time.Second/2)))
+	assert.Equal(t, "full", remember("flag:c", now.Add(time.Second/2)))
+	hit, _ := n.lookup("flag:a", now.Add(time.Second/2))
+	assert.True(t, hit)
+	assert.Equal(t, 2*(6+negativeEntryBytes), n.bytes)
+
+	assert.Equal(t, "", remember("flag:c", now.Add(3*time.Second/2)), "the expired keys make room")
+	assert.Len(t, n.missing, 1)
+	assert.True(t, n.ForgetKey("flag:c"))
+	assert.Equal(t, 0, n.bytes)
+	assert.Empty(t, n.reading)
+}
+
+func TestNegativeCacheTransactions(t *testing.T) {
+	upstream := newFakeTransactions(t)
+	n := NewNegativeCache(NegativeCacheOptions{Prefixes: []string{"flag:"}, TTL: time.Minute, MaxBytes: 1 << 20})
+	opts, unregister := negativeTestOptions(n)
+	defer unregister()
+	opts.Transactions = &Transactions{IdleTimeout: time.Second}
+	client := closingTestConnection(t, upstream.li.Addr().String(), opts)
+	remember := func() {
+		_, r := n.lookup("flag:a", time.Now())
+		n.done(r, true, time.Now())
+	}
+
+	roundTripStrings(t, client, 2, respCommand("MULTI"), respCommand("SET", "flag:a", "1"))
+	// a read sent before the EXEC still finds the key missing
+	remember()
+	roundTripStrings(t, client, 1, respCommand("EXEC"))
+	assert.Empty(t, n.missing, "forgotten once the EXEC ran the SET")
+
+	roundTripStrings(t, client, 2, respCommand("MULTI"), respCommand("SET", "flag:a", "1"))
+	remember()
+	roundTripStrings(t, client, 1, respCommand("DISCARD"))
+	assert.Len(t, n.missing, 1, "a SET discarded changes nothing")
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/coinbase/redisbetween/panics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// recoverPanic recovers a panic handling the connection, logging it with the
+// connection's id and last command, and closes the connection. Any upstream
+// connection it held was closed as the panic unwound, rather than given back
+// to its pool. With panics.SetCrash, the panic crashes the process instead.
+func (c *connection) recoverPanic() {
+	if !panics.Recovering() {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	panics.Recovered(c.connLog, c.statsd, "client", "Connection crashed", r,
+		zap.Uint64("id", c.id), zap.String("socket", c.address), zap.String("last_command", lastCommand(c.request)), zap.String("client_library", c.client.library()))
+	_ = c.conn.Close()
+}
+
+// destroyOnPanic is deferred after whatever gives an upstream connection back to
+// its pool: if the handler panics, destroy closes the connection first, the
+// panic having maybe left it in the middle of a request, and the panic goes on
+// up to the connection's recovery
+func destroyOnPanic(destroy func()) {
+	if r := recover(); r != nil {
+		destroy()
+		panic(r)
+	}
+}
+
+// lastCommand is the name of the last command of a request, without its
+// arguments
+func lastCommand(wm []*redis.Message) string {
+	if len(wm) == 0 {
+		return ""
+	}
+	if m := wm[len(wm)-1]; m != nil && m.IsArray() && len(m.Array) > 0 && m.Array[0] != nil {
+		return strings.ToUpper(string(m.Array[0].Value))
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func countedTestServer(t *testing.T, upstream string) (*pool.Server, *poolCounts) {
+	counts := &poolCounts{}
+	s, err := pool.ConnectServer(pool.Address(upstream),
+		pool.WithMaxConnections(func(uint64) uint64 { return 2 }),
+		pool.WithConnectionPoolMonitor(func(*pool.Monitor) *pool.Monitor { return counts.monitor() }))
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = s.Disconnect(context.Background()) })
+	return s, counts
+}
+
+func TestPanicRecovered(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	t.Cleanup(upstream.Close)
+	s, counts := countedTestServer(t, upstream.Address())
+	core, logs := observer.New(zapcore.ErrorLevel)
+	// the interceptor, which is handed the replies of every request, panics on
+	// that of GET boom
+	interceptor := func(_ []string, replies []*redis.Message) {
+		if len(replies) > 0 && string(replies[0].Value) == "boom-value" {
+			panic("boom")
+		}
+	}
+	serve := func(id uint64) (net.Conn, chan struct{}) {
+		client, server := net.Pipe()
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			CommandConnection(zap.New(core), nil, server, "test", time.Second, time.Second, id, s, make(chan interface{}), interceptor, Options{})
+		}()
+		t.Cleanup(func() { _ = client.Close() })
+		return client, done
+	}
+
+	crashed, done := serve(1)
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, crashed, 1, respCommand("GET", "a")))
+	go func() { _, _ = crashed.Write([]byte(respCommand("GET", "boom"))) }()
+	_, err := crashed.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "the client connection that panicked is closed")
+	<-done
+
+	entries := logs.FilterMessage("Connection crashed").All()
+	if assert.Len(t, entries, 1) {
+		fields := entries[0].ContextMap()
+		assert.Equal(t, "client", fields["component"])
+		assert.Equal(t, "boom", fields["panic"])
+		assert.Equal(t, uint64(1), fields["id"])
+		assert.Equal(t, "GET", fields["last_command"])
+		assert.Contains(t, fields["stack"], "TestPanicRecovered")
+	}
+	assert.Zero(t, atomic.LoadInt64(&counts.checkedOut))
+	assert.Zero(t, atomic.LoadInt64(&counts.negative))
+
+	// and everyone else is served as usual
+	other, _ := serve(2)
+	assert.Equal(t, []string{"$7 \\r\\n b-value \\r\\n "}, roundTripStrings(t, other, 1, respCommand("GET", "b")))
+}
+
+func TestPanicDestroysUpstreamConnection(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	t.Cleanup(upstream.Close)
+	s, counts := countedTestServer(t, upstream.Address())
+	conn, err := s.Connection(context.Background())
+	assert.NoError(t, err)
+	func() {
+		defer func() { assert.Equal(t, "boom", recover()) }()
+		defer func() { _ = conn.Return() }()
+		defer destroyOnPanic(func() { _ = conn.Close() })
+		panic("boom")
+	}()
+	assert.Zero(t, atomic.LoadInt64(&counts.checkedOut))
+	assert.Zero(t, atomic.LoadInt64(&counts.open), "the connection held through the panic is closed, not pooled")
+	assert.Zero(t, atomic.LoadInt64(&counts.negative))
+}
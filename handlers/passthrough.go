@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// PassthroughCommands are the reads answered with an aggregate of values, as
+// large as the values they read, that never holds an error, whose replies may
+// be relayed as the bytes the upstream sent without their elements parsed
+var PassthroughCommands = map[string]bool{
+	"HGETALL":          true,
+	"HKEYS":            true,
+	"HMGET":            true,
+	"HVALS":            true,
+	"LRANGE":           true,
+	"MGET":             true,
+	"SDIFF":            true,
+	"SINTER":           true,
+	"SMEMBERS":         true,
+	"SUNION":           true,
+	"XRANGE":           true,
+	"XREVRANGE":        true,
+	"ZRANGE":           true,
+	"ZRANGEBYSCORE":    true,
+	"ZREVRANGE":        true,
+	"ZREVRANGEBYSCORE": true,
+}
+
+// passesThrough returns the commands of a request forwarded whose replies are
+// read unparsed: those of PassthroughCommands, outside of a transaction, whose
+// reply nothing of the proxy looks into. A mirror comparing every reply does,
+// and so does a Checksums verifying the values of an MGET, while those split
+// into chunks are merged from replies to commands of their own, which aren't
+// among them. nil if there are none.
+func (c *connection) passesThrough(transaction bool, cmds []string, wm []*redis.Message) map[*redis.Message]bool {
+	if transaction {
+		return nil
+	}
+	if m := c.opts.Mirror; m != nil && m.opts.All && m.opts.Compare {
+		return nil
+	}
+	var unparsed map[*redis.Message]bool
+	for i, cmd := range cmds {
+		if !PassthroughCommands[cmd] || (cmd == "MGET" && c.checksummed(wm[i])) {
+			continue
+		}
+		if unparsed == nil {
+			unparsed = make(map[*redis.Message]bool)
+		}
+		unparsed[wm[i]] = true
+	}
+	return unparsed
+}
+
+// checksummed is whether any of the keys of a multi-key read is one a
+// Checksums verifies the value of
+func (c *connection) checksummed(m *redis.Message) bool {
+	if c.opts.Checksums == nil {
+		return false
+	}
+	for _, k := range m.Array[1:] {
+		if c.opts.Checksums.matches(k.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// unparsedReplies are the positions of wm, being sent upstream, whose replies
+// are read unparsed, nil if there are none
+func (c *connection) unparsedReplies(wm []*redis.Message) []bool {
+	if len(c.unparsed) == 0 {
+		return nil
+	}
+	var positions []bool
+	for i, m := range wm {
+		if !c.unparsed[m] {
+			continue
+		}
+		if positions == nil {
+			positions = make([]bool, len(wm))
+		}
+		positions[i] = true
+	}
+	return positions
+}
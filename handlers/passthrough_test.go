@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func passthroughCommands(commands ...[]string) ([]string, []*redis.Message) {
+	cmds := make([]string, len(commands))
+	wm := make([]*redis.Message, len(commands))
+	for i, args := range commands {
+		cmds[i] = args[0]
+		array := make([]*redis.Message, len(args))
+		for j, a := range args {
+			array[j] = redis.NewBulkBytes([]byte(a))
+		}
+		wm[i] = redis.NewArray(array)
+	}
+	return cmds, wm
+}
+
+func TestPassesThrough(t *testing.T) {
+	cmds, wm := passthroughCommands(
+		[]string{"MGET", "a", "b"},
+		[]string{"GET", "a"},
+		[]string{"HGETALL", "h"},
+		[]string{"MGET", "a", "blob:1"},
+	)
+	c := &connection{}
+	assert.Equal(t, map[*redis.Message]bool{wm[0]: true, wm[2]: true, wm[3]: true}, c.passesThrough(false, cmds, wm))
+	assert.Nil(t, c.passesThrough(true, cmds, wm), "nor are the replies inside a transaction")
+
+	c.opts.Checksums = NewChecksums([]string{"blob:"})
+	assert.Equal(t, map[*redis.Message]bool{wm[0]: true, wm[2]: true}, c.passesThrough(false, cmds, wm), "the values of checksummed keys are verified")
+
+	c.opts.Mirror = &Mirror{opts: MirrorOptions{All: true}}
+	assert.Len(t, c.passesThrough(false, cmds, wm), 2, "a mirror that doesn't compare replies doesn't look into them")
+	c.opts.Mirror.opts.Compare = true
+	assert.Nil(t, c.passesThrough(false, cmds, wm))
+
+	c.opts.Mirror = nil
+	c.unparsed = c.passesThrough(false, cmds, wm)
+	assert.Equal(t, []bool{false, true, false}, c.unparsedReplies([]*redis.Message{wm[1], wm[0], wm[3]}))
+	assert.Nil(t, c.unparsedReplies(wm[1:2]))
+}
+
+func TestPassthroughRelayed(t *testing.T) {
+	// length headers with leading zeros, which re-encoding would drop
+	replies := map[string][]byte{
+		"k1":   []byte("*3\r\n$02\r\nv1\r\n$-1\r\n$02\r\nv3\r\n"),
+		"+":    []byte("*2\r\n*2\r\n$03\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n*2\r\n$3\r\n2-0\r\n*0\r\n"),
+		"-1":   []byte("*0\r\n"),
+		"h":    []byte("*4\r\n$1\r\nf\r\n$01\r\nv\r\n$1\r\ng\r\n$1\r\nw\r\n"),
+		"a":    []byte("$05\r\nvalue\r\n"),
+		"none": []byte("*-1\r\n"),
+	}
+	received := make(chan []byte, 100)
+	upstream := newRawUpstream(t, replies, received)
+	defer func() { _ = upstream.Close() }()
+	client := runTestConnection(t, upstream.Addr().String(), Options{})
+	defer func() { _ = client.Close() }()
+
+	var pipeline, expected bytes.Buffer
+	for _, args := range [][]string{
+		{"MGET", "k3", "k2", "k1"},
+		{"XRANGE", "s", "-", "+"},
+		{"GET", "a"},
+		{"LRANGE", "l", "0", "-1"},
+		{"HGETALL", "h"},
+		{"SMEMBERS", "none"},
+	} {
+		pipeline.WriteString(respCommand(args...))
+		expected.Write(replies[args[len(args)-1]])
+	}
+	go func() { _, _ = client.Write(pipeline.Bytes()) }()
+	got := make([]byte, expected.Len())
+	_, err := io.ReadFull(client, got)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.String(), string(got), "relayed byte for byte, in order")
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCred reads the pid and uid of the process at the other end of a unix
+// socket with SO_PEERCRED, which other connections have none of
+func peerCred(conn net.Conn) (pid int32, uid uint32, ok bool) {
+	sc, isSyscall := conn.(syscall.Conn)
+	if !isSyscall {
+		return 0, 0, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return 0, 0, false
+	}
+	return cred.Pid, cred.Uid, true
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerCred(t *testing.T) {
+	li, err := net.Listen("unix", filepath.Join(t.TempDir(), "peer.sock"))
+	assert.NoError(t, err)
+	defer func() { _ = li.Close() }()
+	client, err := net.Dial("unix", li.Addr().String())
+	assert.NoError(t, err)
+	defer func() { _ = client.Close() }()
+	conn, err := li.Accept()
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	pid, uid, ok := peerCred(conn)
+	assert.True(t, ok)
+	assert.Equal(t, int32(os.Getpid()), pid)
+	assert.Equal(t, uint32(os.Getuid()), uid)
+
+	a, b := net.Pipe()
+	defer func() { _ = a.Close(); _ = b.Close() }()
+	_, _, ok = peerCred(a)
+	assert.False(t, ok, "only unix sockets have peer credentials")
+}
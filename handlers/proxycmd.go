@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coinbase/redisbetween/internal/workload"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// MaxBenchDuration caps PROXY BENCH runs, since the client connection running it
+// is blocked until it finishes
+const MaxBenchDuration = 30 * time.Second
+
+// MaxBenchConcurrency caps the connections a PROXY BENCH run opens
+const MaxBenchConcurrency = 64
+
+// Socket maps an upstream address and database to the local socket serving it
+type Socket struct {
+	Upstream string `json:"upstream"`
+	Database int    `json:"database"`
+	Local    string `json:"local"`
+}
+
+func isProxyCommand(cmd string) bool {
+	return cmd == "PROXY" || strings.HasPrefix(cmd, "PROXY ")
+}
+
+// proxyCommand answers PROXY commands, which let clients ask the proxy about
+// itself. They are never forwarded, since redis has no such command.
+func (c *connection) proxyCommand(cmd string, m *redis.Message) *redis.Message {
+	switch cmd {
+	case "PROXY SOCKETS":
+		return c.proxySockets()
+	case "PROXY BENCH":
+		return c.proxyBench(m.Array[2:])
+	case "PROXY TRACE":
+		return c.proxyTrace(m.Array[2:])
+	case "PROXY SCHEMA":
+		return c.proxySchema()
+	case "PROXY LASTSTATS":
+		return c.proxyLastStats(m.Array[2:])
+	case "PROXY WARNINGS":
+		return c.proxyWarnings(m.Array[2:])
+	case "PROXY HANDOFF":
+		return c.proxyHandOff(m.Array[2:])
+	case "PROXY CHECKSUM":
+		return c.proxyChecksum(m.Array[2:])
+	case "PROXY ATOMIC":
+		// a START or END is part of a group, and never answered here
+		return redis.NewErrorf("ERR PROXY ATOMIC takes START or END")
+	case "PROXY PING":
+		// answered without touching an upstream, so it checks the proxy alone
+		return redis.NewString([]byte("PONG"))
+	}
+	return redis.NewErrorf("ERR unknown PROXY subcommand '%s'", strings.TrimPrefix(strings.TrimPrefix(cmd, "PROXY"), " "))
+}
+
+// proxySockets replies with an [upstream, database, local socket] entry for each
+// socket the proxy listens on
+func (c *connection) proxySockets() *redis.Message {
+	if c.opts.Sockets == nil {
+		return redis.NewArray([]*redis.Message{})
+	}
+	sockets := c.opts.Sockets()
+	entries := make([]*redis.Message, len(sockets))
+	for i, s := range sockets {
+		entries[i] = redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte(s.Upstream)),
+			redis.NewInt([]byte(strconv.Itoa(s.Database))),
+			redis.NewBulkBytes([]byte(s.Local)),
+		})
+	}
+	return redis.NewArray(entries)
+}
+
+// proxyHandOff stops accepting on the socket the client connected to, for the
+// successor the client is, which takes its path once answered OK. The
+// connections accepted before are served until they close.
+func (c *connection) proxyHandOff(args []*redis.Message) *redis.Message {
+	if len(args) != 0 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'proxy|handoff' command")
+	}
+	if c.opts.HandOff == nil {
+		return redis.NewErrorf("ERR PROXY HANDOFF is not available")
+	}
+	if err := c.opts.HandOff(c.address); err != nil {
+		return redis.NewErrorf("ERR PROXY HANDOFF failed: %v", err)
+	}
+	return redis.NewString([]byte("OK"))
+}
+
+// proxySchema replies with the schema of the metrics and admin stats as JSON
+func (c *connection) proxySchema() *redis.Message {
+	if c.opts.Schema == nil {
+		return redis.NewErrorf("ERR PROXY SCHEMA is not available")
+	}
+	b, err := json.Marshal(c.opts.Schema())
+	if err != nil {
+		return redis.NewErrorf("ERR PROXY SCHEMA failed: %v", err)
+	}
+	return redis.NewBulkBytes(b)
+}
+
+// proxyBench runs a synthetic workload through the proxy and replies with its
+// results as JSON. Options are name value pairs: DURATION (seconds), CONCURRENCY,
+// PIPELINE, VALUESIZE, KEYSPACE and MIX (e.g. get:80,set:20).
+func (c *connection) proxyBench(args []*redis.Message) *redis.Message {
+	if c.opts.Bench == nil {
+		return redis.NewErrorf("ERR PROXY BENCH is not available")
+	}
+	cfg := workload.DefaultConfig()
+	cfg.Duration = time.Second
+	for ; len(args) > 0; args = args[2:] {
+		opt := strings.ToUpper(string(args[0].Value))
+		if len(args) < 2 {
+			return redis.NewErrorf("ERR missing value for PROXY BENCH option '%s'", opt)
+		}
+		value := string(args[1].Value)
+		var err error
+		switch opt {
+		case "MIX":
+			cfg.Mix, err = workload.ParseMix(value)
+		case "DURATION":
+			var seconds float64
+			seconds, err = strconv.ParseFloat(value, 64)
+			cfg.Duration = time.Duration(seconds * float64(time.Second))
+			if err == nil && (cfg.Duration <= 0 || cfg.Duration > MaxBenchDuration) {
+				return redis.NewErrorf("ERR PROXY BENCH duration must be between 0 and %v", MaxBenchDuration)
+			}
+		case "CONCURRENCY":
+			cfg.Concurrency, err = strconv.Atoi(value)
+		case "PIPELINE":
+			cfg.Pipeline, err = strconv.Atoi(value)
+		case "VALUESIZE":
+			cfg.ValueSize, err = strconv.Atoi(value)
+		case "KEYSPACE":
+			cfg.Keyspace, err = strconv.Atoi(value)
+		default:
+			return redis.NewErrorf("ERR unknown PROXY BENCH option '%s'", opt)
+		}
+		if err != nil {
+			return redis.NewErrorf("ERR invalid value for PROXY BENCH option '%s': %v", opt, err)
+		}
+	}
+
+	if cfg.Concurrency < 1 || cfg.Concurrency > MaxBenchConcurrency {
+		return redis.NewErrorf("ERR PROXY BENCH concurrency must be between 1 and %d", MaxBenchConcurrency)
+	}
+
+	res, err := c.opts.Bench(cfg)
+	if err != nil {
+		return redis.NewErrorf("ERR PROXY BENCH failed: %v", err)
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		return redis.NewErrorf("ERR PROXY BENCH failed: %v", err)
+	}
+	return redis.NewBulkBytes(b)
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/internal/workload"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxySockets(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+
+	client := runTestConnection(t, upstream.Address(), Options{Sockets: func() []Socket {
+		return []Socket{
+			{Upstream: "10.0.0.1:6379", Database: -1, Local: "/var/tmp/redisbetween-10.0.0.1-6379.sock"},
+			{Upstream: "10.0.0.1:6379", Database: 2, Local: "/var/tmp/redisbetween-10.0.0.1-6379-2.sock"},
+		}
+	}})
+	defer func() { _ = client.Close() }()
+
+	assert.Equal(t, []string{
+		"*2 \\r\\n " +
+			"*3 \\r\\n $13 \\r\\n 10.0.0.1:6379 \\r\\n :-1 \\r\\n $40 \\r\\n /var/tmp/redisbetween-10.0.0.1-6379.sock \\r\\n " +
+			"*3 \\r\\n $13 \\r\\n 10.0.0.1:6379 \\r\\n :2 \\r\\n $42 \\r\\n /var/tmp/redisbetween-10.0.0.1-6379-2.sock \\r\\n ",
+	}, roundTripStrings(t, client, 1, respCommand("proxy", "sockets")))
+	assert.Equal(t, []string{"+PONG \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "PING")))
+	assert.Equal(t, []string{"-ERR unknown PROXY subcommand 'NOPE' \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "nope")))
+	assert.Equal(t, []string{"-ERR unknown PROXY subcommand '' \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY")))
+	assert.Equal(t, int64(0), upstream.Commands())
+}
+
+func TestProxyBench(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+
+	var ran workload.Config
+	client := runTestConnection(t, upstream.Address(), Options{Bench: func(cfg workload.Config) (workload.Result, error) {
+		ran = cfg
+		return workload.Result{Target: "proxy", Ops: 10, Throughput: 10, P50: time.Millisecond}, nil
+	}})
+	defer func() { _ = client.Close() }()
+
+	reply := roundTripStrings(t, client, 1, respCommand("PROXY", "BENCH", "duration", "0.5", "concurrency", "2", "pipeline", "10", "mix", "get:1"))
+	assert.Contains(t, reply[0], `"ops":10`)
+	assert.Contains(t, reply[0], `"p50_ns":1000000`)
+	assert.Equal(t, 500*time.Millisecond, ran.Duration)
+	assert.Equal(t, 2, ran.Concurrency)
+	assert.Equal(t, 10, ran.Pipeline)
+	assert.Equal(t, map[string]int{"GET": 1}, ran.Mix)
+	assert.True(t, ran.Signals)
+
+	assert.Equal(t, []string{"-ERR PROXY BENCH duration must be between 0 and 30s \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "BENCH", "DURATION", "60")))
+	assert.Equal(t, []string{"-ERR PROXY BENCH concurrency must be between 1 and 64 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "BENCH", "CONCURRENCY", "0")))
+	assert.Equal(t, []string{"-ERR unknown PROXY BENCH option 'NOPE' \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "BENCH", "nope", "1")))
+	assert.Equal(t, []string{"-ERR missing value for PROXY BENCH option 'PIPELINE' \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "BENCH", "PIPELINE")))
+	assert.Equal(t, int64(0), upstream.Commands())
+}
+
+func TestProxyBenchUnavailable(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+
+	client := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = client.Close() }()
+	assert.Equal(t, []string{"-ERR PROXY BENCH is not available \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "BENCH")))
+}
+
+func TestProxySchema(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+
+	client := runTestConnection(t, upstream.Address(), Options{Schema: func() interface{} {
+		return map[string]int{"version": 3}
+	}})
+	defer func() { _ = client.Close() }()
+	assert.Equal(t, []string{"$13 \\r\\n {\"version\":3} \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "SCHEMA")))
+
+	other := runTestConnection(t, upstream.Address(), Options{})
+	defer func() { _ = other.Close() }()
+	assert.Equal(t, []string{"-ERR PROXY SCHEMA is not available \\r\\n "}, roundTripStrings(t, other, 1, respCommand("PROXY", "SCHEMA")))
+	assert.Equal(t, int64(0), upstream.Commands())
+}
@@ -0,0 +1,551 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// SubscribeCommands are the commands that put a connection in subscribe mode
+var SubscribeCommands = map[string]bool{
+	"SUBSCRIBE":  true,
+	"PSUBSCRIBE": true,
+	"SSUBSCRIBE": true,
+}
+
+// SubscribeModeCommands are the commands redis allows in subscribe mode, with
+// the kind of subscription those that subscribe or unsubscribe are for
+var SubscribeModeCommands = map[string]string{
+	"SUBSCRIBE":    "channel",
+	"UNSUBSCRIBE":  "channel",
+	"PSUBSCRIBE":   "pattern",
+	"PUNSUBSCRIBE": "pattern",
+	"SSUBSCRIBE":   "shard",
+	"SUNSUBSCRIBE": "shard",
+	"PING":         "",
+	"QUIT":         "",
+	"RESET":        "",
+}
+
+// PubSub is the pool of the upstream connections pinned to subscribed clients.
+// A client's lone SUBSCRIBE, PSUBSCRIBE or SSUBSCRIBE checks one out for it
+// alone, which the messages it is pushed are relayed from as they come, and
+// its commands are sent over as redis allows them in subscribe mode, others
+// being answered with the error redis would. Once the client has unsubscribed
+// from everything, or sent RESET, the connection is RESET and returned to the
+// pool, and the client is served as any other again. It is closed instead if
+// the client disconnects or QUITs while subscribed.
+//
+// The messages pushed wait to be written to a slow client in a buffer of its
+// own. Once over MaxBytes of them wait, or one has waited longer than MaxAge,
+// Overflow tells what is done: the client is disconnected, the oldest dropped,
+// or its pinned connection no longer read until the buffer is back under
+// MaxBytes. A MaxBytes or MaxAge of 0 isn't enforced.
+type PubSub struct {
+	Server   *pool.Server
+	MaxBytes int
+	MaxAge   time.Duration
+	Overflow string
+
+	pinned  int64
+	dropped int64
+	stalls  int64
+}
+
+// The overflow policies of the messages pushed that wait for a slow subscriber
+const (
+	OverflowDisconnect   = "disconnect"
+	OverflowDropOldest   = "drop-oldest"
+	OverflowBackpressure = "backpressure"
+)
+
+// DroppedChannel is the channel of the message that stands for those dropped by
+// drop-oldest, in their place, its payload being how many were
+const DroppedChannel = "redisbetween:dropped"
+
+// Pinned is the number of upstream connections pinned to subscribed clients
+func (p *PubSub) Pinned() int64 {
+	return atomic.LoadInt64(&p.pinned)
+}
+
+// isSubscribe is whether a request is a lone subscribe that pins an upstream
+// connection
+func (c *connection) isSubscribe(wm []*redis.Message, b requestBoundaries) bool {
+	if c.opts.PubSub == nil || c.speaksRESP3() || len(wm) != 1 || b.pipelined || b.late > 0 || b.quit || b.invalid != nil {
+		return false
+	}
+	m := wm[0]
+	return m.IsArray() && len(m.Array) > 0 && SubscribeCommands[strings.ToUpper(string(m.Array[0].Value))]
+}
+
+// subscription is a client's upstream connection pinned to it while it is
+// subscribed
+type subscription struct {
+	c    *connection
+	l    *zap.Logger
+	conn *pool.Connection
+	dec  *redis.Decoder
+
+	// mu is held while the client's commands are written upstream, and its
+	// replies and messages written to it, along with the state below
+	mu sync.Mutex
+	// subscribed are the subscriptions of each kind as of the commands written,
+	// which tell how many replies an unsubscribe from everything gets
+	subscribed map[string]map[string]bool
+	// pending is the number of replies the commands written still have to get,
+	// and counts the subscriptions the last replies of each kind tell of
+	pending int
+	counts  map[string]int64
+	// returned is whether the subscription ended with the connection back in
+	// the pool, closed whether it ended with the connection closed, and reset
+	// whether the client sent RESET
+	returned bool
+	closed   bool
+	reset    bool
+	// out are what waits to be written to the client, oldest first, and
+	// outBytes the size of the messages pushed among them, peak being the
+	// most it has been. ready is signalled as they change, and flushed closed
+	// once the writer is done.
+	out      []delivery
+	outBytes int
+	peak     int
+	ready    *sync.Cond
+	flushed  chan struct{}
+}
+
+// delivery is what is written to a subscribed client at once: replies, a
+// message pushed to it, read at, or for drop-oldest the marker of how many
+// messages were dropped in its place
+type delivery struct {
+	msgs      []*redis.Message
+	pipelined bool
+	pushed    bool
+	size      int
+	at        time.Time
+	dropped   int64
+}
+
+// pinSubscription serves a client from its SUBSCRIBE m until its subscription
+// ends, a nil error then leaving the request that follows it unread to be
+// handled as usual
+func (c *connection) pinSubscription(l *zap.Logger, m *redis.Message) error {
+	conn, err := c.checkoutConnection(c.opts.PubSub.Server)
+	if err != nil {
+		code, ok := forwardErrorCode(err)
+		if !ok {
+			code = proxyerr.Unavailable
+		}
+		return WriteWireMessages(c.ctx, l, []*redis.Message{c.proxyError(code, "%v", err)}, c.conn, c.address, c.id, 0, false, c.conn.Close)
+	}
+	l = l.With(zap.Uint64("upstream_id", conn.ID()))
+	atomic.AddInt64(&c.opts.PubSub.pinned, 1)
+	s := &subscription{c: c, l: l, conn: conn, dec: redis.NewDecoder(conn.Conn()), subscribed: make(map[string]map[string]bool), counts: make(map[string]int64), flushed: make(chan struct{})}
+	s.ready = sync.NewCond(&s.mu)
+	go s.deliver()
+	// the client is served as any other, or disconnected, only once what was
+	// queued for it is written
+	defer func() { <-s.flushed }()
+	// a panic ends the subscription with its connection closed, for what was
+	// queued to be delivered first, as for a client that went away
+	defer destroyOnPanic(func() {
+		_ = s.locked(func() error {
+			s.closeLocked("panicked")
+			return nil
+		})
+	})
+
+	if err := s.locked(func() error { return s.send(m) }); err != nil {
+		return err
+	}
+	go s.relay()
+
+	for {
+		c.signaled = false
+		wm, late, err := readWireMessages(c.readCtx, l, c.reader, c.address, c.id, 0, 1, c.checksSignals(), 0, c.conn.Close, c, nil)
+		if err == nil {
+			c.request = wm
+		}
+		done := false
+		err = s.locked(func() error {
+			if s.returned {
+				if err == nil {
+					c.unread, c.unreadLate = wm, late
+				}
+				done = true
+				return err
+			}
+			if err != nil {
+				s.closeLocked("client_closed")
+				done = true
+				return err
+			}
+			return s.handle(wm)
+		})
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// locked runs fn with the subscription locked, unlocking it even if fn panics
+func (s *subscription) locked(fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn()
+}
+
+// handle answers or sends the messages of a request read in subscribe mode. A
+// pipeline is refused whole, since the replies to its commands would be mixed
+// up with the messages pushed.
+func (s *subscription) handle(wm []*redis.Message) error {
+	c := s.c
+	if len(wm) > 1 {
+		replies := make([]*redis.Message, len(wm))
+		for i := range replies {
+			replies[i] = c.proxyError(proxyerr.Blocked, "pipelines are unsupported in subscribe mode")
+		}
+		s.toClient(replies, true)
+		return nil
+	}
+	for _, m := range wm {
+		cmd := ""
+		if m.IsArray() && len(m.Array) > 0 {
+			cmd = strings.ToUpper(string(m.Array[0].Value))
+		}
+		if cmd == "QUIT" {
+			// the reply is the last thing written, so the connection is closed
+			// rather than reset
+			s.toClient([]*redis.Message{redis.NewString([]byte("OK"))}, false)
+			s.closeLocked("quit")
+			return errQuit
+		}
+		if _, ok := SubscribeModeCommands[cmd]; !ok {
+			s.toClient([]*redis.Message{redis.NewErrorf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(cmd))}, false)
+			continue
+		}
+		if err := s.send(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send writes a command of the client upstream, counting the replies it gets:
+// one for each channel of a subscribe or unsubscribe, as many as there are
+// subscriptions of its kind for an unsubscribe from all of them, and one for
+// anything else, errors included
+func (s *subscription) send(m *redis.Message) error {
+	cmd := strings.ToUpper(string(m.Array[0].Value))
+	kind := SubscribeModeCommands[cmd]
+	args := m.Array[1:]
+	replies := 1
+	if kind != "" {
+		set := s.subscribed[kind]
+		if set == nil {
+			set = make(map[string]bool)
+			s.subscribed[kind] = set
+		}
+		unsubscribe := strings.Contains(cmd, "UNSUBSCRIBE")
+		switch {
+		case unsubscribe && len(args) == 0:
+			if len(set) > 0 {
+				replies = len(set)
+			}
+			s.subscribed[kind] = nil
+		case len(args) > 0:
+			replies = len(args)
+			for _, a := range args {
+				if unsubscribe {
+					delete(set, string(a.Value))
+				} else {
+					set[string(a.Value)] = true
+				}
+			}
+		}
+	}
+	if cmd == "RESET" {
+		s.subscribed = make(map[string]map[string]bool)
+		s.reset = true
+	}
+	s.pending += replies
+	err := WriteWireMessages(s.c.ctx, s.l, []*redis.Message{m}, s.conn.Conn(), s.conn.Address().String(), s.conn.ID(), s.c.writeTimeout, false, s.conn.Close)
+	if err != nil {
+		s.closeLocked("upstream_failed")
+	}
+	return err
+}
+
+// toClient queues replies to be written to the client, padded for the signals
+// of a pipeline
+func (s *subscription) toClient(replies []*redis.Message, pipelined bool) {
+	s.out = append(s.out, delivery{msgs: replies, pipelined: pipelined})
+	s.ready.Broadcast()
+}
+
+// deliver writes what is queued for the client, oldest first, until the
+// subscription has ended and nothing is left
+func (s *subscription) deliver() {
+	defer close(s.flushed)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for len(s.out) == 0 && !s.closed && !s.returned {
+			s.ready.Wait()
+		}
+		// messages may have grown too old while the last write was blocked
+		s.overflowLocked(time.Now())
+		if len(s.out) == 0 {
+			if s.closed || s.returned {
+				return
+			}
+			continue
+		}
+		d := s.out[0]
+		s.out[0] = delivery{}
+		s.out = s.out[1:]
+		s.outBytes -= d.size
+		s.ready.Broadcast()
+		if d.dropped > 0 {
+			d.msgs = []*redis.Message{s.droppedMarker(d.dropped)}
+		}
+		s.mu.Unlock()
+		err := WriteWireMessages(s.c.ctx, s.l, d.msgs, s.c.conn, s.c.address, s.c.id, s.c.writeTimeout, d.pipelined, s.c.conn.Close)
+		s.mu.Lock()
+		if err != nil {
+			s.closeLocked("client_closed")
+			s.out, s.outBytes = nil, 0
+			return
+		}
+	}
+}
+
+// relay queues what the pinned connection reads for the client, as it comes,
+// until the subscription ends
+func (s *subscription) relay() {
+	_ = s.conn.Conn().SetReadDeadline(time.Time{})
+	for {
+		m, err := s.dec.DecodeFrame()
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		if err != nil {
+			s.l.Warn("Pinned subscription connection failed", zap.Error(err))
+			s.closeLocked("upstream_failed")
+			// the client is disconnected too, having lost its subscriptions
+			_ = s.c.conn.Close()
+			s.mu.Unlock()
+			return
+		}
+		if pushedMessage(m) {
+			s.pushLocked(m)
+			if s.closed {
+				s.mu.Unlock()
+				return
+			}
+		} else {
+			s.toClient([]*redis.Message{m}, false)
+		}
+		if s.observe(m) {
+			s.returnLocked()
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+// pushedMessage is whether m is a message published to what the client is
+// subscribed to, rather than the reply to one of its commands
+func pushedMessage(m *redis.Message) bool {
+	if (m.Type != redis.TypeArray && m.Type != redis.TypePush) || len(m.Array) == 0 {
+		return false
+	}
+	switch strings.ToLower(string(m.Array[0].Value)) {
+	case "message", "pmessage", "smessage":
+		return true
+	}
+	return false
+}
+
+// pushLocked queues a message pushed to the client. With backpressure, the
+// pinned connection isn't read again until the buffer is back under MaxBytes.
+func (s *subscription) pushLocked(m *redis.Message) {
+	ps := s.c.opts.PubSub
+	now := time.Now()
+	s.out = append(s.out, delivery{msgs: []*redis.Message{m}, pushed: true, size: len(m.Raw), at: now})
+	s.outBytes += len(m.Raw)
+	if s.outBytes > s.peak {
+		s.peak = s.outBytes
+	}
+	s.ready.Broadcast()
+	s.overflowLocked(now)
+	if ps.Overflow != OverflowBackpressure || ps.MaxBytes <= 0 || s.outBytes <= ps.MaxBytes {
+		return
+	}
+	atomic.AddInt64(&ps.stalls, 1)
+	metrics.PubSubOverflow.Incr(s.c.statsd, "backpressure", "bytes")
+	for s.outBytes > ps.MaxBytes && !s.closed && !s.returned {
+		s.ready.Wait()
+	}
+}
+
+// overflowLocked disconnects the client, or drops the oldest messages pushed,
+// once the buffer is over MaxBytes or its oldest message older than MaxAge
+func (s *subscription) overflowLocked(now time.Time) {
+	ps := s.c.opts.PubSub
+	if ps.Overflow != OverflowDisconnect && ps.Overflow != OverflowDropOldest {
+		return
+	}
+	reason := s.overflowReason(now)
+	if reason == "" {
+		return
+	}
+	if ps.Overflow == OverflowDisconnect {
+		metrics.PubSubOverflow.Incr(s.c.statsd, "disconnect", reason)
+		s.l.Warn("Disconnecting a subscriber too slow to read the messages it is pushed", zap.String("reason", reason), zap.Int("buffered_bytes", s.outBytes))
+		s.out, s.outBytes = nil, 0
+		s.closeLocked("slow_subscriber")
+		_ = s.c.conn.Close()
+		return
+	}
+	// the oldest messages are dropped until the rest are within the limits, a
+	// marker taking their place
+	out := make([]delivery, 0, len(s.out))
+	var dropped int64
+	for _, d := range s.out {
+		over := ps.MaxBytes > 0 && s.outBytes > ps.MaxBytes || ps.MaxAge > 0 && now.Sub(d.at) > ps.MaxAge
+		if !d.pushed || !over {
+			out = append(out, d)
+			continue
+		}
+		s.outBytes -= d.size
+		dropped++
+		if n := len(out); n > 0 && out[n-1].dropped > 0 {
+			out[n-1].dropped++
+		} else {
+			out = append(out, delivery{dropped: 1})
+		}
+	}
+	s.out = out
+	atomic.AddInt64(&ps.dropped, dropped)
+	metrics.PubSubOverflow.Incr(s.c.statsd, "drop_oldest", reason)
+	metrics.PubSubDropped.Count(s.c.statsd, dropped)
+	s.l.Debug("Dropped the oldest messages pushed to a slow subscriber", zap.String("reason", reason), zap.Int64("dropped", dropped))
+}
+
+// overflowReason is why the buffer is over its limits, bytes or age, if it is
+func (s *subscription) overflowReason(now time.Time) string {
+	ps := s.c.opts.PubSub
+	if ps.MaxBytes > 0 && s.outBytes > ps.MaxBytes {
+		return "bytes"
+	}
+	if ps.MaxAge > 0 {
+		for _, d := range s.out {
+			if d.pushed {
+				if now.Sub(d.at) > ps.MaxAge {
+					return "age"
+				}
+				break
+			}
+		}
+	}
+	return ""
+}
+
+// droppedMarker is the message pushed on DroppedChannel in place of n dropped
+// ones
+func (s *subscription) droppedMarker(n int64) *redis.Message {
+	m := redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("message")), redis.NewBulkBytes([]byte(DroppedChannel)), redis.NewBulkBytes([]byte(strconv.FormatInt(n, 10)))})
+	if s.c.protocol() == 3 {
+		m.Type = redis.TypePush
+	}
+	return m
+}
+
+// observe accounts for a message read from the pinned connection, returning
+// whether the subscription is over: every reply is in, and the last ones tell
+// of no subscriptions left
+func (s *subscription) observe(m *redis.Message) bool {
+	if m.IsArray() && len(m.Array) > 0 {
+		switch kind := strings.ToLower(string(m.Array[0].Value)); kind {
+		case "message", "pmessage", "smessage":
+			return false
+		case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ssubscribe", "sunsubscribe":
+			if len(m.Array) == 3 && m.Array[2].IsInt() {
+				count, _ := strconv.ParseInt(string(m.Array[2].Value), 10, 64)
+				// channels and patterns are counted together, shard channels
+				// on their own
+				if kind == "ssubscribe" || kind == "sunsubscribe" {
+					s.counts["shard"] = count
+				} else {
+					s.counts["channel"] = count
+				}
+			}
+		}
+	}
+	if m.IsString() && strings.EqualFold(string(m.Value), "RESET") {
+		s.counts = make(map[string]int64)
+	}
+	s.pending--
+	return s.pending <= 0 && s.counts["channel"] == 0 && s.counts["shard"] == 0
+}
+
+// returnLocked resets the connection of a subscription that is over and
+// returns it to the pool, or closes it if that fails
+func (s *subscription) returnLocked() {
+	reset := redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("RESET"))})
+	conn := s.conn
+	err := WriteWireMessages(s.c.ctx, s.l, []*redis.Message{reset}, conn.Conn(), conn.Address().String(), conn.ID(), s.c.writeTimeout, false, conn.Close)
+	if err == nil {
+		_ = conn.Conn().SetReadDeadline(time.Now().Add(s.c.readTimeout))
+		for {
+			var m *redis.Message
+			if m, err = s.dec.Decode(); err != nil || (m.IsString() && strings.EqualFold(string(m.Value), "RESET")) {
+				break
+			}
+		}
+	}
+	if err != nil {
+		s.l.Debug("Failed to reset the connection of a subscription that is over", zap.Error(err))
+		s.closeLocked("upstream_failed")
+		return
+	}
+	end := "unsubscribed"
+	if s.reset {
+		end = "reset"
+	}
+	_ = conn.Return()
+	s.returned = true
+	s.ended(end)
+	s.ready.Broadcast()
+}
+
+// closeLocked ends the subscription with its connection closed, unless it has
+// ended already
+func (s *subscription) closeLocked(end string) {
+	if s.closed || s.returned {
+		return
+	}
+	_ = s.conn.Close()
+	_ = s.conn.Return()
+	s.closed = true
+	s.ended(end)
+	s.ready.Broadcast()
+}
+
+func (s *subscription) ended(end string) {
+	atomic.AddInt64(&s.c.opts.PubSub.pinned, -1)
+	metrics.PubSubSessions.Incr(s.c.statsd, end)
+	metrics.PubSubBufferPeak.Record(s.c.statsd, float64(s.peak))
+	s.l.Debug("Subscription ended", zap.String("end", end))
+}
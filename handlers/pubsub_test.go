@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePubSub is an upstream that subscribes its connections to channels and
+// publishes to them, as redis does in RESP2
+type fakePubSub struct {
+	li   net.Listener
+	mu   sync.Mutex
+	subs map[net.Conn]map[string]bool
+}
+
+func newFakePubSub(t *testing.T) *fakePubSub {
+	t.Helper()
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	f := &fakePubSub{li: li, subs: make(map[net.Conn]map[string]bool)}
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = li.Close() })
+	return f
+}
+
+func pubSubReply(kind string, channel string, n int) *redis.Message {
+	ch := redis.NewBulkBytes(nil)
+	if channel != "" {
+		ch = redis.NewBulkBytes([]byte(channel))
+	}
+	return redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte(kind)), ch, redis.NewInt([]byte(strconv.Itoa(n)))})
+}
+
+func (f *fakePubSub) serve(conn net.Conn) {
+	defer func() {
+		f.mu.Lock()
+		delete(f.subs, conn)
+		f.mu.Unlock()
+		_ = conn.Close()
+	}()
+	d := redis.NewDecoder(conn)
+	for {
+		m, err := d.Decode()
+		if err != nil {
+			return
+		}
+		args := make([]string, len(m.Array))
+		for i, a := range m.Array {
+			args[i] = string(a.Value)
+		}
+		f.mu.Lock()
+		subs := f.subs[conn]
+		var replies []*redis.Message
+		switch strings.ToUpper(args[0]) {
+		case "SUBSCRIBE":
+			if subs == nil {
+				subs = make(map[string]bool)
+				f.subs[conn] = subs
+			}
+			for _, ch := range args[1:] {
+				subs[ch] = true
+				replies = append(replies, pubSubReply("subscribe", ch, len(subs)))
+			}
+		case "UNSUBSCRIBE":
+			chs := args[1:]
+			if len(chs) == 0 {
+				for ch := range subs {
+					chs = append(chs, ch)
+				}
+				sort.Strings(chs)
+			}
+			for _, ch := range chs {
+				delete(subs, ch)
+				replies = append(replies, pubSubReply("unsubscribe", ch, len(subs)))
+			}
+			if len(replies) == 0 {
+				replies = append(replies, pubSubReply("unsubscribe", "", 0))
+			}
+		case "PUBLISH":
+			n := 0
+			for c, s := range f.subs {
+				if s[args[1]] {
+					n++
+					_ = redis.Encode(c, redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("message")), redis.NewBulkBytes([]byte(args[1])), redis.NewBulkBytes([]byte(args[2]))}))
+				}
+			}
+			replies = append(replies, redis.NewInt([]byte(strconv.Itoa(n))))
+		case "PING":
+			if len(subs) > 0 {
+				replies = append(replies, redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("pong")), redis.NewBulkBytes([]byte{})}))
+			} else {
+				replies = append(replies, redis.NewString([]byte("PONG")))
+			}
+		case "RESET":
+			delete(f.subs, conn)
+			replies = append(replies, redis.NewString([]byte("RESET")))
+		default:
+			replies = append(replies, redis.NewBulkBytes([]byte(args[len(args)-1])))
+		}
+		for _, r := range replies {
+			_ = redis.Encode(conn, r)
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakePubSub) publish(t *testing.T, channel, message string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", f.li.Addr().String())
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Write([]byte(respCommand("PUBLISH", channel, message)))
+	assert.NoError(t, err)
+	_, err = redis.NewDecoder(conn).Decode()
+	assert.NoError(t, err)
+}
+
+func TestPubSubPinning(t *testing.T) {
+	upstream := newFakePubSub(t)
+	pinned := newTestServer(t, upstream.li.Addr().String(), 1)
+	defer func() { _ = pinned.Disconnect(context.Background()) }()
+	ps := &PubSub{Server: pinned}
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{PubSub: ps})
+
+	assert.Equal(t, []string{pubSubReply("subscribe", "a", 1).String(), pubSubReply("subscribe", "b", 2).String()},
+		roundTripStrings(t, client, 2, respCommand("SUBSCRIBE", "a", "b")))
+	assert.Equal(t, int64(1), ps.Pinned())
+
+	upstream.publish(t, "a", "hi")
+	assert.Equal(t, []string{"*3 \\r\\n $7 \\r\\n message \\r\\n $1 \\r\\n a \\r\\n $2 \\r\\n hi \\r\\n "}, roundTripStrings(t, client, 1))
+
+	assert.Equal(t, []string{
+		"-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context \\r\\n ",
+		"*2 \\r\\n $4 \\r\\n pong \\r\\n $0 \\r\\n  \\r\\n ",
+	}, roundTripStrings(t, client, 2, respCommand("GET", "k"), respCommand("PING")))
+
+	assert.Equal(t, []string{pubSubReply("unsubscribe", "a", 1).String(), pubSubReply("unsubscribe", "b", 0).String()},
+		roundTripStrings(t, client, 2, respCommand("UNSUBSCRIBE")))
+	assert.Eventually(t, func() bool { return ps.Pinned() == 0 }, time.Second, time.Millisecond)
+
+	assert.Equal(t, []string{"$1 \\r\\n k \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "k")),
+		"served as any other client once unsubscribed")
+	assert.Equal(t, []string{pubSubReply("subscribe", "c", 1).String()}, roundTripStrings(t, client, 1, respCommand("SUBSCRIBE", "c")),
+		"the pool's only connection was reset and returned")
+
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("QUIT")))
+	_, err := redis.NewDecoder(client).Decode()
+	assert.Error(t, err, "the client is disconnected")
+	assert.Eventually(t, func() bool { return ps.Pinned() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestPubSubReset(t *testing.T) {
+	upstream := newFakePubSub(t)
+	pinned := newTestServer(t, upstream.li.Addr().String(), 1)
+	defer func() { _ = pinned.Disconnect(context.Background()) }()
+	ps := &PubSub{Server: pinned}
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{PubSub: ps})
+
+	roundTripStrings(t, client, 1, respCommand("SUBSCRIBE", "a"))
+	assert.Equal(t, []string{"+RESET \\r\\n "}, roundTripStrings(t, client, 1, respCommand("RESET")))
+	assert.Eventually(t, func() bool { return ps.Pinned() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"$1 \\r\\n k \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "k")))
+}
+
+func TestPubSubClientClosed(t *testing.T) {
+	upstream := newFakePubSub(t)
+	pinned := newTestServer(t, upstream.li.Addr().String(), 1)
+	defer func() { _ = pinned.Disconnect(context.Background()) }()
+	ps := &PubSub{Server: pinned}
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{PubSub: ps})
+
+	roundTripStrings(t, client, 1, respCommand("SUBSCRIBE", "a"))
+	_ = client.Close()
+	assert.Eventually(t, func() bool { return ps.Pinned() == 0 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		return len(upstream.subs) == 0
+	}, time.Second, time.Millisecond, "the pinned connection is closed rather than returned subscribed")
+}
+
+func TestPubSubUnsupported(t *testing.T) {
+	upstream := newFakePubSub(t)
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{})
+	assert.Equal(t, []string{"-PROXYBLOCKED SUBSCRIBE is unsupported \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SUBSCRIBE", "a")))
+}
+
+// slowSubscriber subscribes a client to a, and publishes n messages to it that
+// the client doesn't read yet
+func slowSubscriber(t *testing.T, ps *PubSub, n int) (*fakePubSub, net.Conn) {
+	t.Helper()
+	upstream := newFakePubSub(t)
+	pinned := newTestServer(t, upstream.li.Addr().String(), 1)
+	t.Cleanup(func() { _ = pinned.Disconnect(context.Background()) })
+	ps.Server = pinned
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{PubSub: ps})
+	roundTripStrings(t, client, 1, respCommand("SUBSCRIBE", "a"))
+	for i := 0; i < n; i++ {
+		upstream.publish(t, "a", fmt.Sprintf("m%02d", i))
+	}
+	return upstream, client
+}
+
+// readMessages pings the subscribed client, returning the payloads of the
+// messages it is pushed until the pong, and how many the dropped markers
+// among them stand for
+func readMessages(t *testing.T, client net.Conn) ([]string, int64) {
+	t.Helper()
+	go func() { _, _ = client.Write([]byte(respCommand("PING"))) }()
+	d := redis.NewDecoder(client)
+	var payloads []string
+	var dropped int64
+	for {
+		m, err := d.Decode()
+		if !assert.NoError(t, err) || !pushedMessage(m) {
+			return payloads, dropped
+		}
+		if string(m.Array[1].Value) == DroppedChannel {
+			n, _ := strconv.ParseInt(string(m.Array[2].Value), 10, 64)
+			dropped += n
+			continue
+		}
+		payloads = append(payloads, string(m.Array[2].Value))
+	}
+}
+
+// pubSubMessageSize is the size of a message of readMessages' subscription
+var pubSubMessageSize = len("*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$3\r\nm00\r\n")
+
+func TestPubSubOverflowDisconnect(t *testing.T) {
+	ps := &PubSub{MaxBytes: 3 * pubSubMessageSize, Overflow: OverflowDisconnect}
+	upstream, client := slowSubscriber(t, ps, 10)
+	assert.Eventually(t, func() bool { return ps.Pinned() == 0 }, time.Second, time.Millisecond)
+	assert.Less(t, len(readUntilClosed(t, client)), 10, "disconnected with messages left unwritten")
+	assert.Eventually(t, func() bool {
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		return len(upstream.subs) == 0
+	}, time.Second, time.Millisecond, "the pinned connection is closed")
+}
+
+func TestPubSubOverflowDropOldest(t *testing.T) {
+	ps := &PubSub{MaxBytes: 3 * pubSubMessageSize, Overflow: OverflowDropOldest}
+	_, client := slowSubscriber(t, ps, 10)
+	// at most one message is being written while three wait
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&ps.dropped) >= 6 }, time.Second, time.Millisecond)
+
+	payloads, dropped := readMessages(t, client)
+	assert.Equal(t, atomic.LoadInt64(&ps.dropped), dropped, "the markers tell of every message dropped")
+	assert.Equal(t, int64(10), int64(len(payloads))+dropped)
+	if assert.True(t, len(payloads) >= 3) {
+		assert.Equal(t, []string{"m07", "m08", "m09"}, payloads[len(payloads)-3:], "the newest are kept")
+	}
+	assert.Equal(t, int64(1), ps.Pinned(), "still subscribed")
+}
+
+func TestPubSubOverflowDropOldestByAge(t *testing.T) {
+	ps := &PubSub{MaxAge: 200 * time.Millisecond, Overflow: OverflowDropOldest}
+	upstream, client := slowSubscriber(t, ps, 3)
+	time.Sleep(300 * time.Millisecond)
+	upstream.publish(t, "a", "m03")
+	// the first message may be being written
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&ps.dropped) >= 2 }, time.Second, time.Millisecond)
+
+	payloads, dropped := readMessages(t, client)
+	assert.Equal(t, atomic.LoadInt64(&ps.dropped), dropped)
+	assert.Equal(t, int64(4), int64(len(payloads))+dropped)
+}
+
+func TestPubSubOverflowBackpressure(t *testing.T) {
+	ps := &PubSub{MaxBytes: 3 * pubSubMessageSize, Overflow: OverflowBackpressure}
+	_, client := slowSubscriber(t, ps, 10)
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&ps.stalls) >= 1 }, time.Second, time.Millisecond,
+		"the pinned connection is no longer read")
+
+	payloads, dropped := readMessages(t, client)
+	assert.Zero(t, dropped)
+	assert.Equal(t, []string{"m00", "m01", "m02", "m03", "m04", "m05", "m06", "m07", "m08", "m09"}, payloads, "every message, in order")
+	assert.Equal(t, int64(1), ps.Pinned())
+}
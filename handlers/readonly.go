@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"sync/atomic"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+const (
+	// ReadOnlyScriptsBlock rejects every script while read-only
+	ReadOnlyScriptsBlock = "block"
+	// ReadOnlyScriptsAllowRO lets through EVAL_RO, EVALSHA_RO and FCALL_RO, which
+	// redis itself prevents from writing
+	ReadOnlyScriptsAllowRO = "ro"
+)
+
+// ReadOnly is a switch shared by all of an upstream's connections. While it is
+// on, writes are rejected before they are forwarded.
+type ReadOnly struct {
+	enabled int32
+}
+
+func NewReadOnly(enabled bool) *ReadOnly {
+	r := &ReadOnly{}
+	r.Set(enabled)
+	return r
+}
+
+func (r *ReadOnly) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&r.enabled, v)
+}
+
+func (r *ReadOnly) Enabled() bool {
+	return r != nil && atomic.LoadInt32(&r.enabled) == 1
+}
+
+// rejectWrite returns the read-only error for cmd if it must not be forwarded.
+// The switch is checked as each batch is handled, so toggling it applies to every
+// command not yet forwarded.
+func (c *connection) rejectWrite(cmd string) *redis.Message {
+	if !c.opts.ReadOnly.Enabled() {
+		return nil
+	}
+	if WriteCommands[cmd] || (ReadOnlyScriptCommands[cmd] && c.opts.ReadOnlyScripts != ReadOnlyScriptsAllowRO) {
+		metrics.ReadOnlyRejected.Incr(c.statsd, cmd)
+		if c.trace != nil {
+			c.trace.add("read-only", cmd+" rejected, upstream is read-only")
+		}
+		return c.proxyError(proxyerr.Maintenance, "upstream is in read-only mode")
+	}
+	return nil
+}
+
+// rejectTransaction returns the read-only, SWAPDB, CONFIG, PERSIST or banned
+// hash tag error if any command of a transaction must not be forwarded, and the SELECT
+// one in dynamic database mode, where a SELECT is answered by the proxy.
+// Transactions are forwarded whole, so every command in the batch gets the
+// error.
+func (c *connection) rejectTransaction(cmds []string, wm []*redis.Message) *redis.Message {
+	if r := c.unauthenticated(); r != nil {
+		return r
+	}
+	for i, cmd := range cmds {
+		if r := c.rejectInTransaction(cmd, wm[i]); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// rejectInTransaction returns the error of a command that must not be
+// forwarded as part of a transaction
+func (c *connection) rejectInTransaction(cmd string, m *redis.Message) *redis.Message {
+	if r := c.rejectWrite(cmd); r != nil {
+		return r
+	}
+	if r := c.rejectSwapDB(cmd); r != nil {
+		return r
+	}
+	if r := c.rejectConfigWrite(cmd); r != nil {
+		return r
+	}
+	if r := c.rejectPersist(cmd, m); r != nil {
+		return r
+	}
+	if r := c.rejectBannedHashTag(cmd, m); r != nil {
+		return r
+	}
+	if r := c.rejectCorruptWrite(cmd, m); r != nil {
+		return r
+	}
+	if cmd == "SELECT" && c.opts.DBPools != nil {
+		return c.proxyError(proxyerr.Blocked, "SELECT is not allowed inside a transaction in dynamic database mode, select the database before MULTI")
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+
+	readOnly := NewReadOnly(true)
+	client := runTestConnection(t, upstream.Address(), Options{ReadOnly: readOnly, ReadOnlyScripts: ReadOnlyScriptsAllowRO})
+	defer func() { _ = client.Close() }()
+
+	rejected := "-PROXYMAINT upstream is in read-only mode \\r\\n "
+	actual := roundTripStrings(t, client, 7,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("GET", "a"),
+		respCommand("SET", "a", "1"),
+		respCommand("EVAL", "return 1", "0"),
+		respCommand("EVAL_RO", "return 1", "0"),
+		respCommand("XGROUP", "CREATE", "s", "g", "$"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	)
+	assert.Equal(t, []string{"$-1 \\r\\n ", "$7 \\r\\n a-value \\r\\n ", rejected, rejected, "+OK \\r\\n ", rejected, "$-1 \\r\\n "}, actual)
+	assert.Equal(t, int64(2), upstream.Commands(), "only GET and EVAL_RO are forwarded")
+
+	// a transaction containing a write is rejected as a whole
+	actual = roundTripStrings(t, client, 5,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("MULTI"),
+		respCommand("INCR", "a"),
+		respCommand("EXEC"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	)
+	assert.Equal(t, []string{"$-1 \\r\\n ", rejected, rejected, rejected, "$-1 \\r\\n "}, actual)
+
+	// toggling applies to the next batch
+	readOnly.Set(false)
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SET", "a", "1")))
+	assert.Equal(t, int64(3), upstream.Commands())
+}
+
+func TestReadOnlyBlocksAllScripts(t *testing.T) {
+	c := connection{opts: Options{ReadOnly: NewReadOnly(true), ReadOnlyScripts: ReadOnlyScriptsBlock}}
+	assert.NotNil(t, c.rejectWrite("FCALL_RO"))
+	assert.NotNil(t, c.rejectWrite("EVALSHA"))
+	assert.Nil(t, c.rejectWrite("GET"))
+	assert.Nil(t, c.rejectWrite("FUNCTION LIST"))
+	assert.NotNil(t, c.rejectWrite("FUNCTION LOAD"))
+
+	c.opts.ReadOnly = nil
+	assert.Nil(t, c.rejectWrite("SET"), "read-only mode is off without a switch")
+}
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/coinbase/redisbetween/sanitize"
+	"go.uber.org/zap"
+)
+
+// ReadThroughRule sends the GET misses of keys starting with Prefix to Endpoint,
+// and stores the values it returns for TTL
+type ReadThroughRule struct {
+	Prefix   string
+	Endpoint string
+	TTL      time.Duration
+}
+
+// ReadThroughOptions configures read-through. At most Concurrency fallback
+// requests are in flight at once, each taking at most Timeout and returning at
+// most MaxBytes. A miss that finds the fallback at its limit is answered with
+// the miss itself.
+type ReadThroughOptions struct {
+	Rules        []ReadThroughRule
+	Concurrency  int
+	Timeout      time.Duration
+	MaxBytes     int64
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+var errFallbackBusy = errors.New("fallback concurrency limit reached")
+
+// flight is a fallback request, which the concurrent misses of the same key wait
+// on rather than making their own
+type flight struct {
+	done  chan struct{}
+	value []byte
+	found bool
+}
+
+// ReadThrough populates an upstream node from HTTP(S) fallbacks on GET misses
+type ReadThrough struct {
+	log    *zap.Logger
+	statsd *statsd.Client
+	server *pool.Server
+	opts   ReadThroughOptions
+	client *http.Client
+	slots  chan struct{}
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func NewReadThrough(log *zap.Logger, sd *statsd.Client, server *pool.Server, opts ReadThroughOptions) *ReadThrough {
+	return &ReadThrough{
+		log:    log,
+		statsd: sd,
+		server: server,
+		opts:   opts,
+		client: &http.Client{
+			Timeout:   opts.Timeout,
+			Transport: &http.Transport{MaxConnsPerHost: opts.Concurrency, MaxIdleConnsPerHost: opts.Concurrency},
+		},
+		slots:   make(chan struct{}, opts.Concurrency),
+		flights: make(map[string]*flight),
+	}
+}
+
+func (r *ReadThrough) rule(key []byte) *ReadThroughRule {
+	for i := range r.opts.Rules {
+		if strings.HasPrefix(string(key), r.opts.Rules[i].Prefix) {
+			return &r.opts.Rules[i]
+		}
+	}
+	return nil
+}
+
+// readThrough replaces the nil replies to GETs of keys a rule matches with the
+// value of its fallback, if it has one. Misses are looked up concurrently.
+func (c *connection) readThrough(cmds []string, wm, res []*redis.Message) {
+	r := c.opts.ReadThrough
+	if r == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	traces := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		if cmd != "GET" || len(wm[i].Array) != 2 || i >= len(res) || !res[i].IsBulkBytes() || res[i].Value != nil {
+			continue
+		}
+		key := wm[i].Array[1].Value
+		rule := r.rule(key)
+		if rule == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// values are only stored while writes are allowed
+			value, found, err := r.Get(rule, string(key), !c.opts.ReadOnly.Enabled())
+			switch {
+			case err != nil:
+				traces[i] = fmt.Sprintf("GET %s missed, fallback failed: %v", key, err)
+			case found:
+				traces[i] = fmt.Sprintf("GET %s missed, populated from the fallback", key)
+				res[i] = redis.NewBulkBytes(value)
+			default:
+				traces[i] = fmt.Sprintf("GET %s missed, not found by the fallback", key)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if c.trace != nil {
+		for _, t := range traces {
+			if t != "" {
+				c.trace.add("read-through", t)
+			}
+		}
+	}
+}
+
+// Get returns the fallback's value for a missed key, storing it upstream if
+// store is set. Concurrent misses of a key share a single fallback request.
+func (r *ReadThrough) Get(rule *ReadThroughRule, key string, store bool) ([]byte, bool, error) {
+	prefix := sanitize.TagValue(rule.Prefix)
+	metrics.ReadThroughMisses.Incr(r.statsd, prefix)
+
+	r.mu.Lock()
+	if f, ok := r.flights[key]; ok {
+		r.mu.Unlock()
+		metrics.ReadThroughCollapsed.Incr(r.statsd, prefix)
+		<-f.done
+		return f.value, f.found, nil
+	}
+	f := &flight{done: make(chan struct{})}
+	r.flights[key] = f
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.flights, key)
+		r.mu.Unlock()
+		close(f.done)
+	}()
+
+	select {
+	case r.slots <- struct{}{}:
+		defer func() { <-r.slots }()
+	default:
+		metrics.ReadThroughRejected.Incr(r.statsd, prefix)
+		return nil, false, errFallbackBusy
+	}
+
+	var err error
+	f.value, f.found, err = r.fetch(rule, key)
+	if err != nil {
+		r.log.Debug("Read-through fallback failed", zap.String("endpoint", rule.Endpoint), zap.Error(err))
+		return nil, false, err
+	}
+	if f.found && store {
+		r.store(rule, key, f.value)
+	}
+	return f.value, f.found, nil
+}
+
+func (r *ReadThrough) fetch(rule *ReadThroughRule, key string) (value []byte, found bool, err error) {
+	defer func(start time.Time) {
+		result := "found"
+		if err != nil {
+			result = "error"
+		} else if !found {
+			result = "not_found"
+		}
+		metrics.ReadThroughFallback.Record(r.statsd, time.Since(start), sanitize.TagValue(rule.Prefix), result)
+	}(time.Now())
+
+	u, err := url.Parse(rule.Endpoint)
+	if err != nil {
+		return nil, false, err
+	}
+	q := u.Query()
+	q.Set("key", key)
+	u.RawQuery = q.Encode()
+
+	resp, err := r.client.Get(u.String())
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("fallback returned %s", resp.Status)
+	}
+	value, err = ioutil.ReadAll(io.LimitReader(resp.Body, r.opts.MaxBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(value)) > r.opts.MaxBytes {
+		return nil, false, fmt.Errorf("fallback returned more than %d bytes", r.opts.MaxBytes)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, true, nil
+}
+
+// store SETs a fallback's value with the rule's TTL. A failure is only logged,
+// since the client gets the value either way.
+func (r *ReadThrough) store(rule *ReadThroughRule, key string, value []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.ReadTimeout+r.opts.WriteTimeout)
+	defer cancel()
+	set := redis.NewArray([]*redis.Message{
+		redis.NewBulkBytes([]byte("SET")), redis.NewBulkBytes([]byte(key)), redis.NewBulkBytes(value),
+		redis.NewBulkBytes([]byte("PX")), redis.NewBulkBytes([]byte(strconv.FormatInt(rule.TTL.Milliseconds(), 10))),
+	})
+	res, err := Exchange(ctx, r.log, r.server, []*redis.Message{set}, r.opts.ReadTimeout, r.opts.WriteTimeout)
+	if err == nil && res[0].IsError() {
+		err = errors.New(res[0].String())
+	}
+	if err != nil {
+		r.log.Warn("Failed to store a read-through value", zap.Error(err))
+	}
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// store is an upstream that keeps the values of SETs, and answers GETs of
+// others with nil
+type store struct {
+	sync.Mutex
+	sets []string
+}
+
+func (s *store) handle(args []string) *redis.Message {
+	s.Lock()
+	defer s.Unlock()
+	if strings.ToUpper(args[0]) == "SET" {
+		s.sets = append(s.sets, strings.Join(args[1:], " "))
+		return redis.NewString([]byte("OK"))
+	}
+	return redis.NewBulkBytes(nil)
+}
+
+func (s *store) Sets() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.sets...)
+}
+
+func newReadThrough(t *testing.T, upstream string, fallback http.HandlerFunc, concurrency int) (*ReadThrough, *ReadThroughRule) {
+	srv := httptest.NewServer(fallback)
+	t.Cleanup(srv.Close)
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	r := NewReadThrough(zap.NewNop(), sd, newTestServer(t, upstream, 2), ReadThroughOptions{
+		Rules:        []ReadThroughRule{{Prefix: "user:", Endpoint: srv.URL + "/lookup", TTL: 5 * time.Minute}},
+		Concurrency:  concurrency,
+		Timeout:      500 * time.Millisecond,
+		MaxBytes:     16,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	return r, &r.opts.Rules[0]
+}
+
+func TestReadThrough(t *testing.T) {
+	s := &store{}
+	upstream := newFakeUpstream(t, s.handle)
+	defer upstream.Close()
+	r, _ := newReadThrough(t, upstream.Address(), func(w http.ResponseWriter, req *http.Request) {
+		switch key := req.URL.Query().Get("key"); key {
+		case "user:1":
+			_, _ = w.Write([]byte("alice"))
+		case "user:broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "user:big":
+			_, _ = w.Write([]byte(strings.Repeat("x", 17)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}, 10)
+
+	client := runTestConnection(t, upstream.Address(), Options{ReadThrough: r})
+	defer func() { _ = client.Close() }()
+	actual := roundTripStrings(t, client, 7,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("GET", "user:1"),
+		respCommand("GET", "user:2"),
+		respCommand("GET", "user:broken"),
+		respCommand("GET", "user:big"),
+		respCommand("GET", "other:1"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	)
+	assert.Equal(t, []string{"$-1 \\r\\n ", "$5 \\r\\n alice \\r\\n ", "$-1 \\r\\n ", "$-1 \\r\\n ", "$-1 \\r\\n ", "$-1 \\r\\n ", "$-1 \\r\\n "}, actual,
+		"only values the fallback found are returned, and failures return the miss")
+	assert.Equal(t, []string{"user:1 alice PX 300000"}, s.Sets())
+}
+
+func TestReadThroughReadOnly(t *testing.T) {
+	s := &store{}
+	upstream := newFakeUpstream(t, s.handle)
+	defer upstream.Close()
+	r, _ := newReadThrough(t, upstream.Address(), func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("alice"))
+	}, 10)
+
+	client := runTestConnection(t, upstream.Address(), Options{ReadThrough: r, ReadOnly: NewReadOnly(true)})
+	defer func() { _ = client.Close() }()
+	assert.Equal(t, []string{"$5 \\r\\n alice \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "user:1")))
+	assert.Empty(t, s.Sets(), "values aren't stored while the upstream is read-only")
+}
+
+func TestReadThroughSingleFlight(t *testing.T) {
+	s := &store{}
+	upstream := newFakeUpstream(t, s.handle)
+	defer upstream.Close()
+	var requests int32
+	release := make(chan struct{})
+	r, rule := newReadThrough(t, upstream.Address(), func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		_, _ = w.Write([]byte("alice"))
+	}, 1)
+
+	var wg sync.WaitGroup
+	values := make([]string, 5)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, found, err := r.Get(rule, "user:1", true)
+			assert.NoError(t, err)
+			assert.True(t, found)
+			values[i] = string(v)
+		}(i)
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&requests) == 1 }, time.Second, time.Millisecond)
+
+	// another key finds the only fallback slot taken
+	_, found, err := r.Get(rule, "user:2", true)
+	assert.Equal(t, errFallbackBusy, err)
+	assert.False(t, found)
+
+	// give the other misses time to join the flight
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []string{"alice", "alice", "alice", "alice", "alice"}, values)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "concurrent misses share one fallback request")
+	assert.Equal(t, []string{"user:1 alice PX 300000"}, s.Sets())
+}
+
+func TestReadThroughTimeout(t *testing.T) {
+	upstream := newFakeUpstream(t, (&store{}).handle)
+	defer upstream.Close()
+	r, rule := newReadThrough(t, upstream.Address(), func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}, 1)
+
+	start := time.Now()
+	_, found, err := r.Get(rule, "user:1", true)
+	assert.Error(t, err)
+	assert.False(t, found)
+	assert.True(t, time.Since(start) < 2*time.Second, "a slow fallback is abandoned after readthroughtimeout")
+}
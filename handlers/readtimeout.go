@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// errReadTimeout ends the connection of a client that took too long to send
+// its first command, or the rest of one, or idled for too long between two
+var errReadTimeout = errors.New("client read timed out")
+
+// progressConn times the reads of a client's requests: once the first bytes of
+// one arrive, each of its messages must be read whole within ProgressTimeout of
+// the one before, so that a client can't hold its connection, and the
+// goroutine and buffers reading it, by sending a command a byte at a time.
+type progressConn struct {
+	net.Conn
+	c *connection
+}
+
+func (p *progressConn) Read(b []byte) (int, error) {
+	n, err := p.Conn.Read(b)
+	if n > 0 && !p.c.requestStarted {
+		p.c.requestStarted = true
+		p.c.progressDue()
+	}
+	return n, err
+}
+
+// firstByteTimeout is how long a read waits for its first byte: FirstByteTimeout
+// until the client has sent a first request, and then IdleTimeout
+func (c *connection) firstByteTimeout() time.Duration {
+	if c.requested {
+		return c.opts.IdleTimeout
+	}
+	return c.opts.FirstByteTimeout
+}
+
+// framed moves the deadline of a pipeline's next message along as each one is
+// read whole. The read of a request ends with the last.
+func (c *connection) framed(pipelineOpen bool) {
+	if pipelineOpen {
+		c.progressDue()
+	}
+}
+
+// progressDue sets the deadline of the read of the rest of the message being
+// read, lifting that of the first byte, unless the drain has woken the read up
+// already
+func (c *connection) progressDue() {
+	var deadline time.Time
+	if c.opts.ProgressTimeout > 0 {
+		deadline = time.Now().Add(c.opts.ProgressTimeout)
+	} else if c.opts.FirstByteTimeout <= 0 && c.opts.IdleTimeout <= 0 {
+		return
+	}
+	_ = c.conn.SetReadDeadline(deadline)
+	// the drain cancels readCtx before setting its deadline, so either it is
+	// seen here or its deadline is set after this one
+	if c.readCtx.Err() != nil && (atomic.LoadInt32(&c.pipelineOpen) == 0 || c.opts.DrainNotify) {
+		_ = c.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// readTimedOut tells the timeouts of reads apart from other read errors. A
+// client whose command stopped arriving part way is answered with a protocol
+// error, as redis does the commands it can't read, and one that never sent its
+// first, or idled past IdleTimeout since its last, is closed without a word;
+// the connections are then closed.
+func (c *connection) readTimedOut(l *zap.Logger, err error) error {
+	var ne net.Error
+	if c.readCtx.Err() != nil || !errors.As(err, &ne) || !ne.Timeout() {
+		return err
+	}
+	if !c.requestStarted {
+		switch {
+		case c.requested && c.opts.IdleTimeout > 0:
+			metrics.ClientReadTimeouts.Incr(c.statsd, "idle")
+			l.Debug("Closing idle client connection", zap.Duration("timeout", c.opts.IdleTimeout))
+			return errReadTimeout
+		case !c.requested && c.opts.FirstByteTimeout > 0:
+			metrics.ClientReadTimeouts.Incr(c.statsd, "first_byte")
+			l.Debug("Closing client connection that sent nothing", zap.Duration("timeout", c.opts.FirstByteTimeout))
+			return errReadTimeout
+		}
+		return err
+	}
+	if c.opts.ProgressTimeout <= 0 {
+		return err
+	}
+	metrics.ClientReadTimeouts.Incr(c.statsd, "progress")
+	l.Debug("Closing client connection whose command stopped arriving", zap.Duration("timeout", c.opts.ProgressTimeout))
+	mm := []*redis.Message{redis.NewErrorf("ERR Protocol error: command not received whole within %v", c.opts.ProgressTimeout)}
+	_ = WriteWireMessages(c.ctx, l, mm, c.conn, c.address, c.id, c.writeTimeout, false, c.conn.Close)
+	return errReadTimeout
+}
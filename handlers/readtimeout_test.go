@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// trickle writes b to client a byte every interval, stopping once the proxy
+// closes the connection
+func trickle(client net.Conn, b []byte, interval time.Duration) {
+	for i := range b {
+		if _, err := client.Write(b[i : i+1]); err != nil {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+func TestSlowClientsEvicted(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	s := newTestServer(t, upstream.Address(), 2)
+	defer func() { _ = s.Disconnect(context.Background()) }()
+	// the first byte isn't timed, so that only the progress of the commands is
+	opts := Options{ProgressTimeout: 200 * time.Millisecond}
+
+	const clients = 50
+	var served sync.WaitGroup
+	conns := make([]net.Conn, clients)
+	for i := range conns {
+		served.Add(1)
+		conns[i] = serveTestConnection(t, s, opts, served.Done)
+		defer func(c net.Conn) { _ = c.Close() }(conns[i])
+	}
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	commands := []string{
+		respCommand("GET", "a"),
+		// a header claiming a blob far larger than the proxy should ever hold
+		// for a client that hasn't sent it
+		"*2\r\n$3\r\nSET\r\n$100000000\r\n" + string(make([]byte, 64)),
+	}
+	var wg sync.WaitGroup
+	replies := make([][]string, clients)
+	errs := make([]error, clients)
+	for i, client := range conns {
+		wg.Add(1)
+		go func(i int, client net.Conn) {
+			defer wg.Done()
+			go trickle(client, []byte(commands[i%len(commands)]), 50*time.Millisecond)
+			// each client has until its deadline to be answered and closed
+			_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			d := redis.NewDecoder(client)
+			for {
+				m, err := d.Decode()
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				replies[i] = append(replies[i], m.String())
+			}
+		}(i, client)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	var during runtime.MemStats
+	runtime.ReadMemStats(&during)
+	assert.Less(t, int64(during.HeapInuse)-int64(before.HeapInuse), int64(64<<20), "partial commands hold buffers of the bytes received, not of what they claim")
+
+	wg.Wait()
+	for i, r := range replies {
+		assert.Equal(t, []string{"-ERR Protocol error: command not received whole within 200ms \\r\\n "}, r, "client %d", i)
+		assert.Equal(t, io.EOF, errs[i], "client %d is closed by the proxy, not by its deadline", i)
+	}
+	ended := make(chan struct{})
+	go func() {
+		served.Wait()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Error("the connections reading the clients are still served")
+	}
+	assert.EqualValues(t, 0, upstream.Commands(), "nothing was forwarded")
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	opts := Options{FirstByteTimeout: 200 * time.Millisecond, ProgressTimeout: 100 * time.Millisecond}
+
+	silent := runTestConnection(t, upstream.Address(), opts)
+	defer func() { _ = silent.Close() }()
+	started := time.Now()
+	assert.Empty(t, readUntilClosed(t, silent), "a client that sends nothing is closed without a reply")
+	assert.WithinDuration(t, started.Add(200*time.Millisecond), time.Now(), 150*time.Millisecond)
+
+	idle := runTestConnection(t, upstream.Address(), opts)
+	defer func() { _ = idle.Close() }()
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, idle, 1, respCommand("GET", "a")))
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, []string{"$7 \\r\\n b-value \\r\\n "}, roundTripStrings(t, idle, 1, respCommand("GET", "b")), "a client idle between requests is left alone")
+	_, _ = idle.Write([]byte(respCommand("QUIT")))
+	assert.Equal(t, []string{"+OK \\r\\n "}, readUntilClosed(t, idle))
+}
+
+func TestIdleTimeout(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	opts := Options{IdleTimeout: 200 * time.Millisecond, ProgressTimeout: 100 * time.Millisecond}
+
+	// a connection yet to send anything is the first byte timeout's
+	silent := runTestConnection(t, upstream.Address(), opts)
+	defer func() { _ = silent.Close() }()
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, silent, 1, respCommand("GET", "a")))
+
+	started := time.Now()
+	assert.Empty(t, readUntilClosed(t, silent), "a client idle since its last request is closed without a reply")
+	assert.WithinDuration(t, started.Add(200*time.Millisecond), time.Now(), 150*time.Millisecond)
+
+	// the deadline moves along with each request
+	busy := runTestConnection(t, upstream.Address(), opts)
+	defer func() { _ = busy.Close() }()
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, []string{"$7 \\r\\n b-value \\r\\n "}, roundTripStrings(t, busy, 1, respCommand("GET", "b")))
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"fmt"
+	"sync"
+)
+
+// defaultRetryBudgetTokens is both the starting balance and the cap of a retry
+// budget, so that a quiet upstream can still absorb a small burst of retries
+// before any successful traffic has refilled the bucket.
+const defaultRetryBudgetTokens = 10
+
+// RetryBudget is a token bucket shared by every client connection of an upstream.
+// Each retry withdraws one token, and each successful request that did not need
+// a retry deposits `ratio` tokens. Retries can therefore never exceed roughly
+// ratio * successful requests, so an upstream that is failing every request sees
+// about one attempt per client request instead of one per retry.
+type RetryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+
+	requests uint64
+	retries  uint64
+}
+
+// RetryBudgetError is returned when a retryable failure could not be retried
+// because the upstream's retry budget has been spent.
+type RetryBudgetError struct {
+	Wrapped error
+}
+
+func (e RetryBudgetError) Error() string {
+	return fmt.Sprintf("retry budget exhausted: %v", e.Wrapped)
+}
+
+func (e RetryBudgetError) Unwrap() error {
+	return e.Wrapped
+}
+
+func NewRetryBudget(ratio float64) *RetryBudget {
+	return &RetryBudget{
+		ratio:  ratio,
+		max:    defaultRetryBudgetTokens,
+		tokens: defaultRetryBudgetTokens,
+	}
+}
+
+// Success records a request that succeeded without being retried.
+func (b *RetryBudget) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests++
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+// Failure records a request that failed, whether or not it was retried.
+func (b *RetryBudget) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests++
+}
+
+// Withdraw takes a token for a retry, returning false if none are left.
+func (b *RetryBudget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	b.retries++
+	return true
+}
+
+// Exhausted reports whether a retry would currently be refused. Other failure
+// handling (such as circuit breaking) can use this as a sign that the upstream
+// is failing faster than successful traffic can refill the budget.
+func (b *RetryBudget) Exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens < 1
+}
+
+// Snapshot returns the current token balance and the ratio of retries to
+// requests since the previous call, then starts a new observation window.
+func (b *RetryBudget) Snapshot() (tokens, retryRatio float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.requests > 0 {
+		retryRatio = float64(b.retries) / float64(b.requests)
+	}
+	b.requests, b.retries = 0, 0
+	return b.tokens, retryRatio
+}
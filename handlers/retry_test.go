@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRetryBudget(t *testing.T) {
+	b := NewRetryBudget(0.5)
+	for i := 0; i < defaultRetryBudgetTokens; i++ {
+		assert.True(t, b.Withdraw())
+	}
+	assert.False(t, b.Withdraw())
+	assert.True(t, b.Exhausted())
+
+	b.Success()
+	assert.False(t, b.Withdraw(), "half a token is not enough for a retry")
+	b.Success()
+	assert.True(t, b.Withdraw())
+
+	for i := 0; i < 100; i++ {
+		b.Success()
+	}
+	tokens, ratio := b.Snapshot()
+	assert.Equal(t, float64(defaultRetryBudgetTokens), tokens, "tokens are capped")
+	assert.InDelta(t, float64(defaultRetryBudgetTokens+1)/102, ratio, 0.001)
+
+	_, ratio = b.Snapshot()
+	assert.Equal(t, 0.0, ratio, "snapshot starts a new window")
+}
+
+func TestRetryBudgetUnderTotalUpstreamFailure(t *testing.T) {
+	requests := 500
+	assert.Equal(t, int64(2*requests), countDialsWithFailingUpstream(t, requests, Options{Retries: 1}))
+
+	dials := countDialsWithFailingUpstream(t, requests, Options{Retries: 1, RetryBudget: NewRetryBudget(0.1)})
+	assert.InDelta(t, requests, dials, defaultRetryBudgetTokens)
+}
+
+func countDialsWithFailingUpstream(t *testing.T, requests int, opts Options) int64 {
+	t.Helper()
+	var dials int64
+	dialer := pool.WithDialer(func(pool.Dialer) pool.Dialer {
+		return pool.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt64(&dials, 1)
+			return nil, errors.New("connection refused")
+		})
+	})
+	s, err := pool.ConnectServer(pool.Address("127.0.0.1:1"), pool.WithConnectionOptions(func(cos ...pool.ConnectionOption) []pool.ConnectionOption {
+		return append(cos, dialer)
+	}))
+	assert.NoError(t, err)
+	defer func() { _ = s.Disconnect(context.Background()) }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	c := connection{log: zaptest.NewLogger(t), statsd: sd, ctx: context.Background(), server: s, opts: opts}
+	wm := []*redis.Message{redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("PING"))})}
+	for i := 0; i < requests; i++ {
+		_, _, err := c.roundTrip(s, wm)
+		assert.Error(t, err)
+	}
+	return atomic.LoadInt64(&dials)
+}
+
+// faultyConn fails its writes once it has taken budget bytes of them
+type faultyConn struct {
+	net.Conn
+	budget int
+}
+
+func (f *faultyConn) Write(p []byte) (int, error) {
+	if len(p) <= f.budget {
+		f.budget -= len(p)
+		return f.Conn.Write(p)
+	}
+	n, _ := f.Conn.Write(p[:f.budget])
+	f.budget = 0
+	_ = f.Conn.Close()
+	return n, errors.New("connection reset by peer")
+}
+
+// faultyFirstDial returns a connection to upstream that checks out a first
+// connection failing its writes after offset bytes
+func faultyFirstDial(t *testing.T, upstream string, offset int, opts Options) (*connection, *int64) {
+	t.Helper()
+	var dials int64
+	dialer := pool.WithDialer(func(pool.Dialer) pool.Dialer {
+		return pool.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+			if err != nil || atomic.AddInt64(&dials, 1) > 1 {
+				return conn, err
+			}
+			return &faultyConn{Conn: conn, budget: offset}, nil
+		})
+	})
+	s, err := pool.ConnectServer(pool.Address(upstream), pool.WithConnectionOptions(func(cos ...pool.ConnectionOption) []pool.ConnectionOption {
+		return append(cos, dialer)
+	}))
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = s.Disconnect(context.Background()) })
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	return &connection{log: zaptest.NewLogger(t), statsd: sd, ctx: context.Background(), server: s, opts: opts}, &dials
+}
+
+func TestRetryPartialWrites(t *testing.T) {
+	var counter int64
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "INCR" {
+			return redis.NewInt([]byte(strconv.FormatInt(atomic.AddInt64(&counter, 1), 10)))
+		}
+		return redis.NewBulkBytes([]byte(args[1]))
+	})
+	defer upstream.Close()
+	command := func(args ...string) []*redis.Message {
+		m := make([]*redis.Message, len(args))
+		for i, a := range args {
+			m[i] = redis.NewBulkBytes([]byte(a))
+		}
+		return []*redis.Message{redis.NewArray(m)}
+	}
+	incr, get, getdel := command("INCR", "counter"), command("GET", "key"), command("GETDEL", "key")
+	size := len(respCommand("INCR", "counter"))
+
+	for _, c := range []struct {
+		name    string
+		wm      []*redis.Message
+		offset  int
+		retries int
+		dials   int64
+		err     string
+	}{
+		{"nothing of a write is written", incr, 0, 1, 2, ""},
+		{"a write stops within its first message", incr, 1, 1, 1, "possibly delivered (1 of " + strconv.Itoa(size) + " bytes written)"},
+		{"a write stops just short of its end", incr, size - 1, 1, 1, "possibly delivered"},
+		{"without retries nothing is retried", incr, 0, 0, 1, "not delivered (0 of " + strconv.Itoa(size) + " bytes written)"},
+		{"a read is retried however much was written", get, 5, 1, 2, ""},
+		{"a read that writes is a write", getdel, 1, 1, 1, "possibly delivered"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conn, dials := faultyFirstDial(t, upstream.Address(), c.offset, Options{Retries: c.retries})
+			res, _, err := conn.roundTrip(conn.server, c.wm)
+			assert.Equal(t, c.dials, atomic.LoadInt64(dials))
+			if c.err != "" {
+				var we WriteError
+				assert.True(t, errors.As(err, &we))
+				assert.Contains(t, err.Error(), c.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, res, 1)
+		})
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&counter), "only INCRs that were never written are sent again")
+}
+
+func TestIdempotent(t *testing.T) {
+	for cmd, expected := range map[string]bool{
+		"GET k":          true,
+		"SET k v EX 10":  true,
+		"SET k v NX":     false,
+		"SET k v GET":    false,
+		"GETDEL k":       false,
+		"GETEX k":        false,
+		"INCR k":         false,
+		"MSET a 1 b 2":   true,
+		"RPUSH l x":      false,
+		"PEXPIREAT k 10": true,
+	} {
+		m := redis.NewArray(nil)
+		for _, a := range strings.Fields(cmd) {
+			m.Array = append(m.Array, redis.NewBulkBytes([]byte(a)))
+		}
+		assert.Equal(t, expected, idempotent([]*redis.Message{m}), cmd)
+	}
+}
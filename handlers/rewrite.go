@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/netaddr"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// addressPattern matches the IP:port addresses redis puts in error text: IPv4,
+// bracketed IPv6, and IPv6 as cluster nodes announce it, unbracketed, with the
+// port after the last colon
+var addressPattern = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}:\d+\b|\[[0-9a-fA-F:.%]+\]:\d+\b|\b[0-9a-fA-F]{0,4}(?::[0-9a-fA-F]{0,4})*::(?:[0-9a-fA-F]{0,4}:)*\d+\b`)
+
+// ErrorRewriter rewrites the upstream addresses in error replies, which mean
+// nothing to clients that reach the upstream through the proxy. The node a
+// MOVED or ASK redirects to becomes the local address of its listener, and with
+// Scrub every other address becomes Name, the upstream's logical name.
+type ErrorRewriter struct {
+	// Local returns the local address of an upstream node's listener, and false
+	// if the proxy has none for it
+	Local func(upstream string) (string, bool)
+	Scrub bool
+	Name  string
+}
+
+// rewriteErrors replaces the replies whose errors have addresses, those in
+// transaction replies included, leaving every other reply as is
+func (c *connection) rewriteErrors(res []*redis.Message) {
+	if c.opts.ErrorRewriter == nil {
+		return
+	}
+	for i, m := range res {
+		res[i] = c.opts.ErrorRewriter.rewrite(c.statsd, m)
+	}
+}
+
+func (r *ErrorRewriter) rewrite(sd *statsd.Client, m *redis.Message) *redis.Message {
+	if m == nil {
+		return m
+	}
+	if m.IsArray() {
+		var array []*redis.Message
+		for i, e := range m.Array {
+			if rewritten := r.rewrite(sd, e); rewritten != e {
+				if array == nil {
+					array = append([]*redis.Message(nil), m.Array...)
+				}
+				array[i] = rewritten
+			}
+		}
+		if array == nil {
+			return m
+		}
+		return redis.NewArray(array)
+	}
+	if !m.IsError() {
+		return m
+	}
+	if value, ok := r.redirect(m.Value); ok {
+		metrics.ErrorRewrites.Incr(sd, "redirect")
+		return redis.NewError(value)
+	}
+	if r.Scrub && addressPattern.Match(m.Value) {
+		metrics.ErrorRewrites.Incr(sd, "scrub")
+		return redis.NewError(addressPattern.ReplaceAllLiteral(m.Value, []byte(r.Name)))
+	}
+	return m
+}
+
+// redirect rewrites the node of a MOVED or ASK error, "MOVED <slot> <host:port>",
+// to its local address. One for a node without a listener is left as is, unless
+// scrubbed, since a client can't follow it either way.
+func (r *ErrorRewriter) redirect(value []byte) ([]byte, bool) {
+	parts := bytes.Split(value, []byte(" "))
+	if len(parts) != 3 || (!bytes.Equal(parts[0], []byte("MOVED")) && !bytes.Equal(parts[0], []byte("ASK"))) {
+		return nil, false
+	}
+	if local, ok := r.Local(netaddr.FromNode(string(parts[2]))); ok {
+		return bytes.Join([][]byte{parts[0], parts[1], []byte(local)}, []byte(" ")), true
+	}
+	return nil, false
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRewriter(scrub bool) *ErrorRewriter {
+	locals := map[string]string{
+		"10.0.3.17:6379":        "/var/tmp/redisbetween-10.0.3.17-6379.sock",
+		"redis-2.internal:6379": "/var/tmp/redisbetween-redis-2.internal-6379.sock",
+		"[2600:1f14::12]:6379":  "/var/tmp/redisbetween-ipv6-2600-1f14--12-6379.sock",
+		"10.0.3.18:6379":        "127.0.0.1:7001",
+	}
+	return &ErrorRewriter{
+		Local: func(upstream string) (string, bool) {
+			l, ok := locals[upstream]
+			return l, ok
+		},
+		Scrub: scrub,
+		Name:  "sessions",
+	}
+}
+
+func TestErrorRewrite(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		reply               *redis.Message
+		rewritten, scrubbed string
+	}{
+		{"moved", redis.NewErrorf("MOVED 3999 10.0.3.17:6379"),
+			"MOVED 3999 /var/tmp/redisbetween-10.0.3.17-6379.sock", "MOVED 3999 /var/tmp/redisbetween-10.0.3.17-6379.sock"},
+		{"ask during a migration", redis.NewErrorf("ASK 3999 10.0.3.17:6379"),
+			"ASK 3999 /var/tmp/redisbetween-10.0.3.17-6379.sock", "ASK 3999 /var/tmp/redisbetween-10.0.3.17-6379.sock"},
+		{"moved to a local address that looks like one", redis.NewErrorf("MOVED 12 10.0.3.18:6379"),
+			"MOVED 12 127.0.0.1:7001", "MOVED 12 127.0.0.1:7001"},
+		{"moved by hostname", redis.NewErrorf("MOVED 866 redis-2.internal:6379"),
+			"MOVED 866 /var/tmp/redisbetween-redis-2.internal-6379.sock", "MOVED 866 /var/tmp/redisbetween-redis-2.internal-6379.sock"},
+		{"moved to ipv6", redis.NewErrorf("MOVED 866 2600:1f14::12:6379"),
+			"MOVED 866 /var/tmp/redisbetween-ipv6-2600-1f14--12-6379.sock", "MOVED 866 /var/tmp/redisbetween-ipv6-2600-1f14--12-6379.sock"},
+		{"moved to a node without a listener", redis.NewErrorf("MOVED 866 10.0.9.9:6379"),
+			"MOVED 866 10.0.9.9:6379", "MOVED 866 sessions"},
+		{"moved to an unknown endpoint", redis.NewErrorf("MOVED 866 :6379"),
+			"MOVED 866 :6379", "MOVED 866 :6379"},
+		{"tryagain while resharding", redis.NewErrorf("TRYAGAIN Multiple keys request during rehashing of slot"),
+			"TRYAGAIN Multiple keys request during rehashing of slot", "TRYAGAIN Multiple keys request during rehashing of slot"},
+		{"clusterdown", redis.NewErrorf("CLUSTERDOWN The cluster is down"),
+			"CLUSTERDOWN The cluster is down", "CLUSTERDOWN The cluster is down"},
+		{"clusterdown while a slot is unbound", redis.NewErrorf("CLUSTERDOWN Hash slot not served"),
+			"CLUSTERDOWN Hash slot not served", "CLUSTERDOWN Hash slot not served"},
+		{"crossslot", redis.NewErrorf("CROSSSLOT Keys in request don't hash to the same slot"),
+			"CROSSSLOT Keys in request don't hash to the same slot", "CROSSSLOT Keys in request don't hash to the same slot"},
+		{"readonly replica after a failover", redis.NewErrorf("READONLY You can't write against a read only replica."),
+			"READONLY You can't write against a read only replica.", "READONLY You can't write against a read only replica."},
+		{"masterdown", redis.NewErrorf("MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'."),
+			"MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.", "MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'."},
+		{"loading", redis.NewErrorf("LOADING Redis is loading the dataset in memory"),
+			"LOADING Redis is loading the dataset in memory", "LOADING Redis is loading the dataset in memory"},
+		{"replication naming its master", redis.NewErrorf("ERR Error condition on socket for SYNC: Connection refused by 10.0.3.17:6379"),
+			"ERR Error condition on socket for SYNC: Connection refused by 10.0.3.17:6379", "ERR Error condition on socket for SYNC: Connection refused by sessions"},
+		{"failover naming a bracketed replica", redis.NewErrorf("ERR FAILOVER target [2600:1f14::13]:6379 is not a replica"),
+			"ERR FAILOVER target [2600:1f14::13]:6379 is not a replica", "ERR FAILOVER target sessions is not a replica"},
+		{"failover naming an ipv6 replica", redis.NewErrorf("ERR FAILOVER target 2600:1f14::13:6379 is not a replica"),
+			"ERR FAILOVER target 2600:1f14::13:6379 is not a replica", "ERR FAILOVER target sessions is not a replica"},
+		{"exec with a moved command", redis.NewArray([]*redis.Message{redis.NewString([]byte("OK")), redis.NewErrorf("MOVED 1 10.0.3.17:6379")}),
+			"*2 \\r\\n +OK \\r\\n -MOVED 1 /var/tmp/redisbetween-10.0.3.17-6379.sock \\r\\n ", "*2 \\r\\n +OK \\r\\n -MOVED 1 /var/tmp/redisbetween-10.0.3.17-6379.sock \\r\\n "},
+		{"not an error", redis.NewBulkBytes([]byte("MOVED 3999 10.0.3.17:6379")),
+			"$25 \\r\\n MOVED 3999 10.0.3.17:6379 \\r\\n ", "$25 \\r\\n MOVED 3999 10.0.3.17:6379 \\r\\n "},
+	} {
+		for _, scrub := range []bool{false, true} {
+			expected := tc.rewritten
+			if scrub {
+				expected = tc.scrubbed
+			}
+			res := testRewriter(scrub).rewrite(nil, tc.reply)
+			got := res.String()
+			if res.IsError() {
+				got = string(res.Value)
+			}
+			assert.Equal(t, expected, got, "%s, scrub %v", tc.name, scrub)
+		}
+	}
+}
+
+func TestErrorRewriteReplies(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "GET" && args[1] == "moved" {
+			return redis.NewErrorf("MOVED 3999 10.0.3.17:6379")
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{ErrorRewriter: testRewriter(false)})
+	defer func() { _ = client.Close() }()
+	assert.Equal(t, []string{
+		"-MOVED 3999 /var/tmp/redisbetween-10.0.3.17-6379.sock \\r\\n ",
+		"$7 \\r\\n a-value \\r\\n ",
+	}, roundTripStrings(t, client, 2, respCommand("GET", "moved"), respCommand("GET", "a")))
+}
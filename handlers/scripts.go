@@ -0,0 +1,500 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// AllScripts is the Script of a limit on every script
+const AllScripts = "*"
+
+// DefaultScriptsTracked is how many scripts are accounted for by SHA when
+// MaxTracked isn't set
+const DefaultScriptsTracked = 1000
+
+// scriptsTop is how many scripts the stats list, those with the most time spent
+// running
+const scriptsTop = 20
+
+// maxFirstLine is how much of a script's first line is kept for its stats and
+// logs
+const maxFirstLine = 120
+
+// scriptNameComment is the comment a script is named by, one of its leading
+// comment lines, e.g. "-- name: checkout"
+var scriptNameComment = regexp.MustCompile(`^--\s*name:\s*([a-zA-Z0-9_.:-]+)\s*$`)
+
+// ScriptLimit caps the calls of a script, by its SHA or name, or of every script
+// if Script is AllScripts, at Rate calls per second and InFlight requests
+// running it at once. Either is unlimited if 0.
+type ScriptLimit struct {
+	Script   string
+	Rate     float64
+	InFlight int
+}
+
+// ScriptOptions configures the accounting and limits of the Lua scripts sent to
+// a node. A script over its in-flight cap waits up to Wait for a request
+// running it to finish before it is shed. Scripts that take longer than Slow
+// are logged, if it is set. Only MaxTracked scripts are accounted for by SHA,
+// the calls of the rest being counted together.
+type ScriptOptions struct {
+	Limits     []ScriptLimit
+	Wait       time.Duration
+	Slow       time.Duration
+	MaxTracked int
+}
+
+// Scripts accounts for the EVAL and EVALSHA calls of a node's clients, and caps
+// them by their limits. The proxy learns the body behind each SHA from EVAL
+// and SCRIPT LOAD, and with it the script's name; a script only ever called by
+// SHA since the proxy started is known by its SHA alone.
+type Scripts struct {
+	log    *zap.Logger
+	statsd *statsd.Client
+	opts   ScriptOptions
+
+	mu        sync.Mutex
+	scripts   map[string]*scriptState
+	untracked int64
+	limiters  []*scriptLimiter
+}
+
+type scriptState struct {
+	sha, name, firstLine string
+	calls, errors        int64
+	total, max           time.Duration
+}
+
+type scriptLimiter struct {
+	ScriptLimit
+	tokens   float64
+	refilled time.Time
+	inUse    int
+	waiters  []chan struct{}
+	shed     int64
+}
+
+// ScriptStats describe a script for the admin stats. Its latency is the round
+// trip of the requests it was sent in, which is the script's own when it is
+// sent on its own rather than in a pipeline.
+type ScriptStats struct {
+	SHA       string  `json:"sha"`
+	Name      string  `json:"name,omitempty"`
+	FirstLine string  `json:"first_line,omitempty"`
+	Calls     int64   `json:"calls"`
+	Errors    int64   `json:"errors"`
+	TotalMs   float64 `json:"total_ms"`
+	AvgMs     float64 `json:"avg_ms"`
+	MaxMs     float64 `json:"max_ms"`
+}
+
+// ScriptLimitStats describe a script limit for the admin stats
+type ScriptLimitStats struct {
+	Script   string  `json:"script"`
+	Rate     float64 `json:"rate,omitempty"`
+	InFlight int     `json:"in_flight,omitempty"`
+	InUse    int     `json:"in_use"`
+	Waiting  int     `json:"waiting"`
+	Shed     int64   `json:"shed"`
+}
+
+// ScriptsStats are the scripts a node has spent the most time running, its
+// script limits and the calls of scripts beyond the tracked ones
+type ScriptsStats struct {
+	Top       []ScriptStats      `json:"top"`
+	Tracked   int                `json:"tracked"`
+	Untracked int64              `json:"untracked_calls,omitempty"`
+	Limits    []ScriptLimitStats `json:"limits,omitempty"`
+}
+
+func NewScripts(log *zap.Logger, sd *statsd.Client, opts ScriptOptions) *Scripts {
+	if opts.MaxTracked <= 0 {
+		opts.MaxTracked = DefaultScriptsTracked
+	}
+	s := &Scripts{log: log, statsd: sd, opts: opts, scripts: make(map[string]*scriptState)}
+	now := time.Now()
+	for _, l := range opts.Limits {
+		if len(l.Script) == 40 {
+			l.Script = strings.ToLower(l.Script)
+		}
+		s.limiters = append(s.limiters, &scriptLimiter{ScriptLimit: l, tokens: scriptBurst(l.Rate), refilled: now})
+	}
+	return s
+}
+
+// scriptBurst is how many calls a rate limit lets through at once, a second's
+// worth of them
+func scriptBurst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// scriptCall is the SHA a script command runs, and the body it sends if it
+// sends one. SCRIPT LOAD is a call of nothing, but teaches the body of its SHA.
+func scriptCall(m *redis.Message) (sha string, body []byte, call bool) {
+	if !m.IsArray() || len(m.Array) < 2 {
+		return "", nil, false
+	}
+	switch strings.ToUpper(string(m.Array[0].Value)) {
+	case "EVAL", "EVAL_RO":
+		return scriptSHA(m.Array[1].Value), m.Array[1].Value, true
+	case "EVALSHA", "EVALSHA_RO":
+		return strings.ToLower(string(m.Array[1].Value)), nil, true
+	case "SCRIPT":
+		if len(m.Array) == 3 && strings.ToUpper(string(m.Array[1].Value)) == "LOAD" {
+			return scriptSHA(m.Array[2].Value), m.Array[2].Value, false
+		}
+	}
+	return "", nil, false
+}
+
+func scriptSHA(body []byte) string {
+	sum := sha1.Sum(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScript returns the name a script body gives itself in one of its leading
+// comment lines, if it does, and its first line
+func parseScript(body []byte) (name, firstLine string) {
+	lines := strings.Split(string(body), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if firstLine == "" {
+			firstLine = lines[i]
+			if len(firstLine) > maxFirstLine {
+				firstLine = firstLine[:maxFirstLine]
+			}
+			firstLine = strings.TrimSpace(firstLine)
+		}
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		if m := scriptNameComment.FindStringSubmatch(line); m != nil {
+			name = m[1]
+			break
+		}
+	}
+	return name, firstLine
+}
+
+// state returns the state of a script, learning its body if given one, or nil
+// if it isn't tracked. It must be called with mu held.
+func (s *Scripts) state(sha string, body []byte) *scriptState {
+	st, ok := s.scripts[sha]
+	if !ok {
+		if len(s.scripts) >= s.opts.MaxTracked {
+			return nil
+		}
+		st = &scriptState{sha: sha}
+		s.scripts[sha] = st
+	}
+	if body != nil && st.firstLine == "" {
+		st.name, st.firstLine = parseScript(body)
+	}
+	return st
+}
+
+// name is the name of a script, if its body is known and names it. It must be
+// called with mu held.
+func (s *Scripts) name(sha string) string {
+	if st, ok := s.scripts[sha]; ok {
+		return st.name
+	}
+	return ""
+}
+
+// applies is whether a limit applies to a script. It must be called with mu
+// held.
+func (l *scriptLimiter) applies(sha, name string) bool {
+	return l.Script == AllScripts || l.Script == sha || (name != "" && l.Script == name)
+}
+
+// take takes a call of the rate limit, if it has one left. It must be called
+// with mu held.
+func (l *scriptLimiter) take(now time.Time) bool {
+	if l.Rate <= 0 {
+		return true
+	}
+	l.tokens += now.Sub(l.refilled).Seconds() * l.Rate
+	if burst := scriptBurst(l.Rate); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.refilled = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// acquire takes an in-flight slot of l, waiting up to Wait for one, and returns
+// whether it got one
+func (s *Scripts) acquire(l *scriptLimiter) bool {
+	s.mu.Lock()
+	if l.inUse < l.InFlight {
+		l.inUse++
+		s.mu.Unlock()
+		return true
+	}
+	if s.opts.Wait <= 0 {
+		s.mu.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(s.opts.Wait)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range l.waiters {
+		if w == ready {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return false
+		}
+	}
+	// handed a slot as the wait ran out
+	return true
+}
+
+// release gives back an in-flight slot of l, handing it to its first waiter if
+// there is one
+func (s *Scripts) release(l *scriptLimiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(l.waiters) > 0 {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		return
+	}
+	l.inUse--
+}
+
+// observe accounts for the script calls of a round trip that took elapsed, and
+// learns the bodies sent, logging the calls that took longer than Slow
+func (s *Scripts) observe(wm, res []*redis.Message, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	for i, m := range wm {
+		sha, body, call := scriptCall(m)
+		if sha == "" {
+			continue
+		}
+		failed := i >= len(res) || res[i].IsError()
+		s.mu.Lock()
+		st := s.state(sha, body)
+		if !call {
+			s.mu.Unlock()
+			continue
+		}
+		if st == nil {
+			s.untracked++
+			s.mu.Unlock()
+			continue
+		}
+		st.calls++
+		if failed {
+			st.errors++
+		}
+		st.total += elapsed
+		if elapsed > st.max {
+			st.max = elapsed
+		}
+		name, firstLine := st.name, st.firstLine
+		s.mu.Unlock()
+		if s.opts.Slow > 0 && elapsed > s.opts.Slow {
+			tag := name
+			if tag == "" {
+				tag = "unnamed"
+			}
+			metrics.ScriptSlow.Incr(s.statsd, tag)
+			s.log.Warn("Long-running script", zap.String("sha", sha), zap.String("name", name), zap.String("first_line", firstLine), zap.Duration("latency", elapsed), zap.Duration("threshold", s.opts.Slow))
+		}
+	}
+}
+
+// Stats returns the scripts with the most time spent running, and the state of
+// the limits
+func (s *Scripts) Stats() *ScriptsStats {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := &ScriptsStats{Tracked: len(s.scripts), Untracked: s.untracked}
+	for _, st := range s.scripts {
+		if st.calls == 0 {
+			continue
+		}
+		stats.Top = append(stats.Top, ScriptStats{
+			SHA:       st.sha,
+			Name:      st.name,
+			FirstLine: st.firstLine,
+			Calls:     st.calls,
+			Errors:    st.errors,
+			TotalMs:   float64(st.total) / float64(time.Millisecond),
+			AvgMs:     float64(st.total) / float64(st.calls) / float64(time.Millisecond),
+			MaxMs:     float64(st.max) / float64(time.Millisecond),
+		})
+	}
+	sort.Slice(stats.Top, func(i, j int) bool {
+		if stats.Top[i].TotalMs != stats.Top[j].TotalMs {
+			return stats.Top[i].TotalMs > stats.Top[j].TotalMs
+		}
+		return stats.Top[i].SHA < stats.Top[j].SHA
+	})
+	if len(stats.Top) > scriptsTop {
+		stats.Top = stats.Top[:scriptsTop]
+	}
+	for _, l := range s.limiters {
+		stats.Limits = append(stats.Limits, ScriptLimitStats{
+			Script:   l.Script,
+			Rate:     l.Rate,
+			InFlight: l.InFlight,
+			InUse:    l.inUse,
+			Waiting:  len(l.waiters),
+			Shed:     l.shed,
+		})
+	}
+	return stats
+}
+
+// admitScripts takes the allowances of the scripts among the forwarded
+// commands: one call of each rate limit for each of them, and one in-flight
+// slot of each limit for the request as a whole, since the scripts of a
+// request run one after the other on its one connection. The scripts over a
+// limit are answered with PROXYOVERLOADED, keyed by their index in wm, or
+// every command if they are part of a transaction, which is forwarded whole or
+// not at all. The returned function gives the slots back.
+func (c *connection) admitScripts(transaction bool, wm []*redis.Message) (map[int]*redis.Message, func()) {
+	s := c.opts.Scripts
+	if s == nil || len(s.limiters) == 0 {
+		return nil, func() {}
+	}
+	type call struct {
+		i    int
+		sha  string
+		name string
+	}
+	var calls []call
+	s.mu.Lock()
+	for i, m := range wm {
+		sha, body, ok := scriptCall(m)
+		if !ok {
+			continue
+		}
+		// a body sent is learned right away, for the calls by SHA after it
+		name := s.name(sha)
+		if body != nil {
+			if st := s.state(sha, body); st != nil {
+				name = st.name
+			} else {
+				name, _ = parseScript(body)
+			}
+		}
+		calls = append(calls, call{i: i, sha: sha, name: name})
+	}
+	if len(calls) == 0 {
+		s.mu.Unlock()
+		return nil, func() {}
+	}
+
+	shed := make(map[int]*redis.Message)
+	now := time.Now()
+	for _, l := range s.limiters {
+		for _, sc := range calls {
+			if _, ok := shed[sc.i]; ok || !l.applies(sc.sha, sc.name) {
+				continue
+			}
+			if !l.take(now) {
+				l.shed++
+				metrics.ScriptShed.Incr(c.statsd, l.Script, "rate")
+				shed[sc.i] = c.proxyError(proxyerr.Overloaded, "script %s over the rate limit of %s, %v calls per second", sc.sha, l.Script, l.Rate)
+			}
+		}
+	}
+	// only the limits of the scripts left to send are held
+	var holding []*scriptLimiter
+	for _, l := range s.limiters {
+		for _, sc := range calls {
+			if _, ok := shed[sc.i]; !ok && l.InFlight > 0 && l.applies(sc.sha, sc.name) {
+				holding = append(holding, l)
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	// in-flight slots are taken in the order of the limits, so that requests
+	// waiting on several can't deadlock
+	var held []*scriptLimiter
+	release := func() {
+		for _, l := range held {
+			s.release(l)
+		}
+		held = nil
+	}
+	for _, l := range holding {
+		start := time.Now()
+		ok := s.acquire(l)
+		if s.opts.Wait > 0 {
+			metrics.ScriptWait.Record(c.statsd, time.Since(start), l.Script, fmt.Sprint(ok))
+		}
+		if ok {
+			held = append(held, l)
+			continue
+		}
+		release()
+		s.mu.Lock()
+		l.shed++
+		s.mu.Unlock()
+		metrics.ScriptShed.Incr(c.statsd, l.Script, "in_flight")
+		for _, sc := range calls {
+			if _, ok := shed[sc.i]; !ok {
+				shed[sc.i] = c.proxyError(proxyerr.Overloaded, "script %s over the in-flight limit of %s, %d scripts running", sc.sha, l.Script, l.InFlight)
+			}
+		}
+		break
+	}
+	if c.trace != nil && len(shed) > 0 {
+		c.trace.add("scripts", fmt.Sprintf("%d of %d script calls shed by their limits", len(shed), len(calls)))
+	}
+	if transaction && len(shed) > 0 {
+		var r *redis.Message
+		for _, sc := range calls {
+			if r = shed[sc.i]; r != nil {
+				break
+			}
+		}
+		for i := range wm {
+			shed[i] = r
+		}
+	}
+	var once sync.Once
+	return shed, func() { once.Do(release) }
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const checkoutScript = "-- reserves stock for an order\n-- name: checkout\nreturn redis.call('DECR', KEYS[1])"
+
+// scriptsUpstream answers scripts with 1, and EVALSHA with NOSCRIPT unless its
+// body was loaded
+func scriptsUpstream(args []string) *redis.Message {
+	switch args[0] {
+	case "SCRIPT":
+		return redis.NewBulkBytes([]byte(scriptSHA([]byte(args[2]))))
+	case "EVALSHA":
+		if args[1] != scriptSHA([]byte(checkoutScript)) {
+			return redis.NewError([]byte("NOSCRIPT No matching script. Please use EVAL."))
+		}
+		return redis.NewInt([]byte("1"))
+	case "EVAL":
+		return redis.NewInt([]byte("1"))
+	}
+	return echoKey(args)
+}
+
+func TestParseScript(t *testing.T) {
+	name, first := parseScript([]byte(checkoutScript))
+	assert.Equal(t, "checkout", name)
+	assert.Equal(t, "-- reserves stock for an order", first)
+
+	name, first = parseScript([]byte("\n  return 1\n-- name: late"))
+	assert.Empty(t, name, "only the leading comments name a script")
+	assert.Equal(t, "return 1", first)
+}
+
+func TestScriptsAccounting(t *testing.T) {
+	upstream := newFakeUpstream(t, scriptsUpstream)
+	defer upstream.Close()
+	scripts := NewScripts(zaptest.NewLogger(t), nil, ScriptOptions{})
+	client := runTestConnection(t, upstream.Address(), Options{Scripts: scripts})
+	defer func() { _ = client.Close() }()
+
+	sha := scriptSHA([]byte(checkoutScript))
+	assert.Equal(t, []string{"-NOSCRIPT No matching script. Please use EVAL. \\r\\n "}, roundTripStrings(t, client, 1, respCommand("EVALSHA", "0123456789012345678901234567890123456789", "0")))
+	roundTripStrings(t, client, 1, respCommand("SCRIPT", "LOAD", checkoutScript))
+	roundTripStrings(t, client, 1, respCommand("EVALSHA", sha, "1", "stock"))
+	roundTripStrings(t, client, 1, respCommand("evalsha", sha, "1", "stock"))
+	roundTripStrings(t, client, 1, respCommand("EVAL", "return 1", "0"))
+
+	stats := scripts.Stats()
+	assert.Equal(t, 3, stats.Tracked)
+	if assert.Len(t, stats.Top, 3) {
+		byName := make(map[string]ScriptStats)
+		for _, s := range stats.Top {
+			byName[s.SHA] = s
+		}
+		checkout := byName[sha]
+		assert.Equal(t, "checkout", checkout.Name, "the SHA's body was learned from SCRIPT LOAD")
+		assert.Equal(t, "-- reserves stock for an order", checkout.FirstLine)
+		assert.EqualValues(t, 2, checkout.Calls)
+		assert.Zero(t, checkout.Errors)
+		assert.Greater(t, checkout.TotalMs, 0.0)
+		assert.Equal(t, "return 1", byName[scriptSHA([]byte("return 1"))].FirstLine, "EVAL teaches its own body")
+		unknown := byName["0123456789012345678901234567890123456789"]
+		assert.EqualValues(t, 1, unknown.Errors)
+		assert.Empty(t, unknown.FirstLine)
+	}
+
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("QUIT")))
+	assert.Empty(t, readUntilClosed(t, client))
+}
+
+func TestScriptsUntracked(t *testing.T) {
+	s := NewScripts(zaptest.NewLogger(t), nil, ScriptOptions{MaxTracked: 1})
+	wm := []*redis.Message{redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("EVAL")), redis.NewBulkBytes([]byte("return 1")), redis.NewBulkBytes([]byte("0"))}),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("EVAL")), redis.NewBulkBytes([]byte("return 2")), redis.NewBulkBytes([]byte("0"))})}
+	res := []*redis.Message{redis.NewInt([]byte("1")), redis.NewInt([]byte("2"))}
+	s.observe(wm, res, time.Millisecond)
+	s.observe(wm, res, time.Millisecond)
+	stats := s.Stats()
+	assert.Equal(t, 1, stats.Tracked)
+	assert.EqualValues(t, 2, stats.Top[0].Calls)
+	assert.EqualValues(t, 2, stats.Untracked)
+}
+
+func TestScriptSlow(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	s := NewScripts(zap.New(core), nil, ScriptOptions{Slow: 100 * time.Millisecond})
+	body := redis.NewBulkBytes([]byte(checkoutScript))
+	wm := []*redis.Message{redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("EVAL")), body, redis.NewBulkBytes([]byte("0"))})}
+	res := []*redis.Message{redis.NewInt([]byte("1"))}
+
+	s.observe(wm, res, 50*time.Millisecond)
+	assert.Zero(t, logs.Len())
+	s.observe(wm, res, 200*time.Millisecond)
+	if assert.Equal(t, 1, logs.Len()) {
+		fields := logs.All()[0].ContextMap()
+		assert.Equal(t, scriptSHA([]byte(checkoutScript)), fields["sha"])
+		assert.Equal(t, "checkout", fields["name"])
+		assert.Equal(t, "-- reserves stock for an order", fields["first_line"])
+	}
+}
+
+func TestScriptRateLimit(t *testing.T) {
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	upstream := newFakeUpstream(t, scriptsUpstream)
+	defer upstream.Close()
+	scripts := NewScripts(zaptest.NewLogger(t), nil, ScriptOptions{Limits: []ScriptLimit{{Script: "checkout", Rate: 0.001}}})
+	client := runTestConnection(t, upstream.Address(), Options{Scripts: scripts})
+	defer func() { _ = client.Close() }()
+
+	sha := scriptSHA([]byte(checkoutScript))
+	overloaded := "-PROXYOVERLOADED script " + sha + " over the rate limit of checkout, 0.001 calls per second \\r\\n "
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		":1 \\r\\n ",
+		overloaded,
+		":1 \\r\\n ",
+		"$7 \\r\\n a-value \\r\\n ",
+		"$-1 \\r\\n ",
+	}, roundTripStrings(t, client, 6, start, respCommand("EVAL", checkoutScript, "1", "stock"), respCommand("EVALSHA", sha, "1", "stock"), respCommand("EVAL", "return 1", "0"), respCommand("GET", "a"), end),
+		"the call over the limit is shed in its position, and the other scripts aren't limited by it")
+
+	assert.Equal(t, []string{"$-1 \\r\\n ", overloaded, overloaded, overloaded, "$-1 \\r\\n "}, roundTripStrings(t, client, 5, start, respCommand("MULTI"), respCommand("EVALSHA", sha, "1", "stock"), respCommand("EXEC"), end),
+		"a transaction with a script over its limit isn't sent")
+	assert.EqualValues(t, 3, upstream.Commands())
+
+	stats := scripts.Stats()
+	assert.Equal(t, []ScriptLimitStats{{Script: "checkout", Rate: 0.001, Shed: 2}}, stats.Limits)
+
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("QUIT")))
+	assert.Empty(t, readUntilClosed(t, client))
+}
+
+func TestScriptInFlightLimit(t *testing.T) {
+	release := make(chan struct{})
+	var running int32
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "EVAL" {
+			atomic.AddInt32(&running, 1)
+			<-release
+		}
+		return scriptsUpstream(args)
+	})
+	defer upstream.Close()
+	scripts := NewScripts(zaptest.NewLogger(t), nil, ScriptOptions{Limits: []ScriptLimit{{Script: AllScripts, InFlight: 1}}, Wait: 50 * time.Millisecond})
+	first := runTestConnection(t, upstream.Address(), Options{Scripts: scripts})
+	defer func() { _ = first.Close() }()
+	second := runTestConnection(t, upstream.Address(), Options{Scripts: scripts})
+	defer func() { _ = second.Close() }()
+
+	done := make(chan []string)
+	go func() { done <- roundTripStrings(t, first, 1, respCommand("EVAL", "return 1", "0")) }()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&running) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, &ScriptsStats{Tracked: 1, Limits: []ScriptLimitStats{{Script: "*", InFlight: 1, InUse: 1}}}, scripts.Stats())
+
+	assert.Equal(t, []string{"-PROXYOVERLOADED script " + scriptSHA([]byte("return 2")) + " over the in-flight limit of *, 1 scripts running \\r\\n "},
+		roundTripStrings(t, second, 1, respCommand("EVAL", "return 2", "0")), "a script waits for a slot, and is shed once the wait runs out")
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, second, 1, respCommand("GET", "a")), "other commands aren't limited")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release <- struct{}{}
+	}()
+	waited := make(chan []string)
+	go func() { waited <- roundTripStrings(t, second, 1, respCommand("EVAL", "return 3", "0")) }()
+	assert.Equal(t, []string{":1 \\r\\n "}, <-done)
+	release <- struct{}{}
+	assert.Equal(t, []string{":1 \\r\\n "}, <-waited, "a script given a slot within the wait runs")
+	assert.Equal(t, 0, scripts.Stats().Limits[0].InUse)
+
+	for _, client := range []net.Conn{first, second} {
+		_, _ = client.Write([]byte(respCommand("QUIT")))
+		assert.Equal(t, []string{"+OK \\r\\n "}, readUntilClosed(t, client))
+	}
+}
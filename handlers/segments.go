@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// Segment is a share of an upstream node's pool set aside for a class of
+// requests, those with a command Rule matches. Share is a fraction of the pool.
+type Segment struct {
+	Name  string
+	Share float64
+	Rule  Rule
+}
+
+// SegmentOptions configures the segments of a pool of PoolSize connections. A
+// segment out of connections lends one from a segment that has some to spare if
+// Borrow is set, and otherwise has its requests wait up to Wait for one before
+// they are shed.
+type SegmentOptions struct {
+	Segments []Segment
+	PoolSize int
+	Borrow   bool
+	Wait     time.Duration
+}
+
+type segmentState struct {
+	Segment
+	capacity int
+	// used are the slots of the segment taken, by its own requests or lent,
+	// inUse the slots its requests hold, and borrowed those of them lent by other
+	// segments
+	used, inUse, borrowed int
+	waiters               []chan struct{}
+}
+
+func (s *segmentState) free() int {
+	return s.capacity - s.used
+}
+
+// SegmentStats describe a segment for the admin stats
+type SegmentStats struct {
+	Name     string  `json:"name"`
+	Share    float64 `json:"share"`
+	Capacity int     `json:"capacity"`
+	InUse    int     `json:"in_use"`
+	Borrowed int     `json:"borrowed"`
+	Waiting  int     `json:"waiting"`
+}
+
+// Segments partitions the connections of a node's pool between classes of
+// requests, so that one class holding every connection, like slow scans,
+// doesn't starve the others. Each segment caps the requests it has in flight
+// at its share of the pool.
+type Segments struct {
+	opts SegmentOptions
+
+	mu       sync.Mutex
+	segments []*segmentState
+}
+
+func NewSegments(opts SegmentOptions) *Segments {
+	s := &Segments{opts: opts}
+	for _, seg := range opts.Segments {
+		st := &segmentState{Segment: seg}
+		st.capacity = segmentCapacity(seg.Share, opts.PoolSize)
+		s.segments = append(s.segments, st)
+	}
+	return s
+}
+
+// segmentCapacity is a share of the pool, of at least one connection
+func segmentCapacity(share float64, poolSize int) int {
+	if c := int(share * float64(poolSize)); c > 1 {
+		return c
+	}
+	return 1
+}
+
+// SetShares changes the shares of the segments, by name, letting waiters in if
+// their segment has grown. Segments left out keep their share.
+func (s *Segments) SetShares(shares map[string]float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range shares {
+		if s.find(name) == nil {
+			return fmt.Errorf("unknown segment %s", name)
+		}
+	}
+	for _, seg := range s.segments {
+		share, ok := shares[seg.Name]
+		if !ok {
+			continue
+		}
+		seg.Share = share
+		seg.capacity = segmentCapacity(share, s.opts.PoolSize)
+		for seg.free() > 0 && len(seg.waiters) > 0 {
+			seg.used++
+			s.handOff(seg)
+		}
+	}
+	return nil
+}
+
+func (s *Segments) find(name string) *segmentState {
+	for _, seg := range s.segments {
+		if seg.Name == name {
+			return seg
+		}
+	}
+	return nil
+}
+
+// acquire takes a slot in the i-th segment for a request, returning the
+// function that gives it back, or nil if the request is shed, and how it got
+// the slot: ok, borrowed, waited or shed
+func (s *Segments) acquire(i int) (func(), string) {
+	s.mu.Lock()
+	seg := s.segments[i]
+	if seg.free() > 0 {
+		seg.used++
+		seg.inUse++
+		s.mu.Unlock()
+		return s.releaser(seg, seg), "ok"
+	}
+	if s.opts.Borrow {
+		// a segment lends only if it is left with a free slot and nobody waiting,
+		// so that borrowing never makes its own requests wait
+		for _, lender := range s.segments {
+			if lender != seg && len(lender.waiters) == 0 && lender.free() > 1 {
+				lender.used++
+				seg.inUse++
+				seg.borrowed++
+				s.mu.Unlock()
+				return s.releaser(lender, seg), "borrowed"
+			}
+		}
+	}
+	if s.opts.Wait <= 0 {
+		s.mu.Unlock()
+		return nil, "shed"
+	}
+	ready := make(chan struct{})
+	seg.waiters = append(seg.waiters, ready)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(s.opts.Wait)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return s.releaser(seg, seg), "waited"
+	case <-timer.C:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for j, w := range seg.waiters {
+		if w == ready {
+			seg.waiters = append(seg.waiters[:j], seg.waiters[j+1:]...)
+			return nil, "shed"
+		}
+	}
+	// handed a slot as the wait ran out
+	return s.releaser(seg, seg), "waited"
+}
+
+// releaser gives back a slot of owner held by a request of holder, handing it
+// to the first request waiting on owner if there is one
+func (s *Segments) releaser(owner, holder *segmentState) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			holder.inUse--
+			if owner != holder {
+				holder.borrowed--
+			}
+			if owner.free() >= 0 && len(owner.waiters) > 0 {
+				s.handOff(owner)
+				return
+			}
+			owner.used--
+		})
+	}
+}
+
+// handOff passes a slot already counted in seg.used to its first waiter. It
+// must be called with mu held.
+func (s *Segments) handOff(seg *segmentState) {
+	ready := seg.waiters[0]
+	seg.waiters = seg.waiters[1:]
+	seg.inUse++
+	close(ready)
+}
+
+// Stats returns the occupancy of every segment
+func (s *Segments) Stats() []SegmentStats {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]SegmentStats, len(s.segments))
+	for i, seg := range s.segments {
+		stats[i] = SegmentStats{
+			Name:     seg.Name,
+			Share:    seg.Share,
+			Capacity: seg.capacity,
+			InUse:    seg.inUse,
+			Borrowed: seg.borrowed,
+			Waiting:  len(seg.waiters),
+		}
+	}
+	return stats
+}
+
+// Report emits the slots each segment's requests hold
+func (s *Segments) Report(sd *statsd.Client) {
+	for _, st := range s.Stats() {
+		metrics.SegmentInUse.Set(sd, float64(st.InUse), st.Name)
+	}
+}
+
+// segmentFor is the first segment, in configuration order, whose rule matches
+// one of the commands of a request, or the first segment if none does
+func (c *connection) segmentFor(cmds []string, wm []*redis.Message) int {
+	for i, seg := range c.opts.Segments.opts.Segments {
+		for j, m := range wm {
+			if c.matches(seg.Rule, cmds[j], m) {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// acquireSegment takes a slot of the request's segment, failing fast if it is
+// shed. The returned function gives the slot back.
+func (c *connection) acquireSegment(cmds []string, wm []*redis.Message) (func(), error) {
+	i := c.segmentFor(cmds, wm)
+	name := c.opts.Segments.opts.Segments[i].Name
+	start := time.Now()
+	release, result := c.opts.Segments.acquire(i)
+	metrics.SegmentCheckouts.Incr(c.statsd, name, result)
+	if result == "waited" || (result == "shed" && c.opts.Segments.opts.Wait > 0) {
+		metrics.SegmentWait.Record(c.statsd, time.Since(start), name)
+	}
+	if c.trace != nil {
+		c.trace.add("segment", name+", "+result)
+	}
+	if release == nil {
+		return nil, c.failFast(fmt.Sprintf("pool segment %s is exhausted", name))
+	}
+	return release, nil
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSegments(borrow bool, wait time.Duration) *Segments {
+	return NewSegments(SegmentOptions{
+		Segments: []Segment{
+			{Name: "fast", Share: 0.75},
+			{Name: "slow", Share: 0.25, Rule: Rule{Commands: map[string]bool{"KEYS": true}, Prefixes: []string{"analytics:"}}},
+		},
+		PoolSize: 4,
+		Borrow:   borrow,
+		Wait:     wait,
+	})
+}
+
+func TestSegmentsShed(t *testing.T) {
+	s := testSegments(false, 0)
+	release, result := s.acquire(1)
+	assert.Equal(t, "ok", result)
+	_, result = s.acquire(1)
+	assert.Equal(t, "shed", result, "a segment never uses the connections of another")
+
+	for i := 0; i < 3; i++ {
+		_, result = s.acquire(0)
+		assert.Equal(t, "ok", result)
+	}
+	_, result = s.acquire(0)
+	assert.Equal(t, "shed", result)
+	assert.Equal(t, []SegmentStats{
+		{Name: "fast", Share: 0.75, Capacity: 3, InUse: 3},
+		{Name: "slow", Share: 0.25, Capacity: 1, InUse: 1},
+	}, s.Stats())
+
+	release()
+	release()
+	_, result = s.acquire(1)
+	assert.Equal(t, "ok", result, "released slots are reused, once")
+}
+
+func TestSegmentsBorrow(t *testing.T) {
+	s := testSegments(true, 0)
+	_, _ = s.acquire(1)
+	release, result := s.acquire(1)
+	assert.Equal(t, "borrowed", result)
+	_, result = s.acquire(1)
+	assert.Equal(t, "borrowed", result)
+	_, result = s.acquire(1)
+	assert.Equal(t, "shed", result, "a lender keeps a slot for its own requests")
+	assert.Equal(t, SegmentStats{Name: "slow", Share: 0.25, Capacity: 1, InUse: 3, Borrowed: 2}, s.Stats()[1])
+
+	_, result = s.acquire(0)
+	assert.Equal(t, "ok", result)
+	release()
+	assert.Equal(t, SegmentStats{Name: "fast", Share: 0.75, Capacity: 3, InUse: 1}, s.Stats()[0])
+}
+
+func TestSegmentsWait(t *testing.T) {
+	s := testSegments(false, time.Second)
+	release, _ := s.acquire(1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		release()
+	}()
+	start := time.Now()
+	release, result := s.acquire(1)
+	assert.Equal(t, "waited", result)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+
+	s.opts.Wait = 20 * time.Millisecond
+	_, result = s.acquire(1)
+	assert.Equal(t, "shed", result)
+	assert.Equal(t, 0, s.Stats()[1].Waiting)
+
+	// growing a segment lets its waiters in
+	s.opts.Wait = time.Second
+	done := make(chan string)
+	go func() {
+		_, result := s.acquire(1)
+		done <- result
+	}()
+	assert.Eventually(t, func() bool { return s.Stats()[1].Waiting == 1 }, time.Second, time.Millisecond)
+	assert.NoError(t, s.SetShares(map[string]float64{"fast": 0.5, "slow": 0.5}))
+	assert.Equal(t, "waited", <-done)
+	assert.Equal(t, SegmentStats{Name: "slow", Share: 0.5, Capacity: 2, InUse: 2}, s.Stats()[1])
+	assert.EqualError(t, s.SetShares(map[string]float64{"bulk": 0.5}), "unknown segment bulk")
+	release()
+}
+
+func TestSegmentFor(t *testing.T) {
+	c := connection{opts: Options{Segments: testSegments(false, 0)}}
+	for _, tc := range []struct {
+		cmds    [][]string
+		segment int
+	}{
+		{[][]string{{"GET", "user:1"}}, 0},
+		{[][]string{{"KEYS", "*"}}, 1},
+		{[][]string{{"GET", "analytics:1"}}, 1},
+		{[][]string{{"GET", "user:1"}, {"GET", "analytics:1"}}, 1},
+	} {
+		var cmds []string
+		var wm []*redis.Message
+		for _, args := range tc.cmds {
+			cmds = append(cmds, args[0])
+			wm = append(wm, redis.NewArray(bulks(args...)))
+		}
+		assert.Equal(t, tc.segment, c.segmentFor(cmds, wm), tc.cmds)
+	}
+}
+
+func TestSegmentsIsolateSlowRequests(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if len(args) > 1 && args[1] == "analytics:report" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	s := newTestServer(t, upstream.Address(), 4)
+	defer func() { _ = s.Disconnect(context.Background()) }()
+	opts := Options{Upstream: "10.0.0.1:7001", Segments: testSegments(false, 0)}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		client := serveTestConnection(t, s, opts, nil)
+		defer func() { _ = client.Close() }()
+		assert.Equal(t, []string{"$22 \\r\\n analytics:report-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "analytics:report")))
+	}()
+	assert.Eventually(t, func() bool { return opts.Segments.Stats()[1].InUse == 1 }, time.Second, time.Millisecond)
+
+	client := serveTestConnection(t, s, opts, nil)
+	defer func() { _ = client.Close() }()
+	assert.Equal(t, []string{"-PROXYOVERLOADED pool segment slow is exhausted for upstream node 10.0.0.1:7001, failing fast \\r\\n "},
+		roundTripStrings(t, client, 1, respCommand("GET", "analytics:other")))
+	start := time.Now()
+	assert.Equal(t, []string{"$12 \\r\\n user:1-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "user:1")))
+	assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond), "fast requests must not wait for slow ones")
+	wg.Wait()
+}
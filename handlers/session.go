@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// recordSession writes a request and the replies it got to the connection's
+// session file, first starting one if a rule armed for the client matches it.
+// Until then, this costs one atomic load per request.
+func (c *connection) recordSession(read time.Time, wm, replies []*redis.Message) {
+	if c.session == nil {
+		if !c.opts.Sessions.Armed() {
+			return
+		}
+		w, err := c.opts.Sessions.Start(c.clientAddr(), c.client.name, c.opts.Upstream)
+		if err != nil {
+			c.log.Error("Failed to start session recording", zap.Error(err))
+		}
+		if w == nil {
+			return
+		}
+		c.log.Info("Recording client session", zap.String("file", w.Path()), zap.String("client", c.clientAddr()), zap.String("client_name", c.client.name))
+		c.session = w
+	}
+	if err := c.session.Write(read, rawMessages(wm), rawMessages(replies)); err != nil {
+		c.stopSession(err.Error())
+	}
+}
+
+// stopSession ends the connection's session recording, if there is one
+func (c *connection) stopSession(reason string) {
+	if c.session == nil {
+		return
+	}
+	if err := c.session.Close(reason); err != nil {
+		c.log.Error("Failed to close session recording", zap.String("file", c.session.Path()), zap.Error(err))
+	}
+	c.log.Info("Stopped recording client session", zap.String("file", c.session.Path()), zap.String("reason", reason))
+	c.session = nil
+}
+
+func (c *connection) clientAddr() string {
+	if a := c.conn.RemoteAddr(); a != nil {
+		return a.String()
+	}
+	return ""
+}
+
+// rawMessages returns the exact bytes of each message, which only those the proxy
+// made itself need encoding for
+func rawMessages(wm []*redis.Message) [][]byte {
+	raw := make([][]byte, len(wm))
+	for i, m := range wm {
+		if m.Raw != nil {
+			raw[i] = m.Raw
+			continue
+		}
+		raw[i], _ = redis.EncodeToBytes(m)
+	}
+	return raw
+}
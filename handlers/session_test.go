@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coinbase/redisbetween/session"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordSession(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "sessions")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	recorder := session.NewRecorder(dir, 1<<20, 10)
+	_, err = recorder.Arm("", "checkout-7")
+	assert.NoError(t, err)
+
+	s := newTestServer(t, upstream.Address(), 2)
+	done := make(chan struct{})
+	client := serveTestConnection(t, s, Options{Sessions: recorder}, func() {
+		_ = s.Disconnect(context.Background())
+		close(done)
+	})
+	roundTripStrings(t, client, 1, respCommand("GET", "before"))
+	roundTripStrings(t, client, 1, respCommand("HELLO", "2", "SETNAME", "checkout-7"))
+	roundTripStrings(t, client, 1, respCommand("GET", "a"))
+	roundTripStrings(t, client, 4,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("GET", "b"),
+		respCommand("SET", "c", "1"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	)
+	_ = client.Close()
+	<-done
+
+	files, err := filepath.Glob(filepath.Join(dir, "session-*.jsonl"))
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	recorded, err := session.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "checkout-7", recorded.Header.Name)
+	assert.Equal(t, "client disconnected", recorded.End)
+	if assert.Len(t, recorded.Requests, 3, "recording starts with the request that matched") {
+		assert.Equal(t, respCommand("GET", "a"), string(recorded.Requests[1].Commands[0]))
+		assert.Equal(t, "$7\r\na-value\r\n", string(recorded.Requests[1].Replies[0]))
+		assert.Equal(t, []string{respCommand("GET", "b"), respCommand("SET", "c", "1")}, []string{string(recorded.Requests[2].Commands[0]), string(recorded.Requests[2].Commands[1])})
+		assert.Equal(t, "+OK\r\n", string(recorded.Requests[2].Replies[1]))
+	}
+	assert.False(t, recorder.Armed())
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"go.uber.org/zap"
+)
+
+// SignalsWarnInterval is how often each anomaly of the pipeline signals is
+// logged per listener, the ones in between being counted in the next warning
+const SignalsWarnInterval = 10 * time.Second
+
+// The anomalies of the pipeline signals, as tagged in the pipeline.signals
+// metric
+const (
+	SignalNestedStart = "nested_start"
+	SignalStrayEnd    = "stray_end"
+	SignalAbandoned   = "abandoned"
+)
+
+// Signals accounts for the pipelines the client connections of a listener wrap
+// in the GET 🔜 and GET 🔚 signals, and for the signals that don't balance: a
+// start signal inside an open pipeline, which the proxy reads as part of it, an
+// end signal outside of any, which it skips, and a pipeline whose connection
+// ended before its end signal. The pipelines open are kept with the time they
+// were opened, so that one that is stuck can be spotted.
+type Signals struct {
+	opened, closed, abandoned, nested, stray int64
+
+	mu     sync.Mutex
+	open   map[uint64]openPipeline
+	warned map[string]time.Time
+	missed map[string]int64
+}
+
+type openPipeline struct {
+	client  string
+	name    string
+	started time.Time
+}
+
+// SignalsStats are the counts of a listener's Signals, and its pipelines open,
+// the oldest first
+type SignalsStats struct {
+	Opened       int64          `json:"opened"`
+	Closed       int64          `json:"closed"`
+	Abandoned    int64          `json:"abandoned"`
+	NestedStarts int64          `json:"nested_starts"`
+	StrayEnds    int64          `json:"stray_ends"`
+	Open         []OpenPipeline `json:"open"`
+}
+
+// OpenPipeline is a pipeline whose end signal is yet to be read: the id of its
+// connection, the client library and name it announced, and how long ago its
+// start signal was read
+type OpenPipeline struct {
+	ID     uint64  `json:"id"`
+	Client string  `json:"client"`
+	Name   string  `json:"name,omitempty"`
+	AgeMs  float64 `json:"age_ms"`
+}
+
+func NewSignals() *Signals {
+	return &Signals{open: make(map[uint64]openPipeline), warned: make(map[string]time.Time), missed: make(map[string]int64)}
+}
+
+// Stats returns the counts and open pipelines of the signals, nil without
+// Signals
+func (s *Signals) Stats() *SignalsStats {
+	if s == nil {
+		return nil
+	}
+	st := &SignalsStats{
+		Opened:       atomic.LoadInt64(&s.opened),
+		Closed:       atomic.LoadInt64(&s.closed),
+		Abandoned:    atomic.LoadInt64(&s.abandoned),
+		NestedStarts: atomic.LoadInt64(&s.nested),
+		StrayEnds:    atomic.LoadInt64(&s.stray),
+		Open:         []OpenPipeline{},
+	}
+	now := time.Now()
+	s.mu.Lock()
+	for id, p := range s.open {
+		st.Open = append(st.Open, OpenPipeline{ID: id, Client: p.client, Name: p.name, AgeMs: float64(now.Sub(p.started)) / float64(time.Millisecond)})
+	}
+	s.mu.Unlock()
+	sort.Slice(st.Open, func(i, j int) bool {
+		return st.Open[i].AgeMs > st.Open[j].AgeMs
+	})
+	return st
+}
+
+// opening records the pipeline of connection id as open, from now
+func (s *Signals) opening(id uint64, client clientInfo, now time.Time) {
+	atomic.AddInt64(&s.opened, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.open[id] = openPipeline{client: client.library(), name: client.name, started: now}
+}
+
+// closing forgets the open pipeline of connection id, counting it closed, or
+// abandoned if its end signal was never read
+func (s *Signals) closing(id uint64, abandoned bool) {
+	if abandoned {
+		atomic.AddInt64(&s.abandoned, 1)
+	} else {
+		atomic.AddInt64(&s.closed, 1)
+	}
+	s.forget(id)
+}
+
+// forget forgets the open pipeline of connection id, uncounted
+func (s *Signals) forget(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.open, id)
+}
+
+// anomaly counts an anomaly of the signals, and returns whether it is to be
+// logged, with the number of the same anomaly that weren't since the last
+func (s *Signals) anomaly(kind string, now time.Time) (bool, int64) {
+	switch kind {
+	case SignalNestedStart:
+		atomic.AddInt64(&s.nested, 1)
+	case SignalStrayEnd:
+		atomic.AddInt64(&s.stray, 1)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.warned[kind]) < SignalsWarnInterval {
+		s.missed[kind]++
+		return false, 0
+	}
+	missed := s.missed[kind]
+	s.warned[kind], s.missed[kind] = now, 0
+	return true, missed
+}
+
+// signalRead accounts for a signal read from the client: a start signal if
+// open, with read being the messages read before it in the request, and was
+// whether a pipeline was open already
+func (c *connection) signalRead(open, was bool, read int) {
+	now := time.Now()
+	switch {
+	case open && !was:
+		metrics.PipelineSignals.Incr(c.statsd, "opened")
+		c.signalStarted, c.signalBefore = now, read
+		if s := c.opts.Signals; s != nil {
+			s.opening(c.id, c.client, now)
+		}
+	case !open && was:
+		metrics.PipelineSignals.Incr(c.statsd, "closed")
+		metrics.PipelineSignalCommands.Record(c.statsd, float64(read-c.signalBefore))
+		metrics.PipelineSignalDuration.Record(c.statsd, now.Sub(c.signalStarted))
+		if s := c.opts.Signals; s != nil {
+			s.closing(c.id, false)
+		}
+	case open:
+		c.signalAnomaly(SignalNestedStart, "Client sent a pipeline start signal inside an open pipeline", now)
+	default:
+		c.signalAnomaly(SignalStrayEnd, "Client sent a pipeline end signal outside of any pipeline", now)
+	}
+}
+
+// signalAbandoned accounts for the pipeline left open as the connection ends,
+// unless it was cut short by a drain rather than by the client
+func (c *connection) signalAbandoned() {
+	if c.readCtx.Err() != nil {
+		if s := c.opts.Signals; s != nil {
+			s.forget(c.id)
+		}
+		return
+	}
+	if s := c.opts.Signals; s != nil {
+		s.closing(c.id, true)
+	}
+	c.signalAnomaly(SignalAbandoned, "Client disconnected in the middle of a pipeline, before its end signal", time.Now())
+}
+
+// signalAnomaly counts an anomaly of the signals, logging it with the client
+// sending them unless one of its kind was logged within SignalsWarnInterval
+func (c *connection) signalAnomaly(kind, msg string, now time.Time) {
+	metrics.PipelineSignals.Incr(c.statsd, kind)
+	s := c.opts.Signals
+	if s == nil {
+		return
+	}
+	if ok, missed := s.anomaly(kind, now); ok {
+		c.log.Warn(msg, zap.String("client_library", c.client.library()), zap.String("client_name", c.client.name), zap.Int64("unlogged", missed))
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignals(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	t.Cleanup(upstream.Close)
+	s := NewSignals()
+	client := closingTestConnection(t, upstream.Address(), Options{Signals: s})
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+
+	roundTripStrings(t, client, 4, start, respCommand("GET", "a"), respCommand("GET", "b"), end)
+	assert.Equal(t, &SignalsStats{Opened: 1, Closed: 1, Open: []OpenPipeline{}}, s.Stats())
+
+	// a start signal inside the pipeline is read as part of it, and the end
+	// signal left over is skipped
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n ", "$7 \\r\\n b-value \\r\\n "},
+		roundTripStrings(t, client, 4, start, respCommand("GET", "a"), start, respCommand("GET", "b"), end)[1:3])
+	assert.Equal(t, []string{"$7 \\r\\n c-value \\r\\n "}, roundTripStrings(t, client, 1, end, respCommand("GET", "c")))
+	st := s.Stats()
+	assert.Equal(t, int64(1), st.NestedStarts)
+	assert.Equal(t, int64(1), st.StrayEnds)
+	assert.Equal(t, int64(2), st.Closed)
+
+	// a pipeline is listed open until its end signal is read
+	go func() { _, _ = client.Write([]byte(start + respCommand("GET", "a"))) }()
+	assert.Eventually(t, func() bool { return len(s.Stats().Open) == 1 }, time.Second, time.Millisecond)
+	open := s.Stats().Open[0]
+	assert.Equal(t, uint64(1), open.ID)
+	assert.Equal(t, UnknownClientLibrary, open.Client)
+	assert.Len(t, roundTripStrings(t, client, 4, respCommand("GET", "b"), end), 4)
+	assert.Empty(t, s.Stats().Open)
+
+	// and abandoned if its connection ends before
+	go func() { _, _ = client.Write([]byte(start + respCommand("GET", "a"))) }()
+	assert.Eventually(t, func() bool { return len(s.Stats().Open) == 1 }, time.Second, time.Millisecond)
+	_ = client.Close()
+	assert.Eventually(t, func() bool { return s.Stats().Abandoned == 1 }, time.Second, time.Millisecond)
+	st = s.Stats()
+	assert.Empty(t, st.Open)
+	assert.Equal(t, int64(4), st.Opened)
+	assert.Equal(t, int64(3), st.Closed)
+}
+
+func TestSignalsWarnedOncePerInterval(t *testing.T) {
+	s := NewSignals()
+	now := time.Now()
+	for i, want := range []struct {
+		logged   bool
+		unlogged int64
+		after    time.Duration
+	}{
+		{true, 0, 0},
+		{false, 0, time.Second},
+		{false, 0, 2 * time.Second},
+		{true, 2, SignalsWarnInterval},
+	} {
+		logged, unlogged := s.anomaly(SignalNestedStart, now.Add(want.after))
+		assert.Equal(t, want.logged, logged, i)
+		assert.Equal(t, want.unlogged, unlogged, i)
+	}
+	logged, _ := s.anomaly(SignalStrayEnd, now)
+	assert.True(t, logged, "each anomaly is logged on its own")
+	assert.Equal(t, int64(4), s.Stats().NestedStarts)
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+)
+
+// SLO classes other than a command name
+const (
+	SLOClassAll   = "all"
+	SLOClassRead  = "read"
+	SLOClassWrite = "write"
+)
+
+// DefaultSLOMinSamples is the number of requests a window needs for its burn
+// rate to be reported
+const DefaultSLOMinSamples = 100
+
+// SLOWindows are the windows burn rates are computed over
+var SLOWindows = []struct {
+	Name   string
+	Length time.Duration
+}{{"5m", 5 * time.Minute}, {"1h", time.Hour}, {"6h", 6 * time.Hour}}
+
+// sloBucket is the length of the buckets requests are counted in
+const sloBucket = time.Minute
+
+// sloBuckets covers the longest window, plus the bucket being filled
+const sloBuckets = int(6*time.Hour/sloBucket) + 1
+
+// SLO is a latency objective: that Objective, a fraction, of the requests of
+// Class are answered within Threshold. Class is read, write, all, or a command,
+// which requests match if every one of their commands is it.
+type SLO struct {
+	Name      string
+	Class     string
+	Threshold time.Duration
+	Objective float64
+}
+
+// matches is whether a request, a command or a pipeline of them, is of the
+// SLO's class. Pipelines are measured as a whole, so a pipeline is a read if it
+// has no write, and a write otherwise.
+func (s SLO) matches(cmds []string) bool {
+	switch s.Class {
+	case SLOClassAll:
+		return true
+	case SLOClassRead, SLOClassWrite:
+		return isWrite(cmds) == (s.Class == SLOClassWrite)
+	}
+	for _, cmd := range cmds {
+		if cmd != s.Class {
+			return false
+		}
+	}
+	return len(cmds) > 0
+}
+
+func isWrite(cmds []string) bool {
+	for _, cmd := range cmds {
+		if WriteCommands[cmd] {
+			return true
+		}
+	}
+	return false
+}
+
+// requestClass is read or write, the latency tag of a request
+func requestClass(cmds []string) string {
+	if isWrite(cmds) {
+		return SLOClassWrite
+	}
+	return SLOClassRead
+}
+
+type sloCount struct {
+	minute    int64
+	good, bad int64
+}
+
+type sloState struct {
+	SLO
+	buckets [sloBuckets]sloCount
+}
+
+func (s *sloState) bucket(now time.Time) *sloCount {
+	minute := now.UnixNano() / int64(sloBucket)
+	b := &s.buckets[minute%int64(sloBuckets)]
+	if b.minute != minute {
+		*b = sloCount{minute: minute}
+	}
+	return b
+}
+
+// counts sums the buckets in the window ending now
+func (s *sloState) counts(now time.Time, window time.Duration) (good, bad int64) {
+	minute := now.UnixNano() / int64(sloBucket)
+	for m := minute - int64(window/sloBucket) + 1; m <= minute; m++ {
+		if b := s.buckets[m%int64(sloBuckets)]; b.minute == m {
+			good += b.good
+			bad += b.bad
+		}
+	}
+	return good, bad
+}
+
+// SLOStatus is the compliance of an SLO over each of SLOWindows. The burn rate
+// of a window is the rate its error budget is spent at, 1 spending it exactly
+// over the period of the SLO, and is left out until the window has
+// MinSamples requests.
+type SLOStatus struct {
+	Name      string              `json:"name"`
+	Class     string              `json:"class"`
+	Threshold string              `json:"threshold"`
+	Objective float64             `json:"objective"`
+	Windows   map[string]SLOCount `json:"windows"`
+}
+
+// SLOCount is the requests of a window, and its burn rate if there are enough
+type SLOCount struct {
+	Good     int64    `json:"good"`
+	Bad      int64    `json:"bad"`
+	BurnRate *float64 `json:"burn_rate,omitempty"`
+}
+
+// SLOs tracks the SLOs of an upstream, classifying each request by the latency
+// it was answered with
+type SLOs struct {
+	minSamples int64
+	now        func() time.Time
+
+	mu   sync.Mutex
+	slos []*sloState
+}
+
+func NewSLOs(slos []SLO, minSamples int) *SLOs {
+	s := &SLOs{minSamples: int64(minSamples), now: time.Now}
+	for _, slo := range slos {
+		s.slos = append(s.slos, &sloState{SLO: slo})
+	}
+	return s
+}
+
+// Observe counts a request answered after elapsed as good or bad against each
+// SLO its commands match
+func (s *SLOs) Observe(sd *statsd.Client, cmds []string, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	now := s.now()
+	for _, slo := range s.slos {
+		if !slo.matches(cmds) {
+			continue
+		}
+		good := elapsed <= slo.Threshold
+		s.mu.Lock()
+		b := slo.bucket(now)
+		if good {
+			b.good++
+		} else {
+			b.bad++
+		}
+		s.mu.Unlock()
+		if good {
+			metrics.SLORequests.Incr(sd, slo.Name, "good")
+		} else {
+			metrics.SLORequests.Incr(sd, slo.Name, "bad")
+		}
+	}
+}
+
+// Status returns the current compliance of every SLO
+func (s *SLOs) Status() []SLOStatus {
+	if s == nil {
+		return nil
+	}
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]SLOStatus, 0, len(s.slos))
+	for _, slo := range s.slos {
+		st := SLOStatus{
+			Name:      slo.Name,
+			Class:     slo.Class,
+			Threshold: slo.Threshold.String(),
+			Objective: slo.Objective,
+			Windows:   make(map[string]SLOCount, len(SLOWindows)),
+		}
+		for _, w := range SLOWindows {
+			c := SLOCount{}
+			c.Good, c.Bad = slo.counts(now, w.Length)
+			if total := c.Good + c.Bad; total > 0 && total >= s.minSamples {
+				burn := float64(c.Bad) / float64(total) / (1 - slo.Objective)
+				c.BurnRate = &burn
+			}
+			st.Windows[w.Name] = c
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// Report emits the burn rate of every window with enough requests
+func (s *SLOs) Report(sd *statsd.Client) {
+	for _, st := range s.Status() {
+		for _, w := range SLOWindows {
+			if c := st.Windows[w.Name]; c.BurnRate != nil {
+				metrics.SLOBurnRate.Set(sd, *c.BurnRate, st.Name, w.Name)
+			}
+		}
+	}
+}
+
+// NormalizeSLOClass returns the class of an SLO as it is matched: lower case
+// for read, write and all, and upper case for a command
+func NormalizeSLOClass(class string) string {
+	switch c := strings.ToLower(class); c {
+	case SLOClassAll, SLOClassRead, SLOClassWrite:
+		return c
+	}
+	return strings.ToUpper(class)
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSLOMatches(t *testing.T) {
+	read := SLO{Class: SLOClassRead}
+	write := SLO{Class: SLOClassWrite}
+	get := SLO{Class: "GET"}
+	all := SLO{Class: SLOClassAll}
+
+	assert.True(t, read.matches([]string{"GET"}))
+	assert.True(t, read.matches([]string{"GET", "MGET"}))
+	assert.False(t, read.matches([]string{"GET", "SET"}), "a pipeline with a write is a write")
+	assert.True(t, write.matches([]string{"GET", "SET"}))
+	assert.False(t, write.matches([]string{"GET"}))
+	assert.True(t, get.matches([]string{"GET", "GET"}))
+	assert.False(t, get.matches([]string{"GET", "MGET"}))
+	assert.False(t, get.matches(nil))
+	assert.True(t, all.matches([]string{"SET"}))
+
+	assert.Equal(t, "read", NormalizeSLOClass("Read"))
+	assert.Equal(t, "GET", NormalizeSLOClass("get"))
+}
+
+func TestSLOBurnRate(t *testing.T) {
+	s := NewSLOs([]SLO{
+		{Name: "get-fast", Class: "GET", Threshold: 5 * time.Millisecond, Objective: 0.99},
+		{Name: "writes", Class: SLOClassWrite, Threshold: 20 * time.Millisecond, Objective: 0.9},
+	}, 10)
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+
+	// too few requests for a burn rate
+	s.Observe(nil, []string{"GET"}, time.Second)
+	s.Observe(nil, []string{"GET"}, time.Millisecond)
+	status := s.Status()
+	assert.Equal(t, SLOCount{Good: 1, Bad: 1}, status[0].Windows["5m"], "two requests aren't enough to report a burn rate")
+	assert.Equal(t, SLOCount{}, status[1].Windows["5m"])
+
+	// an hour ago, every GET was fast
+	now = now.Add(-time.Hour)
+	for i := 0; i < 100; i++ {
+		s.Observe(nil, []string{"GET"}, time.Millisecond)
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 8; i++ {
+		s.Observe(nil, []string{"GET"}, time.Millisecond)
+	}
+	for i := 0; i < 20; i++ {
+		s.Observe(nil, []string{"SET"}, 30*time.Millisecond)
+	}
+
+	status = s.Status()
+	assert.Equal(t, "get-fast", status[0].Name)
+	assert.Equal(t, "5ms", status[0].Threshold)
+	fiveMinutes := status[0].Windows["5m"]
+	assert.Equal(t, int64(9), fiveMinutes.Good)
+	assert.Equal(t, int64(1), fiveMinutes.Bad)
+	assert.InDelta(t, 10, *fiveMinutes.BurnRate, 1e-9, "10%% bad against a 1%% budget burns it 10 times too fast")
+	sixHours := status[0].Windows["6h"]
+	assert.Equal(t, int64(109), sixHours.Good)
+	assert.InDelta(t, 1/110.0/0.01, *sixHours.BurnRate, 1e-9)
+	assert.InDelta(t, 10, *status[1].Windows["1h"].BurnRate, 1e-9, "writes are all slow")
+
+	// the window moves on
+	now = now.Add(10 * time.Minute)
+	status = s.Status()
+	assert.Equal(t, SLOCount{}, status[0].Windows["5m"])
+	assert.Equal(t, int64(9), status[0].Windows["1h"].Good)
+}
+
+func TestSLOObservesRequests(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	s := NewSLOs([]SLO{
+		{Name: "reads", Class: SLOClassRead, Threshold: time.Second, Objective: 0.999},
+		{Name: "instant", Class: SLOClassAll, Threshold: time.Nanosecond, Objective: 0.999},
+	}, 1)
+	client := runTestConnection(t, upstream.Address(), Options{SLOs: s})
+	defer func() { _ = client.Close() }()
+
+	roundTripStrings(t, client, 1, respCommand("GET", "a"))
+	roundTripStrings(t, client, 4, respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", "a"), respCommand("SET", "a", "1"), respCommand("GET", string(PipelineSignalEndKey)))
+	assert.Eventually(t, func() bool {
+		return s.Status()[1].Windows["5m"].Bad == 2
+	}, time.Second, time.Millisecond)
+	reads := s.Status()[0].Windows["5m"]
+	assert.Equal(t, int64(1), reads.Good, "a pipeline counts once, as a write")
+	assert.Equal(t, int64(0), reads.Bad)
+	assert.Equal(t, 0.0, *reads.BurnRate)
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// SlowLogKeep is how many of the most recent slow round trips a slow log keeps
+// for the admin server
+const SlowLogKeep = 128
+
+// SlowLogOptions configure the slow log: the upstream round trips that take
+// longer than Threshold are logged and kept, with the first KeyBytes bytes of
+// their first key, or none of it if the key matches a Redact pattern, as
+// path.Match has them
+type SlowLogOptions struct {
+	Threshold time.Duration
+	KeyBytes  int
+	Redact    []string
+}
+
+// SlowEntry is an upstream round trip that took longer than the threshold: the
+// first command of the request and how many it had, its first key, the node it
+// went to and the client connection it came from
+type SlowEntry struct {
+	Time      time.Time `json:"time"`
+	Command   string    `json:"command"`
+	Commands  int       `json:"commands"`
+	Key       string    `json:"key,omitempty"`
+	KeyLength int       `json:"key_length,omitempty"`
+	Redacted  bool      `json:"redacted,omitempty"`
+	Latency   string    `json:"latency"`
+	Node      string    `json:"node"`
+	Socket    string    `json:"socket"`
+	Client    uint64    `json:"client"`
+}
+
+// SlowLog logs an upstream's slow round trips, keeping the last SlowLogKeep. A
+// nil SlowLog logs nothing.
+type SlowLog struct {
+	opts SlowLogOptions
+
+	mu     sync.Mutex
+	recent [SlowLogKeep]SlowEntry
+	next   int
+	kept   int
+}
+
+func NewSlowLog(opts SlowLogOptions) *SlowLog {
+	return &SlowLog{opts: opts}
+}
+
+// observe logs and keeps the round trip of wm to node if it took longer than
+// the threshold. Below it, nothing is allocated.
+func (s *SlowLog) observe(c *connection, node string, wm []*redis.Message, elapsed time.Duration) {
+	if s == nil || elapsed <= s.opts.Threshold || len(wm) == 0 {
+		return
+	}
+	e := SlowEntry{Time: time.Now(), Commands: len(wm), Latency: elapsed.String(), Node: node, Socket: c.address, Client: c.id}
+	if m := wm[0]; m.IsArray() && len(m.Array) > 0 {
+		e.Command = strings.ToUpper(string(m.Array[0].Value))
+		if key, ok := c.opts.Keys.FirstKey(e.Command, m); ok {
+			e.Key, e.KeyLength, e.Redacted = s.key(key)
+		}
+	}
+	metrics.SlowRoundTrips.Incr(c.statsd, e.Command)
+	c.log.Warn("Slow upstream round trip",
+		zap.String("command", e.Command),
+		zap.Int("commands", e.Commands),
+		zap.String("key", e.Key),
+		zap.Int("key_length", e.KeyLength),
+		zap.Bool("redacted", e.Redacted),
+		zap.Duration("latency", elapsed),
+		zap.Duration("threshold", s.opts.Threshold),
+		zap.String("node", node),
+		zap.String("client", c.clientAddr()))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recent[s.next] = e
+	s.next = (s.next + 1) % SlowLogKeep
+	if s.kept < SlowLogKeep {
+		s.kept++
+	}
+}
+
+// key is what is logged of a key: its first KeyBytes bytes, or nothing if it
+// is to be redacted, along with its length
+func (s *SlowLog) key(key []byte) (string, int, bool) {
+	for _, p := range s.opts.Redact {
+		if ok, _ := path.Match(p, string(key)); ok {
+			return "", len(key), true
+		}
+	}
+	if len(key) > s.opts.KeyBytes {
+		return string(key[:s.opts.KeyBytes]), len(key), false
+	}
+	return string(key), len(key), false
+}
+
+// Recent returns the slow round trips kept, the most recent first
+func (s *SlowLog) Recent() []SlowEntry {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]SlowEntry, s.kept)
+	for i := range entries {
+		entries[i] = s.recent[(s.next-1-i+SlowLogKeep)%SlowLogKeep]
+	}
+	return entries
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSlowLog(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if strings.ToUpper(args[0]) == "HGETALL" {
+			time.Sleep(50 * time.Millisecond)
+			return redis.NewArray(nil)
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	slow := NewSlowLog(SlowLogOptions{Threshold: 20 * time.Millisecond, KeyBytes: 8, Redact: []string{"session:*"}})
+	s := newTestServer(t, upstream.Address(), 2)
+	done := make(chan struct{})
+	client := serveTestConnection(t, s, Options{SlowLog: slow}, func() { close(done) })
+
+	roundTripStrings(t, client, 1, respCommand("GET", "fast"))
+	assert.Empty(t, slow.Recent(), "under the threshold")
+
+	roundTripStrings(t, client, 1, respCommand("hgetall", "accounts:1234567"))
+	roundTripStrings(t, client, 1, respCommand("HGETALL", "session:secret"))
+	_ = client.Close()
+	<-done
+	recent := slow.Recent()
+	if assert.Len(t, recent, 2) {
+		assert.Equal(t, "HGETALL", recent[0].Command)
+		assert.Equal(t, "", recent[0].Key, "the most recent first, redacted")
+		assert.Equal(t, 14, recent[0].KeyLength)
+		assert.True(t, recent[0].Redacted)
+		assert.Equal(t, "accounts", recent[1].Key, "truncated to KeyBytes")
+		assert.Equal(t, 16, recent[1].KeyLength)
+		assert.Equal(t, upstream.Address(), recent[1].Node)
+		assert.Equal(t, 1, recent[1].Commands)
+		assert.Equal(t, "test", recent[1].Socket)
+	}
+}
+
+func TestSlowLogKeepsTheLast(t *testing.T) {
+	slow := NewSlowLog(SlowLogOptions{KeyBytes: 32})
+	c := &connection{log: zaptest.NewLogger(t), conn: &net.UnixConn{}}
+	for i := 0; i < SlowLogKeep+10; i++ {
+		slow.observe(c, "node", []*redis.Message{redis.NewArray(bulks("GET", "k"))}, time.Duration(i+1))
+	}
+	recent := slow.Recent()
+	assert.Len(t, recent, SlowLogKeep)
+	assert.Equal(t, time.Duration(SlowLogKeep+10).String(), recent[0].Latency)
+	assert.Equal(t, time.Duration(11).String(), recent[SlowLogKeep-1].Latency)
+}
+
+func TestSlowLogUnderThresholdDoesNotAllocate(t *testing.T) {
+	slow := NewSlowLog(SlowLogOptions{Threshold: time.Second, KeyBytes: 32})
+	c := &connection{}
+	wm := []*redis.Message{redis.NewArray(bulks("GET", "k"))}
+	allocs := testing.AllocsPerRun(100, func() {
+		slow.observe(c, "node", wm, time.Millisecond)
+	})
+	assert.Zero(t, allocs)
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// DefaultSplitChunkSize is the number of keys per chunk when a split threshold is
+// configured without a chunk size
+const DefaultSplitChunkSize = 100
+
+// splitSpec describes a multi-key command that can be split into several smaller
+// commands of the same kind, and how to merge the replies of those chunks
+type splitSpec struct {
+	argsPerKey int
+	merge      func(c *connection, replies []*redis.Message) *redis.Message
+}
+
+// SplittableCommands are the commands a split threshold applies to. Note that
+// splitting MSET gives up its atomicity: another client may observe some chunks
+// applied before the others.
+var SplittableCommands = map[string]splitSpec{
+	"MGET":   {argsPerKey: 1, merge: mergeArrays},
+	"MSET":   {argsPerKey: 2, merge: mergeOK},
+	"DEL":    {argsPerKey: 1, merge: mergeSum},
+	"UNLINK": {argsPerKey: 1, merge: mergeSum},
+	"EXISTS": {argsPerKey: 1, merge: mergeSum},
+	"TOUCH":  {argsPerKey: 1, merge: mergeSum},
+}
+
+// splitPlan records where the chunks of each split command ended up in an
+// expanded batch, so that replies can be merged back into their original positions
+type splitPlan struct {
+	expanded []*redis.Message
+	groups   []splitGroup
+}
+
+type splitGroup struct {
+	start  int
+	chunks int
+	spec   splitSpec
+}
+
+// planSplits expands every command in wm that exceeds the split threshold into
+// chunks. It returns nil if nothing needs splitting. Transactions are never split,
+// since EXEC replies with a single array for the whole transaction.
+func (c *connection) planSplits(cmds []string, wm []*redis.Message) *splitPlan {
+	if c.opts.SplitThreshold <= 0 || hasTransaction(cmds) {
+		return nil
+	}
+	chunkSize := c.opts.SplitChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultSplitChunkSize
+	}
+
+	var plan *splitPlan
+	for i, m := range wm {
+		spec, ok := SplittableCommands[cmds[i]]
+		if !ok || (len(m.Array)-1)/spec.argsPerKey <= c.opts.SplitThreshold || (len(m.Array)-1)%spec.argsPerKey != 0 {
+			if plan != nil {
+				plan.groups = append(plan.groups, splitGroup{start: len(plan.expanded), chunks: 1})
+				plan.expanded = append(plan.expanded, m)
+			}
+			continue
+		}
+		if plan == nil {
+			plan = &splitPlan{}
+			for _, prev := range wm[:i] {
+				plan.groups = append(plan.groups, splitGroup{start: len(plan.expanded), chunks: 1})
+				plan.expanded = append(plan.expanded, prev)
+			}
+		}
+
+		g := splitGroup{start: len(plan.expanded), spec: spec}
+		step := chunkSize * spec.argsPerKey
+		for lo := 1; lo < len(m.Array); lo += step {
+			hi := lo + step
+			if hi > len(m.Array) {
+				hi = len(m.Array)
+			}
+			chunk := make([]*redis.Message, 0, hi-lo+1)
+			chunk = append(chunk, m.Array[0])
+			chunk = append(chunk, m.Array[lo:hi]...)
+			plan.expanded = append(plan.expanded, redis.NewArray(chunk))
+			g.chunks++
+		}
+		plan.groups = append(plan.groups, g)
+
+		metrics.SplitActivations.Incr(c.statsd, cmds[i])
+		metrics.SplitChunks.Record(c.statsd, float64(g.chunks), cmds[i])
+	}
+	return plan
+}
+
+// merge folds the replies to an expanded batch back into one reply per original command
+func (p *splitPlan) merge(c *connection, res []*redis.Message) []*redis.Message {
+	merged := make([]*redis.Message, len(p.groups))
+	for i, g := range p.groups {
+		if g.spec.merge == nil {
+			merged[i] = res[g.start]
+			continue
+		}
+		merged[i] = g.spec.merge(c, res[g.start:g.start+g.chunks])
+	}
+	return merged
+}
+
+// forward sends wm upstream, splitting oversized multi-key commands if configured.
+// A batch consisting of a single split command is fanned out over up to
+// SplitParallelism connections, otherwise all chunks go out on one connection.
+func (c *connection) forward(server *pool.Server, cmds []string, wm []*redis.Message) ([]*redis.Message, *zap.Logger, error) {
+	plan := c.planSplits(cmds, wm)
+	if plan == nil {
+		return c.roundTrip(server, wm)
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.SplitDuration.Record(c.statsd, time.Since(start))
+	}()
+	if c.trace != nil {
+		parallelism := 1
+		if len(wm) == 1 && c.opts.SplitParallelism > 1 {
+			parallelism = c.opts.SplitParallelism
+		}
+		c.trace.add("split", fmt.Sprintf("%d commands expanded to %d, over up to %d connections", len(wm), len(plan.expanded), parallelism))
+	}
+
+	if len(wm) > 1 || c.opts.SplitParallelism <= 1 {
+		res, l, err := c.roundTrip(server, plan.expanded)
+		if err != nil {
+			return nil, l, err
+		}
+		return plan.merge(c, res), l, nil
+	}
+
+	parallelism := c.opts.SplitParallelism
+	if parallelism > len(plan.expanded) {
+		parallelism = len(plan.expanded)
+	}
+	res := make([]*redis.Message, len(plan.expanded))
+	errs := make([]error, parallelism)
+	var wg sync.WaitGroup
+	per := (len(plan.expanded) + parallelism - 1) / parallelism
+	for w := 0; w < parallelism; w++ {
+		lo, hi := w*per, (w+1)*per
+		if hi > len(plan.expanded) {
+			hi = len(plan.expanded)
+		}
+		if lo >= hi {
+			continue
+		}
+		wg.Add(1)
+		go func(w, lo, hi int) {
+			defer wg.Done()
+			rr, _, err := c.roundTrip(server, plan.expanded[lo:hi])
+			if err != nil {
+				errs[w] = err
+				return
+			}
+			copy(res[lo:hi], rr)
+		}(w, lo, hi)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, c.log, err
+		}
+	}
+	return plan.merge(c, res), c.log, nil
+}
+
+func firstError(replies []*redis.Message) *redis.Message {
+	for _, r := range replies {
+		if r.IsError() {
+			return r
+		}
+	}
+	return nil
+}
+
+func mergeArrays(c *connection, replies []*redis.Message) *redis.Message {
+	if e := firstError(replies); e != nil {
+		return e
+	}
+	var all []*redis.Message
+	for _, r := range replies {
+		all = append(all, r.Array...)
+	}
+	return redis.NewArray(all)
+}
+
+func mergeSum(c *connection, replies []*redis.Message) *redis.Message {
+	if e := firstError(replies); e != nil {
+		return e
+	}
+	var sum int64
+	for _, r := range replies {
+		n, err := redis.Btoi64(r.Value)
+		if err != nil {
+			return c.proxyError(proxyerr.Unavailable, "unexpected reply to a chunk of a split command: %v", err)
+		}
+		sum += n
+	}
+	return redis.NewInt([]byte(strconv.FormatInt(sum, 10)))
+}
+
+func mergeOK(c *connection, replies []*redis.Message) *redis.Message {
+	if e := firstError(replies); e != nil {
+		return e
+	}
+	return replies[0]
+}
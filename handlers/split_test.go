@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// multiKey answers MGET with "<key>-value" for each key, and DEL and EXISTS with
+// the number of keys, counting the largest command it saw
+func multiKey(largest *int64) func(args []string) *redis.Message {
+	return func(args []string) *redis.Message {
+		for {
+			l := atomic.LoadInt64(largest)
+			if int64(len(args)) <= l || atomic.CompareAndSwapInt64(largest, l, int64(len(args))) {
+				break
+			}
+		}
+		switch strings.ToUpper(args[0]) {
+		case "MGET":
+			values := make([]*redis.Message, len(args)-1)
+			for i, k := range args[1:] {
+				values[i] = redis.NewBulkBytes([]byte(k + "-value"))
+			}
+			return redis.NewArray(values)
+		case "DEL", "EXISTS":
+			return redis.NewInt([]byte(strconv.Itoa(len(args) - 1)))
+		}
+		return echoKey(args)
+	}
+}
+
+func TestSplitMGET(t *testing.T) {
+	for _, parallelism := range []int{1, 3} {
+		var largest int64
+		upstream := newFakeUpstream(t, multiKey(&largest))
+		client := runTestConnection(t, upstream.Address(), Options{SplitThreshold: 10, SplitChunkSize: 4, SplitParallelism: parallelism})
+
+		args := []string{"MGET"}
+		expected := "*25 \\r\\n "
+		for i := 0; i < 25; i++ {
+			k := "k" + strconv.Itoa(i)
+			args = append(args, k)
+			v := k + "-value"
+			expected += "$" + strconv.Itoa(len(v)) + " \\r\\n " + v + " \\r\\n "
+		}
+		assert.Equal(t, []string{expected}, roundTripStrings(t, client, 1, respCommand(args...)))
+		assert.Equal(t, int64(7), upstream.Commands(), "25 keys in chunks of 4")
+		assert.Equal(t, int64(5), atomic.LoadInt64(&largest))
+
+		_ = client.Close()
+		upstream.Close()
+	}
+}
+
+func TestSplitInsidePipeline(t *testing.T) {
+	var largest int64
+	upstream := newFakeUpstream(t, multiKey(&largest))
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{SplitThreshold: 2, SplitChunkSize: 2, SplitParallelism: 4})
+	defer func() { _ = client.Close() }()
+
+	actual := roundTripStrings(t, client, 5,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("DEL", "a", "b", "c", "d", "e"),
+		respCommand("GET", "a"),
+		respCommand("MSET", "a", "1", "b", "2", "c", "3"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	)
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		":5 \\r\\n ",
+		"$7 \\r\\n a-value \\r\\n ",
+		"+OK \\r\\n ",
+		"$-1 \\r\\n ",
+	}, actual)
+	assert.Equal(t, int64(6), upstream.Commands(), "3 DEL chunks, GET and 2 MSET chunks")
+	assert.Equal(t, int64(5), atomic.LoadInt64(&largest))
+}
+
+func TestSplitBelowThresholdUntouched(t *testing.T) {
+	c := connection{opts: Options{SplitThreshold: 3}}
+	wm := []*redis.Message{redis.NewArray(bulks("MGET", "a", "b", "c")), redis.NewArray(bulks("GET", "a"))}
+	assert.Nil(t, c.planSplits([]string{"MGET", "GET"}, wm))
+
+	wm = []*redis.Message{redis.NewArray(bulks("MULTI")), redis.NewArray(bulks("DEL", "a", "b", "c", "d")), redis.NewArray(bulks("EXEC"))}
+	assert.Nil(t, c.planSplits([]string{"MULTI", "DEL", "EXEC"}, wm), "transactions are never split")
+}
+
+func TestSplitMergeErrors(t *testing.T) {
+	err := redis.NewError([]byte("WRONGTYPE Operation against a key holding the wrong kind of value"))
+	assert.Equal(t, err, mergeArrays(&connection{}, []*redis.Message{redis.NewArray(bulks("a")), err}))
+	assert.Equal(t, err, mergeSum(&connection{}, []*redis.Message{redis.NewInt([]byte("1")), err}))
+	assert.Equal(t, err, mergeOK(&connection{}, []*redis.Message{redis.NewString([]byte("OK")), err}))
+
+	// a reply that isn't a count is the proxy's error, coded as its others are
+	unexpected := []*redis.Message{redis.NewInt([]byte("1")), redis.NewString([]byte("OK"))}
+	assert.True(t, strings.HasPrefix(mergeSum(&connection{}, unexpected).String(), "-PROXYUNAVAILABLE unexpected reply to a chunk of a split command"))
+	assert.True(t, strings.HasPrefix(mergeSum(&connection{opts: Options{PlainErrors: true}}, unexpected).String(), "-ERR redisbetween: unexpected reply"))
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// StreamCommands are the reads answered with a single bulk string, as large as
+// the value they read, whose replies may be streamed
+var StreamCommands = map[string]bool{
+	"GET":      true,
+	"GETRANGE": true,
+	"SUBSTR":   true,
+	"DUMP":     true,
+	"HGET":     true,
+	"LINDEX":   true,
+}
+
+// streamChunk is how much of a streamed reply is copied at a time
+const streamChunk = 64 * 1024
+
+// streamedReply stands for a reply already streamed to the client, in the
+// position of its command, so that it isn't written again
+var streamedReply = redis.NewString([]byte("streamed"))
+
+// StreamError is a streamed reply cut short, by the read of the upstream's
+// reply failing or, if Client is set, the write to the client. Part of the bulk
+// string having been written, which can't be cut short legally, the client is
+// closed.
+type StreamError struct {
+	Client  bool
+	Wrapped error
+}
+
+func (e StreamError) Error() string {
+	if e.Client {
+		return "reply stream to the client failed: " + e.Wrapped.Error()
+	}
+	return "reply stream from the upstream failed: " + e.Wrapped.Error()
+}
+
+func (e StreamError) Unwrap() error {
+	return e.Wrapped
+}
+
+// streams is whether the reply of a request may be streamed: that of a lone
+// StreamCommands read, not wrapped in pipeline signals, whose reply nothing of
+// the proxy needs whole, as it does that of a coalesced read
+func (c *connection) streams(b requestBoundaries, transaction bool, cmds []string, wm []*redis.Message) bool {
+	if c.opts.StreamThreshold <= 0 || transaction || b.pipelined || len(wm) != 1 || len(cmds) != 1 || !StreamCommands[cmds[0]] {
+		return false
+	}
+	// the values of checksummed keys are verified whole before they are relayed
+	if len(wm[0].Array) > 1 && c.opts.Checksums.matches(wm[0].Array[1].Value) {
+		return false
+	}
+	return c.opts.Coalescer == nil || !CoalesceCommands[cmds[0]]
+}
+
+// streamed is whether res is a reply streamed to the client
+func streamed(res []*redis.Message) bool {
+	return len(res) == 1 && res[0] == streamedReply
+}
+
+// readStreaming reads the reply of a request whose reply may be streamed. A
+// bulk string of more than StreamThreshold bytes is copied from conn to the
+// client as it arrives rather than read whole, a chunk at a time, each given
+// the read and write timeouts, and answered by streamedReply. One over
+// StreamMaxBytes is refused before any of it is written, conn being closed
+// with the rest of it unread. It also returns how long conn was held
+// streaming, which isn't the upstream's latency but the client's.
+func (c *connection) readStreaming(l *zap.Logger, conn *pool.Connection, readTimeout time.Duration) ([]*redis.Message, time.Duration, error) {
+	nc, addr := conn.Conn(), conn.Address().String()
+	if err := nc.SetReadDeadline(deadlineAfter(readTimeout)); err != nil {
+		return nil, 0, pool.ConnectionError{Address: addr, ID: conn.ID(), Wrapped: err, Message: "failed to set read deadline"}
+	}
+	d := redis.NewPooledDecoder(nc)
+	defer d.Release()
+	m, s, err := d.DecodeFrameOrStream(int64(c.opts.StreamThreshold))
+	if err != nil {
+		return nil, 0, err
+	}
+	if s == nil {
+		return []*redis.Message{m}, 0, nil
+	}
+	if c.opts.StreamMaxBytes > 0 && s.Len > int64(c.opts.StreamMaxBytes) {
+		metrics.StreamReplies.Incr(c.statsd, "too_large")
+		_ = conn.Close()
+		if c.trace != nil {
+			c.trace.add("stream", fmt.Sprintf("reply of %d bytes refused, over streammaxbytes", s.Len))
+		}
+		return []*redis.Message{c.proxyError(proxyerr.Blocked, "reply of %d bytes is over streammaxbytes %d", s.Len, c.opts.StreamMaxBytes)}, 0, nil
+	}
+
+	start := time.Now()
+	written, err := c.stream(nc, s, readTimeout)
+	held := time.Since(start)
+	outcome := "streamed"
+	if err != nil {
+		outcome = "aborted"
+	}
+	metrics.StreamReplies.Incr(c.statsd, outcome)
+	metrics.StreamHold.Record(c.statsd, held, outcome)
+	if err != nil {
+		_ = c.conn.Close()
+		l.Warn("Reply stream cut short, closed the client", zap.Int64("size", s.Len), zap.Int64("written", written), zap.Duration("held", held), zap.Error(err))
+		return nil, held, err
+	}
+	if c.trace != nil {
+		c.trace.add("stream", fmt.Sprintf("reply of %d bytes streamed in %v", s.Len, held))
+	}
+	return []*redis.Message{streamedReply}, held, nil
+}
+
+// stream copies s from nc to the client, returning how much of it was written
+func (c *connection) stream(nc net.Conn, s *redis.Stream, readTimeout time.Duration) (int64, error) {
+	buf := make([]byte, streamChunk)
+	chunk := s.Header
+	var written int64
+	for {
+		if err := c.conn.SetWriteDeadline(deadlineAfter(c.writeTimeout)); err != nil {
+			return written, StreamError{Client: true, Wrapped: err}
+		}
+		n, err := c.conn.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, StreamError{Client: true, Wrapped: err}
+		}
+		if err := nc.SetReadDeadline(deadlineAfter(readTimeout)); err != nil {
+			return written, StreamError{Wrapped: err}
+		}
+		n, err = s.Body.Read(buf)
+		chunk = buf[:n]
+		if err == io.EOF {
+			if n == 0 {
+				return written, nil
+			}
+			continue
+		}
+		if err != nil {
+			return written, StreamError{Wrapped: err}
+		}
+	}
+}
+
+// deadlineAfter is the deadline of a timeout from now, none if it is 0
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
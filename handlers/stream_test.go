@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// bigValueUpstream answers GET big with a bulk string of size bytes, generated
+// as it is written rather than held, closing the connection after cut bytes of
+// it if cut is positive, and every other GET with the key's value
+func bigValueUpstream(t *testing.T, size, cut int) string {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = li.Close() })
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				d := redis.NewDecoder(conn)
+				for {
+					m, err := d.Decode()
+					if err != nil {
+						return
+					}
+					if string(m.Array[1].Value) != "big" {
+						_ = redis.Encode(conn, redis.NewBulkBytes(m.Array[1].Value))
+						continue
+					}
+					w := bufio.NewWriter(conn)
+					_, _ = w.WriteString("$" + strconv.Itoa(size) + "\r\n")
+					for left := size; left > 0; left -= len(chunk) {
+						n := len(chunk)
+						if n > left {
+							n = left
+						}
+						if cut > 0 && size-left+n > cut {
+							_, _ = w.Write(chunk[:cut-(size-left)])
+							_ = w.Flush()
+							return
+						}
+						if _, err := w.Write(chunk[:n]); err != nil {
+							return
+						}
+					}
+					_, _ = w.WriteString("\r\n")
+					_ = w.Flush()
+				}
+			}()
+		}
+	}()
+	return li.Addr().String()
+}
+
+// readBulkLen reads a bulk string reply without holding it, returning its
+// length and the bytes it was read whole with
+func readBulkLen(r *bufio.Reader) (int64, error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(header, "$"), "\r\n"), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(io.Discard, r, n); err != nil {
+		return 0, err
+	}
+	end := make([]byte, 2)
+	if _, err := io.ReadFull(r, end); err != nil {
+		return 0, err
+	}
+	if string(end) != "\r\n" {
+		return 0, redis.ErrBadCRLFEnd
+	}
+	return n, nil
+}
+
+func TestStreamReply(t *testing.T) {
+	size := 300 * 1024 * 1024
+	upstream := bigValueUpstream(t, size, 0)
+	client := closingTestConnection(t, upstream, Options{StreamThreshold: 1024 * 1024})
+	_ = client.SetDeadline(time.Now().Add(time.Minute))
+	r := bufio.NewReader(client)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	_, _ = client.Write([]byte(respCommand("GET", "big")))
+	n, err := readBulkLen(r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(size), n)
+	runtime.ReadMemStats(&after)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(64*1024*1024), "the value isn't held by the proxy")
+
+	// the reply after it is framed as usual, over the same pooled connection
+	for i := 0; i < 2; i++ {
+		_, _ = client.Write([]byte(respCommand("GET", "small")))
+		line, _ := r.ReadString('\n')
+		value, _ := r.ReadString('\n')
+		assert.Equal(t, "$5\r\nsmall\r\n", line+value)
+	}
+}
+
+func TestStreamReplyTooLarge(t *testing.T) {
+	upstream := bigValueUpstream(t, 8*1024*1024, 0)
+	client := closingTestConnection(t, upstream, Options{StreamThreshold: 1024, StreamMaxBytes: 1024 * 1024})
+
+	replies := roundTripStrings(t, client, 2, respCommand("GET", "big")+respCommand("GET", "small"))
+	assert.True(t, strings.HasPrefix(replies[0], "-PROXYBLOCKED reply of 8388608 bytes is over streammaxbytes 1048576"), replies[0])
+	assert.Equal(t, "$5 \\r\\n small \\r\\n ", replies[1], "the refused reply's connection isn't reused")
+}
+
+func TestStreamReplyAborted(t *testing.T) {
+	upstream := bigValueUpstream(t, 8*1024*1024, 3*1024*1024)
+	client := closingTestConnection(t, upstream, Options{StreamThreshold: 1024})
+	r := bufio.NewReader(client)
+
+	_, _ = client.Write([]byte(respCommand("GET", "big")))
+	_, err := readBulkLen(r)
+	assert.Error(t, err, "a stream cut short closes the client, as the bulk string can't be")
+	_, err = client.Write([]byte(respCommand("GET", "small")))
+	assert.Error(t, err)
+}
+
+func TestStreamReplySlowClient(t *testing.T) {
+	upstream := bigValueUpstream(t, 4*1024*1024, 0)
+	breaker := NewBreaker(BreakerOptions{Latency: 50 * time.Millisecond, Failures: 1, Window: time.Minute, Cooldown: time.Minute})
+	client := closingTestConnection(t, upstream, Options{StreamThreshold: 1024, Breaker: breaker})
+	r := bufio.NewReader(client)
+
+	// a client reading slowly holds the upstream connection for as long, which
+	// isn't the upstream's latency
+	_, _ = client.Write([]byte(respCommand("GET", "big")))
+	time.Sleep(200 * time.Millisecond)
+	n, err := readBulkLen(r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4*1024*1024), n)
+	assert.Equal(t, BreakerClosed, breaker.State())
+
+	// nor are replies under the threshold streamed
+	assert.Equal(t, []string{"$5 \\r\\n small \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "small")))
+}
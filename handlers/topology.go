@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/netaddr"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// ClusterTopologyCommands are the commands whose replies describe the
+// cluster's nodes by address
+var ClusterTopologyCommands = map[string]bool{
+	"CLUSTER SLOTS":  true,
+	"CLUSTER SHARDS": true,
+	"CLUSTER NODES":  true,
+}
+
+// TopologyRewriter rewrites the node addresses of ClusterTopologyCommands
+// replies to the local addresses of their listeners, so that cluster clients
+// discovering the topology connect to the proxy rather than to the nodes. A
+// local unix socket is given as its path, with port 0, since the replies have
+// no other way to name one. Node IDs, replicas and the rest of the replies are
+// left as they are, as is a node without a listener.
+type TopologyRewriter struct {
+	// Local returns the local address of an upstream node's listener, and false
+	// if the proxy has none for it
+	Local func(upstream string) (string, bool)
+}
+
+// rewriteTopology replaces the replies of the ClusterTopologyCommands of cmds
+// with rewritten ones
+func (c *connection) rewriteTopology(cmds []string, res []*redis.Message) {
+	r := c.opts.TopologyRewriter
+	if r == nil {
+		return
+	}
+	for i, cmd := range cmds {
+		if !ClusterTopologyCommands[cmd] || i >= len(res) {
+			continue
+		}
+		rewritten, n := VisitClusterNodes(cmd, res[i], r.Local)
+		if n > 0 {
+			res[i] = rewritten
+			metrics.TopologyRewrites.Count(c.statsd, int64(n), cmd)
+		}
+	}
+}
+
+// VisitClusterNodes calls visit with the normalized address of every node of
+// a reply to one of ClusterTopologyCommands, replicas included, and returns
+// the reply with the address of each node replaced by the local address visit
+// returns for it, unless it returns false, along with the number replaced. m
+// is left as it is, since a decoded reply must not be modified, and returned if
+// nothing is replaced.
+func VisitClusterNodes(cmd string, m *redis.Message, visit func(node string) (string, bool)) (*redis.Message, int) {
+	switch cmd {
+	case "CLUSTER SLOTS":
+		return visitSlots(m, visit)
+	case "CLUSTER SHARDS":
+		return visitShards(m, visit)
+	case "CLUSTER NODES":
+		return visitNodes(m, visit)
+	}
+	return m, 0
+}
+
+// localHostPort splits a local address into the host and port a topology
+// reply gives, a unix socket being its path and port 0
+func localHostPort(local string) (string, string) {
+	if host, port, err := net.SplitHostPort(local); err == nil {
+		if _, err := strconv.Atoi(port); err == nil {
+			return host, port
+		}
+	}
+	return local, "0"
+}
+
+// withElement returns array, or once an element has been replaced, a copy of
+// it, with element i replaced by e
+func withElement(array, original *redis.Message, i int, e *redis.Message) *redis.Message {
+	if array == original {
+		array = redis.NewArray(append([]*redis.Message(nil), original.Array...))
+	}
+	array.Array[i] = e
+	return array
+}
+
+// visitSlots rewrites CLUSTER SLOTS, an array of slot ranges, each the range's
+// start and end followed by its primary and replicas, "ip, port, id, ..."
+func visitSlots(m *redis.Message, visit func(node string) (string, bool)) (*redis.Message, int) {
+	if !m.IsArray() {
+		return m, 0
+	}
+	out, n := m, 0
+	for i, slot := range m.Array {
+		if !slot.IsArray() {
+			continue
+		}
+		rewritten := slot
+		for j := 2; j < len(slot.Array); j++ {
+			node := slot.Array[j]
+			if !node.IsArray() || len(node.Array) < 2 || !node.Array[0].IsBulkBytes() || !node.Array[1].IsInt() {
+				continue
+			}
+			local, ok := visit(netaddr.FromNode(string(node.Array[0].Value) + ":" + string(node.Array[1].Value)))
+			if !ok {
+				continue
+			}
+			host, port := localHostPort(local)
+			node = withElement(node, node, 0, redis.NewBulkBytes([]byte(host)))
+			node.Array[1] = redis.NewInt([]byte(port))
+			rewritten = withElement(rewritten, slot, j, node)
+			n++
+		}
+		if rewritten != slot {
+			out = withElement(out, m, i, rewritten)
+		}
+	}
+	return out, n
+}
+
+// visitShards rewrites CLUSTER SHARDS, an array of shards, each a map whose
+// nodes are maps with the node's ip, endpoint and port or tls-port
+func visitShards(m *redis.Message, visit func(node string) (string, bool)) (*redis.Message, int) {
+	if !m.IsArray() {
+		return m, 0
+	}
+	out, n := m, 0
+	for i, shard := range m.Array {
+		k := mapField(shard, "nodes")
+		if k < 0 || !shard.Array[k].IsArray() {
+			continue
+		}
+		nodes := shard.Array[k]
+		rewritten := nodes
+		for j, node := range nodes.Array {
+			host, port := mapField(node, "ip"), mapField(node, "port")
+			if host < 0 {
+				host = mapField(node, "endpoint")
+			}
+			if port < 0 {
+				port = mapField(node, "tls-port")
+			}
+			if host < 0 || port < 0 || !node.Array[port].IsInt() {
+				continue
+			}
+			local, ok := visit(netaddr.FromNode(string(node.Array[host].Value) + ":" + string(node.Array[port].Value)))
+			if !ok {
+				continue
+			}
+			h, p := localHostPort(local)
+			copied := redis.NewArray(append([]*redis.Message(nil), node.Array...))
+			for field, v := range map[string]*redis.Message{
+				"ip": redis.NewBulkBytes([]byte(h)), "endpoint": redis.NewBulkBytes([]byte(h)),
+				"port": redis.NewInt([]byte(p)), "tls-port": redis.NewInt([]byte(p)),
+			} {
+				if f := mapField(node, field); f >= 0 {
+					copied.Array[f] = v
+				}
+			}
+			rewritten = withElement(rewritten, nodes, j, copied)
+			n++
+		}
+		if rewritten != nodes {
+			out = withElement(out, m, i, withElement(shard, shard, k, rewritten))
+		}
+	}
+	return out, n
+}
+
+// mapField is the index of the value of a field of a map given as an array of
+// alternating names and values, or -1
+func mapField(m *redis.Message, name string) int {
+	if !m.IsArray() {
+		return -1
+	}
+	for i := 0; i+1 < len(m.Array); i += 2 {
+		if string(m.Array[i].Value) == name {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// visitNodes rewrites CLUSTER NODES, a line per node, "id ip:port@cport[,hostname]
+// flags ...". The address becomes "host:port@0", without the hostname.
+func visitNodes(m *redis.Message, visit func(node string) (string, bool)) (*redis.Message, int) {
+	if !m.IsBulkBytes() || m.Value == nil {
+		return m, 0
+	}
+	n := 0
+	lines := strings.Split(string(m.Value), "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, " ")
+		if len(fields) < 2 {
+			continue
+		}
+		at := strings.IndexByte(fields[1], '@')
+		if at <= 0 {
+			continue
+		}
+		local, ok := visit(netaddr.FromNode(fields[1][:at]))
+		if !ok {
+			continue
+		}
+		host, port := localHostPort(local)
+		fields[1] = host + ":" + port + "@0"
+		lines[i] = strings.Join(fields, " ")
+		n++
+	}
+	if n == 0 {
+		return m, 0
+	}
+	return redis.NewBulkBytes([]byte(strings.Join(lines, "\n"))), n
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func bulk(s string) *redis.Message {
+	return redis.NewBulkBytes([]byte(s))
+}
+
+func integer(s string) *redis.Message {
+	return redis.NewInt([]byte(s))
+}
+
+func topologyLocals() func(string) (string, bool) {
+	locals := map[string]string{
+		"10.0.3.17:6379":       "/var/tmp/redisbetween-10.0.3.17-6379.sock",
+		"10.0.3.18:6379":       "127.0.0.1:7001",
+		"[2600:1f14::12]:6379": "/var/tmp/redisbetween-ipv6-2600-1f14--12-6379.sock",
+	}
+	return func(upstream string) (string, bool) {
+		l, ok := locals[upstream]
+		return l, ok
+	}
+}
+
+func TestVisitClusterSlots(t *testing.T) {
+	reply := redis.NewArray([]*redis.Message{
+		redis.NewArray([]*redis.Message{integer("0"), integer("8191"),
+			redis.NewArray([]*redis.Message{bulk("10.0.3.17"), integer("6379"), bulk("id-1"), redis.NewArray(nil)}),
+			redis.NewArray([]*redis.Message{bulk("2600:1f14::12"), integer("6379"), bulk("id-2")}),
+		}),
+		redis.NewArray([]*redis.Message{integer("8192"), integer("16383"),
+			redis.NewArray([]*redis.Message{bulk("10.0.3.18"), integer("6379"), bulk("id-3")}),
+			redis.NewArray([]*redis.Message{bulk("10.0.9.9"), integer("6379"), bulk("id-4")}),
+		}),
+	})
+	original := reply.String()
+	rewritten, n := VisitClusterNodes("CLUSTER SLOTS", reply, topologyLocals())
+	assert.Equal(t, 3, n)
+	assert.Equal(t, original, reply.String(), "the reply itself isn't modified")
+
+	expected := redis.NewArray([]*redis.Message{
+		redis.NewArray([]*redis.Message{integer("0"), integer("8191"),
+			redis.NewArray([]*redis.Message{bulk("/var/tmp/redisbetween-10.0.3.17-6379.sock"), integer("0"), bulk("id-1"), redis.NewArray(nil)}),
+			redis.NewArray([]*redis.Message{bulk("/var/tmp/redisbetween-ipv6-2600-1f14--12-6379.sock"), integer("0"), bulk("id-2")}),
+		}),
+		redis.NewArray([]*redis.Message{integer("8192"), integer("16383"),
+			redis.NewArray([]*redis.Message{bulk("127.0.0.1"), integer("7001"), bulk("id-3")}),
+			redis.NewArray([]*redis.Message{bulk("10.0.9.9"), integer("6379"), bulk("id-4")}),
+		}),
+	})
+	assert.Equal(t, expected.String(), rewritten.String(), "replicas are rewritten too, and a node without a listener is left")
+}
+
+func TestVisitClusterShards(t *testing.T) {
+	node := func(id, ip, port, role string) *redis.Message {
+		return redis.NewArray([]*redis.Message{
+			bulk("id"), bulk(id), bulk("port"), integer(port), bulk("ip"), bulk(ip), bulk("endpoint"), bulk(ip),
+			bulk("replication-offset"), integer("72156"), bulk("role"), bulk(role), bulk("health"), bulk("online"),
+		})
+	}
+	shard := func(nodes ...*redis.Message) *redis.Message {
+		return redis.NewArray([]*redis.Message{
+			bulk("slots"), redis.NewArray([]*redis.Message{integer("0"), integer("8191")}),
+			bulk("nodes"), redis.NewArray(nodes),
+		})
+	}
+	reply := redis.NewArray([]*redis.Message{shard(node("id-1", "10.0.3.17", "6379", "master"), node("id-4", "10.0.9.9", "6379", "replica"))})
+	rewritten, n := VisitClusterNodes("CLUSTER SHARDS", reply, topologyLocals())
+	assert.Equal(t, 1, n)
+	expected := redis.NewArray([]*redis.Message{shard(node("id-1", "/var/tmp/redisbetween-10.0.3.17-6379.sock", "0", "master"), node("id-4", "10.0.9.9", "6379", "replica"))})
+	assert.Equal(t, expected.String(), rewritten.String())
+}
+
+func TestVisitClusterNodes(t *testing.T) {
+	reply := bulk("id-1 10.0.3.17:6379@16379,redis-1.internal myself,master - 0 0 1 connected 0-8191\n" +
+		"id-3 10.0.3.18:6379@16379 slave id-1 0 1700000000000 1 connected\n" +
+		"id-4 10.0.9.9:6379@16379 master - 0 1700000000000 2 connected 8192-16383\n")
+	rewritten, n := VisitClusterNodes("CLUSTER NODES", reply, topologyLocals())
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "id-1 /var/tmp/redisbetween-10.0.3.17-6379.sock:0@0 myself,master - 0 0 1 connected 0-8191\n"+
+		"id-3 127.0.0.1:7001@0 slave id-1 0 1700000000000 1 connected\n"+
+		"id-4 10.0.9.9:6379@16379 master - 0 1700000000000 2 connected 8192-16383\n", string(rewritten.Value))
+
+	var visited []string
+	VisitClusterNodes("CLUSTER NODES", rewritten, func(node string) (string, bool) {
+		visited = append(visited, node)
+		return "", false
+	})
+	assert.Len(t, visited, 3, "and the nodes can be visited without rewriting them")
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// DefaultTraceKeep is how many of the most recent routing traces are kept for
+// each upstream, for the admin server
+const DefaultTraceKeep = 1000
+
+// traceIDs numbers traces across every upstream of the process, so that an ID
+// alone finds a trace
+var traceIDs uint64
+
+var tracePool = sync.Pool{New: func() interface{} { return &trace{} }}
+
+// TraceStep is one routing decision: what was decided, and why
+type TraceStep struct {
+	Decision string `json:"decision"`
+	Detail   string `json:"detail"`
+}
+
+// Trace is the ordered list of routing decisions that took one request, a
+// command or a pipeline, to where it went
+type Trace struct {
+	ID       uint64      `json:"id"`
+	Client   uint64      `json:"client"`
+	Upstream string      `json:"upstream"`
+	Start    time.Time   `json:"start"`
+	Commands []string    `json:"commands"`
+	Steps    []TraceStep `json:"steps"`
+}
+
+// trace is a Trace being recorded. Steps are added concurrently by split commands
+// fanned out over several upstream connections.
+type trace struct {
+	mu sync.Mutex
+	Trace
+}
+
+func (t *trace) add(decision, detail string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Steps = append(t.Steps, TraceStep{Decision: decision, Detail: detail})
+}
+
+// copy returns a copy of t that doesn't share its slices, which are reused once t
+// goes back to the pool
+func (t *trace) copy() Trace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return Trace{
+		ID:       t.ID,
+		Client:   t.Client,
+		Upstream: t.Upstream,
+		Start:    t.Start,
+		Commands: append([]string(nil), t.Commands...),
+		Steps:    append([]TraceStep(nil), t.Steps...),
+	}
+}
+
+// Tracer records the routing traces of an upstream's listeners: for every
+// request of the connections that turned tracing on with PROXY TRACE ON, and for
+// a sample of all other requests. The most recent traces are kept until they are
+// replaced, when their memory is reused for new ones. A nil Tracer records
+// nothing.
+type Tracer struct {
+	sampleEvery uint64
+	requests    uint64
+
+	mu     sync.Mutex
+	recent []*trace
+	next   int
+	byID   map[uint64]*trace
+}
+
+// NewTracer returns a tracer that samples sampleRate of all requests, and keeps
+// the last keep traces
+func NewTracer(sampleRate float64, keep int) *Tracer {
+	t := &Tracer{
+		recent: make([]*trace, keep),
+		byID:   make(map[uint64]*trace, keep),
+	}
+	if sampleRate > 0 {
+		t.sampleEvery = uint64(1 / sampleRate)
+		if t.sampleEvery < 1 {
+			t.sampleEvery = 1
+		}
+	}
+	return t
+}
+
+// start returns a trace for the next request if it is to be traced, which it
+// always is if forced, and nil otherwise
+func (t *Tracer) start(forced bool, client uint64, upstream string, cmds []string) *trace {
+	if t == nil || (!forced && (t.sampleEvery == 0 || atomic.AddUint64(&t.requests, 1)%t.sampleEvery != 0)) {
+		return nil
+	}
+	tr := tracePool.Get().(*trace)
+	tr.ID = atomic.AddUint64(&traceIDs, 1)
+	tr.Client = client
+	tr.Upstream = upstream
+	tr.Start = time.Now()
+	tr.Commands = append(tr.Commands[:0], cmds...)
+	tr.Steps = tr.Steps[:0]
+	return tr
+}
+
+// finish keeps tr, replacing the oldest trace kept
+func (t *Tracer) finish(tr *trace) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.recent) == 0 {
+		tracePool.Put(tr)
+		return
+	}
+	if old := t.recent[t.next]; old != nil {
+		delete(t.byID, old.ID)
+		tracePool.Put(old)
+	}
+	t.recent[t.next] = tr
+	t.byID[tr.ID] = tr
+	t.next = (t.next + 1) % len(t.recent)
+}
+
+// Get returns the trace with the given ID, if it is still kept
+func (t *Tracer) Get(id uint64) (Trace, bool) {
+	if t == nil {
+		return Trace{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr, ok := t.byID[id]
+	if !ok {
+		return Trace{}, false
+	}
+	return tr.copy(), true
+}
+
+// Recent returns up to n of the traces kept, newest first
+func (t *Tracer) Recent(n int) []Trace {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var traces []Trace
+	for i := 1; i <= len(t.recent) && len(traces) < n; i++ {
+		tr := t.recent[(t.next-i+len(t.recent))%len(t.recent)]
+		if tr == nil {
+			break
+		}
+		traces = append(traces, tr.copy())
+	}
+	return traces
+}
+
+// startTrace starts tracing the request made of cmds, if it is to be traced. Every
+// routing decision is then recorded with c.trace.add, guarded by a nil check so
+// that building its detail costs nothing while tracing is off.
+func (c *connection) startTrace(cmds []string) {
+	// asking for a trace isn't traced, so PROXY TRACE LAST can be repeated
+	if len(cmds) == 1 && cmds[0] == "PROXY TRACE" {
+		return
+	}
+	c.trace = c.opts.Tracer.start(c.tracing, c.id, c.opts.Upstream, cmds)
+}
+
+func (c *connection) finishTrace() {
+	if c.trace == nil {
+		return
+	}
+	c.lastTrace = c.trace.ID
+	c.opts.Tracer.finish(c.trace)
+	c.trace = nil
+}
+
+// traceSlots records the cluster slot of each command's first key, for nodes of a
+// cluster
+func (c *connection) traceSlots(cmds []string, wm []*redis.Message) {
+	if c.opts.Slots == nil {
+		return
+	}
+	slots := c.opts.Slots()
+	for i, m := range wm {
+		if key, ok := c.opts.Keys.FirstKey(cmds[i], m); ok {
+			c.trace.add("slot", fmt.Sprintf("%s %s is in slot %d, node serves %s", cmds[i], key, redis.KeySlot(key), slots))
+		}
+	}
+}
+
+// proxyTrace turns tracing on or off for the connection, or replies with the
+// trace of its last traced request
+func (c *connection) proxyTrace(args []*redis.Message) *redis.Message {
+	if len(args) != 1 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'proxy|trace' command")
+	}
+	switch strings.ToUpper(string(args[0].Value)) {
+	case "ON":
+		if c.opts.Tracer == nil {
+			return redis.NewErrorf("ERR PROXY TRACE is not available")
+		}
+		c.tracing = true
+	case "OFF":
+		c.tracing = false
+	case "LAST":
+		tr, ok := c.opts.Tracer.Get(c.lastTrace)
+		if !ok {
+			return redis.NewBulkBytes(nil)
+		}
+		return traceReply(tr)
+	default:
+		return redis.NewErrorf("ERR unknown PROXY TRACE option '%s'", string(args[0].Value))
+	}
+	return redis.NewString([]byte("OK"))
+}
+
+// traceReply is a trace as [id, [command, ...], [[decision, detail], ...]]
+func traceReply(tr Trace) *redis.Message {
+	cmds := make([]*redis.Message, len(tr.Commands))
+	for i, cmd := range tr.Commands {
+		cmds[i] = redis.NewBulkBytes([]byte(cmd))
+	}
+	steps := make([]*redis.Message, len(tr.Steps))
+	for i, s := range tr.Steps {
+		steps[i] = redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte(s.Decision)),
+			redis.NewBulkBytes([]byte(s.Detail)),
+		})
+	}
+	return redis.NewArray([]*redis.Message{
+		redis.NewInt([]byte(strconv.FormatUint(tr.ID, 10))),
+		redis.NewArray(cmds),
+		redis.NewArray(steps),
+	})
+}
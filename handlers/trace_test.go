@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracer(t *testing.T) {
+	tracer := NewTracer(0.5, 2)
+	var sampled []*trace
+	for i := 0; i < 6; i++ {
+		if tr := tracer.start(false, 1, "u", []string{"GET"}); tr != nil {
+			sampled = append(sampled, tr)
+		}
+	}
+	assert.Len(t, sampled, 3, "every other request is sampled")
+	for _, tr := range sampled {
+		tr.add("node", "n")
+		tracer.finish(tr)
+	}
+	ids := []uint64{sampled[0].ID, sampled[1].ID, sampled[2].ID}
+
+	_, ok := tracer.Get(ids[0])
+	assert.False(t, ok, "only the last 2 traces are kept")
+	tr, ok := tracer.Get(ids[2])
+	assert.True(t, ok)
+	assert.Equal(t, []string{"GET"}, tr.Commands)
+	assert.Equal(t, []TraceStep{{Decision: "node", Detail: "n"}}, tr.Steps)
+
+	recent := tracer.Recent(10)
+	assert.Len(t, recent, 2)
+	assert.Equal(t, ids[2], recent[0].ID, "newest first")
+	assert.Equal(t, ids[1], recent[1].ID)
+
+	assert.Nil(t, NewTracer(0, 2).start(false, 1, "u", nil), "nothing is sampled at rate 0")
+	assert.NotNil(t, NewTracer(0, 2).start(true, 1, "u", nil))
+	var off *Tracer
+	assert.Nil(t, off.start(true, 1, "u", nil))
+	assert.Empty(t, off.Recent(10))
+}
+
+func TestTracingOffDoesNotAllocate(t *testing.T) {
+	for _, tracer := range []*Tracer{nil, NewTracer(0, 10)} {
+		c := connection{opts: Options{Tracer: tracer}}
+		cmds := []string{"GET"}
+		allocs := testing.AllocsPerRun(100, func() {
+			c.startTrace(cmds)
+			c.finishTrace()
+		})
+		assert.Equal(t, float64(0), allocs)
+	}
+}
+
+func TestProxyTrace(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+
+	tracer := NewTracer(0, 10)
+	s := newTestServer(t, upstream.Address(), 2)
+	done := make(chan struct{})
+	client := serveTestConnection(t, s, Options{Tracer: tracer, ReadOnly: NewReadOnly(true)}, func() {
+		_ = s.Disconnect(context.Background())
+		close(done)
+	})
+	// the connection must be done logging before the test ends
+	defer func() {
+		_ = client.Close()
+		<-done
+	}()
+
+	assert.Equal(t, []string{"$-1 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "TRACE", "LAST")))
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "TRACE", "ON")))
+	roundTripStrings(t, client, 4,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("GET", "a"),
+		respCommand("SET", "a", "1"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	)
+
+	d := redis.NewDecoder(client)
+	go func() { _, _ = client.Write([]byte(respCommand("PROXY", "TRACE", "LAST"))) }()
+	m, err := d.Decode()
+	assert.NoError(t, err)
+	if !assert.Len(t, m.Array, 3) {
+		return
+	}
+	id, err := redis.Btoi64(m.Array[0].Value)
+	assert.NoError(t, err)
+	tr, ok := tracer.Get(uint64(id))
+	assert.True(t, ok)
+	assert.Equal(t, []string{"GET", "SET"}, tr.Commands)
+	if assert.Len(t, tr.Steps, 2) {
+		assert.Equal(t, TraceStep{Decision: "read-only", Detail: "SET rejected, upstream is read-only"}, tr.Steps[0])
+		assert.Equal(t, "node", tr.Steps[1].Decision)
+		assert.Contains(t, tr.Steps[1].Detail, upstream.Address())
+	}
+	assert.Len(t, m.Array[2].Array, 2)
+	assert.Equal(t, "read-only", string(m.Array[2].Array[0].Array[0].Value))
+
+	// asking again returns the same trace
+	go func() { _, _ = client.Write([]byte(respCommand("PROXY", "TRACE", "LAST"))) }()
+	again, err := d.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, m.Array[0].Value, again.Array[0].Value)
+
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "TRACE", "OFF")))
+	roundTripStrings(t, client, 1, respCommand("GET", "a"))
+	assert.Len(t, tracer.Recent(10), 1, "nothing is traced once tracing is off")
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"sync/atomic"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// Traffic counts what the clients of a listener send, in the units of the
+// requests and commands metrics, so that /stats agrees with them. A request is
+// what the proxy reads and answers at once: a single command, or a whole
+// pipeline delimited by the pipeline signals, which aren't commands themselves.
+// Commands are the redis commands of the requests, each command of a pipeline
+// counted. Connections are the client connections accepted, and Errors the
+// commands answered with an error.
+type Traffic struct {
+	requests, commands, connections, errors int64
+}
+
+// TrafficStats describe a listener's Traffic for the admin stats
+type TrafficStats struct {
+	Requests    int64 `json:"requests"`
+	Commands    int64 `json:"commands"`
+	Connections int64 `json:"connections"`
+	Errors      int64 `json:"errors"`
+}
+
+// Stats returns the counts of the traffic so far
+func (t *Traffic) Stats() TrafficStats {
+	if t == nil {
+		return TrafficStats{}
+	}
+	return TrafficStats{
+		Requests:    atomic.LoadInt64(&t.requests),
+		Commands:    atomic.LoadInt64(&t.commands),
+		Connections: atomic.LoadInt64(&t.connections),
+		Errors:      atomic.LoadInt64(&t.errors),
+	}
+}
+
+// countConnection counts a client connection accepted
+func (c *connection) countConnection() {
+	if t := c.opts.Traffic; t != nil {
+		atomic.AddInt64(&t.connections, 1)
+	}
+}
+
+// countErrors counts the commands of a request answered with an error
+func (c *connection) countErrors(replies []*redis.Message) {
+	t := c.opts.Traffic
+	if t == nil {
+		return
+	}
+	for _, r := range replies {
+		if r != nil && r.IsError() {
+			atomic.AddInt64(&t.errors, 1)
+		}
+	}
+}
+
+// countRequest counts a request read from the client, and its commands, in the
+// metrics and the listener's Traffic alike
+func (c *connection) countRequest(wm []*redis.Message) {
+	metrics.Requests.Incr(c.statsd)
+	metrics.Commands.Count(c.statsd, int64(len(wm)))
+	if t := c.opts.Traffic; t != nil {
+		atomic.AddInt64(&t.requests, 1)
+		atomic.AddInt64(&t.commands, int64(len(wm)))
+	}
+}
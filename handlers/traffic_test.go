@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrafficCountsConnectionsAndErrors(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if strings.ToUpper(args[0]) == "INCR" {
+			return redis.NewError([]byte("ERR value is not an integer or out of range"))
+		}
+		return echoKey(args)
+	})
+	defer upstream.Close()
+	s := newTestServer(t, upstream.Address(), 2)
+	traffic := &Traffic{}
+	for i := 0; i < 2; i++ {
+		done := make(chan struct{})
+		client := serveTestConnection(t, s, Options{Traffic: traffic}, func() { close(done) })
+		roundTripStrings(t, client, 1, respCommand("GET", "k"))
+		roundTripStrings(t, client, 1, respCommand("INCR", "k"))
+		_ = client.Close()
+		<-done
+	}
+	assert.Equal(t, TrafficStats{Requests: 4, Commands: 4, Connections: 2, Errors: 2}, traffic.Stats())
+}
@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// Transactions pins a connection of the pool to a client whose request leaves a
+// transaction open, from its MULTI, or from its WATCH, since redis watches keys
+// for a connection. The client's requests are sent over that connection alone
+// until EXEC or DISCARD closes the transaction, or UNWATCH drops the watch, and
+// it is then returned to the pool. A client that disconnects or QUITs with a
+// transaction open has it discarded before the connection is returned, and so
+// does one idle for longer than IdleTimeout, whose commands are then answered
+// with an error up to the end of the transaction.
+type Transactions struct {
+	IdleTimeout time.Duration
+
+	pinned int64
+}
+
+// Pinned is the number of connections pinned to clients in a transaction
+func (t *Transactions) Pinned() int64 {
+	return atomic.LoadInt64(&t.pinned)
+}
+
+// opensTransaction is whether a request leaves a transaction open, pinning a
+// connection to the client
+func (c *connection) opensTransaction(wm []*redis.Message, b requestBoundaries) bool {
+	if c.opts.Transactions == nil || b.late > 0 || b.quit || b.invalid != nil {
+		return false
+	}
+	var t pinnedTransaction
+	for _, m := range wm {
+		if m.IsArray() && len(m.Array) > 0 {
+			t.track(strings.ToUpper(string(m.Array[0].Value)))
+		}
+	}
+	return t.open()
+}
+
+// pinnedTransaction is the state of a client's transaction, as the client sees
+// it, and the connection pinned to it while it is open
+type pinnedTransaction struct {
+	c       *connection
+	l       *zap.Logger
+	conn    *pool.Connection
+	release func()
+
+	multi    bool
+	watching bool
+	// aborted is what the commands of a transaction the proxy discarded are
+	// answered with, up to its end. Nothing is pinned then.
+	aborted *redis.Message
+	// end is how the connection's pin ends, unless it fails
+	end string
+	// queued are the writes queued since MULTI, which only change their keys
+	// once EXEC runs them, and ran those of the EXECs of the request
+	queued []Invalidation
+	ran    []Invalidation
+}
+
+// pinTransaction serves a client from the request that opens its transaction
+// until it is closed, a nil error then leaving the client to be served as usual
+func (c *connection) pinTransaction(l *zap.Logger, wm []*redis.Message, b requestBoundaries) error {
+	t := &pinnedTransaction{c: c, l: l, end: "closed"}
+	c.tx = t
+	defer func() { c.tx = nil }()
+	defer destroyOnPanic(func() {
+		if t.conn != nil {
+			t.closeConn("panicked")
+		}
+	})
+	for {
+		if err := t.request(wm, b); err != nil {
+			end := "client_closed"
+			if err == errQuit {
+				end = "quit"
+			}
+			t.abort(end, nil)
+			return err
+		}
+		if !t.open() {
+			return nil
+		}
+		var err error
+		if wm, b, err = t.next(); err != nil {
+			return err
+		}
+	}
+}
+
+// next reads the client's next request of the transaction. A client idle for
+// over the IdleTimeout while it holds a connection has its transaction aborted,
+// and the request it sends next is read as usual, to be answered as aborted.
+func (t *pinnedTransaction) next() ([]*redis.Message, requestBoundaries, error) {
+	c, l := t.c, t.l
+	for {
+		// the client is only timed while it holds a connection
+		var timeout time.Duration
+		if t.conn != nil {
+			timeout = c.opts.Transactions.IdleTimeout
+		}
+		c.signaled = false
+		wm, late, err := readWireMessages(c.readCtx, l, c.reader, c.address, c.id, timeout, 1, c.checksSignals(), 0, c.conn.Close, c, nil)
+		invalid := err != nil && redis.IsProtocolError(err)
+		if err != nil && !invalid {
+			var ne net.Error
+			if t.conn != nil && !c.requestStarted && c.readCtx.Err() == nil && errors.As(err, &ne) && ne.Timeout() {
+				l.Debug("Aborting the transaction of an idle client", zap.Duration("timeout", timeout))
+				t.abort("idle", c.proxyError(proxyerr.Timeout, "transaction aborted, the client was idle for over %v", timeout))
+				// nothing of the next request was read, so its decoder can go on
+				c.dec.Err = nil
+				continue
+			}
+			t.abort("client_closed", nil)
+			return nil, requestBoundaries{}, c.readTimedOut(l, err)
+		}
+		c.requested, c.requestStarted = true, false
+		c.countRequest(wm)
+		b := boundaries(wm, late, false, c.signaled)
+		if invalid && !b.quit {
+			b.invalid, b.pipelined = err, atomic.LoadInt32(&c.pipelineOpen) == 1
+		}
+		return wm[:b.received], b, nil
+	}
+}
+
+func (t *pinnedTransaction) open() bool {
+	return t.multi || t.watching
+}
+
+// track follows the transaction through a command sent upstream. As with
+// redis, EXEC and DISCARD only close a transaction opened by MULTI, and WATCH
+// and UNWATCH inside one are errors.
+func (t *pinnedTransaction) track(cmd string) {
+	switch cmd {
+	case "MULTI":
+		t.multi = true
+	case "EXEC", "DISCARD":
+		if t.multi {
+			t.multi, t.watching = false, false
+		}
+	case "WATCH":
+		if !t.multi {
+			t.watching = true
+		}
+	case "UNWATCH":
+		if !t.multi {
+			t.watching = false
+		}
+	}
+}
+
+// queue follows the writes queued inside MULTI up to the EXEC that runs them,
+// with the transaction as it was before cmd
+func (t *pinnedTransaction) queue(cmd string, m *redis.Message) {
+	if !t.multi {
+		return
+	}
+	switch cmd {
+	case "EXEC":
+		t.ran, t.queued = append(t.ran, t.queued...), nil
+	case "DISCARD":
+		t.queued = nil
+	default:
+		if inv, ok := Invalidates(cmd, m); ok {
+			t.queued = append(t.queued, inv)
+		}
+	}
+}
+
+// forgetWritten has the KeyCaches forget the keys the writes forwarded changed
+// once they have been answered, or may have if the exchange failed, those
+// queued included once an EXEC ran them
+func (t *pinnedTransaction) forgetWritten(cmds []string, forward []*redis.Message, positions []int) {
+	c := t.c
+	for j, m := range forward {
+		if positions[j] >= 0 {
+			c.forgetWritten(c.db, cmds[positions[j]:positions[j]+1], []*redis.Message{m})
+		}
+	}
+	for _, inv := range t.ran {
+		c.forgetKeys(c.db, inv)
+	}
+	t.ran = nil
+}
+
+// trackAborted follows a transaction the proxy discarded through a command
+// answered in its place, up to the EXEC or DISCARD that ends it, or the
+// UNWATCH that drops its watch outside MULTI
+func (t *pinnedTransaction) trackAborted(cmd string) {
+	switch cmd {
+	case "MULTI":
+		t.multi = true
+	case "EXEC", "DISCARD":
+		t.multi, t.watching, t.aborted = false, false, nil
+	case "UNWATCH":
+		if !t.multi {
+			t.watching, t.aborted = false, nil
+		}
+	}
+}
+
+// request answers a request of a client in a transaction. Commands the proxy
+// won't forward inside one are answered in their position, as usual, but
+// discard a transaction opened by MULTI upstream, as redis would at EXEC.
+func (t *pinnedTransaction) request(wm []*redis.Message, b requestBoundaries) error {
+	c := t.c
+	c.request = wm
+	read := time.Now()
+	replies := make([]*redis.Message, len(wm))
+	cmds := c.validateCommands(wm, replies)
+	c.opts.Mix.Observe(cmds)
+	c.sampleSlots(cmds, wm)
+	var forward []*redis.Message
+	var positions []int
+	for i, m := range wm {
+		cmd := cmds[i]
+		if t.aborted != nil {
+			replies[i] = t.aborted
+			t.trackAborted(cmd)
+			continue
+		}
+		if replies[i] == nil {
+			replies[i] = c.rejectTransaction([]string{cmd}, []*redis.Message{m})
+		}
+		// outside MULTI, a blocking command would hold the pinned connection
+		// for as long as it blocks
+		if replies[i] == nil && !t.multi && t.watching && isBlockingCommand(cmd) {
+			replies[i] = c.proxyError(proxyerr.Blocked, "%v is unsupported while watching keys", cmd)
+		}
+		if replies[i] != nil {
+			tc, ok := TransactionCommands[cmd]
+			switch {
+			case t.multi:
+				forward, positions = append(forward, redis.NewArray(bulks("DISCARD"))), append(positions, -1)
+				t.aborted, t.end = c.proxyError(proxyerr.Blocked, "transaction discarded, %v was rejected", cmd), "rejected"
+			case ok && tc == TransactionClose && t.watching:
+				// a transaction the request had whole was discarded, which
+				// drops the watch as its EXEC would have
+				forward, positions = append(forward, redis.NewArray(bulks("UNWATCH"))), append(positions, -1)
+				t.watching = false
+			}
+			continue
+		}
+		forward, positions = append(forward, c.enforceTTL(cmd, m)), append(positions, i)
+		c.forgetReads(c.db, []string{cmd}, []*redis.Message{m})
+		c.forgetWritten(c.db, []string{cmd}, []*redis.Message{m})
+		t.queue(cmd, m)
+		t.track(cmd)
+	}
+
+	if len(forward) > 0 {
+		res, err := t.exchange(forward)
+		for j, r := range res {
+			if positions[j] >= 0 {
+				replies[positions[j]] = r
+			}
+		}
+		t.forgetWritten(cmds, forward, positions)
+		if err != nil {
+			code, ok := forwardErrorCode(err)
+			if !ok {
+				code = proxyerr.Unavailable
+			}
+			for j := len(res); j < len(forward); j++ {
+				if positions[j] >= 0 {
+					replies[positions[j]] = c.proxyError(code, "%v", err)
+				}
+			}
+			if t.open() && t.aborted == nil {
+				t.aborted = c.proxyError(proxyerr.Unavailable, "transaction aborted, its upstream connection failed")
+			}
+		}
+	}
+	if t.conn != nil && (!t.open() || t.aborted != nil) {
+		t.unpin(t.end)
+	}
+	if err := c.writeReplies(t.l, b, replies, b.pipelined); err != nil {
+		return err
+	}
+	c.recordRequest(wm, cmds, replies, time.Since(read))
+	return b.end(nil, nil)
+}
+
+// exchange sends commands over the pinned connection, pinning one first if
+// there is none, closing it if that fails
+func (t *pinnedTransaction) exchange(wm []*redis.Message) ([]*redis.Message, error) {
+	c := t.c
+	if t.conn == nil {
+		if err := t.pin(); err != nil {
+			return nil, err
+		}
+	}
+	conn := t.conn
+	if err := WriteWireMessages(c.ctx, t.l, wm, conn.Conn(), conn.Address().String(), conn.ID(), c.writeTimeout, false, conn.Close); err != nil {
+		t.closeConn("upstream_failed")
+		return nil, err
+	}
+	res, _, err := readWireMessages(c.ctx, t.l, conn.Conn(), conn.Address().String(), conn.ID(), c.readTimeout, len(wm), false, 0, conn.Close, nil, nil)
+	if err != nil {
+		t.l.Warn("Pinned transaction connection failed", zap.Error(err))
+		t.closeConn("upstream_failed")
+	}
+	return res, err
+}
+
+// pin checks a connection out for the client, of the pool of the database it
+// selected
+func (t *pinnedTransaction) pin() error {
+	c := t.c
+	server := c.general()
+	release := func() {}
+	if c.opts.DBPools != nil && c.db != c.opts.Database {
+		s, r, err := c.dbServer(c.db)
+		if err != nil {
+			return err
+		}
+		server, release = s, r
+	}
+	conn, err := c.checkoutConnection(server)
+	if err != nil {
+		release()
+		return err
+	}
+	t.conn, t.release = conn, release
+	t.l = c.log.With(zap.Uint64("upstream_id", conn.ID()))
+	atomic.AddInt64(&c.opts.Transactions.pinned, 1)
+	t.l.Debug("Connection pinned for a transaction")
+	return nil
+}
+
+// abort discards the transaction open on the pinned connection and returns it
+// to the pool, the client's commands being answered with reply up to the end
+// of the transaction, if it is still there
+func (t *pinnedTransaction) abort(end string, reply *redis.Message) {
+	if t.conn == nil {
+		return
+	}
+	cmd := "UNWATCH"
+	if t.multi {
+		cmd = "DISCARD"
+	}
+	c, conn := t.c, t.conn
+	err := WriteWireMessages(c.ctx, t.l, []*redis.Message{redis.NewArray(bulks(cmd))}, conn.Conn(), conn.Address().String(), conn.ID(), c.writeTimeout, false, conn.Close)
+	if err == nil {
+		_, _, err = readWireMessages(c.ctx, t.l, conn.Conn(), conn.Address().String(), conn.ID(), c.readTimeout, 1, false, 0, conn.Close, nil, nil)
+	}
+	if err != nil {
+		t.l.Debug("Failed to discard an aborted transaction", zap.Error(err))
+		t.closeConn(end)
+	} else {
+		t.unpin(end)
+	}
+	t.aborted = reply
+}
+
+// closeConn closes the pinned connection, which may have been left with a
+// transaction open or part of a reply unread, and unpins it
+func (t *pinnedTransaction) closeConn(end string) {
+	_ = t.conn.Close()
+	t.unpin(end)
+}
+
+func (t *pinnedTransaction) unpin(end string) {
+	_ = t.conn.Return()
+	t.release()
+	t.conn, t.release = nil, nil
+	atomic.AddInt64(&t.c.opts.Transactions.pinned, -1)
+	metrics.TransactionPins.Incr(t.c.statsd, end)
+	t.l.Debug("Transaction unpinned", zap.String("end", end))
+	t.l, t.end = t.c.log, "closed"
+}
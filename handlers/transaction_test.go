@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTransactions is an upstream that queues the commands of a connection's
+// MULTI until its EXEC, echoing the key of each, as redis does
+type fakeTransactions struct {
+	li   net.Listener
+	mu   sync.Mutex
+	sent []string
+}
+
+func newFakeTransactions(t *testing.T) *fakeTransactions {
+	t.Helper()
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	f := &fakeTransactions{li: li}
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = li.Close() })
+	return f
+}
+
+func (f *fakeTransactions) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	d := redis.NewDecoder(conn)
+	var queued []*redis.Message
+	multi := false
+	for {
+		m, err := d.Decode()
+		if err != nil {
+			return
+		}
+		args := make([]string, len(m.Array))
+		for i, a := range m.Array {
+			args[i] = string(a.Value)
+		}
+		cmd := strings.ToUpper(args[0])
+		f.mu.Lock()
+		f.sent = append(f.sent, cmd)
+		f.mu.Unlock()
+		var reply *redis.Message
+		switch {
+		case cmd == "MULTI" && !multi:
+			multi, queued = true, nil
+			reply = redis.NewString([]byte("OK"))
+		case cmd == "EXEC" && multi:
+			multi, reply = false, redis.NewArray(queued)
+		case cmd == "DISCARD" && multi:
+			multi, reply = false, redis.NewString([]byte("OK"))
+		case cmd == "EXEC" || cmd == "DISCARD":
+			reply = redis.NewErrorf("ERR %s without MULTI", cmd)
+		case cmd == "WATCH" || cmd == "UNWATCH":
+			reply = redis.NewString([]byte("OK"))
+		case multi:
+			queued = append(queued, redis.NewBulkBytes([]byte(args[len(args)-1])))
+			reply = redis.NewString([]byte("QUEUED"))
+		default:
+			reply = redis.NewBulkBytes([]byte(args[len(args)-1]))
+		}
+		_ = redis.Encode(conn, reply)
+	}
+}
+
+func (f *fakeTransactions) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.sent...)
+}
+
+func TestTransactionPinning(t *testing.T) {
+	upstream := newFakeTransactions(t)
+	tx := &Transactions{IdleTimeout: time.Second}
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{Transactions: tx})
+
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("MULTI")))
+	assert.Equal(t, int64(1), tx.Pinned())
+	assert.Equal(t, []string{"+QUEUED \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SET", "a", "1")))
+	assert.Equal(t, []string{"+QUEUED \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "b")))
+	assert.Equal(t, []string{"*2 \\r\\n $1 \\r\\n 1 \\r\\n $1 \\r\\n b \\r\\n "}, roundTripStrings(t, client, 1, respCommand("EXEC")),
+		"the queued commands and EXEC went over the connection MULTI did")
+	assert.Equal(t, int64(0), tx.Pinned())
+
+	assert.Equal(t, []string{"$1 \\r\\n k \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "k")),
+		"served as any other client once the transaction is closed")
+}
+
+func TestTransactionWatch(t *testing.T) {
+	upstream := newFakeTransactions(t)
+	tx := &Transactions{IdleTimeout: time.Second}
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{Transactions: tx})
+
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("WATCH", "k")))
+	assert.Equal(t, int64(1), tx.Pinned(), "pinned from the WATCH")
+	assert.Equal(t, []string{"$1 \\r\\n k \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "k")))
+	assert.Equal(t, []string{"+OK \\r\\n ", "+QUEUED \\r\\n "}, roundTripStrings(t, client, 2, respCommand("MULTI"), respCommand("SET", "k", "v")))
+	assert.Equal(t, int64(1), tx.Pinned())
+	assert.Equal(t, []string{"*1 \\r\\n $1 \\r\\n v \\r\\n "}, roundTripStrings(t, client, 1, respCommand("EXEC")))
+	assert.Equal(t, int64(0), tx.Pinned())
+
+	roundTripStrings(t, client, 1, respCommand("WATCH", "k"))
+	assert.Equal(t, []string{"+OK \\r\\n "}, roundTripStrings(t, client, 1, respCommand("UNWATCH")))
+	assert.Equal(t, int64(0), tx.Pinned(), "unpinned by the UNWATCH")
+}
+
+func TestTransactionClientClosed(t *testing.T) {
+	upstream := newFakeTransactions(t)
+	tx := &Transactions{IdleTimeout: time.Second}
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{Transactions: tx})
+
+	roundTripStrings(t, client, 1, respCommand("MULTI"))
+	roundTripStrings(t, client, 1, respCommand("SET", "a", "1"))
+	_ = client.Close()
+	assert.Eventually(t, func() bool { return tx.Pinned() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"MULTI", "SET", "DISCARD"}, upstream.commands(), "discarded before being returned")
+}
+
+func TestTransactionIdle(t *testing.T) {
+	upstream := newFakeTransactions(t)
+	tx := &Transactions{IdleTimeout: 50 * time.Millisecond}
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{Transactions: tx})
+
+	roundTripStrings(t, client, 1, respCommand("MULTI"))
+	assert.Eventually(t, func() bool { return tx.Pinned() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"MULTI", "DISCARD"}, upstream.commands())
+
+	aborted := "-PROXYTIMEOUT transaction aborted, the client was idle for over 50ms \\r\\n "
+	assert.Equal(t, []string{aborted}, roundTripStrings(t, client, 1, respCommand("SET", "a", "1")))
+	assert.Equal(t, []string{aborted}, roundTripStrings(t, client, 1, respCommand("EXEC")))
+	assert.Equal(t, []string{"$1 \\r\\n k \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "k")),
+		"served as usual after the EXEC")
+	assert.Equal(t, []string{"MULTI", "DISCARD", "GET"}, upstream.commands())
+
+	// an abort answers nothing, whatever the request before it was
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	assert.Equal(t, []string{"$-1 \\r\\n ", "+OK \\r\\n ", "+QUEUED \\r\\n ", "$-1 \\r\\n "},
+		roundTripStrings(t, client, 4, start, respCommand("MULTI"), respCommand("SET", "a", "1"), end))
+	assert.Eventually(t, func() bool { return tx.Pinned() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{aborted}, roundTripStrings(t, client, 1, respCommand("EXEC")))
+	assert.Equal(t, []string{"$1 \\r\\n k \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "k")))
+}
+
+func TestTransactionRejectedCommand(t *testing.T) {
+	upstream := newFakeTransactions(t)
+	tx := &Transactions{IdleTimeout: time.Second}
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{Transactions: tx})
+
+	roundTripStrings(t, client, 1, respCommand("MULTI"))
+	assert.Equal(t, []string{"-PROXYBLOCKED SUBSCRIBE is unsupported \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SUBSCRIBE", "a")))
+	assert.Equal(t, int64(0), tx.Pinned())
+	discarded := "-PROXYBLOCKED transaction discarded, SUBSCRIBE was rejected \\r\\n "
+	assert.Equal(t, []string{discarded, discarded}, roundTripStrings(t, client, 2, respCommand("SET", "a", "1"), respCommand("EXEC")))
+	assert.Equal(t, []string{"MULTI", "DISCARD"}, upstream.commands())
+}
+
+func TestTransactionLeftOpenWithoutPinning(t *testing.T) {
+	upstream := newFakeTransactions(t)
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{})
+	assert.Equal(t, []string{"-PROXYBLOCKED cannot leave an open transaction \\r\\n "}, roundTripStrings(t, client, 1, respCommand("MULTI")))
+}
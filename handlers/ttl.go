@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/proxyerr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// TTLNamespace is the keys starting with Prefix, which never live longer than
+// MaxTTL, a whole number of seconds
+type TTLNamespace struct {
+	Prefix string
+	MaxTTL time.Duration
+}
+
+// TTLPolicy caps the TTLs of the keys of its namespaces, the first whose prefix
+// a key starts with applying. A SET without an expiry is given one at the cap,
+// as is one with KEEPTTL, which would leave a key it creates without any, and
+// the expiries of SET, SETEX, PSETEX, GETEX and the EXPIRE family above the cap
+// are lowered to it. A PERSIST, or GETEX PERSIST, is rejected, or with
+// PersistToExpire turned into an expiry at the cap. If FollowUp is set, the
+// keys created by TTLFollowUpCommands, which can't set an expiry, are given
+// one by an EXPIRE sent after their replies, as far as the reply tells that the
+// key was created. The commands queued in transactions are capped and rejected
+// alike, but never followed up.
+type TTLPolicy struct {
+	Namespaces      []TTLNamespace
+	PersistToExpire bool
+	FollowUp        bool
+}
+
+// TTLFollowUpCommands are the writes creating keys that a FollowUp gives an
+// expiry, with whether a reply tells that the key was created, or may have
+// been: a list whose length is that of the elements pushed, as many fields or
+// members added as given, a counter at the increment. Replies that can't tell
+// are always followed up, except errors.
+var TTLFollowUpCommands = map[string]func(m, r *redis.Message) bool{
+	"APPEND":  func(m, r *redis.Message) bool { return replyInt(r) == int64(len(m.Array[2].Value)) },
+	"DECR":    func(m, r *redis.Message) bool { return replyInt(r) == -1 },
+	"DECRBY":  func(m, r *redis.Message) bool { return -replyInt(r) == argInt(m, 2) },
+	"GETSET":  func(m, r *redis.Message) bool { return true },
+	"HINCRBY": func(m, r *redis.Message) bool { return replyInt(r) == argInt(m, 3) },
+	"HMSET":   func(m, r *redis.Message) bool { return true },
+	"HSET":    func(m, r *redis.Message) bool { return replyInt(r) == int64(len(m.Array)-2)/2 },
+	"HSETNX":  func(m, r *redis.Message) bool { return replyInt(r) == 1 },
+	"INCR":    func(m, r *redis.Message) bool { return replyInt(r) == 1 },
+	"INCRBY":  func(m, r *redis.Message) bool { return replyInt(r) == argInt(m, 2) },
+	"LPUSH":   func(m, r *redis.Message) bool { return replyInt(r) == int64(len(m.Array)-2) },
+	"MSET":    func(m, r *redis.Message) bool { return true },
+	"MSETNX":  func(m, r *redis.Message) bool { return replyInt(r) == 1 },
+	"RPUSH":   func(m, r *redis.Message) bool { return replyInt(r) == int64(len(m.Array)-2) },
+	"SADD":    func(m, r *redis.Message) bool { return replyInt(r) == int64(len(m.Array)-2) },
+	"SETNX":   func(m, r *redis.Message) bool { return replyInt(r) == 1 },
+	"ZADD":    zaddCreated,
+}
+
+// ttlArity is the least number of arguments, the command name included, of
+// the commands whose expiry the policy looks at
+var ttlArity = map[string]int{
+	"SET": 3, "SETEX": 4, "PSETEX": 4, "GETEX": 2, "PERSIST": 2,
+	"EXPIRE": 3, "PEXPIRE": 3, "EXPIREAT": 3, "PEXPIREAT": 3,
+	"APPEND": 3, "DECR": 2, "DECRBY": 3, "GETSET": 3, "HINCRBY": 4, "HMSET": 4,
+	"HSET": 4, "HSETNX": 4, "INCR": 2, "INCRBY": 3, "LPUSH": 3, "MSET": 3,
+	"MSETNX": 3, "RPUSH": 3, "SADD": 3, "SETNX": 3, "ZADD": 4,
+}
+
+// zaddOptions are those ZADD takes before its score and member pairs
+var zaddOptions = map[string]bool{"NX": true, "XX": true, "GT": true, "LT": true, "CH": true, "INCR": true}
+
+func zaddCreated(m, r *redis.Message) bool {
+	i := 2
+	for i < len(m.Array) && zaddOptions[strings.ToUpper(string(m.Array[i].Value))] {
+		i++
+	}
+	// the INCR form replies with the score, which can't tell
+	if !r.IsInt() {
+		return !(r.IsBulkBytes() && r.Value == nil)
+	}
+	return replyInt(r) == int64(len(m.Array)-i)/2
+}
+
+func replyInt(r *redis.Message) int64 {
+	if !r.IsInt() {
+		return -1 << 63
+	}
+	n, _ := strconv.ParseInt(string(r.Value), 10, 64)
+	return n
+}
+
+func argInt(m *redis.Message, i int) int64 {
+	n, err := strconv.ParseInt(string(m.Array[i].Value), 10, 64)
+	if err != nil {
+		return -1 << 63
+	}
+	return n
+}
+
+// namespace is the namespace of a key, if any
+func (p *TTLPolicy) namespace(key []byte) *TTLNamespace {
+	for i := range p.Namespaces {
+		if bytes.HasPrefix(key, []byte(p.Namespaces[i].Prefix)) {
+			return &p.Namespaces[i]
+		}
+	}
+	return nil
+}
+
+// ttlNamespace is the namespace of the key of a command the policy looks at
+func (c *connection) ttlNamespace(cmd string, m *redis.Message) *TTLNamespace {
+	p := c.opts.TTLPolicy
+	if p == nil {
+		return nil
+	}
+	if n, ok := ttlArity[cmd]; !ok || len(m.Array) < n {
+		return nil
+	}
+	return p.namespace(m.Array[1].Value)
+}
+
+// ttlEnforced counts and traces what the policy did to a command
+func (c *connection) ttlEnforced(ns *TTLNamespace, cmd, action string) {
+	metrics.TTLEnforced.Incr(c.statsd, ns.Prefix, action)
+	if c.trace != nil {
+		c.trace.add("ttl", cmd+" of "+ns.Prefix+" "+action)
+	}
+}
+
+// persists is whether a command removes the expiry of its key
+func persists(cmd string, m *redis.Message) bool {
+	return cmd == "PERSIST" || (cmd == "GETEX" && len(m.Array) == 3 && strings.EqualFold(string(m.Array[2].Value), "PERSIST"))
+}
+
+// rejectPersist answers the PERSIST of a key of a namespace with an error,
+// unless the policy turns it into an expiry
+func (c *connection) rejectPersist(cmd string, m *redis.Message) *redis.Message {
+	ns := c.ttlNamespace(cmd, m)
+	if ns == nil || c.opts.TTLPolicy.PersistToExpire || !persists(cmd, m) {
+		return nil
+	}
+	c.ttlEnforced(ns, cmd, "rejected")
+	return c.proxyError(proxyerr.Blocked, "%s would keep %s forever, but keys starting with %s expire within %v", cmd, m.Array[1].Value, ns.Prefix, ns.MaxTTL)
+}
+
+// enforceTTL returns a command with its expiry capped for the namespace of its
+// key, or the command itself if it needs no change. m is left as it is, since
+// the client's request is recorded as it sent it.
+func (c *connection) enforceTTL(cmd string, m *redis.Message) *redis.Message {
+	ns := c.ttlNamespace(cmd, m)
+	if ns == nil {
+		return m
+	}
+	maxSeconds := int64(ns.MaxTTL / time.Second)
+	args := append([]*redis.Message(nil), m.Array...)
+	ex := []*redis.Message{redis.NewBulkBytes([]byte("EX")), redis.NewBulkBytes([]byte(strconv.FormatInt(maxSeconds, 10)))}
+	// clamp lowers the expiry argument at i, in seconds or milliseconds from
+	// now or as a unix time, to the cap
+	clamp := func(i int, unit time.Duration, absolute bool) bool {
+		v, err := strconv.ParseInt(string(args[i].Value), 10, 64)
+		if err != nil {
+			return false
+		}
+		limit := int64(ns.MaxTTL / unit)
+		if absolute {
+			limit += time.Now().UnixNano() / int64(unit)
+		}
+		if v <= limit {
+			return false
+		}
+		args[i] = redis.NewBulkBytes([]byte(strconv.FormatInt(limit, 10)))
+		return true
+	}
+
+	action := ""
+	switch cmd {
+	case "SET", "GETEX":
+		first := 3
+		if cmd == "GETEX" {
+			first = 2
+		}
+		found := false
+		for i := first; i < len(args); i++ {
+			switch strings.ToUpper(string(args[i].Value)) {
+			case "EX", "PX", "EXAT", "PXAT":
+				if i+1 >= len(args) {
+					return m
+				}
+				found = true
+				unit, absolute := time.Second, false
+				switch strings.ToUpper(string(args[i].Value)) {
+				case "PX":
+					unit = time.Millisecond
+				case "EXAT":
+					absolute = true
+				case "PXAT":
+					unit, absolute = time.Millisecond, true
+				}
+				if clamp(i+1, unit, absolute) {
+					action = "clamped"
+				}
+				i++
+			case "KEEPTTL", "PERSIST":
+				// a rejected GETEX PERSIST never gets here
+				found = true
+				args = append(append(append([]*redis.Message(nil), args[:i]...), ex...), args[i+1:]...)
+				action = "injected"
+				if cmd == "GETEX" {
+					action = "converted"
+				}
+				i++
+			}
+		}
+		// a GETEX without an option leaves the expiry as it is
+		if !found && cmd == "SET" {
+			args = append(args, ex...)
+			action = "injected"
+		}
+	case "SETEX", "EXPIRE":
+		if clamp(2, time.Second, false) {
+			action = "clamped"
+		}
+	case "PSETEX", "PEXPIRE":
+		if clamp(2, time.Millisecond, false) {
+			action = "clamped"
+		}
+	case "EXPIREAT":
+		if clamp(2, time.Second, true) {
+			action = "clamped"
+		}
+	case "PEXPIREAT":
+		if clamp(2, time.Millisecond, true) {
+			action = "clamped"
+		}
+	case "PERSIST":
+		if c.opts.TTLPolicy.PersistToExpire {
+			args = []*redis.Message{redis.NewBulkBytes([]byte("EXPIRE")), args[1], ex[1]}
+			action = "converted"
+		}
+	}
+	if action == "" {
+		return m
+	}
+	c.ttlEnforced(ns, cmd, action)
+	return redis.NewArray(args)
+}
+
+// expireCreated sends an EXPIRE at the cap for each key of a namespace that a
+// forwarded command of TTLFollowUpCommands created, once it has been answered.
+// A failed follow-up is logged and counted, the command's reply standing.
+func (c *connection) expireCreated(db int, cmds []string, wm, res []*redis.Message) {
+	p := c.opts.TTLPolicy
+	if p == nil || !p.FollowUp {
+		return
+	}
+	var expires []*redis.Message
+	var namespaces []*TTLNamespace
+	for i, cmd := range cmds {
+		created, ok := TTLFollowUpCommands[cmd]
+		if !ok || res[i].IsError() || len(wm[i].Array) < ttlArity[cmd] || !created(wm[i], res[i]) {
+			continue
+		}
+		// MSET and MSETNX set every other argument's key
+		step := len(wm[i].Array)
+		if cmd == "MSET" || cmd == "MSETNX" {
+			step = 2
+		}
+		for k := 1; k < len(wm[i].Array); k += step {
+			key := wm[i].Array[k]
+			ns := p.namespace(key.Value)
+			if ns == nil {
+				continue
+			}
+			expires = append(expires, redis.NewArray([]*redis.Message{
+				redis.NewBulkBytes([]byte("EXPIRE")), key, redis.NewBulkBytes([]byte(strconv.FormatInt(int64(ns.MaxTTL/time.Second), 10))),
+			}))
+			namespaces = append(namespaces, ns)
+		}
+	}
+	if len(expires) == 0 {
+		return
+	}
+	expireCmds := make([]string, len(expires))
+	for i := range expireCmds {
+		expireCmds[i] = "EXPIRE"
+	}
+	fres, _, err := c.guardedForward(db, expireCmds, expires)
+	for i, ns := range namespaces {
+		if i >= len(fres) || fres[i].IsError() {
+			metrics.TTLEnforced.Incr(c.statsd, ns.Prefix, "followup_failed")
+			continue
+		}
+		c.ttlEnforced(ns, "EXPIRE", "followed_up")
+	}
+	if err != nil {
+		c.log.Warn("Follow-up EXPIRE of created keys failed, leaving them without a TTL", zap.Int("keys", len(expires)), zap.Error(err))
+	}
+}
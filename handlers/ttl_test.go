@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// listUpstream records the commands it is sent, answering RPUSH with the length
+// of the list and everything else with +OK
+type listUpstream struct {
+	mu    sync.Mutex
+	sent  []string
+	lists map[string]int
+}
+
+func (u *listUpstream) handle(args []string) *redis.Message {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sent = append(u.sent, strings.Join(args, " "))
+	if strings.ToUpper(args[0]) == "RPUSH" {
+		u.lists[args[1]] += len(args) - 2
+		return redis.NewInt([]byte(strconv.Itoa(u.lists[args[1]])))
+	}
+	return redis.NewString([]byte("OK"))
+}
+
+// take returns the commands sent since the last call
+func (u *listUpstream) take() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	sent := u.sent
+	u.sent = nil
+	return sent
+}
+
+func TestTTLPolicy(t *testing.T) {
+	u := &listUpstream{lists: make(map[string]int)}
+	upstream := newFakeUpstream(t, u.handle)
+	defer upstream.Close()
+	policy := &TTLPolicy{Namespaces: []TTLNamespace{{Prefix: "pii:", MaxTTL: time.Minute}}, FollowUp: true}
+	client := closingTestConnection(t, upstream.Address(), Options{TTLPolicy: policy})
+
+	for _, c := range []struct {
+		command []string
+		sent    []string
+	}{
+		{[]string{"SET", "pii:a", "v"}, []string{"SET pii:a v EX 60"}},
+		{[]string{"SET", "pii:a", "v", "NX", "ex", "3600"}, []string{"SET pii:a v NX ex 60"}},
+		{[]string{"SET", "pii:a", "v", "PX", "1000"}, []string{"SET pii:a v PX 1000"}},
+		{[]string{"SET", "pii:a", "v", "KEEPTTL", "GET"}, []string{"SET pii:a v EX 60 GET"}},
+		{[]string{"SET", "user:a", "v"}, []string{"SET user:a v"}},
+		{[]string{"SETEX", "pii:a", "86400", "v"}, []string{"SETEX pii:a 60 v"}},
+		{[]string{"EXPIRE", "pii:a", "3600", "NX"}, []string{"EXPIRE pii:a 60 NX"}},
+		{[]string{"EXPIRE", "user:a", "3600"}, []string{"EXPIRE user:a 3600"}},
+		{[]string{"RPUSH", "pii:l", "x", "y"}, []string{"RPUSH pii:l x y", "EXPIRE pii:l 60"}},
+		{[]string{"RPUSH", "pii:l", "z"}, []string{"RPUSH pii:l z"}},
+		{[]string{"RPUSH", "user:l", "x"}, []string{"RPUSH user:l x"}},
+		{[]string{"MSET", "pii:m", "1", "user:m", "2"}, []string{"MSET pii:m 1 user:m 2", "EXPIRE pii:m 60"}},
+	} {
+		roundTripStrings(t, client, 1, respCommand(c.command...))
+		assert.Equal(t, c.sent, u.take(), strings.Join(c.command, " "))
+	}
+
+	roundTripStrings(t, client, 1, respCommand("PEXPIREAT", "pii:a", "99999999999999"))
+	sent := u.take()
+	if assert.Len(t, sent, 1) {
+		at, err := strconv.ParseInt(strings.TrimPrefix(sent[0], "PEXPIREAT pii:a "), 10, 64)
+		assert.NoError(t, err)
+		assert.InDelta(t, time.Now().Add(time.Minute).UnixNano()/int64(time.Millisecond), at, 5000, "an expiry at a time is lowered to now plus the cap")
+	}
+
+	replies := roundTripStrings(t, client, 2, respCommand("PERSIST", "pii:a"), respCommand("GETEX", "pii:a", "PERSIST"))
+	for _, r := range replies {
+		assert.True(t, strings.HasPrefix(r, "-PROXYBLOCKED PERSIST") || strings.HasPrefix(r, "-PROXYBLOCKED GETEX"), r)
+		assert.Contains(t, r, "keys starting with pii: expire within 1m0s")
+	}
+	assert.Empty(t, u.take(), "a rejected PERSIST isn't forwarded")
+	roundTripStrings(t, client, 1, respCommand("PERSIST", "user:a"))
+	assert.Equal(t, []string{"PERSIST user:a"}, u.take())
+}
+
+func TestTTLPolicyPersistToExpire(t *testing.T) {
+	u := &listUpstream{lists: make(map[string]int)}
+	upstream := newFakeUpstream(t, u.handle)
+	defer upstream.Close()
+	policy := &TTLPolicy{Namespaces: []TTLNamespace{{Prefix: "pii:", MaxTTL: time.Hour}}, PersistToExpire: true}
+	client := closingTestConnection(t, upstream.Address(), Options{TTLPolicy: policy})
+
+	roundTripStrings(t, client, 1, respCommand("PERSIST", "pii:a"))
+	assert.Equal(t, []string{"EXPIRE pii:a 3600"}, u.take())
+	roundTripStrings(t, client, 1, respCommand("GETEX", "pii:a", "persist"))
+	assert.Equal(t, []string{"GETEX pii:a EX 3600"}, u.take())
+	roundTripStrings(t, client, 1, respCommand("RPUSH", "pii:l", "x"))
+	assert.Equal(t, []string{"RPUSH pii:l x"}, u.take(), "without FollowUp no EXPIRE follows")
+}
+
+func TestTTLPolicyInTransactions(t *testing.T) {
+	u := &listUpstream{lists: make(map[string]int)}
+	upstream := newFakeUpstream(t, u.handle)
+	defer upstream.Close()
+	policy := &TTLPolicy{Namespaces: []TTLNamespace{{Prefix: "pii:", MaxTTL: time.Minute}}}
+	client := closingTestConnection(t, upstream.Address(), Options{TTLPolicy: policy})
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+
+	// the commands of a transaction sent whole are capped
+	roundTripStrings(t, client, 6, start, respCommand("MULTI"), respCommand("SET", "pii:a", "v"), respCommand("EXPIRE", "pii:a", "3600"), respCommand("EXEC"), end)
+	assert.Equal(t, []string{"MULTI", "SET pii:a v EX 60", "EXPIRE pii:a 60", "EXEC"}, u.take())
+
+	// and one with a PERSIST is rejected whole
+	replies := roundTripStrings(t, client, 5, start, respCommand("MULTI"), respCommand("PERSIST", "pii:a"), respCommand("EXEC"), end)
+	for _, r := range replies[1:4] {
+		assert.True(t, strings.HasPrefix(r, "-PROXYBLOCKED PERSIST would keep pii:a forever"), r)
+	}
+	assert.Empty(t, u.take())
+}
+
+func TestTTLPolicyInPinnedTransactions(t *testing.T) {
+	upstream := newFakeTransactions(t)
+	policy := &TTLPolicy{Namespaces: []TTLNamespace{{Prefix: "pii:", MaxTTL: time.Minute}}}
+	client := closingTestConnection(t, upstream.li.Addr().String(), Options{TTLPolicy: policy, Transactions: &Transactions{IdleTimeout: time.Second}})
+
+	roundTripStrings(t, client, 1, respCommand("MULTI"))
+	assert.Equal(t, []string{"+QUEUED \\r\\n "}, roundTripStrings(t, client, 1, respCommand("SET", "pii:a", "v")))
+	assert.Equal(t, []string{"*1 \\r\\n $2 \\r\\n 60 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("EXEC")),
+		"the SET queued was given an expiry at the cap")
+
+	roundTripStrings(t, client, 1, respCommand("MULTI"))
+	r := roundTripStrings(t, client, 1, respCommand("PERSIST", "pii:a"))[0]
+	assert.True(t, strings.HasPrefix(r, "-PROXYBLOCKED PERSIST would keep pii:a forever"), r)
+	discarded := "-PROXYBLOCKED transaction discarded, PERSIST was rejected \\r\\n "
+	assert.Equal(t, []string{discarded}, roundTripStrings(t, client, 1, respCommand("EXEC")))
+	assert.Equal(t, []string{"MULTI", "SET", "EXEC", "MULTI", "DISCARD"}, upstream.commands())
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// integerArgs are the positions of arguments that must be integers, of commands
+// that check them before anything else, including looking up their key. Exact,
+// if set, limits the check to commands with that many arguments, for commands
+// like EXPIRE that parse their options first when they have any.
+var integerArgs = map[string]struct {
+	positions   []int
+	exact       int
+	nonNegative bool
+}{
+	"DECRBY":    {positions: []int{2}},
+	"EXPIRE":    {positions: []int{2}, exact: 3},
+	"EXPIREAT":  {positions: []int{2}, exact: 3},
+	"GETRANGE":  {positions: []int{2, 3}},
+	"HINCRBY":   {positions: []int{3}},
+	"INCRBY":    {positions: []int{2}},
+	"LRANGE":    {positions: []int{2, 3}},
+	"LTRIM":     {positions: []int{2, 3}},
+	"PEXPIRE":   {positions: []int{2}, exact: 3},
+	"PEXPIREAT": {positions: []int{2}, exact: 3},
+	"PSETEX":    {positions: []int{2}},
+	"SETEX":     {positions: []int{2}},
+	"SETRANGE":  {positions: []int{2}, nonNegative: true},
+}
+
+// validate rejects the commands redis itself would reject for their number of
+// arguments, or for a malformed integer argument, with the same error. Arity
+// comes from the upstream's COMMAND reply, so nothing is validated until the key
+// table has been loaded.
+func (c *connection) validate(cmd string, m *redis.Message) *redis.Message {
+	if !c.opts.StrictValidation || !c.opts.Keys.Loaded() {
+		return nil
+	}
+	r := validateCommand(c.opts.Keys, cmd, m)
+	if r != nil {
+		metrics.ValidationRejected.Incr(c.statsd, cmd)
+		if c.trace != nil {
+			c.trace.add("validation", string(r.Value))
+		}
+	}
+	return r
+}
+
+func validateCommand(keys *KeyTable, cmd string, m *redis.Message) *redis.Message {
+	a, ok := keys.arity(cmd)
+	if !ok {
+		return nil
+	}
+	if n := len(m.Array); (a.n > 0 && n != a.n) || (a.n < 0 && n < -a.n) {
+		return redis.NewErrorf("ERR wrong number of arguments for '%s' command", a.name)
+	}
+	check, ok := integerArgs[cmd]
+	if !ok || (check.exact > 0 && len(m.Array) != check.exact) {
+		return nil
+	}
+	for _, i := range check.positions {
+		if i >= len(m.Array) {
+			continue
+		}
+		n, ok := parseInteger(m.Array[i].Value)
+		if !ok {
+			return redis.NewErrorf("ERR value is not an integer or out of range")
+		}
+		if check.nonNegative && n < 0 {
+			return redis.NewErrorf("ERR offset is out of range")
+		}
+	}
+	return nil
+}
+
+// parseInteger parses an integer the way redis does, which only accepts the
+// canonical form: no sign but a minus, no leading zeros and no spaces
+func parseInteger(b []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != string(b) {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// validationCorpus are malformed commands, each rejected by redis before it
+// looks at any key
+var validationCorpus = [][]string{
+	{"GET"},
+	{"GET", "a", "b"},
+	{"SET", "a"},
+	{"MSET", "a"},
+	{"HSET", "h", "f"},
+	{"EXPIRE", "k"},
+	{"EXPIRE", "k", "soon"},
+	{"EXPIRE", "k", "1.5"},
+	{"EXPIRE", "k", "+5"},
+	{"PEXPIRE", "k", "007"},
+	{"EXPIREAT", "k", ""},
+	{"PEXPIREAT", "k", "-0"},
+	{"SETRANGE", "k", "-1", "v"},
+	{"SETRANGE", "k", "x", "v"},
+	{"SETRANGE", "k", "1"},
+	{"GETRANGE", "k", "0", "x"},
+	{"INCRBY", "k", "99999999999999999999"},
+	{"DECRBY", "k", " 1"},
+	{"HINCRBY", "h", "f", "x"},
+	{"LRANGE", "l", "0", "x"},
+	{"LTRIM", "l", "x", "1"},
+	{"SETEX", "k", "x", "v"},
+	{"PSETEX", "k", "1e3", "v"},
+}
+
+func arityInfo(name string, arity int) *redis.Message {
+	itoa := func(i int) *redis.Message { return redis.NewInt([]byte(strconv.Itoa(i))) }
+	return redis.NewArray([]*redis.Message{
+		redis.NewBulkBytes([]byte(name)), itoa(arity), redis.NewArray(nil), itoa(1), itoa(1), itoa(1),
+	})
+}
+
+func validationTable(t *testing.T) *KeyTable {
+	keys := NewKeyTable()
+	client := arityInfo("client", -2)
+	setinfo := arityInfo("client|setinfo", 4)
+	client.Array = append(client.Array, redis.NewArray(nil), redis.NewArray(nil), redis.NewArray(nil), redis.NewArray([]*redis.Message{setinfo}))
+	_, err := keys.Load(redis.NewArray([]*redis.Message{
+		arityInfo("get", 2),
+		arityInfo("set", -3),
+		arityInfo("expire", -3),
+		arityInfo("setrange", 4),
+		client,
+	}))
+	assert.NoError(t, err)
+	return keys
+}
+
+func TestValidateCommand(t *testing.T) {
+	keys := validationTable(t)
+	for _, tc := range []struct {
+		cmd      string
+		args     []string
+		expected string
+	}{
+		{"GET", []string{"GET"}, "ERR wrong number of arguments for 'get' command"},
+		{"GET", []string{"get", "a", "b"}, "ERR wrong number of arguments for 'get' command"},
+		{"GET", []string{"GET", "a"}, ""},
+		{"SET", []string{"SET", "a"}, "ERR wrong number of arguments for 'set' command"},
+		{"SET", []string{"SET", "a", "b", "EX", "10"}, ""},
+		{"EXPIRE", []string{"EXPIRE", "k", "soon"}, "ERR value is not an integer or out of range"},
+		{"EXPIRE", []string{"EXPIRE", "k", "-10"}, ""},
+		{"EXPIRE", []string{"EXPIRE", "k", "soon", "NX"}, ""},
+		{"SETRANGE", []string{"SETRANGE", "k", "-1", "v"}, "ERR offset is out of range"},
+		{"SETRANGE", []string{"SETRANGE", "k", "01", "v"}, "ERR value is not an integer or out of range"},
+		{"CLIENT SETINFO", []string{"CLIENT", "SETINFO", "lib-name"}, "ERR wrong number of arguments for 'client|setinfo' command"},
+		{"CLIENT", []string{"CLIENT"}, "ERR wrong number of arguments for 'client' command"},
+		{"INCRBY", []string{"INCRBY", "k", "x"}, "" /* unknown to the table */},
+	} {
+		r := validateCommand(keys, tc.cmd, redis.NewArray(bulks(tc.args...)))
+		if tc.expected == "" {
+			assert.Nil(t, r, tc.args)
+		} else if assert.NotNil(t, r, tc.args) {
+			assert.Equal(t, tc.expected, string(r.Value), tc.args)
+		}
+	}
+}
+
+func TestStrictValidation(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{StrictValidation: true, Keys: validationTable(t)})
+	defer func() { _ = client.Close() }()
+
+	assert.Equal(t, []string{"-ERR wrong number of arguments for 'get' command \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET")))
+	assert.Equal(t, []string{"-ERR value is not an integer or out of range \\r\\n "}, roundTripStrings(t, client, 1, respCommand("EXPIRE", "k", "soon")))
+	assert.Equal(t, int64(0), upstream.Commands(), "invalid commands are answered without a round trip")
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n "}, roundTripStrings(t, client, 1, respCommand("GET", "a")))
+	assert.Equal(t, int64(1), upstream.Commands())
+}
+
+func TestStrictValidationUnloaded(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	defer upstream.Close()
+	client := runTestConnection(t, upstream.Address(), Options{StrictValidation: true, Keys: NewKeyTable()})
+	defer func() { _ = client.Close() }()
+	roundTripStrings(t, client, 1, respCommand("GET"))
+	assert.Equal(t, int64(1), upstream.Commands(), "without the arity of commands, everything is forwarded")
+}
+
+// assumes a standalone redis listening on port 7006. see docker-compose.yml
+func TestValidationMatchesServer(t *testing.T) {
+	host := os.Getenv("REDIS_HOST")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, "7006"), time.Second)
+	if err != nil {
+		t.Fatalf("error connecting to redis: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	d := redis.NewDecoder(conn)
+	do := func(args ...string) *redis.Message {
+		assert.NoError(t, redis.Encode(conn, redis.NewArray(bulks(args...))))
+		m, err := d.Decode()
+		assert.NoError(t, err)
+		return m
+	}
+
+	keys := NewKeyTable()
+	_, err = keys.Load(do("COMMAND"))
+	assert.NoError(t, err)
+	for _, args := range validationCorpus {
+		server := do(args...)
+		assert.True(t, server.IsError(), args)
+		local := validateCommand(keys, args[0], redis.NewArray(bulks(args...)))
+		if assert.NotNil(t, local, args) {
+			assert.Equal(t, string(server.Value), string(local.Value), args)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// MaxPendingWarnings bounds the warnings a connection holds until they are
+// delivered, those attached past it being suppressed
+const MaxPendingWarnings = 16
+
+// The types of the warnings the proxy attaches itself
+const (
+	WarningDeprecatedClient = "deprecated_client"
+	WarningMemoryLimit      = "memory_limit"
+	WarningPipelineSignals  = "pipeline_signals"
+)
+
+// warningType is what the types of broadcasts are made of, being metric tags
+var warningType = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// Warning is an advisory message for a client, of a Type telling what it is
+// about. A broadcast Warning is attached to the connections that send a request
+// before it Expires.
+type Warning struct {
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+	Expires time.Time `json:"expires,omitempty"`
+	seq     uint64
+}
+
+// WarningsOptions configures Warnings: a connection is attached a warning of
+// a type at most once per Interval, and with Signals, those of the requests
+// wrapped in pipeline signals are warned the signals are deprecated
+type WarningsOptions struct {
+	Interval time.Duration
+	Signals  bool
+}
+
+// Warnings are the advisory messages the proxy attaches to the client
+// connections of a listener, for the policies they run into and the broadcasts
+// of the operator. Each connection holds its own until they are delivered: a
+// RESP3 client is pushed them after the replies of its next request, and others
+// read them with PROXY WARNINGS. Broadcasts reach the connections as they send
+// their next request, until they expire.
+type Warnings struct {
+	opts WarningsOptions
+	seq  uint64
+
+	mu         sync.Mutex
+	broadcasts []Warning
+	attached   map[string]int64
+	suppressed map[string]int64
+}
+
+// WarningsStats are the broadcasts of a listener still to expire, and the
+// warnings attached to its connections and suppressed, by type
+type WarningsStats struct {
+	Broadcasts []Warning        `json:"broadcasts"`
+	Attached   map[string]int64 `json:"attached"`
+	Suppressed map[string]int64 `json:"suppressed"`
+}
+
+func NewWarnings(opts WarningsOptions) *Warnings {
+	return &Warnings{opts: opts, attached: make(map[string]int64), suppressed: make(map[string]int64)}
+}
+
+// Broadcast attaches w to every connection that sends a request within ttl
+func (ws *Warnings) Broadcast(w Warning, ttl time.Duration, now time.Time) error {
+	if !warningType.MatchString(w.Type) {
+		return fmt.Errorf("invalid warning type %q, expected up to 32 lowercase letters, digits and underscores", w.Type)
+	}
+	if w.Message == "" || ttl <= 0 {
+		return fmt.Errorf("a warning needs a message and a positive ttl")
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.expire(now)
+	w.Expires = now.Add(ttl)
+	w.seq = atomic.AddUint64(&ws.seq, 1)
+	ws.broadcasts = append(ws.broadcasts, w)
+	return nil
+}
+
+// expire forgets the broadcasts expired by now
+func (ws *Warnings) expire(now time.Time) {
+	n := 0
+	for _, b := range ws.broadcasts {
+		if now.Before(b.Expires) {
+			ws.broadcasts[n] = b
+			n++
+		}
+	}
+	ws.broadcasts = ws.broadcasts[:n]
+}
+
+// Stats returns the broadcasts to expire and the warnings counted so far, nil
+// without Warnings
+func (ws *Warnings) Stats() *WarningsStats {
+	if ws == nil {
+		return nil
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.expire(time.Now())
+	s := &WarningsStats{Broadcasts: append([]Warning{}, ws.broadcasts...), Attached: make(map[string]int64), Suppressed: make(map[string]int64)}
+	for t, n := range ws.attached {
+		s.Attached[t] = n
+	}
+	for t, n := range ws.suppressed {
+		s.Suppressed[t] = n
+	}
+	return s
+}
+
+func (ws *Warnings) count(typ string, attached bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if attached {
+		ws.attached[typ]++
+	} else {
+		ws.suppressed[typ]++
+	}
+}
+
+// connWarnings are the warnings of a connection: those pending delivery, when
+// each type was attached last, and the last broadcast it was attached
+type connWarnings struct {
+	pending []Warning
+	last    map[string]time.Time
+	seen    uint64
+}
+
+// warn attaches a warning to the connection, unless one of its type was
+// within the interval, or too many are pending
+func (c *connection) warn(typ, message string) {
+	ws := c.opts.Warnings
+	if ws == nil {
+		return
+	}
+	now := time.Now()
+	if c.warnings.last == nil {
+		c.warnings.last = make(map[string]time.Time)
+	}
+	if last, ok := c.warnings.last[typ]; (ok && now.Sub(last) < ws.opts.Interval) || len(c.warnings.pending) >= MaxPendingWarnings {
+		ws.count(typ, false)
+		metrics.Warnings.Incr(c.statsd, typ, "suppressed")
+		return
+	}
+	c.warnings.last[typ] = now
+	c.warnings.pending = append(c.warnings.pending, Warning{Type: typ, Message: message})
+	ws.count(typ, true)
+	metrics.Warnings.Incr(c.statsd, typ, "attached")
+}
+
+// receiveBroadcasts attaches the broadcasts the connection has yet to be, as
+// it starts handling a request
+func (c *connection) receiveBroadcasts() {
+	ws := c.opts.Warnings
+	if ws == nil || atomic.LoadUint64(&ws.seq) == c.warnings.seen {
+		return
+	}
+	now := time.Now()
+	ws.mu.Lock()
+	var fresh []Warning
+	for _, b := range ws.broadcasts {
+		if b.seq > c.warnings.seen && now.Before(b.Expires) {
+			fresh = append(fresh, b)
+		}
+	}
+	c.warnings.seen = atomic.LoadUint64(&ws.seq)
+	ws.mu.Unlock()
+	sort.Slice(fresh, func(i, j int) bool { return fresh[i].seq < fresh[j].seq })
+	for _, b := range fresh {
+		c.warn(b.Type, b.Message)
+	}
+}
+
+// takeWarnings returns the pending warnings, which are delivered
+func (c *connection) takeWarnings(delivery string) []Warning {
+	pending := c.warnings.pending
+	c.warnings.pending = nil
+	if len(pending) > 0 {
+		metrics.WarningsDelivered.Count(c.statsd, int64(len(pending)), delivery)
+	}
+	return pending
+}
+
+// warningPushes are the pending warnings as the pushes RESP3 clients are sent
+// after the replies of a request, none for other clients, or those whose
+// replies are padded for pipeline signals
+func (c *connection) warningPushes(pipelined bool) []*redis.Message {
+	if c.opts.Warnings == nil || len(c.warnings.pending) == 0 || !c.speaksRESP3() || pipelined {
+		return nil
+	}
+	var pushes []*redis.Message
+	for _, w := range c.takeWarnings("push") {
+		m := redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("proxy-warning")),
+			redis.NewBulkBytes([]byte(w.Type)),
+			redis.NewBulkBytes([]byte(w.Message)),
+		})
+		m.Type = redis.TypePush
+		pushes = append(pushes, m)
+	}
+	return pushes
+}
+
+// proxyWarnings answers PROXY WARNINGS with the pending warnings, as a
+// [type, message] array each, which are delivered
+func (c *connection) proxyWarnings(args []*redis.Message) *redis.Message {
+	if len(args) != 0 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'proxy|warnings' command")
+	}
+	if c.opts.Warnings == nil {
+		return redis.NewArray([]*redis.Message{})
+	}
+	c.receiveBroadcasts()
+	res := []*redis.Message{}
+	for _, w := range c.takeWarnings("command") {
+		res = append(res, redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte(w.Type)), redis.NewBulkBytes([]byte(w.Message))}))
+	}
+	return redis.NewArray(res)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/memwatch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarnings(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	t.Cleanup(upstream.Close)
+	ws := NewWarnings(WarningsOptions{Interval: time.Minute, Signals: true})
+	client := closingTestConnection(t, upstream.Address(), Options{
+		Warnings:          ws,
+		Memory:            newWatchdog(t, memwatch.Options{Soft: memwatch.Limit{Bytes: 1}, ShedBytes: 100}),
+		ClientLibraries:   NewClientLibraries(4),
+		DeprecatedClients: regexp.MustCompile(`^redis-rb/4\.`),
+	})
+
+	roundTripStrings(t, client, 2, respCommand("CLIENT", "SETINFO", "lib-name", "redis-rb"), respCommand("CLIENT", "SETINFO", "lib-ver", "4.8.1"))
+	roundTripStrings(t, client, 1, respCommand("GET", "a"))
+	assert.Equal(t, []string{"*2 \\r\\n " +
+		"*2 \\r\\n $17 \\r\\n deprecated_client \\r\\n $55 \\r\\n client library redis-rb/4.8.1 is deprecated, upgrade it \\r\\n " +
+		"*2 \\r\\n $12 \\r\\n memory_limit \\r\\n $72 \\r\\n the proxy's memory is over its soft limit, large requests are being shed \\r\\n "},
+		roundTripStrings(t, client, 1, respCommand("PROXY", "WARNINGS")))
+
+	// a type is attached once per interval, and broadcasts as the connection
+	// sends its next request
+	roundTripStrings(t, client, 1, respCommand("GET", "a"))
+	assert.Equal(t, []string{"*0 \\r\\n "}, roundTripStrings(t, client, 1, respCommand("PROXY", "WARNINGS")))
+	assert.NoError(t, ws.Broadcast(Warning{Type: "maintenance", Message: "maintenance at 02:00 UTC"}, time.Hour, time.Now()))
+	start, end := respCommand("GET", string(PipelineSignalStartKey)), respCommand("GET", string(PipelineSignalEndKey))
+	roundTripStrings(t, client, 4, start, respCommand("GET", "a"), respCommand("GET", "b"), end)
+	r := roundTripStrings(t, client, 1, respCommand("PROXY", "WARNINGS"))
+	assert.Contains(t, r[0], "maintenance at 02:00 UTC")
+	assert.Contains(t, r[0], "pipeline_signals")
+
+	s := ws.Stats()
+	assert.Equal(t, map[string]int64{"deprecated_client": 1, "memory_limit": 1, "maintenance": 1, "pipeline_signals": 1}, s.Attached)
+	assert.Equal(t, int64(2), s.Suppressed["memory_limit"])
+	if assert.Len(t, s.Broadcasts, 1) {
+		assert.Equal(t, "maintenance", s.Broadcasts[0].Type)
+	}
+}
+
+func TestWarningsPush(t *testing.T) {
+	upstream := newFakeUpstream(t, echoKey)
+	t.Cleanup(upstream.Close)
+	s := newTestServer(t, upstream.Address(), 2)
+	t.Cleanup(func() { _ = s.Disconnect(context.Background()) })
+	ws := NewWarnings(WarningsOptions{Interval: time.Minute})
+	client := closingTestConnection(t, upstream.Address(), Options{Warnings: ws, RESP3: s})
+
+	r := roundTripFrames(t, client, 1, respCommand("HELLO", "3"))
+	assert.True(t, strings.HasPrefix(r[0], "%"), r[0])
+	assert.NoError(t, ws.Broadcast(Warning{Type: "maintenance", Message: "soon"}, time.Hour, time.Now()))
+	assert.Equal(t, []string{"$7 \\r\\n a-value \\r\\n ", ">3 \\r\\n $13 \\r\\n proxy-warning \\r\\n $11 \\r\\n maintenance \\r\\n $4 \\r\\n soon \\r\\n "},
+		roundTripFrames(t, client, 2, respCommand("GET", "a")), "RESP3 clients are pushed their warnings after the replies")
+	assert.Equal(t, []string{"*0 \\r\\n "}, roundTripFrames(t, client, 1, respCommand("PROXY", "WARNINGS")))
+}
+
+func TestWarningsBounded(t *testing.T) {
+	ws := NewWarnings(WarningsOptions{})
+	c := connection{opts: Options{Warnings: ws}}
+	for i := 0; i < MaxPendingWarnings+4; i++ {
+		c.warn(WarningDeprecatedClient, "upgrade")
+	}
+	assert.Len(t, c.warnings.pending, MaxPendingWarnings)
+	assert.Equal(t, int64(4), ws.Stats().Suppressed[WarningDeprecatedClient])
+
+	now := time.Now()
+	assert.Error(t, ws.Broadcast(Warning{Type: "Maintenance!", Message: "soon"}, time.Hour, now))
+	assert.Error(t, ws.Broadcast(Warning{Type: "maintenance"}, time.Hour, now))
+	assert.NoError(t, ws.Broadcast(Warning{Type: "maintenance", Message: "soon"}, time.Millisecond, now.Add(-time.Second)))
+	assert.Empty(t, ws.Stats().Broadcasts, "expired broadcasts are forgotten")
+	c.warnings.pending = nil
+	c.receiveBroadcasts()
+	assert.Empty(t, c.warnings.pending)
+
+	var none *Warnings
+	assert.Nil(t, none.Stats())
+}
@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	// WriteBehindReplyQueued acknowledges an absorbed increment with the integer
+	// 0, a placeholder like the QUEUED of a transaction. It is NOT the value of
+	// the counter.
+	WriteBehindReplyQueued = "queued"
+	// WriteBehindReplyTotal acknowledges an absorbed increment with the
+	// counter's value as of the last flush plus the increments absorbed since.
+	// The first increment of a counter the proxy doesn't know the value of is
+	// forwarded to learn it.
+	WriteBehindReplyTotal = "total"
+
+	writeBehindMaxBackoff = 5 * time.Second
+)
+
+// WriteBehindCommands are the increments that write-behind can absorb
+var WriteBehindCommands = map[string]bool{
+	"INCR":    true,
+	"INCRBY":  true,
+	"HINCRBY": true,
+}
+
+// transient upstream errors, after which a flush is retried rather than dropped
+var writeBehindRetryable = []string{"LOADING", "TRYAGAIN", "CLUSTERDOWN", "BUSY", "MASTERDOWN"}
+
+// WriteBehindOptions configures write-behind. Increments of keys starting with
+// one of Prefixes are acknowledged right away and flushed to the upstream as a
+// single INCRBY or HINCRBY per counter, every Interval or as soon as FlushKeys
+// counters are pending. At most MaxPending counters are pending at once, after
+// which increments of other counters are forwarded as usual.
+type WriteBehindOptions struct {
+	Prefixes     []string
+	Interval     time.Duration
+	FlushKeys    int
+	MaxPending   int
+	Reply        string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+type counterKey struct {
+	key   string
+	field string
+	hash  bool
+}
+
+type counter struct {
+	// pending is absorbed but not yet sent, flushing is sent but not yet
+	// acknowledged by the upstream, and base is the value the upstream last
+	// replied with
+	pending  int64
+	flushing int64
+	base     int64
+	known    bool
+	touched  bool
+}
+
+func (e *counter) dirty() bool {
+	return e.pending != 0 || e.flushing != 0
+}
+
+// WriteBehind aggregates the increments of one upstream node. Reads of a counter
+// see the upstream value, which lags by up to Interval (or longer while flushes
+// fail), whatever the reply mode.
+type WriteBehind struct {
+	log    *zap.Logger
+	statsd *statsd.Client
+	server *pool.Server
+	opts   WriteBehindOptions
+
+	mu       sync.Mutex
+	counters map[counterKey]*counter
+	dirty    int
+	warned   bool
+
+	flushNow chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+func NewWriteBehind(log *zap.Logger, sd *statsd.Client, server *pool.Server, opts WriteBehindOptions) *WriteBehind {
+	return &WriteBehind{
+		log:      log,
+		statsd:   sd,
+		server:   server,
+		opts:     opts,
+		counters: make(map[counterKey]*counter),
+		flushNow: make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// parseIncrement returns the counter and increment of an INCR, INCRBY or
+// HINCRBY, or false for malformed ones, which are forwarded for the upstream to
+// answer with its own error
+func parseIncrement(cmd string, m *redis.Message) (counterKey, int64, bool) {
+	args := m.Array
+	var k counterKey
+	var by []byte
+	switch {
+	case cmd == "INCR" && len(args) == 2:
+		k.key = string(args[1].Value)
+		return k, 1, true
+	case cmd == "INCRBY" && len(args) == 3:
+		k.key, by = string(args[1].Value), args[2].Value
+	case cmd == "HINCRBY" && len(args) == 4:
+		k.key, k.field, k.hash, by = string(args[1].Value), string(args[2].Value), true, args[3].Value
+	default:
+		return k, 0, false
+	}
+	n, err := strconv.ParseInt(string(by), 10, 64)
+	return k, n, err == nil
+}
+
+func (w *WriteBehind) matches(key string) bool {
+	for _, prefix := range w.opts.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Absorb queues an increment, returning the reply to acknowledge it with, or nil
+// if it must be forwarded: its key doesn't match a prefix, the queue is full, or
+// its counter's value isn't known yet in the total reply mode
+func (w *WriteBehind) Absorb(cmd string, m *redis.Message) *redis.Message {
+	if w == nil {
+		return nil
+	}
+	k, n, ok := parseIncrement(cmd, m)
+	if !ok || !w.matches(k.key) {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e := w.counters[k]
+	if e == nil {
+		if len(w.counters) >= w.opts.MaxPending {
+			metrics.WriteBehindFull.Incr(w.statsd)
+			if !w.warned {
+				w.warned = true
+				w.log.Warn("Write-behind queue is full, increments of other counters are forwarded until it flushes", zap.Int("pending", w.dirty))
+			}
+			return nil
+		}
+		e = &counter{}
+		w.counters[k] = e
+	}
+	e.touched = true
+	if w.opts.Reply == WriteBehindReplyTotal && !e.known {
+		return nil
+	}
+	if (n > 0 && e.pending > math.MaxInt64-n) || (n < 0 && e.pending < math.MinInt64-n) {
+		return nil
+	}
+	if !e.dirty() {
+		w.dirty++
+	}
+	e.pending += n
+	if e.pending == 0 && e.flushing == 0 {
+		// increments that cancel out leave nothing to flush
+		w.dirty--
+	}
+	metrics.WriteBehindAbsorbed.Incr(w.statsd, cmd)
+	if w.dirty >= w.opts.FlushKeys {
+		select {
+		case w.flushNow <- struct{}{}:
+		default:
+		}
+	}
+
+	if w.opts.Reply == WriteBehindReplyTotal {
+		return redis.NewInt([]byte(strconv.FormatInt(e.base+e.flushing+e.pending, 10)))
+	}
+	return redis.NewInt([]byte("0"))
+}
+
+// Observe learns the value of the counters whose increments were forwarded
+func (w *WriteBehind) Observe(cmds []string, wm, res []*redis.Message) {
+	if w == nil || w.opts.Reply != WriteBehindReplyTotal {
+		return
+	}
+	for i, cmd := range cmds {
+		if !WriteBehindCommands[cmd] || i >= len(res) || !res[i].IsInt() {
+			continue
+		}
+		k, _, ok := parseIncrement(cmd, wm[i])
+		if !ok || !w.matches(k.key) {
+			continue
+		}
+		v, err := strconv.ParseInt(string(res[i].Value), 10, 64)
+		if err != nil {
+			continue
+		}
+		w.mu.Lock()
+		if e := w.counters[k]; e != nil && !e.known {
+			e.base, e.known = v, true
+		}
+		w.mu.Unlock()
+	}
+}
+
+// Run flushes every Interval, and whenever FlushKeys counters are pending, until
+// Close. A failed flush is retried with a backoff, its increments staying queued.
+func (w *WriteBehind) Run() {
+	defer close(w.done)
+	backoff := w.opts.Interval
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-timer.C:
+		case <-w.flushNow:
+			if backoff > w.opts.Interval {
+				// still backing off from a failure
+				continue
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), w.opts.ReadTimeout+w.opts.WriteTimeout)
+		err := w.flush(ctx)
+		cancel()
+		if err != nil {
+			backoff *= 2
+			if backoff > writeBehindMaxBackoff {
+				backoff = writeBehindMaxBackoff
+			}
+			w.log.Warn("Write-behind flush failed, retrying", zap.Error(err), zap.Duration("backoff", backoff), zap.Int("pending", w.Pending()))
+		} else {
+			backoff = w.opts.Interval
+		}
+		timer.Reset(backoff)
+	}
+}
+
+// Close stops Run and flushes what is pending, retrying until ctx is done. The
+// counters that could not be flushed by then are logged with their increments,
+// so that they can be applied by hand.
+func (w *WriteBehind) Close(ctx context.Context) error {
+	if w == nil {
+		return nil
+	}
+	select {
+	case <-w.quit:
+	default:
+		close(w.quit)
+	}
+	<-w.done
+
+	backoff := w.opts.Interval
+	for {
+		err := w.flush(ctx)
+		if err == nil && w.Pending() == 0 {
+			return nil
+		}
+		if err == nil {
+			// transient errors left some counters queued
+			err = errors.New("upstream is unavailable")
+		}
+		select {
+		case <-ctx.Done():
+			w.logLost(err)
+			return fmt.Errorf("write-behind increments of %d counters were not flushed: %w", w.Pending(), err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > writeBehindMaxBackoff {
+			backoff = writeBehindMaxBackoff
+		}
+	}
+}
+
+// ClearDB forgets the values of the counters, learnt in the total reply mode,
+// once their database is flushed or swapped. Increments absorbed before that
+// are still flushed, after it.
+func (w *WriteBehind) ClearDB() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for k, e := range w.counters {
+		if !e.dirty() {
+			delete(w.counters, k)
+			continue
+		}
+		e.base, e.known = 0, false
+	}
+}
+
+// Pending returns the number of counters with increments not yet flushed
+func (w *WriteBehind) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dirty
+}
+
+func (w *WriteBehind) logLost(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for k, e := range w.counters {
+		if !e.dirty() {
+			continue
+		}
+		metrics.WriteBehindLost.Incr(w.statsd)
+		w.log.Error("Write-behind increment was not flushed", zap.String("key", k.key), zap.String("field", k.field), zap.Int64("increment", e.pending+e.flushing), zap.Error(err))
+	}
+}
+
+// flush sends the pending increments as one INCRBY or HINCRBY per counter,
+// pipelined FlushKeys at a time
+func (w *WriteBehind) flush(ctx context.Context) error {
+	w.mu.Lock()
+	var keys []counterKey
+	for k, e := range w.counters {
+		switch {
+		case e.pending != 0:
+			e.flushing, e.pending = e.pending, 0
+			keys = append(keys, k)
+		case !e.touched && !e.dirty():
+			// forget the value of counters idle since the last flush
+			delete(w.counters, k)
+		}
+		e.touched = false
+	}
+	w.warned = false
+	metrics.WriteBehindPending.Set(w.statsd, float64(w.dirty))
+	w.mu.Unlock()
+
+	var err error
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > w.opts.FlushKeys {
+			n = w.opts.FlushKeys
+		}
+		if err == nil {
+			err = w.flushChunk(ctx, keys[:n])
+		} else {
+			w.requeue(keys[:n])
+		}
+		keys = keys[n:]
+	}
+	return err
+}
+
+func (w *WriteBehind) flushChunk(ctx context.Context, keys []counterKey) (err error) {
+	defer func(start time.Time) {
+		metrics.WriteBehindFlush.Record(w.statsd, time.Since(start), strconv.FormatBool(err == nil))
+	}(time.Now())
+
+	w.mu.Lock()
+	wm := make([]*redis.Message, len(keys))
+	for i, k := range keys {
+		by := redis.NewBulkBytes([]byte(strconv.FormatInt(w.counters[k].flushing, 10)))
+		if k.hash {
+			wm[i] = redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("HINCRBY")), redis.NewBulkBytes([]byte(k.key)), redis.NewBulkBytes([]byte(k.field)), by})
+		} else {
+			wm[i] = redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("INCRBY")), redis.NewBulkBytes([]byte(k.key)), by})
+		}
+	}
+	w.mu.Unlock()
+
+	res, err := Exchange(ctx, w.log, w.server, wm, w.opts.ReadTimeout, w.opts.WriteTimeout)
+	if err != nil {
+		w.requeue(keys)
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, k := range keys {
+		e := w.counters[k]
+		r := res[i]
+		switch {
+		case r.IsInt():
+			e.base, _ = strconv.ParseInt(string(r.Value), 10, 64)
+			e.known = true
+		case r.IsError() && retryableError(r):
+			e.pending += e.flushing
+			e.flushing = 0
+			continue
+		default:
+			metrics.WriteBehindRejected.Incr(w.statsd)
+			w.log.Error("Upstream rejected a write-behind increment, it is dropped", zap.String("key", k.key), zap.String("field", k.field), zap.Int64("increment", e.flushing), zap.String("reply", r.String()))
+			e.known = false
+		}
+		e.flushing = 0
+		if !e.dirty() {
+			w.dirty--
+		}
+	}
+	metrics.WriteBehindFlushedKeys.Record(w.statsd, float64(len(keys)))
+	return nil
+}
+
+// requeue returns the increments of a failed flush to the queue
+func (w *WriteBehind) requeue(keys []counterKey) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, k := range keys {
+		e := w.counters[k]
+		e.pending += e.flushing
+		e.flushing = 0
+	}
+}
+
+func retryableError(r *redis.Message) bool {
+	for _, prefix := range writeBehindRetryable {
+		if strings.HasPrefix(string(r.Value), prefix) {
+			return true
+		}
+	}
+	return false
+}
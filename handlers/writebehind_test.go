@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// counters is an upstream that keeps INCRBY, HINCRBY and INCR counters, and
+// answers GET with their value
+type counters struct {
+	sync.Mutex
+	values   map[string]int64
+	received []string
+	reply    func(args []string) *redis.Message
+}
+
+func (c *counters) handle(args []string) *redis.Message {
+	c.Lock()
+	defer c.Unlock()
+	c.received = append(c.received, strings.Join(args, " "))
+	if c.reply != nil {
+		if r := c.reply(args); r != nil {
+			return r
+		}
+	}
+	key := args[1]
+	by := int64(1)
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		return redis.NewBulkBytes([]byte(strconv.FormatInt(c.values[key], 10)))
+	case "INCRBY":
+		by, _ = strconv.ParseInt(args[2], 10, 64)
+	case "HINCRBY":
+		key += "/" + args[2]
+		by, _ = strconv.ParseInt(args[3], 10, 64)
+	}
+	c.values[key] += by
+	return redis.NewInt([]byte(strconv.FormatInt(c.values[key], 10)))
+}
+
+func (c *counters) Received() []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string(nil), c.received...)
+}
+
+func newWriteBehindUpstream(t *testing.T, values map[string]int64) (*counters, *fakeUpstream) {
+	c := &counters{values: values}
+	upstream := newFakeUpstream(t, c.handle)
+	t.Cleanup(upstream.Close)
+	return c, upstream
+}
+
+func writeBehindOptions(reply string) WriteBehindOptions {
+	return WriteBehindOptions{
+		Prefixes:     []string{"metrics:"},
+		Interval:     time.Hour,
+		FlushKeys:    100,
+		MaxPending:   100,
+		Reply:        reply,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	}
+}
+
+func startWriteBehind(t *testing.T, upstream string, opts WriteBehindOptions) *WriteBehind {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	w := NewWriteBehind(zap.NewNop(), sd, newTestServer(t, upstream, 2), opts)
+	go w.Run()
+	return w
+}
+
+func incrCommand(key string) *redis.Message {
+	return redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("INCR")), redis.NewBulkBytes([]byte(key))})
+}
+
+func intReply(n int) string {
+	return ":" + strconv.Itoa(n) + " \\r\\n "
+}
+
+func TestWriteBehindQueued(t *testing.T) {
+	c, upstream := newWriteBehindUpstream(t, map[string]int64{})
+	w := startWriteBehind(t, upstream.Address(), writeBehindOptions(WriteBehindReplyQueued))
+
+	client := runTestConnection(t, upstream.Address(), Options{WriteBehind: w})
+	defer func() { _ = client.Close() }()
+	actual := roundTripStrings(t, client, 8,
+		respCommand("GET", string(PipelineSignalStartKey)),
+		respCommand("INCR", "metrics:a"),
+		respCommand("INCR", "metrics:a"),
+		respCommand("INCRBY", "metrics:a", "5"),
+		respCommand("HINCRBY", "metrics:h", "f", "2"),
+		respCommand("INCR", "other"),
+		respCommand("GET", "metrics:a"),
+		respCommand("GET", string(PipelineSignalEndKey)),
+	)
+	assert.Equal(t, []string{"$-1 \\r\\n ", intReply(0), intReply(0), intReply(0), intReply(0), intReply(1), "$1 \\r\\n 0 \\r\\n ", "$-1 \\r\\n "}, actual,
+		"absorbed increments are acknowledged with 0, and reads see the upstream value until a flush")
+	assert.Equal(t, []string{"INCR other", "GET metrics:a"}, c.Received())
+	assert.Equal(t, 2, w.Pending())
+
+	assert.NoError(t, w.Close(context.Background()))
+	assert.ElementsMatch(t, []string{"INCR other", "GET metrics:a", "INCRBY metrics:a 7", "HINCRBY metrics:h f 2"}, c.Received())
+	assert.Equal(t, int64(7), c.values["metrics:a"])
+	assert.Equal(t, int64(2), c.values["metrics:h/f"])
+	assert.Equal(t, 0, w.Pending())
+}
+
+func TestWriteBehindTotal(t *testing.T) {
+	c, upstream := newWriteBehindUpstream(t, map[string]int64{"metrics:a": 10})
+	w := startWriteBehind(t, upstream.Address(), writeBehindOptions(WriteBehindReplyTotal))
+
+	client := runTestConnection(t, upstream.Address(), Options{WriteBehind: w})
+	defer func() { _ = client.Close() }()
+	// the first increment is forwarded to learn the counter's value
+	assert.Equal(t, []string{intReply(12)}, roundTripStrings(t, client, 1, respCommand("INCRBY", "metrics:a", "2")))
+	assert.Equal(t, []string{intReply(13)}, roundTripStrings(t, client, 1, respCommand("INCR", "metrics:a")))
+	assert.Equal(t, []string{intReply(18)}, roundTripStrings(t, client, 1, respCommand("INCRBY", "metrics:a", "5")))
+
+	// another client's increment shows up in the totals once flushed
+	c.Lock()
+	c.values["metrics:a"] += 100
+	c.Unlock()
+	assert.NoError(t, w.flush(context.Background()))
+	assert.Equal(t, []string{intReply(119)}, roundTripStrings(t, client, 1, respCommand("INCR", "metrics:a")))
+
+	assert.NoError(t, w.Close(context.Background()))
+	assert.Equal(t, []string{"INCRBY metrics:a 2", "INCRBY metrics:a 6", "INCRBY metrics:a 1"}, c.Received())
+	assert.Equal(t, int64(119), c.values["metrics:a"])
+}
+
+func TestWriteBehindFlushKeys(t *testing.T) {
+	c, upstream := newWriteBehindUpstream(t, map[string]int64{})
+	opts := writeBehindOptions(WriteBehindReplyQueued)
+	opts.FlushKeys = 2
+	w := startWriteBehind(t, upstream.Address(), opts)
+	defer func() { _ = w.Close(context.Background()) }()
+
+	assert.NotNil(t, w.Absorb("INCR", incrCommand("metrics:a")))
+	assert.NotNil(t, w.Absorb("INCR", incrCommand("metrics:a")))
+	assert.Empty(t, c.Received())
+	assert.NotNil(t, w.Absorb("INCR", incrCommand("metrics:b")))
+	assert.Eventually(t, func() bool { return len(c.Received()) == 2 }, time.Second, 5*time.Millisecond,
+		"pending counters reaching FlushKeys flush without waiting for the interval")
+	assert.ElementsMatch(t, []string{"INCRBY metrics:a 2", "INCRBY metrics:b 1"}, c.Received())
+}
+
+func TestWriteBehindFull(t *testing.T) {
+	_, upstream := newWriteBehindUpstream(t, map[string]int64{})
+	opts := writeBehindOptions(WriteBehindReplyQueued)
+	opts.FlushKeys, opts.MaxPending = 1, 1
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	w := NewWriteBehind(zap.NewNop(), sd, newTestServer(t, upstream.Address(), 1), opts)
+
+	assert.NotNil(t, w.Absorb("INCR", incrCommand("metrics:a")))
+	assert.NotNil(t, w.Absorb("INCR", incrCommand("metrics:a")), "a pending counter keeps absorbing")
+	assert.Nil(t, w.Absorb("INCR", incrCommand("metrics:b")), "other counters are forwarded while the queue is full")
+	assert.Nil(t, w.Absorb("INCR", incrCommand("other:a")), "keys outside the prefixes are never absorbed")
+	assert.Nil(t, w.Absorb("INCRBY", redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("INCRBY")), redis.NewBulkBytes([]byte("metrics:a")), redis.NewBulkBytes([]byte("x"))})),
+		"malformed increments are forwarded for the upstream to reject")
+}
+
+func TestWriteBehindFlushErrors(t *testing.T) {
+	c, upstream := newWriteBehindUpstream(t, map[string]int64{})
+	loading := true
+	c.reply = func(args []string) *redis.Message {
+		if args[1] == "metrics:list" {
+			return redis.NewErrorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		if loading {
+			loading = false
+			return redis.NewErrorf("LOADING Redis is loading the dataset in memory")
+		}
+		return nil
+	}
+	w := startWriteBehind(t, upstream.Address(), writeBehindOptions(WriteBehindReplyQueued))
+	w.Absorb("INCR", incrCommand("metrics:list"))
+	w.Absorb("INCR", incrCommand("metrics:a"))
+	assert.NoError(t, w.flush(context.Background()))
+	assert.Equal(t, 1, w.Pending(), "rejected increments are dropped, and transient errors requeued")
+	assert.NoError(t, w.Close(context.Background()))
+	assert.Equal(t, int64(1), c.values["metrics:a"])
+	assert.Equal(t, 0, w.Pending())
+}
+
+func TestWriteBehindCloseUnavailable(t *testing.T) {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_ = li.Close()
+	opts := writeBehindOptions(WriteBehindReplyQueued)
+	opts.Interval = 10 * time.Millisecond
+	w := startWriteBehind(t, li.Addr().String(), opts)
+	w.Absorb("INCR", incrCommand("metrics:a"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = w.Close(ctx)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "write-behind increments of 1 counters were not flushed")
+	}
+	assert.Equal(t, 1, w.Pending(), "unflushed increments are kept, and logged")
+}
@@ -0,0 +1,286 @@
+// Package workload drives a synthetic redis workload over raw connections and
+// measures its throughput and latency. It is used by the bench subcommand and
+// PROXY BENCH, and can drive soak tests.
+package workload
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// Commands are the commands a workload mix can contain
+var Commands = map[string]bool{"GET": true, "SET": true, "INCR": true, "DEL": true, "PING": true}
+
+var (
+	pipelineStart = []byte("🔜")
+	pipelineEnd   = []byte("🔚")
+)
+
+type Config struct {
+	// Mix weights the commands sent, e.g. {"GET": 80, "SET": 20}
+	Mix         map[string]int
+	ValueSize   int
+	Keyspace    int
+	Pipeline    int
+	Concurrency int
+	Duration    time.Duration
+	// Signals wraps pipelines in the signal keys redisbetween expects. Disable it
+	// when talking to redis directly.
+	Signals bool
+}
+
+// DefaultConfig is a read heavy workload of small values
+func DefaultConfig() Config {
+	return Config{
+		Mix:         map[string]int{"GET": 80, "SET": 20},
+		ValueSize:   64,
+		Keyspace:    10000,
+		Pipeline:    1,
+		Concurrency: 8,
+		Duration:    5 * time.Second,
+		Signals:     true,
+	}
+}
+
+// ParseMix parses a mix like "get:80,set:20"
+func ParseMix(s string) (map[string]int, error) {
+	mix := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, ":", 2)
+		cmd := strings.ToUpper(strings.TrimSpace(kv[0]))
+		if !Commands[cmd] {
+			return nil, fmt.Errorf("unsupported command in mix: %s", kv[0])
+		}
+		weight := 1
+		if len(kv) == 2 {
+			w, err := strconv.Atoi(kv[1])
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("invalid weight in mix: %s", part)
+			}
+			weight = w
+		}
+		mix[cmd] += weight
+	}
+	return mix, nil
+}
+
+// Result summarizes a run. Latencies are per round trip, which is a whole pipeline
+// when Pipeline is more than 1.
+type Result struct {
+	Target     string        `json:"target"`
+	Ops        int64         `json:"ops"`
+	Errors     int64         `json:"errors"`
+	Duration   time.Duration `json:"duration_ns"`
+	Throughput float64       `json:"ops_per_second"`
+	P50        time.Duration `json:"p50_ns"`
+	P90        time.Duration `json:"p90_ns"`
+	P99        time.Duration `json:"p99_ns"`
+	P999       time.Duration `json:"p999_ns"`
+	Max        time.Duration `json:"max_ns"`
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%-10s %10d ops %12.0f ops/s  p50 %-10v p90 %-10v p99 %-10v p99.9 %-10v max %-10v errors %d",
+		r.Target, r.Ops, r.Throughput, r.P50, r.P90, r.P99, r.P999, r.Max, r.Errors)
+}
+
+// Run drives the workload over Concurrency connections opened with dial until
+// Duration passes or ctx is done
+func Run(ctx context.Context, target string, dial func() (net.Conn, error), cfg Config) (Result, error) {
+	if cfg.Pipeline < 1 {
+		cfg.Pipeline = 1
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Keyspace < 1 {
+		cfg.Keyspace = 1
+	}
+	if cfg.ValueSize < 0 {
+		cfg.ValueSize = 0
+	}
+	commands, err := weighted(cfg.Mix)
+	if err != nil {
+		return Result{}, err
+	}
+
+	conns := make([]net.Conn, cfg.Concurrency)
+	for i := range conns {
+		if conns[i], err = dial(); err != nil {
+			for _, c := range conns[:i] {
+				_ = c.Close()
+			}
+			return Result{}, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	workers := make([]worker, cfg.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range workers {
+		wg.Add(1)
+		go func(w *worker, conn net.Conn, seed int64) {
+			defer wg.Done()
+			defer func() { _ = conn.Close() }()
+			// unblock a round trip still waiting on a reply when the run ends
+			go func() {
+				<-ctx.Done()
+				_ = conn.SetDeadline(time.Now())
+			}()
+			w.run(ctx, conn, cfg, commands, rand.New(rand.NewSource(seed))) // #nosec
+		}(&workers[i], conns[i], int64(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	res := Result{Target: target, Duration: elapsed}
+	var latencies []time.Duration
+	for _, w := range workers {
+		if w.err != nil {
+			return res, w.err
+		}
+		res.Ops += w.ops
+		res.Errors += w.errors
+		latencies = append(latencies, w.latencies...)
+	}
+	res.Throughput = float64(res.Ops) / elapsed.Seconds()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	res.P50 = percentile(latencies, 0.5)
+	res.P90 = percentile(latencies, 0.9)
+	res.P99 = percentile(latencies, 0.99)
+	res.P999 = percentile(latencies, 0.999)
+	if len(latencies) > 0 {
+		res.Max = latencies[len(latencies)-1]
+	}
+	return res, nil
+}
+
+type worker struct {
+	ops       int64
+	errors    int64
+	latencies []time.Duration
+	err       error
+}
+
+func (w *worker) run(ctx context.Context, conn net.Conn, cfg Config, commands []string, rnd *rand.Rand) {
+	value := make([]byte, cfg.ValueSize)
+	for i := range value {
+		value[i] = 'a' + byte(rnd.Intn(26))
+	}
+	enc := redis.NewEncoder(conn)
+	dec := redis.NewDecoderBuffer(bufio.NewReader(conn))
+	wrap := cfg.Signals && cfg.Pipeline > 1
+
+	batch := make([]*redis.Message, 0, cfg.Pipeline+2)
+	for ctx.Err() == nil {
+		batch = batch[:0]
+		if wrap {
+			batch = append(batch, command("GET", pipelineStart))
+		}
+		for i := 0; i < cfg.Pipeline; i++ {
+			batch = append(batch, next(commands[rnd.Intn(len(commands))], rnd, cfg.Keyspace, value))
+		}
+		if wrap {
+			batch = append(batch, command("GET", pipelineEnd))
+		}
+
+		start := time.Now()
+		for _, m := range batch {
+			if err := enc.Encode(m, false); err != nil {
+				w.fail(ctx, err)
+				return
+			}
+		}
+		if err := enc.Flush(); err != nil {
+			w.fail(ctx, err)
+			return
+		}
+		for range batch {
+			m, err := dec.Decode()
+			if err != nil {
+				w.fail(ctx, err)
+				return
+			}
+			if m.IsError() {
+				w.errors++
+			}
+		}
+		w.latencies = append(w.latencies, time.Since(start))
+		w.ops += int64(cfg.Pipeline)
+	}
+}
+
+// fail records err unless the run was already over
+func (w *worker) fail(ctx context.Context, err error) {
+	if ctx.Err() == nil {
+		w.err = err
+	}
+}
+
+func next(cmd string, rnd *rand.Rand, keyspace int, value []byte) *redis.Message {
+	key := []byte("bench:" + strconv.Itoa(rnd.Intn(keyspace)))
+	switch cmd {
+	case "SET":
+		return command(cmd, key, value)
+	case "PING":
+		return command(cmd)
+	default:
+		return command(cmd, key)
+	}
+}
+
+func command(name string, args ...[]byte) *redis.Message {
+	mm := []*redis.Message{redis.NewBulkBytes([]byte(name))}
+	for _, a := range args {
+		mm = append(mm, redis.NewBulkBytes(a))
+	}
+	return redis.NewArray(mm)
+}
+
+func weighted(mix map[string]int) ([]string, error) {
+	var commands []string
+	names := make([]string, 0, len(mix))
+	for cmd := range mix {
+		names = append(names, cmd)
+	}
+	sort.Strings(names)
+	for _, cmd := range names {
+		if !Commands[cmd] {
+			return nil, fmt.Errorf("unsupported command in mix: %s", cmd)
+		}
+		for i := 0; i < mix[cmd]; i++ {
+			commands = append(commands, cmd)
+		}
+	}
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("empty command mix")
+	}
+	return commands, nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
@@ -0,0 +1,142 @@
+package workload
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// serve answers every command with +OK, except INCR which gets an error, and
+// records the commands it saw
+func serve(t *testing.T) (addr string, seen func() map[string]int, stop func()) {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				d := redis.NewDecoder(conn)
+				for {
+					m, err := d.Decode()
+					if err != nil {
+						return
+					}
+					cmd := string(m.Array[0].Value)
+					mu.Lock()
+					counts[cmd]++
+					mu.Unlock()
+					reply := redis.NewString([]byte("OK"))
+					if cmd == "INCR" {
+						reply = redis.NewErrorf("ERR value is not an integer or out of range")
+					}
+					if redis.Encode(conn, reply) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return li.Addr().String(), func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		c := make(map[string]int, len(counts))
+		for k, v := range counts {
+			c[k] = v
+		}
+		return c
+	}, func() { _ = li.Close() }
+}
+
+func TestRun(t *testing.T) {
+	addr, seen, stop := serve(t)
+	defer stop()
+
+	cfg := Config{
+		Mix:         map[string]int{"SET": 1, "INCR": 1},
+		ValueSize:   16,
+		Keyspace:    10,
+		Pipeline:    4,
+		Concurrency: 3,
+		Duration:    200 * time.Millisecond,
+		Signals:     true,
+	}
+	res, err := Run(context.Background(), "test", func() (net.Conn, error) { return net.Dial("tcp", addr) }, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", res.Target)
+	assert.True(t, res.Ops > 0)
+	assert.Equal(t, int64(0), res.Ops%4, "ops are counted per pipelined command")
+	assert.True(t, res.Errors > 0 && res.Errors < res.Ops)
+	assert.True(t, res.Throughput > 0)
+	assert.True(t, res.P50 <= res.P90 && res.P90 <= res.P99 && res.P99 <= res.P999 && res.P999 <= res.Max)
+	assert.True(t, res.Duration >= cfg.Duration)
+
+	counts := seen()
+	assert.Equal(t, []string{"GET", "INCR", "SET"}, keys(counts), "pipelines are wrapped in signal GETs")
+	assert.True(t, int64(counts["SET"]+counts["INCR"]) >= res.Ops)
+}
+
+func TestRunWithoutSignals(t *testing.T) {
+	addr, seen, stop := serve(t)
+	defer stop()
+
+	cfg := DefaultConfig()
+	cfg.Mix = map[string]int{"PING": 1}
+	cfg.Pipeline = 3
+	cfg.Duration = 50 * time.Millisecond
+	cfg.Signals = false
+	res, err := Run(context.Background(), "upstream", func() (net.Conn, error) { return net.Dial("tcp", addr) }, cfg)
+	assert.NoError(t, err)
+	assert.True(t, res.Ops > 0)
+	assert.Equal(t, int64(0), res.Errors)
+	assert.Equal(t, []string{"PING"}, keys(seen()))
+}
+
+func TestRunDialError(t *testing.T) {
+	_, err := Run(context.Background(), "test", func() (net.Conn, error) { return net.Dial("tcp", "127.0.0.1:1") }, DefaultConfig())
+	assert.Error(t, err)
+}
+
+func TestParseMix(t *testing.T) {
+	mix, err := ParseMix("get:80, SET:20,ping")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"GET": 80, "SET": 20, "PING": 1}, mix)
+
+	_, err = ParseMix("flushall:1")
+	assert.EqualError(t, err, "unsupported command in mix: flushall")
+	_, err = ParseMix("get:x")
+	assert.EqualError(t, err, "invalid weight in mix: get:x")
+	_, err = weighted(map[string]int{"GET": 0})
+	assert.EqualError(t, err, "empty command mix")
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i))
+	}
+	assert.Equal(t, time.Duration(50), percentile(sorted, 0.5))
+	assert.Equal(t, time.Duration(99), percentile(sorted, 0.99))
+	assert.Equal(t, time.Duration(100), percentile(sorted, 0.999))
+	assert.Equal(t, time.Duration(0), percentile(nil, 0.5))
+}
+
+func keys(m map[string]int) []string {
+	var kk []string
+	for _, k := range []string{"DEL", "GET", "INCR", "PING", "SET"} {
+		if m[k] > 0 {
+			kk = append(kk, k)
+		}
+	}
+	return kk
+}
@@ -0,0 +1,68 @@
+package memwatch
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup filesystem is mounted
+var cgroupRoot = "/sys/fs/cgroup"
+
+// unlimited is the smallest limit taken to mean there is none, cgroup v1
+// reporting the largest page aligned int64 rather than "max"
+const unlimited = 1 << 62
+
+// readCgroup reads the working set and memory limit of the process's cgroup,
+// trying cgroup v2 then v1, as they are seen from inside a container
+func readCgroup() (usage, limit uint64, ok bool) {
+	if usage, limit, ok = readCgroupFiles(cgroupRoot, "memory.current", "memory.max", "inactive_file"); ok {
+		return usage, limit, ok
+	}
+	return readCgroupFiles(filepath.Join(cgroupRoot, "memory"), "memory.usage_in_bytes", "memory.limit_in_bytes", "total_inactive_file")
+}
+
+func readCgroupFiles(dir, usageFile, limitFile, inactiveStat string) (usage, limit uint64, ok bool) {
+	limit, ok = readUint(filepath.Join(dir, limitFile))
+	if !ok || limit >= unlimited {
+		return 0, 0, false
+	}
+	usage, ok = readUint(filepath.Join(dir, usageFile))
+	if !ok {
+		return 0, 0, false
+	}
+	if inactive, ok := readStat(filepath.Join(dir, "memory.stat"), inactiveStat); ok && inactive < usage {
+		usage -= inactive
+	}
+	return usage, limit, true
+}
+
+func readUint(path string) (uint64, bool) {
+	b, err := ioutil.ReadFile(path) // #nosec
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(string(bytes.TrimSpace(b)), 10, 64)
+	return n, err == nil
+}
+
+func readStat(path, key string) (uint64, bool) {
+	f, err := os.Open(path) // #nosec
+	if err != nil {
+		return 0, false
+	}
+	defer func() { _ = f.Close() }()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, err := strconv.ParseUint(fields[1], 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
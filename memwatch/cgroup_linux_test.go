@@ -0,0 +1,52 @@
+package memwatch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCgroup(t *testing.T, dir string, files map[string]string) {
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	for name, content := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+}
+
+func TestReadCgroup(t *testing.T) {
+	old := cgroupRoot
+	defer func() { cgroupRoot = old }()
+	for name, tc := range map[string]struct {
+		dir          string
+		files        map[string]string
+		usage, limit uint64
+		ok           bool
+	}{
+		"v2": {"", map[string]string{
+			"memory.current": "1000\n",
+			"memory.max":     "4000\n",
+			"memory.stat":    "anon 600\nfile 400\ninactive_file 300\n",
+		}, 700, 4000, true},
+		"v2 unlimited": {"", map[string]string{"memory.current": "1000\n", "memory.max": "max\n"}, 0, 0, false},
+		"v1": {"memory", map[string]string{
+			"memory.usage_in_bytes": "2000\n",
+			"memory.limit_in_bytes": "8000\n",
+			"memory.stat":           "cache 500\ninactive_file 100\ntotal_inactive_file 400\n",
+		}, 1600, 8000, true},
+		"v1 unlimited": {"memory", map[string]string{"memory.usage_in_bytes": "2000\n", "memory.limit_in_bytes": "9223372036854771712\n"}, 0, 0, false},
+		"none":         {"", nil, 0, 0, false},
+	} {
+		dir, err := ioutil.TempDir("", "cgroup")
+		assert.NoError(t, err)
+		defer func() { _ = os.RemoveAll(dir) }()
+		cgroupRoot = dir
+		writeCgroup(t, filepath.Join(dir, tc.dir), tc.files)
+		usage, limit, ok := readCgroup()
+		assert.Equal(t, tc.ok, ok, name)
+		assert.Equal(t, tc.usage, usage, name)
+		assert.Equal(t, tc.limit, limit, name)
+	}
+}
@@ -0,0 +1,333 @@
+// Package memwatch keeps the process from being OOM-killed, by watching its
+// memory and telling the proxy to shed traffic as it nears its limits.
+package memwatch
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultInterval is how often memory is read
+	DefaultInterval = 250 * time.Millisecond
+	// DefaultShedBytes is the size above which requests are shed over the soft
+	// limit
+	DefaultShedBytes = 64 * 1024
+
+	// softGCPercent is GOGC while over the soft limit, collecting more often to
+	// keep the heap closer to what is live
+	softGCPercent = 25
+	// freeInterval is the least time between the forced collections that return
+	// memory to the OS while over the soft limit
+	freeInterval = time.Second
+)
+
+// State is how close the process is to running out of memory
+type State int32
+
+const (
+	// Normal is below the soft limit
+	Normal State = iota
+	// Soft is over the soft limit: large, non-critical requests are shed
+	Soft
+	// Hard is over the hard limit: new connections are refused and every
+	// non-critical request is shed
+	Hard
+)
+
+func (s State) String() string {
+	switch s {
+	case Soft:
+		return "soft"
+	case Hard:
+		return "hard"
+	}
+	return "normal"
+}
+
+// Limit is a memory threshold, either absolute Bytes or a Fraction of the
+// cgroup's memory limit. The zero Limit is disabled.
+type Limit struct {
+	Bytes    uint64
+	Fraction float64
+}
+
+// ParseLimit parses a number of bytes, with an optional k, m or g suffix for
+// powers of 1024, or a fraction of the cgroup limit between 0 and 1, written
+// with a decimal point. The empty string is the zero Limit.
+func ParseLimit(s string) (Limit, error) {
+	if s == "" {
+		return Limit{}, nil
+	}
+	if strings.Contains(s, ".") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f <= 0 || f > 1 {
+			return Limit{}, fmt.Errorf("invalid memory limit %q: fractions must be between 0 and 1", s)
+		}
+		return Limit{Fraction: f}, nil
+	}
+	n, unit := s, uint64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		unit = 1 << 10
+	case "m":
+		unit = 1 << 20
+	case "g":
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		n = s[:len(s)-1]
+	}
+	b, err := strconv.ParseUint(n, 10, 64)
+	if err != nil || b == 0 {
+		return Limit{}, fmt.Errorf("invalid memory limit %q", s)
+	}
+	return Limit{Bytes: b * unit}, nil
+}
+
+func (l Limit) IsZero() bool {
+	return l == Limit{}
+}
+
+func (l Limit) String() string {
+	if l.Fraction > 0 {
+		return strconv.FormatFloat(l.Fraction, 'f', -1, 64)
+	}
+	return strconv.FormatUint(l.Bytes, 10)
+}
+
+// Resolve returns the limit in bytes, given the cgroup's limit, which is 0 if
+// none was detected
+func (l Limit) Resolve(cgroupLimit uint64) (uint64, error) {
+	if l.Fraction == 0 {
+		return l.Bytes, nil
+	}
+	if cgroupLimit == 0 {
+		return 0, fmt.Errorf("memory limit %v is a fraction of the cgroup limit, but none was detected", l)
+	}
+	return uint64(l.Fraction * float64(cgroupLimit)), nil
+}
+
+// Usage is a reading of the process's memory
+type Usage struct {
+	// Go is the memory the Go runtime holds from the OS
+	Go uint64
+	// Cgroup is the working set of the process's cgroup, its usage less the
+	// page cache the kernel would reclaim before OOM-killing it. It and
+	// CgroupLimit are 0 outside of a cgroup with a memory limit.
+	Cgroup      uint64
+	CgroupLimit uint64
+}
+
+// Used is the larger of the two readings, which is what the limits are
+// compared to
+func (u Usage) Used() uint64 {
+	if u.Cgroup > u.Go {
+		return u.Cgroup
+	}
+	return u.Go
+}
+
+// ReadUsage reads the process's memory
+func ReadUsage() Usage {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	u := Usage{Go: ms.Sys - ms.HeapReleased}
+	u.Cgroup, u.CgroupLimit, _ = readCgroup()
+	return u
+}
+
+// Options configures a Watchdog. Either limit may be zero, disabling it.
+type Options struct {
+	Soft      Limit
+	Hard      Limit
+	ShedBytes int
+	Interval  time.Duration
+}
+
+// Watchdog reads memory every interval, moving between states as usage crosses
+// the limits. Usage has to recede 5% below a limit to leave its state, so that
+// it doesn't flap around the limit. Every method is safe to call on a nil
+// Watchdog, which is always Normal.
+type Watchdog struct {
+	log       *zap.Logger
+	sd        *statsd.Client
+	soft      uint64
+	hard      uint64
+	shedBytes int
+	interval  time.Duration
+	read      func() Usage
+	free      func()
+
+	state     int32
+	freeing   int32
+	mu        sync.Mutex
+	gcPercent int
+	freed     time.Time
+}
+
+// New resolves the limits against the detected cgroup limit
+func New(log *zap.Logger, sd *statsd.Client, opts Options) (*Watchdog, error) {
+	_, limit, _ := readCgroup()
+	return newWatchdog(log, sd, opts, limit, ReadUsage)
+}
+
+func newWatchdog(log *zap.Logger, sd *statsd.Client, opts Options, cgroupLimit uint64, read func() Usage) (*Watchdog, error) {
+	soft, err := opts.Soft.Resolve(cgroupLimit)
+	if err != nil {
+		return nil, err
+	}
+	hard, err := opts.Hard.Resolve(cgroupLimit)
+	if err != nil {
+		return nil, err
+	}
+	if soft > 0 && hard > 0 && soft >= hard {
+		return nil, fmt.Errorf("memory soft limit %d must be below the hard limit %d", soft, hard)
+	}
+	if soft == 0 && hard == 0 {
+		return nil, errors.New("memory watchdog needs a soft or a hard limit")
+	}
+	if opts.ShedBytes <= 0 {
+		opts.ShedBytes = DefaultShedBytes
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	log.Info("Watching memory", zap.Uint64("soft_limit", soft), zap.Uint64("hard_limit", hard), zap.Uint64("cgroup_limit", cgroupLimit))
+	return &Watchdog{
+		log:       log,
+		sd:        sd,
+		soft:      soft,
+		hard:      hard,
+		shedBytes: opts.ShedBytes,
+		interval:  opts.Interval,
+		read:      read,
+		free:      debug.FreeOSMemory,
+	}, nil
+}
+
+// Run checks memory every interval until quit is closed
+func (w *Watchdog) Run(quit chan interface{}) {
+	if w == nil {
+		return
+	}
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+			w.Check()
+		}
+	}
+}
+
+// Check reads memory once, changing state if a limit was crossed. Over the
+// soft limit it collects garbage more aggressively, which also empties the
+// sync.Pools that buffers are recycled through, and returns what it freed to
+// the OS.
+func (w *Watchdog) Check() State {
+	if w == nil {
+		return Normal
+	}
+	u := w.read()
+	used := u.Used()
+	metrics.MemoryUsage.Set(w.sd, float64(u.Go), "go")
+	if u.CgroupLimit > 0 {
+		metrics.MemoryUsage.Set(w.sd, float64(u.Cgroup), "cgroup")
+	}
+	if w.soft > 0 {
+		metrics.MemoryLimit.Set(w.sd, float64(w.soft), "soft")
+	}
+	if w.hard > 0 {
+		metrics.MemoryLimit.Set(w.sd, float64(w.hard), "hard")
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	prev := w.State()
+	next := w.next(prev, used)
+	metrics.MemoryState.Set(w.sd, float64(next))
+	if next != prev {
+		atomic.StoreInt32(&w.state, int32(next))
+		metrics.MemoryTransitions.Incr(w.sd, prev.String(), next.String())
+		log := w.log.With(zap.String("from", prev.String()), zap.String("to", next.String()), zap.Uint64("used", used),
+			zap.Uint64("go", u.Go), zap.Uint64("cgroup", u.Cgroup))
+		if next > prev {
+			log.Warn("Memory limit exceeded, shedding traffic")
+		} else {
+			log.Info("Memory usage receded")
+		}
+		if prev == Normal {
+			w.gcPercent = debug.SetGCPercent(softGCPercent)
+		} else if next == Normal {
+			debug.SetGCPercent(w.gcPercent)
+		}
+	}
+	// a forced collection can take a while under load, during which the
+	// watchdog keeps checking
+	if next != Normal && time.Since(w.freed) >= freeInterval && atomic.CompareAndSwapInt32(&w.freeing, 0, 1) {
+		w.freed = time.Now()
+		go func() {
+			defer atomic.StoreInt32(&w.freeing, 0)
+			w.free()
+		}()
+	}
+	return next
+}
+
+func (w *Watchdog) next(s State, used uint64) State {
+	switch {
+	case w.hard > 0 && used >= w.hard:
+		return Hard
+	case s == Hard && w.hard > 0 && used >= recede(w.hard):
+		return Hard
+	case w.soft > 0 && used >= w.soft:
+		return Soft
+	case s >= Soft && w.soft > 0 && used >= recede(w.soft):
+		return Soft
+	}
+	return Normal
+}
+
+func recede(limit uint64) uint64 {
+	return limit - limit/20
+}
+
+// State is the state as of the last Check
+func (w *Watchdog) State() State {
+	if w == nil {
+		return Normal
+	}
+	return State(atomic.LoadInt32(&w.state))
+}
+
+// Shed returns whether a request of size bytes should be failed fast rather than
+// forwarded. Critical requests are never shed.
+func (w *Watchdog) Shed(size int, critical bool) bool {
+	switch w.State() {
+	case Soft:
+		return !critical && size > w.shedBytes
+	case Hard:
+		return !critical
+	}
+	return false
+}
+
+// Refuse returns whether new client connections should be closed as soon as
+// they are accepted
+func (w *Watchdog) Refuse() bool {
+	return w.State() == Hard
+}
@@ -0,0 +1,100 @@
+package memwatch
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestParseLimit(t *testing.T) {
+	for s, expected := range map[string]Limit{
+		"":        {},
+		"1048576": {Bytes: 1 << 20},
+		"512k":    {Bytes: 512 << 10},
+		"256M":    {Bytes: 256 << 20},
+		"2g":      {Bytes: 2 << 30},
+		"0.8":     {Fraction: 0.8},
+		"1.0":     {Fraction: 1},
+	} {
+		l, err := ParseLimit(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, l, s)
+	}
+	for _, s := range []string{"0", "-1", "lots", "1.5", "0.0", "1t", "g"} {
+		_, err := ParseLimit(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	b, err := Limit{Bytes: 100}.Resolve(0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), b)
+	b, err = Limit{Fraction: 0.75}.Resolve(1000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(750), b)
+	_, err = Limit{Fraction: 0.75}.Resolve(0)
+	assert.EqualError(t, err, "memory limit 0.75 is a fraction of the cgroup limit, but none was detected")
+}
+
+func TestInvalidWatchdog(t *testing.T) {
+	_, err := newWatchdog(zap.NewNop(), nil, Options{Soft: Limit{Fraction: 0.9}, Hard: Limit{Bytes: 800}}, 1000, nil)
+	assert.EqualError(t, err, "memory soft limit 900 must be below the hard limit 800")
+	_, err = newWatchdog(zap.NewNop(), nil, Options{}, 1000, nil)
+	assert.EqualError(t, err, "memory watchdog needs a soft or a hard limit")
+}
+
+func TestTransitions(t *testing.T) {
+	var usage Usage
+	w, err := newWatchdog(zap.NewNop(), nil, Options{Soft: Limit{Fraction: 0.5}, Hard: Limit{Fraction: 0.8}, ShedBytes: 10}, 1000, func() Usage { return usage })
+	assert.NoError(t, err)
+	var freed int32
+	w.free = func() { atomic.AddInt32(&freed, 1) }
+	defer debug.SetGCPercent(100)
+
+	for _, step := range []struct {
+		goUsage, cgroup uint64
+		expected        State
+	}{
+		{100, 0, Normal},
+		{499, 0, Normal},
+		{100, 500, Soft}, // the larger reading counts
+		{480, 0, Soft},   // within 5% of the soft limit
+		{474, 0, Normal}, // receded
+		{900, 0, Hard},   // straight past the soft limit
+		{770, 0, Hard},   // within 5% of the hard limit
+		{700, 0, Soft},   // receded below the hard limit only
+		{0, 0, Normal},
+	} {
+		usage = Usage{Go: step.goUsage, Cgroup: step.cgroup, CgroupLimit: 1000}
+		assert.Equal(t, step.expected, w.Check(), step)
+		assert.Equal(t, step.expected, w.State(), step)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&freed), "collections are forced at most once a second")
+
+	usage = Usage{Go: 600}
+	w.Check()
+	assert.False(t, w.Shed(10, false))
+	assert.True(t, w.Shed(11, false))
+	assert.False(t, w.Shed(11, true), "critical requests are never shed")
+	assert.False(t, w.Refuse())
+	usage = Usage{Go: 800}
+	w.Check()
+	assert.True(t, w.Shed(1, false))
+	assert.False(t, w.Shed(1, true))
+	assert.True(t, w.Refuse())
+}
+
+func TestNilWatchdog(t *testing.T) {
+	var w *Watchdog
+	assert.Equal(t, Normal, w.Check())
+	assert.Equal(t, Normal, w.State())
+	assert.False(t, w.Shed(1<<30, false))
+	assert.False(t, w.Refuse())
+	w.Run(nil)
+}
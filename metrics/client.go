@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+const (
+	// resolveRetryMin and resolveRetryMax bound the backoff between attempts to
+	// resolve the statsd address
+	resolveRetryMin = 100 * time.Millisecond
+	resolveRetryMax = 30 * time.Second
+	// resolveTimeout is how long one attempt may take
+	resolveTimeout = 10 * time.Second
+)
+
+// Writer sends metrics to a statsd address over UDP, resolving the address in
+// the background, with retries, rather than when the client is made. Until the
+// address resolves, metrics are dropped and counted. Writes never block: they
+// come from the client's own sender goroutine, and a UDP write either goes out
+// or fails.
+type Writer struct {
+	addr    string
+	dial    func(ctx context.Context, addr string) (net.Conn, error)
+	conn    atomic.Value // net.Conn
+	dropped int64
+	ready   chan struct{}
+
+	mu     sync.Mutex
+	quit   chan struct{}
+	closed bool
+}
+
+// NewWriter starts resolving addr, a host:port, in the background
+func NewWriter(addr string) *Writer {
+	return newWriter(addr, func(ctx context.Context, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "udp", addr)
+	})
+}
+
+func newWriter(addr string, dial func(ctx context.Context, addr string) (net.Conn, error)) *Writer {
+	w := &Writer{addr: addr, dial: dial, ready: make(chan struct{}), quit: make(chan struct{})}
+	go w.resolve()
+	return w
+}
+
+func (w *Writer) resolve() {
+	backoff := resolveRetryMin
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		conn, err := w.dial(ctx, w.addr)
+		cancel()
+		if err == nil {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if w.closed {
+				_ = conn.Close()
+				return
+			}
+			w.conn.Store(conn)
+			close(w.ready)
+			return
+		}
+		select {
+		case <-w.quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > resolveRetryMax {
+			backoff = resolveRetryMax
+		}
+	}
+}
+
+// Write sends a payload, or drops it while the address is unresolved
+func (w *Writer) Write(data []byte) (int, error) {
+	conn, ok := w.conn.Load().(net.Conn)
+	if !ok {
+		atomic.AddInt64(&w.dropped, 1)
+		return len(data), nil
+	}
+	return conn.Write(data)
+}
+
+// SetWriteTimeout is a no-op, since UDP writes don't block
+func (w *Writer) SetWriteTimeout(time.Duration) error {
+	return nil
+}
+
+// Close stops resolving, and closes the connection if there is one
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.quit)
+	if conn, ok := w.conn.Load().(net.Conn); ok {
+		return conn.Close()
+	}
+	return nil
+}
+
+// Ready is closed once the address has resolved
+func (w *Writer) Ready() <-chan struct{} {
+	return w.ready
+}
+
+// Dropped returns how many payloads have been dropped while the address was
+// unresolved
+func (w *Writer) Dropped() int64 {
+	return atomic.LoadInt64(&w.dropped)
+}
+
+// sharedWriter is the Writer of a client cloned from another, which leaves
+// closing it to the client it was made for
+type sharedWriter struct {
+	*Writer
+}
+
+func (sharedWriter) Close() error {
+	return nil
+}
+
+type clientWriter struct {
+	writer  *Writer
+	options []statsd.Option
+}
+
+var (
+	clientsLock sync.Mutex
+	clients     = make(map[*statsd.Client]clientWriter)
+)
+
+// NewClient makes a statsd client whose address resolves in the background, see
+// Writer. Clients of Unix socket addresses, which need no resolving, are made
+// by statsd.New, as are those without an address, which statsd.New finds in the
+// environment.
+func NewClient(addr string, options ...statsd.Option) (*statsd.Client, *Writer, error) {
+	if addr == "" || strings.HasPrefix(addr, statsd.UnixAddressPrefix) {
+		c, err := statsd.New(addr, options...)
+		return c, nil, err
+	}
+	w := NewWriter(addr)
+	c, err := statsd.NewWithWriter(w, options...)
+	if err != nil {
+		_ = w.Close()
+		return nil, nil, err
+	}
+	clientsLock.Lock()
+	clients[c] = clientWriter{writer: w, options: options}
+	clientsLock.Unlock()
+	// nothing is dropped once the address resolves, so the drops are counted
+	// then, through the client that can finally send them
+	go func() {
+		select {
+		case <-w.ready:
+			StatsdDropped.Count(c, w.Dropped())
+		case <-w.quit:
+		}
+	}()
+	return c, w, nil
+}
+
+// Clone is statsd.CloneWithExtraOptions, except that a client made by NewClient
+// shares its writer with its clones, rather than each clone resolving the
+// address again, inline
+func Clone(c *statsd.Client, options ...statsd.Option) (*statsd.Client, error) {
+	clientsLock.Lock()
+	cw, ok := clients[c]
+	clientsLock.Unlock()
+	if !ok {
+		return statsd.CloneWithExtraOptions(c, options...)
+	}
+	all := append(append([]statsd.Option(nil), cw.options...), options...)
+	clone, err := statsd.NewWithWriter(sharedWriter{cw.writer}, all...)
+	if err != nil {
+		return nil, err
+	}
+	clientsLock.Lock()
+	clients[clone] = clientWriter{writer: cw.writer, options: all}
+	clientsLock.Unlock()
+	return clone, nil
+}
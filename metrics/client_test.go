@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterResolvesInBackground(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// DNS for the statsd host answers only once released
+	release := make(chan struct{})
+	start := time.Now()
+	w := newWriter("statsd.internal:8125", func(ctx context.Context, addr string) (net.Conn, error) {
+		<-release
+		return net.Dial("udp", conn.LocalAddr().String())
+	})
+	defer func() { _ = w.Close() }()
+	sd, err := statsd.NewWithWriter(w, statsd.WithoutTelemetry())
+	assert.NoError(t, err)
+	defer func() { _ = sd.Close() }()
+	clone, err := statsd.NewWithWriter(sharedWriter{w}, statsd.WithoutTelemetry(), statsd.WithTags([]string{"upstream:a"}))
+	assert.NoError(t, err)
+
+	Counter{&Metric{Name: "example.requests", Tags: []string{}}}.Incr(sd)
+	assert.NoError(t, sd.Flush())
+	assert.NoError(t, clone.Flush())
+	assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond), "nothing waits on the address")
+	assert.Eventually(t, func() bool { return w.Dropped() == 1 }, time.Second, time.Millisecond)
+
+	close(release)
+	<-w.Ready()
+	assert.NoError(t, clone.Close(), "a clone leaves the shared writer open")
+	Counter{&Metric{Name: "example.requests", Tags: []string{}}}.Incr(sd)
+	assert.NoError(t, sd.Flush())
+	buf := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.requests:1|c", strings.TrimSpace(string(buf[:n])))
+	assert.EqualValues(t, 1, w.Dropped())
+}
+
+func TestWriterRetries(t *testing.T) {
+	attempts := make(chan struct{}, 10)
+	w := newWriter("statsd.invalid:8125", func(ctx context.Context, addr string) (net.Conn, error) {
+		attempts <- struct{}{}
+		return nil, &net.DNSError{Err: "no such host", Name: "statsd.invalid", IsNotFound: true}
+	})
+	for i := 0; i < 3; i++ {
+		select {
+		case <-attempts:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the address is resolved again after a failure")
+		}
+	}
+	assert.NoError(t, w.Close())
+	n, err := w.Write([]byte("example.requests:1|c"))
+	assert.NoError(t, err)
+	assert.Equal(t, 20, n)
+}
+
+func TestCloneSharesWriter(t *testing.T) {
+	sd, w, err := NewClient("statsd.invalid:8125", statsd.WithNamespace("redisbetween"), statsd.WithoutTelemetry())
+	assert.NoError(t, err)
+	defer func() { _ = sd.Close() }()
+	assert.NotNil(t, w)
+	clone, err := Clone(sd, statsd.WithTags([]string{"upstream:a"}), statsd.WithoutTelemetry())
+	assert.NoError(t, err)
+	defer func() { _ = clone.Close() }()
+	assert.Equal(t, "redisbetween.", clone.Namespace, "a clone keeps the options of the client it is cloned from")
+	assert.Equal(t, w, clients[clone].writer)
+
+	_, w, err = NewClient("unix:///tmp/redisbetween-statsd-test.sock")
+	assert.NoError(t, err)
+	assert.Nil(t, w, "unix sockets need no resolving")
+}
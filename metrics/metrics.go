@@ -0,0 +1,196 @@
+// Package metrics is the registry of the statsd metrics redisbetween emits. Every
+// metric is declared here once, with its type and tag keys, and emitted through
+// its declaration, so that the schema served to tooling is the list the code
+// actually uses.
+//
+// Dashboards and runbooks are built against these names. Renaming a metric or a
+// tag, or changing a type, is a breaking change: bump SchemaVersion, and keep a
+// renamed metric emitted under its old name too, with RenamedFrom, for one minor
+// release.
+package metrics
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// SchemaVersion is the version of the metric names and /stats fields. It is
+// bumped on every breaking change to either.
+const SchemaVersion = 1
+
+// Type is the statsd type of a metric
+type Type string
+
+const (
+	TypeCount     Type = "count"
+	TypeGauge     Type = "gauge"
+	TypeTiming    Type = "timing"
+	TypeHistogram Type = "histogram"
+)
+
+// Unit is what one count or sample of a metric stands for. A request is what a
+// client sends and the proxy answers at once, a single command or a whole
+// pipeline, and a command is each redis command of it, so that a pipeline of
+// 500 commands is one request and 500 commands. Timings are in milliseconds and
+// time one of their unit; counters count their unit.
+type Unit string
+
+const (
+	UnitRequest Unit = "request"
+	UnitCommand Unit = "command"
+	// UnitEvent is for metrics of things other than client traffic, such as
+	// checkouts or flushes, which the description names
+	UnitEvent Unit = "event"
+)
+
+// CommonTags are the tags of the statsd clients metrics are emitted with, which
+// depending on where a metric comes from are added to the tags it declares:
+// cluster for upstreams with a label, upstream and local for those of a
+// listener, and lane for the reserved lane's pool.
+var CommonTags = []string{"cluster", "upstream", "local", "lane"}
+
+// Metric describes one metric
+type Metric struct {
+	Name        string   `json:"name"`
+	Type        Type     `json:"type"`
+	Tags        []string `json:"tags"`
+	Description string   `json:"description"`
+	// Unit is set for every timing and histogram, and every counter of traffic
+	Unit Unit `json:"unit,omitempty"`
+	// RenamedFrom is the old name of a renamed metric, which it is also emitted
+	// under until the old name is dropped
+	RenamedFrom string `json:"renamed_from,omitempty"`
+	// Emitter is set for metrics emitted by a dependency rather than through
+	// their declaration
+	Emitter string `json:"emitter,omitempty"`
+}
+
+var registry []*Metric
+
+func register(name string, t Type, description string, tags ...string) *Metric {
+	if tags == nil {
+		tags = []string{}
+	}
+	m := &Metric{Name: name, Type: t, Tags: tags, Description: description}
+	registry = append(registry, m)
+	return m
+}
+
+// All returns every metric, in the order they are declared
+func All() []Metric {
+	all := make([]Metric, len(registry))
+	for i, m := range registry {
+		all[i] = *m
+	}
+	return all
+}
+
+// tags pairs the metric's tag keys with values, given in the same order
+func (m *Metric) tags(values []string) []string {
+	tags := make([]string, len(m.Tags))
+	for i, k := range m.Tags {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		tags[i] = k + ":" + v
+	}
+	return tags
+}
+
+// names are the names the metric is emitted under
+func (m *Metric) names() []string {
+	if m.RenamedFrom == "" {
+		return []string{m.Name}
+	}
+	return []string{m.Name, m.RenamedFrom}
+}
+
+// Counter is a count metric
+type Counter struct{ *Metric }
+
+func newCounter(name, description string, tags ...string) Counter {
+	return Counter{register(name, TypeCount, description, tags...)}
+}
+
+func (c Counter) per(u Unit) Counter {
+	c.Unit = u
+	return c
+}
+
+// Incr counts one, with values for the counter's tags
+func (c Counter) Incr(sd *statsd.Client, values ...string) {
+	tags := c.tags(values)
+	for _, name := range c.names() {
+		_ = sd.Incr(name, tags, 1)
+	}
+}
+
+// Count counts n, with values for the counter's tags
+func (c Counter) Count(sd *statsd.Client, n int64, values ...string) {
+	tags := c.tags(values)
+	for _, name := range c.names() {
+		_ = sd.Count(name, n, tags, 1)
+	}
+}
+
+// Gauge is a gauge metric
+type Gauge struct{ *Metric }
+
+func newGauge(name, description string, tags ...string) Gauge {
+	return Gauge{register(name, TypeGauge, description, tags...)}
+}
+
+// Set reports the gauge's value, with values for its tags
+func (g Gauge) Set(sd *statsd.Client, value float64, values ...string) {
+	tags := g.tags(values)
+	for _, name := range g.names() {
+		_ = sd.Gauge(name, value, tags, 1)
+	}
+}
+
+// Timing is a timing metric
+type Timing struct{ *Metric }
+
+func newTiming(name, description string, tags ...string) Timing {
+	return Timing{register(name, TypeTiming, description, tags...)}
+}
+
+func (t Timing) per(u Unit) Timing {
+	t.Unit = u
+	return t
+}
+
+// Record reports a duration, with values for the timing's tags
+func (t Timing) Record(sd *statsd.Client, d time.Duration, values ...string) {
+	tags := t.tags(values)
+	for _, name := range t.names() {
+		_ = sd.Timing(name, d, tags, 1)
+	}
+}
+
+// Histogram is a histogram metric
+type Histogram struct{ *Metric }
+
+func newHistogram(name, description string, tags ...string) Histogram {
+	return Histogram{register(name, TypeHistogram, description, tags...)}
+}
+
+func (h Histogram) per(u Unit) Histogram {
+	h.Unit = u
+	return h
+}
+
+// Record reports a value, with values for the histogram's tags
+func (h Histogram) Record(sd *statsd.Client, value float64, values ...string) {
+	tags := h.tags(values)
+	for _, name := range h.names() {
+		_ = sd.Histogram(name, value, tags, 1)
+	}
+}
+
+// external declares a metric that a dependency emits under its own name
+func external(name string, t Type, emitter, description string) {
+	register(name, t, description).Emitter = emitter
+}
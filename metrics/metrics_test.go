@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	names := make(map[string]bool)
+	for _, m := range All() {
+		assert.False(t, names[m.Name], "%s is declared twice", m.Name)
+		names[m.Name] = true
+		assert.NotEmpty(t, m.Description, m.Name)
+		assert.NotNil(t, m.Tags, m.Name)
+		if m.Emitter != "" {
+			continue
+		}
+		// latency, size and error metrics say whether they are per request or per
+		// command, see Unit
+		if m.Type == TypeTiming || m.Type == TypeHistogram || trafficCounter.MatchString(m.Name) {
+			assert.NotEmpty(t, m.Unit, "%s has no unit", m.Name)
+		}
+	}
+	assert.True(t, names["handle_message"])
+	assert.True(t, names["open_connections"])
+}
+
+var trafficCounter = regexp.MustCompile(`(^|[._])(requests|commands|errors|rejected|shed)($|[._])`)
+
+// rawEmission matches calls of a statsd client's own methods, which take the
+// metric's name first, rather than the declaration's
+var rawEmission = regexp.MustCompile(`(\bsd|[sS]tatsd)\.(Incr|Decr|Count|Gauge|Timing|TimeInMilliseconds|Histogram|Distribution|Set)\(\s*"`)
+
+func TestEmissionThroughRegistry(t *testing.T) {
+	err := filepath.Walk("..", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && (info.Name() == "metrics" || info.Name() == "vendor" || strings.HasPrefix(info.Name(), ".") && info.Name() != "..") {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, loc := range rawEmission.FindAllIndex(src, -1) {
+			line := 1 + strings.Count(string(src[:loc[0]]), "\n")
+			t.Errorf("%s:%d emits a metric without declaring it, use its declaration in package metrics", path, line)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestEmit(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	sd, err := statsd.New(conn.LocalAddr().String(), statsd.WithoutTelemetry())
+	assert.NoError(t, err)
+
+	c := Counter{&Metric{Name: "example.requests", Type: TypeCount, Tags: []string{"code", "command"}, RenamedFrom: "example.old_requests"}}
+	c.Incr(sd, "PROXYTIMEOUT", "GET")
+	Gauge{&Metric{Name: "example.open", Type: TypeGauge, Tags: []string{}}}.Set(sd, 3)
+	assert.NoError(t, sd.Flush())
+
+	buf := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	var lines []string
+	for len(lines) < 3 {
+		n, _, err := conn.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		lines = append(lines, strings.Split(strings.TrimSpace(string(buf[:n])), "\n")...)
+	}
+	sort.Strings(lines)
+	assert.Equal(t, []string{
+		"example.old_requests:1|c|#code:PROXYTIMEOUT,command:GET",
+		"example.open:3|g",
+		"example.requests:1|c|#code:PROXYTIMEOUT,command:GET",
+	}, lines, "a renamed metric is emitted under both names")
+}
@@ -0,0 +1,510 @@
+package metrics
+
+// Requests
+var (
+	Requests = newCounter("requests",
+		"Requests read from clients, a command or a whole pipeline").per(UnitRequest)
+	Commands = newCounter("commands",
+		"Commands read from clients, each command of a pipeline counted").per(UnitCommand)
+	HandleMessage = newTiming("handle_message",
+		"Time to read, handle and answer a client request, a command or a pipeline", "success").per(UnitRequest)
+	RequestLatency = newTiming("request.latency",
+		"Time from a client request being read to its reply being written, a command or a pipeline", "class").per(UnitRequest)
+	CommandLatency = newTiming("command",
+		"Time from the request of a command being read to its reply being written, by command, other for those not in commandmetrics", "command").per(UnitCommand)
+	CommandErrors = newCounter("command.errors",
+		"Commands answered with an error, by command, other for those not in commandmetrics", "command").per(UnitCommand)
+	CheckoutConnection = newTiming("checkout_connection",
+		"Time to check an upstream connection out of the pool", "address", "success").per(UnitEvent)
+	CheckoutRetry = newCounter("checkout_connection.retry",
+		"Retries of failed connection checkouts")
+	RetryBudgetExhausted = newCounter("retry_budget.exhausted",
+		"Failed checkouts and writes returned without a retry because the retry budget was spent")
+	UpstreamWriteFailures = newCounter("upstream_write_failures",
+		"Requests whose write to an upstream connection failed, by whether any of it was written and whether it was retried", "delivery", "retried").per(UnitRequest)
+	ReservedLaneRequests = newCounter("reserved_lane.requests",
+		"Requests served by the reserved lane").per(UnitRequest)
+	ProxyErrors = newCounter("proxy_errors",
+		"Error replies the proxy answered commands with itself, by PROXY* code", "code").per(UnitCommand)
+	UpstreamACLErrors = newCounter("upstream_acl_errors",
+		"NOPERM and WRONGPASS errors returned by upstream ACLs", "code", "command").per(UnitCommand)
+	ErrorRewrites = newCounter("error_rewrites",
+		"Upstream error replies whose addresses were rewritten, by kind: redirect for MOVED and ASK, or scrub", "kind").per(UnitCommand)
+	TopologyRewrites = newCounter("topology_rewrites",
+		"Node addresses of CLUSTER SLOTS, SHARDS and NODES replies rewritten to local addresses, by command", "command").per(UnitEvent)
+	ReadOnlyRejected = newCounter("read_only.rejected",
+		"Writes rejected while the upstream is in read-only mode", "command").per(UnitCommand)
+	ValidationRejected = newCounter("validation.rejected",
+		"Commands answered with a validation error by strictvalidation instead of being forwarded", "command").per(UnitCommand)
+	BlockedCommands = newCounter("commands.blocked",
+		"Commands blocked by allowcommands or denycommands instead of being forwarded, by command, other for those neither denied nor known to redis", "command").per(UnitCommand)
+	ClientLibraryConnections = newCounter("client_library.connections",
+		"Client connections by the lib-name/lib-ver they announced", "library")
+	ReadaheadCommands = newHistogram("readahead.commands",
+		"Commands read at once by readahead, of the requests of more than one that weren't wrapped in pipeline signals").per(UnitRequest)
+)
+
+// Pipeline signals
+var (
+	PipelineSignals = newCounter("pipeline.signals",
+		"Pipelines wrapped in the GET 🔜 and GET 🔚 signals, by event: opened and closed, nested_start for a start signal inside an open pipeline, stray_end for an end signal outside of any, and abandoned for a pipeline whose connection ended before its end signal", "event").per(UnitEvent)
+	PipelineSignalCommands = newHistogram("pipeline.signals.commands",
+		"Commands read between the start and end signals of a pipeline").per(UnitRequest)
+	PipelineSignalDuration = newTiming("pipeline.signals.duration",
+		"Time from the start signal of a pipeline being read to its end signal").per(UnitRequest)
+)
+
+// Splitting
+var (
+	SplitActivations = newCounter("split.activations",
+		"Commands split into smaller ones", "command").per(UnitCommand)
+	SplitChunks = newHistogram("split.chunks",
+		"Commands a split command was split into", "command").per(UnitCommand)
+	SplitDuration = newTiming("split.duration",
+		"Time to run the commands of a split request and reassemble their replies").per(UnitCommand)
+)
+
+// Atomic groups
+var (
+	AtomicGroups = newCounter("atomic.groups",
+		"PROXY ATOMIC groups, by whether their transaction ran, was aborted by the upstream or discarded by the proxy", "result").per(UnitEvent)
+)
+
+// Scripts
+var (
+	ScriptShed = newCounter("script.shed",
+		"Script calls answered with PROXYOVERLOADED by a script limit, by the limit and whether its rate or in-flight cap was reached", "limit", "reason").per(UnitCommand)
+	ScriptWait = newTiming("script.wait",
+		"Time requests waited for an in-flight slot of a script limit, by whether they got one", "limit", "success").per(UnitRequest)
+	ScriptSlow = newCounter("script.slow",
+		"Script calls that took longer than scriptslow, by the name the script gives itself, or unnamed", "script").per(UnitCommand)
+)
+
+// Circuit breaking and limits
+var (
+	CircuitState = newGauge("circuit.state",
+		"Circuit state of a node: 0 closed, 1 half-open, 2 open")
+	CircuitTransitions = newCounter("circuit.transitions",
+		"Circuit state changes of a node, by the state it changed to: open, or closed", "state").per(UnitEvent)
+	CircuitRejected = newCounter("circuit.rejected",
+		"Requests failed fast by an open circuit").per(UnitRequest)
+	InFlightRejected = newCounter("in_flight.rejected",
+		"Requests failed fast by maxinflight").per(UnitRequest)
+	RetryBudgetTokens = newGauge("retry_budget.tokens",
+		"Retries the retry budget has left")
+	RetryBudgetRatio = newGauge("retry_budget.retry_ratio",
+		"Retries as a fraction of recent successful requests")
+	ReadOnly = newGauge("read_only",
+		"Whether the upstream is in read-only mode")
+	ConnectLimiterWaiting = newGauge("connect_limiter.waiting",
+		"Connection creations waiting on connectrate")
+	BlockingRequests = newGauge("blocking.blocked",
+		"Requests waiting on a blocking command, each holding a connection of the blocking pool")
+	PubSubPinned = newGauge("pubsub.pinned",
+		"Subscribed clients, each holding a connection of the pubsub pool")
+	PubSubSessions = newCounter("pubsub.sessions",
+		"Subscriptions ended, by how: unsubscribed, reset, quit, client_closed, upstream_failed, slow_subscriber or panicked", "end").per(UnitEvent)
+	PubSubBufferPeak = newHistogram("pubsub.buffer_high_watermark",
+		"Most bytes of pushed messages that waited to be written to a subscribed client, for each subscription ended").per(UnitEvent)
+	PubSubOverflow = newCounter("pubsub.overflow",
+		"Times the pushed messages waiting for a slow subscriber went over pubsubmaxbytes or pubsubmaxage, by what was done: disconnect, drop_oldest or backpressure, and why: bytes or age", "action", "reason").per(UnitEvent)
+	PubSubDropped = newCounter("pubsub.dropped",
+		"Messages pushed to a slow subscriber dropped by drop-oldest").per(UnitEvent)
+	TransactionsPinned = newGauge("transactions.pinned",
+		"Clients in a transaction, each holding a connection of the pool")
+	TransactionPins = newCounter("transactions.pins",
+		"Pinned transactions ended, by how: closed, rejected, idle, quit, client_closed, upstream_failed or panicked", "end").per(UnitEvent)
+)
+
+// Watchdog
+var (
+	WatchdogHeartbeat = newTiming("watchdog.heartbeat",
+		"Time for a socket to answer the watchdog's heartbeat, by whether it did in time", "success").per(UnitEvent)
+	WatchdogStalled = newGauge("watchdog.stalled",
+		"Whether a socket has failed watchdogfailures heartbeats in a row")
+)
+
+// Panics
+var (
+	PanicRecovered = newCounter("panic.recovered",
+		"Panics recovered, by the component that recovered them and carried on without what panicked: client for a client connection, which is closed, scheduler for a background task, mirror for a mirrored request, or pool_advisor", "component").per(UnitEvent)
+)
+
+// Server-side latency
+var (
+	ServerLatency = newTiming("server.latency",
+		"Average time the upstream spent executing a command between two samples of INFO commandstats, without the network", "command").per(UnitCommand)
+	ServerLatencySamples = newCounter("server.latency.samples",
+		"Samples of server-side latency, by result: ok, skipped while the pool was busy, denied by the upstream, or failed", "result")
+)
+
+// Upstream configuration
+var (
+	ConfigGets = newCounter("config.get",
+		"CONFIG GET commands, by how they were answered: cached by the proxy, or forwarded to the upstream", "result").per(UnitCommand)
+	ConfigRefreshes = newCounter("config.refreshes",
+		"Refreshes of the cached upstream configuration, by result: ok, skipped while the pool was busy, denied by the upstream, or failed", "result")
+)
+
+// Upstream identity
+var (
+	UpstreamIdentityMismatches = newCounter("upstream.identity_mismatch",
+		"Identity checks an upstream failed, by the check that didn't match: key, info or mode", "check").per(UnitEvent)
+)
+
+// Upstream auth
+var (
+	UpstreamAuthFailures = newCounter("upstream.auth_failures",
+		"New upstream connections whose AUTH or SELECT the upstream rejected, by the first word of its error, e.g. wrongpass or noperm", "reason").per(UnitEvent)
+)
+
+// Upstream TLS
+var (
+	UpstreamTLSHandshake = newTiming("upstream.tls_handshake",
+		"Time to complete the TLS handshake of a new upstream connection, by whether it did", "success").per(UnitEvent)
+)
+
+// Upstream DNS
+var (
+	DNSStaleFallback = newCounter("dns.stale_fallback",
+		"Upstream dials made to the addresses the host name last connected on, because it failed to resolve").per(UnitEvent)
+)
+
+// Upstream connects, each new connection that failed counted by the stage it
+// failed at
+var (
+	DialDNSError = newCounter("dial.dns_error",
+		"New upstream connections whose host name failed to resolve").per(UnitEvent)
+	DialRefused = newCounter("dial.refused",
+		"New upstream connections the upstream refused").per(UnitEvent)
+	DialTimeout = newCounter("dial.timeout",
+		"New upstream connections that timed out connecting or being prepared").per(UnitEvent)
+	DialTLSError = newCounter("dial.tls_error",
+		"New upstream connections whose TLS handshake failed").per(UnitEvent)
+	DialError = newCounter("dial.error",
+		"New upstream connections that failed to connect for any other reason").per(UnitEvent)
+	InitAuthError = newCounter("init.auth_error",
+		"New upstream connections whose AUTH the upstream rejected").per(UnitEvent)
+	InitHelloError = newCounter("init.hello_error",
+		"New upstream connections of the RESP3 pool whose HELLO 3 the upstream rejected").per(UnitEvent)
+	InitSelectError = newCounter("init.select_error",
+		"New upstream connections whose SELECT the upstream rejected").per(UnitEvent)
+)
+
+// Statsd
+var (
+	StatsdDropped = newCounter("statsd.dropped",
+		"Metric payloads dropped at startup while the statsd address was unresolved, counted once it resolves")
+)
+
+// Service discovery
+var (
+	DiscoveryRegistrations = newCounter("discovery.registrations",
+		"Listener registrations with the service discovery backend, by result: ok, failed, deregistered or deregister_failed", "result")
+	DiscoveryHeartbeats = newCounter("discovery.heartbeats",
+		"Updates of the health checks of registered listeners, by result: ok or failed", "result")
+	DiscoveryRegistered = newGauge("discovery.registered",
+		"Listeners registered with the service discovery backend")
+)
+
+// Admin drains
+var (
+	DrainRefused = newCounter("drain.refused_connections",
+		"Client connections closed on accept because the listener was drained through the admin server")
+)
+
+// Reloads
+var (
+	Reloads = newCounter("reload.applied",
+		"Reloads of listener settings, by result: ok, or failed if a socket couldn't be replaced", "result")
+	ConfigReloads = newCounter("reload.config",
+		"Reloads of the upstreams from the config file on SIGHUP, by result: ok, failed if the config is invalid or a proxy couldn't be started, or cancelled through the admin server while it waited for its jitter", "result")
+	ReloadPrewarms = newCounter("reload.prewarm",
+		"New proxies of upstreams changed by a reload that waited for their pools to be warm before taking over, by result: warm, or cold if they weren't within reloadprewarm", "result")
+	SocketHandOffs = newCounter("reload.handoff",
+		"Sockets of a predecessor's taken over at startup, by result: handed_off, replaced if the predecessor didn't answer PROXY HANDOFF, or failed if the new socket couldn't take its place", "result")
+)
+
+// Pool segments
+var (
+	SegmentCheckouts = newCounter("segment.checkouts",
+		"Requests given a slot of their pool segment, by how: ok, borrowed from another segment, waited, or shed", "segment", "result").per(UnitRequest)
+	SegmentWait = newTiming("segment.wait",
+		"Time requests waited for a slot of their exhausted pool segment", "segment").per(UnitRequest)
+	SegmentInUse = newGauge("segment.in_use",
+		"Slots held by the requests of a pool segment, including those borrowed", "segment")
+)
+
+// Fair checkout
+var (
+	FairQueueWait = newTiming("fair_queue.wait",
+		"Time checkouts waited for their turn in the fair queue, by whether they got one", "success").per(UnitEvent)
+	FairQueueMaxWait = newGauge("fair_queue.max_wait",
+		"Longest wait for a turn in the fair queue since the last report, in milliseconds, counting checkouts still waiting")
+	FairQueueMaxHeld = newGauge("fair_queue.max_held",
+		"Most upstream connections held at once by one client connection")
+)
+
+// SLOs
+var (
+	SLORequests = newCounter("slo.requests",
+		"Requests counted against an SLO, good if answered within its threshold", "slo", "result").per(UnitRequest)
+	SLOBurnRate = newGauge("slo.burn_rate",
+		"Rate the error budget of an SLO is spent at over a window, 1 spending it exactly over the SLO's period", "slo", "window")
+)
+
+// Command mix
+var (
+	CommandMix = newGauge("command_mix.count",
+		"Commands of a class, read, write or other, over a window, or since the start with window total", "window", "class")
+	CommandMixTop = newGauge("command_mix.top",
+		"Commands sent of each of the most frequent commands over a window, or since the start with window total", "window", "command")
+)
+
+// Databases
+var (
+	DatabaseInvalidations = newCounter("db.invalidations",
+		"FLUSHDB, FLUSHALL and SWAPDB commands forwarded, clearing the caches of the databases they changed", "command")
+	DBPools = newGauge("db.pools",
+		"Databases clients SELECTed in dynamic database mode that have a pool of their own")
+	DBRequests = newCounter("db.requests",
+		"Requests forwarded in dynamic database mode, by the database they were for", "db").per(UnitRequest)
+)
+
+// Write-behind
+var (
+	WriteBehindAbsorbed = newCounter("writebehind.absorbed",
+		"Increments acknowledged by the proxy and queued for the next flush", "command")
+	WriteBehindFull = newCounter("writebehind.queue_full",
+		"Increments forwarded as usual because the write-behind queue was full")
+	WriteBehindPending = newGauge("writebehind.pending_counters",
+		"Counters with increments not yet flushed, as of the start of a flush")
+	WriteBehindFlush = newTiming("writebehind.flush",
+		"Time to flush a pipeline of consolidated increments", "success").per(UnitEvent)
+	WriteBehindFlushedKeys = newHistogram("writebehind.flushed_counters",
+		"Counters flushed by one pipeline").per(UnitEvent)
+	WriteBehindRejected = newCounter("writebehind.rejected",
+		"Consolidated increments the upstream rejected, which are dropped and logged").per(UnitCommand)
+	WriteBehindLost = newCounter("writebehind.lost",
+		"Counters whose increments could not be flushed before shutdown, which are logged")
+)
+
+// Read-through
+var (
+	ReadThroughMisses = newCounter("readthrough.misses",
+		"GET misses of keys matching a read-through rule", "prefix")
+	ReadThroughCollapsed = newCounter("readthrough.collapsed",
+		"Misses that waited on the fallback request of a concurrent miss of the same key", "prefix")
+	ReadThroughRejected = newCounter("readthrough.rejected",
+		"Misses answered as misses because readthroughconcurrency fallback requests were in flight", "prefix").per(UnitCommand)
+	ReadThroughFallback = newTiming("readthrough.fallback",
+		"Time to request a value from a fallback, by whether it was found, not found or failed", "prefix", "result").per(UnitEvent)
+)
+
+// Coalescing
+var (
+	CoalesceJoined = newCounter("coalesce.joined",
+		"Reads answered with the reply of an identical read in flight rather than sent upstream").per(UnitCommand)
+	CoalesceSkipped = newCounter("coalesce.skipped",
+		"Reads that could be coalesced but were sent on their own, by why: too_large, or full when coalescemaxkeys reads were in flight", "reason").per(UnitCommand)
+	CoalesceMaxFanout = newGauge("coalesce.max_fanout",
+		"Most reads answered by one upstream read since the last report, the one sent included")
+	CoalesceInFlight = newGauge("coalesce.in_flight",
+		"Reads in flight that identical reads can join")
+)
+
+// Negative caching
+var (
+	NegativeCacheHits = newCounter("negcache.hits",
+		"EXISTS, TTL and GET of negcacheprefixes keys answered as missing without a round trip").per(UnitCommand)
+	NegativeCacheMisses = newCounter("negcache.misses",
+		"EXISTS, TTL and GET of negcacheprefixes keys sent upstream, the negative cache not knowing them missing").per(UnitCommand)
+	NegativeCacheSkipped = newCounter("negcache.skipped",
+		"Keys found missing but not remembered, by why: full when negcachemaxbytes is reached, or written while the read was in flight", "reason").per(UnitEvent)
+	NegativeCacheInvalidations = newCounter("negcache.invalidations",
+		"Keys remembered missing that were forgotten because a write changed them").per(UnitEvent)
+	NegativeCacheBytes = newGauge("negcache.bytes",
+		"Bytes the negative cache accounts for the keys it remembers, at most negcachemaxbytes")
+	NegativeCacheKeys = newGauge("negcache.keys",
+		"Keys the negative cache remembers missing, expired ones included until swept")
+)
+
+// TTL policy
+var (
+	TTLEnforced = newCounter("ttl.enforced",
+		"Commands of keys of a TTL namespace whose expiry the proxy changed, by namespace prefix and action: injected, clamped, converted, rejected, followed_up, or followup_failed for a follow-up EXPIRE that failed", "namespace", "action").per(UnitCommand)
+)
+
+// Read fallback
+var (
+	ReadFallbacks = newCounter("read_fallback",
+		"Reads retried against the read fallback upstream, by why, error or nil, and which upstream's reply was served: secondary, primary, or none if both failed", "reason", "served_by").per(UnitCommand)
+)
+
+// Client warnings
+var (
+	Warnings = newCounter("warnings",
+		"Warnings for client connections, by type and whether they were attached or suppressed, being within warninginterval of another or too many pending", "type", "result").per(UnitEvent)
+	WarningsDelivered = newCounter("warnings.delivered",
+		"Warnings delivered to clients, by how: pushed to RESP3 clients, or read with PROXY WARNINGS", "delivery").per(UnitEvent)
+)
+
+// Reply streaming
+var (
+	StreamReplies = newCounter("stream.replies",
+		"Bulk string replies over streamthreshold, by outcome: streamed whole, aborted mid-stream, closing the client, or too_large, over streammaxbytes and refused", "outcome").per(UnitRequest)
+	StreamHold = newTiming("stream.hold",
+		"Time an upstream connection was held streaming a reply to its client, by outcome", "outcome").per(UnitRequest)
+)
+
+// Value checksums
+var (
+	ChecksumVerified = newCounter("checksum.verified",
+		"Framed values of checksumprefixes keys verified, by direction: write, as sent by the client, or read, as read from the upstream", "direction").per(UnitCommand)
+	ChecksumFailures = newCounter("checksum.failures",
+		"Framed values of checksumprefixes keys whose checksum didn't match, by direction, each answered with PROXYCHECKSUM", "direction").per(UnitCommand)
+)
+
+// Mirroring
+var (
+	MirrorCommands = newCounter("mirror.commands",
+		"Commands the mirror answered").per(UnitCommand)
+	MirrorDropped = newCounter("mirror.dropped",
+		"Requests that weren't mirrored, by why: full when mirrorqueue requests were waiting, or closed when the listener closed first", "reason").per(UnitRequest)
+	MirrorFailed = newCounter("mirror.failed",
+		"Requests the mirror wasn't sent, or didn't answer, for want of a connection or on a network error").per(UnitRequest)
+	MirrorMismatches = newCounter("mirror.mismatches",
+		"Commands the mirror answered unlike the upstream, with mirrorcompare", "command").per(UnitCommand)
+	MirrorLag = newTiming("mirror.lag",
+		"Time from a request being queued for the mirror to its reply, or its failure", "success").per(UnitRequest)
+	MirrorQueued = newGauge("mirror.queued",
+		"Requests waiting to be sent to the mirror")
+)
+
+// Topology coordination
+var (
+	TopologyVersion = newGauge("topology.version",
+		"Version of the cluster topology the proxy last saw")
+	TopologyVersionSkew = newGauge("topology.version_skew",
+		"How many versions the newest topology shared by another instance is ahead of the proxy's")
+	TopologyRefresh = newTiming("topology.refresh",
+		"Time to refresh the topology with CLUSTER SLOTS, by what triggered it: moved, key or peer", "trigger", "success").per(UnitEvent)
+	TopologyPublished = newCounter("topology.published",
+		"Topologies shared with other instances, through the shared key or a peer", "target", "success")
+	TopologyReceived = newCounter("topology.received",
+		"Topologies shared by other instances, by whether they were newer than the proxy's", "source", "newer")
+)
+
+// Slot hotspots
+var (
+	SlotHotspot = newCounter("cluster.slot_hotspot",
+		"Windows of sampled commands in which one slot took more than hotspotshare of them, by slot", "slot").per(UnitEvent)
+	HotspotRejected = newCounter("cluster.hash_tag_rejected",
+		"Writes rejected for a key whose hash tag matches bannedhashtags, by command", "command").per(UnitCommand)
+)
+
+// Slow log
+var (
+	SlowRoundTrips = newCounter("upstream.slow",
+		"Upstream round trips that took longer than slowlog, by the first command of their request", "command").per(UnitRequest)
+)
+
+// Client authentication
+var (
+	AuthAttempts = newCounter("auth.attempts",
+		"Client AUTHs, by result: ok, unverified (let in by a failing-open verifier), invalid, error or timeout", "result")
+	AuthVerify = newTiming("auth.verify",
+		"Time for one attempt of the external verifier, by result: ok, invalid or error", "result").per(UnitEvent)
+	AuthCache = newCounter("auth.cache",
+		"Lookups of the external verifier's cached verdicts: hit, negative_hit or miss", "result")
+	AuthReload = newCounter("auth.reloads",
+		"Reloads of the auth file after it changed", "success")
+)
+
+// Memory
+var (
+	MemoryUsage = newGauge("memory.usage",
+		"Memory used by the process, as seen by the Go runtime or by its cgroup", "source")
+	MemoryLimit = newGauge("memory.limit",
+		"Resolved memory threshold, soft or hard", "threshold")
+	MemoryState = newGauge("memory.state",
+		"Memory watchdog state: 0 normal, 1 over the soft limit, 2 over the hard limit")
+	MemoryTransitions = newCounter("memory.transitions",
+		"Memory watchdog state changes", "from", "to")
+	MemoryShed = newCounter("memory.shed",
+		"Requests failed fast with PROXYOVERLOADED to relieve memory, by watchdog state", "state").per(UnitRequest)
+	MemoryRefused = newCounter("memory.refused_connections",
+		"Client connections closed on accept because memory is over the hard limit")
+)
+
+// Pools
+var (
+	PoolCheckedOutConnections = newGauge("pool.checked_out_connections",
+		"Upstream connections checked out of the pool")
+	PoolOpenConnections = newGauge("pool.open_connections",
+		"Open upstream connections of the pool")
+	PoolConnectionCreated = newPoolEvent("connection_created", "Upstream connections opened")
+	PoolConnectionClosed  = newPoolEvent("connection_closed", "Upstream connections closed")
+	PoolCheckOutStarted   = newPoolEvent("connection_check_out_started", "Connection checkouts started")
+	PoolCheckedOut        = newPoolEvent("connection_checked_out", "Connections checked out")
+	PoolCheckOutFailed    = newPoolEvent("connection_check_out_failed", "Connection checkouts that failed")
+	PoolCheckedIn         = newPoolEvent("connection_checked_in", "Connections returned to the pool")
+	PoolCreated           = newPoolEvent("connection_pool_created", "Pools created")
+	PoolCleared           = newPoolEvent("connection_pool_cleared", "Pools cleared")
+	PoolClosed            = newPoolEvent("connection_pool_closed", "Pools closed")
+	PoolHealed            = newCounter("pool.healed",
+		"Connections created to bring a pool back to its minimum size, by the reason most of its connections were closed for", "reason").per(UnitEvent)
+	PoolInvariantViolations = newCounter("pool.invariant_violations",
+		"Checks that found a pool outside its size limits, over_max being more connections than its maximum", "invariant").per(UnitEvent)
+	PoolAdviceMinSize = newGauge("pool.advice.min_size",
+		"Min size recommended for the pool by the pool advisor, the median of its connections in use")
+	PoolAdviceMaxSize = newGauge("pool.advice.max_size",
+		"Max size recommended for the pool by the pool advisor, the 99.9th percentile of its connections in use plus headroom")
+	PoolReaped = newCounter("pool.reaped",
+		"Idle connections closed for having been idle longer than maxconnectionidletime").per(UnitEvent)
+	PoolHealthChecks = newCounter("pool.health_checks",
+		"PINGs sent connections idle for healthcheckinterval, by result, those that failed being closed", "result").per(UnitEvent)
+)
+
+func newPoolEvent(event, description string) Counter {
+	return newCounter("pool_event."+event, description, "address", "reason")
+}
+
+// Connection budget
+var (
+	ConnectionBudgetCeiling = newGauge("connection_budget.ceiling",
+		"Upstream connections the whole process may have open at once, maxupstreamconns")
+	ConnectionBudgetUsed = newGauge("connection_budget.used",
+		"Upstream connections open, or being opened, across every pool of the process")
+	ConnectionBudgetWaiting = newGauge("connection_budget.waiting",
+		"New upstream connections waiting for a slot of the budget")
+	ConnectionBudgetShare = newGauge("connection_budget.share",
+		"Connections of the budget a pool is entitled to by upstreamconnpolicy")
+	ConnectionBudgetShed = newCounter("connection_budget.shed",
+		"New upstream connections that failed for getting no slot of the budget within upstreamconnwait").per(UnitEvent)
+	ConnectionBudgetReclaimed = newCounter("connection_budget.reclaimed",
+		"Idle connections closed to hand their slot to a pool under its share").per(UnitEvent)
+)
+
+// Client reads
+var (
+	ClientReadTimeouts = newCounter("client.read_timeouts",
+		"Client connections closed for being too slow to send, by kind: first_byte for one that sent nothing, progress for a command that stopped arriving, or idle for one that sent no command within clientidletimeout", "kind").per(UnitEvent)
+)
+
+// Client connection limits
+var (
+	ClientsOpen = newGauge("clients.open",
+		"Client connections open to the upstream's listeners, heartbeats left out")
+	ClientsPeak = newGauge("clients.peak",
+		"Most client connections open to the upstream's listeners at once since the proxy started")
+	ClientsRejected = newCounter("clients.rejected",
+		"Client connections closed on accept because maxclients were open already").per(UnitEvent)
+)
+
+// Client connections, counted by the listener
+func init() {
+	external("open_connections", TypeGauge, "listener", "Open client connections")
+	external("connection_opened", TypeCount, "listener", "Client connections accepted")
+	external("connection_closed", TypeCount, "listener", "Client connections closed")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/coinbase/redisbetween/sharding"
+)
+
+// migrate implements `redisbetween migrate`, which reads keys, one per line, and
+// prints the server each key is placed on by a twemproxy pool config, and
+// optionally by a second one, to check that a migration keeps keys where they
+// are. It returns the process exit code: 1 if any key is placed differently.
+func migrate(args []string, stdout, stderr io.Writer) int {
+	var from, to, pool, toPool, keysFile string
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "Usage: redisbetween migrate -from nutcracker.yml -pool alpha [-to redisbetween.yml] < keys.txt\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&from, "from", "", "Twemproxy config file to place keys with")
+	fs.StringVar(&to, "to", "", "Optional second config file to compare placement with")
+	fs.StringVar(&pool, "pool", "", "Server pool to use in the -from config")
+	fs.StringVar(&toPool, "topool", "", "Server pool to use in the -to config. Defaults to -pool")
+	fs.StringVar(&keysFile, "keys", "", "File to read the keys from. Defaults to stdin")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if from == "" || pool == "" {
+		fs.Usage()
+		return 2
+	}
+	if toPool == "" {
+		toPool = pool
+	}
+
+	fromRing, err := loadRing(from, pool)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 2
+	}
+	var toRing *sharding.Ring
+	if to != "" {
+		if toRing, err = loadRing(to, toPool); err != nil {
+			_, _ = fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+	var keys io.Reader = os.Stdin
+	if keysFile != "" {
+		f, err := os.Open(keysFile) // #nosec
+		if err != nil {
+			_, _ = fmt.Fprintln(stderr, err)
+			return 2
+		}
+		defer func() { _ = f.Close() }()
+		keys = f
+	}
+
+	n, moved, err := place(keys, stdout, fromRing, toRing)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if toRing != nil {
+		_, _ = fmt.Fprintf(stderr, "%d keys, %d placed differently\n", n, moved)
+		if moved > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+func loadRing(path, pool string) (*sharding.Ring, error) {
+	f, err := os.Open(path) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	rings, err := sharding.LoadTwemproxy(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	ring, ok := rings[pool]
+	if !ok {
+		return nil, fmt.Errorf("%s: no pool named %q", path, pool)
+	}
+	return ring, nil
+}
+
+// place writes a tab separated line per key with its server name under from, and
+// under to if given, followed by "moved" if they differ
+func place(r io.Reader, w io.Writer, from, to *sharding.Ring) (keys, moved int, err error) {
+	out := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key := scanner.Bytes()
+		keys++
+		a := from.Server(key)
+		if to == nil {
+			_, _ = fmt.Fprintf(out, "%s\t%s\n", key, a.Name)
+			continue
+		}
+		b := to.Server(key)
+		if a.Name == b.Name && a.Address == b.Address {
+			_, _ = fmt.Fprintf(out, "%s\t%s\t%s\n", key, a.Name, b.Name)
+		} else {
+			moved++
+			_, _ = fmt.Fprintf(out, "%s\t%s\t%s\tmoved\n", key, a.Name, b.Name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return keys, moved, err
+	}
+	return keys, moved, out.Flush()
+}
@@ -0,0 +1,62 @@
+// Package netaddr normalizes the host:port addresses of upstreams, so that every
+// spelling of an address, IPv6 literals included, names the same upstream.
+//
+// Configured addresses bracket IPv6 literals, as in [2600:1f14::12]:6379, while
+// redis announces cluster nodes without brackets, as in 2600:1f14::12:6379, in
+// CLUSTER SLOTS, CLUSTER NODES and MOVED and ASK errors. Both normalize to the
+// bracketed form with the literal in its canonical, shortest spelling.
+package netaddr
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Normalize canonicalizes a configured address. Addresses that aren't IPv6
+// literals are returned unchanged, and IPv6 literals must be bracketed and
+// have a port, since the port of an unbracketed one is ambiguous.
+func Normalize(hostport string) (string, error) {
+	if strings.Count(hostport, ":") < 2 {
+		return hostport, nil
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %s, IPv6 addresses must be bracketed like [2600:1f14::12]:6379: %w", hostport, err)
+	}
+	return net.JoinHostPort(canonical(host), port), nil
+}
+
+// FromNode normalizes a node address as announced by redis, whose port is
+// whatever follows the last colon
+func FromNode(addr string) string {
+	if strings.HasPrefix(addr, "[") {
+		if n, err := Normalize(addr); err == nil {
+			return n
+		}
+		return addr
+	}
+	i := strings.LastIndexByte(addr, ':')
+	if i < 0 || !strings.Contains(addr[:i], ":") {
+		return addr
+	}
+	return net.JoinHostPort(canonical(addr[:i]), addr[i+1:])
+}
+
+// IsIPv6 reports whether the host of hostport is an IPv6 literal
+func IsIPv6(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	return err == nil && strings.Contains(host, ":")
+}
+
+// canonical is the shortest spelling of an IPv6 literal, keeping its zone
+func canonical(host string) string {
+	ip, zone := host, ""
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		ip, zone = host[:i], host[i:]
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String() + zone
+	}
+	return host
+}
@@ -0,0 +1,49 @@
+package netaddr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	valid := map[string]string{
+		"localhost":                "localhost",
+		"localhost:7000":           "localhost:7000",
+		"10.0.0.1:6379":            "10.0.0.1:6379",
+		"[2600:1f14::12]:6379":     "[2600:1f14::12]:6379",
+		"[2600:1F14:0:0::12]:6379": "[2600:1f14::12]:6379",
+		"[::1]:7000":               "[::1]:7000",
+		"[fe80::1%eth0]:6379":      "[fe80::1%eth0]:6379",
+	}
+	for in, out := range valid {
+		n, err := Normalize(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, out, n, in)
+	}
+	for _, in := range []string{"2600:1f14::12:6379", "[2600:1f14::12]", "[::1"} {
+		_, err := Normalize(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestFromNode(t *testing.T) {
+	nodes := map[string]string{
+		"127.0.0.1:7000":         "127.0.0.1:7000",
+		"redis-0.internal:7000":  "redis-0.internal:7000",
+		"2600:1f14::12:6379":     "[2600:1f14::12]:6379",
+		"2600:1f14:0:0::12:6379": "[2600:1f14::12]:6379",
+		"::1:7000":               "[::1]:7000",
+		"[2600:1f14::12]:6379":   "[2600:1f14::12]:6379",
+		"localhost":              "localhost",
+	}
+	for in, out := range nodes {
+		assert.Equal(t, out, FromNode(in), in)
+	}
+}
+
+func TestIsIPv6(t *testing.T) {
+	assert.True(t, IsIPv6("[2600:1f14::12]:6379"))
+	assert.False(t, IsIPv6("10.0.0.1:6379"))
+	assert.False(t, IsIPv6("localhost"))
+}
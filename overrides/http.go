@@ -0,0 +1,58 @@
+package overrides
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/coinbase/redisbetween/admin"
+)
+
+type setRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   string `json:"ttl"`
+}
+
+// Handler serves the admin route for runtime overrides. GET lists the settings,
+// PUT sets an override from a JSON body of key, value and an optional ttl such as
+// "30m", and DELETE removes the override named by the key query param.
+func (s *Store) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"settings": s.Settings()})
+		case http.MethodPut, http.MethodPost:
+			var req setRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			var ttl time.Duration
+			if req.TTL != "" {
+				var err error
+				if ttl, err = time.ParseDuration(req.TTL); err != nil {
+					writeError(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+			if err := s.Set(req.Key, req.Value, ttl); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"settings": s.Settings()})
+		case http.MethodDelete:
+			if err := s.Delete(r.URL.Query().Get("key")); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"settings": s.Settings()})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	admin.WriteJSON(w, status, map[string]string{"error": err.Error()})
+}
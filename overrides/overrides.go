@@ -0,0 +1,258 @@
+// Package overrides keeps settings changed at runtime through the admin server,
+// persisting them to a state file so that they are reapplied after a restart.
+package overrides
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coinbase/redisbetween/atomicfile"
+	"go.uber.org/zap"
+)
+
+const (
+	SourceConfig          = "config"
+	SourceRuntime         = "runtime"
+	SourceRuntimeRestored = "runtime-restored"
+)
+
+// Override is a runtime value for a registered setting. ExpiresAt is absolute, so
+// a TTL keeps counting down across restarts.
+type Override struct {
+	Key       string     `json:"key"`
+	Value     string     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Source    string     `json:"source"`
+}
+
+// Setting is the effective value of a registered setting, as shown by /config
+type Setting struct {
+	Key       string     `json:"key"`
+	Value     string     `json:"value"`
+	Source    string     `json:"source"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type setting struct {
+	base  string
+	apply func(value string) error
+}
+
+type Store struct {
+	log       *zap.Logger
+	path      string
+	now       func() time.Time
+	mu        sync.Mutex
+	settings  map[string]setting
+	overrides map[string]Override
+}
+
+// New creates a store persisting to path. An empty path keeps overrides in memory only.
+func New(log *zap.Logger, path string) *Store {
+	return &Store{
+		log:       log,
+		path:      path,
+		now:       time.Now,
+		settings:  make(map[string]setting),
+		overrides: make(map[string]Override),
+	}
+}
+
+// Register makes a setting overridable. base is its value from the config, which
+// apply is called with again when an override is removed or expires. A setting
+// registered again, as when its upstream is reloaded, has apply called with its
+// override right away, if it has one.
+func (s *Store) Register(key, base string, apply func(value string) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings[key] = setting{base: base, apply: apply}
+	if o, ok := s.overrides[key]; ok {
+		if err := apply(o.Value); err != nil {
+			s.log.Error("Failed to reapply runtime override", zap.String("key", key), zap.String("value", o.Value), zap.Error(err))
+		}
+	}
+}
+
+// Unregister drops a setting that no longer exists, along with its override
+func (s *Store) Unregister(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.settings, key)
+	if _, ok := s.overrides[key]; !ok {
+		return
+	}
+	delete(s.overrides, key)
+	if err := s.persist(); err != nil {
+		s.log.Error("Failed to write runtime state", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// Restore reapplies the overrides in the state file. Expired overrides and those
+// for settings that are no longer registered are dropped.
+func (s *Store) Restore() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []Override
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("invalid runtime state file %s: %v", s.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, o := range saved {
+		log := s.log.With(zap.String("key", o.Key), zap.String("value", o.Value))
+		st, ok := s.settings[o.Key]
+		if !ok {
+			log.Warn("Dropping runtime override for unknown setting")
+			continue
+		}
+		if o.ExpiresAt != nil && !o.ExpiresAt.After(now) {
+			log.Info("Dropping expired runtime override", zap.Time("expires_at", *o.ExpiresAt))
+			continue
+		}
+		if err := st.apply(o.Value); err != nil {
+			log.Error("Failed to restore runtime override", zap.Error(err))
+			continue
+		}
+		o.Source = SourceRuntimeRestored
+		s.overrides[o.Key] = o
+		log.Info("Restored runtime override")
+	}
+	return s.persist()
+}
+
+// Discard empties the state file without applying it, for a clean-slate start
+func (s *Store) Discard() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log.Info("Ignoring runtime state", zap.String("path", s.path))
+	return s.persist()
+}
+
+// Set applies and persists an override. A positive ttl makes it expire.
+func (s *Store) Set(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.settings[key]
+	if !ok {
+		return fmt.Errorf("unknown setting: %s", key)
+	}
+	if err := st.apply(value); err != nil {
+		return err
+	}
+	o := Override{Key: key, Value: value, Source: SourceRuntime}
+	if ttl > 0 {
+		expiresAt := s.now().Add(ttl).UTC()
+		o.ExpiresAt = &expiresAt
+	}
+	s.overrides[key] = o
+	s.log.Info("Set runtime override", zap.String("key", key), zap.String("value", value), zap.Duration("ttl", ttl))
+	return s.persist()
+}
+
+// Delete removes an override, restoring the setting's config value
+func (s *Store) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.overrides[key]; !ok {
+		return nil
+	}
+	if err := s.reset(key); err != nil {
+		return err
+	}
+	s.log.Info("Removed runtime override", zap.String("key", key))
+	return s.persist()
+}
+
+// Expire removes overrides whose TTL has passed
+func (s *Store) Expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	expired := false
+	for key, o := range s.overrides {
+		if o.ExpiresAt == nil || o.ExpiresAt.After(now) {
+			continue
+		}
+		if err := s.reset(key); err != nil {
+			s.log.Error("Failed to expire runtime override", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		s.log.Info("Runtime override expired", zap.String("key", key))
+		expired = true
+	}
+	if expired {
+		if err := s.persist(); err != nil {
+			s.log.Error("Failed to write runtime state", zap.Error(err))
+		}
+	}
+}
+
+// Run expires overrides every interval until quit is closed
+func (s *Store) Run(interval time.Duration, quit <-chan interface{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.Expire()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Settings lists every registered setting with its effective value and source
+func (s *Store) Settings() []Setting {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings := make([]Setting, 0, len(s.settings))
+	for key, st := range s.settings {
+		if o, ok := s.overrides[key]; ok {
+			settings = append(settings, Setting{Key: key, Value: o.Value, Source: o.Source, ExpiresAt: o.ExpiresAt})
+		} else {
+			settings = append(settings, Setting{Key: key, Value: st.base, Source: SourceConfig})
+		}
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings
+}
+
+func (s *Store) reset(key string) error {
+	if err := s.settings[key].apply(s.settings[key].base); err != nil {
+		return err
+	}
+	delete(s.overrides, key)
+	return nil
+}
+
+// persist atomically replaces the state file with the current overrides
+func (s *Store) persist() error {
+	if s.path == "" {
+		return nil
+	}
+	saved := make([]Override, 0, len(s.overrides))
+	for _, o := range s.overrides {
+		saved = append(saved, o)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Key < saved[j].Key })
+	b, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(s.path, b, 0600)
+}
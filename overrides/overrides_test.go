@@ -0,0 +1,103 @@
+package overrides
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRestoreAcrossRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrides")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "state.json")
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	var level, pool string
+	s := New(zaptest.NewLogger(t), path)
+	s.now = func() time.Time { return now }
+	s.Register("loglevel", "info", func(v string) error { level = v; return nil })
+	s.Register("maxpoolsize", "10", func(v string) error { pool = v; return nil })
+
+	assert.NoError(t, s.Set("loglevel", "debug", 0))
+	assert.NoError(t, s.Set("maxpoolsize", "20", time.Hour))
+	assert.EqualError(t, s.Set("nope", "1", 0), "unknown setting: nope")
+	assert.Equal(t, "debug", level)
+	assert.Equal(t, "20", pool)
+
+	// a restart finds both overrides, until the ttl passes
+	for _, elapsed := range []time.Duration{30 * time.Minute, 2 * time.Hour} {
+		level, pool = "info", "10"
+		restarted := New(zaptest.NewLogger(t), path)
+		restarted.now = func() time.Time { return now.Add(elapsed) }
+		restarted.Register("loglevel", "info", func(v string) error { level = v; return nil })
+		restarted.Register("maxpoolsize", "10", func(v string) error { pool = v; return nil })
+		assert.NoError(t, restarted.Restore())
+		assert.Equal(t, "debug", level)
+
+		settings := restarted.Settings()
+		assert.Equal(t, "loglevel", settings[0].Key)
+		assert.Equal(t, SourceRuntimeRestored, settings[0].Source)
+		if elapsed < time.Hour {
+			assert.Equal(t, "20", pool)
+			assert.Equal(t, Setting{Key: "maxpoolsize", Value: "20", Source: SourceRuntimeRestored, ExpiresAt: settings[1].ExpiresAt}, settings[1])
+			assert.Equal(t, now.Add(time.Hour), *settings[1].ExpiresAt)
+		} else {
+			assert.Equal(t, "10", pool)
+			assert.Equal(t, Setting{Key: "maxpoolsize", Value: "10", Source: SourceConfig}, settings[1])
+		}
+	}
+}
+
+func TestExpireAndDelete(t *testing.T) {
+	now := time.Now()
+	var level string
+	s := New(zaptest.NewLogger(t), "")
+	s.now = func() time.Time { return now }
+	s.Register("loglevel", "info", func(v string) error { level = v; return nil })
+
+	assert.NoError(t, s.Set("loglevel", "debug", time.Minute))
+	s.Expire()
+	assert.Equal(t, "debug", level)
+	now = now.Add(time.Minute)
+	s.Expire()
+	assert.Equal(t, "info", level)
+
+	assert.NoError(t, s.Set("loglevel", "warn", 0))
+	assert.NoError(t, s.Delete("loglevel"))
+	assert.Equal(t, "info", level)
+	assert.Equal(t, []Setting{{Key: "loglevel", Value: "info", Source: SourceConfig}}, s.Settings())
+}
+
+func TestFailedApplyNotPersisted(t *testing.T) {
+	s := New(zaptest.NewLogger(t), "")
+	s.Register("loglevel", "info", func(v string) error { return errors.New("invalid loglevel: " + v) })
+	assert.EqualError(t, s.Set("loglevel", "loud", 0), "invalid loglevel: loud")
+	assert.Equal(t, SourceConfig, s.Settings()[0].Source)
+}
+
+func TestRegisterAgain(t *testing.T) {
+	s := New(zaptest.NewLogger(t), "")
+	var before, after string
+	s.Register("readonly.cache", "false", func(v string) error { before = v; return nil })
+	assert.NoError(t, s.Set("readonly.cache", "true", 0))
+	assert.Equal(t, "true", before)
+
+	// the override carries over to what replaced the setting
+	s.Register("readonly.cache", "false", func(v string) error { after = v; return nil })
+	assert.Equal(t, "true", after)
+	assert.NoError(t, s.Delete("readonly.cache"))
+	assert.Equal(t, "false", after)
+	assert.Equal(t, "true", before, "the replaced setting is no longer applied")
+
+	assert.NoError(t, s.Set("readonly.cache", "true", 0))
+	s.Unregister("readonly.cache")
+	assert.Empty(t, s.Settings())
+	assert.EqualError(t, s.Set("readonly.cache", "true", 0), "unknown setting: readonly.cache")
+}
@@ -0,0 +1,52 @@
+// Package panics recovers the panics of the goroutines serving client
+// connections and running background work, so that one of them failing takes
+// down only what it was doing rather than the whole process.
+package panics
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"go.uber.org/zap"
+)
+
+var crash int32
+
+// SetCrash has the panics that would be recovered crash the process instead,
+// as they do without recovery, for development and tests
+func SetCrash(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&crash, v)
+}
+
+// Recovering is whether panics are recovered, as they are unless SetCrash
+func Recovering() bool {
+	return atomic.LoadInt32(&crash) == 0
+}
+
+// Recovered counts a panic recovered by component in panic.recovered, and logs
+// msg with the panic's value, the stack it was raised on and fields. It must
+// be called from the deferred function that recovered it, for the stack to be
+// that of the panic.
+func Recovered(log *zap.Logger, sd *statsd.Client, component, msg string, value interface{}, fields ...zap.Field) {
+	metrics.PanicRecovered.Incr(sd, component)
+	fields = append(fields, zap.String("component", component), zap.String("panic", fmt.Sprintf("%v", value)), zap.String("stack", string(debug.Stack())))
+	log.Error(msg, fields...)
+}
+
+// Recover is deferred at the top of a background goroutine, or around each
+// piece of work it runs, to recover a panic there with Recovered
+func Recover(log *zap.Logger, sd *statsd.Client, component, msg string) {
+	if !Recovering() {
+		return
+	}
+	if r := recover(); r != nil {
+		Recovered(log, sd, component, msg, r)
+	}
+}
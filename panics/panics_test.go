@@ -0,0 +1,40 @@
+package panics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRecover(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	func() {
+		defer Recover(zap.New(core), nil, "scheduler", "Background task crashed")
+		panic("boom")
+	}()
+	entries := logs.FilterMessage("Background task crashed").All()
+	if assert.Len(t, entries, 1) {
+		fields := entries[0].ContextMap()
+		assert.Equal(t, "scheduler", fields["component"])
+		assert.Equal(t, "boom", fields["panic"])
+		assert.Contains(t, fields["stack"], "TestRecover")
+	}
+
+	func() {
+		defer Recover(zap.New(core), nil, "scheduler", "Background task crashed")
+	}()
+	assert.Equal(t, 1, logs.Len(), "nothing is logged without a panic")
+}
+
+func TestSetCrash(t *testing.T) {
+	SetCrash(true)
+	defer SetCrash(false)
+	assert.False(t, Recovering())
+	assert.PanicsWithValue(t, "boom", func() {
+		defer Recover(zap.NewNop(), nil, "scheduler", "Background task crashed")
+		panic("boom")
+	}, "the panic is left to crash the process")
+}
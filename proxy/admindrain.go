@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/handlers"
+)
+
+// ListenerDrain is whether a listener accepts new client connections, as
+// drained through the admin server, and what its clients are doing
+type ListenerDrain struct {
+	Upstream string `json:"upstream"`
+	Node     string `json:"node"`
+	Local    string `json:"local"`
+	// State is accepting or draining
+	State string `json:"state"`
+	handlers.ActivityStats
+}
+
+// DrainEvent is sent on the events of a DrainReport each time listeners are
+// drained or undrained through the admin server, and once the drain of a
+// graceful shutdown starts
+type DrainEvent struct {
+	Time time.Time `json:"time"`
+	// State is draining, accepting, or shutdown
+	State string `json:"state"`
+	// Listeners are the sockets whose state changed, none for a shutdown
+	Listeners []string `json:"listeners,omitempty"`
+}
+
+// drainRequest names the listeners POST /drain and /undrain apply to, all of
+// them if it names none
+type drainRequest struct {
+	Listeners []string `json:"listeners"`
+}
+
+// SetEvents has the report send every DrainEvent to events, without blocking:
+// events are dropped while it is full
+func (d *DrainReport) SetEvents(events chan<- DrainEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = events
+}
+
+// DrainListeners has the listeners named, by the name of their upstream, the
+// node they serve or their socket, or all of them if names is empty, refuse
+// new client connections, while those they have are served until they close.
+// Draining a listener already draining does nothing.
+func (d *DrainReport) DrainListeners(names []string) error {
+	return d.setDraining(names, true)
+}
+
+// UndrainListeners has the listeners named, or all of them if names is empty,
+// accept new client connections again
+func (d *DrainReport) UndrainListeners(names []string) error {
+	return d.setDraining(names, false)
+}
+
+func (d *DrainReport) setDraining(names []string, draining bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	match := make(map[string]bool, len(names))
+	for _, n := range names {
+		match[n] = false
+	}
+	var v int32
+	state := "accepting"
+	if draining {
+		v, state = 1, "draining"
+	}
+
+	type target struct {
+		p *Proxy
+		l *upstreamListener
+	}
+	var targets []target
+	var whole []*Proxy
+	for _, p := range d.proxies {
+		_, all := match[p.Name()]
+		if all || len(names) == 0 {
+			match[p.Name()] = true
+			whole = append(whole, p)
+		}
+		p.listenerLock.Lock()
+		for _, l := range p.listeners {
+			_, node := match[l.upstream]
+			_, local := match[l.local]
+			if node {
+				match[l.upstream] = true
+			}
+			if local {
+				match[l.local] = true
+			}
+			if all || node || local || len(names) == 0 {
+				targets = append(targets, target{p, l})
+			}
+		}
+		p.listenerLock.Unlock()
+	}
+	for _, n := range names {
+		if !match[n] {
+			return fmt.Errorf("no listener named %s", n)
+		}
+	}
+
+	if len(names) == 0 {
+		d.all = draining
+	}
+	for _, p := range whole {
+		atomic.StoreInt32(&p.drainNew, v)
+	}
+	var changed []string
+	for _, t := range targets {
+		if atomic.SwapInt32(&t.l.draining, v) != v {
+			changed = append(changed, t.l.local)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		d.send(DrainEvent{Time: time.Now(), State: state, Listeners: changed})
+	}
+	return nil
+}
+
+// send sends e to the events, if any, with mu held
+func (d *DrainReport) send(e DrainEvent) {
+	if d.events == nil {
+		return
+	}
+	select {
+	case d.events <- e:
+	default:
+	}
+}
+
+// Listeners returns the drain state of every listener, sorted by upstream and
+// node
+func (d *DrainReport) Listeners() []ListenerDrain {
+	d.mu.Lock()
+	proxies := d.proxies
+	d.mu.Unlock()
+	listeners := []ListenerDrain{}
+	for _, p := range proxies {
+		p.listenerLock.Lock()
+		for _, l := range p.listeners {
+			ld := ListenerDrain{Upstream: p.Name(), Node: l.upstream, Local: l.local, State: "accepting", ActivityStats: l.options.Activity.Stats()}
+			if atomic.LoadInt32(&l.draining) == 1 {
+				ld.State = "draining"
+			}
+			listeners = append(listeners, ld)
+		}
+		p.listenerLock.Unlock()
+	}
+	sort.Slice(listeners, func(i, j int) bool {
+		if listeners[i].Upstream != listeners[j].Upstream {
+			return listeners[i].Upstream < listeners[j].Upstream
+		}
+		return listeners[i].Node < listeners[j].Node
+	})
+	return listeners
+}
+
+// Drained returns the sockets of the listeners drained through the admin
+// server
+func (d *DrainReport) Drained() []string {
+	if d == nil {
+		return nil
+	}
+	var drained []string
+	for _, l := range d.Listeners() {
+		if l.State == "draining" {
+			drained = append(drained, l.Local)
+		}
+	}
+	return drained
+}
+
+// DrainHandler answers POST /drain, with the listeners to drain, all of them
+// if the body names none, POST /undrain alike, and GET /drain/status, each with
+// the state of every listener
+func DrainHandler(d *DrainReport) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var set func([]string) error
+		switch {
+		case r.URL.Path == "/drain/status" && r.Method == http.MethodGet:
+		case r.URL.Path == "/drain" && r.Method == http.MethodPost:
+			set = d.DrainListeners
+		case r.URL.Path == "/undrain" && r.Method == http.MethodPost:
+			set = d.UndrainListeners
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if set != nil {
+			var req drainRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+				admin.WriteJSON(rw, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := set(req.Listeners); err != nil {
+				admin.WriteJSON(rw, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		admin.WriteJSON(rw, http.StatusOK, map[string]interface{}{"listeners": d.Listeners()})
+	})
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/handlers"
+	redisproto "github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func drainRoute(t *testing.T, d *DrainReport, method, path, body string) (int, []ListenerDrain) {
+	rec := httptest.NewRecorder()
+	DrainHandler(d).ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var res struct {
+		Listeners []ListenerDrain `json:"listeners"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &res)
+	return rec.Code, res.Listeners
+}
+
+func TestAdminDrain(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	p := startDBProxy(t, cfg, node.Address(), -1, handlers.NewDatabases())
+	assert.Eventually(t, p.Listening, time.Second, time.Millisecond)
+	d := NewDrainReport([]*Proxy{p})
+	events := make(chan DrainEvent, 4)
+	d.SetEvents(events)
+
+	client, err := net.Dial("unix", p.localConfigHost)
+	assert.NoError(t, err)
+	defer func() { _ = client.Close() }()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	dec := redisproto.NewDecoder(client)
+	get := func() string {
+		writeCommand(t, client, "GET", "k")
+		m, err := dec.Decode()
+		assert.NoError(t, err)
+		return m.String()
+	}
+	assert.Equal(t, "$-1 \\r\\n ", get())
+
+	code, listeners := drainRoute(t, d, http.MethodGet, "/drain/status", "")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, listeners, 1) {
+		assert.Equal(t, "accepting", listeners[0].State)
+		assert.Equal(t, int64(1), listeners[0].Clients)
+	}
+	assert.Equal(t, http.StatusOK, healthz(nil, d))
+
+	code, _ = drainRoute(t, d, http.MethodPost, "/drain", `{"listeners": ["10.0.0.1:6379"]}`)
+	assert.Equal(t, http.StatusNotFound, code, "unknown listeners drain nothing")
+	code, listeners = drainRoute(t, d, http.MethodPost, "/drain", `{"listeners": ["`+node.Address()+`"]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "draining", listeners[0].State)
+	e := <-events
+	assert.Equal(t, "draining", e.State)
+	assert.Equal(t, []string{p.localConfigHost}, e.Listeners)
+	code, _ = drainRoute(t, d, http.MethodPost, "/drain", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, events, 0, "draining again changes nothing")
+	assert.Equal(t, http.StatusServiceUnavailable, healthz(nil, d))
+	ok, status := Health(nil, d)
+	assert.False(t, ok)
+	assert.Equal(t, "drained", status)
+
+	// the client connected keeps being served, while new ones are refused
+	assert.Equal(t, "$-1 \\r\\n ", get())
+	refused, err := net.Dial("unix", p.localConfigHost)
+	assert.NoError(t, err)
+	m, err := redisproto.NewDecoder(refused).Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "-PROXYUNAVAILABLE listener draining, refusing connections \\r\\n ", m.String())
+	_ = refused.Close()
+
+	// a shutdown goes on from the drained listeners
+	d.Start(time.Now().Add(time.Minute))
+	assert.Equal(t, "shutdown", (<-events).State)
+	_ = client.Close()
+	p.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, p.Drain(ctx))
+}
+
+func TestAdminUndrain(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	p := startDBProxy(t, cfg, node.Address(), -1, handlers.NewDatabases())
+	assert.Eventually(t, p.Listening, time.Second, time.Millisecond)
+	d := NewDrainReport([]*Proxy{p})
+
+	assert.NoError(t, d.DrainListeners(nil))
+	assert.Equal(t, []string{p.localConfigHost}, d.Drained())
+	code, listeners := drainRoute(t, d, http.MethodPost, "/undrain", `{"listeners": ["`+p.localConfigHost+`"]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "accepting", listeners[0].State)
+	assert.Empty(t, d.Drained())
+	assert.Equal(t, http.StatusOK, healthz(nil, d))
+
+	client := setupStandaloneClient(t, p.localConfigHost)
+	assert.NoError(t, client.Set(context.Background(), "k", "v", 0).Err(), "accepting again")
+
+	code, _ = drainRoute(t, d, http.MethodGet, "/drain", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = drainRoute(t, d, http.MethodPost, "/drain", "{")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
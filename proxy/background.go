@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/panics"
+	"github.com/coinbase/redisbetween/scheduler"
+)
+
+var (
+	warmupLock  sync.Mutex
+	warmupSlots = make(chan struct{}, config.DefaultWarmupConcurrency)
+)
+
+// SetWarmupConcurrency caps the pool warmup dials in flight across all upstreams.
+// It should be called before any proxy runs.
+func SetWarmupConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	warmupLock.Lock()
+	defer warmupLock.Unlock()
+	warmupSlots = make(chan struct{}, n)
+}
+
+func acquireWarmupSlot(ctx context.Context) (release func(), err error) {
+	warmupLock.Lock()
+	slots := warmupSlots
+	warmupLock.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// schedule runs fn once a second on the shared background scheduler until the
+// proxy shuts down
+func (p *Proxy) schedule(fn func()) {
+	// the scheduler's goroutine runs the tasks of every upstream, which one
+	// panicking mustn't stop
+	remove := scheduler.Default.Add(func() {
+		defer panics.Recover(p.log, p.statsd, "scheduler", "Background task crashed")
+		fn()
+	})
+	p.backgroundLock.Lock()
+	defer p.backgroundLock.Unlock()
+	select {
+	case <-p.quit:
+		remove()
+	default:
+		p.background = append(p.background, remove)
+	}
+}
+
+// probe paces a periodic check of an upstream on the shared scheduler: a check
+// is due once interval has passed since the last one started, and only one runs
+// at a time, in a goroutine of its own, so that a slow upstream never holds up
+// the scheduler
+type probe struct {
+	interval time.Duration
+	// busy, if set, is whether client requests hold every connection of the
+	// pool, a check being put off until they don't
+	busy func() bool
+	// skipped, if set, is called for a check a busy pool skips rather than puts
+	// off, the next one being due an interval later
+	skipped func()
+
+	mu      sync.Mutex
+	running bool
+	next    time.Time
+}
+
+// tick starts a check once it is due, without waiting for it. start is called
+// with mu held, and returns the check to run, or nil if there is nothing to do.
+func (pr *probe) tick(now time.Time, start func(now time.Time) func()) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if pr.running || now.Before(pr.next) {
+		return
+	}
+	if pr.busy != nil && pr.busy() {
+		if pr.skipped != nil {
+			pr.next = now.Add(pr.interval)
+			pr.skipped()
+		}
+		return
+	}
+	pr.next = now.Add(pr.interval)
+	check := start(now)
+	if check == nil {
+		return
+	}
+	pr.running = true
+	go func() {
+		defer func() {
+			pr.mu.Lock()
+			pr.running = false
+			pr.mu.Unlock()
+		}()
+		check()
+	}()
+}
+
+// runProbe ticks a probe every second until the proxy shuts down
+func (p *Proxy) runProbe(pr *probe, start func(now time.Time) func()) {
+	p.schedule(func() { pr.tick(time.Now(), start) })
+}
+
+// poolBusy is whether client requests hold every connection of a listener's
+// pool
+func poolBusy(l *upstreamListener) func() bool {
+	return func() bool {
+		return atomic.LoadInt64(&l.pool.checkedOut) >= int64(l.pool.maxSize)
+	}
+}
+
+func (p *Proxy) stopBackground() {
+	p.backgroundLock.Lock()
+	defer p.backgroundLock.Unlock()
+	for _, remove := range p.background {
+		remove()
+	}
+	p.background = nil
+}
+
+// countingGaugeCallback counts an event, with values for its tags, and moves the
+// gauge it belongs to
+type countingGaugeCallback func(event metrics.Counter, values ...string)
+
+// countingGauge is util.StatsdBackgroundGauge without a goroutine per gauge: it
+// counts with an atomic and is flushed by the shared scheduler
+func (p *Proxy) countingGauge(sd *statsd.Client, gauge metrics.Gauge, count *int64) (increment, decrement countingGaugeCallback) {
+	p.schedule(func() {
+		gauge.Set(sd, float64(atomic.LoadInt64(count)))
+	})
+	increment = func(event metrics.Counter, values ...string) {
+		event.Incr(sd, values...)
+		atomic.AddInt64(count, 1)
+	}
+	decrement = func(event metrics.Counter, values ...string) {
+		event.Incr(sd, values...)
+		atomic.AddInt64(count, -1)
+	}
+	return
+}
+
+// backgroundFlushInterval is the buffer flush interval of the statsd clients made
+// by taggedStatsd. It is long enough that their own flush loops stay idle, since
+// the shared scheduler flushes them instead.
+const backgroundFlushInterval = time.Hour
+
+// taggedStatsd is util.StatsdWithTags for clients that live as long as the proxy.
+// Each clone is a whole client, so these skip telemetry, which the base client
+// already reports, and are flushed once a second by the shared scheduler rather
+// than by a loop of their own. Clones of a metrics.NewClient share its writer,
+// so making one for a newly discovered node never resolves the address inline.
+func (p *Proxy) taggedStatsd(sd *statsd.Client, tags []string) (*statsd.Client, error) {
+	clone, err := metrics.Clone(sd,
+		statsd.WithTags(append(sd.Tags, tags...)),
+		statsd.WithoutTelemetry(),
+		statsd.WithBufferFlushInterval(backgroundFlushInterval),
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.schedule(func() { _ = clone.Flush() })
+	p.backgroundLock.Lock()
+	p.statsdClients = append(p.statsdClients, clone)
+	p.backgroundLock.Unlock()
+	return clone, nil
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/scheduler"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBackgroundWorkIsShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "background")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(dir, "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	before := scheduler.Default.Len()
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: "127.0.0.1:7000", Label: "c", Database: -1, MaxPoolSize: 1, Retries: 1, RetryBudget: 0.1})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	assert.Eventually(t, func() bool { return len(p.Sockets()) == 1 }, time.Second, 10*time.Millisecond)
+
+	// the label and listener statsd flushes, two pool gauges, the retry budget,
+	// read-only and client connection reports, and the config refresh
+	assert.Equal(t, before+8, scheduler.Default.Len())
+	p.Shutdown()
+	assert.Equal(t, before, scheduler.Default.Len(), "a stopped proxy leaves no background work behind")
+}
+
+func TestWarmupConcurrency(t *testing.T) {
+	SetWarmupConcurrency(1)
+	defer SetWarmupConcurrency(config.DefaultWarmupConcurrency)
+
+	release, err := acquireWarmupSlot(context.Background())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = acquireWarmupSlot(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "warmup dials beyond the cap wait")
+
+	release()
+	release, err = acquireWarmupSlot(context.Background())
+	assert.NoError(t, err)
+	release()
+}
+
+func TestStatsdFaultsLeaveRequestsAlone(t *testing.T) {
+	for _, addr := range []string{
+		// a blackholed address, and a name that never resolves
+		"192.0.2.1:8125",
+		"statsd.invalid:8125",
+	} {
+		node := newDBNode(t)
+		start := time.Now()
+		sd, _, err := metrics.NewClient(addr, statsd.WithNamespace("redisbetween"))
+		assert.NoError(t, err)
+		cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+		p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: node.Address(), Label: "faulty", MaxPoolSize: 4, ReadTimeout: time.Second, WriteTimeout: time.Second})
+		assert.NoError(t, err)
+		go func() { _ = p.Run() }()
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(p.localConfigHost)
+			return err == nil
+		}, time.Second, time.Millisecond, addr)
+
+		client := setupStandaloneClient(t, p.localConfigHost)
+		var slowest time.Duration
+		for i := 0; i < 200; i++ {
+			begin := time.Now()
+			assert.NoError(t, client.Set(context.Background(), "k", "v", 0).Err())
+			if d := time.Since(begin); d > slowest {
+				slowest = d
+			}
+		}
+		// the proxy's clients for its listeners are made as it starts, so
+		// none of them waited on the address either
+		assert.Less(t, int64(time.Since(start)), int64(2*time.Second), addr)
+		assert.Less(t, int64(slowest), int64(100*time.Millisecond), addr)
+		_ = client.Close()
+		p.Shutdown()
+		_ = sd.Close()
+	}
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/coinbase/redisbetween/internal/workload"
+	"go.uber.org/zap"
+)
+
+// bench runs a PROXY BENCH workload through one of the proxy's own sockets, so it
+// measures the whole path a client takes. Only one runs at a time per proxy, so
+// that overlapping runs don't skew each other's results.
+func (p *Proxy) bench(local string, cfg workload.Config) (workload.Result, error) {
+	if !atomic.CompareAndSwapInt32(&p.benching, 0, 1) {
+		return workload.Result{}, errors.New("a benchmark is already running")
+	}
+	defer atomic.StoreInt32(&p.benching, 0)
+
+	p.log.Info("Running PROXY BENCH", zap.String("local", local), zap.Duration("duration", cfg.Duration), zap.Int("concurrency", cfg.Concurrency), zap.Int("pipeline", cfg.Pipeline))
+	return workload.Run(context.Background(), "proxy", func() (net.Conn, error) {
+		return net.Dial(p.config.Network, local)
+	}, cfg)
+}
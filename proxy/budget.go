@@ -0,0 +1,366 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/panics"
+	"github.com/coinbase/redisbetween/scheduler"
+	"go.uber.org/zap"
+)
+
+// reclaimTimeout bounds the checkout of an idle connection to reclaim, which
+// fails rather than waits if the pool has none
+const reclaimTimeout = 10 * time.Millisecond
+
+var errBudgetExhausted = errors.New("upstream connection budget exhausted")
+
+var (
+	budgetLock   sync.Mutex
+	budget       *connBudget
+	budgetReport func()
+)
+
+// SetConnectionBudget caps the upstream connections of the whole process, every
+// pool's connections counting against the same ceiling, and reports the budget
+// once a second. It should be called before any proxy runs, and leaves
+// connections uncapped if the ceiling is 0.
+func SetConnectionBudget(log *zap.Logger, sd *statsd.Client, c config.ConnectionBudget) {
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	if budgetReport != nil {
+		budgetReport()
+		budgetReport = nil
+	}
+	budget = nil
+	if c.Ceiling <= 0 {
+		return
+	}
+	b := newConnBudget(c.Ceiling, c.Policy, c.Wait)
+	budget = b
+	budgetReport = scheduler.Default.Add(func() {
+		defer panics.Recover(log, sd, "scheduler", "Background task crashed")
+		b.report(sd)
+		b.rebalance(sd)
+	})
+}
+
+func currentBudget() *connBudget {
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	return budget
+}
+
+// ConnectionBudgetStats returns the state of the connection budget, or nil if
+// connections are uncapped
+func ConnectionBudgetStats() *BudgetStats {
+	return currentBudget().stats()
+}
+
+// BudgetStats is the state of the process-wide connection budget, served in
+// /stats
+type BudgetStats struct {
+	Ceiling int    `json:"ceiling"`
+	Policy  string `json:"policy"`
+	Used    int    `json:"used"`
+	Waiting int    `json:"waiting"`
+	Pools   int    `json:"pools"`
+}
+
+// PoolBudgetStats is a pool's allocation of the connection budget: its share,
+// the connections it holds, and those waiting for a slot
+type PoolBudgetStats struct {
+	Share   int `json:"share"`
+	Held    int `json:"held"`
+	Waiting int `json:"waiting"`
+}
+
+// connBudget is the process-wide ceiling on upstream connections. Pools take a
+// slot for each connection they open and give it back as soon as the
+// connection is closed. While the budget is exhausted, new connections wait,
+// and are handed the slots given back in order of priority: first those of
+// pools under their minimum, then those of pools under their share, each pool's
+// fair part of the ceiling by the budget's policy, and then the others, in the
+// order they came within each. A pool may grow past its share while no pool
+// under its own waits, and its idle connections are reclaimed for one that does.
+type connBudget struct {
+	ceiling int
+	policy  string
+	wait    time.Duration
+
+	mu      sync.Mutex
+	used    int
+	pools   map[*budgetPool]bool
+	waiters []*budgetWaiter
+}
+
+// budgetPool is a pool's account with the budget
+type budgetPool struct {
+	budget   *connBudget
+	min, max int
+	held     int
+	waiting  int
+	// reclaim, once the pool is connected, closes one of its idle connections,
+	// returning whether it had one
+	reclaim func() bool
+}
+
+type budgetWaiter struct {
+	pool  *budgetPool
+	ready chan struct{}
+}
+
+func newConnBudget(ceiling int, policy string, wait time.Duration) *connBudget {
+	return &connBudget{ceiling: ceiling, policy: policy, wait: wait, pools: make(map[*budgetPool]bool)}
+}
+
+// register opens the account of a pool of min to max connections
+func (b *connBudget) register(min, max int) *budgetPool {
+	bp := &budgetPool{budget: b, min: min, max: max}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pools[bp] = true
+	return bp
+}
+
+// unregister closes the account of a pool once it is closed, which leaves the
+// shares of the others to grow. Connections of the pool still open give back
+// their slots as they are closed.
+func (bp *budgetPool) unregister() {
+	b := bp.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pools, bp)
+	b.handoff()
+}
+
+func (bp *budgetPool) setReclaim(reclaim func() bool) {
+	bp.budget.mu.Lock()
+	defer bp.budget.mu.Unlock()
+	bp.reclaim = reclaim
+}
+
+// share is a pool's fair part of the ceiling, never less than its minimum:
+// proportional to its maximum size, or with the demand policy, to the
+// connections it holds and waits for, which leaves the part of an idle pool to
+// the busy ones. It must be called with the lock held.
+func (b *connBudget) share(bp *budgetPool) int {
+	weight := func(p *budgetPool) int { return p.max }
+	if b.policy == config.BudgetDemand {
+		var demand int
+		for p := range b.pools {
+			demand += p.held + p.waiting
+		}
+		if demand > 0 {
+			weight = func(p *budgetPool) int { return p.held + p.waiting }
+		}
+	}
+	var total int
+	for p := range b.pools {
+		total += weight(p)
+	}
+	share := 0
+	if total > 0 {
+		share = b.ceiling * weight(bp) / total
+	}
+	if share < bp.min {
+		share = bp.min
+	}
+	return share
+}
+
+// priority is the rank of a pool's next connection: 0 under its minimum, 1
+// under its share and 2 past it. It must be called with the lock held.
+func (b *connBudget) priority(bp *budgetPool) int {
+	switch {
+	case bp.held < bp.min:
+		return 0
+	case bp.held < b.share(bp):
+		return 1
+	}
+	return 2
+}
+
+// acquire takes a slot for a new connection of bp, waiting for one no longer
+// than the budget's wait, or until ctx is done
+func (bp *budgetPool) acquire(ctx context.Context) error {
+	b := bp.budget
+	b.mu.Lock()
+	if b.used < b.ceiling && !b.waitingAhead(b.priority(bp)) {
+		b.grant(bp)
+		b.mu.Unlock()
+		return nil
+	}
+	w := &budgetWaiter{pool: bp, ready: make(chan struct{})}
+	b.waiters = append(b.waiters, w)
+	bp.waiting++
+	b.mu.Unlock()
+
+	t := time.NewTimer(b.wait)
+	defer t.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-t.C:
+		err = fmt.Errorf("%w, no slot of %d within %v", errBudgetExhausted, b.ceiling, b.wait)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, queued := range b.waiters {
+		if queued == w {
+			b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+			bp.waiting--
+			return err
+		}
+	}
+	// handed a slot as it gave up
+	return nil
+}
+
+// release gives back the slot of a connection of bp
+func (bp *budgetPool) release() {
+	b := bp.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bp.held--
+	b.used--
+	b.handoff()
+}
+
+// waitingAhead is whether a connection waits with the priority given or a
+// better one, which a new one has to wait behind. It must be called with the
+// lock held.
+func (b *connBudget) waitingAhead(priority int) bool {
+	for _, w := range b.waiters {
+		if b.priority(w.pool) <= priority {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *connBudget) grant(bp *budgetPool) {
+	bp.held++
+	b.used++
+}
+
+// handoff hands the free slots to the waiters with the best priority, in the
+// order they came. It must be called with the lock held.
+func (b *connBudget) handoff() {
+	for b.used < b.ceiling && len(b.waiters) > 0 {
+		next := 0
+		best := b.priority(b.waiters[0].pool)
+		for i, w := range b.waiters[1:] {
+			if p := b.priority(w.pool); p < best {
+				next, best = i+1, p
+			}
+		}
+		w := b.waiters[next]
+		b.waiters = append(b.waiters[:next], b.waiters[next+1:]...)
+		w.pool.waiting--
+		b.grant(w.pool)
+		close(w.ready)
+	}
+}
+
+// rebalance reclaims the idle connections of pools past their share, the most
+// over it first, for as many connections as wait under their pool's share
+func (b *connBudget) rebalance(sd *statsd.Client) {
+	b.mu.Lock()
+	var starved int
+	for _, w := range b.waiters {
+		if b.priority(w.pool) < 2 {
+			starved++
+		}
+	}
+	type candidate struct {
+		pool   *budgetPool
+		excess int
+	}
+	var over []candidate
+	for bp := range b.pools {
+		if excess := bp.held - b.share(bp); excess > 0 && bp.reclaim != nil {
+			over = append(over, candidate{bp, excess})
+		}
+	}
+	b.mu.Unlock()
+	sort.Slice(over, func(i, j int) bool { return over[i].excess > over[j].excess })
+	for _, c := range over {
+		for i := 0; i < c.excess && starved > 0; i++ {
+			if !c.pool.reclaim() {
+				break
+			}
+			metrics.ConnectionBudgetReclaimed.Incr(sd)
+			starved--
+		}
+	}
+}
+
+func (b *connBudget) report(sd *statsd.Client) {
+	s := b.stats()
+	metrics.ConnectionBudgetCeiling.Set(sd, float64(s.Ceiling))
+	metrics.ConnectionBudgetUsed.Set(sd, float64(s.Used))
+	metrics.ConnectionBudgetWaiting.Set(sd, float64(s.Waiting))
+}
+
+func (b *connBudget) stats() *BudgetStats {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &BudgetStats{Ceiling: b.ceiling, Policy: b.policy, Used: b.used, Waiting: len(b.waiters), Pools: len(b.pools)}
+}
+
+func (bp *budgetPool) stats() *PoolBudgetStats {
+	if bp == nil {
+		return nil
+	}
+	b := bp.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &PoolBudgetStats{Share: b.share(bp), Held: bp.held, Waiting: bp.waiting}
+}
+
+// budgetConn gives back its budget slot as soon as it is closed
+type budgetConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *budgetConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// reclaimIdle closes one of the idle connections of a pool, if it has one, by
+// checking it out and returning it closed, which the pool then discards
+func reclaimIdle(s *pool.Server, counts *poolCounts) bool {
+	if atomic.LoadInt64(&counts.open)-atomic.LoadInt64(&counts.checkedOut) <= 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reclaimTimeout)
+	defer cancel()
+	conn, err := s.Connection(ctx)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	_ = conn.Return()
+	return true
+}
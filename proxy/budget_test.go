@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// acquireAsync starts acquiring a slot of bp, the result being sent on the
+// channel returned once it is granted or given up on
+func acquireAsync(t *testing.T, bp *budgetPool) chan error {
+	done := make(chan error, 1)
+	go func() { done <- bp.acquire(context.Background()) }()
+	// wait for it to queue
+	assert.Eventually(t, func() bool {
+		bp.budget.mu.Lock()
+		defer bp.budget.mu.Unlock()
+		return bp.waiting > 0
+	}, time.Second, time.Millisecond)
+	return done
+}
+
+func waited(t *testing.T, done chan error) {
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("no slot handed over")
+	}
+}
+
+func TestConnectionBudgetStarvation(t *testing.T) {
+	b := newConnBudget(4, config.BudgetProportional, time.Minute)
+	busy, starved := b.register(0, 10), b.register(0, 10)
+	assert.Equal(t, 2, b.share(busy))
+
+	// a pool may take more than its share while no other waits
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, busy.acquire(context.Background()))
+	}
+	assert.Equal(t, &PoolBudgetStats{Share: 2, Held: 4}, busy.stats())
+
+	waiting := acquireAsync(t, starved)
+	// the pool past its share waits behind the starved one
+	more := acquireAsync(t, busy)
+	busy.release()
+	waited(t, waiting)
+	assert.Equal(t, &PoolBudgetStats{Share: 2, Held: 1}, starved.stats())
+	select {
+	case <-more:
+		t.Fatal("a pool past its share got a slot ahead of one under it")
+	default:
+	}
+	assert.Equal(t, &BudgetStats{Ceiling: 4, Policy: config.BudgetProportional, Used: 4, Waiting: 1, Pools: 2}, b.stats())
+
+	// once no pool under its share waits, the next slot goes to the one past it
+	starved.release()
+	waited(t, more)
+	assert.Equal(t, 4, b.stats().Used)
+}
+
+func TestConnectionBudgetRebalance(t *testing.T) {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	b := newConnBudget(4, config.BudgetProportional, time.Minute)
+	idle, busy := b.register(0, 10), b.register(0, 10)
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, idle.acquire(context.Background()))
+	}
+	var reclaimed int
+	idle.setReclaim(func() bool {
+		reclaimed++
+		idle.release()
+		return true
+	})
+
+	// with nothing waiting, nothing is reclaimed
+	b.rebalance(sd)
+	assert.Equal(t, 0, reclaimed)
+
+	// the idle connections of the pool past its share go to the one waiting
+	first, second := acquireAsync(t, busy), acquireAsync(t, busy)
+	b.rebalance(sd)
+	waited(t, first)
+	waited(t, second)
+	assert.Equal(t, 2, reclaimed)
+	assert.Equal(t, &PoolBudgetStats{Share: 2, Held: 2}, idle.stats())
+	assert.Equal(t, &PoolBudgetStats{Share: 2, Held: 2}, busy.stats())
+
+	// a pool closing leaves its share to the others
+	idle.release()
+	idle.release()
+	idle.unregister()
+	assert.Equal(t, 4, b.share(busy))
+}
+
+func TestConnectionBudgetDemand(t *testing.T) {
+	b := newConnBudget(6, config.BudgetDemand, time.Minute)
+	idle, busy := b.register(1, 10), b.register(0, 10)
+	assert.Equal(t, 3, b.share(busy), "without any demand, shares are proportional")
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, busy.acquire(context.Background()))
+	}
+	assert.Equal(t, 6, b.share(busy), "an idle pool leaves its part to the busy ones")
+	assert.Equal(t, 1, b.share(idle), "but keeps its minimum")
+}
+
+func TestConnectionBudgetMinimum(t *testing.T) {
+	b := newConnBudget(2, config.BudgetProportional, time.Minute)
+	under, warming := b.register(0, 10), b.register(1, 10)
+	assert.NoError(t, under.acquire(context.Background()))
+	assert.NoError(t, under.acquire(context.Background()))
+
+	share := acquireAsync(t, under)
+	minimum := acquireAsync(t, warming)
+	under.release()
+	waited(t, minimum)
+	select {
+	case <-share:
+		t.Fatal("a connection under its pool's share got a slot ahead of one under its pool's minimum")
+	default:
+	}
+	warming.release()
+	waited(t, share)
+}
+
+func TestConnectionBudgetShed(t *testing.T) {
+	b := newConnBudget(1, config.BudgetProportional, 10*time.Millisecond)
+	bp := b.register(0, 1)
+	assert.NoError(t, bp.acquire(context.Background()))
+	err := bp.acquire(context.Background())
+	assert.True(t, errors.Is(err, errBudgetExhausted))
+	assert.EqualError(t, err, "upstream connection budget exhausted, no slot of 1 within 10ms")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, bp.acquire(ctx))
+	assert.Equal(t, &PoolBudgetStats{Share: 1, Held: 1}, bp.stats(), "connections given up on hold nothing")
+
+	// a connection gives back its slot once, however many times it is closed
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+	c := &budgetConn{Conn: client, release: bp.release}
+	_ = c.Close()
+	_ = c.Close()
+	assert.Equal(t, 0, b.stats().Used)
+}
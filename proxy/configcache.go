@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// configRefreshInterval is how often the cached configuration of an upstream is
+// refreshed
+const configRefreshInterval = time.Minute
+
+// configRefresher keeps a listener's handlers.ConfigCache up to date with a
+// CONFIG GET * every interval, taken like the server-side latency samples only
+// while the pool has connections to spare
+type configRefresher struct {
+	probe
+	log    *zap.Logger
+	statsd *statsd.Client
+	cache  *handlers.ConfigCache
+	// get sends CONFIG GET *
+	get    func() (*redis.Message, error)
+	denied bool
+}
+
+// refreshConfig caches the configuration of a listener's upstream, refreshed
+// every configRefreshInterval until the proxy shuts down
+func (p *Proxy) refreshConfig(l *upstreamListener, logWith *zap.Logger, sdWith *statsd.Client) *handlers.ConfigCache {
+	r := &configRefresher{
+		probe: probe{interval: configRefreshInterval, busy: poolBusy(l), skipped: func() {
+			metrics.ConfigRefreshes.Incr(sdWith, "skipped")
+		}},
+		log:    logWith,
+		statsd: sdWith,
+		cache:  handlers.NewConfigCache(),
+		get: func() (*redis.Message, error) {
+			return p.command(l.server, "CONFIG", "GET", "*")
+		},
+	}
+	p.runProbe(&r.probe, r.start)
+	return r.cache
+}
+
+func (r *configRefresher) start(now time.Time) func() {
+	return func() { r.refresh(now) }
+}
+
+func (r *configRefresher) refresh(now time.Time) {
+	res, err := r.get()
+	if err == nil && res.IsError() {
+		// an upstream that doesn't allow it, by its ACL or a renamed command,
+		// is refreshed no less, in case that changes, but logged only once
+		err = errors.New(string(res.Value))
+		r.cache.Fail(err)
+		if !r.denied {
+			r.log.Info("Upstream denied CONFIG GET, the proxy forwards it instead of answering from its cache", zap.Error(err))
+		}
+		r.denied = true
+		metrics.ConfigRefreshes.Incr(r.statsd, "denied")
+		return
+	}
+	if err != nil {
+		r.cache.Fail(err)
+		r.log.Debug("Failed to refresh the upstream configuration", zap.Error(err))
+		metrics.ConfigRefreshes.Incr(r.statsd, "failed")
+		return
+	}
+	r.denied = false
+	r.cache.Set(configValues(res), now)
+	metrics.ConfigRefreshes.Incr(r.statsd, "ok")
+}
+
+// configValues picks handlers.ConfigParams out of the name and value pairs of a
+// CONFIG GET reply
+func configValues(res *redis.Message) map[string]string {
+	all := make(map[string]string, len(res.Array)/2)
+	for i := 0; i+1 < len(res.Array); i += 2 {
+		all[strings.ToLower(string(res.Array[i].Value))] = string(res.Array[i+1].Value)
+	}
+	values := make(map[string]string)
+	for _, p := range handlers.ConfigParams {
+		if v, ok := all[p]; ok {
+			values[p] = v
+		}
+	}
+	return values
+}
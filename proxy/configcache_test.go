@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestConfigRefresh(t *testing.T) {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	var res *redis.Message
+	var getErr error
+	r := &configRefresher{
+		log:    zap.NewNop(),
+		statsd: sd,
+		probe:  probe{interval: time.Minute, busy: func() bool { return false }},
+		cache:  handlers.NewConfigCache(),
+		get:    func() (*redis.Message, error) { return res, getErr },
+	}
+	now := time.Now()
+
+	pairs := func(kv ...string) *redis.Message {
+		mm := make([]*redis.Message, len(kv))
+		for i, s := range kv {
+			mm[i] = redis.NewBulkBytes([]byte(s))
+		}
+		return redis.NewArray(mm)
+	}
+	res = pairs("maxmemory", "0", "requirepass", "hunter2", "databases", "16")
+	r.refresh(now)
+	assert.Equal(t, handlers.ConfigCacheStats{Params: 2, Refreshed: now}, *r.cache.Stats(), "only the safe parameters are kept")
+
+	res = redis.NewErrorf("NOPERM this user has no permissions to run the 'config|get' command")
+	r.refresh(now.Add(time.Minute))
+	assert.Equal(t, handlers.ConfigCacheStats{Params: 2, Refreshed: now, Error: "NOPERM this user has no permissions to run the 'config|get' command"}, *r.cache.Stats(), "the last values are kept")
+	assert.True(t, r.denied)
+
+	getErr = errors.New("i/o timeout")
+	r.refresh(now.Add(2 * time.Minute))
+	assert.Equal(t, "i/o timeout", r.cache.Stats().Error)
+
+	r.tick(now.Add(3*time.Minute), r.start)
+	assert.Equal(t, now.Add(4*time.Minute), r.next)
+}
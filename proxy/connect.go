@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	connectLimitersLock sync.Mutex
+	connectLimiters     = make(map[string]*connectLimiter)
+)
+
+// connectLimiterFor returns the connection rate limiter of an upstream endpoint,
+// creating it with the given rate and burst. Every pool dialing the endpoint
+// shares it, whatever database, lane or proxy the pool is for, so that the cap
+// holds for what the server sees. Pools configured with different caps for the
+// same endpoint get the strictest.
+func connectLimiterFor(address string, rate float64, burst int) *connectLimiter {
+	connectLimitersLock.Lock()
+	defer connectLimitersLock.Unlock()
+	l, ok := connectLimiters[address]
+	if !ok {
+		l = newConnectLimiter(rate, burst)
+		connectLimiters[address] = l
+		return l
+	}
+	l.restrict(rate, burst)
+	return l
+}
+
+// connectLimiter is a token bucket that connection creations wait on: warmup,
+// growth under load, and replacements of closed connections alike
+type connectLimiter struct {
+	waiting int64
+
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// demandSince is when creations started waiting without a break, and warned
+	// whether that has been logged yet
+	demandSince time.Time
+	warned      bool
+}
+
+func newConnectLimiter(rate float64, burst int) *connectLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &connectLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (l *connectLimiter) restrict(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < l.rate {
+		l.rate = rate
+	}
+	if b := float64(burst); b >= 1 && b < l.burst {
+		l.burst = b
+		if l.tokens > b {
+			l.tokens = b
+		}
+	}
+}
+
+// wait blocks until a connection may be created, or ctx is done
+func (l *connectLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// the token is taken now, so waiters are served in the order they came
+	l.tokens--
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	atomic.AddInt64(&l.waiting, 1)
+	defer atomic.AddInt64(&l.waiting, -1)
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return fmt.Errorf("waiting %v for the connection rate limit: %w", delay, ctx.Err())
+	}
+}
+
+// Waiting is the number of connection creations waiting on the limit
+func (l *connectLimiter) Waiting() int64 {
+	return atomic.LoadInt64(&l.waiting)
+}
+
+// overloaded reports, once for each stretch of time in which creations have been
+// waiting without a break, when that has lasted longer than after. It returns
+// how long it has lasted.
+func (l *connectLimiter) overloaded(now time.Time, after time.Duration) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Waiting() == 0 {
+		l.demandSince = time.Time{}
+		l.warned = false
+		return 0, false
+	}
+	if l.demandSince.IsZero() {
+		l.demandSince = now
+	}
+	d := now.Sub(l.demandSince)
+	if l.warned || d <= after {
+		return d, false
+	}
+	l.warned = true
+	return d, true
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectLimiter(t *testing.T) {
+	l := newConnectLimiter(20, 2)
+	start := time.Now()
+	assert.NoError(t, l.wait(context.Background()))
+	assert.NoError(t, l.wait(context.Background()))
+	assert.True(t, time.Since(start) < 25*time.Millisecond, "the burst is not held back")
+
+	done := make(chan error)
+	go func() { done <- l.wait(context.Background()) }()
+	assert.Eventually(t, func() bool { return l.Waiting() == 1 }, time.Second, time.Millisecond)
+	assert.NoError(t, <-done)
+	assert.True(t, time.Since(start) >= 45*time.Millisecond, "past the burst, creations come at the rate")
+	assert.Equal(t, int64(0), l.Waiting())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	assert.Error(t, l.wait(ctx))
+}
+
+func TestConnectLimiterShared(t *testing.T) {
+	a := connectLimiterFor("10.0.0.9:6379", 10, 5)
+	b := connectLimiterFor("10.0.0.9:6379", 2, 10)
+	assert.True(t, a == b, "pools dialing one endpoint share its limiter")
+	assert.Equal(t, float64(2), a.rate)
+	assert.Equal(t, float64(5), a.burst, "the strictest cap applies")
+	assert.False(t, a == connectLimiterFor("10.0.0.10:6379", 10, 5))
+}
+
+func TestConnectLimiterOverloaded(t *testing.T) {
+	l := newConnectLimiter(1, 1)
+	now := time.Now()
+	_, warn := l.overloaded(now, time.Second)
+	assert.False(t, warn)
+
+	l.waiting = 3
+	_, warn = l.overloaded(now, time.Second)
+	assert.False(t, warn)
+	d, warn := l.overloaded(now.Add(2*time.Second), time.Second)
+	assert.True(t, warn)
+	assert.Equal(t, 2*time.Second, d)
+	_, warn = l.overloaded(now.Add(3*time.Second), time.Second)
+	assert.False(t, warn, "each stretch of demand is logged once")
+
+	l.waiting = 0
+	_, _ = l.overloaded(now.Add(4*time.Second), time.Second)
+	l.waiting = 1
+	_, warn = l.overloaded(now.Add(5*time.Second), time.Second)
+	assert.False(t, warn)
+	_, warn = l.overloaded(now.Add(7*time.Second), time.Second)
+	assert.True(t, warn)
+}
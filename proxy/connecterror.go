@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+)
+
+// ConnectStage is the stage of making a new upstream connection that failed,
+// each with a remediation of its own, named as it is counted
+type ConnectStage string
+
+const (
+	ConnectDNS     ConnectStage = "dial.dns_error"
+	ConnectRefused ConnectStage = "dial.refused"
+	ConnectTimeout ConnectStage = "dial.timeout"
+	ConnectTLS     ConnectStage = "dial.tls_error"
+	ConnectOther   ConnectStage = "dial.error"
+	ConnectAuth    ConnectStage = "init.auth_error"
+	ConnectHello   ConnectStage = "init.hello_error"
+	ConnectSelect  ConnectStage = "init.select_error"
+)
+
+var connectStageCounters = map[ConnectStage]metrics.Counter{
+	ConnectDNS:     metrics.DialDNSError,
+	ConnectRefused: metrics.DialRefused,
+	ConnectTimeout: metrics.DialTimeout,
+	ConnectTLS:     metrics.DialTLSError,
+	ConnectOther:   metrics.DialError,
+	ConnectAuth:    metrics.InitAuthError,
+	ConnectHello:   metrics.InitHelloError,
+	ConnectSelect:  metrics.InitSelectError,
+}
+
+// ConnectError is a new upstream connection that failed at Stage
+type ConnectError struct {
+	Stage ConnectStage
+	Err   error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// connectError is err, made dialing or preparing a new upstream connection,
+// as the ConnectError of the stage it failed at
+func connectError(err error) *ConnectError {
+	var ce *ConnectError
+	if errors.As(err, &ce) {
+		return ce
+	}
+	var authErr *UpstreamAuthError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	stage := ConnectOther
+	switch {
+	case errors.As(err, &authErr) && authErr.Command == "SELECT":
+		stage = ConnectSelect
+	case errors.As(err, &authErr) && authErr.Command == "HELLO":
+		stage = ConnectHello
+	case errors.As(err, &authErr):
+		stage = ConnectAuth
+	case errors.As(err, &dnsErr):
+		stage = ConnectDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		stage = ConnectRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		stage = ConnectTimeout
+	}
+	return &ConnectError{Stage: stage, Err: err}
+}
+
+// connectErrorOf finds the ConnectError of a failed checkout, which the pool
+// wraps in a ConnectionError
+func connectErrorOf(err error) (*ConnectError, bool) {
+	for err != nil {
+		var ce *ConnectError
+		if errors.As(err, &ce) {
+			return ce, true
+		}
+		var pe pool.ConnectionError
+		if !errors.As(err, &pe) {
+			break
+		}
+		err = pe.Wrapped
+	}
+	return nil, false
+}
+
+// connectFailed counts a new upstream connection that failed with err by its
+// stage, returning its ConnectError
+func connectFailed(sdWith *statsd.Client, err error) *ConnectError {
+	ce := connectError(err)
+	connectStageCounters[ce.Stage].Incr(sdWith)
+	return ce
+}
+
+const (
+	minInitBackoff = time.Second
+	maxInitBackoff = time.Minute
+)
+
+// initBackoff holds off the dials of an upstream's pools once it rejected the
+// AUTH or the SELECT of one of their new connections, which it would go on
+// rejecting. A pool that clients wait on dials as fast as its connections fail, which is
+// right for a dial that timed out, but would retry rejected credentials in a
+// tight loop, and could get the account locked out. Dials fail with the
+// rejection until the backoff is over, which doubles with each rejection in a
+// row, up to maxInitBackoff.
+type initBackoff struct {
+	mu    sync.Mutex
+	until time.Time
+	delay time.Duration
+	err   *ConnectError
+}
+
+// held is the rejection dials fail with at now, nil if they may go ahead
+func (b *initBackoff) held(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil || !now.Before(b.until) {
+		return nil
+	}
+	return b.err
+}
+
+// done records the outcome of a dial at now, which failed with err if set
+func (b *initBackoff) done(now time.Time, err *ConnectError) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case err == nil:
+		b.delay, b.err = 0, nil
+		return
+	case err.Stage != ConnectAuth && err.Stage != ConnectSelect:
+		return
+	}
+	b.delay *= 2
+	if b.delay < minInitBackoff {
+		b.delay = minInitBackoff
+	}
+	if b.delay > maxInitBackoff {
+		b.delay = maxInitBackoff
+	}
+	b.until, b.err = now.Add(b.delay), err
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestConnectErrorStages(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_ = closed.Close()
+	_, refused := net.Dial("tcp", closed.Addr().String())
+	_, unresolved := net.DefaultResolver.LookupHost(context.Background(), "redis.invalid")
+
+	for _, c := range []struct {
+		err   error
+		stage ConnectStage
+	}{
+		{refused, ConnectRefused},
+		{unresolved, ConnectDNS},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), ConnectTimeout},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, ConnectTimeout},
+		{&ConnectError{Stage: ConnectTLS, Err: errors.New("bad certificate")}, ConnectTLS},
+		{&UpstreamAuthError{Command: "AUTH", Reply: "WRONGPASS"}, ConnectAuth},
+		{&UpstreamAuthError{Command: "SELECT", Reply: "NOAUTH"}, ConnectSelect},
+		{&UpstreamAuthError{Command: "HELLO", Reply: "NOPROTO"}, ConnectHello},
+		{errors.New("network is unreachable"), ConnectOther},
+	} {
+		ce := connectError(c.err)
+		assert.Equal(t, c.stage, ce.Stage, c.err.Error())
+		assert.True(t, errors.Is(ce, c.err) || ce == c.err, "the cause is kept")
+	}
+
+	ce := &ConnectError{Stage: ConnectRefused, Err: errors.New("connection refused")}
+	assert.EqualError(t, ce, "dial.refused: connection refused")
+	found, ok := connectErrorOf(pool.ConnectionError{Address: "127.0.0.1:6379", Wrapped: ce})
+	assert.True(t, ok, "found under the error of the checkout")
+	assert.Equal(t, ce, found)
+	_, ok = connectErrorOf(errors.New("pool closed"))
+	assert.False(t, ok)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestInitBackoff(t *testing.T) {
+	var b initBackoff
+	now := time.Now()
+	assert.NoError(t, b.held(now))
+
+	b.done(now, &ConnectError{Stage: ConnectTimeout, Err: context.DeadlineExceeded})
+	assert.NoError(t, b.held(now), "a dial that timed out is retried right away")
+
+	rejected := &ConnectError{Stage: ConnectAuth, Err: errors.New("WRONGPASS")}
+	b.done(now, rejected)
+	assert.Equal(t, rejected, b.held(now.Add(time.Second/2)))
+	assert.NoError(t, b.held(now.Add(time.Second)))
+	b.done(now, rejected)
+	assert.Equal(t, rejected, b.held(now.Add(time.Second)), "the backoff doubles")
+	assert.NoError(t, b.held(now.Add(2*time.Second)))
+	for i := 0; i < 10; i++ {
+		b.done(now, rejected)
+	}
+	assert.NoError(t, b.held(now.Add(maxInitBackoff)), "up to maxInitBackoff")
+
+	b.done(now, nil)
+	assert.NoError(t, b.held(now))
+	b.done(now, rejected)
+	assert.NoError(t, b.held(now.Add(time.Second)), "starting over once a dial goes through")
+}
+
+func TestPoolBacksOffRejectedCredentials(t *testing.T) {
+	s := newAuthServer(t)
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, &config.Config{}, &config.Upstream{
+		UpstreamConfigHost: s.Address(),
+		Database:           -1,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+		Credentials:        config.Credentials{User: "proxy", Password: "wrong"},
+	})
+	assert.NoError(t, err)
+	server, err := p.connectServer(zap.NewNop(), sd, s.Address(), nil, &poolCounts{maxSize: 1}, -1)
+	assert.NoError(t, err)
+	defer func() { _ = server.Disconnect(context.Background()) }()
+
+	checkout := func() error {
+		conn, err := server.Connection(context.Background())
+		if err == nil {
+			_ = conn.Return()
+		}
+		return err
+	}
+	err = checkout()
+	ce, ok := connectErrorOf(err)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, ConnectAuth, ce.Stage)
+	}
+	assert.Equal(t, []string{"AUTH proxy wrong"}, s.Commands())
+
+	err = checkout()
+	ce, ok = connectErrorOf(err)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, ConnectAuth, ce.Stage)
+	}
+	assert.Len(t, s.Commands(), 1, "the upstream isn't dialed again while the backoff holds")
+
+	p.credentials = config.Credentials{User: "proxy", Password: "s3cret"}
+	p.initBackoff.until = time.Time{}
+	assert.NoError(t, checkout())
+	assert.Equal(t, []string{"AUTH proxy wrong", "AUTH proxy s3cret"}, s.Commands())
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/handlers"
+	redisproto "github.com/coinbase/redisbetween/redis"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// dbNode is a standalone upstream with numbered databases, each connection on
+// the one it last SELECTed
+type dbNode struct {
+	sync.Mutex
+	li  net.Listener
+	dbs map[int]map[string]string
+}
+
+func newDBNode(t *testing.T) *dbNode {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	n := &dbNode{li: li, dbs: make(map[int]map[string]string)}
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = li.Close() })
+	return n
+}
+
+func (n *dbNode) Address() string {
+	return n.li.Addr().String()
+}
+
+func (n *dbNode) get(db int, key string) string {
+	n.Lock()
+	defer n.Unlock()
+	return n.dbs[db][key]
+}
+
+func (n *dbNode) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	d := redisproto.NewDecoder(conn)
+	db := 0
+	for {
+		m, err := d.Decode()
+		if err != nil {
+			return
+		}
+		args := make([]string, len(m.Array))
+		for i, a := range m.Array {
+			args[i] = string(a.Value)
+		}
+		var r *redisproto.Message
+		n.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "SELECT":
+			db, _ = strconv.Atoi(args[1])
+			r = redisproto.NewString([]byte("OK"))
+		case "SET":
+			if n.dbs[db] == nil {
+				n.dbs[db] = make(map[string]string)
+			}
+			n.dbs[db][args[1]] = args[2]
+			r = redisproto.NewString([]byte("OK"))
+		case "GET":
+			if v, ok := n.dbs[db][args[1]]; ok {
+				r = redisproto.NewBulkBytes([]byte(v))
+			} else {
+				r = redisproto.NewBulkBytes(nil)
+			}
+		case "SWAPDB":
+			a, _ := strconv.Atoi(args[1])
+			b, _ := strconv.Atoi(args[2])
+			n.dbs[a], n.dbs[b] = n.dbs[b], n.dbs[a]
+			r = redisproto.NewString([]byte("OK"))
+		case "FLUSHDB":
+			delete(n.dbs, db)
+			r = redisproto.NewString([]byte("OK"))
+		default:
+			r = redisproto.NewString([]byte("PONG"))
+		}
+		n.Unlock()
+		if err := redisproto.Encode(conn, r); err != nil {
+			return
+		}
+	}
+}
+
+func startDBProxy(t *testing.T, cfg *config.Config, node string, db int, databases *handlers.Databases) *Proxy {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{
+		UpstreamConfigHost: node,
+		Database:           db,
+		MaxPoolSize:        4,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+	})
+	assert.NoError(t, err)
+	p.ShareDatabases(databases)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(p.localConfigHost)
+		return err == nil
+	}, time.Second, time.Millisecond)
+	return p
+}
+
+func TestSwapDB(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true, AllowSwapDB: true}
+	databases := handlers.NewDatabases()
+	two := setupStandaloneClient(t, startDBProxy(t, cfg, node.Address(), 2, databases).localConfigHost)
+	defer func() { _ = two.Close() }()
+	three := setupStandaloneClient(t, startDBProxy(t, cfg, node.Address(), 3, databases).localConfigHost)
+	defer func() { _ = three.Close() }()
+
+	ctx := context.Background()
+	assert.NoError(t, two.Set(ctx, "k", "two", 0).Err())
+	assert.NoError(t, three.Set(ctx, "k", "three", 0).Err())
+	assert.NoError(t, two.Do(ctx, "SWAPDB", "2", "3").Err())
+
+	// clients stay on their database, now holding the other's data, as they
+	// would connected to redis directly: pooled connections are on a database
+	// by number, which a swap doesn't change
+	for i := 0; i < 8; i++ {
+		assert.Equal(t, "three", two.Get(ctx, "k").Val())
+		assert.Equal(t, "two", three.Get(ctx, "k").Val())
+	}
+	assert.NoError(t, three.Set(ctx, "k", "new three", 0).Err())
+	assert.Equal(t, "new three", node.get(3, "k"))
+}
+
+func TestSwapDBRejectedByDefault(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	client := setupStandaloneClient(t, startDBProxy(t, cfg, node.Address(), 2, handlers.NewDatabases()).localConfigHost)
+	defer func() { _ = client.Close() }()
+
+	ctx := context.Background()
+	assert.NoError(t, client.Set(ctx, "k", "two", 0).Err())
+	err := client.Do(ctx, "SWAPDB", "2", "3").Err()
+	assert.EqualError(t, err, "PROXYBLOCKED SWAPDB would swap databases under every client sharing the upstream through the proxy's pool. Start the proxy with -allowswapdb to allow it")
+	assert.Equal(t, "two", client.Get(ctx, "k").Val())
+}
+
+func TestDynamicDB(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{
+		UpstreamConfigHost: node.Address(),
+		Database:           -1,
+		MaxPoolSize:        4,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+		DynamicDB:          true,
+		MaxDBs:             4,
+		DBIdleTimeout:      time.Millisecond,
+	})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(p.localConfigHost)
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	// one socket for every database, each client's selected on connect
+	ctx := context.Background()
+	clients := make([]*redis.Client, 3)
+	for db := range clients {
+		clients[db] = redis.NewClient(&redis.Options{Network: "unix", Addr: p.localConfigHost, DB: db, MaxRetries: 1})
+		defer func(c *redis.Client) { _ = c.Close() }(clients[db])
+		assert.NoError(t, clients[db].Set(ctx, "k", "db"+strconv.Itoa(db), 0).Err())
+	}
+	for db, c := range clients {
+		assert.Equal(t, "db"+strconv.Itoa(db), c.Get(ctx, "k").Val())
+		assert.Equal(t, "db"+strconv.Itoa(db), node.get(db, "k"))
+	}
+	p.listenerLock.Lock()
+	l := p.listeners[node.Address()]
+	p.listenerLock.Unlock()
+	assert.Equal(t, []int{1, 2}, l.options.DBPools.DBs())
+
+	// idle databases are disconnected, and connected again when next used
+	assert.Eventually(t, func() bool { return len(l.options.DBPools.DBs()) == 0 }, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "db2", clients[2].Get(ctx, "k").Val())
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"go.uber.org/zap"
+)
+
+// familyFallbackTimeout bounds a dial to one of an upstream's addresses while
+// others remain to be tried, so that an address family that doesn't route, like
+// IPv6 in a VPC without it, costs a short wait rather than the whole dial timeout
+const familyFallbackTimeout = 2 * time.Second
+
+// familyDialer dials upstreams given by name one resolved address at a time,
+// starting with the address family that last connected and falling back to the
+// others. It is a lite happy eyeballs: attempts don't race, but one stuck on a
+// family that doesn't connect gives up quickly, and the family that works is
+// tried first from then on. Addresses that are IP literals are dialed directly.
+// A name that fails to resolve is dialed on the addresses it last connected on,
+// if it ever did, so that a DNS outage doesn't stop the pools replacing their
+// connections to upstreams whose addresses haven't changed.
+type familyDialer struct {
+	log     *zap.Logger
+	statsd  *statsd.Client
+	timeout time.Duration
+	lookup  func(ctx context.Context, host string) ([]net.IPAddr, error)
+	dial    func(ctx context.Context, network, address string) (net.Conn, error)
+	known   *knownAddresses
+
+	// preferred is 4 or 6, the family of the last address that connected
+	preferred int32
+}
+
+func newFamilyDialer(log *zap.Logger, sd *statsd.Client, timeout time.Duration) *familyDialer {
+	d := &net.Dialer{Timeout: timeout}
+	return &familyDialer{log: log, statsd: sd, timeout: timeout, lookup: net.DefaultResolver.LookupIPAddr, dial: d.DialContext, known: lastKnownAddresses}
+}
+
+func (d *familyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || network != "tcp" || net.ParseIP(host) != nil {
+		return d.dial(ctx, network, address)
+	}
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		if ips = d.stale(ctx, host, err); ips == nil {
+			return nil, err
+		}
+	} else if d.known.resolved(host) {
+		d.log.Info("Upstream host name resolves again", zap.String("host", host))
+	}
+	resolved := ips
+	ips = d.order(ips)
+	var firstErr error
+	for i, ip := range ips {
+		attempt := ctx
+		if i < len(ips)-1 {
+			var cancel context.CancelFunc
+			attempt, cancel = context.WithTimeout(ctx, familyFallbackTimeout)
+			defer cancel()
+		}
+		conn, err := d.dial(attempt, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			atomic.StoreInt32(&d.preferred, family(ip.IP))
+			d.known.connected(host, resolved)
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// stale returns the addresses host last connected on, to be dialed in place of
+// those it failed to resolve to with err, or nil if it never connected, or if
+// the dial is given up already. The first fallback of an outage is logged.
+func (d *familyDialer) stale(ctx context.Context, host string, err error) []net.IPAddr {
+	if ctx.Err() != nil {
+		return nil
+	}
+	ips, first := d.known.fallback(host)
+	if ips == nil {
+		return nil
+	}
+	metrics.DNSStaleFallback.Incr(d.statsd)
+	if first {
+		addrs := make([]string, len(ips))
+		for i, ip := range ips {
+			addrs[i] = ip.String()
+		}
+		d.log.Warn("Upstream host name failed to resolve, using the addresses it last connected on", zap.String("host", host), zap.Strings("addresses", addrs), zap.Error(err))
+	}
+	return ips
+}
+
+// lastKnownAddresses is shared by every dialer, so that the pools of an upstream,
+// and upstreams that share a host name, fall back on each other's connections
+var lastKnownAddresses = newKnownAddresses()
+
+// knownAddresses are the addresses each host name last resolved to when one of
+// them connected, and whether the name fails to resolve since
+type knownAddresses struct {
+	mu    sync.Mutex
+	hosts map[string][]net.IPAddr
+	stale map[string]bool
+}
+
+func newKnownAddresses() *knownAddresses {
+	return &knownAddresses{hosts: make(map[string][]net.IPAddr), stale: make(map[string]bool)}
+}
+
+// connected records ips as the addresses of host, one of which connected
+func (k *knownAddresses) connected(host string, ips []net.IPAddr) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.hosts[host] = ips
+}
+
+// fallback returns the known addresses of host, marking it stale, and whether it
+// wasn't already
+func (k *knownAddresses) fallback(host string) ([]net.IPAddr, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ips, ok := k.hosts[host]
+	if !ok {
+		return nil, false
+	}
+	first := !k.stale[host]
+	k.stale[host] = true
+	return ips, first
+}
+
+// resolved marks host as resolving, returning whether it was stale until now
+func (k *knownAddresses) resolved(host string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	stale := k.stale[host]
+	delete(k.stale, host)
+	return stale
+}
+
+// order moves the addresses of the preferred family first, keeping the
+// resolver's order otherwise
+func (d *familyDialer) order(ips []net.IPAddr) []net.IPAddr {
+	preferred := atomic.LoadInt32(&d.preferred)
+	if preferred == 0 {
+		return ips
+	}
+	ordered := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		if family(ip.IP) == preferred {
+			ordered = append(ordered, ip)
+		}
+	}
+	for _, ip := range ips {
+		if family(ip.IP) != preferred {
+			ordered = append(ordered, ip)
+		}
+	}
+	return ordered
+}
+
+func family(ip net.IP) int32 {
+	if ip.To4() != nil {
+		return 4
+	}
+	return 6
+}
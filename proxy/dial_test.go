@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestFamilyDialer(t *testing.T) {
+	var dialed []string
+	var bounded []bool
+	d := newFamilyDialer(zap.NewNop(), nil, time.Second)
+	d.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		assert.Equal(t, "redis.internal", host)
+		return []net.IPAddr{{IP: net.ParseIP("2600:1f14::12")}, {IP: net.ParseIP("10.0.0.12")}}, nil
+	}
+	d.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		_, ok := ctx.Deadline()
+		bounded = append(bounded, ok)
+		if address == "[2600:1f14::12]:6379" {
+			return nil, errors.New("network is unreachable")
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}
+
+	conn, err := d.DialContext(context.Background(), "tcp", "redis.internal:6379")
+	assert.NoError(t, err)
+	_ = conn.Close()
+	assert.Equal(t, []string{"[2600:1f14::12]:6379", "10.0.0.12:6379"}, dialed)
+	assert.Equal(t, []bool{true, false}, bounded, "only attempts with a fallback left are bounded")
+
+	dialed = nil
+	conn, err = d.DialContext(context.Background(), "tcp", "redis.internal:6379")
+	assert.NoError(t, err)
+	_ = conn.Close()
+	assert.Equal(t, []string{"10.0.0.12:6379"}, dialed, "the family that connected is tried first")
+
+	dialed = nil
+	conn, err = d.DialContext(context.Background(), "tcp", "[2600:1f14::12]:6379")
+	assert.Error(t, err)
+	assert.Nil(t, conn)
+	assert.Equal(t, []string{"[2600:1f14::12]:6379"}, dialed, "literals are dialed as they are")
+}
+
+func TestFamilyDialerAllFail(t *testing.T) {
+	d := newFamilyDialer(zap.NewNop(), nil, time.Second)
+	d.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	d.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("refused " + address)
+	}
+	_, err := d.DialContext(context.Background(), "tcp", "localhost:6379")
+	assert.EqualError(t, err, "refused [::1]:6379", "the first error is returned")
+}
+
+func TestFamilyDialerStaleFallback(t *testing.T) {
+	var dialed []string
+	var lookupErr error
+	addr := "10.0.0.12"
+	d := newFamilyDialer(zap.NewNop(), nil, time.Second)
+	d.known = newKnownAddresses()
+	d.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return []net.IPAddr{{IP: net.ParseIP(addr)}}, nil
+	}
+	d.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}
+	dial := func() error {
+		conn, err := d.DialContext(context.Background(), "tcp", "redis.internal:6379")
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err
+	}
+
+	lookupErr = &net.DNSError{Err: "server misbehaving", Name: "redis.internal", IsTemporary: true}
+	assert.Error(t, dial(), "a name that never connected has nothing to fall back on")
+	assert.Empty(t, dialed)
+
+	lookupErr = nil
+	assert.NoError(t, dial())
+
+	// the DNS goes down, and the pool keeps replacing its connections
+	lookupErr = &net.DNSError{Err: "i/o timeout", Name: "redis.internal", IsTimeout: true}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, dial())
+	}
+	assert.Equal(t, []string{"10.0.0.12:6379", "10.0.0.12:6379", "10.0.0.12:6379", "10.0.0.12:6379"}, dialed)
+	assert.True(t, d.known.stale["redis.internal"])
+
+	// and comes back with the upstream moved
+	lookupErr, addr, dialed = nil, "10.0.0.13", nil
+	assert.NoError(t, dial())
+	assert.Equal(t, []string{"10.0.0.13:6379"}, dialed)
+	assert.False(t, d.known.stale["redis.internal"])
+	lookupErr, dialed = errors.New("lookup failed"), nil
+	assert.NoError(t, dial())
+	assert.Equal(t, []string{"10.0.0.13:6379"}, dialed, "the address that last connected")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := d.DialContext(ctx, "tcp", "redis.internal:6379")
+	assert.Equal(t, lookupErr, err, "a dial given up doesn't fall back")
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coinbase/redisbetween/atomicfile"
+	"github.com/coinbase/redisbetween/discovery"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/sanitize"
+	"go.uber.org/zap"
+)
+
+// Discovery publishes the authoritative upstream to socket path mapping of all
+// proxies in the process, so that clients don't have to derive socket paths
+// themselves. The mapping is served by PROXY SOCKETS and the admin /sockets route,
+// and written to a file whenever a listener starts or a proxy stops.
+type Discovery struct {
+	log     *zap.Logger
+	path    string
+	mu      sync.Mutex
+	proxies []*Proxy
+	// serializes refreshes, so that an older mapping never replaces a newer one
+	writeMu  sync.Mutex
+	onChange func()
+}
+
+// NewDiscovery creates a discovery writing to path, or only serving the mapping
+// if path is empty
+func NewDiscovery(log *zap.Logger, path string) *Discovery {
+	return &Discovery{log: log.With(zap.String("discovery", path)), path: path}
+}
+
+// Register adds a proxy's sockets to the mapping. It must be called before the
+// proxy runs.
+func (d *Discovery) Register(p *Proxy) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.proxies = append(d.proxies, p)
+	p.discovery = d
+}
+
+// Deregister removes a proxy's sockets from the mapping, once it is replaced or
+// removed by a reload
+func (d *Discovery) Deregister(p *Proxy) {
+	d.mu.Lock()
+	for i, q := range d.proxies {
+		if q == p {
+			d.proxies = append(d.proxies[:i:i], d.proxies[i+1:]...)
+			break
+		}
+	}
+	d.mu.Unlock()
+	d.Refresh()
+}
+
+// Sockets lists the sockets of all running proxies, ordered by upstream and database
+func (d *Discovery) Sockets() []handlers.Socket {
+	d.mu.Lock()
+	proxies := d.proxies
+	d.mu.Unlock()
+
+	sockets := make([]handlers.Socket, 0)
+	for _, p := range proxies {
+		sockets = append(sockets, p.Sockets()...)
+	}
+	sort.Slice(sockets, func(i, j int) bool {
+		if sockets[i].Upstream != sockets[j].Upstream {
+			return sockets[i].Upstream < sockets[j].Upstream
+		}
+		return sockets[i].Database < sockets[j].Database
+	})
+	return sockets
+}
+
+// OnChange calls fn whenever the mapping may have changed, after the discovery
+// file is rewritten. It must be called before the proxies run.
+func (d *Discovery) OnChange(fn func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onChange = fn
+}
+
+// Registrations describes the sockets of all running proxies for a service
+// discovery backend, see Proxy.Registrations
+func (d *Discovery) Registrations(version string) []discovery.Registration {
+	d.mu.Lock()
+	proxies := d.proxies
+	d.mu.Unlock()
+
+	registrations := make([]discovery.Registration, 0)
+	for _, p := range proxies {
+		registrations = append(registrations, p.Registrations(version)...)
+	}
+	return registrations
+}
+
+// Refresh rewrites the discovery file
+func (d *Discovery) Refresh() {
+	d.mu.Lock()
+	onChange := d.onChange
+	d.mu.Unlock()
+	if onChange != nil {
+		defer onChange()
+	}
+	if d.path == "" {
+		return
+	}
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	b, err := json.MarshalIndent(map[string]interface{}{"sockets": d.Sockets()}, "", "  ")
+	if err == nil {
+		err = atomicfile.Write(d.path, b, 0644)
+	}
+	if err != nil {
+		d.log.Error("Failed to write discovery file", zap.Error(err))
+	}
+}
+
+// Sockets lists the sockets this proxy listens on, or none once it has shut down
+func (p *Proxy) Sockets() []handlers.Socket {
+	select {
+	case <-p.quit:
+		return nil
+	default:
+	}
+
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	sockets := make([]handlers.Socket, 0, len(p.listeners))
+	for _, l := range p.listeners {
+		sockets = append(sockets, handlers.Socket{Upstream: l.upstream, Database: p.database, Local: l.local})
+	}
+	return sockets
+}
+
+// Registrations describes the sockets this proxy listens on for a service
+// discovery backend, as the service named by the proxy's label, or redisbetween
+// without one. The address of a unix socket is its path.
+func (p *Proxy) Registrations(version string) []discovery.Registration {
+	name := p.label
+	if name == "" {
+		name = "redisbetween"
+	}
+	registrations := make([]discovery.Registration, 0)
+	for _, s := range p.Sockets() {
+		r := discovery.Registration{
+			ID:      "redisbetween-" + sanitize.PathComponent(strings.Trim(strings.Replace(s.Local, "/", "-", -1), "-")),
+			Name:    name,
+			Address: s.Local,
+			Tags:    []string{"redisbetween", p.config.Network},
+			Meta: map[string]string{
+				"upstream": s.Upstream,
+				"db":       strconv.Itoa(s.Database),
+				"version":  version,
+			},
+		}
+		if !strings.HasPrefix(p.config.Network, "unix") {
+			if host, port, err := net.SplitHostPort(s.Local); err == nil {
+				r.Address = host
+				r.Port, _ = strconv.Atoi(port)
+			}
+		}
+		registrations = append(registrations, r)
+	}
+	return registrations
+}
+
+func (p *Proxy) refreshDiscovery() {
+	if p.discovery != nil {
+		p.discovery.Refresh()
+	}
+}
+
+func (p *Proxy) sockets() []handlers.Socket {
+	if p.discovery != nil {
+		return p.discovery.Sockets()
+	}
+	return p.Sockets()
+}
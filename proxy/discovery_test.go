@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/discovery"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDiscoveryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "rb-sockets.json")
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(dir, "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	discovery := NewDiscovery(zap.NewNop(), path)
+	var proxies []*Proxy
+	for _, db := range []int{-1, 3} {
+		p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: "127.0.0.1:7000", Database: db, MaxPoolSize: 1})
+		assert.NoError(t, err)
+		discovery.Register(p)
+		proxies = append(proxies, p)
+		go func() { _ = p.Run() }()
+	}
+
+	read := func() []handlers.Socket {
+		var file struct{ Sockets []handlers.Socket }
+		b, err := ioutil.ReadFile(path)
+		if err != nil || json.Unmarshal(b, &file) != nil {
+			return nil
+		}
+		return file.Sockets
+	}
+	socket := func(upstream string, db int, local string) handlers.Socket {
+		return handlers.Socket{Upstream: upstream, Database: db, Local: filepath.Join(dir, local)}
+	}
+
+	expected := []handlers.Socket{
+		socket("127.0.0.1:7000", -1, "rb-127.0.0.1-7000.sock"),
+		socket("127.0.0.1:7000", 3, "rb-127.0.0.1-7000-3.sock"),
+	}
+	assert.Eventually(t, func() bool { return assert.ObjectsAreEqual(expected, read()) }, time.Second, 10*time.Millisecond)
+
+	// a cluster node discovered through CLUSTER SLOTS is added to the file
+	proxies[0].ensureListenerForUpstream("127.0.0.1:7001", "CLUSTER SLOTS")
+	expected = []handlers.Socket{expected[0], expected[1], socket("127.0.0.1:7001", -1, "rb-127.0.0.1-7001.sock")}
+	assert.Equal(t, expected, read())
+	assert.Equal(t, expected, discovery.Sockets())
+
+	proxies[0].Shutdown()
+	assert.Equal(t, []handlers.Socket{expected[1]}, read(), "a stopped proxy is removed")
+	proxies[1].Shutdown()
+	assert.Empty(t, read())
+}
+
+func TestDiscoveryRegistrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registrations")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(dir, "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	d := NewDiscovery(zap.NewNop(), "")
+	changed := make(chan struct{}, 10)
+	d.OnChange(func() { changed <- struct{}{} })
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: "127.0.0.1:7000", Label: "sessions", Database: 3, MaxPoolSize: 1})
+	assert.NoError(t, err)
+	d.Register(p)
+	go func() { _ = p.Run() }()
+	defer p.Shutdown()
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("a starting listener changes the mapping")
+	}
+
+	local := filepath.Join(dir, "rb-127.0.0.1-7000-3.sock")
+	assert.Equal(t, []discovery.Registration{{
+		ID:      "redisbetween-" + strings.Trim(strings.Replace(local, "/", "-", -1), "-"),
+		Name:    "sessions",
+		Address: local,
+		Tags:    []string{"redisbetween", "unix"},
+		Meta:    map[string]string{"upstream": "127.0.0.1:7000", "db": "3", "version": "v1.2.0"},
+	}}, d.Registrations("v1.2.0"))
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/config"
+)
+
+// LinkReadFallbacks makes each proxy whose upstream has a readfallback retry its
+// reads against the proxy of that upstream, proxies being those of c's
+// upstreams in order and targets the proxies reads fall back to for each of
+// them. It must be called before they run, and only links those that aren't
+// linked already, which are the new ones of a reload. A reload gives as the
+// target of a changed upstream its running proxy, which configuredServer
+// follows to the new one once it took over, so that a new proxy failing to take
+// over never leaves a fallback to it.
+func LinkReadFallbacks(c *config.Config, proxies, targets []*Proxy) {
+	for i, u := range c.Upstreams {
+		if u.ReadFallback.Upstream == "" || proxies[i].readFallback != nil {
+			continue
+		}
+		if j := config.FindUpstream(c.Upstreams, u.ReadFallback.Upstream); j >= 0 && j != i {
+			proxies[i].readFallback = targets[j]
+		}
+	}
+}
+
+// configuredServer returns the pool of the listener of the configured upstream,
+// or of the proxy that took it over, or nil until there is one
+func (p *Proxy) configuredServer() *pool.Server {
+	p.listenerLock.Lock()
+	l, ok := p.listeners[p.upstreamConfigHost]
+	successor := p.successor
+	p.listenerLock.Unlock()
+	if ok {
+		return l.server
+	}
+	if successor != nil {
+		return successor.configuredServer()
+	}
+	return nil
+}
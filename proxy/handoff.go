@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// maxSocketPath is the longest path a unix socket can be bound to on every
+// platform the proxy runs on, and handOffSuffix room for what handOffPath adds
+const (
+	maxSocketPath = 103
+	handOffSuffix = 24
+)
+
+// handOffSeq tells apart the paths sockets are bound to before they take the
+// place of their predecessors'
+var handOffSeq uint64
+
+// handOffPath is the path a socket taking over local's is bound to until it is
+// renamed to local
+func handOffPath(local string) string {
+	return fmt.Sprintf("%s.%d.%d", local, os.Getpid(), atomic.AddUint64(&handOffSeq, 1))
+}
+
+// dialPredecessor connects to the instance listening on local, if one is, for
+// the socket about to take local's place to be handed it. It returns nil
+// without -unlink, with which sockets are bound over those in the way, or if
+// there is nothing listening on local: no socket, or a stale one which is
+// unlinked as the socket is bound over it.
+func (p *Proxy) dialPredecessor(local string) net.Conn {
+	if !p.config.Unlink || !strings.Contains(p.config.Network, "unix") || len(local)+handOffSuffix > maxSocketPath {
+		return nil
+	}
+	if _, err := os.Stat(local); err != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout(p.config.Network, local, socketReadyTimeout)
+	if err != nil {
+		p.log.Info("Replacing a stale socket", zap.String("local", local), zap.Error(err))
+		return nil
+	}
+	return conn
+}
+
+// takeSocket takes the place of the predecessor's socket at the listener's path
+// once the listener's own socket listens: the predecessor is sent PROXY HANDOFF
+// over conn, and stops accepting before it answers, and the socket is then
+// given its permissions and renamed over the path, which is atomic. A
+// predecessor that doesn't answer OK has its socket replaced all the same, as
+// -unlink would, while a socket that doesn't listen leaves the predecessor's as
+// it was.
+func (p *Proxy) takeSocket(l *upstreamListener, conn net.Conn, stopped chan error) {
+	defer func() { _ = conn.Close() }()
+	bind := l.bound
+	logWith := p.log.With(zap.String("upstream", l.upstream), zap.String("local", l.local), zap.String("bound", bind))
+	if err := p.awaitSocket(bind, stopped); err != nil {
+		metrics.SocketHandOffs.Incr(p.statsd, "failed")
+		logWith.Error("Socket did not start, leaving the predecessor's in place", zap.Error(err))
+		l.Shutdown()
+		return
+	}
+
+	result := "handed_off"
+	if err := requestHandOff(conn); err != nil {
+		result = "replaced"
+		logWith.Warn("Predecessor did not hand off its socket, replacing it", zap.Error(err))
+	}
+	if err := p.placeSocket(bind, l.local); err != nil {
+		metrics.SocketHandOffs.Incr(p.statsd, "failed")
+		logWith.Error("Could not move the socket to its path", zap.Error(err))
+		l.Shutdown()
+		return
+	}
+	atomic.StoreInt32(&l.accepting, 1)
+	metrics.SocketHandOffs.Incr(p.statsd, result)
+	logWith.Info("Took over the predecessor's socket", zap.String("result", result))
+}
+
+// requestHandOff sends PROXY HANDOFF over conn, and reads its answer
+func requestHandOff(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(socketReadyTimeout))
+	cmd := redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("PROXY")), redis.NewBulkBytes([]byte("HANDOFF"))})
+	if err := redis.Encode(conn, cmd); err != nil {
+		return err
+	}
+	m, err := redis.NewDecoder(conn).Decode()
+	if err != nil {
+		return err
+	}
+	if !m.IsString() || string(m.Value) != "OK" {
+		return fmt.Errorf("unexpected PROXY HANDOFF reply %s", m.String())
+	}
+	return nil
+}
+
+// handOffFunc is the handlers.Options.HandOff of a listener, for proxies that
+// take the sockets of their predecessors at startup, and so hand theirs off in
+// turn
+func (p *Proxy) handOffFunc(l *upstreamListener) func(local string) error {
+	if !p.config.Unlink || !strings.Contains(p.config.Network, "unix") {
+		return nil
+	}
+	return func(local string) error {
+		return p.handOff(l, local)
+	}
+}
+
+// handOff stops accepting on the listener's socket at local for a successor,
+// once local is no longer the socket's, for the successor's to take its place
+func (p *Proxy) handOff(l *upstreamListener, local string) error {
+	p.listenerLock.Lock()
+	if l.local != local {
+		p.listenerLock.Unlock()
+		return fmt.Errorf("socket %s is retiring", local)
+	}
+	s, bound := l.Listener, l.bound == local
+	atomic.StoreInt32(&l.handedOff, 1)
+	p.listenerLock.Unlock()
+	p.log.Info("Handing off socket to a successor", zap.String("upstream", l.upstream), zap.String("local", local))
+	s.Shutdown()
+	if bound {
+		awaitRemoved(local)
+	}
+	return nil
+}
+
+// HandedOff is whether every socket of the proxy was handed off to a successor
+func (p *Proxy) HandedOff() bool {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	if len(p.listeners) == 0 {
+		return false
+	}
+	for _, l := range p.listeners {
+		if atomic.LoadInt32(&l.handedOff) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	redisproto "github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// connections is how many client connections the proxy has accepted, the
+// heartbeats of its sockets starting possibly among them
+func connections(p *Proxy) int64 {
+	return p.Stats().Connections
+}
+
+// pingSocket sends a PING over a new connection to local
+func pingSocket(t *testing.T, local string) {
+	t.Helper()
+	conn, err := net.Dial("unix", local)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	writeCommand(t, conn, "PING")
+	m, err := redisproto.NewDecoder(conn).Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "+PONG \\r\\n ", m.String())
+}
+
+func startHandOffProxy(t *testing.T, cfg *config.Config, node string) *Proxy {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: node, Database: -1, MaxPoolSize: 4, ReadTimeout: time.Second, WriteTimeout: time.Second})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, p.Listening, 5*time.Second, time.Millisecond)
+	return p
+}
+
+func TestHandOffLivePredecessor(t *testing.T) {
+	node := newDBNode(t)
+	dir := t.TempDir()
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(dir, "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	old := startHandOffProxy(t, cfg, node.Address())
+	local := old.localConfigHost
+	pingSocket(t, local)
+
+	// a client of the old instance is served until it disconnects
+	client, err := net.Dial("unix", local)
+	assert.NoError(t, err)
+	defer func() { _ = client.Close() }()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	dec := redisproto.NewDecoder(client)
+
+	next := startHandOffProxy(t, cfg, node.Address())
+	assert.True(t, old.HandedOff())
+	assert.False(t, next.HandedOff())
+	before, served := connections(old), connections(next)
+	pingSocket(t, local)
+	assert.Equal(t, before, connections(old), "the old instance accepts no more")
+	assert.Equal(t, served+1, connections(next))
+
+	writeCommand(t, client, "SET", "k", "v")
+	m, err := dec.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK \\r\\n ", m.String())
+
+	// a successor's own socket, renamed over the path, is handed off in turn,
+	// and left in place as it shuts down
+	last := startHandOffProxy(t, cfg, node.Address())
+	assert.True(t, next.HandedOff())
+	next.Shutdown()
+	served = connections(last)
+	pingSocket(t, local)
+	assert.Equal(t, served+1, connections(last))
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "only the socket, at its path")
+
+	// and the last one removes it
+	last.Shutdown()
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(local)
+		return os.IsNotExist(err)
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestHandOffStaleSocket(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	local := localSocketPathFromUpstream(node.Address(), -1, cfg.LocalSocketPrefix, cfg.LocalSocketSuffix)
+	// the socket of an instance that crashed, which nothing accepts on
+	li, err := net.ListenUnix("unix", &net.UnixAddr{Name: local, Net: "unix"})
+	assert.NoError(t, err)
+	li.SetUnlinkOnClose(false)
+	assert.NoError(t, li.Close())
+	_, err = os.Stat(local)
+	assert.NoError(t, err)
+
+	p := startHandOffProxy(t, cfg, node.Address())
+	assert.Equal(t, local, p.localConfigHost)
+	served := connections(p)
+	pingSocket(t, local)
+	assert.Equal(t, served+1, connections(p))
+	assert.False(t, p.HandedOff())
+}
+
+func TestHandOffUnavailableWithoutUnlink(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock"}
+	p := startHandOffProxy(t, cfg, node.Address())
+	conn, err := net.Dial("unix", p.localConfigHost)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	writeCommand(t, conn, "PROXY", "HANDOFF")
+	m, err := redisproto.NewDecoder(conn).Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "-ERR PROXY HANDOFF is not available \\r\\n ", m.String())
+	assert.False(t, p.HandedOff())
+}
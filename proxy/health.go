@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// Listening is whether the proxy's listener for its upstream is accepting
+// client connections
+func (p *Proxy) Listening() bool {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	l, ok := p.listeners[p.upstreamConfigHost]
+	return ok && atomic.LoadInt32(&l.accepting) == 1
+}
+
+// Starting returns the names of the proxies reported on that aren't listening
+// yet
+func (d *DrainReport) Starting() []string {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	proxies := d.proxies
+	d.mu.Unlock()
+	var starting []string
+	for _, p := range proxies {
+		if !p.Listening() {
+			starting = append(starting, p.Name())
+		}
+	}
+	return starting
+}
+
+// NodeReadiness is the outcome of the PING /readyz sent a node through the
+// pool of one of an upstream's listeners
+type NodeReadiness struct {
+	Upstream string `json:"upstream"`
+	Node     string `json:"node"`
+	Error    string `json:"error,omitempty"`
+	// Stage is the stage a new connection to the node failed at, when that is
+	// why the PING did, such as dial.refused or init.auth_error
+	Stage ConnectStage `json:"stage,omitempty"`
+}
+
+// ReadyHandler answers GET /readyz with 200 once the process is healthy, as
+// HealthHandler has it, and every listener of proxies checked out a connection
+// of its pool and had it answer a PING within timeout, or 503 along with the
+// nodes that didn't
+func ReadyHandler(proxies []*Proxy, w *Watchdog, d *DrainReport, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if ok, status := Health(w, d); !ok {
+			admin.WriteJSON(rw, http.StatusServiceUnavailable, map[string]interface{}{"status": status})
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		nodes := pingNodes(ctx, proxies)
+		code, status := http.StatusOK, "ready"
+		for _, n := range nodes {
+			if n.Error != "" {
+				code, status = http.StatusServiceUnavailable, "not_ready"
+			}
+		}
+		admin.WriteJSON(rw, code, map[string]interface{}{"status": status, "nodes": nodes})
+	})
+}
+
+// pingNodes sends a PING through the pool of each listener of proxies at once,
+// sorted by upstream and node
+func pingNodes(ctx context.Context, proxies []*Proxy) []NodeReadiness {
+	var nodes []NodeReadiness
+	var owners []*Proxy
+	var checks []*upstreamListener
+	for _, p := range proxies {
+		p.listenerLock.Lock()
+		for _, l := range p.listeners {
+			nodes = append(nodes, NodeReadiness{Upstream: p.Name(), Node: l.upstream})
+			owners = append(owners, p)
+			checks = append(checks, l)
+		}
+		p.listenerLock.Unlock()
+	}
+	var wg sync.WaitGroup
+	for i, l := range checks {
+		wg.Add(1)
+		go func(n *NodeReadiness, p *Proxy, l *upstreamListener) {
+			defer wg.Done()
+			if err := p.ping(ctx, l.server); err != nil {
+				n.Error = err.Error()
+				if ce, ok := connectErrorOf(err); ok {
+					n.Stage = ce.Stage
+				}
+			}
+		}(&nodes[i], owners[i], l)
+	}
+	wg.Wait()
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Upstream != nodes[j].Upstream {
+			return nodes[i].Upstream < nodes[j].Upstream
+		}
+		return nodes[i].Node < nodes[j].Node
+	})
+	return nodes
+}
+
+// ping checks out a connection of the pool s and has it answer a PING before
+// the deadline of ctx
+func (p *Proxy) ping(ctx context.Context, s *pool.Server) error {
+	readTimeout, writeTimeout := p.readTimeout, p.writeTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		readTimeout, writeTimeout = time.Until(deadline), time.Until(deadline)
+	}
+	wm := []*redis.Message{redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("PING"))})}
+	res, err := handlers.Exchange(ctx, p.log, s, wm, readTimeout, writeTimeout)
+	if err != nil {
+		return err
+	}
+	return checkPong(res[0])
+}
+
+// checkPong fails unless m is the PONG of a PING
+func checkPong(m *redis.Message) error {
+	if !m.IsString() || string(m.Value) != "PONG" {
+		return fmt.Errorf("unexpected PING reply %s", m.String())
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func readyz(proxies []*Proxy, d *DrainReport) (int, string, []NodeReadiness) {
+	rec := httptest.NewRecorder()
+	ReadyHandler(proxies, nil, d, 200*time.Millisecond).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var res struct {
+		Status string          `json:"status"`
+		Nodes  []NodeReadiness `json:"nodes"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &res)
+	return rec.Code, res.Status, res.Nodes
+}
+
+func TestHealthStarting(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: node.Address(), MaxPoolSize: 4, ReadTimeout: time.Second, WriteTimeout: time.Second})
+	assert.NoError(t, err)
+	d := NewDrainReport([]*Proxy{p})
+
+	assert.Equal(t, http.StatusServiceUnavailable, healthz(nil, d), "not listening yet")
+	ok, status := Health(nil, d)
+	assert.False(t, ok)
+	assert.Equal(t, "starting", status)
+	code, status, _ := readyz([]*Proxy{p}, d)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "starting", status)
+
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool { return healthz(nil, d) == http.StatusOK }, time.Second, time.Millisecond)
+}
+
+func TestReadyHandler(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	p := startDBProxy(t, cfg, node.Address(), -1, handlers.NewDatabases())
+	assert.Eventually(t, p.Listening, time.Second, time.Millisecond)
+	code, status, nodes := readyz([]*Proxy{p}, NewDrainReport([]*Proxy{p}))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", status)
+	assert.Equal(t, []NodeReadiness{{Upstream: node.Address(), Node: node.Address()}}, nodes)
+
+	// a node that accepts connections but never answers
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = li.Close() }()
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+	silent := startDBProxy(t, cfg, li.Addr().String(), -1, handlers.NewDatabases())
+	assert.Eventually(t, silent.Listening, time.Second, time.Millisecond)
+	proxies := []*Proxy{p, silent}
+	code, status, nodes = readyz(proxies, NewDrainReport(proxies))
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not_ready", status)
+	if assert.Len(t, nodes, 2) {
+		for _, n := range nodes {
+			assert.Equal(t, n.Node == li.Addr().String(), n.Error != "", n.Node)
+		}
+	}
+}
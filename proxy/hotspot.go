@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/handlers"
+)
+
+// HotspotsHandler serves the slot hotspot reports of proxies for GET
+// /hotspots, by upstream, for those that sample slots or ban hash tags
+func HotspotsHandler(proxies []*Proxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hotspots := make(map[string]*handlers.HotspotStats)
+		for _, p := range proxies {
+			if s := p.hotspots.Stats(); s != nil {
+				hotspots[p.Name()] = s
+			}
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"hotspots": hotspots})
+	})
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHotspotsHandler(t *testing.T) {
+	sampled := &Proxy{label: "sampled", hotspots: handlers.NewHotspots(handlers.HotspotOptions{Sample: 10, Banned: []string{"user*"}})}
+	off := &Proxy{label: "off"}
+	w := httptest.NewRecorder()
+	HotspotsHandler([]*Proxy{sampled, off}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hotspots", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res struct {
+		Hotspots map[string]handlers.HotspotStats `json:"hotspots"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Len(t, res.Hotspots, 1, "only the upstreams that sample or ban")
+	assert.Equal(t, 10, res.Hotspots["sampled"].Sample)
+	assert.Equal(t, []string{"user*"}, res.Hotspots["sampled"].Banned)
+}
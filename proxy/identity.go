@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// IdentityKey is the canary key an upstream is recognized by, set on it to the
+// value of its identity param, e.g. SET __redisbetween_identity__ cache-eu-1
+const IdentityKey = "__redisbetween_identity__"
+
+// identityChecker checks a listener's upstream against its configured identity
+// every interval, recording the result in a handlers.Identity. Like the
+// configuration refreshes, checks are only sent while the pool has connections
+// to spare, a check held up by a busy pool being sent as soon as it isn't.
+type identityChecker struct {
+	probe
+	log      *zap.Logger
+	statsd   *statsd.Client
+	want     config.Identity
+	identity *handlers.Identity
+	// command sends a command to the upstream
+	command func(args ...string) (*redis.Message, error)
+}
+
+// checkIdentity checks the identity of a listener's upstream before it serves,
+// and then every interval until the proxy shuts down
+func (p *Proxy) checkIdentity(l *upstreamListener, logWith *zap.Logger, sdWith *statsd.Client) *handlers.Identity {
+	c := &identityChecker{
+		probe:    probe{interval: p.identity.Interval, busy: poolBusy(l)},
+		log:      logWith,
+		statsd:   sdWith,
+		want:     p.identity,
+		identity: handlers.NewIdentity(p.identity.Policy == config.IdentityFailFast),
+		command: func(args ...string) (*redis.Message, error) {
+			return p.command(l.server, args...)
+		},
+	}
+	now := time.Now()
+	c.next = now.Add(c.interval)
+	c.run(now)
+	p.runProbe(&c.probe, c.start)
+	return c.identity
+}
+
+func (c *identityChecker) start(now time.Time) func() {
+	return func() { c.run(now) }
+}
+
+func (c *identityChecker) run(now time.Time) {
+	check, mismatch, err := identityMismatch(c.want, c.command)
+	if err != nil {
+		c.identity.Fail(err)
+		c.log.Warn("Failed to check the upstream identity", zap.Error(err))
+		return
+	}
+	was := c.identity.Mismatch()
+	c.identity.Set(mismatch, now)
+	if mismatch != "" {
+		metrics.UpstreamIdentityMismatches.Incr(c.statsd, check)
+		c.log.Error("Upstream identity mismatch, it is not the redis configured", zap.String("check", check), zap.String("mismatch", mismatch), zap.String("policy", c.want.Policy))
+		return
+	}
+	if was != "" {
+		c.log.Info("Upstream identity matches again")
+	}
+}
+
+// identityMismatch checks an upstream against the identity it should have,
+// returning the check it failed and why, or an error if it couldn't be checked.
+// A cluster node that doesn't own the canary key's slot answers its GET with a
+// redirect, which leaves it unchecked: the key can only identify one node of a
+// cluster, so the others are better identified by their INFO fields and mode.
+func identityMismatch(want config.Identity, command func(args ...string) (*redis.Message, error)) (check, mismatch string, err error) {
+	if want.Key != "" {
+		res, err := command("GET", IdentityKey)
+		if err != nil {
+			return "", "", err
+		}
+		if res.IsError() {
+			return "", "", fmt.Errorf("GET %s: %s", IdentityKey, res.Value)
+		}
+		if !res.IsBulkBytes() || res.Value == nil {
+			return "key", fmt.Sprintf("%s is not set, expected %q", IdentityKey, want.Key), nil
+		}
+		if string(res.Value) != want.Key {
+			return "key", fmt.Sprintf("%s is %q, expected %q", IdentityKey, res.Value, want.Key), nil
+		}
+	}
+	if len(want.Info) == 0 && want.Mode == "" {
+		return "", "", nil
+	}
+	res, err := command("INFO")
+	if err != nil {
+		return "", "", err
+	}
+	if res.IsError() {
+		return "", "", errors.New("INFO: " + string(res.Value))
+	}
+	info := parseInfo(string(res.Value))
+	// sorted, so that the same mismatch is reported every time
+	fields := make([]string, 0, len(want.Info))
+	for f := range want.Info {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		v, ok := info[f]
+		if prefix := want.Info[f]; !ok || !strings.HasPrefix(v, prefix) {
+			return "info", fmt.Sprintf("INFO %s is %q, expected it to start with %q", f, v, prefix), nil
+		}
+	}
+	if want.Mode != "" {
+		mode := "standalone"
+		if info["cluster_enabled"] == "1" {
+			mode = "cluster"
+		}
+		if mode != want.Mode {
+			return "mode", fmt.Sprintf("upstream is in %s mode, expected %s", mode, want.Mode), nil
+		}
+	}
+	return "", "", nil
+}
+
+// parseInfo returns the fields of an INFO reply
+func parseInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			fields[line[:i]] = line[i+1:]
+		}
+	}
+	return fields
+}
+
+// Check connects to the upstream with a connection of its own, outside of any
+// listener, and checks that it answers and, if it has one configured, passes
+// its identity check. It backs the -check preflight.
+func (p *Proxy) Check() error {
+	counts := &poolCounts{minSize: 0, maxSize: 1}
+	s, err := p.connectServer(p.log, p.statsd, p.upstreamConfigHost, nil, counts, p.database)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+		defer cancel()
+		_ = s.Disconnect(ctx)
+	}()
+	res, err := p.command(s, "PING")
+	if err != nil {
+		return err
+	}
+	if res.IsError() {
+		return errors.New("PING: " + string(res.Value))
+	}
+	if !p.identity.Enabled() {
+		return nil
+	}
+	check, mismatch, err := identityMismatch(p.identity, func(args ...string) (*redis.Message, error) {
+		return p.command(s, args...)
+	})
+	if err != nil {
+		return err
+	}
+	if mismatch != "" {
+		return fmt.Errorf("identity %s check failed, %s", check, mismatch)
+	}
+	return nil
+}
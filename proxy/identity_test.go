@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestIdentityMismatch(t *testing.T) {
+	const info = "# Server\r\nredis_version:7.2.4\r\nredis_mode:standalone\r\nos:Linux 6.1.0 x86_64\r\n\r\n# Cluster\r\ncluster_enabled:0\r\n"
+	canary := redis.NewBulkBytes([]byte("cache-eu-1"))
+	for name, tc := range map[string]struct {
+		want     config.Identity
+		key      *redis.Message
+		check    string
+		mismatch string
+		err      string
+	}{
+		"matching": {
+			want: config.Identity{Key: "cache-eu-1", Info: map[string]string{"redis_version": "7.", "os": "Linux"}, Mode: "standalone"},
+			key:  canary,
+		},
+		"another redis": {
+			want:     config.Identity{Key: "cache-us-1"},
+			key:      canary,
+			check:    "key",
+			mismatch: `__redisbetween_identity__ is "cache-eu-1", expected "cache-us-1"`,
+		},
+		"a redis without the key": {
+			want:     config.Identity{Key: "cache-eu-1"},
+			key:      &redis.Message{Type: redis.TypeBulkBytes},
+			check:    "key",
+			mismatch: `__redisbetween_identity__ is not set, expected "cache-eu-1"`,
+		},
+		"a cluster node without the key's slot": {
+			want: config.Identity{Key: "cache-eu-1"},
+			key:  redis.NewErrorf("MOVED 3001 10.0.0.2:7000"),
+			err:  "GET __redisbetween_identity__: MOVED 3001 10.0.0.2:7000",
+		},
+		"an older version": {
+			want:     config.Identity{Info: map[string]string{"redis_version": "7.", "os": "Darwin"}},
+			check:    "info",
+			mismatch: `INFO os is "Linux 6.1.0 x86_64", expected it to start with "Darwin"`,
+		},
+		"a missing field": {
+			want:     config.Identity{Info: map[string]string{"cluster_name": "eu"}},
+			check:    "info",
+			mismatch: `INFO cluster_name is "", expected it to start with "eu"`,
+		},
+		"a standalone redis for a cluster": {
+			want:     config.Identity{Mode: "cluster"},
+			check:    "mode",
+			mismatch: "upstream is in standalone mode, expected cluster",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var sent []string
+			check, mismatch, err := identityMismatch(tc.want, func(args ...string) (*redis.Message, error) {
+				sent = append(sent, args[0])
+				if args[0] == "GET" {
+					return tc.key, nil
+				}
+				return redis.NewBulkBytes([]byte(info)), nil
+			})
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.check, check)
+			assert.Equal(t, tc.mismatch, mismatch)
+		})
+	}
+}
+
+func TestIdentityChecker(t *testing.T) {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	var key *redis.Message
+	var getErr error
+	busy := false
+	c := &identityChecker{
+		log:      zap.NewNop(),
+		statsd:   sd,
+		probe:    probe{interval: time.Minute, busy: func() bool { return busy }},
+		want:     config.Identity{Key: "cache-eu-1", Policy: config.IdentityFailFast},
+		identity: handlers.NewIdentity(true),
+		command:  func(args ...string) (*redis.Message, error) { return key, getErr },
+	}
+	now := time.Now()
+
+	key = redis.NewBulkBytes([]byte("cache-us-1"))
+	c.run(now)
+	assert.Equal(t, `__redisbetween_identity__ is "cache-us-1", expected "cache-eu-1"`, c.identity.Mismatch())
+
+	getErr = errors.New("i/o timeout")
+	c.run(now.Add(time.Minute))
+	assert.Equal(t, &handlers.IdentityStats{Mismatch: c.identity.Mismatch(), Checked: now, Error: "i/o timeout"}, c.identity.Stats(), "an upstream that can't be checked stays mismatched")
+
+	getErr, key = nil, redis.NewBulkBytes([]byte("cache-eu-1"))
+	c.run(now.Add(2 * time.Minute))
+	assert.Equal(t, &handlers.IdentityStats{Verified: true, Checked: now.Add(2 * time.Minute)}, c.identity.Stats())
+
+	busy = true
+	c.tick(now.Add(3*time.Minute), c.start)
+	assert.True(t, c.next.IsZero(), "a check held up by a busy pool is sent as soon as it isn't")
+	busy = false
+	c.tick(now.Add(3*time.Minute), c.start)
+	assert.Equal(t, now.Add(4*time.Minute), c.next)
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return !c.running
+	}, time.Second, time.Millisecond)
+}
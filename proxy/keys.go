@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// loadKeyTable fills keys from the upstream's COMMAND reply in the background,
+// so a slow upstream doesn't hold up its listener. Upstreams that don't allow
+// COMMAND keep the default key positions.
+func (p *Proxy) loadKeyTable(log *zap.Logger, s *pool.Server, keys *handlers.KeyTable) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.readTimeout+p.writeTimeout)
+		defer cancel()
+		conn, err := s.Connection(ctx)
+		if err != nil {
+			log.Info("Could not load command key positions, using defaults", zap.Error(err))
+			return
+		}
+		defer func() {
+			_ = conn.Return()
+		}()
+
+		command := []*redis.Message{redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("COMMAND"))})}
+		address := conn.Address().String()
+		err = handlers.WriteWireMessages(ctx, log, command, conn.Conn(), address, conn.ID(), p.writeTimeout, false, conn.Close)
+		var res []*redis.Message
+		if err == nil {
+			res, err = handlers.ReadWireMessages(ctx, log, conn.Conn(), address, conn.ID(), p.readTimeout, 1, false, conn.Close)
+		}
+		var n int
+		if err == nil {
+			n, err = keys.Load(res[0])
+		}
+		if err != nil {
+			log.Info("Could not load command key positions, using defaults", zap.Error(err))
+			return
+		}
+		log.Info("Loaded command key positions", zap.Int("commands", n))
+	}()
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func maxClientsProxy(t *testing.T, closeRejected bool) *Proxy {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{
+		UpstreamConfigHost: node.Address(),
+		Database:           -1,
+		MaxPoolSize:        4,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+		MaxClients:         2,
+		MaxClientsClose:    closeRejected,
+	})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(p.localConfigHost)
+		return err == nil
+	}, time.Second, time.Millisecond)
+	return p
+}
+
+// dialPing opens a client connection and returns it once it was answered a
+// PING, for it to be counted as open
+func dialPing(t *testing.T, p *Proxy) net.Conn {
+	conn, err := net.Dial("unix", p.localConfigHost)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	_, err = conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	assert.NoError(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "+PONG\r\n", line)
+	return conn
+}
+
+// rejected reads what a connection opened past maxclients is sent before it is
+// closed
+func rejected(t *testing.T, p *Proxy) string {
+	conn, err := net.Dial("unix", p.localConfigHost)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err, "the connection is closed")
+	return string(b)
+}
+
+func TestMaxClients(t *testing.T) {
+	p := maxClientsProxy(t, false)
+	first := dialPing(t, p)
+	dialPing(t, p)
+	assert.Equal(t, "-ERR max number of clients reached\r\n", rejected(t, p))
+	assert.Equal(t, "-ERR max number of clients reached\r\n", rejected(t, p))
+	assert.Equal(t, int64(2), p.Stats().PeakClients)
+
+	_ = first.Close()
+	assert.Eventually(t, func() bool {
+		return p.Stats().Clients == 1
+	}, time.Second, time.Millisecond)
+	dialPing(t, p)
+	assert.Equal(t, int64(2), p.Stats().PeakClients)
+}
+
+func TestMaxClientsClose(t *testing.T) {
+	p := maxClientsProxy(t, true)
+	dialPing(t, p)
+	dialPing(t, p)
+	assert.Empty(t, rejected(t, p), "connections past maxclients are closed with no error written")
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/memwatch"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// TestMemoryFlood has clients keep arriving, each writing large values as fast
+// as it can. Unchecked, memory would grow with every client. Instead, large
+// writes are shed over the soft limit, and clients are turned away over the hard
+// limit, until memory recedes. The process rides its limits, overshooting the
+// hard one only by the values its clients were already writing.
+func TestMemoryFlood(t *testing.T) {
+	const valueSize = 1 << 20
+	node := newFakeNode(t)
+	dir, err := ioutil.TempDir("", "memory")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	debug.FreeOSMemory()
+	base := memwatch.ReadUsage().Used()
+	soft, hard := base+64<<20, base+128<<20
+	w, err := memwatch.New(zap.NewNop(), nil, memwatch.Options{
+		Soft:      memwatch.Limit{Bytes: soft},
+		Hard:      memwatch.Limit{Bytes: hard},
+		ShedBytes: valueSize / 2,
+	})
+	assert.NoError(t, err)
+	defer debug.SetGCPercent(100)
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(dir, "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{
+		UpstreamConfigHost: node.Address(),
+		Database:           -1,
+		MaxPoolSize:        4,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+	})
+	assert.NoError(t, err)
+	p.WatchMemory(w)
+	go func() { _ = p.Run() }()
+	defer p.Shutdown()
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(p.localConfigHost)
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	var peak uint64
+	states := make(map[memwatch.State]bool)
+	quit := make(chan interface{})
+	var watching sync.WaitGroup
+	watching.Add(1)
+	go func() {
+		defer watching.Done()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			states[w.Check()] = true
+			if used := memwatch.ReadUsage().Used(); used > peak {
+				peak = used
+			}
+		}
+	}()
+
+	var forwarded, shed, refused int64
+	var flooding sync.WaitGroup
+	command := []byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1048576\r\n" + strings.Repeat("x", valueSize) + "\r\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		flooding.Add(1)
+		go func() {
+			defer flooding.Done()
+			conn, err := net.Dial("unix", p.localConfigHost)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+			_ = conn.SetDeadline(deadline.Add(5 * time.Second))
+			d := redis.NewDecoder(conn)
+			for time.Now().Before(deadline) {
+				go func() { _, _ = conn.Write(command) }()
+				m, err := d.Decode()
+				switch {
+				case err != nil:
+					return
+				case strings.HasPrefix(string(m.Value), "PROXYOVERLOADED memory over its hard limit, refusing"):
+					atomic.AddInt64(&refused, 1)
+					return
+				case m.IsError():
+					atomic.AddInt64(&shed, 1)
+				default:
+					atomic.AddInt64(&forwarded, 1)
+				}
+			}
+		}()
+		time.Sleep(2 * time.Millisecond)
+	}
+	flooding.Wait()
+	close(quit)
+	watching.Wait()
+
+	t.Logf("base %dMB, peak %dMB: %d forwarded, %d shed, %d connections refused", base>>20, peak>>20, forwarded, shed, refused)
+	assert.True(t, states[memwatch.Soft], "memory crossed the soft limit")
+	assert.True(t, forwarded > 0, "requests are forwarded while memory is below the soft limit")
+	assert.True(t, shed > 0, "large requests are shed over the soft limit")
+	assert.True(t, refused > 0, "connections are refused over the hard limit")
+	assert.True(t, peak < 2*hard, "peak %dMB, hard limit %dMB", peak>>20, hard>>20)
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"go.uber.org/zap"
+)
+
+// connectMirror creates the pool of a listener's connections to the mirror.
+// Unlike the upstream's pools, it has no idle connections, and its dials take
+// no slot of the connection budget or warmup and leave the init backoff alone,
+// so that a mirror that can't be reached never holds up the upstream's
+// connections.
+func (p *Proxy) connectMirror(logWith *zap.Logger, sdMirror *statsd.Client) (*pool.Server, error) {
+	size := uint64(p.mirror.PoolSize)
+	monitor := p.poolMonitor(sdMirror, &poolCounts{maxSize: p.mirror.PoolSize})
+	dlr := newFamilyDialer(logWith, sdMirror, 30*time.Second)
+	timeout := p.readTimeout + p.writeTimeout
+	co := pool.WithDialer(func(pool.Dialer) pool.Dialer {
+		return pool.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dlr.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, connectFailed(sdMirror, err)
+			}
+			if err := prepareConn(conn, address, p.mirror.Credentials, p.database, false, timeout); err != nil {
+				_ = conn.Close()
+				return nil, connectFailed(sdMirror, err)
+			}
+			return conn, nil
+		})
+	})
+	return pool.ConnectServer(pool.Address(p.mirror.Address),
+		pool.WithMinConnections(func(uint64) uint64 { return 0 }),
+		pool.WithMaxConnections(func(uint64) uint64 { return size }),
+		pool.WithConnectionPoolMonitor(func(*pool.Monitor) *pool.Monitor { return monitor }),
+		pool.WithConnectionOptions(func(cos ...pool.ConnectionOption) []pool.ConnectionOption {
+			return append(cos, co)
+		}),
+	)
+}
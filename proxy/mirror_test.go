@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func startMirroredProxy(t *testing.T, node, mirror string) *Proxy {
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{
+		UpstreamConfigHost: node,
+		Database:           -1,
+		MaxPoolSize:        4,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+		Mirror:             config.Mirror{Address: mirror, Compare: true, Queue: 10, PoolSize: 1},
+	})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(p.localConfigHost)
+		return err == nil
+	}, time.Second, time.Millisecond)
+	return p
+}
+
+func TestMirror(t *testing.T) {
+	node, shadow := newDBNode(t), newDBNode(t)
+	p := startMirroredProxy(t, node.Address(), shadow.Address())
+	client := setupStandaloneClient(t, p.localConfigHost)
+
+	assert.NoError(t, client.Set(context.Background(), "k", "v", 0).Err())
+	assert.Equal(t, "v", client.Get(context.Background(), "k").Val())
+	assert.Eventually(t, func() bool { return shadow.get(0, "k") == "v" }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return p.Stats().Listeners[0].Mirror.Mirrored == 1 }, time.Second, time.Millisecond)
+	assert.Zero(t, p.Stats().Listeners[0].Mirror.Mismatches)
+}
+
+func TestMirrorUnreachable(t *testing.T) {
+	node := newDBNode(t)
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_ = li.Close()
+	p := startMirroredProxy(t, node.Address(), li.Addr().String())
+	client := setupStandaloneClient(t, p.localConfigHost)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, client.Set(context.Background(), "k", "v", 0).Err(), "the mirror failing fails nothing")
+	}
+	assert.Equal(t, "v", node.get(0, "k"))
+	assert.Eventually(t, func() bool { return p.Stats().Listeners[0].Mirror.Failed == 3 }, time.Second, time.Millisecond)
+}
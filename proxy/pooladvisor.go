@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/panics"
+	"go.uber.org/zap"
+)
+
+// poolAdviceLogInterval is how often the advice of each pool is logged
+const poolAdviceLogInterval = 24 * time.Hour
+
+// PoolAdvice recommends the size limits of a pool from its utilization since
+// Since: the connections in use, sampled many times a second, the checkouts
+// that found them all in use and waited, and the connections the pool opened
+// and closed as it grew and shrank. It is advice only, no pool is resized.
+type PoolAdvice struct {
+	Since     time.Time `json:"since"`
+	Samples   int64     `json:"samples"`
+	InUseP50  int       `json:"in_use_p50"`
+	InUseP99  int       `json:"in_use_p99"`
+	InUseP999 int       `json:"in_use_p999"`
+	Checkouts int64     `json:"checkouts"`
+	Waited    int64     `json:"checkouts_waited"`
+	Created   int64     `json:"connections_created"`
+	Closed    int64     `json:"connections_closed"`
+	// SuggestedMinSize is the median of the connections in use, and
+	// SuggestedMaxSize their 99.9th percentile plus the headroom
+	SuggestedMinSize int `json:"suggested_min_size"`
+	SuggestedMaxSize int `json:"suggested_max_size"`
+	// Saturated is whether checkouts waited on a pool whose connections were
+	// all in use for the 99.9th percentile, so that demand may be higher than
+	// what could be observed
+	Saturated bool `json:"saturated"`
+}
+
+// poolAdvisor summarizes the utilization of a pool in constant memory: a
+// histogram of the connections in use, with a bucket for each count up to the
+// pool's max size, and counters of its checkouts and connections
+type poolAdvisor struct {
+	lane     string
+	headroom float64
+	done     chan struct{}
+	stop     sync.Once
+
+	checkouts, waited, created, closed int64
+
+	mu      sync.Mutex
+	since   time.Time
+	inUse   []int64
+	samples int64
+}
+
+func newPoolAdvisor(lane string, maxSize int, headroom float64, now time.Time) *poolAdvisor {
+	if maxSize < 0 {
+		maxSize = 0
+	}
+	return &poolAdvisor{lane: lane, headroom: headroom, done: make(chan struct{}), since: now, inUse: make([]int64, maxSize+1)}
+}
+
+// sample records n connections in use, n past the max size counting as it
+func (a *poolAdvisor) sample(n int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	if n >= int64(len(a.inUse)) {
+		n = int64(len(a.inUse) - 1)
+	}
+	a.inUse[n]++
+	a.samples++
+}
+
+// observe counts the checkouts, and the connections created and closed, of
+// the pool whose counts are c. It does nothing without an advisor.
+func (a *poolAdvisor) observe(eventType string, c *poolCounts) {
+	if a == nil {
+		return
+	}
+	switch eventType {
+	case "ConnectionCheckOutStarted":
+		atomic.AddInt64(&a.checkouts, 1)
+		if atomic.LoadInt64(&c.checkedOut) >= int64(c.maxSize) {
+			atomic.AddInt64(&a.waited, 1)
+		}
+	case pool.ConnectionCreated:
+		atomic.AddInt64(&a.created, 1)
+	case pool.ConnectionClosed:
+		atomic.AddInt64(&a.closed, 1)
+	case pool.Closed:
+		a.stop.Do(func() { close(a.done) })
+	}
+}
+
+// reset starts the observation over at now, so that an anomaly observed
+// doesn't weigh on the advice
+func (a *poolAdvisor) reset(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.inUse {
+		a.inUse[i] = 0
+	}
+	a.samples, a.since = 0, now
+	atomic.StoreInt64(&a.checkouts, 0)
+	atomic.StoreInt64(&a.waited, 0)
+	atomic.StoreInt64(&a.created, 0)
+	atomic.StoreInt64(&a.closed, 0)
+}
+
+// quantile is the fewest connections in use of at least permille thousandths
+// of the samples, with mu held
+func (a *poolAdvisor) quantile(permille int64) int {
+	var seen int64
+	for n, samples := range a.inUse {
+		seen += samples
+		if seen*1000 >= a.samples*permille {
+			return n
+		}
+	}
+	return len(a.inUse) - 1
+}
+
+// advice is the advice on the pool, whose max size is maxSize, of what was
+// observed so far, none before the first sample. It is nil without an advisor.
+func (a *poolAdvisor) advice(maxSize int) *PoolAdvice {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.samples == 0 {
+		return nil
+	}
+	ad := &PoolAdvice{
+		Since:     a.since,
+		Samples:   a.samples,
+		InUseP50:  a.quantile(500),
+		InUseP99:  a.quantile(990),
+		InUseP999: a.quantile(999),
+		Checkouts: atomic.LoadInt64(&a.checkouts),
+		Waited:    atomic.LoadInt64(&a.waited),
+		Created:   atomic.LoadInt64(&a.created),
+		Closed:    atomic.LoadInt64(&a.closed),
+	}
+	ad.SuggestedMinSize = ad.InUseP50
+	ad.SuggestedMaxSize = int(math.Ceil(float64(ad.InUseP999) * (1 + a.headroom)))
+	if ad.SuggestedMaxSize < 1 {
+		ad.SuggestedMaxSize = 1
+	}
+	ad.Saturated = ad.Waited > 0 && ad.InUseP999 >= maxSize
+	return ad
+}
+
+// advise has the utilization of the pool whose counts are given observed, if
+// the upstream's pools are advised on. It is called before the pool is
+// connected, for its monitor to find the advisor.
+func (p *Proxy) advise(logWith *zap.Logger, sd *statsd.Client, counts *poolCounts, lane string) {
+	if !p.poolAdvisor.Enabled {
+		return
+	}
+	a := newPoolAdvisor(lane, counts.maxSize, p.poolAdvisor.Headroom, time.Now())
+	counts.advisor = a
+	go p.samplePool(logWith.With(zap.String("lane", lane)), counts)
+	p.schedule(func() {
+		if ad := a.advice(counts.maxSize); ad != nil {
+			metrics.PoolAdviceMinSize.Set(sd, float64(ad.SuggestedMinSize))
+			metrics.PoolAdviceMaxSize.Set(sd, float64(ad.SuggestedMaxSize))
+		}
+	})
+}
+
+// samplePool samples the connections in use of the pool whose counts are
+// given, logging its advice daily, until the pool or the proxy is closed
+func (p *Proxy) samplePool(log *zap.Logger, counts *poolCounts) {
+	defer panics.Recover(log, p.statsd, "pool_advisor", "Pool sampler crashed")
+	a := counts.advisor
+	t := time.NewTicker(p.poolAdvisor.Sample)
+	defer t.Stop()
+	next := time.Now().Add(poolAdviceLogInterval)
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-a.done:
+			return
+		case now := <-t.C:
+			a.sample(atomic.LoadInt64(&counts.checkedOut))
+			if now.Before(next) {
+				continue
+			}
+			next = now.Add(poolAdviceLogInterval)
+			if ad := a.advice(counts.maxSize); ad != nil {
+				log.Info("pool advice",
+					zap.Int("min_size", counts.minSize),
+					zap.Int("max_size", counts.maxSize),
+					zap.Int("suggested_min_size", ad.SuggestedMinSize),
+					zap.Int("suggested_max_size", ad.SuggestedMaxSize),
+					zap.Int("in_use_p50", ad.InUseP50),
+					zap.Int("in_use_p999", ad.InUseP999),
+					zap.Int64("checkouts_waited", ad.Waited),
+					zap.Bool("saturated", ad.Saturated),
+					zap.Time("since", ad.Since))
+			}
+		}
+	}
+}
+
+// advisedPools are the pools of a listener that are advised on
+func (l *upstreamListener) advisedPools() []*poolCounts {
+	var pools []*poolCounts
+	for _, c := range []*poolCounts{l.pool, l.reserved, l.blocking, l.pubSub, l.resp3} {
+		if c != nil && c.advisor != nil {
+			pools = append(pools, c)
+		}
+	}
+	return pools
+}
+
+// ListenerPoolAdvice is the advice on the size of a pool of a listener, by its
+// lane: general, reserved, blocking, pubsub or resp3
+type ListenerPoolAdvice struct {
+	Upstream string      `json:"upstream"`
+	Node     string      `json:"node"`
+	Lane     string      `json:"lane"`
+	MinSize  int         `json:"min_size"`
+	MaxSize  int         `json:"max_size"`
+	Advice   *PoolAdvice `json:"advice"`
+}
+
+// poolAdviceRequest names the upstreams, or nodes, whose observation POST
+// /pooladvice/reset starts over, all of them if it names none
+type poolAdviceRequest struct {
+	Upstreams []string `json:"upstreams"`
+}
+
+// poolAdvice returns the advice on the pools of proxies advised on, sorted by
+// upstream, node and lane, having started their observation over first if
+// reset is set. Only the pools of the upstreams or nodes named are, all of
+// them if names is empty, and naming one that doesn't exist is an error.
+func poolAdvice(proxies []*Proxy, names []string, reset bool) ([]ListenerPoolAdvice, error) {
+	now := time.Now()
+	advice := []ListenerPoolAdvice{}
+	err := eachListener(proxies, names, func(p *Proxy, l *upstreamListener) {
+		for _, c := range l.advisedPools() {
+			if reset {
+				c.advisor.reset(now)
+			}
+			advice = append(advice, ListenerPoolAdvice{Upstream: p.Name(), Node: l.upstream, Lane: c.advisor.lane, MinSize: c.minSize, MaxSize: c.maxSize, Advice: c.advisor.advice(c.maxSize)})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(advice, func(i, j int) bool {
+		if advice[i].Upstream != advice[j].Upstream {
+			return advice[i].Upstream < advice[j].Upstream
+		}
+		return advice[i].Node < advice[j].Node
+	})
+	return advice, nil
+}
+
+// PoolAdviceHandler answers GET /pooladvice with the advice on the size of
+// every pool advised on, and POST /pooladvice/reset, with the upstreams whose
+// observation starts over, all of them if the body names none, with the advice
+// once reset
+func PoolAdviceHandler(proxies []*Proxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req poolAdviceRequest
+		reset := false
+		switch {
+		case r.URL.Path == "/pooladvice" && r.Method == http.MethodGet:
+		case r.URL.Path == "/pooladvice/reset" && r.Method == http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+				admin.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			reset = true
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		advice, err := poolAdvice(proxies, req.Upstreams, reset)
+		if err != nil {
+			admin.WriteJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"pools": advice})
+	})
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestPoolAdvice(t *testing.T) {
+	start := time.Now()
+	a := newPoolAdvisor("general", 10, 0.25, start)
+	assert.Nil(t, a.advice(10), "no advice before the first sample")
+	for n, samples := range map[int64]int{2: 500, 4: 400, 6: 99, 10: 1} {
+		for i := 0; i < samples; i++ {
+			a.sample(n)
+		}
+	}
+	counts := &poolCounts{maxSize: 10, checkedOut: 3}
+	a.observe("ConnectionCheckOutStarted", counts)
+	a.observe("ConnectionCreated", counts)
+
+	ad := a.advice(10)
+	assert.Equal(t, PoolAdvice{Since: start, Samples: 1000, InUseP50: 2, InUseP99: 6, InUseP999: 6, Checkouts: 1, Created: 1, SuggestedMinSize: 2, SuggestedMaxSize: 8}, *ad)
+	a.sample(12)
+	assert.Equal(t, int64(2), a.inUse[10], "samples past the max size count as it")
+
+	// checkouts waiting on a pool in use up to its max size for the 99.9th
+	// percentile mean it is too small to tell the demand
+	counts.checkedOut = 10
+	a.observe("ConnectionCheckOutStarted", counts)
+	for i := 0; i < 1000; i++ {
+		a.sample(10)
+	}
+	ad = a.advice(10)
+	assert.Equal(t, int64(1), ad.Waited)
+	assert.Equal(t, 10, ad.InUseP999)
+	assert.Equal(t, 13, ad.SuggestedMaxSize)
+	assert.True(t, ad.Saturated)
+
+	a.reset(start.Add(time.Hour))
+	assert.Nil(t, a.advice(10))
+	a.sample(1)
+	assert.Equal(t, PoolAdvice{Since: start.Add(time.Hour), Samples: 1, InUseP50: 1, InUseP99: 1, InUseP999: 1, SuggestedMinSize: 1, SuggestedMaxSize: 2}, *a.advice(10))
+
+	a.observe("ConnectionPoolClosed", counts)
+	a.observe("ConnectionPoolClosed", counts)
+	_, open := <-a.done
+	assert.False(t, open, "the sampling stops once the pool is closed")
+}
+
+func poolAdviceRoute(t *testing.T, proxies []*Proxy, method, path, body string) (int, []ListenerPoolAdvice) {
+	rec := httptest.NewRecorder()
+	PoolAdviceHandler(proxies).ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var res struct {
+		Pools []ListenerPoolAdvice `json:"pools"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &res)
+	return rec.Code, res.Pools
+}
+
+func TestPoolAdviceHandler(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{
+		UpstreamConfigHost: node.Address(),
+		Database:           -1,
+		MaxPoolSize:        4,
+		ReservedPoolSize:   1,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+		PoolAdvisor:        config.PoolAdvisor{Enabled: true, Headroom: 0.5, Sample: time.Millisecond},
+	})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(p.localConfigHost)
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	client := setupStandaloneClient(t, p.localConfigHost)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, client.Set(context.Background(), "k", "v", 0).Err())
+	}
+	assert.Eventually(t, func() bool {
+		ad := p.Stats().Listeners[0].Pool.Advice
+		return ad != nil && ad.Samples >= 10
+	}, time.Second, time.Millisecond)
+	ad := p.Stats().Listeners[0].Pool.Advice
+	assert.GreaterOrEqual(t, ad.Checkouts, int64(10))
+	assert.GreaterOrEqual(t, ad.Created, int64(1))
+	assert.Zero(t, ad.Waited)
+	assert.LessOrEqual(t, ad.SuggestedMaxSize, 3, "sequential commands use two connections at most, as one is checked in")
+	assert.NotNil(t, p.Stats().Listeners[0].ReservedPool.Advice)
+
+	code, pools := poolAdviceRoute(t, []*Proxy{p}, http.MethodGet, "/pooladvice", "")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, pools, 2) {
+		assert.Equal(t, "general", pools[0].Lane)
+		assert.Equal(t, "reserved", pools[1].Lane)
+		assert.Equal(t, node.Address(), pools[0].Node)
+		assert.Equal(t, 4, pools[0].MaxSize)
+	}
+
+	code, _ = poolAdviceRoute(t, []*Proxy{p}, http.MethodPost, "/pooladvice/reset", `{"upstreams": ["10.0.0.1:6379"]}`)
+	assert.Equal(t, http.StatusNotFound, code, "unknown upstreams reset nothing")
+	before := p.Stats().Listeners[0].Pool.Advice.Since
+	code, pools = poolAdviceRoute(t, []*Proxy{p}, http.MethodPost, "/pooladvice/reset", `{"upstreams": ["`+node.Address()+`"]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, pools, 2)
+	ad = p.Stats().Listeners[0].Pool.Advice
+	if ad != nil {
+		assert.True(t, ad.Since.After(before), "the observation starts over")
+		assert.Less(t, ad.Checkouts, int64(10))
+	}
+
+	code, _ = poolAdviceRoute(t, []*Proxy{p}, http.MethodGet, "/pooladvice/reset", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = poolAdviceRoute(t, []*Proxy{p}, http.MethodPost, "/pooladvice/reset", "{")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
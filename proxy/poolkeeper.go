@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/metrics"
+	"go.uber.org/zap"
+)
+
+// poolKeeper checks a pool's open connections against its size limits. The pool
+// only tops itself up to its minimum when it starts, so connections closed after,
+// by errors or the budget, are otherwise replaced only once traffic grows it
+// again.
+type poolKeeper struct {
+	probe
+	log     *zap.Logger
+	statsd  *statsd.Client
+	server  *pool.Server
+	counts  *poolCounts
+	overMax bool
+}
+
+// keepPoolInvariants checks a pool every interval until the proxy shuts down
+func (p *Proxy) keepPoolInvariants(logWith *zap.Logger, sdWith *statsd.Client, s *pool.Server, counts *poolCounts) {
+	k := &poolKeeper{probe: probe{interval: p.poolHealInterval}, log: logWith, statsd: sdWith, server: s, counts: counts}
+	p.runProbe(&k.probe, k.start)
+}
+
+// start checks the pool, and returns its healing if it is below its minimum
+func (k *poolKeeper) start(now time.Time) func() {
+	open := atomic.LoadInt64(&k.counts.open)
+	// more connections than the pool may hold can only be a miscount, logged
+	// once for each stretch of time it lasts
+	if k.counts.maxSize > 0 && open > int64(k.counts.maxSize) {
+		metrics.PoolInvariantViolations.Incr(k.statsd, "over_max")
+		if !k.overMax {
+			s := k.counts.stats()
+			k.log.Error("Pool has more open connections than its maximum size", zap.Int("min_size", s.MinSize), zap.Int("max_size", s.MaxSize),
+				zap.Int64("open", s.Open), zap.Int64("checked_out", s.CheckedOut), zap.Any("budget", s.Budget), zap.Any("closed", k.counts.closeReasons(false)))
+		}
+		k.overMax = true
+	} else {
+		k.overMax = false
+	}
+	if open >= int64(k.counts.minSize) {
+		return nil
+	}
+	return func() { k.heal(open) }
+}
+
+// heal brings the pool back to its minimum by checking out as many connections
+// as it has to hold at once to get there, which makes it create the missing
+// ones, each waiting on the connection rate limit like any other, and returning
+// them all
+func (k *poolKeeper) heal(open int64) {
+	reason := shrinkReason(k.counts.closeReasons(true))
+	want := int64(k.counts.minSize) - atomic.LoadInt64(&k.counts.checkedOut)
+	ctx, cancel := context.WithTimeout(context.Background(), k.interval)
+	defer cancel()
+	var conns []*pool.Connection
+	var err error
+	for i := int64(0); i < want; i++ {
+		var conn *pool.Connection
+		if conn, err = k.server.Connection(ctx); err != nil {
+			break
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		_ = conn.Return()
+	}
+
+	created := atomic.LoadInt64(&k.counts.open) - open
+	if created < 0 {
+		created = 0
+	}
+	metrics.PoolHealed.Count(k.statsd, created, reason)
+	log := k.log.With(zap.Int("min_size", k.counts.minSize), zap.Int64("open", open), zap.Int64("created", created), zap.String("reason", reason))
+	if err != nil {
+		log.Warn("Pool below its minimum size could not be healed", zap.Error(err))
+		return
+	}
+	log.Info("Pool below its minimum size healed")
+}
+
+// shrinkReason is the reason most connections were closed for, "unknown" if
+// none were
+func shrinkReason(reasons map[string]int64) string {
+	names := make([]string, 0, len(reasons))
+	for r := range reasons {
+		names = append(names, r)
+	}
+	sort.Strings(names)
+	reason, most := "unknown", int64(0)
+	for _, r := range names {
+		if reasons[r] > most {
+			reason, most = r, reasons[r]
+		}
+	}
+	return reason
+}
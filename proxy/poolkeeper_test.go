@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestPoolKeeperHealsBelowMinimum(t *testing.T) {
+	node := newDBNode(t)
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: node.Address(), Database: -1, MinPoolSize: 3, MaxPoolSize: 5,
+		ReadTimeout: time.Second, WriteTimeout: time.Second, PoolHealInterval: time.Second})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+
+	var l *upstreamListener
+	assert.Eventually(t, func() bool {
+		p.listenerLock.Lock()
+		defer p.listenerLock.Unlock()
+		l = p.listeners[node.Address()]
+		return l != nil && atomic.LoadInt64(&l.pool.open) == 3
+	}, time.Second, time.Millisecond)
+
+	// the connections break, and are discarded as they are returned
+	var conns []*pool.Connection
+	for i := 0; i < 3; i++ {
+		conn, err := l.server.Connection(context.Background())
+		assert.NoError(t, err)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		_ = conn.Conn().Close()
+		_ = conn.Close()
+		_ = conn.Return()
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&l.pool.open) < 3 }, time.Second, time.Millisecond)
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&l.pool.open) == 3 }, 3*time.Second, 10*time.Millisecond,
+		"the pool is topped up within the interval, without any traffic")
+	assert.Equal(t, int64(0), atomic.LoadInt64(&l.pool.checkedOut))
+	assert.Empty(t, l.pool.closeReasons(false), "the reasons are taken by the healing")
+}
+
+func TestPoolKeeperOverMax(t *testing.T) {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	core, logs := observer.New(zapcore.ErrorLevel)
+	counts := &poolCounts{minSize: 1, maxSize: 2, open: 3}
+	counts.closed(pool.ReasonStale)
+	k := &poolKeeper{probe: probe{interval: time.Second}, log: zap.New(core), statsd: sd, counts: counts}
+
+	now := time.Now()
+	k.tick(now, k.start)
+	k.tick(now.Add(time.Second), k.start)
+	errs := logs.All()
+	if assert.Len(t, errs, 1, "logged once while it lasts") {
+		fields := errs[0].ContextMap()
+		assert.Equal(t, int64(3), fields["open"])
+		assert.Equal(t, int64(2), fields["max_size"])
+		assert.Equal(t, map[string]int64{pool.ReasonStale: 1}, fields["closed"])
+	}
+
+	atomic.StoreInt64(&counts.open, 2)
+	k.tick(now.Add(2*time.Second), k.start)
+	atomic.StoreInt64(&counts.open, 3)
+	k.tick(now.Add(3*time.Second), k.start)
+	assert.Len(t, logs.All(), 2, "and again once it comes back")
+}
+
+func TestShrinkReason(t *testing.T) {
+	assert.Equal(t, "unknown", shrinkReason(nil))
+	assert.Equal(t, pool.ReasonConnectionErrored, shrinkReason(map[string]int64{pool.ReasonStale: 1, pool.ReasonConnectionErrored: 4}))
+	assert.Equal(t, pool.ReasonConnectionErrored, shrinkReason(map[string]int64{pool.ReasonStale: 2, pool.ReasonConnectionErrored: 2}), "ties go to the first by name")
+}
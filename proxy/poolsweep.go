@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// idleConn is an upstream connection that keeps the time it was last read from
+// or written to, which tells the sweeps of its pool how long it has been idle.
+// The sweeps' own PINGs are sent on the connection under it, so that they
+// don't count as use.
+type idleConn struct {
+	net.Conn
+	used int64 // unix nanoseconds, accessed atomically
+}
+
+func newIdleConn(c net.Conn) *idleConn {
+	return &idleConn{Conn: c, used: time.Now().UnixNano()}
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.StoreInt64(&c.used, time.Now().UnixNano())
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.StoreInt64(&c.used, time.Now().UnixNano())
+	return n, err
+}
+
+// idle is how long the connection has gone unused at now
+func (c *idleConn) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&c.used)))
+}
+
+// idleConnOf is the idleConn of a pooled connection, under the budgetConn it
+// has if connections are capped process-wide
+func idleConnOf(c net.Conn) (*idleConn, bool) {
+	if bc, ok := c.(*budgetConn); ok {
+		c = bc.Conn
+	}
+	ic, ok := c.(*idleConn)
+	return ic, ok
+}
+
+// sweepsIdle is whether the upstream's pools are swept for idle connections
+func (p *Proxy) sweepsIdle() bool {
+	return p.maxConnIdleTime > 0 || p.idlePingInterval > 0
+}
+
+// poolSweep closes the idle connections of a pool that it shouldn't keep. The
+// pool itself keeps every connection returned to it for as long as it is open,
+// however long it goes unused, which servers like ElastiCache eventually close
+// on their side, failing the request that next gets it. Connections idle for
+// longer than maxIdle are closed, oldest first, as long as the pool keeps its
+// minimum size, and those idle for pingAfter are sent a PING, and closed if it
+// fails, which also keeps the minimum warm on the server's side.
+type poolSweep struct {
+	probe
+	log       *zap.Logger
+	statsd    *statsd.Client
+	server    *pool.Server
+	counts    *poolCounts
+	maxIdle   time.Duration
+	pingAfter time.Duration
+	timeout   time.Duration
+}
+
+// sweepIdle sweeps a pool until the proxy shuts down
+func (p *Proxy) sweepIdle(logWith *zap.Logger, sdWith *statsd.Client, s *pool.Server, counts *poolCounts) {
+	sw := &poolSweep{probe: probe{interval: sweepInterval(p.maxConnIdleTime, p.idlePingInterval)}, log: logWith, statsd: sdWith, server: s, counts: counts,
+		maxIdle: p.maxConnIdleTime, pingAfter: p.idlePingInterval, timeout: p.readTimeout + p.writeTimeout}
+	p.runProbe(&sw.probe, sw.start)
+}
+
+// sweepInterval is how often a pool is swept: every pingAfter, or every half
+// of maxIdle if that is sooner, so that a connection is closed within half of
+// maxIdle of going over it
+func sweepInterval(maxIdle, pingAfter time.Duration) time.Duration {
+	interval := pingAfter
+	if half := maxIdle / 2; half > 0 && (interval == 0 || half < interval) {
+		interval = half
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// start sweeps the pool if it has idle connections
+func (sw *poolSweep) start(now time.Time) func() {
+	if atomic.LoadInt64(&sw.counts.open)-atomic.LoadInt64(&sw.counts.checkedOut) <= 0 {
+		return nil
+	}
+	return func() { sw.sweep(now) }
+}
+
+// sweep checks out every idle connection of the pool, which it gives most
+// recently used first, closes those it shouldn't keep, and returns the others
+// in the order they came in. The PINGs are sent at once, so that the
+// connections are held for a single round trip.
+func (sw *poolSweep) sweep(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), reclaimTimeout)
+	defer cancel()
+	var conns []*pool.Connection
+	for open := atomic.LoadInt64(&sw.counts.open); int64(len(conns)) < open; {
+		if atomic.LoadInt64(&sw.counts.open)-atomic.LoadInt64(&sw.counts.checkedOut) <= 0 {
+			break
+		}
+		conn, err := sw.server.Connection(ctx)
+		if err != nil {
+			break
+		}
+		conns = append(conns, conn)
+	}
+
+	keep := atomic.LoadInt64(&sw.counts.open)
+	var wg sync.WaitGroup
+	for i := len(conns) - 1; i >= 0; i-- {
+		ic, ok := idleConnOf(conns[i].Conn())
+		if !ok {
+			continue
+		}
+		idle := ic.idle(now)
+		switch {
+		case sw.maxIdle > 0 && idle > sw.maxIdle && keep > int64(sw.counts.minSize):
+			keep--
+			metrics.PoolReaped.Incr(sw.statsd)
+			_ = conns[i].Close()
+		case sw.pingAfter > 0 && idle >= sw.pingAfter:
+			wg.Add(1)
+			go func(conn *pool.Connection) {
+				defer wg.Done()
+				if err := sw.ping(conn, ic.Conn); err != nil {
+					metrics.PoolHealthChecks.Incr(sw.statsd, "failed")
+					sw.log.Debug("Idle upstream connection failed its health check", zap.Uint64("id", conn.ID()), zap.Error(err))
+					_ = conn.Close()
+					return
+				}
+				metrics.PoolHealthChecks.Incr(sw.statsd, "ok")
+			}(conns[i])
+		}
+	}
+	wg.Wait()
+	for i := len(conns) - 1; i >= 0; i-- {
+		_ = conns[i].Return()
+	}
+}
+
+// ping sends a PING on nc, the connection under the idleConn of conn
+func (sw *poolSweep) ping(conn *pool.Connection, nc net.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sw.timeout)
+	defer cancel()
+	addr := conn.Address().String()
+	wm := []*redis.Message{redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("PING"))})}
+	if err := handlers.WriteWireMessages(ctx, sw.log, wm, nc, addr, conn.ID(), sw.timeout, false, conn.Close); err != nil {
+		return err
+	}
+	res, err := handlers.ReadWireMessages(ctx, sw.log, nc, addr, conn.ID(), sw.timeout, 1, false, conn.Close)
+	if err != nil {
+		return err
+	}
+	return checkPong(res[0])
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/config"
+	redisproto "github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// pongNode answers every command with PONG, counting them and PINGs, and keeps
+// the server side of each connection for the test to close, as a server timing
+// out idle clients would
+type pongNode struct {
+	li       net.Listener
+	mu       sync.Mutex
+	conns    map[string]net.Conn
+	commands int64
+	pings    int64
+}
+
+func newPongNode(t *testing.T) *pongNode {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	n := &pongNode{li: li, conns: make(map[string]net.Conn)}
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			n.conns[conn.RemoteAddr().String()] = conn
+			n.mu.Unlock()
+			go n.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = li.Close() })
+	return n
+}
+
+func (n *pongNode) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	d := redisproto.NewDecoder(conn)
+	for {
+		m, err := d.Decode()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&n.commands, 1)
+		if len(m.Array) == 1 && string(m.Array[0].Value) == "PING" {
+			atomic.AddInt64(&n.pings, 1)
+		}
+		if err := redisproto.Encode(conn, redisproto.NewString([]byte("PONG"))); err != nil {
+			return
+		}
+	}
+}
+
+// closeIdle closes the server side of one of the idle connections of a pool
+func (n *pongNode) closeIdle(t *testing.T, s *pool.Server) {
+	conn, err := s.Connection(context.Background())
+	assert.NoError(t, err)
+	n.mu.Lock()
+	_ = n.conns[conn.Conn().LocalAddr().String()].Close()
+	n.mu.Unlock()
+	_ = conn.Return()
+}
+
+func startSweptProxy(t *testing.T, node *pongNode, upstream config.Upstream) *upstreamListener {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	upstream.UpstreamConfigHost, upstream.Database = node.li.Addr().String(), -1
+	upstream.ReadTimeout, upstream.WriteTimeout = time.Second, time.Second
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &upstream)
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+
+	var l *upstreamListener
+	assert.Eventually(t, func() bool {
+		p.listenerLock.Lock()
+		defer p.listenerLock.Unlock()
+		l = p.listeners[upstream.UpstreamConfigHost]
+		// once the command table the proxy loads has been, and its connection
+		// returned
+		return l != nil && atomic.LoadInt64(&l.pool.open) == int64(upstream.MinPoolSize) &&
+			atomic.LoadInt64(&node.commands) > 0 && atomic.LoadInt64(&l.pool.checkedOut) == 0
+	}, time.Second, time.Millisecond)
+	return l
+}
+
+// grow has the pool open n connections, all returned idle
+func grow(t *testing.T, l *upstreamListener, n int) {
+	var conns []*pool.Connection
+	for i := 0; i < n; i++ {
+		conn, err := l.server.Connection(context.Background())
+		assert.NoError(t, err)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		_ = conn.Return()
+	}
+	assert.Equal(t, int64(n), atomic.LoadInt64(&l.pool.open))
+}
+
+func TestPoolSweepReapsIdle(t *testing.T) {
+	node := newPongNode(t)
+	l := startSweptProxy(t, node, config.Upstream{MinPoolSize: 2, MaxPoolSize: 5, MaxConnIdleTime: time.Hour})
+	grow(t, l, 5)
+	sw := &poolSweep{log: zap.NewNop(), server: l.server, counts: l.pool, maxIdle: time.Hour}
+
+	sw.sweep(time.Now())
+	assert.Equal(t, int64(5), atomic.LoadInt64(&l.pool.open), "none has been idle for long enough")
+
+	sw.sweep(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&l.pool.open), "reaped down to the minimum")
+	assert.Equal(t, int64(0), atomic.LoadInt64(&l.pool.checkedOut))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&node.pings), "reaping sends nothing")
+
+	sw.sweep(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&l.pool.open))
+}
+
+func TestPoolSweepHealthCheck(t *testing.T) {
+	node := newPongNode(t)
+	l := startSweptProxy(t, node, config.Upstream{MinPoolSize: 3, MaxPoolSize: 5, IdlePingInterval: time.Hour})
+	sw := &poolSweep{log: zap.NewNop(), server: l.server, counts: l.pool, pingAfter: time.Hour, timeout: time.Second}
+
+	sw.sweep(time.Now())
+	assert.Equal(t, int64(0), atomic.LoadInt64(&node.pings), "none has been idle for long enough")
+
+	node.closeIdle(t, l.server)
+	sw.sweep(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&l.pool.open), "the dead one is discarded")
+	assert.Equal(t, int64(2), atomic.LoadInt64(&node.pings))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&l.pool.checkedOut))
+
+	// a PING isn't use, so the connections are as idle as they were
+	sw.sweep(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, int64(4), atomic.LoadInt64(&node.pings))
+}
+
+func TestPoolSweepOffByDefault(t *testing.T) {
+	node := newPongNode(t)
+	l := startSweptProxy(t, node, config.Upstream{MinPoolSize: 1, MaxPoolSize: 5})
+	conn, err := l.server.Connection(context.Background())
+	assert.NoError(t, err)
+	defer func() { _ = conn.Return() }()
+	_, ok := idleConnOf(conn.Conn())
+	assert.False(t, ok, "connections are left as they are dialed")
+}
+
+func TestSweepInterval(t *testing.T) {
+	assert.Equal(t, 10*time.Second, sweepInterval(0, 10*time.Second))
+	assert.Equal(t, 30*time.Second, sweepInterval(time.Minute, 0))
+	assert.Equal(t, 5*time.Second, sweepInterval(time.Minute, 5*time.Second))
+	assert.Equal(t, 30*time.Second, sweepInterval(time.Minute, time.Hour))
+	assert.Equal(t, time.Second, sweepInterval(time.Second, 0))
+}
@@ -4,21 +4,29 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/coinbase/memcachedbetween/listener"
 	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/auth"
 	"github.com/coinbase/redisbetween/config"
 	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/internal/workload"
+	"github.com/coinbase/redisbetween/memwatch"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/netaddr"
+	"github.com/coinbase/redisbetween/proxyerr"
 	"github.com/coinbase/redisbetween/redis"
-	"github.com/coinbase/mongobetween/util"
+	"github.com/coinbase/redisbetween/sanitize"
+	"github.com/coinbase/redisbetween/session"
 	"github.com/mediocregopher/radix/v3"
-	"io"
 	"net"
-	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
@@ -28,12 +36,21 @@ import (
 const restartSleep = 1 * time.Second
 const disconnectTimeout = 10 * time.Second
 
+// Version is the module version the proxy was built from, or unknown
+func Version() string {
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "unknown"
+}
+
 type Proxy struct {
 	log    *zap.Logger
 	statsd *statsd.Client
 
 	config *config.Config
 
+	label              string
 	upstreamConfigHost string
 	localConfigHost    string
 	maxPoolSize        int
@@ -41,49 +58,484 @@ type Proxy struct {
 	readTimeout        time.Duration
 	writeTimeout       time.Duration
 	database           int
+	retries            int
+	retryBudget        float64
+	reservedPoolSize   int
+	blockingPoolSize   int
+	pubSubPoolSize     int
+	resp3PoolSize      int
+	pubSubBuffer       config.PubSubBuffer
+	pinTransactions    bool
+	transactionIdle    time.Duration
+	criticalCommands   map[string]bool
+	criticalPrefixes   []string
+	splitThreshold     int
+	splitChunkSize     int
+	splitParallelism   int
+	atomicMaxCommands  int
+	pipelineReadahead  int
+	streamThreshold    int
+	streamMaxBytes     int
+	checksumPrefixes   []string
+	maxClients         int64
+	maxClientsClose    bool
+	socketPerms        socketPerms
+	ignoreSignals      bool
+	readOnly           *handlers.ReadOnly
+	readOnlyScripts    string
+	breaker            handlers.BreakerOptions
+	maxInFlight        int
+	connectRate        float64
+	connectBurst       int
+	connectWarnAfter   time.Duration
+	writeBehind        config.WriteBehind
+	readThrough        config.ReadThrough
+	readFallback       *Proxy
+	readFallbackNil    []string
+	coalesce           config.Coalesce
+	negativeCache      config.NegativeCache
+	poolAdvisor        config.PoolAdvisor
+	mirror             config.Mirror
+	warnings           config.Warnings
+	ttlPolicy          *handlers.TTLPolicy
+	strictValidation   bool
+	tracer             *handlers.Tracer
+	sessions           *session.Recorder
+	memory             *memwatch.Watchdog
+	auth               auth.Provider
+	databases          *handlers.Databases
+	slos               *handlers.SLOs
+	mix                *handlers.CommandMix
+	commandMetrics     handlers.CommandMetrics
+	commandFilter      *handlers.CommandFilter
+	hotspots           *handlers.Hotspots
+	slowLog            *handlers.SlowLog
+	accessLog          *handlers.AccessLog
+	segments           []handlers.Segment
+	segmentBorrow      bool
+	segmentWait        time.Duration
+	segmentsLock       sync.Mutex
+	socketPrefix       string
+	socketSuffix       string
+	policy             *listenerPolicy
+	policyLock         sync.Mutex
+	reloadLock         sync.Mutex
+	dynamicDB          bool
+	maxDBs             int
+	dbIdleTimeout      time.Duration
+	serverLatency      time.Duration
+	poolHealInterval   time.Duration
+	initBackoff        initBackoff
+	maxConnIdleTime    time.Duration
+	idlePingInterval   time.Duration
+	identity           config.Identity
+	scripts            config.Scripts
+	credentials        config.Credentials
+	tls                *tls.Config
+	errorRewriter      *handlers.ErrorRewriter
+	topologyRewriter   *handlers.TopologyRewriter
+	fairCheckout       bool
+	fairHold           int
+	configGetForward   bool
 
 	quit chan interface{}
 	kill chan interface{}
 
-	listeners    map[string]*listener.Listener
+	listeners    map[string]*upstreamListener
 	listenerLock sync.Mutex
 	listenerWg   sync.WaitGroup
+	discovery    *Discovery
+	benching     int32
+
+	// slots are the cluster slot ranges of each node, as last seen in CLUSTER
+	// SLOTS or CLUSTER NODES replies
+	slots     map[string]string
+	slotsLock sync.Mutex
+	// topology shares the slots with the other instances in front of the
+	// cluster, if configured
+	topology *coordinator
+
+	background     []func()
+	statsdClients  []*statsd.Client
+	backgroundLock sync.Mutex
+
+	// clients counts the open client connections across all listeners, and
+	// peakClients the most that were open at once. atMaxClients is set while
+	// new ones are rejected for there being maxClients open.
+	clients      int64
+	peakClients  int64
+	atMaxClients int32
+	// drainNew is set while the proxy is drained as a whole through the admin
+	// server, for the listeners it creates to start out draining too
+	drainNew int32
+
+	// successor is the proxy that took over the listeners after a reload of
+	// the upstream's config, and predecessor the one it took them over from
+	successor   *Proxy
+	predecessor *Proxy
 }
 
-func NewProxy(log *zap.Logger, sd *statsd.Client, config *config.Config, label, upstreamHost string, database int, minPoolSize, maxPoolSize int, readTimeout, writeTimeout time.Duration) (*Proxy, error) {
-	if label != "" {
-		log = log.With(zap.String("cluster", label))
+// upstreamListener is a listener for one upstream address, along with the state
+// shared by all of its client connections
+type upstreamListener struct {
+	*listener.Listener
+	upstream string
+	local    string
+	options  handlers.Options
+	server   *pool.Server
+	pool     *poolCounts
+	reserved *poolCounts
+	blocking *poolCounts
+	pubSub   *poolCounts
+	resp3    *poolCounts
+	statsd   *statsd.Client
+	latency  *serverLatency
 
-		var err error
-		sd, err = util.StatsdWithTags(sd, []string{fmt.Sprintf("cluster:%s", label)})
-		if err != nil {
-			return nil, err
-		}
+	// handler serves the connections accepted on a socket, and closePools
+	// disconnects the pools once every socket of the listener has closed: a
+	// socket being replaced is still open until its connections are done
+	handler    func(local string) listener.ConnectionHandler
+	closePools func()
+	sockets    int32
+	// retiring are the replaced sockets still accepting, by path, for clients
+	// that looked up the old path just before it changed
+	retiring map[*listener.Listener]string
+	// successor is the listener of another proxy that took over the sockets,
+	// and serving the connections the listener itself was handed by them
+	successor     *upstreamListener
+	successorLock sync.Mutex
+	serving       sync.WaitGroup
+	// bound is the path the socket was bound to: local, or a path of its own
+	// until it took the place of a predecessor's socket at local. predecessor
+	// is the connection to the instance listening on local until then, which
+	// is asked to hand it off once the socket listens. handedOff is set once
+	// the socket was handed off to a successor in turn, and accepting once
+	// the socket first answered at local.
+	bound       string
+	predecessor net.Conn
+	handedOff   int32
+	accepting   int32
+	// draining is set while the listener refuses new client connections, having
+	// been drained through the admin server
+	draining int32
+}
+
+func NewProxy(log *zap.Logger, sd *statsd.Client, config *config.Config, upstream *config.Upstream) (*Proxy, error) {
+	criticalCommands := make(map[string]bool, len(upstream.CriticalCommands))
+	for _, c := range upstream.CriticalCommands {
+		criticalCommands[strings.ToUpper(c)] = true
+	}
+	if upstream.Label != "" {
+		log = log.With(zap.String("cluster", upstream.Label))
 	}
-	return &Proxy{
+	p := &Proxy{
 		log:    log,
 		statsd: sd,
 		config: config,
 
-		upstreamConfigHost: upstreamHost,
-		localConfigHost:    localSocketPathFromUpstream(upstreamHost, database, config.LocalSocketPrefix, config.LocalSocketSuffix),
-		minPoolSize:        minPoolSize,
-		maxPoolSize:        maxPoolSize,
-		readTimeout:        readTimeout,
-		writeTimeout:       writeTimeout,
-		database:           database,
+		label:              upstream.Label,
+		upstreamConfigHost: upstream.UpstreamConfigHost,
+		localConfigHost:    localSocketPathFromUpstream(upstream.UpstreamConfigHost, upstream.Database, config.LocalSocketPrefix, config.LocalSocketSuffix),
+		minPoolSize:        upstream.MinPoolSize,
+		maxPoolSize:        upstream.MaxPoolSize,
+		readTimeout:        upstream.ReadTimeout,
+		writeTimeout:       upstream.WriteTimeout,
+		database:           upstream.Database,
+		retries:            upstream.Retries,
+		retryBudget:        upstream.RetryBudget,
+		reservedPoolSize:   upstream.ReservedPoolSize,
+		blockingPoolSize:   upstream.BlockingPoolSize,
+		pubSubPoolSize:     upstream.PubSubPoolSize,
+		resp3PoolSize:      upstream.RESP3PoolSize,
+		pubSubBuffer:       upstream.PubSubBuffer,
+		pinTransactions:    upstream.PinTransactions,
+		transactionIdle:    upstream.TransactionIdle,
+		criticalCommands:   criticalCommands,
+		criticalPrefixes:   upstream.CriticalPrefixes,
+		splitThreshold:     upstream.SplitThreshold,
+		splitChunkSize:     upstream.SplitChunkSize,
+		splitParallelism:   upstream.SplitParallelism,
+		atomicMaxCommands:  upstream.AtomicMaxCommands,
+		pipelineReadahead:  upstream.PipelineReadahead,
+		streamThreshold:    upstream.StreamThreshold,
+		streamMaxBytes:     upstream.StreamMaxBytes,
+		checksumPrefixes:   upstream.ChecksumPrefixes,
+		maxClients:         int64(upstream.MaxClients),
+		maxClientsClose:    upstream.MaxClientsClose,
+		socketPerms:        socketPermsOf(config, upstream),
+		ignoreSignals:      upstream.IgnorePipelineSignals,
+		identity:           upstream.Identity,
+		scripts:            upstream.Scripts,
+		credentials:        upstream.Credentials,
+		readOnly:           handlers.NewReadOnly(upstream.ReadOnly),
+		readOnlyScripts:    upstream.ReadOnlyScripts,
+		breaker: handlers.BreakerOptions{
+			ErrorRate:   upstream.BreakerErrorRate,
+			Latency:     upstream.BreakerLatency,
+			MinRequests: upstream.BreakerMinRequests,
+			Window:      upstream.BreakerWindow,
+			Cooldown:    upstream.BreakerCooldown,
+			Failures:    upstream.BreakerFailures,
+			Ping:        upstream.BreakerPing,
+		},
+		maxInFlight:      upstream.MaxInFlight,
+		connectRate:      upstream.ConnectRate,
+		connectBurst:     upstream.ConnectBurst,
+		connectWarnAfter: upstream.ConnectWarnAfter,
+		writeBehind:      upstream.WriteBehind,
+		readThrough:      upstream.ReadThrough,
+		readFallbackNil:  upstream.ReadFallback.NilPrefixes,
+		coalesce:         upstream.Coalesce,
+		negativeCache:    upstream.NegativeCache,
+		poolAdvisor:      upstream.PoolAdvisor,
+		mirror:           upstream.Mirror,
+		warnings:         upstream.Warnings,
+		strictValidation: upstream.StrictValidation,
+		dynamicDB:        upstream.DynamicDB,
+		maxDBs:           upstream.MaxDBs,
+		dbIdleTimeout:    upstream.DBIdleTimeout,
+		serverLatency:    upstream.ServerLatency,
+		poolHealInterval: upstream.PoolHealInterval,
+		maxConnIdleTime:  upstream.MaxConnIdleTime,
+		idlePingInterval: upstream.IdlePingInterval,
+		fairCheckout:     upstream.FairCheckout,
+		fairHold:         upstream.FairHold,
+		configGetForward: upstream.ConfigGetForward,
+		socketPrefix:     config.LocalSocketPrefix,
+		socketSuffix:     config.LocalSocketSuffix,
+		tracer:           handlers.NewTracer(config.TraceSampleRate, handlers.DefaultTraceKeep),
+		databases:        handlers.NewDatabases(),
+		commandFilter:    handlers.NewCommandFilter(upstream.AllowCommands, upstream.DenyCommands),
 
 		quit: make(chan interface{}),
 		kill: make(chan interface{}),
 
-		listeners: make(map[string]*listener.Listener),
-	}, nil
+		listeners: make(map[string]*upstreamListener),
+		slots:     make(map[string]string),
+	}
+	if len(upstream.SLOs) > 0 {
+		slos := make([]handlers.SLO, len(upstream.SLOs))
+		for i, s := range upstream.SLOs {
+			slos[i] = handlers.SLO{Name: s.Name, Class: handlers.NormalizeSLOClass(s.Class), Threshold: s.Threshold, Objective: s.Objective}
+		}
+		p.slos = handlers.NewSLOs(slos, upstream.SLOMinSamples)
+	}
+	if upstream.CommandMixTop > 0 {
+		p.mix = handlers.NewCommandMix(upstream.CommandMixTop)
+	}
+	if h := upstream.Hotspots; h.Sample > 0 || len(h.Banned) > 0 {
+		p.hotspots = handlers.NewHotspots(handlers.HotspotOptions{Sample: h.Sample, Share: h.Share, Window: h.Window, MinSamples: h.MinSamples, Banned: h.Banned})
+	}
+	if sl := upstream.SlowLog; sl.Threshold > 0 {
+		p.slowLog = handlers.NewSlowLog(handlers.SlowLogOptions{Threshold: sl.Threshold, KeyBytes: sl.KeyBytes, Redact: sl.Redact})
+	}
+	switch cm := upstream.CommandMetrics; {
+	case cm == nil:
+		p.commandMetrics = handlers.NewCommandMetrics(handlers.DefaultCommandMetrics)
+	case len(cm) == 1 && strings.EqualFold(cm[0], "none"):
+		// left nil, which disables the command metrics
+	default:
+		p.commandMetrics = handlers.NewCommandMetrics(cm)
+	}
+	for _, seg := range upstream.Segments.List {
+		commands := make(map[string]bool, len(seg.Commands))
+		for _, c := range seg.Commands {
+			commands[strings.ToUpper(c)] = true
+		}
+		p.segments = append(p.segments, handlers.Segment{Name: seg.Name, Share: seg.Share, Rule: handlers.Rule{Commands: commands, Prefixes: seg.Prefixes}})
+	}
+	p.segmentBorrow, p.segmentWait = upstream.Segments.Borrow, upstream.Segments.Wait
+	if t := upstream.Topology; t.Key != "" || len(t.Peers) > 0 {
+		p.topology = newCoordinator(p, t)
+	}
+	if upstream.TopologyRewrite {
+		p.topologyRewriter = &handlers.TopologyRewriter{Local: p.localFor}
+	}
+	if t := upstream.TTLPolicy; len(t.Namespaces) > 0 {
+		p.ttlPolicy = &handlers.TTLPolicy{PersistToExpire: t.Persist == "expire", FollowUp: t.FollowUp}
+		for _, ns := range t.Namespaces {
+			p.ttlPolicy.Namespaces = append(p.ttlPolicy.Namespaces, handlers.TTLNamespace{Prefix: ns.Prefix, MaxTTL: ns.MaxTTL})
+		}
+	}
+	if upstream.ErrorRewrite != "" {
+		p.errorRewriter = &handlers.ErrorRewriter{Local: p.localFor, Scrub: upstream.ErrorRewrite == "scrub", Name: p.Name()}
+	}
+	var err error
+	if p.tls, err = upstreamTLSConfig(upstream.TLS); err != nil {
+		return nil, err
+	}
+	if err := p.socketPerms.resolve(config.Network); err != nil {
+		return nil, err
+	}
+	if upstream.Label != "" {
+		p.statsd, err = p.taggedStatsd(sd, []string{sanitize.Tag("cluster", upstream.Label)})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
 }
 
 func (p *Proxy) Run() error {
+	p.start()
 	return p.run()
 }
 
+// start begins what the proxy does besides its listeners
+func (p *Proxy) start() {
+	if p.readOnly.Enabled() {
+		p.log.Warn("Upstream is in read-only mode, writes will be rejected")
+	}
+	p.reportReadOnly()
+	p.schedule(func() {
+		metrics.ClientsOpen.Set(p.statsd, float64(atomic.LoadInt64(&p.clients)))
+		metrics.ClientsPeak.Set(p.statsd, float64(atomic.LoadInt64(&p.peakClients)))
+	})
+	if p.slos != nil {
+		p.schedule(func() { p.slos.Report(p.statsd) })
+	}
+	if p.mix != nil {
+		p.schedule(func() { p.mix.Report(p.statsd) })
+	}
+	if p.hotspots != nil {
+		p.schedule(func() { p.hotspots.Tick(p.log, p.statsd) })
+	}
+	if p.topology != nil {
+		p.reportTopology()
+		go p.topology.run(p.quit)
+	}
+}
+
+// Name identifies the proxy in admin routes, by its label if it has one
+func (p *Proxy) Name() string {
+	if p.label != "" {
+		return p.label
+	}
+	return p.upstreamConfigHost
+}
+
+// eachListener calls fn with the listeners of proxies, those of the upstreams
+// or nodes named only, all of them if names is empty, naming one that doesn't
+// exist being an error
+func eachListener(proxies []*Proxy, names []string, fn func(p *Proxy, l *upstreamListener)) error {
+	match := make(map[string]bool, len(names))
+	for _, n := range names {
+		match[n] = false
+	}
+	for _, p := range proxies {
+		_, all := match[p.Name()]
+		if all {
+			match[p.Name()] = true
+		}
+		p.listenerLock.Lock()
+		for _, l := range p.listeners {
+			_, node := match[l.upstream]
+			if node {
+				match[l.upstream] = true
+			}
+			if all || node || len(names) == 0 {
+				fn(p, l)
+			}
+		}
+		p.listenerLock.Unlock()
+	}
+	for _, n := range names {
+		if !match[n] {
+			return fmt.Errorf("no upstream named %s", n)
+		}
+	}
+	return nil
+}
+
+// RecordSessions records the sessions of the clients the recorder's rules are
+// armed for. It must be called before Run.
+func (p *Proxy) RecordSessions(r *session.Recorder) {
+	p.sessions = r
+}
+
+// LogAccess logs the requests of the proxy's clients to log, as opts say. It
+// must be called before Run.
+func (p *Proxy) LogAccess(log *zap.Logger, opts handlers.AccessLogOptions) {
+	if p.label != "" {
+		log = log.With(zap.String("cluster", p.label))
+	}
+	p.accessLog = handlers.NewAccessLog(log, opts)
+}
+
+// WatchMemory sheds requests, and refuses connections, while the watchdog says
+// the process is over its memory limits. It must be called before Run.
+func (p *Proxy) WatchMemory(w *memwatch.Watchdog) {
+	p.memory = w
+}
+
+// AuthenticateClients makes clients authenticate with the provider before
+// anything else. It must be called before Run.
+func (p *Proxy) AuthenticateClients(provider auth.Provider) {
+	p.auth = provider
+}
+
+// ShareDatabases tracks the caches of the proxy's databases along with those of
+// the other proxies sharing d, so that a FLUSHALL or SWAPDB through one clears
+// the caches of the others' databases too. It must be called before Run.
+func (p *Proxy) ShareDatabases(d *handlers.Databases) {
+	p.databases = d
+}
+
+func (p *Proxy) ReadOnly() bool {
+	return p.readOnly.Enabled()
+}
+
+// SetReadOnly toggles read-only mode for every connection to the upstream. It
+// applies to all commands that have not yet been forwarded.
+func (p *Proxy) SetReadOnly(enabled bool) {
+	if p.readOnly.Enabled() == enabled {
+		return
+	}
+	p.readOnly.Set(enabled)
+	if enabled {
+		p.log.Warn("Upstream switched to read-only mode, writes will be rejected")
+	} else {
+		p.log.Warn("Upstream switched out of read-only mode, writes are allowed")
+	}
+}
+
+// Segments returns the shares of the pool segments, as percentages
+func (p *Proxy) Segments() map[string]float64 {
+	p.segmentsLock.Lock()
+	defer p.segmentsLock.Unlock()
+	shares := make(map[string]float64, len(p.segments))
+	for _, seg := range p.segments {
+		shares[seg.Name] = seg.Share * 100
+	}
+	return shares
+}
+
+// SetSegmentShares changes the shares of pool segments, fractions of the pool
+// by name, in every node's pool and in those created later
+func (p *Proxy) SetSegmentShares(shares map[string]float64) error {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	p.segmentsLock.Lock()
+	defer p.segmentsLock.Unlock()
+	if len(shares) != len(p.segments) {
+		return fmt.Errorf("expected a share for each of the %d pool segments", len(p.segments))
+	}
+	for i, seg := range p.segments {
+		share, ok := shares[seg.Name]
+		if !ok {
+			return fmt.Errorf("missing a share for pool segment %s", seg.Name)
+		}
+		p.segments[i].Share = share
+	}
+	for _, l := range p.listeners {
+		if err := l.options.Segments.SetShares(shares); err != nil {
+			return err
+		}
+	}
+	p.log.Info("Changed pool segment shares", zap.Any("shares", shares))
+	return nil
+}
+
 func (p *Proxy) Shutdown() {
 	defer func() {
 		_ = recover() // "close of closed channel" panic if Shutdown() was already called
@@ -91,9 +543,14 @@ func (p *Proxy) Shutdown() {
 	p.listenerLock.Lock()
 	for _, l := range p.listeners {
 		l.Shutdown()
+		for r := range l.retiring {
+			r.Shutdown()
+		}
 	}
 	p.listenerLock.Unlock()
 	close(p.quit)
+	p.stopBackground()
+	p.refreshDiscovery()
 }
 
 func (p *Proxy) Kill() {
@@ -104,6 +561,9 @@ func (p *Proxy) Kill() {
 	p.listenerLock.Lock()
 	for _, l := range p.listeners {
 		l.Kill()
+		for r := range l.retiring {
+			r.Kill()
+		}
 	}
 	p.listenerLock.Unlock()
 	close(p.kill)
@@ -140,11 +600,13 @@ func (p *Proxy) run() error {
 		p.runListener(l)
 	}
 	p.listenerLock.Unlock()
+	p.refreshDiscovery()
 
 	return nil
 }
 
-func (p *Proxy) runListener(l *listener.Listener) {
+func (p *Proxy) runListener(l *upstreamListener) {
+	stopped := make(chan error, 1)
 	p.listenerWg.Add(1)
 	go func() {
 		defer p.listenerWg.Done()
@@ -153,40 +615,66 @@ func (p *Proxy) runListener(l *listener.Listener) {
 		if err != nil {
 			p.log.Error("Error", zap.Error(err))
 		}
+		stopped <- err
+	}()
+	if conn := l.predecessor; conn != nil {
+		l.predecessor = nil
+		p.takeSocket(l, conn, stopped)
+		return
+	}
+	go func() {
+		if p.awaitSocket(l.bound, stopped) != nil {
+			return
+		}
+		if l.bound != l.local {
+			if err := p.placeSocket(l.bound, l.local); err != nil {
+				p.log.Error("Could not give the socket its permissions", zap.String("upstream", l.upstream), zap.String("local", l.local), zap.Error(err))
+				l.Shutdown()
+				return
+			}
+		}
+		atomic.StoreInt32(&l.accepting, 1)
 	}()
 }
 
 func (p *Proxy) interceptMessages(originalCmds []string, mm []*redis.Message) {
 	for i, m := range mm {
 		if originalCmds[i] == "CLUSTER SLOTS" {
-			b, err := redis.EncodeToBytes(m)
-			if err != nil {
-				p.log.Error("failed to encode cluster slots message", zap.Error(err))
-				return
-			}
-			slots := radix.ClusterTopo{}
-			err = slots.UnmarshalRESP(bufio.NewReader(bytes.NewReader(b)))
-			if err != nil {
+			if err := p.observeClusterSlots(m, originalCmds[i]); err != nil {
 				p.log.Error("failed to unmarshal cluster slots message", zap.Error(err))
-				return
 			}
-			for _, slot := range slots {
-				p.ensureListenerForUpstream(slot.Addr, originalCmds[i])
-			}
-			return
+			continue
+		}
+
+		if originalCmds[i] == "CLUSTER SHARDS" {
+			handlers.VisitClusterNodes(originalCmds[i], m, func(node string) (string, bool) {
+				p.ensureListenerForClient(node, originalCmds[i])
+				return "", false
+			})
+			continue
 		}
 
 		if originalCmds[i] == "CLUSTER NODES" {
 			if m.IsBulkBytes() {
+				ranges := make(map[string][]string)
 				lines := strings.Split(string(m.Value), "\n")
 				for _, line := range lines {
 					lt := strings.IndexByte(line, ' ')
 					rt := strings.IndexByte(line, '@')
 					if lt > 0 && rt > 0 {
-						hostPort := line[lt+1 : rt]
-						p.ensureListenerForUpstream(hostPort, originalCmds[i])
+						hostPort := netaddr.FromNode(line[lt+1 : rt])
+						p.ensureListenerForClient(hostPort, originalCmds[i])
+						// fields after the 8th are the slots, or importing/migrating markers in brackets
+						if fields := strings.Fields(line); len(fields) > 8 {
+							for _, f := range fields[8:] {
+								if !strings.HasPrefix(f, "[") {
+									ranges[hostPort] = append(ranges[hostPort], f)
+								}
+							}
+						}
 					}
 				}
+				p.setSlotRanges(ranges)
 			}
 		}
 
@@ -195,121 +683,832 @@ func (p *Proxy) interceptMessages(originalCmds []string, mm []*redis.Message) {
 			if strings.HasPrefix(msg, "MOVED") || strings.HasPrefix(msg, "ASK") {
 				parts := strings.Split(msg, " ")
 				if len(parts) < 3 {
+					// the other replies of a pipeline may still have redirects of their own
 					p.log.Error("failed to parse MOVED error", zap.String("original command", originalCmds[i]), zap.String("original message", msg))
-					return
+					continue
+				}
+				node := netaddr.FromNode(parts[2])
+				if p.ensureListenerForUpstream(node, originalCmds[i]+" "+parts[0]) && p.errorRewriter != nil {
+					// the client follows the rewritten redirect right away
+					p.awaitListening(node)
+				}
+				// a slot that moved means the topology changed, while ASK is a migration in progress
+				if parts[0] == "MOVED" {
+					p.topology.trigger("moved")
 				}
-				p.ensureListenerForUpstream(parts[2], originalCmds[i]+" "+parts[0])
 			}
 		}
 	}
 }
 
+// ensureListenerForClient ensures there is a listener for a node of a topology
+// reply a client is given, waiting for one that was added to accept when the
+// reply is rewritten, since the client connects to it right away
+func (p *Proxy) ensureListenerForClient(upstream, originalCmd string) {
+	if p.ensureListenerForUpstream(upstream, originalCmd) && p.topologyRewriter != nil {
+		p.awaitListening(upstream)
+	}
+}
+
+// observeClusterSlots ensures there is a listener for every node of a CLUSTER
+// SLOTS reply, and records the slots each serves
+func (p *Proxy) observeClusterSlots(m *redis.Message, originalCmd string) error {
+	b, err := redis.EncodeToBytes(m)
+	if err != nil {
+		return err
+	}
+	slots := radix.ClusterTopo{}
+	if err := slots.UnmarshalRESP(bufio.NewReader(bytes.NewReader(b))); err != nil {
+		return err
+	}
+	ranges := make(map[string][]string)
+	for _, slot := range slots {
+		addr := netaddr.FromNode(slot.Addr)
+		p.ensureListenerForClient(addr, originalCmd)
+		for _, r := range slot.Slots {
+			ranges[addr] = append(ranges[addr], slotRange(r[0], r[1]-1))
+		}
+	}
+	p.setSlotRanges(ranges)
+	return nil
+}
+
+// localSocketPathFromUpstream derives the socket path for an upstream. The host
+// portion is passed through sanitize.PathComponent, so ordinary host names are
+// unchanged while anything unusual is escaped deterministically. IPv6 literals,
+// which are normalized before they get here, are named ipv6-<address>-<port>
+// without their brackets.
 func localSocketPathFromUpstream(upstream string, database int, prefix, suffix string) string {
-	path := prefix + strings.Replace(upstream, ":", "-", -1)
+	name := upstream
+	if netaddr.IsIPv6(upstream) {
+		name = "ipv6-" + strings.NewReplacer("[", "", "]", "").Replace(upstream)
+	}
+	path := prefix + sanitize.PathComponent(strings.Replace(name, ":", "-", -1))
 	if database > -1 {
 		path += "-" + strconv.Itoa(database)
 	}
 	return path + suffix
 }
 
-func (p *Proxy) ensureListenerForUpstream(upstream, originalCmd string) {
+// LocalSocketPath is the socket path an upstream of the config is served on
+func LocalSocketPath(c *config.Config, u config.Upstream) string {
+	return localSocketPathFromUpstream(u.UpstreamConfigHost, u.Database, c.LocalSocketPrefix, c.LocalSocketSuffix)
+}
+
+// CheckSocketPaths checks that no two upstreams of the config would listen on
+// the same socket, which addresses that only differ in characters escaped or
+// replaced in socket paths, like host:6379 and host-6379, would, and that those
+// given socket permissions can be bound elsewhere first
+func CheckSocketPaths(c *config.Config) error {
+	seen := make(map[string]config.Upstream, len(c.Upstreams))
+	name := func(u config.Upstream) string {
+		if u.Label != "" {
+			return u.Label + " " + u.UpstreamConfigHost
+		}
+		return u.UpstreamConfigHost
+	}
+	for _, u := range c.Upstreams {
+		path := LocalSocketPath(c, u)
+		if socketPermsOf(c, &u).set() && len(path)+handOffSuffix > maxSocketPath {
+			return fmt.Errorf("socket path %s of upstream %s is too long to be bound elsewhere first for socketmode and socketgroup", path, name(u))
+		}
+		if other, ok := seen[path]; ok {
+			return fmt.Errorf("upstreams %s and %s would both listen on %s", name(other), name(u), path)
+		}
+		seen[path] = u
+	}
+	return nil
+}
+
+// ensureListenerForUpstream starts a listener for an upstream node if there is
+// none yet, and returns whether it did
+func (p *Proxy) ensureListenerForUpstream(upstream, originalCmd string) (added bool) {
 	p.log.Info("ensuring we have a listener for", zap.String("upstream", upstream), zap.String("command", originalCmd))
+	defer func() {
+		if added {
+			p.refreshDiscovery()
+		}
+	}()
 	p.listenerLock.Lock()
 	defer p.listenerLock.Unlock()
+	// a proxy that shut down, or was replaced, starts no more listeners
+	select {
+	case <-p.quit:
+		return false
+	default:
+	}
 	_, ok := p.listeners[upstream]
 	if !ok {
-		local := localSocketPathFromUpstream(upstream, p.database, p.config.LocalSocketPrefix, p.config.LocalSocketSuffix)
+		local := localSocketPathFromUpstream(upstream, p.database, p.socketPrefix, p.socketSuffix)
 		p.log.Info("did not find listener, creating new one", zap.String("upstream", upstream), zap.String("local", local), zap.String("command", originalCmd))
 		l, err := p.createListener(local, upstream)
 		if err != nil {
 			p.log.Error("unable to create listener", zap.Error(err))
+			return false
 		}
 		p.listeners[upstream] = l
 		p.runListener(l)
+		added = true
+	}
+	return added
+}
+
+// awaitListening waits for the socket of a listener that was just started to
+// answer, for a client told to connect to it
+func (p *Proxy) awaitListening(upstream string) {
+	local, ok := p.localFor(upstream)
+	if !ok {
+		return
+	}
+	deadline := time.Now().Add(socketReadyTimeout)
+	for {
+		err := beat(p.config.Network, local, socketReadyTimeout)
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			p.log.Warn("Listener did not start in time", zap.String("upstream", upstream), zap.String("local", local), zap.Error(err))
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+func (p *Proxy) createListener(local, upstream string) (*upstreamListener, error) {
+	if err := p.checkSocketPerms(local); err != nil {
+		return nil, err
+	}
+	ul, err := p.newUpstreamListener(local, upstream)
+	if err != nil {
+		return nil, err
+	}
+	bind, predecessor := local, p.dialPredecessor(local)
+	if predecessor != nil || p.socketPerms.set() {
+		bind = handOffPath(local)
+	}
+	l, err := ul.newSocket(p.log.With(zap.String("upstream", upstream), zap.String("local", local)), p.config.Network, local, bind, p.config.Unlink)
+	if err != nil {
+		if predecessor != nil {
+			_ = predecessor.Close()
+		}
+		return nil, err
 	}
+	ul.Listener, ul.bound, ul.predecessor = l, bind, predecessor
+	return ul, nil
 }
 
-func (p *Proxy) createListener(local, upstream string) (*listener.Listener, error) {
+// newUpstreamListener builds the pools and the state shared by the client
+// connections of a listener, without its socket
+func (p *Proxy) newUpstreamListener(local, upstream string) (*upstreamListener, error) {
 	logWith := p.log.With(zap.String("upstream", upstream), zap.String("local", local))
-	sdWith, err := util.StatsdWithTags(p.statsd, []string{fmt.Sprintf("upstream:%s", upstream), fmt.Sprintf("local:%s", local)})
+	if h := strings.Replace(upstream, ":", "-", -1); sanitize.PathComponent(h) != h {
+		logWith.Warn("upstream address contains characters that are unsafe in socket paths, they have been escaped")
+	}
+	sdWith, err := p.taggedStatsd(p.statsd, []string{sanitize.Tag("upstream", upstream), sanitize.Tag("local", local)})
 	if err != nil {
 		return nil, err
 	}
-	opts := []pool.ServerOption{
-		pool.WithMinConnections(func(uint64) uint64 { return uint64(p.minPoolSize) }),
-		pool.WithMaxConnections(func(uint64) uint64 { return uint64(p.maxPoolSize) }),
-		pool.WithConnectionPoolMonitor(func(*pool.Monitor) *pool.Monitor { return poolMonitor(sdWith) }),
+	// every pool dialing the upstream waits on the same connection rate limit
+	var limiter *connectLimiter
+	if p.connectRate > 0 {
+		limiter = connectLimiterFor(upstream, p.connectRate, p.connectBurst)
+		p.reportConnectLimiter(logWith, sdWith, limiter)
+	}
+	if err := p.checkCredentials(logWith, sdWith, upstream); err != nil {
+		return nil, err
+	}
+	counts := &poolCounts{minSize: p.minPoolSize, maxSize: p.maxPoolSize}
+	p.advise(logWith, sdWith, counts, "general")
+	s, err := p.connectServer(logWith, sdWith, upstream, limiter, counts, p.database)
+	if err != nil {
+		return nil, err
 	}
 
-	// if a db number has been specified, we need to issue a SELECT command before adding
-	// that connection to the pool, so its always pinned to the right db
-	if p.database > -1 {
-		co := pool.WithDialer(func(dialer pool.Dialer) pool.Dialer {
-			return pool.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
-				dlr := &net.Dialer{Timeout: 30 * time.Second}
-				conn, err := dlr.DialContext(ctx, network, address)
-				if err != nil {
-					return conn, err
+	// the reserved lane is a separate, always-warm pool that only critical commands
+	// may use, so they keep working when the general pool is saturated
+	var reserved *pool.Server
+	var reservedCounts *poolCounts
+	if p.reservedPoolSize > 0 {
+		sdReserved, err := p.taggedStatsd(sdWith, []string{"lane:reserved"})
+		if err != nil {
+			return nil, err
+		}
+		reservedCounts = &poolCounts{minSize: p.reservedPoolSize, maxSize: p.reservedPoolSize}
+		p.advise(logWith, sdReserved, reservedCounts, "reserved")
+		reserved, err = p.connectServer(logWith, sdReserved, upstream, limiter, reservedCounts, p.database)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// blocking commands wait on a pool of their own, which starts empty, so that
+	// the clients blocked on them hold none of the general pool's connections
+	var blocking *handlers.Blocking
+	var blockingCounts *poolCounts
+	if p.blockingPoolSize > 0 {
+		sdBlocking, err := p.taggedStatsd(sdWith, []string{"lane:blocking"})
+		if err != nil {
+			return nil, err
+		}
+		blockingCounts = &poolCounts{maxSize: p.blockingPoolSize}
+		p.advise(logWith, sdBlocking, blockingCounts, "blocking")
+		bs, err := p.connectServer(logWith, sdBlocking, upstream, limiter, blockingCounts, p.database)
+		if err != nil {
+			return nil, err
+		}
+		blocking = &handlers.Blocking{Server: bs}
+		p.schedule(func() { metrics.BlockingRequests.Set(sdWith, float64(blocking.Blocked())) })
+	}
+	// and subscribed clients each pin one of a pool of their own for as long
+	// as they are subscribed
+	var pubSub *handlers.PubSub
+	var pubSubCounts *poolCounts
+	if p.pubSubPoolSize > 0 {
+		sdPubSub, err := p.taggedStatsd(sdWith, []string{"lane:pubsub"})
+		if err != nil {
+			return nil, err
+		}
+		pubSubCounts = &poolCounts{maxSize: p.pubSubPoolSize}
+		p.advise(logWith, sdPubSub, pubSubCounts, "pubsub")
+		ps, err := p.connectServer(logWith, sdPubSub, upstream, limiter, pubSubCounts, p.database)
+		if err != nil {
+			return nil, err
+		}
+		pubSub = &handlers.PubSub{Server: ps, MaxBytes: p.pubSubBuffer.MaxBytes, MaxAge: p.pubSubBuffer.MaxAge, Overflow: p.pubSubBuffer.Overflow}
+		p.schedule(func() { metrics.PubSubPinned.Set(sdWith, float64(pubSub.Pinned())) })
+	}
+	// clients that negotiate RESP3 with HELLO 3 are served over a pool of their
+	// own, whose connections speak it, unless the upstream doesn't
+	var resp3 *pool.Server
+	var resp3Counts *poolCounts
+	if p.resp3PoolSize > 0 && p.checkRESP3(logWith, sdWith, upstream) {
+		sdRESP3, err := p.taggedStatsd(sdWith, []string{"lane:resp3"})
+		if err != nil {
+			return nil, err
+		}
+		resp3Counts = &poolCounts{maxSize: p.resp3PoolSize, resp3: true}
+		p.advise(logWith, sdRESP3, resp3Counts, "resp3")
+		resp3, err = p.connectServer(logWith, sdRESP3, upstream, limiter, resp3Counts, p.database)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// clients in a transaction pin a connection of the general pool until it
+	// is closed
+	var transactions *handlers.Transactions
+	if p.pinTransactions {
+		transactions = &handlers.Transactions{IdleTimeout: p.transactionIdle}
+		p.schedule(func() { metrics.TransactionsPinned.Set(sdWith, float64(transactions.Pinned())) })
+	}
+
+	ul := &upstreamListener{upstream: upstream, local: local, server: s, pool: counts, reserved: reservedCounts, blocking: blockingCounts, pubSub: pubSubCounts, resp3: resp3Counts, statsd: sdWith,
+		draining: atomic.LoadInt32(&p.drainNew)}
+	if p.serverLatency > 0 {
+		ul.latency = p.sampleServerLatency(ul, logWith, sdWith)
+	}
+	// connections without a database of their own are on the default one
+	db := p.database
+	if db < 0 {
+		db = 0
+	}
+	opts := handlers.Options{
+		Retries:           p.retries,
+		Reserved:          reserved,
+		Blocking:          blocking,
+		PubSub:            pubSub,
+		RESP3:             resp3,
+		Transactions:      transactions,
+		CommandMetrics:    p.commandMetrics,
+		CommandFilter:     p.commandFilter,
+		Hotspots:          p.hotspots,
+		SlowLog:           p.slowLog,
+		AccessLog:         p.accessLog,
+		CriticalCommands:  p.criticalCommands,
+		CriticalPrefixes:  p.criticalPrefixes,
+		ClientLibraries:   handlers.NewClientLibraries(handlers.MaxClientLibraries),
+		DeprecatedClients: p.config.DeprecatedClients,
+		SplitThreshold:    p.splitThreshold,
+		SplitChunkSize:    p.splitChunkSize,
+		SplitParallelism:  p.splitParallelism,
+		AtomicMaxCommands: p.atomicMaxCommands,
+		Upstream:          upstream,
+		UpstreamUser:      p.credentials.User,
+		ProxyVersion:      Version(),
+		EnrichACLErrors:   p.config.EnrichACLErrors,
+		PlainErrors:       p.config.PlainErrors,
+		ErrorRewriter:     p.errorRewriter,
+		TopologyRewriter:  p.topologyRewriter,
+		TTLPolicy:         p.ttlPolicy,
+		ReadOnly:          p.readOnly,
+		ReadOnlyScripts:   p.readOnlyScripts,
+		StrictValidation:  p.strictValidation,
+		Sockets:           p.sockets,
+		Bench: func(cfg workload.Config) (workload.Result, error) {
+			return p.bench(p.socketOf(ul), cfg)
+		},
+		Schema:      func() interface{} { return StatsSchema() },
+		HandOff:     p.handOffFunc(ul),
+		Slots:       func() string { return p.slotRanges(upstream) },
+		Keys:        handlers.NewKeyTable(),
+		Tracer:      p.tracer,
+		Sessions:    p.sessions,
+		Memory:      p.memory,
+		AuthTimeout: p.config.ClientAuth.Timeout,
+		LocalAuth:   p.credentials.Enabled(),
+		Database:    db,
+		Databases:   p.databases,
+		SLOs:        p.slos,
+		Mix:         p.mix,
+		AllowSwapDB: p.config.AllowSwapDB,
+		DrainNotify: p.config.DrainNotify,
+		Activity:    &handlers.Activity{},
+		Traffic:     &handlers.Traffic{},
+		Signals:     handlers.NewSignals(),
+
+		ConfigCache:       p.refreshConfig(ul, logWith, sdWith),
+		ConfigGetForward:  p.configGetForward,
+		AllowConfigWrites: p.config.AllowConfigWrites,
+
+		FirstByteTimeout: p.config.FirstByteTimeout,
+		ProgressTimeout:  p.config.ProgressTimeout,
+		IdleTimeout:      p.config.IdleTimeout,
+
+		IgnorePipelineSignals: p.ignoreSignals,
+		Readahead:             p.pipelineReadahead,
+
+		StreamThreshold: p.streamThreshold,
+		StreamMaxBytes:  p.streamMaxBytes,
+	}
+	if p.identity.Enabled() {
+		opts.Identity = p.checkIdentity(ul, logWith, sdWith)
+	}
+	if len(p.checksumPrefixes) > 0 {
+		opts.Checksums = handlers.NewChecksums(p.checksumPrefixes)
+	}
+	// scripts are capped per node, where they run
+	limits := make([]handlers.ScriptLimit, len(p.scripts.Limits))
+	for i, l := range p.scripts.Limits {
+		limits[i] = handlers.ScriptLimit{Script: l.Script, Rate: l.Rate, InFlight: l.InFlight}
+	}
+	opts.Scripts = handlers.NewScripts(logWith, sdWith, handlers.ScriptOptions{
+		Limits:     limits,
+		Wait:       p.scripts.Wait,
+		Slow:       p.scripts.Slow,
+		MaxTracked: p.scripts.MaxTracked,
+	})
+	p.loadKeyTable(logWith, s, opts.Keys)
+	// breakers and in-flight limits are per node, so that in cluster mode one
+	// unhealthy node fails fast while the others keep serving
+	if p.breaker.ErrorRate > 0 || p.breaker.Failures > 0 {
+		opts.Breaker = handlers.NewBreaker(p.breaker)
+		p.reportBreaker(sdWith, opts.Breaker)
+		if p.breaker.Ping {
+			p.pingBreaker(logWith, sdWith, upstream, s, opts.Breaker)
+		}
+	}
+	if p.maxInFlight > 0 {
+		opts.InFlight = handlers.NewInFlight(p.maxInFlight)
+	}
+	if p.fairCheckout {
+		opts.FairQueue = handlers.NewFairQueue(p.maxPoolSize, p.fairHold)
+		p.schedule(func() { opts.FairQueue.Report(sdWith) })
+	}
+	// segments split each node's pool, created with the shares as last set
+	p.segmentsLock.Lock()
+	if len(p.segments) > 0 {
+		opts.Segments = handlers.NewSegments(handlers.SegmentOptions{
+			Segments: append([]handlers.Segment(nil), p.segments...),
+			PoolSize: p.maxPoolSize,
+			Borrow:   p.segmentBorrow,
+			Wait:     p.segmentWait,
+		})
+		p.schedule(func() { opts.Segments.Report(sdWith) })
+	}
+	p.segmentsLock.Unlock()
+	if p.dynamicDB {
+		opts.DBPools = p.dbPools(logWith, sdWith, upstream, limiter)
+	}
+	if p.retries > 0 {
+		opts.RetryBudget = handlers.NewRetryBudget(p.retryBudget)
+		p.reportRetryBudget(sdWith, opts.RetryBudget)
+	}
+	// increments are aggregated per node, since that is where their keys live
+	unregister := func() {}
+	if len(p.writeBehind.Prefixes) > 0 {
+		opts.WriteBehind = handlers.NewWriteBehind(logWith, sdWith, s, handlers.WriteBehindOptions{
+			Prefixes:     p.writeBehind.Prefixes,
+			Interval:     p.writeBehind.Interval,
+			FlushKeys:    p.writeBehind.FlushKeys,
+			MaxPending:   p.writeBehind.MaxPending,
+			Reply:        p.writeBehind.Reply,
+			ReadTimeout:  p.readTimeout,
+			WriteTimeout: p.writeTimeout,
+		})
+		go opts.WriteBehind.Run()
+		unregister = p.databases.Register(upstream, db, opts.WriteBehind)
+	}
+	// each node's commands are copied to the mirror over a pool of its own,
+	// without which they are just not mirrored
+	var mirror *pool.Server
+	if p.mirror.Address != "" {
+		sdMirror, err := p.taggedStatsd(sdWith, []string{"lane:mirror"})
+		if err != nil {
+			return nil, err
+		}
+		if mirror, err = p.connectMirror(logWith, sdMirror); err != nil {
+			logWith.Warn("Error connecting the mirror, commands aren't mirrored", zap.String("mirror", p.mirror.Address), zap.Error(err))
+		} else {
+			opts.Mirror = handlers.NewMirror(logWith.With(zap.String("mirror", p.mirror.Address)), sdMirror, mirror, handlers.MirrorOptions{
+				All:          p.mirror.All,
+				Compare:      p.mirror.Compare,
+				Queue:        p.mirror.Queue,
+				Workers:      p.mirror.PoolSize,
+				ReadTimeout:  p.readTimeout,
+				WriteTimeout: p.writeTimeout,
+			})
+			opts.Mirror.Run()
+			p.schedule(func() { opts.Mirror.Report(sdMirror) })
+		}
+	}
+	if p.warnings.Enabled {
+		opts.Warnings = handlers.NewWarnings(handlers.WarningsOptions{Interval: p.warnings.Interval, Signals: p.warnings.Signals})
+	}
+	if len(p.readThrough.Rules) > 0 {
+		rules := make([]handlers.ReadThroughRule, len(p.readThrough.Rules))
+		for i, r := range p.readThrough.Rules {
+			rules[i] = handlers.ReadThroughRule{Prefix: r.Prefix, Endpoint: r.Endpoint, TTL: r.TTL}
+		}
+		opts.ReadThrough = handlers.NewReadThrough(logWith, sdWith, s, handlers.ReadThroughOptions{
+			Rules:        rules,
+			Concurrency:  p.readThrough.Concurrency,
+			Timeout:      p.readThrough.Timeout,
+			MaxBytes:     p.readThrough.MaxBytes,
+			ReadTimeout:  p.readTimeout,
+			WriteTimeout: p.writeTimeout,
+		})
+	}
+	if p.coalesce.Enabled {
+		opts.Coalescer = handlers.NewCoalescer(handlers.CoalesceOptions{MaxKeys: p.coalesce.MaxKeys, MaxBytes: p.coalesce.MaxBytes})
+		p.schedule(func() { opts.Coalescer.Report(sdWith) })
+	}
+	// the keys remembered missing are forgotten as they are written through any
+	// listener, which Databases tells the caches of
+	if len(p.negativeCache.Prefixes) > 0 {
+		opts.NegativeCache = handlers.NewNegativeCache(handlers.NegativeCacheOptions{
+			Prefixes: p.negativeCache.Prefixes,
+			TTL:      p.negativeCache.TTL,
+			MaxBytes: p.negativeCache.MaxBytes,
+		})
+		p.schedule(func() { opts.NegativeCache.Report(sdWith) })
+		unregisterWB := unregister
+		unregisterNC := p.databases.Register(upstream, db, opts.NegativeCache)
+		unregister = func() {
+			unregisterWB()
+			unregisterNC()
+		}
+	}
+	if f := p.readFallback; f != nil {
+		opts.ReadFallback = &handlers.ReadFallback{Name: f.upstreamConfigHost, Server: f.configuredServer, NilPrefixes: p.readFallbackNil}
+	}
+
+	ul.handler = func(local string) listener.ConnectionHandler {
+		return func(log *zap.Logger, conn net.Conn, id uint64, kill chan interface{}) {
+			p.handleConnection(log, conn, id, kill, local, s, sdWith, ul)
+		}
+	}
+	ul.closePools = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+		defer cancel()
+		// every client connection has closed, so nothing is absorbed anymore
+		unregister()
+		if err := opts.WriteBehind.Close(ctx); err != nil {
+			logWith.Error("Error flushing write-behind increments", zap.Error(err))
+		}
+		opts.Mirror.Close(ctx)
+		if mirror != nil {
+			_ = mirror.Disconnect(ctx)
+		}
+		_ = s.Disconnect(ctx)
+		if reserved != nil {
+			_ = reserved.Disconnect(ctx)
+		}
+		if blocking != nil {
+			_ = blocking.Server.Disconnect(ctx)
+		}
+		if pubSub != nil {
+			_ = pubSub.Server.Disconnect(ctx)
+		}
+		if resp3 != nil {
+			_ = resp3.Disconnect(ctx)
+		}
+		opts.DBPools.Close(ctx)
+	}
+	ul.options = opts
+	return ul, nil
+}
+
+// handleConnection serves a client connection accepted on local, holding it to
+// the listener policy in effect as it was accepted
+func (p *Proxy) handleConnection(log *zap.Logger, conn net.Conn, id uint64, kill chan interface{}, local string, s *pool.Server, sdWith *statsd.Client, ul *upstreamListener) {
+	opts := ul.options
+	// the watchdog's heartbeats are answered locally, and left out of the
+	// limits and metrics of clients
+	if isHeartbeat(conn) {
+		handlers.CommandConnection(log, nil, conn, local, p.readTimeout, p.writeTimeout, id, s, kill, p.interceptMessages, handlers.Options{Upstream: opts.Upstream})
+		return
+	}
+	if atomic.LoadInt32(&ul.draining) == 1 {
+		metrics.DrainRefused.Incr(sdWith)
+		_, _ = conn.Write([]byte("-" + proxyerr.Format(proxyerr.Unavailable, p.config.PlainErrors, "listener draining, refusing connections") + "\r\n"))
+		_ = conn.Close()
+		return
+	}
+	if p.memory.Refuse() {
+		metrics.MemoryRefused.Incr(sdWith)
+		_, _ = conn.Write([]byte("-" + proxyerr.Format(proxyerr.Overloaded, p.config.PlainErrors, "memory over its hard limit, refusing connections") + "\r\n"))
+		_ = conn.Close()
+		return
+	}
+	if !p.admitClient(log, sdWith) {
+		if !p.maxClientsClose {
+			_, _ = conn.Write([]byte("-ERR max number of clients reached\r\n"))
+		}
+		_ = conn.Close()
+		return
+	}
+	defer atomic.AddInt64(&p.clients, -1)
+	policy := p.currentPolicy()
+	opts.Auth, opts.Draining = policy.auth, policy.retired
+	handlers.CommandConnection(log.With(zap.Uint64("generation", policy.generation)), p.statsd, conn, local, p.readTimeout, p.writeTimeout, id, s, kill, p.interceptMessages, opts)
+}
+
+// admitClient counts a client connection as open, unless maxClients are open
+// already. Reaching the limit and getting back under it are logged, rather
+// than each connection rejected.
+func (p *Proxy) admitClient(log *zap.Logger, sdWith *statsd.Client) bool {
+	n := atomic.AddInt64(&p.clients, 1)
+	if p.maxClients > 0 && n > p.maxClients {
+		atomic.AddInt64(&p.clients, -1)
+		metrics.ClientsRejected.Incr(sdWith)
+		if atomic.CompareAndSwapInt32(&p.atMaxClients, 0, 1) {
+			p.log.Warn("Client connections at maxclients, rejecting new ones", zap.Int64("maxclients", p.maxClients))
+		}
+		log.Debug("Rejected client connection at maxclients", zap.Int64("maxclients", p.maxClients))
+		return false
+	}
+	for {
+		peak := atomic.LoadInt64(&p.peakClients)
+		if n <= peak || atomic.CompareAndSwapInt64(&p.peakClients, peak, n) {
+			break
+		}
+	}
+	if p.maxClients > 0 && n < p.maxClients && atomic.CompareAndSwapInt32(&p.atMaxClients, 1, 0) {
+		p.log.Info("Client connections back under maxclients, accepting new ones", zap.Int64("maxclients", p.maxClients))
+	}
+	return true
+}
+
+func (p *Proxy) poolOptions(logWith *zap.Logger, sdWith *statsd.Client, limiter *connectLimiter, counts *poolCounts, db int) []pool.ServerOption {
+	minPoolSize, maxPoolSize := counts.minSize, counts.maxSize
+	if b := currentBudget(); b != nil {
+		counts.budget = b.register(minPoolSize, maxPoolSize)
+	}
+	bp := counts.budget
+	monitor := p.poolMonitor(sdWith, counts)
+	poolOpts := []pool.ServerOption{
+		pool.WithMinConnections(func(uint64) uint64 { return uint64(minPoolSize) }),
+		pool.WithMaxConnections(func(uint64) uint64 { return uint64(maxPoolSize) }),
+		pool.WithConnectionPoolMonitor(func(*pool.Monitor) *pool.Monitor { return monitor }),
+	}
+
+	// the first minPoolSize dials of a pool are its warmup, which is capped across
+	// all upstreams so that starting hundreds of them doesn't open every connection
+	// at once. Later dials, made as the pool grows or replaces connections, are not
+	// held back by other upstreams.
+	warmup := int64(minPoolSize)
+	dlr := newFamilyDialer(logWith, sdWith, 30*time.Second)
+	co := pool.WithDialer(func(dialer pool.Dialer) pool.Dialer {
+		return pool.DialerFunc(func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+			if err := p.initBackoff.held(time.Now()); err != nil {
+				return nil, err
+			}
+			// a connection takes its slot of the process-wide budget before anything
+			// else, and gives it back if it fails to be made
+			if bp != nil {
+				if err := bp.acquire(ctx); err != nil {
+					if errors.Is(err, errBudgetExhausted) {
+						metrics.ConnectionBudgetShed.Incr(sdWith)
+					}
+					return nil, err
 				}
-				d := strconv.Itoa(p.database)
-				_, err = conn.Write([]byte("*2\r\n$6\r\nSELECT\r\n$" + strconv.Itoa(len(d)) + "\r\n" + d + "\r\n"))
-				if err != nil {
-					logWith.Error("failed to write select command", zap.Error(err))
-					return conn, err
+				defer func() {
+					if err != nil {
+						bp.release()
+						return
+					}
+					conn = &budgetConn{Conn: conn, release: bp.release}
+				}()
+			}
+			if limiter != nil {
+				if err := limiter.wait(ctx); err != nil {
+					return nil, err
 				}
-				res := make([]byte, 5)
-				_, err = io.ReadFull(conn, res)
-				if err != nil || string(res) != "+OK\r\n" {
-					logWith.Error("failed to read select response", zap.Error(err), zap.String("response", string(res)))
+			}
+			if atomic.AddInt64(&warmup, -1) >= 0 {
+				release, err := acquireWarmupSlot(ctx)
+				if err != nil {
+					return nil, err
 				}
-				return conn, err
-			})
+				defer release()
+			}
+			conn, err = p.dialUpstream(ctx, dlr, sdWith, network, address, p.readTimeout+p.writeTimeout)
+			if err != nil {
+				return nil, connectFailed(sdWith, err)
+			}
+			if p.sweepsIdle() {
+				conn = newIdleConn(conn)
+			}
+
+			// connections are authenticated, switched to the protocol of their
+			// pool, and pinned to the db if one has been specified, before they
+			// are added to the pool
+			if err := prepareConn(conn, address, p.credentials, db, counts.resp3, p.readTimeout+p.writeTimeout); err != nil {
+				authFailed(logWith, sdWith, err)
+				_ = conn.Close()
+				ce := connectFailed(sdWith, err)
+				p.initBackoff.done(time.Now(), ce)
+				return nil, ce
+			}
+			p.initBackoff.done(time.Now(), nil)
+			return conn, nil
 		})
-		opts = append(opts, pool.WithConnectionOptions(func(cos ...pool.ConnectionOption) []pool.ConnectionOption {
-			return append(cos, co)
-		}))
-	}
+	})
+	poolOpts = append(poolOpts, pool.WithConnectionOptions(func(cos ...pool.ConnectionOption) []pool.ConnectionOption {
+		return append(cos, co)
+	}))
 
-	s, err := pool.ConnectServer(pool.Address(upstream), opts...)
+	return poolOpts
+}
+
+// connectServer creates a pool of the connections counts are kept of, which, if
+// connections are capped process-wide, has its idle connections reclaimed when
+// it is past its share of the budget and other pools wait for theirs
+func (p *Proxy) connectServer(logWith *zap.Logger, sdWith *statsd.Client, upstream string, limiter *connectLimiter, counts *poolCounts, db int) (*pool.Server, error) {
+	s, err := pool.ConnectServer(pool.Address(upstream), p.poolOptions(logWith, sdWith, limiter, counts, db)...)
 	if err != nil {
+		if counts.budget != nil {
+			counts.budget.unregister()
+		}
 		return nil, err
 	}
+	if p.poolHealInterval > 0 {
+		p.keepPoolInvariants(logWith, sdWith, s, counts)
+	}
+	if p.sweepsIdle() {
+		p.sweepIdle(logWith, sdWith, s, counts)
+	}
+	if bp := counts.budget; bp != nil {
+		bp.setReclaim(func() bool { return reclaimIdle(s, counts) })
+		p.schedule(func() {
+			if bs := bp.stats(); bs != nil {
+				metrics.ConnectionBudgetShare.Set(sdWith, float64(bs.Share))
+			}
+		})
+	}
+	return s, nil
+}
 
-	connectionHandler := func(log *zap.Logger, conn net.Conn, id uint64, kill chan interface{}) {
-		handlers.CommandConnection(log, p.statsd, conn, local, p.readTimeout, p.writeTimeout, id, s, kill, p.interceptMessages)
+// dbPools creates the pools of the databases clients SELECT in dynamic database
+// mode. Each database gets an even share of the upstream's pool, with no idle
+// connections, and metrics tagged with its number. Idle pools are reaped, and
+// the number of pools reported, once a second until the proxy shuts down.
+func (p *Proxy) dbPools(logWith *zap.Logger, sdWith *statsd.Client, upstream string, limiter *connectLimiter) *handlers.DBPools {
+	size := p.maxPoolSize / p.maxDBs
+	if size < 1 {
+		size = 1
 	}
-	shutdownHandler := func() {
+	// a database's client is kept across the pools it gets, since they are
+	// never closed until shutdown
+	clients := make(map[int]*statsd.Client)
+	d := handlers.NewDBPools(logWith, p.maxDBs, p.dbIdleTimeout, func(db int) (*pool.Server, error) {
+		sdDB, ok := clients[db]
+		if !ok {
+			var err error
+			if sdDB, err = p.taggedStatsd(sdWith, []string{"db:" + strconv.Itoa(db)}); err != nil {
+				return nil, err
+			}
+			clients[db] = sdDB
+		}
+		return p.connectServer(logWith.With(zap.Int("db", db)), sdDB, upstream, limiter, &poolCounts{maxSize: size}, db)
+	})
+	p.schedule(func() {
 		ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
 		defer cancel()
-		_ = s.Disconnect(ctx)
-	}
+		d.Reap(ctx)
+		d.Report(sdWith)
+	})
+	return d
+}
+
+// reportRetryBudget emits the state of an upstream's retry budget once a second
+// until the proxy shuts down
+func (p *Proxy) reportRetryBudget(sd *statsd.Client, b *handlers.RetryBudget) {
+	p.schedule(func() {
+		tokens, ratio := b.Snapshot()
+		metrics.RetryBudgetTokens.Set(sd, tokens)
+		metrics.RetryBudgetRatio.Set(sd, ratio)
+	})
+}
+
+// reportConnectLimiter emits how many connection creations are waiting on the
+// connection rate limit once a second until the proxy shuts down, and warns when
+// they have been waiting for longer than connectWarnAfter
+func (p *Proxy) reportConnectLimiter(logWith *zap.Logger, sd *statsd.Client, l *connectLimiter) {
+	p.schedule(func() {
+		metrics.ConnectLimiterWaiting.Set(sd, float64(l.Waiting()))
+		if d, warn := l.overloaded(time.Now(), p.connectWarnAfter); warn {
+			logWith.Warn("Connection creations have been waiting on the connection rate limit", zap.Duration("for", d), zap.Int64("waiting", l.Waiting()), zap.Float64("connectrate", p.connectRate))
+		}
+	})
+}
 
-	return listener.New(logWith, sdWith, p.config.Network, local, p.config.Unlink, connectionHandler, shutdownHandler)
+// reportBreaker emits the circuit state of an upstream node once a second until
+// the proxy shuts down: 0 closed, 1 half-open, 2 open
+func (p *Proxy) reportBreaker(sd *statsd.Client, b *handlers.Breaker) {
+	p.schedule(func() {
+		metrics.CircuitState.Set(sd, float64(b.State()))
+	})
 }
 
-func poolMonitor(sd *statsd.Client) *pool.Monitor {
-	checkedOut, checkedIn := util.StatsdBackgroundGauge(sd, "pool.checked_out_connections", []string{})
-	opened, closed := util.StatsdBackgroundGauge(sd, "pool.open_connections", []string{})
+// pingBreaker probes the open circuit of an upstream node with a PING every
+// cooldown, until one succeeds and closes it, rather than with a client request
+func (p *Proxy) pingBreaker(logWith *zap.Logger, sdWith *statsd.Client, upstream string, s *pool.Server, b *handlers.Breaker) {
+	pr := &probe{interval: time.Second}
+	p.runProbe(pr, func(time.Time) func() {
+		if !b.PingDue() {
+			return nil
+		}
+		return func() {
+			ctx, cancel := context.WithTimeout(context.Background(), p.readTimeout+p.writeTimeout)
+			defer cancel()
+			start := time.Now()
+			err := p.ping(ctx, s)
+			if state, changed := b.Record(true, time.Since(start), err); changed {
+				handlers.BreakerChanged(logWith, sdWith, upstream, state, true, err)
+			}
+		}
+	})
+}
+
+// reportReadOnly emits whether the upstream is in read-only mode once a second
+// until the proxy shuts down
+func (p *Proxy) reportReadOnly() {
+	p.schedule(func() {
+		var v float64
+		if p.readOnly.Enabled() {
+			v = 1
+		}
+		metrics.ReadOnly.Set(p.statsd, v)
+	})
+}
+
+// poolEvents are the counters of the pool's events that don't move a gauge
+var poolEvents = map[string]metrics.Counter{
+	"ConnectionCheckOutStarted": metrics.PoolCheckOutStarted,
+	pool.GetFailed:              metrics.PoolCheckOutFailed,
+	pool.Created:                metrics.PoolCreated,
+	pool.Cleared:                metrics.PoolCleared,
+	pool.Closed:                 metrics.PoolClosed,
+}
+
+func (p *Proxy) poolMonitor(sd *statsd.Client, counts *poolCounts) *pool.Monitor {
+	checkedOut, checkedIn := p.countingGauge(sd, metrics.PoolCheckedOutConnections, &counts.checkedOut)
+	opened, closed := p.countingGauge(sd, metrics.PoolOpenConnections, &counts.open)
 
 	return &pool.Monitor{
 		Event: func(e *pool.Event) {
-			snake := strings.ToLower(regexp.MustCompile("([a-z0-9])([A-Z])").ReplaceAllString(e.Type, "${1}_${2}"))
-			name := fmt.Sprintf("pool_event.%s", snake)
-			tags := []string{
-				fmt.Sprintf("address:%s", e.Address),
-				fmt.Sprintf("reason:%s", e.Reason),
-			}
+			address, reason := sanitize.TagValue(e.Address), sanitize.TagValue(e.Reason)
+			counts.advisor.observe(e.Type, counts)
 			switch e.Type {
 			case pool.ConnectionCreated:
-				opened(name, tags)
+				opened(metrics.PoolConnectionCreated, address, reason)
 			case pool.ConnectionClosed:
-				closed(name, tags)
+				counts.closed(reason)
+				closed(metrics.PoolConnectionClosed, address, reason)
 			case pool.GetSucceeded:
-				checkedOut(name, tags)
+				checkedOut(metrics.PoolCheckedOut, address, reason)
 			case pool.ConnectionReturned:
-				checkedIn(name, tags)
+				checkedIn(metrics.PoolCheckedIn, address, reason)
+			case pool.Closed:
+				// the pool's connections are closed, and their slots given back, already
+				if counts.budget != nil {
+					counts.budget.unregister()
+				}
+				metrics.PoolClosed.Incr(sd, address, reason)
 			default:
-				_ = sd.Incr(name, tags, 1)
+				if event, ok := poolEvents[e.Type]; ok {
+					event.Incr(sd, address, reason)
+				}
 			}
 		},
 	}
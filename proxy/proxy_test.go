@@ -5,20 +5,24 @@ import (
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/coinbase/redisbetween/config"
 	"github.com/coinbase/redisbetween/handlers"
+	redisproto "github.com/coinbase/redisbetween/redis"
 	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 // assumes a redis cluster running with 6 nodes on 127.0.0.1 ports 7000-7005, and
-// a standalone redis on port 7006. see docker-compose.yml
+// a standalone redis on port 7006 and another bound to ::1 on port 7007. see
+// docker-compose.yml
 
 func redisHost() string {
 	h := os.Getenv("REDIS_HOST")
@@ -113,6 +117,23 @@ func TestPipelinedCommands(t *testing.T) {
 	shutdownProxy()
 }
 
+func TestPipelinedCommandsIsolated(t *testing.T) {
+	shutdownProxy := setupProxy(t, "7006", 3)
+	client := setupStandaloneClient(t, "/var/tmp/redisbetween-"+redisHost()+"-7006-3.sock")
+	assertResponsePipelined(t, []command{
+		{cmd: "get", args: []string{string(handlers.PipelineSignalStartKey)}, res: "get 🔜: redis: nil"},
+		{cmd: "set", args: []string{"isolated", "hi"}, res: "set isolated hi: OK"},
+		{cmd: "subscribe", args: []string{"news"}, res: "subscribe news: PROXYBLOCKED SUBSCRIBE is unsupported"},
+		{cmd: "incr", args: []string{"isolated"}, res: "incr isolated: ERR value is not an integer or out of range"},
+		{cmd: "multi", res: "multi: PROXYBLOCKED transaction discarded, SUBSCRIBE is unsupported"},
+		{cmd: "subscribe", args: []string{"news"}, res: "subscribe news: PROXYBLOCKED transaction discarded, SUBSCRIBE is unsupported"},
+		{cmd: "exec", res: "exec: PROXYBLOCKED transaction discarded, SUBSCRIBE is unsupported"},
+		{cmd: "get", args: []string{"isolated"}, res: "get isolated: hi"},
+		{cmd: "get", args: []string{string(handlers.PipelineSignalEndKey)}, res: "get 🔚: redis: nil"},
+	}, client)
+	shutdownProxy()
+}
+
 func TestDbSelectCommand(t *testing.T) {
 	shutdown := setupProxy(t, "7006", 3)
 	client := setupStandaloneClient(t, "/var/tmp/redisbetween-"+redisHost()+"-7006-3.sock")
@@ -126,6 +147,83 @@ func TestLocalSocketPathFromUpstream(t *testing.T) {
 	assert.Equal(t, "prefix-with.host-colon.suffix", localSocketPathFromUpstream("with.host:colon", -1, "prefix-", ".suffix"))
 	assert.Equal(t, "prefix-withoutcolon.host.suffix", localSocketPathFromUpstream("withoutcolon.host", -1, "prefix-", ".suffix"))
 	assert.Equal(t, "prefix-with.host-db-1.suffix", localSocketPathFromUpstream("with.host:db", 1, "prefix-", ".suffix"))
+
+	escaped := localSocketPathFromUpstream("🔑.host:6379", 2, "prefix-", ".suffix")
+	assert.Regexp(t, `^prefix-_\.host-6379_[0-9a-f]{8}-2\.suffix$`, escaped)
+	assert.Equal(t, escaped, localSocketPathFromUpstream("🔑.host:6379", 2, "prefix-", ".suffix"))
+
+	assert.Equal(t, "prefix-ipv6-2600-1f14--12-6379.suffix", localSocketPathFromUpstream("[2600:1f14::12]:6379", -1, "prefix-", ".suffix"))
+	assert.Equal(t, "prefix-ipv6---1-7000-0.suffix", localSocketPathFromUpstream("[::1]:7000", 0, "prefix-", ".suffix"))
+	assert.Regexp(t, `^prefix-ipv6-fe80--1_eth0-6379_[0-9a-f]{8}\.suffix$`, localSocketPathFromUpstream("[fe80::1%eth0]:6379", -1, "prefix-", ".suffix"))
+}
+
+func TestCheckSocketPaths(t *testing.T) {
+	c := &config.Config{LocalSocketPrefix: "/var/tmp/redisbetween-", LocalSocketSuffix: ".sock", Upstreams: []config.Upstream{
+		{UpstreamConfigHost: "cache:6379", Database: -1, Label: "cache"},
+		{UpstreamConfigHost: "cache:6379", Database: 1},
+		{UpstreamConfigHost: "other:6379", Database: -1},
+	}}
+	assert.NoError(t, CheckSocketPaths(c))
+	c.Upstreams = append(c.Upstreams, config.Upstream{UpstreamConfigHost: "cache-6379", Database: -1})
+	assert.EqualError(t, CheckSocketPaths(c), "upstreams cache cache:6379 and cache-6379 would both listen on /var/tmp/redisbetween-cache-6379.sock")
+}
+
+func TestIPv6Upstream(t *testing.T) {
+	li, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer func() { _ = li.Close() }()
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				d := redisproto.NewDecoder(conn)
+				for {
+					if _, err := d.Decode(); err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte("+PONG\r\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(li.Addr().String())
+
+	dir, err := ioutil.TempDir("", "ipv6")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: dir + "/rb-", LocalSocketSuffix: ".sock", Unlink: true}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: "[::1]:" + port, Database: -1, MinPoolSize: 1, MaxPoolSize: 1, ReadTimeout: time.Second, WriteTimeout: time.Second})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	defer p.Shutdown()
+
+	client := redis.NewClient(&redis.Options{Network: "unix", Addr: dir + "/rb-ipv6---1-" + port + ".sock", MaxRetries: 1})
+	defer func() { _ = client.Close() }()
+	assert.Eventually(t, func() bool { return client.Ping(context.Background()).Err() == nil }, 2*time.Second, 10*time.Millisecond)
+}
+
+// assumes a standalone redis listening on [::1]:7007. see docker-compose.yml
+func TestProxyIPv6(t *testing.T) {
+	sd := setupProxyAt(t, "::1", "7007", -1)
+
+	client := setupStandaloneClient(t, "/var/tmp/redisbetween-ipv6---1-7007.sock")
+	res := client.Do(context.Background(), "set", "hello", "world")
+	assert.NoError(t, res.Err())
+	res = client.Do(context.Background(), "get", "hello")
+	assert.NoError(t, res.Err())
+	assert.Equal(t, "get hello: world", res.String())
+	assert.NoError(t, client.Close())
+	sd()
 }
 
 func assertResponse(t *testing.T, cmd command, c *redis.ClusterClient) {
@@ -161,8 +259,13 @@ func assertResponsePipelined(t *testing.T, cmds []command, c *redis.Client) {
 
 func setupProxy(t *testing.T, upstreamPort string, db int) func() {
 	t.Helper()
+	return setupProxyAt(t, redisHost(), upstreamPort, db)
+}
 
-	uri := redisHost() + ":" + upstreamPort
+func setupProxyAt(t *testing.T, host, upstreamPort string, db int) func() {
+	t.Helper()
+
+	uri := net.JoinHostPort(host, upstreamPort)
 
 	sd, err := statsd.New("localhost:8125")
 	assert.NoError(t, err)
@@ -174,7 +277,17 @@ func setupProxy(t *testing.T, upstreamPort string, db int) func() {
 		Unlink:            true,
 	}
 
-	proxy, err := NewProxy(zap.L(), sd, cfg, "test", uri, db, 1, 1, 1*time.Second, 1*time.Second)
+	proxy, err := NewProxy(zap.L(), sd, cfg, &config.Upstream{
+		UpstreamConfigHost: uri,
+		Label:              "test",
+		Database:           db,
+		MinPoolSize:        1,
+		MaxPoolSize:        1,
+		ReadTimeout:        1 * time.Second,
+		WriteTimeout:       1 * time.Second,
+		ErrorRewrite:       "redirects",
+		TopologyRewrite:    true,
+	})
 	assert.NoError(t, err)
 	go func() {
 		err := proxy.Run()
@@ -205,16 +318,12 @@ func setupClusterClient(t *testing.T, address string) *redis.ClusterClient {
 	opt := &redis.ClusterOptions{
 		Addrs: []string{address},
 		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			// redis client patch that translates tcp connection attempts to the local socket instead
-			if strings.Contains(network, "tcp") {
-				host, port, err := net.SplitHostPort(addr)
-				if err != nil {
-					return nil, err
-				}
-				addr = "/var/tmp/redisbetween-" + host + "-" + port + ".sock"
-				network = "unix"
+			// the proxy gives its sockets as their path, with port 0 in the
+			// topology and without a port in MOVED and ASK
+			if strings.HasPrefix(addr, "/") {
+				addr, network = strings.TrimSuffix(addr, ":0"), "unix"
 			}
-			return net.Dial(network, addr)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
 		},
 		MaxRetries: 1,
 	}
@@ -227,3 +336,35 @@ func setupClusterClient(t *testing.T, address string) *redis.ClusterClient {
 	}
 	return client
 }
+
+func TestPingBreaker(t *testing.T) {
+	node := newPongNode(t)
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, &config.Config{}, &config.Upstream{
+		UpstreamConfigHost: node.li.Addr().String(),
+		Database:           -1,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+		BreakerFailures:    1,
+		BreakerCooldown:    10 * time.Millisecond,
+		BreakerPing:        true,
+	})
+	assert.NoError(t, err)
+	defer p.Shutdown()
+	s, err := p.connectServer(zap.NewNop(), sd, node.li.Addr().String(), nil, &poolCounts{maxSize: 1}, -1)
+	assert.NoError(t, err)
+	defer func() { _ = s.Disconnect(context.Background()) }()
+
+	b := handlers.NewBreaker(p.breaker)
+	p.pingBreaker(zap.NewNop(), sd, node.li.Addr().String(), s, b)
+	allowed, probe := b.Allow()
+	assert.True(t, allowed)
+	state, _ := b.Record(probe, time.Second, context.DeadlineExceeded)
+	assert.Equal(t, handlers.BreakerOpen, state)
+	allowed, _ = b.Allow()
+	assert.False(t, allowed, "requests fail fast while the proxy PINGs the node")
+
+	assert.Eventually(t, func() bool { return b.State() == handlers.BreakerClosed }, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&node.pings), "closed by the PING")
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// redirectingNode answers GET of "moved" and "ask" with redirects to other, of
+// "bad" with a redirect naming no node, and of any other key with the key.
+// CLUSTER SLOTS has it serve every slot, with other as its replica.
+func redirectingNode(t *testing.T, other string) string {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = li.Close() })
+	node := func(addr, id string) *redis.Message {
+		host, port, _ := net.SplitHostPort(addr)
+		return redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte(host)), redis.NewInt([]byte(port)), redis.NewBulkBytes([]byte(id))})
+	}
+	slots := redis.NewArray([]*redis.Message{redis.NewArray([]*redis.Message{
+		redis.NewInt([]byte("0")), redis.NewInt([]byte("16383")), node(li.Addr().String(), "id-1"), node(other, "id-2"),
+	})})
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				d := redis.NewDecoder(conn)
+				for {
+					m, err := d.Decode()
+					if err != nil {
+						return
+					}
+					r := redis.NewString([]byte("OK"))
+					if strings.ToUpper(string(m.Array[0].Value)) == "CLUSTER" {
+						r = slots
+					}
+					if strings.ToUpper(string(m.Array[0].Value)) == "GET" {
+						switch key := string(m.Array[1].Value); key {
+						case "moved":
+							r = redis.NewErrorf("MOVED 866 %s", other)
+						case "ask":
+							r = redis.NewErrorf("ASK 3999 %s", other)
+						case "bad":
+							r = redis.NewErrorf("MOVED 866")
+						default:
+							r = redis.NewBulkBytes([]byte(key))
+						}
+					}
+					if err := redis.Encode(conn, r); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return li.Addr().String()
+}
+
+func TestRedirectsInPipeline(t *testing.T) {
+	other := newDBNode(t)
+	upstream := redirectingNode(t, other.Address())
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: upstream, Database: -1, MaxPoolSize: 2,
+		ReadTimeout: time.Second, WriteTimeout: time.Second, ErrorRewrite: "redirects"})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool {
+		conn, err := dialHeartbeat("unix", configSocket(p), time.Second)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	conn, err := net.Dial("unix", configSocket(p))
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var pipeline []byte
+	keys := []string{string(handlers.PipelineSignalStartKey), "a", "bad", "ask", "b", "moved", string(handlers.PipelineSignalEndKey)}
+	for _, key := range keys {
+		b, err := redis.EncodeToBytes(redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("GET")), redis.NewBulkBytes([]byte(key))}))
+		assert.NoError(t, err)
+		pipeline = append(pipeline, b...)
+	}
+	_, err = conn.Write(pipeline)
+	assert.NoError(t, err)
+	dec := redis.NewDecoder(conn)
+	replies := make([]string, len(keys))
+	for i := range replies {
+		m, err := dec.Decode()
+		assert.NoError(t, err)
+		replies[i] = m.String()
+	}
+
+	local, ok := p.localFor(other.Address())
+	assert.True(t, ok, "a listener is started for the node redirected to")
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"$1 \\r\\n a \\r\\n ",
+		"-MOVED 866 \\r\\n ",
+		"-ASK 3999 " + local + " \\r\\n ",
+		"$1 \\r\\n b \\r\\n ",
+		"-MOVED 866 " + local + " \\r\\n ",
+		"$-1 \\r\\n ",
+	}, replies, "every redirect keeps its position, past one that names no node")
+
+	// and it accepts as soon as the redirect is answered
+	node, err := net.DialTimeout("unix", local, time.Second)
+	assert.NoError(t, err)
+	_ = node.Close()
+}
+
+func TestTopologyRewrite(t *testing.T) {
+	other := newDBNode(t)
+	upstream := redirectingNode(t, other.Address())
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: upstream, Database: -1, MaxPoolSize: 2,
+		ReadTimeout: time.Second, WriteTimeout: time.Second, TopologyRewrite: true})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool {
+		conn, err := dialHeartbeat("unix", configSocket(p), time.Second)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	conn, err := net.Dial("unix", configSocket(p))
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	res, err := roundTrip(conn, redis.NewDecoder(conn), "CLUSTER", "SLOTS")
+	assert.NoError(t, err)
+
+	local, ok := p.localFor(other.Address())
+	assert.True(t, ok, "a listener is started for the replica")
+	bulk := func(s string) string { return fmt.Sprintf("$%d \\r\\n %s \\r\\n ", len(s), s) }
+	assert.Equal(t, "*1 \\r\\n *4 \\r\\n :0 \\r\\n :16383 \\r\\n "+
+		"*3 \\r\\n "+bulk(configSocket(p))+":0 \\r\\n "+bulk("id-1")+
+		"*3 \\r\\n "+bulk(local)+":0 \\r\\n "+bulk("id-2"), res, "every node is given as its local socket")
+
+	// which accepts as soon as the reply is answered
+	node, err := net.DialTimeout("unix", local, time.Second)
+	assert.NoError(t, err)
+	_ = node.Close()
+}
@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/listener"
+	"github.com/coinbase/redisbetween/auth"
+	"github.com/coinbase/redisbetween/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	// socketOverlap is how long a replaced socket keeps accepting after its
+	// replacement does, for clients that looked up the old path just before
+	socketOverlap = time.Second
+	// socketReadyTimeout is how long a reload waits for a new socket to answer
+	socketReadyTimeout = 5 * time.Second
+)
+
+// Reload is a change of the settings of a proxy's listeners: the provider
+// clients authenticate with, nil for none, and the paths of the sockets.
+// Connections accepted before it keep the previous settings, unless KickAfter
+// is set, in which case they are closed once idle after that long.
+type Reload struct {
+	Auth              auth.Provider
+	LocalSocketPrefix string
+	LocalSocketSuffix string
+	KickAfter         time.Duration
+}
+
+// listenerPolicy is what a client connection is held to, captured as it is
+// accepted and never changed under it. Each reload starts a generation.
+type listenerPolicy struct {
+	generation uint64
+	auth       auth.Provider
+	// retired is closed once the connections of the generation are to close
+	// as soon as they are idle: at shutdown, or when kicked after a reload
+	retired chan interface{}
+	kick    func()
+}
+
+func (p *Proxy) newPolicy(generation uint64, provider auth.Provider) *listenerPolicy {
+	retired, kicked := make(chan interface{}), make(chan interface{})
+	var once sync.Once
+	go func() {
+		select {
+		case <-p.quit:
+		case <-kicked:
+		}
+		close(retired)
+	}()
+	return &listenerPolicy{generation: generation, auth: provider, retired: retired, kick: func() { once.Do(func() { close(kicked) }) }}
+}
+
+// currentPolicy is the policy new connections are held to
+func (p *Proxy) currentPolicy() *listenerPolicy {
+	p.policyLock.Lock()
+	defer p.policyLock.Unlock()
+	if p.policy == nil {
+		p.policy = p.newPolicy(1, p.auth)
+	}
+	return p.policy
+}
+
+// Generation is the number of the listener policy new connections are held to,
+// incremented by every reload
+func (p *Proxy) Generation() uint64 {
+	return p.currentPolicy().generation
+}
+
+// Reload applies new listener settings. The policy changes first, for the
+// connections accepted from then on, whichever socket they come through. Each
+// socket whose path changes is then replaced: the new one is bound, and the old
+// one closed only once the new one answers, so that there is no moment when
+// neither accepts.
+func (p *Proxy) Reload(r Reload) error {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	previous := p.currentPolicy()
+	p.policyLock.Lock()
+	p.policy = p.newPolicy(previous.generation+1, r.Auth)
+	p.policyLock.Unlock()
+	p.log.Info("Reloaded listener policy", zap.Uint64("generation", previous.generation+1), zap.Duration("kick_after", r.KickAfter))
+	if r.KickAfter > 0 {
+		time.AfterFunc(r.KickAfter, previous.kick)
+	}
+
+	p.listenerLock.Lock()
+	p.socketPrefix, p.socketSuffix = r.LocalSocketPrefix, r.LocalSocketSuffix
+	listeners := make([]*upstreamListener, 0, len(p.listeners))
+	for _, l := range p.listeners {
+		listeners = append(listeners, l)
+	}
+	p.listenerLock.Unlock()
+
+	var err error
+	for _, l := range listeners {
+		local := localSocketPathFromUpstream(l.upstream, p.database, r.LocalSocketPrefix, r.LocalSocketSuffix)
+		if local == p.socketOf(l) {
+			continue
+		}
+		if e := p.replaceSocket(l, local); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		metrics.Reloads.Incr(p.statsd, "failed")
+		return err
+	}
+	metrics.Reloads.Incr(p.statsd, "ok")
+	p.refreshDiscovery()
+	return nil
+}
+
+// replaceSocket moves a listener to a new socket path, keeping the old one
+// open for socketOverlap once the new one answers
+func (p *Proxy) replaceSocket(l *upstreamListener, local string) error {
+	logWith := p.log.With(zap.String("upstream", l.upstream), zap.String("local", local))
+	// a reload back to a path whose socket is still retiring waits for that
+	// one to be gone, since closing it removes the path
+	p.awaitRetired(l, local)
+	if err := p.checkSocketPerms(local); err != nil {
+		return err
+	}
+	bind := local
+	if p.socketPerms.set() {
+		bind = handOffPath(local)
+	}
+	s, err := l.newSocket(logWith, p.config.Network, local, bind, p.config.Unlink)
+	if err != nil {
+		return err
+	}
+	stopped := make(chan error, 1)
+	p.listenerWg.Add(1)
+	go func() {
+		defer p.listenerWg.Done()
+		err := s.Run()
+		if err != nil {
+			logWith.Error("Error", zap.Error(err))
+		}
+		stopped <- err
+	}()
+	if err := p.awaitSocket(bind, stopped); err != nil {
+		s.Shutdown()
+		return fmt.Errorf("socket %s for upstream %s did not start: %w", local, l.upstream, err)
+	}
+	if bind != local {
+		if err := p.placeSocket(bind, local); err != nil {
+			s.Shutdown()
+			return fmt.Errorf("socket %s for upstream %s could not be given its permissions: %w", local, l.upstream, err)
+		}
+	}
+
+	p.listenerLock.Lock()
+	select {
+	case <-p.quit:
+		// shut down while the socket was starting
+		p.listenerLock.Unlock()
+		s.Shutdown()
+		return nil
+	default:
+	}
+	old, oldLocal := l.Listener, l.local
+	l.Listener, l.local, l.bound = s, local, bind
+	if l.upstream == p.upstreamConfigHost {
+		p.localConfigHost = local
+	}
+	if l.retiring == nil {
+		l.retiring = make(map[*listener.Listener]string)
+	}
+	l.retiring[old] = oldLocal
+	p.listenerLock.Unlock()
+	logWith.Info("Replaced listener socket", zap.String("old", oldLocal))
+
+	time.AfterFunc(socketOverlap, func() {
+		old.Shutdown()
+		awaitRemoved(oldLocal)
+		p.listenerLock.Lock()
+		defer p.listenerLock.Unlock()
+		delete(l.retiring, old)
+	})
+	return nil
+}
+
+// awaitRetired waits until none of the listener's retiring sockets is at a path
+func (p *Proxy) awaitRetired(l *upstreamListener, local string) {
+	for {
+		p.listenerLock.Lock()
+		retiring := false
+		for _, r := range l.retiring {
+			retiring = retiring || r == local
+		}
+		p.listenerLock.Unlock()
+		if !retiring {
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// awaitRemoved waits for a socket that was shut down to be unlinked, which
+// happens as it stops accepting
+func awaitRemoved(local string) {
+	deadline := time.Now().Add(socketReadyTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(local); err != nil {
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// awaitSocket waits for a socket that was just started to answer a heartbeat
+func (p *Proxy) awaitSocket(local string, stopped chan error) error {
+	deadline := time.Now().Add(socketReadyTimeout)
+	for {
+		select {
+		case err := <-stopped:
+			if err == nil {
+				err = fmt.Errorf("stopped")
+			}
+			return err
+		default:
+		}
+		err := beat(p.config.Network, local, socketReadyTimeout)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// newSocket makes a socket for the listener at local, bound to bind, which
+// closes its pools once it is the last socket of the listener to shut down. The
+// socket serves the listener that took it over instead, if one has. A socket
+// bound to a path of its own, to be renamed to local, removes local as it shuts
+// down, unless it was handed off to a successor, while one bound to local has
+// it removed as it stops accepting.
+func (l *upstreamListener) newSocket(log *zap.Logger, network, local, bind string, unlink bool) (*listener.Listener, error) {
+	atomic.AddInt32(&l.sockets, 1)
+	s, err := listener.New(log, l.statsd, network, bind, unlink, func(log *zap.Logger, conn net.Conn, id uint64, kill chan interface{}) {
+		current := l.acquire()
+		defer current.serving.Done()
+		current.handler(local)(log, conn, id, kill)
+	}, func() {
+		current := l.acquire()
+		defer current.serving.Done()
+		if bind != local && atomic.LoadInt32(&current.handedOff) == 0 {
+			_ = os.Remove(local)
+		}
+		if atomic.AddInt32(&current.sockets, -1) == 0 {
+			current.closePools()
+		}
+	})
+	if err != nil {
+		atomic.AddInt32(&l.sockets, -1)
+	}
+	return s, err
+}
+
+// acquire returns the listener serving the listener's sockets: the listener
+// itself, or the one that took them over. It is held serving until its
+// serving.Done is called, which its successor waits for before closing its
+// pools.
+func (l *upstreamListener) acquire() *upstreamListener {
+	l.successorLock.Lock()
+	if next := l.successor; next != nil {
+		l.successorLock.Unlock()
+		return next.acquire()
+	}
+	l.serving.Add(1)
+	l.successorLock.Unlock()
+	return l
+}
+
+// socketOf is the path a listener accepts new connections on
+func (p *Proxy) socketOf(l *upstreamListener) string {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	return l.local
+}
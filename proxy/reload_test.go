@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/auth"
+	"github.com/coinbase/redisbetween/config"
+	redisproto "github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func configSocket(p *Proxy) string {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	return p.localConfigHost
+}
+
+// password is the one a generation's provider accepts, and no other's does
+func password(generation uint64) string {
+	return "pw" + strconv.FormatUint(generation, 10)
+}
+
+func roundTrip(conn net.Conn, dec *redisproto.Decoder, args ...string) (string, error) {
+	mm := make([]*redisproto.Message, len(args))
+	for i, a := range args {
+		mm[i] = redisproto.NewBulkBytes([]byte(a))
+	}
+	if err := redisproto.Encode(conn, redisproto.NewArray(mm)); err != nil {
+		return "", err
+	}
+	m, err := dec.Decode()
+	if err != nil {
+		return "", err
+	}
+	return m.String(), nil
+}
+
+func startReloadProxy(t *testing.T, prefix string) *Proxy {
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: prefix, LocalSocketSuffix: ".sock", Unlink: true}
+	node := newDBNode(t)
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: node.Address(), MaxPoolSize: 4, ReadTimeout: time.Second, WriteTimeout: time.Second})
+	assert.NoError(t, err)
+	p.AuthenticateClients(auth.Static{"app": password(1)})
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool {
+		conn, err := dialHeartbeat("unix", configSocket(p), time.Second)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, time.Second, time.Millisecond)
+	return p
+}
+
+func TestReloadUnderConnects(t *testing.T) {
+	prefixes := []string{filepath.Join(t.TempDir(), "rb-"), filepath.Join(t.TempDir(), "rb-"), filepath.Join(t.TempDir(), "rb-")}
+	p := startReloadProxy(t, prefixes[0])
+
+	var refused, misapplied, connects int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// the generation the connection is held to is one of those
+				// current between dialing and the proxy answering it
+				from := p.Generation()
+				conn, err := net.Dial("unix", configSocket(p))
+				if err != nil {
+					atomic.AddInt64(&refused, 1)
+					t.Log(err)
+					continue
+				}
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+				dec := redisproto.NewDecoder(conn)
+				if _, err := roundTrip(conn, dec, "PING"); err != nil {
+					atomic.AddInt64(&refused, 1)
+					t.Log(err)
+					_ = conn.Close()
+					continue
+				}
+				to := p.Generation()
+				accepted := 0
+				for g := from; g <= to; g++ {
+					res, err := roundTrip(conn, dec, "AUTH", "app", password(g))
+					if err == nil && res == "+OK \\r\\n " {
+						accepted++
+					}
+				}
+				if accepted != 1 {
+					atomic.AddInt64(&misapplied, 1)
+					t.Logf("%d of the passwords of generations %d to %d accepted", accepted, from, to)
+				}
+				atomic.AddInt64(&connects, 1)
+				_ = conn.Close()
+			}
+		}()
+	}
+
+	for i := 1; i <= 8; i++ {
+		time.Sleep(400 * time.Millisecond)
+		generation := p.Generation() + 1
+		// every other reload changes the socket path, and the rest only the
+		// credentials
+		prefix := prefixes[(i/2)%len(prefixes)]
+		assert.NoError(t, p.Reload(Reload{Auth: auth.Static{"app": password(generation)}, LocalSocketPrefix: prefix, LocalSocketSuffix: ".sock"}))
+		assert.Equal(t, generation, p.Generation())
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	assert.Zero(t, atomic.LoadInt64(&refused), "no connection is refused while sockets are replaced")
+	assert.Zero(t, atomic.LoadInt64(&misapplied), "every connection is held to the policy of exactly one generation")
+	assert.Greater(t, atomic.LoadInt64(&connects), int64(100))
+	assert.Equal(t, localSocketPathFromUpstream(p.upstreamConfigHost, p.database, prefixes[1], ".sock"), configSocket(p))
+}
+
+func TestReloadKeepsAcceptedConnections(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "rb-")
+	p := startReloadProxy(t, prefix)
+
+	old, err := net.Dial("unix", configSocket(p))
+	assert.NoError(t, err)
+	defer func() { _ = old.Close() }()
+	_ = old.SetDeadline(time.Now().Add(5 * time.Second))
+	oldDec := redisproto.NewDecoder(old)
+	res, err := roundTrip(old, oldDec, "PING")
+	assert.NoError(t, err)
+	assert.Equal(t, "-NOAUTH Authentication required. \\r\\n ", res)
+
+	assert.NoError(t, p.Reload(Reload{Auth: auth.Static{"app": password(2)}, LocalSocketPrefix: prefix, LocalSocketSuffix: ".sock"}))
+	res, err = roundTrip(old, oldDec, "AUTH", "app", password(1))
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK \\r\\n ", res, "a connection keeps the credentials it was accepted with")
+
+	kicked, err := net.Dial("unix", configSocket(p))
+	assert.NoError(t, err)
+	defer func() { _ = kicked.Close() }()
+	_ = kicked.SetDeadline(time.Now().Add(5 * time.Second))
+	kickedDec := redisproto.NewDecoder(kicked)
+	res, err = roundTrip(kicked, kickedDec, "AUTH", "app", password(1))
+	assert.NoError(t, err)
+	assert.Equal(t, "-WRONGPASS invalid username-password pair or user is disabled. \\r\\n ", res)
+	res, err = roundTrip(kicked, kickedDec, "AUTH", "app", password(2))
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK \\r\\n ", res)
+
+	assert.NoError(t, p.Reload(Reload{LocalSocketPrefix: prefix, LocalSocketSuffix: ".sock", KickAfter: 50 * time.Millisecond}))
+	_, err = kickedDec.Decode()
+	assert.Error(t, err, "the previous generation's connections are closed once kicked")
+	res, err = roundTrip(old, oldDec, "PING")
+	assert.NoError(t, err)
+	assert.Equal(t, "+PONG \\r\\n ", res, "only the generation before the reload is kicked")
+
+	// without a provider, new connections need no AUTH
+	fresh := setupStandaloneClient(t, configSocket(p))
+	defer func() { _ = fresh.Close() }()
+	assert.EqualValues(t, 3, p.Generation())
+}
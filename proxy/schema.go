@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/coinbase/redisbetween/metrics"
+)
+
+// Schema describes the metrics and the admin /stats JSON that tooling is built
+// against, so that it can check what it relies on still exists. It is generated
+// from the metric registry and the Stats types themselves, so it can't drift
+// from what is emitted and served.
+type Schema struct {
+	Version    int              `json:"version"`
+	CommonTags []string         `json:"common_tags"`
+	Metrics    []metrics.Metric `json:"metrics"`
+	Stats      []StatsField     `json:"stats"`
+}
+
+// StatsField is a field of the /stats JSON, by its path from the root, like
+// proxies[].listeners[].upstream. A field with a deprecated struct tag is a
+// renamed one still served under its old name, to be removed in the next minor
+// release.
+type StatsField struct {
+	Path       string `json:"path"`
+	Type       string `json:"type"`
+	Deprecated string `json:"deprecated,omitempty"`
+}
+
+// StatsSchema returns the schema of the metrics and /stats JSON
+func StatsSchema() Schema {
+	return Schema{
+		Version:    metrics.SchemaVersion,
+		CommonTags: metrics.CommonTags,
+		Metrics:    metrics.All(),
+		Stats:      statsFields("proxies[]", reflect.TypeOf(Stats{}), nil),
+	}
+}
+
+func statsFields(prefix string, t reflect.Type, fields []StatsField) []StatsField {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		path := prefix + "." + name
+		ft := f.Type
+		if ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct {
+			fields = append(fields, StatsField{Path: path, Type: "array", Deprecated: f.Tag.Get("deprecated")})
+			fields = statsFields(path+"[]", ft.Elem(), fields)
+			continue
+		}
+		fields = append(fields, StatsField{Path: path, Type: jsonType(ft), Deprecated: f.Tag.Get("deprecated")})
+	}
+	return fields
+}
+
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Map:
+		return "object of " + jsonType(t.Elem())
+	case reflect.Slice, reflect.Array:
+		return "array of " + jsonType(t.Elem())
+	case reflect.Ptr:
+		return jsonType(t.Elem())
+	}
+	return "object"
+}
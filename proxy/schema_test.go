@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var updateSchema = flag.Bool("update-schema", false, "rewrite testdata/schema.json from the current metrics and stats")
+
+// TestSchemaGolden fails on any change to the metrics or /stats fields, so that
+// none is made by accident. After a deliberate change, bump
+// metrics.SchemaVersion if it breaks anything, and rerun with -update-schema.
+func TestSchemaGolden(t *testing.T) {
+	golden := filepath.Join("testdata", "schema.json")
+	actual, err := json.MarshalIndent(StatsSchema(), "", "  ")
+	assert.NoError(t, err)
+	actual = append(actual, '\n')
+	if *updateSchema {
+		assert.NoError(t, ioutil.WriteFile(golden, actual, 0644))
+	}
+	expected, err := ioutil.ReadFile(golden)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual), "the metrics or stats schema changed, rerun with -update-schema if that was deliberate")
+}
+
+func TestStatsFields(t *testing.T) {
+	type inner struct {
+		Name string `json:"name"`
+	}
+	type outer struct {
+		Count   int64            `json:"count"`
+		OldName string           `json:"old_name" deprecated:"renamed to name"`
+		Rates   map[string]int64 `json:"rates,omitempty"`
+		Inner   []inner          `json:"inner"`
+		Hidden  string           `json:"-"`
+		Tags    []string         `json:"tags"`
+	}
+	assert.Equal(t, []StatsField{
+		{Path: "x.count", Type: "integer"},
+		{Path: "x.old_name", Type: "string", Deprecated: "renamed to name"},
+		{Path: "x.rates", Type: "object of integer"},
+		{Path: "x.inner", Type: "array"},
+		{Path: "x.inner[].name", Type: "string"},
+		{Path: "x.tags", Type: "array of string"},
+	}, statsFields("x", reflect.TypeOf(outer{}), nil))
+}
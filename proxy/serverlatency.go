@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/metrics"
+	"go.uber.org/zap"
+)
+
+// ServerLatencySample is the last sample of the time an upstream spent executing
+// commands, served under each listener in /stats
+type ServerLatencySample struct {
+	Time time.Time `json:"time"`
+	// Commands are the average microseconds the server spent executing each
+	// command called since the sample before
+	Commands map[string]float64 `json:"commands_usec,omitempty"`
+	// Error is why the sample failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// commandTotals are the cumulative counts of a command in INFO commandstats
+type commandTotals struct {
+	calls, usec int64
+}
+
+// serverLatency samples how long an upstream spends executing each command, from
+// the change in INFO commandstats between samples, so that dashboards can tell
+// the server's time from the network's, which the proxy's own latency includes.
+// Samples are taken on the listener's pool only while it has connections to
+// spare, so that they never hold up client requests.
+type serverLatency struct {
+	probe
+	log    *zap.Logger
+	statsd *statsd.Client
+	// sample sends INFO commandstats
+	sample func() (string, error)
+
+	// lock guards the samples, read by Last
+	lock   sync.Mutex
+	totals map[string]commandTotals
+	last   *ServerLatencySample
+	denied bool
+}
+
+// sampleServerLatency samples the server-side latency of a listener's upstream
+// every interval until the proxy shuts down
+func (p *Proxy) sampleServerLatency(l *upstreamListener, logWith *zap.Logger, sdWith *statsd.Client) *serverLatency {
+	s := &serverLatency{
+		probe: probe{interval: p.serverLatency, busy: poolBusy(l), skipped: func() {
+			metrics.ServerLatencySamples.Incr(sdWith, "skipped")
+		}},
+		log:    logWith,
+		statsd: sdWith,
+		sample: func() (string, error) {
+			res, err := p.command(l.server, "INFO", "commandstats")
+			if err != nil {
+				return "", err
+			}
+			if res.IsError() {
+				return "", errServerLatencyDenied(res.Value)
+			}
+			return string(res.Value), nil
+		},
+	}
+	p.runProbe(&s.probe, s.start)
+	return s
+}
+
+// errServerLatencyDenied is the upstream's error for INFO commandstats, such as
+// an ACL without the permission
+type errServerLatencyDenied []byte
+
+func (e errServerLatencyDenied) Error() string {
+	return string(e)
+}
+
+func (s *serverLatency) start(now time.Time) func() {
+	return func() { s.take(now) }
+}
+
+func (s *serverLatency) take(now time.Time) {
+	info, err := s.sample()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		s.last = &ServerLatencySample{Time: now, Error: err.Error()}
+		if _, ok := err.(errServerLatencyDenied); ok {
+			// an upstream that doesn't allow it is sampled no less, in case
+			// that changes, but logged only once
+			if !s.denied {
+				s.log.Info("Upstream denied INFO commandstats, server-side latency is unavailable", zap.Error(err))
+			}
+			s.denied = true
+			metrics.ServerLatencySamples.Incr(s.statsd, "denied")
+			return
+		}
+		s.log.Debug("Failed to sample server-side latency", zap.Error(err))
+		metrics.ServerLatencySamples.Incr(s.statsd, "failed")
+		return
+	}
+	s.denied = false
+	totals := parseCommandStats(info)
+	sample := &ServerLatencySample{Time: now, Commands: make(map[string]float64)}
+	for command, t := range totals {
+		prev, ok := s.totals[command]
+		// counts that went down were reset, with CONFIG RESETSTAT or a restart
+		if !ok || t.calls <= prev.calls || t.usec < prev.usec {
+			continue
+		}
+		usec := float64(t.usec-prev.usec) / float64(t.calls-prev.calls)
+		sample.Commands[command] = usec
+		metrics.ServerLatency.Record(s.statsd, time.Duration(usec*float64(time.Microsecond)), command)
+	}
+	s.totals = totals
+	s.last = sample
+	metrics.ServerLatencySamples.Incr(s.statsd, "ok")
+}
+
+// Last returns the last sample, nil before the first
+func (s *serverLatency) Last() *ServerLatencySample {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.last
+}
+
+// parseCommandStats reads the calls and microseconds of each command from the
+// commandstats section of INFO, lines like
+// cmdstat_get:calls=21,usec=175,usec_per_call=8.33,rejected_calls=0,failed_calls=0
+func parseCommandStats(info string) map[string]commandTotals {
+	totals := make(map[string]commandTotals)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "cmdstat_") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		var t commandTotals
+		var calls, usec bool
+		for _, field := range strings.Split(line[i+1:], ",") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "calls":
+				t.calls, _ = strconv.ParseInt(kv[1], 10, 64)
+				calls = true
+			case "usec":
+				t.usec, _ = strconv.ParseInt(kv[1], 10, 64)
+				usec = true
+			}
+		}
+		if calls && usec {
+			totals[line[len("cmdstat_"):i]] = t
+		}
+	}
+	return totals
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestParseCommandStats(t *testing.T) {
+	info := "# Commandstats\r\n" +
+		"cmdstat_get:calls=21,usec=175,usec_per_call=8.33,rejected_calls=0,failed_calls=0\r\n" +
+		"cmdstat_client|list:calls=2,usec=30,usec_per_call=15.00\r\n" +
+		"cmdstat_broken:usec_per_call=1.00\r\n"
+	assert.Equal(t, map[string]commandTotals{
+		"get":         {calls: 21, usec: 175},
+		"client|list": {calls: 2, usec: 30},
+	}, parseCommandStats(info))
+}
+
+func TestServerLatencySamples(t *testing.T) {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	var info string
+	var infoErr error
+	busy := false
+	s := &serverLatency{
+		log:    zap.NewNop(),
+		statsd: sd,
+		probe:  probe{interval: 10 * time.Second, busy: func() bool { return busy }, skipped: func() {}},
+		sample: func() (string, error) { return info, infoErr },
+	}
+	now := time.Now()
+	assert.Nil(t, s.Last())
+
+	info = "cmdstat_get:calls=10,usec=100\r\ncmdstat_set:calls=5,usec=100\r\n"
+	s.take(now)
+	assert.Empty(t, s.Last().Commands, "the first sample is only a baseline")
+
+	info = "cmdstat_get:calls=30,usec=500\r\ncmdstat_set:calls=5,usec=100\r\ncmdstat_del:calls=1,usec=3\r\n"
+	s.take(now.Add(10 * time.Second))
+	assert.Equal(t, map[string]float64{"get": 20}, s.Last().Commands, "averaged over the calls since the sample before")
+
+	info = "cmdstat_get:calls=2,usec=10\r\n"
+	s.take(now.Add(20 * time.Second))
+	assert.Empty(t, s.Last().Commands, "reset counts are a new baseline")
+
+	infoErr = errServerLatencyDenied("NOPERM this user has no permissions to run the 'info' command")
+	s.take(now.Add(30 * time.Second))
+	assert.Equal(t, "NOPERM this user has no permissions to run the 'info' command", s.Last().Error)
+	assert.True(t, s.denied)
+
+	infoErr = errors.New("i/o timeout")
+	s.take(now.Add(40 * time.Second))
+	assert.Equal(t, "i/o timeout", s.Last().Error)
+
+	// samples wait for the interval, and for the pool to have a connection to
+	// spare
+	infoErr = nil
+	s.next = now.Add(time.Minute)
+	s.tick(now.Add(50*time.Second), s.start)
+	assert.False(t, s.running)
+	busy = true
+	s.tick(now.Add(time.Minute), s.start)
+	assert.False(t, s.running)
+	assert.Equal(t, now.Add(time.Minute+10*time.Second), s.next, "a skipped sample waits for the next interval")
+}
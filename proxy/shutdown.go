@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/redisbetween/handlers"
+	"go.uber.org/zap"
+)
+
+const (
+	drainPollInterval = 10 * time.Millisecond
+	drainLogInterval  = time.Second
+)
+
+// Drain waits for the client connections of a proxy that has been shut down to
+// close. Idle connections close right away, and busy ones once the command they
+// are handling has been answered.
+func (p *Proxy) Drain(ctx context.Context) error {
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for {
+		n := atomic.LoadInt64(&p.clients)
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d client connections still open: %w", n, ctx.Err())
+		case <-t.C:
+		}
+	}
+}
+
+// ClosePools waits for every listener of a proxy that has been shut down to
+// disconnect its upstream pools, which each does once its client connections have
+// closed. The sockets taken over from a predecessor are waited for too.
+func (p *Proxy) ClosePools(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		for q := p; q != nil; q = q.previous() {
+			q.listenerWg.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("upstream pools still open: %w", ctx.Err())
+	}
+}
+
+// CloseMetrics flushes and closes the statsd clients the proxy made for its own
+// tags. It must only be called once the pools are closed, since they report
+// their events until then.
+func (p *Proxy) CloseMetrics() error {
+	p.backgroundLock.Lock()
+	clients := p.statsdClients
+	p.statsdClients = nil
+	p.backgroundLock.Unlock()
+
+	var err error
+	for _, c := range clients {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// UpstreamDrain is what a listener's drain is still waiting for
+type UpstreamDrain struct {
+	Upstream string `json:"upstream"`
+	Local    string `json:"local"`
+	handlers.ActivityStats
+}
+
+// DrainStatus is the drain report: what every listener is still waiting for,
+// and the time left until client connections are force closed
+type DrainStatus struct {
+	Upstreams []UpstreamDrain `json:"upstreams"`
+	Remaining float64         `json:"remaining_seconds"`
+}
+
+// DrainReport makes the drain of a graceful shutdown observable, for deploy
+// tooling to decide whether to wait for it, and drains listeners ahead of one
+// through the admin server. A shutdown goes on from listeners drained that way,
+// whose clients are there to drain still, while the others stop accepting too.
+type DrainReport struct {
+	proxies []*Proxy
+
+	mu       sync.Mutex
+	deadline time.Time
+	// all is whether every listener was drained through the admin server, for
+	// the proxies of a reload to start out drained too
+	all    bool
+	events chan<- DrainEvent
+}
+
+func NewDrainReport(proxies []*Proxy) *DrainReport {
+	return &DrainReport{proxies: proxies}
+}
+
+// SetProxies replaces the proxies reported on, after a reload
+func (d *DrainReport) SetProxies(proxies []*Proxy) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.proxies = proxies
+	if d.all {
+		for _, p := range proxies {
+			atomic.StoreInt32(&p.drainNew, 1)
+		}
+	}
+}
+
+// Start marks the start of the drain, which ends in force closing client
+// connections at deadline
+func (d *DrainReport) Start(deadline time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadline = deadline
+	d.send(DrainEvent{Time: time.Now(), State: "shutdown"})
+}
+
+// Status returns the drain report, and false if the drain hasn't started
+func (d *DrainReport) Status() (DrainStatus, bool) {
+	if d == nil {
+		return DrainStatus{}, false
+	}
+	d.mu.Lock()
+	deadline, proxies := d.deadline, d.proxies
+	d.mu.Unlock()
+	if deadline.IsZero() {
+		return DrainStatus{}, false
+	}
+	s := DrainStatus{Upstreams: []UpstreamDrain{}}
+	if remaining := time.Until(deadline); remaining > 0 {
+		s.Remaining = remaining.Seconds()
+	}
+	for _, p := range proxies {
+		s.Upstreams = append(s.Upstreams, p.drainStats()...)
+	}
+	return s, true
+}
+
+// LogUntil logs the drain report once a second until done is closed
+func (d *DrainReport) LogUntil(log *zap.Logger, done <-chan struct{}) {
+	t := time.NewTicker(drainLogInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		s, ok := d.Status()
+		if !ok {
+			continue
+		}
+		for _, u := range s.Upstreams {
+			if u.Clients == 0 {
+				continue
+			}
+			log.Info("Draining", zap.String("upstream", u.Upstream), zap.String("local", u.Local), zap.Int64("clients", u.Clients),
+				zap.Int64("in_flight", u.InFlight), zap.Int64("pinned_pipelines", u.Pinned["pipeline"]), zap.Float64("remaining_seconds", s.Remaining))
+		}
+	}
+}
+
+// drainStats returns what each listener's drain is still waiting for
+func (p *Proxy) drainStats() []UpstreamDrain {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	stats := make([]UpstreamDrain, 0, len(p.listeners))
+	for _, l := range p.listeners {
+		stats = append(stats, UpstreamDrain{Upstream: l.upstream, Local: l.local, ActivityStats: l.options.Activity.Stats()})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Upstream < stats[j].Upstream })
+	return stats
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/handlers"
+	redisproto "github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCommand(t *testing.T, conn net.Conn, args ...string) {
+	t.Helper()
+	mm := make([]*redisproto.Message, len(args))
+	for i, a := range args {
+		mm[i] = redisproto.NewBulkBytes([]byte(a))
+	}
+	assert.NoError(t, redisproto.Encode(conn, redisproto.NewArray(mm)))
+}
+
+func pinnedPipelines(d *DrainReport) int64 {
+	s, _ := d.Status()
+	return s.Upstreams[0].Pinned["pipeline"]
+}
+
+func TestDrainReportPinnedPipeline(t *testing.T) {
+	for _, notify := range []bool{false, true} {
+		node := newDBNode(t)
+		cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true, DrainNotify: notify}
+		p := startDBProxy(t, cfg, node.Address(), -1, handlers.NewDatabases())
+		d := NewDrainReport([]*Proxy{p})
+		_, ok := d.Status()
+		assert.False(t, ok, "not draining before the drain starts")
+
+		conn, err := net.Dial("unix", p.localConfigHost)
+		assert.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		writeCommand(t, conn, "GET", string(handlers.PipelineSignalStartKey))
+		writeCommand(t, conn, "SET", "k", "v")
+		d.Start(time.Now().Add(time.Minute))
+		assert.Eventually(t, func() bool { return pinnedPipelines(d) == 1 }, time.Second, time.Millisecond)
+		// the SET is read before the drain begins
+		time.Sleep(20 * time.Millisecond)
+
+		p.Shutdown()
+		dec := redisproto.NewDecoder(conn)
+		if notify {
+			// the SET is answered, and the client told to release its pipeline
+			for _, expected := range []string{"$-1 \\r\\n ", "+OK \\r\\n ", "-PROXYMAINT shutting down \\r\\n "} {
+				m, err := dec.Decode()
+				assert.NoError(t, err)
+				assert.Equal(t, expected, m.String())
+			}
+		} else {
+			// the pipeline is read to its end, and answered, including its
+			// signals, but the GET read after the drain began is not forwarded
+			time.Sleep(50 * time.Millisecond)
+			writeCommand(t, conn, "GET", "k")
+			writeCommand(t, conn, "GET", string(handlers.PipelineSignalEndKey))
+			for _, expected := range []string{"$-1 \\r\\n ", "+OK \\r\\n ", "-PROXYMAINT shutting down \\r\\n ", "$-1 \\r\\n "} {
+				m, err := dec.Decode()
+				assert.NoError(t, err)
+				assert.Equal(t, expected, m.String())
+			}
+		}
+		_, err = dec.Decode()
+		assert.Error(t, err, "the connection closes once its pipeline is done")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		assert.NoError(t, p.Drain(ctx))
+		cancel()
+		s, ok := d.Status()
+		assert.True(t, ok)
+		assert.Equal(t, handlers.ActivityStats{Pinned: map[string]int64{"pipeline": 0}}, s.Upstreams[0].ActivityStats)
+		assert.Greater(t, s.Remaining, float64(50))
+		assert.Equal(t, http.StatusServiceUnavailable, healthz(nil, d))
+	}
+}
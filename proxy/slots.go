@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func slotRange(start, end uint16) string {
+	if start == end {
+		return strconv.Itoa(int(start))
+	}
+	return strconv.Itoa(int(start)) + "-" + strconv.Itoa(int(end))
+}
+
+// setSlotRanges replaces the slot ranges of every node with those of the latest
+// cluster topology
+func (p *Proxy) setSlotRanges(ranges map[string][]string) {
+	slots := make(map[string]string, len(ranges))
+	for node, rr := range ranges {
+		sort.Slice(rr, func(i, j int) bool { return slotStart(rr[i]) < slotStart(rr[j]) })
+		slots[node] = strings.Join(rr, ",")
+	}
+	p.setSlots(slots)
+}
+
+// setSlots replaces the slot ranges of every node, and shares them with the other
+// instances if they are new
+func (p *Proxy) setSlots(slots map[string]string) {
+	p.slotsLock.Lock()
+	p.slots = slots
+	p.slotsLock.Unlock()
+	p.topology.observe(slots)
+}
+
+// slotNode returns the node serving a slot, or "" if the proxy hasn't seen the
+// cluster topology
+func (p *Proxy) slotNode(slot int) string {
+	p.slotsLock.Lock()
+	defer p.slotsLock.Unlock()
+	for node, ranges := range p.slots {
+		for _, r := range strings.Split(ranges, ",") {
+			end := slotStart(r)
+			if i := strings.IndexByte(r, '-'); i >= 0 {
+				end, _ = strconv.Atoi(r[i+1:])
+			}
+			if slot >= slotStart(r) && slot <= end {
+				return node
+			}
+		}
+	}
+	return ""
+}
+
+// slotRanges returns the slot ranges a node serves, e.g. "0-5460,10923", or ""
+// if the proxy hasn't seen the cluster topology
+func (p *Proxy) slotRanges(node string) string {
+	p.slotsLock.Lock()
+	defer p.slotsLock.Unlock()
+	return p.slots[node]
+}
+
+func slotStart(r string) int {
+	if i := strings.IndexByte(r, '-'); i >= 0 {
+		r = r[:i]
+	}
+	n, _ := strconv.Atoi(r)
+	return n
+}
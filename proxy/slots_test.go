@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestSlotRangesAndBreakersPerNode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slots")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(dir, "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: "127.0.0.1:7000", Database: -1, MaxPoolSize: 1, BreakerErrorRate: 0.5, BreakerMinRequests: 5, MaxInFlight: 10})
+	assert.NoError(t, err)
+	defer p.Shutdown()
+
+	nodes := "07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:7001@17001 myself,master - 0 0 1 connected 0-5460 10923\n" +
+		"67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:7002@17002 master - 0 1426238316232 2 connected 5461-10922 [5461->-e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca]\n" +
+		"292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 127.0.0.1:7003@17003 slave 07c37dfeb235213a872192d90877d0cd55635b91 0 1426238317239 1 connected\n"
+	p.interceptMessages([]string{"CLUSTER NODES"}, []*redis.Message{redis.NewBulkBytes([]byte(nodes))})
+	assert.Equal(t, "0-5460,10923", p.slotRanges("127.0.0.1:7001"))
+	assert.Equal(t, "5461-10922", p.slotRanges("127.0.0.1:7002"))
+	assert.Equal(t, "", p.slotRanges("127.0.0.1:7003"))
+
+	slot := func(start, end int, addr string, port int) *redis.Message {
+		return redis.NewArray([]*redis.Message{
+			redis.NewInt([]byte(strconv.Itoa(start))),
+			redis.NewInt([]byte(strconv.Itoa(end))),
+			redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte(addr)), redis.NewInt([]byte(strconv.Itoa(port)))}),
+		})
+	}
+	slots := redis.NewArray([]*redis.Message{slot(0, 8191, "127.0.0.1", 7001), slot(8192, 16383, "127.0.0.1", 7002)})
+	p.interceptMessages([]string{"CLUSTER SLOTS"}, []*redis.Message{slots})
+	assert.Equal(t, "0-8191", p.slotRanges("127.0.0.1:7001"))
+	assert.Equal(t, "8192-16383", p.slotRanges("127.0.0.1:7002"))
+
+	p.listenerLock.Lock()
+	a, b := p.listeners["127.0.0.1:7001"].options, p.listeners["127.0.0.1:7002"].options
+	p.listenerLock.Unlock()
+	assert.NotNil(t, a.Breaker)
+	assert.False(t, a.Breaker == b.Breaker, "every node has its own breaker")
+	assert.False(t, a.InFlight == b.InFlight, "and its own in-flight limit")
+	assert.Equal(t, "0-8191", a.Slots())
+
+	stats := p.Stats()
+	assert.Equal(t, "closed", stats.Listeners[0].Circuit)
+	assert.Equal(t, "0-8191", stats.Listeners[0].Slots)
+}
+
+func TestIPv6NodeAnnouncements(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slots")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(dir, "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: "[2600:1f14::10]:7000", Database: -1, MaxPoolSize: 1})
+	assert.NoError(t, err)
+	defer p.Shutdown()
+
+	nodes := "07c37dfeb235213a872192d90877d0cd55635b91 2600:1f14::11:7001@17001 myself,master - 0 0 1 connected 0-8191\n" +
+		"67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 2600:1f14:0:0::12:7002@17002 master - 0 1426238316232 2 connected 8192-16383\n"
+	p.interceptMessages([]string{"CLUSTER NODES"}, []*redis.Message{redis.NewBulkBytes([]byte(nodes))})
+	assert.Equal(t, "0-8191", p.slotRanges("[2600:1f14::11]:7001"))
+	assert.Equal(t, "8192-16383", p.slotRanges("[2600:1f14::12]:7002"))
+
+	slots := redis.NewArray([]*redis.Message{redis.NewArray([]*redis.Message{
+		redis.NewInt([]byte("0")),
+		redis.NewInt([]byte("16383")),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("2600:1f14::13")), redis.NewInt([]byte("7003"))}),
+	})})
+	p.interceptMessages([]string{"CLUSTER SLOTS"}, []*redis.Message{slots})
+	assert.Equal(t, "0-16383", p.slotRanges("[2600:1f14::13]:7003"))
+
+	p.interceptMessages([]string{"GET"}, []*redis.Message{redis.NewError([]byte("MOVED 3999 2600:1f14::14:7004"))})
+
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	for _, upstream := range []string{"[2600:1f14::11]:7001", "[2600:1f14::12]:7002", "[2600:1f14::13]:7003", "[2600:1f14::14]:7004"} {
+		assert.Contains(t, p.listeners, upstream)
+	}
+	if l, ok := p.listeners["[2600:1f14::12]:7002"]; ok {
+		assert.Equal(t, filepath.Join(dir, "rb-ipv6-2600-1f14--12-7002.sock"), l.local)
+	}
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/handlers"
+)
+
+// SlowLogHandler serves the slow round trips proxies kept for GET /slowlog, the
+// most recent first, by upstream, for those with a slow log
+func SlowLogHandler(proxies []*Proxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slow := make(map[string][]handlers.SlowEntry)
+		for _, p := range proxies {
+			if p.slowLog != nil {
+				slow[p.Name()] = p.slowLog.Recent()
+			}
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"slowlog": slow})
+	})
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowLogHandler(t *testing.T) {
+	logged := &Proxy{label: "logged", slowLog: handlers.NewSlowLog(handlers.SlowLogOptions{Threshold: time.Second})}
+	off := &Proxy{label: "off"}
+	w := httptest.NewRecorder()
+	SlowLogHandler([]*Proxy{logged, off}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slowlog", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res struct {
+		SlowLog map[string][]handlers.SlowEntry `json:"slowlog"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Len(t, res.SlowLog, 1, "only the upstreams with a slow log")
+	assert.NotNil(t, res.SlowLog["logged"])
+}
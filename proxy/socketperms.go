@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/coinbase/redisbetween/config"
+)
+
+// socketPerms are the file mode and group a proxy's unix sockets are given
+// before clients can connect to them: a socket is bound to a path of its own,
+// given them once it listens, and only then renamed to its path, so that a
+// client never finds one there with other permissions, even as it replaces
+// another's
+type socketPerms struct {
+	mode  os.FileMode
+	group string
+	gid   int
+}
+
+// socketPermsOf are the socket permissions of an upstream, its socketmode and
+// socketgroup overriding those of the config
+func socketPermsOf(c *config.Config, u *config.Upstream) socketPerms {
+	s := socketPerms{mode: c.SocketMode, group: c.SocketGroup, gid: -1}
+	if u.SocketMode != 0 {
+		s.mode = u.SocketMode
+	}
+	if u.SocketGroup != "" {
+		s.group = u.SocketGroup
+	}
+	return s
+}
+
+// set is whether there are permissions to give the sockets
+func (s socketPerms) set() bool {
+	return s.mode != 0 || s.group != ""
+}
+
+// resolve looks up the gid of the group. A group that doesn't exist, or that
+// the process can't give its sockets, not running as root or in the group, is
+// an error rather than sockets left with the process's group.
+func (s *socketPerms) resolve(network string) error {
+	if !s.set() {
+		return nil
+	}
+	if !strings.Contains(network, "unix") {
+		return fmt.Errorf("socketmode and socketgroup need a unix network, not %s", network)
+	}
+	if s.group == "" {
+		return nil
+	}
+	g, err := user.LookupGroup(s.group)
+	if err != nil {
+		return fmt.Errorf("invalid socketgroup %s: %w", s.group, err)
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid socketgroup %s: gid %s", s.group, g.Gid)
+	}
+	if !canChown(gid) {
+		return fmt.Errorf("invalid socketgroup %s: the process is neither root nor in the group", s.group)
+	}
+	s.gid = gid
+	return nil
+}
+
+// canChown is whether the process can give the files it owns the group gid
+func canChown(gid int) bool {
+	if os.Geteuid() == 0 || os.Getegid() == gid {
+		return true
+	}
+	groups, err := os.Getgroups()
+	if err != nil {
+		return false
+	}
+	for _, g := range groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// apply gives the socket bound to path its mode and group
+func (s socketPerms) apply(path string) error {
+	if s.mode != 0 {
+		if err := os.Chmod(path, s.mode); err != nil {
+			return err
+		}
+	}
+	if s.gid >= 0 {
+		if err := os.Chown(path, -1, s.gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSocketPerms checks, for a proxy giving its sockets permissions, that a
+// socket at local can be bound to a path of its own first, and without
+// -unlink that there is no socket in its way, as listening on local would
+func (p *Proxy) checkSocketPerms(local string) error {
+	if !p.socketPerms.set() {
+		return nil
+	}
+	if len(local)+handOffSuffix > maxSocketPath {
+		return fmt.Errorf("socket path %s is too long to be bound elsewhere first for socketmode and socketgroup", local)
+	}
+	if _, err := os.Lstat(local); err == nil && !p.config.Unlink {
+		return fmt.Errorf("listen %s %s: %w", p.config.Network, local, syscall.EADDRINUSE)
+	}
+	return nil
+}
+
+// placeSocket gives the socket listening on bind its permissions, and moves it
+// to local, atomically: with -unlink it is renamed over whatever is there, and
+// otherwise linked to local, which fails if there is a socket in the way
+func (p *Proxy) placeSocket(bind, local string) error {
+	if err := p.socketPerms.apply(bind); err != nil {
+		return err
+	}
+	if p.config.Unlink {
+		return os.Rename(bind, local)
+	}
+	if err := os.Link(bind, local); err != nil {
+		return err
+	}
+	return os.Remove(bind)
+}
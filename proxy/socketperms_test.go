@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// testSocketGroup is a group the process can give its sockets, other than its
+// own if it runs as root
+func testSocketGroup(t *testing.T) *user.Group {
+	if os.Geteuid() == 0 {
+		if g, err := user.LookupGroup("daemon"); err == nil {
+			return g
+		}
+	}
+	g, err := user.LookupGroupId(strconv.Itoa(os.Getegid()))
+	if err != nil {
+		t.Skipf("no group to give sockets: %v", err)
+	}
+	return g
+}
+
+func assertSocketPerms(t *testing.T, local string, mode os.FileMode, g *user.Group) {
+	t.Helper()
+	fi, err := os.Stat(local)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, mode, fi.Mode().Perm())
+	assert.Equal(t, g.Gid, strconv.Itoa(int(fi.Sys().(*syscall.Stat_t).Gid)))
+}
+
+func TestSocketPerms(t *testing.T) {
+	node := newDBNode(t)
+	dir := t.TempDir()
+	g := testSocketGroup(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(dir, "rb-"), LocalSocketSuffix: ".sock", Unlink: true, SocketMode: 0640, SocketGroup: g.Name}
+	old := startHandOffProxy(t, cfg, node.Address())
+	local := old.localConfigHost
+	assertSocketPerms(t, local, 0640, g)
+	pingSocket(t, local)
+
+	// a successor taking over the socket never leaves one at its path with
+	// other permissions
+	var wrong int32
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if fi, err := os.Stat(local); err == nil && fi.Mode().Perm() != 0640 {
+				atomic.StoreInt32(&wrong, 1)
+			}
+		}
+	}()
+	next := startHandOffProxy(t, cfg, node.Address())
+	close(done)
+	assert.True(t, old.HandedOff())
+	assert.Zero(t, atomic.LoadInt32(&wrong))
+	assertSocketPerms(t, local, 0640, g)
+	pingSocket(t, local)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "only the socket, at its path")
+
+	// an upstream's own socketmode overrides the config's
+	u := &config.Upstream{SocketMode: 0600}
+	p := socketPermsOf(cfg, u)
+	assert.NoError(t, p.resolve(cfg.Network))
+	assert.Equal(t, os.FileMode(0600), p.mode)
+	assert.Equal(t, g.Gid, strconv.Itoa(p.gid))
+	next.Shutdown()
+}
+
+func TestSocketPermsReload(t *testing.T) {
+	node := newDBNode(t)
+	dir := t.TempDir()
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(dir, "rb-"), LocalSocketSuffix: ".sock", Unlink: true, SocketMode: 0600}
+	p := startHandOffProxy(t, cfg, node.Address())
+	old := configSocket(p)
+
+	// a socket replaced on reload is given the permissions before its path
+	assert.NoError(t, p.Reload(Reload{LocalSocketPrefix: filepath.Join(dir, "next-"), LocalSocketSuffix: ".sock"}))
+	local := configSocket(p)
+	assert.NotEqual(t, old, local)
+	assertSocketPerms(t, local, 0600, &user.Group{Gid: strconv.Itoa(os.Getegid())})
+	pingSocket(t, local)
+}
+
+func TestSocketPermsWithoutUnlink(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", SocketMode: 0660}
+	p := startHandOffProxy(t, cfg, node.Address())
+	assertSocketPerms(t, p.localConfigHost, 0660, &user.Group{Gid: strconv.Itoa(os.Getegid())})
+
+	// a socket in the way is left in place, as listening on it would
+	_, err := p.createListener(p.localConfigHost, node.Address())
+	assert.EqualError(t, err, "listen unix "+p.localConfigHost+": address already in use")
+	assertSocketPerms(t, p.localConfigHost, 0660, &user.Group{Gid: strconv.Itoa(os.Getegid())})
+}
+
+func TestSocketPermsErrors(t *testing.T) {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	u := &config.Upstream{UpstreamConfigHost: "cache:6379", Database: -1}
+	_, err = NewProxy(zap.NewNop(), sd, &config.Config{Network: "unix", SocketGroup: "no-such-group"}, u)
+	assert.EqualError(t, err, "invalid socketgroup no-such-group: group: unknown group no-such-group")
+	_, err = NewProxy(zap.NewNop(), sd, &config.Config{Network: "tcp", SocketMode: 0660}, u)
+	assert.EqualError(t, err, "socketmode and socketgroup need a unix network, not tcp")
+
+	c := &config.Config{LocalSocketPrefix: "/var/tmp/redisbetween-some-rather-long-directory-name/", LocalSocketSuffix: ".sock", Upstreams: []config.Upstream{
+		{UpstreamConfigHost: "cache.internal.example.com:6379", Database: -1},
+	}}
+	assert.NoError(t, CheckSocketPaths(c))
+	c.Upstreams[0].SocketMode = 0660
+	assert.EqualError(t, CheckSocketPaths(c), "socket path /var/tmp/redisbetween-some-rather-long-directory-name/cache.internal.example.com-6379.sock of upstream cache.internal.example.com:6379 is too long to be bound elsewhere first for socketmode and socketgroup")
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coinbase/redisbetween/handlers"
+)
+
+// Stats is a point-in-time summary of a proxy, served by the admin /stats route.
+type Stats struct {
+	Label    string `json:"label"`
+	Upstream string `json:"upstream"`
+	ReadOnly bool   `json:"read_only"`
+	Clients  int64  `json:"clients"`
+	// PeakClients is the most client connections open at once
+	PeakClients int64 `json:"peak_clients"`
+	// Requests, Commands, Connections and Errors are the totals of the
+	// listeners
+	Requests    int64                `json:"requests"`
+	Commands    int64                `json:"commands"`
+	Connections int64                `json:"connections"`
+	Errors      int64                `json:"errors"`
+	Topology    *TopologyStats       `json:"topology,omitempty"`
+	SLOs        []handlers.SLOStatus `json:"slos,omitempty"`
+	Mix         *handlers.MixStats   `json:"command_mix,omitempty"`
+	Listeners   []ListenerStats      `json:"listeners"`
+}
+
+// ListenerStats describes one upstream address and the local socket mapped to it.
+type ListenerStats struct {
+	Upstream        string                     `json:"upstream"`
+	Local           string                     `json:"local"`
+	ClientLibraries map[string]int64           `json:"client_libraries"`
+	Circuit         string                     `json:"circuit,omitempty"`
+	Slots           string                     `json:"slots,omitempty"`
+	Pool            PoolStats                  `json:"pool"`
+	ReservedPool    *PoolStats                 `json:"reserved_pool,omitempty"`
+	BlockingPool    *PoolStats                 `json:"blocking_pool,omitempty"`
+	Blocked         int64                      `json:"blocked,omitempty"`
+	PubSubPool      *PoolStats                 `json:"pubsub_pool,omitempty"`
+	Pinned          int64                      `json:"pinned,omitempty"`
+	RESP3Pool       *PoolStats                 `json:"resp3_pool,omitempty"`
+	Transactions    int64                      `json:"pinned_transactions,omitempty"`
+	Segments        []handlers.SegmentStats    `json:"segments,omitempty"`
+	FairQueue       *handlers.FairQueueStats   `json:"fair_queue,omitempty"`
+	ServerLatency   *ServerLatencySample       `json:"server_latency,omitempty"`
+	Config          *handlers.ConfigCacheStats `json:"config,omitempty"`
+	Identity        *handlers.IdentityStats    `json:"identity,omitempty"`
+	Scripts         *handlers.ScriptsStats     `json:"scripts,omitempty"`
+	Mirror          *handlers.MirrorStats      `json:"mirror,omitempty"`
+	Warnings        *handlers.WarningsStats    `json:"warnings,omitempty"`
+	Signals         *handlers.SignalsStats     `json:"signals,omitempty"`
+	handlers.TrafficStats
+}
+
+// PoolStats are the size limits and connection counts of an upstream pool
+type PoolStats struct {
+	MinSize    int   `json:"min_size"`
+	MaxSize    int   `json:"max_size"`
+	Open       int64 `json:"open"`
+	CheckedOut int64 `json:"checked_out"`
+	// Budget is the pool's allocation of the connection budget, if there is one
+	Budget *PoolBudgetStats `json:"budget,omitempty"`
+	// Advice recommends the pool's size limits, if it is advised on
+	Advice *PoolAdvice `json:"advice,omitempty"`
+}
+
+// poolCounts are kept up to date by a pool's monitor
+type poolCounts struct {
+	minSize, maxSize int
+	open, checkedOut int64
+	// resp3 is whether the pool's connections speak RESP3
+	resp3 bool
+	// budget is the pool's account with the connection budget, if there is one
+	budget *budgetPool
+	// advisor observes the pool's utilization, if it is advised on
+	advisor *poolAdvisor
+
+	// closes are the reasons connections were closed for, since the pool was
+	// last healed
+	closesLock sync.Mutex
+	closes     map[string]int64
+}
+
+// closed counts a connection closed for reason
+func (c *poolCounts) closed(reason string) {
+	c.closesLock.Lock()
+	defer c.closesLock.Unlock()
+	if c.closes == nil {
+		c.closes = make(map[string]int64)
+	}
+	c.closes[reason]++
+}
+
+// closeReasons returns a copy of the reasons connections were closed for,
+// starting over if reset is set
+func (c *poolCounts) closeReasons(reset bool) map[string]int64 {
+	c.closesLock.Lock()
+	defer c.closesLock.Unlock()
+	reasons := make(map[string]int64, len(c.closes))
+	for r, n := range c.closes {
+		reasons[r] = n
+	}
+	if reset {
+		c.closes = nil
+	}
+	return reasons
+}
+
+func (c *poolCounts) stats() PoolStats {
+	return PoolStats{
+		MinSize:    c.minSize,
+		MaxSize:    c.maxSize,
+		Open:       atomic.LoadInt64(&c.open),
+		CheckedOut: atomic.LoadInt64(&c.checkedOut),
+		Budget:     c.budget.stats(),
+		Advice:     c.advisor.advice(c.maxSize),
+	}
+}
+
+func (p *Proxy) Stats() Stats {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+
+	s := Stats{
+		Label:       p.label,
+		Upstream:    p.upstreamConfigHost,
+		ReadOnly:    p.readOnly.Enabled(),
+		Clients:     atomic.LoadInt64(&p.clients),
+		PeakClients: atomic.LoadInt64(&p.peakClients),
+		Topology:    p.topology.stats(),
+		SLOs:        p.slos.Status(),
+		Mix:         p.mix.Stats(),
+	}
+	for _, l := range p.listeners {
+		ls := ListenerStats{
+			Upstream: l.upstream,
+			Local:    l.local,
+		}
+		if l.options.ClientLibraries != nil {
+			ls.ClientLibraries = l.options.ClientLibraries.Snapshot()
+		}
+		if l.options.Breaker != nil {
+			ls.Circuit = handlers.BreakerStateName(l.options.Breaker.State())
+		}
+		ls.Slots = p.slotRanges(l.upstream)
+		if l.pool != nil {
+			ls.Pool = l.pool.stats()
+		}
+		if l.reserved != nil {
+			rs := l.reserved.stats()
+			ls.ReservedPool = &rs
+		}
+		if l.blocking != nil {
+			bs := l.blocking.stats()
+			ls.BlockingPool = &bs
+			ls.Blocked = l.options.Blocking.Blocked()
+		}
+		if l.pubSub != nil {
+			ps := l.pubSub.stats()
+			ls.PubSubPool = &ps
+			ls.Pinned = l.options.PubSub.Pinned()
+		}
+		if l.resp3 != nil {
+			rs := l.resp3.stats()
+			ls.RESP3Pool = &rs
+		}
+		if l.options.Transactions != nil {
+			ls.Transactions = l.options.Transactions.Pinned()
+		}
+		ls.Segments = l.options.Segments.Stats()
+		ls.FairQueue = l.options.FairQueue.Stats()
+		ls.ServerLatency = l.latency.Last()
+		ls.Config = l.options.ConfigCache.Stats()
+		ls.Identity = l.options.Identity.Stats()
+		ls.Scripts = l.options.Scripts.Stats()
+		ls.Mirror = l.options.Mirror.Stats()
+		ls.Warnings = l.options.Warnings.Stats()
+		ls.Signals = l.options.Signals.Stats()
+		ls.TrafficStats = l.options.Traffic.Stats()
+		s.Requests += ls.Requests
+		s.Commands += ls.Commands
+		s.Connections += ls.Connections
+		s.Errors += ls.Errors
+		s.Listeners = append(s.Listeners, ls)
+	}
+	sort.Slice(s.Listeners, func(i, j int) bool {
+		return s.Listeners[i].Upstream < s.Listeners[j].Upstream
+	})
+	return s
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"go.uber.org/zap"
+)
+
+// TakeOver replaces old, a running proxy of the same upstream and database, by
+// p, a proxy built from a changed config of it. p takes over old's sockets, so
+// that no client ever finds nothing listening: the connections they accept from
+// then on are served with p's pools, while those accepted before finish with
+// old's. old is then shut down, its pools closing in the background once its
+// connections are done, or after drainTimeout at the latest. With a prewarm,
+// p's pools are first given up to that long to open their minpoolsize
+// connections, the takeover failing if they don't. p must not have run, and is
+// run by TakeOver. If it fails old keeps serving as it was, and p is shut down,
+// its metrics closed.
+func (p *Proxy) TakeOver(old *Proxy, drainTimeout, prewarm time.Duration) error {
+	old.reloadLock.Lock()
+	defer old.reloadLock.Unlock()
+
+	// a socket replaced by a reload of the listener settings is still open,
+	// and still served by old, until it retires
+	old.awaitSocketsRetired()
+
+	old.listenerLock.Lock()
+	previous := make(map[string]*upstreamListener, len(old.listeners))
+	for upstream, l := range old.listeners {
+		previous[upstream] = l
+	}
+	socketPrefix, socketSuffix := old.socketPrefix, old.socketSuffix
+	old.listenerLock.Unlock()
+	if _, ok := previous[old.upstreamConfigHost]; !ok {
+		p.Shutdown()
+		_ = p.CloseMetrics()
+		return fmt.Errorf("taking over %s: not listening", old.Name())
+	}
+
+	policy := old.currentPolicy()
+	p.policyLock.Lock()
+	p.policy = p.newPolicy(policy.generation, policy.auth)
+	p.policyLock.Unlock()
+	old.slotsLock.Lock()
+	for node, slots := range old.slots {
+		p.slots[node] = slots
+	}
+	old.slotsLock.Unlock()
+	p.start()
+
+	adopted := make(map[string]*upstreamListener, len(previous))
+	for upstream, l := range previous {
+		nl, err := p.newUpstreamListener(l.local, upstream)
+		if err != nil {
+			for _, nl := range adopted {
+				nl.closePools()
+			}
+			p.Shutdown()
+			_ = p.CloseMetrics()
+			return fmt.Errorf("taking over %s: %w", old.Name(), err)
+		}
+		adopted[upstream] = nl
+	}
+	if prewarm > 0 {
+		if err := p.awaitWarm(adopted, prewarm); err != nil {
+			for _, nl := range adopted {
+				nl.closePools()
+			}
+			p.Shutdown()
+			_ = p.CloseMetrics()
+			return fmt.Errorf("taking over %s: %w", old.Name(), err)
+		}
+	}
+
+	old.listenerLock.Lock()
+	p.listenerLock.Lock()
+	p.socketPrefix, p.socketSuffix = socketPrefix, socketSuffix
+	for upstream, l := range previous {
+		nl := adopted[upstream]
+		nl.Listener, nl.local, nl.bound, nl.sockets, nl.accepting = l.Listener, l.local, l.bound, 1, atomic.LoadInt32(&l.accepting)
+		l.successorLock.Lock()
+		l.successor = nl
+		l.successorLock.Unlock()
+		p.listeners[upstream] = nl
+		// a listener old started since is left to it, to shut down below
+		delete(old.listeners, upstream)
+	}
+	p.localConfigHost = old.localConfigHost
+	p.predecessor = old
+	old.successor = p
+	p.listenerLock.Unlock()
+	old.listenerLock.Unlock()
+
+	// the sockets keep reporting through old's statsd clients, which are closed
+	// along with p's
+	old.backgroundLock.Lock()
+	clients := old.statsdClients
+	old.statsdClients = nil
+	old.backgroundLock.Unlock()
+	p.backgroundLock.Lock()
+	p.statsdClients = append(p.statsdClients, clients...)
+	p.backgroundLock.Unlock()
+
+	p.log.Info("Took over listeners", zap.Int("listeners", len(adopted)), zap.Uint64("generation", policy.generation))
+	p.refreshDiscovery()
+	// with its listeners taken over, this only closes old's idle connections,
+	// and those that are busy once they have been answered
+	old.Shutdown()
+	go old.retire(previous, drainTimeout)
+	return nil
+}
+
+// awaitWarm waits up to prewarm for the pool of each listener to answer PINGs
+// through as many connections at once as its minimum, or one, for them to be
+// connected before the listener serves clients. A round of PINGs that fails is
+// tried again until prewarm is up.
+func (p *Proxy) awaitWarm(listeners map[string]*upstreamListener, prewarm time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prewarm)
+	defer cancel()
+	start := time.Now()
+	for {
+		err := p.warmUp(ctx, listeners)
+		if err == nil {
+			metrics.ReloadPrewarms.Incr(p.statsd, "warm")
+			p.log.Info("Pools warm, taking over listeners", zap.Duration("waited", time.Since(start)))
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			metrics.ReloadPrewarms.Incr(p.statsd, "cold")
+			return fmt.Errorf("pools not warm after %v: %w", prewarm, err)
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
+
+// warmUp sends the PINGs of a round of awaitWarm at once, returning the first
+// error
+func (p *Proxy) warmUp(ctx context.Context, listeners map[string]*upstreamListener) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var first error
+	for _, l := range listeners {
+		n := l.pool.minSize
+		if n < 1 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(l *upstreamListener) {
+				defer wg.Done()
+				if err := p.ping(ctx, l.server); err != nil {
+					mu.Lock()
+					if first == nil {
+						first = err
+					}
+					mu.Unlock()
+				}
+			}(l)
+		}
+	}
+	wg.Wait()
+	return first
+}
+
+// retire closes the pools of the listeners a proxy that was shut down had
+// taken over, once the connections they were serving are done
+func (p *Proxy) retire(listeners map[string]*upstreamListener, drainTimeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	for _, l := range listeners {
+		done := make(chan struct{})
+		go func(l *upstreamListener) {
+			l.serving.Wait()
+			close(done)
+		}(l)
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+	if ctx.Err() != nil {
+		p.log.Warn("Drain of replaced listeners timed out, closing their pools", zap.Duration("timeout", drainTimeout), zap.Int64("clients", atomic.LoadInt64(&p.clients)))
+	}
+	for _, l := range listeners {
+		l.closePools()
+	}
+	p.log.Info("Retired replaced listeners", zap.Int("listeners", len(listeners)))
+}
+
+// awaitSocketsRetired waits until no listener has a replaced socket still open
+func (p *Proxy) awaitSocketsRetired() {
+	for {
+		p.listenerLock.Lock()
+		retiring := 0
+		for _, l := range p.listeners {
+			retiring += len(l.retiring)
+		}
+		p.listenerLock.Unlock()
+		if retiring == 0 {
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// previous is the proxy p took its listeners over from, if any
+func (p *Proxy) previous() *Proxy {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	return p.predecessor
+}
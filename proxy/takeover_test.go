@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	redisproto "github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func authedConn(t *testing.T, local string) (net.Conn, *redisproto.Decoder) {
+	conn, err := net.Dial("unix", local)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	dec := redisproto.NewDecoder(conn)
+	res, err := roundTrip(conn, dec, "AUTH", "app", password(1))
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK \\r\\n ", res)
+	return conn, dec
+}
+
+func TestTakeOver(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "rb-")
+	old := startReloadProxy(t, prefix)
+	local := configSocket(old)
+	before, beforeDec := authedConn(t, local)
+	res, err := roundTrip(before, beforeDec, "SET", "a", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK \\r\\n ", res)
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	changed := &config.Upstream{UpstreamConfigHost: old.upstreamConfigHost, MaxPoolSize: 8, ReadTimeout: time.Second, WriteTimeout: time.Second}
+	p, err := NewProxy(zap.NewNop(), sd, old.config, changed)
+	assert.NoError(t, err)
+	t.Cleanup(p.Shutdown)
+	assert.NoError(t, p.TakeOver(old, time.Second, 0))
+
+	assert.Equal(t, local, configSocket(p), "the socket is taken over as it is")
+	assert.Empty(t, old.Sockets())
+	after, afterDec := authedConn(t, local)
+	res, err = roundTrip(after, afterDec, "GET", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "$1 \\r\\n 1 \\r\\n ", res)
+	stats := p.Stats()
+	assert.Len(t, stats.Listeners, 1)
+	assert.Equal(t, 8, stats.Listeners[0].Pool.MaxSize, "new connections are served by the new pool")
+	assert.EqualValues(t, 1, p.Generation(), "clients are held to the policy they were")
+
+	_, err = beforeDec.Decode()
+	assert.Error(t, err, "an idle connection of the replaced proxy is closed")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, old.Drain(ctx))
+
+	p.Shutdown()
+	assert.NoError(t, p.Drain(ctx))
+	assert.NoError(t, p.ClosePools(ctx), "the sockets taken over close with the proxy that took them")
+}
+
+func TestTakeOverNotListening(t *testing.T) {
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	upstream := &config.Upstream{UpstreamConfigHost: "127.0.0.1:1", MaxPoolSize: 4}
+	old, err := NewProxy(zap.NewNop(), sd, cfg, upstream)
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, cfg, upstream)
+	assert.NoError(t, err)
+	assert.EqualError(t, p.TakeOver(old, time.Second, 0), "taking over 127.0.0.1:1: not listening")
+	select {
+	case <-p.quit:
+	default:
+		t.Error("the proxy that failed to take over is shut down")
+	}
+}
+
+func TestTakeOverPrewarm(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	old := startHandOffProxy(t, cfg, node.Address())
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	changed := &config.Upstream{UpstreamConfigHost: node.Address(), Database: -1, MinPoolSize: 2, MaxPoolSize: 4, ReadTimeout: time.Second, WriteTimeout: time.Second}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, changed)
+	assert.NoError(t, err)
+	t.Cleanup(p.Shutdown)
+	assert.NoError(t, p.TakeOver(old, time.Second, 5*time.Second))
+	assert.GreaterOrEqual(t, p.Stats().Listeners[0].Pool.Open, int64(2), "the pool is warm as it takes over")
+	pingSocket(t, p.localConfigHost)
+
+	// pools that can't warm up leave the running proxy in place
+	_ = node.li.Close()
+	next, err := NewProxy(zap.NewNop(), sd, cfg, changed)
+	assert.NoError(t, err)
+	err = next.TakeOver(p, time.Second, 100*time.Millisecond)
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "taking over "+node.Address()+": pools not warm after 100ms: "), err.Error())
+	}
+	assert.Len(t, p.Sockets(), 1)
+}
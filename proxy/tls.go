@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/metrics"
+)
+
+// upstreamTLSConfig loads the CAs the upstream's certificate is verified with and
+// the certificate the proxy authenticates with, if they are configured, or
+// returns nil if upstream connections are plaintext
+func upstreamTLSConfig(t config.TLS) (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream TLS: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("upstream TLS: no certificates in " + t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream TLS: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// dialUpstream dials a new upstream connection, and, if the upstream is served
+// over TLS, completes the handshake within timeout. Without a tlsservername,
+// the certificate is verified for the host dialed, or, if that is an IP, such
+// as a cluster node's, for the host of the upstream URL.
+func (p *Proxy) dialUpstream(ctx context.Context, dlr *familyDialer, sdWith *statsd.Client, network, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := dlr.DialContext(ctx, network, address)
+	if err != nil || p.tls == nil {
+		return conn, err
+	}
+	cfg := p.tls
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = p.serverName(address)
+	}
+	start := time.Now()
+	tconn := tls.Client(conn, cfg)
+	deadline := start.Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = tconn.SetDeadline(deadline); err == nil {
+		err = tconn.Handshake()
+	}
+	metrics.UpstreamTLSHandshake.Record(sdWith, time.Since(start), strconv.FormatBool(err == nil))
+	if err != nil {
+		_ = conn.Close()
+		return nil, &ConnectError{Stage: ConnectTLS, Err: fmt.Errorf("TLS handshake with %s: %w", address, err)}
+	}
+	_ = tconn.SetDeadline(time.Time{})
+	return tconn, nil
+}
+
+func (p *Proxy) serverName(address string) string {
+	for _, a := range []string{address, p.upstreamConfigHost} {
+		if host, _, err := net.SplitHostPort(a); err == nil && net.ParseIP(host) == nil {
+			return host
+		}
+	}
+	host, _, _ := net.SplitHostPort(address)
+	return host
+}
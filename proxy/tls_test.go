@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and its key
+// to dir, returning their paths
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pemBytes, err := ioutil.ReadFile(certFile)
+	assert.NoError(t, err)
+	pool.AppendCertsFromPEM(pemBytes)
+	li, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	assert.NoError(t, err)
+	s := serveAuth(t, li)
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	newProxy := func(c config.TLS) *Proxy {
+		p, err := NewProxy(zap.NewNop(), sd, &config.Config{Network: "unix", LocalSocketPrefix: dir + "/rb-", LocalSocketSuffix: ".sock"}, &config.Upstream{
+			UpstreamConfigHost: s.Address(),
+			Database:           -1,
+			MaxPoolSize:        1,
+			ReadTimeout:        time.Second,
+			WriteTimeout:       time.Second,
+			Credentials:        config.Credentials{User: "proxy", Password: "s3cret"},
+			TLS:                c,
+		})
+		assert.NoError(t, err)
+		return p
+	}
+
+	// connections are authenticated over TLS, with a client certificate too
+	assert.NoError(t, newProxy(config.TLS{Enabled: true, CAFile: certFile}).Check())
+	assert.NoError(t, newProxy(config.TLS{Enabled: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile}).Check())
+	assert.NoError(t, newProxy(config.TLS{Enabled: true, InsecureSkipVerify: true}).Check())
+	assert.Equal(t, []string{"AUTH proxy s3cret", "PING", "AUTH proxy s3cret", "PING", "AUTH proxy s3cret", "PING"}, s.Commands())
+
+	err = newProxy(config.TLS{Enabled: true}).Check()
+	assert.Error(t, err, "the upstream's certificate isn't signed by a system CA")
+	assert.Contains(t, err.Error(), "TLS handshake with "+s.Address())
+	err = newProxy(config.TLS{Enabled: true, CAFile: certFile, ServerName: "redis.example.com"}).Check()
+	assert.Error(t, err, "the upstream's certificate isn't for the server name")
+
+	_, err = NewProxy(zap.NewNop(), sd, &config.Config{}, &config.Upstream{TLS: config.TLS{Enabled: true, CAFile: keyFile}})
+	assert.EqualError(t, err, "upstream TLS: no certificates in "+keyFile)
+}
+
+func TestServerName(t *testing.T) {
+	p := &Proxy{upstreamConfigHost: "cache.example.com:6379"}
+	assert.Equal(t, "node.example.com", p.serverName("node.example.com:6379"))
+	assert.Equal(t, "cache.example.com", p.serverName("10.0.0.1:6379"), "a cluster node dialed by IP")
+	p.upstreamConfigHost = "10.0.0.2:6379"
+	assert.Equal(t, "10.0.0.1", p.serverName("10.0.0.1:6379"))
+}
@@ -0,0 +1,428 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/netaddr"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// minTopologyRefresh is the shortest time between two refreshes, so that a burst
+// of MOVED errors costs a single CLUSTER SLOTS
+const minTopologyRefresh = 100 * time.Millisecond
+
+// topologyTimeout bounds every request made to the shared key or a peer, so that
+// coordination being unavailable only ever delays coordination itself
+const topologyTimeout = time.Second
+
+// casTopology sets the shared key to ARGV[2] unless it already holds a topology
+// of version ARGV[1] or later, so that the first instance to see a topology is
+// the one that writes it
+const casTopology = `local cur = redis.call('GET', KEYS[1])
+if cur then
+  local ok, t = pcall(cjson.decode, cur)
+  if ok and type(t) == 'table' and tonumber(t.version) and tonumber(t.version) >= tonumber(ARGV[1]) then
+    return 0
+  end
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 1`
+
+// Topology is a cluster's slot map as shared between instances: the slot ranges
+// of each node, versioned by the instance that saw the map first. Cluster is the
+// name of the proxy, so instances must give an upstream the same label.
+type Topology struct {
+	Cluster string            `json:"cluster"`
+	Version uint64            `json:"version"`
+	Slots   map[string]string `json:"slots"`
+}
+
+// TopologyStats is the topology version a proxy uses, and the newest one other
+// instances have shared with it
+type TopologyStats struct {
+	Version uint64 `json:"version"`
+	Newest  uint64 `json:"newest_seen"`
+}
+
+// coordinator shares the topology a proxy sees with the other instances in front
+// of the same cluster, and refreshes it when they see a newer one. Everything it
+// does is best effort and off the request path: serving never waits on it, and
+// without it the proxy behaves exactly as it does when coordination is off.
+type coordinator struct {
+	p       *Proxy
+	key     string
+	peers   []string
+	poll    time.Duration
+	client  *http.Client
+	refresh chan string
+	// token is the admin token peers are sent, started as they are with the
+	// same -admintoken
+	token string
+
+	mu sync.Mutex
+	// current is the topology the proxy uses, newest the newest shared with it
+	current Topology
+	newest  Topology
+}
+
+func newCoordinator(p *Proxy, cfg config.Topology) *coordinator {
+	return &coordinator{
+		p:       p,
+		key:     cfg.Key,
+		peers:   cfg.Peers,
+		poll:    cfg.Poll,
+		client:  &http.Client{Timeout: topologyTimeout},
+		refresh: make(chan string, 1),
+		token:   p.config.AdminAuth.Token,
+	}
+}
+
+// trigger asks for a refresh of the topology, without waiting for it
+func (c *coordinator) trigger(reason string) {
+	if c == nil {
+		return
+	}
+	select {
+	case c.refresh <- reason:
+	default:
+	}
+}
+
+func (c *coordinator) run(quit chan interface{}) {
+	var poll <-chan time.Time
+	if c.key != "" {
+		t := time.NewTicker(c.poll)
+		defer t.Stop()
+		poll = t.C
+	}
+	var last time.Time
+	for {
+		select {
+		case <-quit:
+			return
+		case <-poll:
+			c.pollKey()
+		case trigger := <-c.refresh:
+			if wait := minTopologyRefresh - time.Since(last); wait > 0 {
+				select {
+				case <-quit:
+					return
+				case <-time.After(wait):
+				}
+			}
+			// a refresh asked for while waiting is covered by this one
+			select {
+			case <-c.refresh:
+			default:
+			}
+			c.p.refreshTopology(trigger)
+			last = time.Now()
+		}
+	}
+}
+
+// observe versions the slots the proxy has just seen. Slots matching the newest
+// topology shared by another instance take its version, and any others are a new
+// version, which is shared with the other instances.
+func (c *coordinator) observe(slots map[string]string) {
+	if c == nil || len(slots) == 0 {
+		return
+	}
+	c.mu.Lock()
+	if reflect.DeepEqual(slots, c.current.Slots) {
+		c.mu.Unlock()
+		return
+	}
+	publish := true
+	if c.newest.Version > c.current.Version && reflect.DeepEqual(slots, c.newest.Slots) {
+		c.current = c.newest
+		publish = false
+	} else {
+		version := c.current.Version
+		if c.newest.Version > version {
+			version = c.newest.Version
+		}
+		c.current = Topology{Cluster: c.p.Name(), Version: version + 1, Slots: slots}
+	}
+	t := c.current
+	c.mu.Unlock()
+	if publish {
+		go c.publish(t)
+	}
+}
+
+// receive takes a topology shared by another instance. A newer one is applied
+// right away, creating listeners for its nodes, and then checked with a refresh
+// of the proxy's own.
+func (c *coordinator) receive(t Topology, source string) {
+	slots := make(map[string]string, len(t.Slots))
+	for node, ranges := range t.Slots {
+		addr, err := netaddr.Normalize(node)
+		if err != nil {
+			c.p.log.Warn("Ignoring a shared topology with an invalid node", zap.String("source", source), zap.String("node", node), zap.Error(err))
+			return
+		}
+		slots[addr] = ranges
+	}
+	t.Slots = slots
+
+	c.mu.Lock()
+	newer := t.Version > c.current.Version
+	if t.Version > c.newest.Version {
+		c.newest = t
+	}
+	apply := newer && !reflect.DeepEqual(slots, c.current.Slots)
+	if newer && !apply {
+		// the same slots, seen first by another instance
+		c.current = t
+	}
+	c.mu.Unlock()
+	metrics.TopologyReceived.Incr(c.p.statsd, source, strconv.FormatBool(newer))
+	if !apply {
+		return
+	}
+	c.p.log.Info("Applying a newer topology shared by another instance", zap.String("source", source), zap.Uint64("version", t.Version))
+	for addr := range slots {
+		c.p.ensureListenerForUpstream(addr, "topology from "+source)
+	}
+	c.p.setSlots(slots)
+	c.trigger(source)
+}
+
+func (c *coordinator) stats() *TopologyStats {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &TopologyStats{Version: c.current.Version, Newest: c.newest.Version}
+	if s.Newest < s.Version {
+		s.Newest = s.Version
+	}
+	return s
+}
+
+// publish shares a topology through the shared key, unless the upstream is
+// read-only, and with every peer
+func (c *coordinator) publish(t Topology) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return
+	}
+	if c.key != "" && !c.p.readOnly.Enabled() {
+		res, err := c.keyCommand("EVAL", casTopology, "1", c.key, strconv.FormatUint(t.Version, 10), string(b))
+		if err == nil && res.IsError() {
+			err = errors.New(string(res.Value))
+		}
+		metrics.TopologyPublished.Incr(c.p.statsd, "key", strconv.FormatBool(err == nil))
+		if err != nil {
+			c.p.log.Warn("Failed to share the topology through the shared key", zap.String("key", c.key), zap.Error(err))
+		}
+	}
+	var wg sync.WaitGroup
+	for _, peer := range c.peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			err := c.put(peer, b)
+			metrics.TopologyPublished.Incr(c.p.statsd, "peer", strconv.FormatBool(err == nil))
+			if err != nil {
+				c.p.log.Warn("Failed to share the topology with a peer", zap.String("peer", peer), zap.Error(err))
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (c *coordinator) put(peer string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPut, "http://"+peer+"/topology", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("peer returned " + resp.Status)
+	}
+	return nil
+}
+
+// pollKey reads the shared key, which is how the other instances' topologies
+// are watched
+func (c *coordinator) pollKey() {
+	res, err := c.keyCommand("GET", c.key)
+	if err != nil {
+		c.p.log.Debug("Failed to read the shared topology key", zap.String("key", c.key), zap.Error(err))
+		return
+	}
+	if !res.IsBulkBytes() || res.Value == nil {
+		return
+	}
+	var t Topology
+	if err := json.Unmarshal(res.Value, &t); err != nil {
+		c.p.log.Warn("Ignoring an unparseable shared topology", zap.String("key", c.key), zap.Error(err))
+		return
+	}
+	c.receive(t, "key")
+}
+
+// keyCommand sends a command about the shared key to the node serving it, as far
+// as the proxy knows, or else to the configured upstream. A MOVED reply is
+// handled like one sent to a client.
+func (c *coordinator) keyCommand(args ...string) (*redis.Message, error) {
+	s := c.p.server(c.p.slotNode(redis.KeySlot([]byte(c.key))))
+	if s == nil {
+		s = c.p.server(c.p.upstreamConfigHost)
+	}
+	res, err := c.p.command(s, args...)
+	if err == nil {
+		c.p.interceptMessages([]string{args[0]}, []*redis.Message{res})
+	}
+	return res, err
+}
+
+// refreshTopology reads the topology with CLUSTER SLOTS, from the configured
+// upstream or else any node the proxy listens for
+func (p *Proxy) refreshTopology(trigger string) {
+	start := time.Now()
+	err := errors.New("no listener to refresh the topology through")
+	for _, s := range p.servers() {
+		var res *redis.Message
+		if res, err = p.command(s, "CLUSTER", "SLOTS"); err == nil && res.IsError() {
+			err = errors.New(string(res.Value))
+		}
+		if err == nil {
+			err = p.observeClusterSlots(res, "CLUSTER SLOTS refresh")
+		}
+		if err == nil {
+			break
+		}
+	}
+	metrics.TopologyRefresh.Record(p.statsd, time.Since(start), trigger, strconv.FormatBool(err == nil))
+	if err != nil {
+		p.log.Warn("Failed to refresh the cluster topology", zap.String("trigger", trigger), zap.Error(err))
+	}
+}
+
+// reportTopology emits the topology version and its skew from the newest version
+// other instances have shared once a second until the proxy shuts down
+func (p *Proxy) reportTopology() {
+	p.schedule(func() {
+		s := p.topology.stats()
+		metrics.TopologyVersion.Set(p.statsd, float64(s.Version))
+		metrics.TopologyVersionSkew.Set(p.statsd, float64(s.Newest-s.Version))
+	})
+}
+
+// server returns the pool of the listener for an upstream, if there is one
+func (p *Proxy) server(upstream string) *pool.Server {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	if l, ok := p.listeners[upstream]; ok {
+		return l.server
+	}
+	return nil
+}
+
+// localFor returns the local address of the listener for an upstream, if there
+// is one
+func (p *Proxy) localFor(upstream string) (string, bool) {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	if l, ok := p.listeners[upstream]; ok {
+		return l.local, true
+	}
+	return "", false
+}
+
+// servers returns the pools of every listener, the configured upstream's first
+func (p *Proxy) servers() []*pool.Server {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	var servers []*pool.Server
+	if l, ok := p.listeners[p.upstreamConfigHost]; ok {
+		servers = append(servers, l.server)
+	}
+	for upstream, l := range p.listeners {
+		if upstream != p.upstreamConfigHost {
+			servers = append(servers, l.server)
+		}
+	}
+	return servers
+}
+
+// command sends a command of the proxy's own to an upstream
+func (p *Proxy) command(s *pool.Server, args ...string) (*redis.Message, error) {
+	if s == nil {
+		return nil, errors.New("no listener for the upstream")
+	}
+	timeout := p.readTimeout + p.writeTimeout
+	if timeout > topologyTimeout {
+		timeout = topologyTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	mm := make([]*redis.Message, len(args))
+	for i, a := range args {
+		mm[i] = redis.NewBulkBytes([]byte(a))
+	}
+	res, err := handlers.Exchange(ctx, p.log, s, []*redis.Message{redis.NewArray(mm)}, p.readTimeout, p.writeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return res[0], nil
+}
+
+// TopologyHandler serves the topology versions of proxies for GET /topology, and
+// takes the topologies peers share for PUT /topology
+func TopologyHandler(proxies []*Proxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			topologies := make(map[string]*TopologyStats)
+			for _, p := range proxies {
+				if s := p.topology.stats(); s != nil {
+					topologies[p.Name()] = s
+				}
+			}
+			admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"topologies": topologies})
+		case http.MethodPut, http.MethodPost:
+			var t Topology
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&t); err != nil {
+				admin.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid topology: " + err.Error()})
+				return
+			}
+			for _, p := range proxies {
+				if p.Name() == t.Cluster && p.topology != nil {
+					p.topology.receive(t, "peer")
+					admin.WriteJSON(w, http.StatusOK, p.topology.stats())
+					return
+				}
+			}
+			admin.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "no coordinated upstream " + t.Cluster})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeNode is a cluster node whose CLUSTER SLOTS reply can be changed, and which
+// stores a single key for GET and the compare-and-set script
+type fakeNode struct {
+	li net.Listener
+
+	sync.Mutex
+	split int
+	other string
+	key   []byte
+}
+
+func newFakeNode(t *testing.T) *fakeNode {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	n := &fakeNode{li: li, split: 8191, other: "127.0.0.1:1"}
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = li.Close() })
+	return n
+}
+
+func (n *fakeNode) Address() string {
+	return n.li.Addr().String()
+}
+
+// reshard moves the slots after split to the other node
+func (n *fakeNode) reshard(split int) {
+	n.Lock()
+	defer n.Unlock()
+	n.split = split
+}
+
+func (n *fakeNode) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	d := redis.NewDecoder(conn)
+	for {
+		m, err := d.Decode()
+		if err != nil {
+			return
+		}
+		args := make([]string, len(m.Array))
+		for i, a := range m.Array {
+			args[i] = string(a.Value)
+		}
+		if err := redis.Encode(conn, n.handle(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (n *fakeNode) handle(args []string) *redis.Message {
+	n.Lock()
+	defer n.Unlock()
+	node := func(addr string) *redis.Message {
+		host, port, _ := net.SplitHostPort(addr)
+		return redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte(host)), redis.NewInt([]byte(port))})
+	}
+	switch strings.ToUpper(args[0]) {
+	case "CLUSTER":
+		return redis.NewArray([]*redis.Message{
+			redis.NewArray([]*redis.Message{redis.NewInt([]byte("0")), redis.NewInt([]byte(strconv.Itoa(n.split))), node(n.Address())}),
+			redis.NewArray([]*redis.Message{redis.NewInt([]byte(strconv.Itoa(n.split + 1))), redis.NewInt([]byte("16383")), node(n.other)}),
+		})
+	case "GET":
+		return redis.NewBulkBytes(n.key)
+	case "EVAL":
+		var stored, t Topology
+		_ = json.Unmarshal(n.key, &stored)
+		_ = json.Unmarshal([]byte(args[5]), &t)
+		if n.key != nil && stored.Version >= t.Version {
+			return redis.NewInt([]byte("0"))
+		}
+		n.key = []byte(args[5])
+		return redis.NewInt([]byte("1"))
+	}
+	return redis.NewString([]byte("OK"))
+}
+
+func newCoordinatedProxy(t *testing.T, upstream string, topology config.Topology) *Proxy {
+	dir, err := ioutil.TempDir("", "topology")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(dir, "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{
+		UpstreamConfigHost: upstream,
+		Label:              "cache",
+		Database:           -1,
+		MaxPoolSize:        2,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+		Topology:           topology,
+	})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool { return p.server(upstream) != nil }, time.Second, time.Millisecond)
+	return p
+}
+
+func topologyStats(p *Proxy) TopologyStats {
+	return *p.Stats().Topology
+}
+
+func TestTopologyPeers(t *testing.T) {
+	node := newFakeNode(t)
+	// the admin servers of the two instances, which exist before the proxies do
+	var a, b *Proxy
+	adminA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		TopologyHandler([]*Proxy{a}).ServeHTTP(w, r)
+	}))
+	defer adminA.Close()
+	adminB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		TopologyHandler([]*Proxy{b}).ServeHTTP(w, r)
+	}))
+	defer adminB.Close()
+	peer := func(s *httptest.Server) string { return strings.TrimPrefix(s.URL, "http://") }
+
+	// a peer that is down doesn't keep the others from being told
+	a = newCoordinatedProxy(t, node.Address(), config.Topology{Peers: []string{"127.0.0.1:1", peer(adminB)}})
+	b = newCoordinatedProxy(t, node.Address(), config.Topology{Peers: []string{peer(adminA)}})
+	assert.Equal(t, TopologyStats{}, topologyStats(b))
+
+	// a MOVED seen by one instance refreshes its topology, and then the other's
+	a.interceptMessages([]string{"GET"}, []*redis.Message{redis.NewError([]byte("MOVED 3999 " + node.Address()))})
+	assert.Eventually(t, func() bool { return topologyStats(b) == TopologyStats{Version: 1, Newest: 1} }, 2*time.Second, time.Millisecond)
+	assert.Equal(t, TopologyStats{Version: 1, Newest: 1}, topologyStats(a))
+	assert.Equal(t, "8192-16383", b.slotRanges("127.0.0.1:1"))
+	assert.NotNil(t, b.server("127.0.0.1:1"), "the other instance listens for every node of the shared topology")
+
+	node.reshard(4095)
+	b.interceptMessages([]string{"GET"}, []*redis.Message{redis.NewError([]byte("MOVED 5000 127.0.0.1:1"))})
+	assert.Eventually(t, func() bool { return a.slotRanges("127.0.0.1:1") == "4096-16383" }, 2*time.Second, time.Millisecond)
+	assert.Equal(t, TopologyStats{Version: 2, Newest: 2}, topologyStats(a))
+	assert.Equal(t, TopologyStats{Version: 2, Newest: 2}, topologyStats(b))
+
+	// a topology older than the proxy's is counted but not applied
+	resp, err := http.Post(adminA.URL, "application/json", strings.NewReader(`{"cluster": "cache", "version": 1, "slots": {"127.0.0.1:2": "0-16383"}}`))
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "4096-16383", a.slotRanges("127.0.0.1:1"))
+
+	resp, err = http.Post(adminA.URL, "application/json", strings.NewReader(`{"cluster": "other", "version": 9}`))
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestTopologySharedKey(t *testing.T) {
+	node := newFakeNode(t)
+	cfg := config.Topology{Key: "redisbetween:topology", Poll: 10 * time.Millisecond}
+	a := newCoordinatedProxy(t, node.Address(), cfg)
+	b := newCoordinatedProxy(t, node.Address(), cfg)
+
+	// a client's CLUSTER SLOTS shows a the topology, which it writes to the key
+	res, err := a.command(a.server(node.Address()), "CLUSTER", "SLOTS")
+	assert.NoError(t, err)
+	a.interceptMessages([]string{"CLUSTER SLOTS"}, []*redis.Message{res})
+	assert.Equal(t, TopologyStats{Version: 1, Newest: 1}, topologyStats(a))
+	assert.Eventually(t, func() bool { return topologyStats(b) == TopologyStats{Version: 1, Newest: 1} }, 2*time.Second, time.Millisecond)
+	assert.Equal(t, "0-8191", b.slotRanges(node.Address()))
+
+	var stored Topology
+	node.Lock()
+	assert.NoError(t, json.Unmarshal(node.key, &stored))
+	node.Unlock()
+	assert.Equal(t, Topology{Cluster: "cache", Version: 1, Slots: map[string]string{node.Address(): "0-8191", "127.0.0.1:1": "8192-16383"}}, stored)
+}
+
+func TestTopologyWithoutCoordination(t *testing.T) {
+	p, err := NewProxy(zap.NewNop(), nil, &config.Config{}, &config.Upstream{UpstreamConfigHost: "127.0.0.1:7000", Database: -1})
+	assert.NoError(t, err)
+	p.topology.trigger("moved")
+	p.setSlots(map[string]string{"127.0.0.1:7000": "0-16383"})
+	assert.Nil(t, p.Stats().Topology)
+	assert.Equal(t, "127.0.0.1:7000", p.slotNode(redis.KeySlot([]byte("a"))))
+	assert.Equal(t, "", p.slotNode(redis.SlotCount))
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/handlers"
+)
+
+// defaultTraces is how many traces /traces lists when not asked for a number
+const defaultTraces = 100
+
+// TracesHandler serves the routing traces of proxies: the one with a given ID for
+// /traces?id=<id>, or the most recent for /traces?limit=<n>
+func TracesHandler(proxies []*Proxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if id := q.Get("id"); id != "" {
+			n, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				admin.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id: " + id})
+				return
+			}
+			for _, p := range proxies {
+				if tr, ok := p.tracer.Get(n); ok {
+					admin.WriteJSON(w, http.StatusOK, tr)
+					return
+				}
+			}
+			admin.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "no trace " + id})
+			return
+		}
+
+		limit := defaultTraces
+		if l := q.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 {
+				admin.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit: " + l})
+				return
+			}
+			limit = n
+		}
+		var traces []handlers.Trace
+		for _, p := range proxies {
+			traces = append(traces, p.tracer.Recent(limit)...)
+		}
+		sort.Slice(traces, func(i, j int) bool { return traces[i].ID > traces[j].ID })
+		if len(traces) > limit {
+			traces = traces[:limit]
+		}
+		admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"traces": traces})
+	})
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracesHandler(t *testing.T) {
+	h := TracesHandler([]*Proxy{{tracer: handlers.NewTracer(0, 10)}, {}})
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+	w := get("/traces")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"traces": null}`, w.Body.String())
+	assert.Equal(t, http.StatusNotFound, get("/traces?id=5").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/traces?id=five").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/traces?limit=0").Code)
+}
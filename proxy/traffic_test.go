@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/handlers"
+	redisproto "github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// statsdCounts sums the counters sent to a fake statsd server, by name
+type statsdCounts struct {
+	sync.Mutex
+	counts map[string]int64
+}
+
+func listenStatsd(t *testing.T) (string, *statsdCounts) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	sc := &statsdCounts{counts: make(map[string]int64)}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				// name:value|c|#tags
+				parts := strings.Split(line, "|")
+				if len(parts) < 2 || parts[1] != "c" {
+					continue
+				}
+				i := strings.LastIndex(parts[0], ":")
+				v, err := strconv.ParseInt(parts[0][i+1:], 10, 64)
+				if i < 0 || err != nil {
+					continue
+				}
+				sc.Lock()
+				sc.counts[parts[0][:i]] += v
+				sc.Unlock()
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), sc
+}
+
+func (sc *statsdCounts) get(name string) int64 {
+	sc.Lock()
+	defer sc.Unlock()
+	return sc.counts[name]
+}
+
+func TestTrafficCountsAgree(t *testing.T) {
+	addr, counts := listenStatsd(t)
+	sd, err := statsd.New(addr, statsd.WithoutTelemetry())
+	assert.NoError(t, err)
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{
+		UpstreamConfigHost: node.Address(),
+		Database:           -1,
+		MaxPoolSize:        4,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+	})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	defer p.Shutdown()
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(p.localConfigHost)
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	conn, err := net.Dial("unix", p.localConfigHost)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	dec := redisproto.NewDecoder(conn)
+	replies := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := dec.Decode()
+			assert.NoError(t, err)
+		}
+	}
+
+	// three single commands, one at a time
+	for _, k := range []string{"a", "b", "c"} {
+		writeCommand(t, conn, "SET", k, "v")
+		replies(1)
+	}
+	// pipelines between the signals are one request each, of all their commands
+	for _, keys := range [][]string{{"a", "b", "c", "d", "e"}, {"a", "b"}} {
+		writeCommand(t, conn, "GET", string(handlers.PipelineSignalStartKey))
+		for _, k := range keys {
+			writeCommand(t, conn, "GET", k)
+		}
+		writeCommand(t, conn, "GET", string(handlers.PipelineSignalEndKey))
+		replies(len(keys) + 2)
+	}
+
+	const requests, commands = 3 + 1 + 1, 3 + 5 + 2
+
+	s := p.Stats()
+	assert.EqualValues(t, requests, s.Requests)
+	assert.EqualValues(t, commands, s.Commands)
+	assert.EqualValues(t, 1, s.Connections)
+	assert.Equal(t, handlers.TrafficStats{Requests: requests, Commands: commands, Connections: 1}, s.Listeners[0].TrafficStats)
+
+	a := admin.New(zap.NewNop(), "127.0.0.1:0", admin.Options{})
+	a.HandleJSON("/stats", func() interface{} { return p.Stats() })
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = a.Serve(li) }()
+	defer func() { _ = a.Close() }()
+	res, err := http.Get("http://" + li.Addr().String() + "/stats")
+	assert.NoError(t, err)
+	var served struct {
+		Requests  int64 `json:"requests"`
+		Commands  int64 `json:"commands"`
+		Listeners []struct {
+			Requests int64 `json:"requests"`
+			Commands int64 `json:"commands"`
+		} `json:"listeners"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&served))
+	_ = res.Body.Close()
+	assert.EqualValues(t, requests, served.Requests)
+	assert.EqualValues(t, commands, served.Commands)
+	assert.EqualValues(t, requests, served.Listeners[0].Requests)
+	assert.EqualValues(t, commands, served.Listeners[0].Commands)
+
+	assert.Eventually(t, func() bool {
+		return counts.get("requests") == requests && counts.get("commands") == commands
+	}, 2*time.Second, 10*time.Millisecond, "statsd counts %d requests and %d commands", counts.get("requests"), counts.get("commands"))
+}
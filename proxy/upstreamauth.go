@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// UpstreamAuthError is an upstream rejecting the AUTH, the HELLO or the SELECT
+// a new connection is prepared with
+type UpstreamAuthError struct {
+	Upstream string
+	Command  string
+	Reply    string
+}
+
+func (e *UpstreamAuthError) Error() string {
+	return fmt.Sprintf("upstream %s rejected the proxy's %s: %s", e.Upstream, e.Command, e.Reply)
+}
+
+// reason is the first word of the upstream's error, which metrics are tagged by
+func (e *UpstreamAuthError) reason() string {
+	if i := strings.IndexByte(e.Reply, ' '); i > 0 {
+		return strings.ToLower(e.Reply[:i])
+	}
+	return strings.ToLower(e.Reply)
+}
+
+// prepareConn authenticates a new upstream connection, if there are credentials,
+// switches it to RESP3 if resp3 is set, and selects its db, if there is one,
+// before it joins a pool, so that every connection handed to a client is ready
+// to be used by it. AUTH, HELLO and SELECT are pipelined, the first error the
+// upstream answers with being returned.
+func prepareConn(conn net.Conn, upstream string, credentials config.Credentials, db int, resp3 bool, timeout time.Duration) error {
+	var cmds [][]string
+	if credentials.Enabled() {
+		auth := []string{"AUTH", credentials.Password}
+		if credentials.User != "" {
+			auth = []string{"AUTH", credentials.User, credentials.Password}
+		}
+		cmds = append(cmds, auth)
+	}
+	if resp3 {
+		cmds = append(cmds, []string{"HELLO", "3"})
+	}
+	if db >= 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(db)})
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+	enc := redis.NewEncoder(conn)
+	for i, cmd := range cmds {
+		mm := make([]*redis.Message, len(cmd))
+		for j, a := range cmd {
+			mm[j] = redis.NewBulkBytes([]byte(a))
+		}
+		if err := enc.Encode(redis.NewArray(mm), i == len(cmds)-1); err != nil {
+			return err
+		}
+	}
+	d := redis.NewDecoder(conn)
+	var rejected error
+	for _, cmd := range cmds {
+		// the reply of HELLO 3 is a RESP3 map
+		res, err := d.DecodeFrame()
+		if err != nil {
+			return err
+		}
+		if res.IsError() && rejected == nil {
+			rejected = &UpstreamAuthError{Upstream: upstream, Command: cmd[0], Reply: string(res.Value)}
+		}
+	}
+	return rejected
+}
+
+// authFailed records a new connection the upstream rejected
+func authFailed(logWith *zap.Logger, sdWith *statsd.Client, err error) {
+	var authErr *UpstreamAuthError
+	if !errors.As(err, &authErr) {
+		return
+	}
+	metrics.UpstreamAuthFailures.Incr(sdWith, authErr.reason())
+	logWith.Error("Upstream rejected a new connection", zap.Error(err))
+}
+
+// checkCredentials dials the upstream once before a listener's pools are made,
+// so that credentials it rejects fail the listener with why, rather than every
+// pooled connection failing in the background and clients getting NOAUTH. An
+// upstream that can't be reached is left to the pools, which keep dialing.
+func (p *Proxy) checkCredentials(logWith *zap.Logger, sdWith *statsd.Client, upstream string) error {
+	if !p.credentials.Enabled() {
+		return nil
+	}
+	timeout := p.readTimeout + p.writeTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := p.dialUpstream(ctx, newFamilyDialer(logWith, sdWith, timeout), sdWith, "tcp", upstream, timeout)
+	if err != nil {
+		ce := connectFailed(sdWith, err)
+		logWith.Warn("Failed to connect to check the upstream credentials", zap.String("stage", string(ce.Stage)), zap.Error(ce.Err))
+		return nil
+	}
+	defer func() { _ = conn.Close() }()
+	err = prepareConn(conn, upstream, p.credentials, p.database, false, timeout)
+	if err == nil {
+		return nil
+	}
+	ce := connectFailed(sdWith, err)
+	var authErr *UpstreamAuthError
+	if errors.As(err, &authErr) {
+		authFailed(logWith, sdWith, err)
+		return ce
+	}
+	logWith.Warn("Failed to check the upstream credentials", zap.String("stage", string(ce.Stage)), zap.Error(ce.Err))
+	return nil
+}
+
+// checkRESP3 dials the upstream once before the RESP3 pool of a listener is
+// made, returning whether the upstream speaks RESP3. One that answers HELLO 3
+// with an error, as redis before 6 does, gets no RESP3 pool, its clients being
+// kept to RESP2. An upstream that can't be reached is assumed to speak it.
+func (p *Proxy) checkRESP3(logWith *zap.Logger, sdWith *statsd.Client, upstream string) bool {
+	timeout := p.readTimeout + p.writeTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := p.dialUpstream(ctx, newFamilyDialer(logWith, sdWith, timeout), sdWith, "tcp", upstream, timeout)
+	if err != nil {
+		return true
+	}
+	defer func() { _ = conn.Close() }()
+	err = prepareConn(conn, upstream, p.credentials, p.database, true, timeout)
+	var authErr *UpstreamAuthError
+	if errors.As(err, &authErr) && authErr.Command == "HELLO" {
+		connectFailed(sdWith, err)
+		logWith.Warn("Upstream doesn't speak RESP3, clients are kept to RESP2", zap.Error(err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// authServer is a redis that answers everything but AUTH with NOAUTH until a
+// connection authenticates as proxy:s3cret, recording the commands it gets. It
+// answers HELLO 3 with NOPROTO unless resp3 is set.
+type authServer struct {
+	li net.Listener
+
+	mu       sync.Mutex
+	commands []string
+	resp3    bool
+}
+
+func newAuthServer(t *testing.T) *authServer {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	return serveAuth(t, li)
+}
+
+func serveAuth(t *testing.T, li net.Listener) *authServer {
+	s := &authServer{li: li}
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = li.Close() })
+	return s
+}
+
+func (s *authServer) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	d := redis.NewDecoder(conn)
+	var authenticated bool
+	for {
+		m, err := d.Decode()
+		if err != nil {
+			return
+		}
+		args := make([]string, len(m.Array))
+		for i, a := range m.Array {
+			args[i] = string(a.Value)
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.Join(args, " "))
+		resp3 := s.resp3
+		s.mu.Unlock()
+		res := redis.NewString([]byte("OK"))
+		switch {
+		case strings.ToUpper(args[0]) == "AUTH":
+			authenticated = len(args) == 3 && args[1] == "proxy" && args[2] == "s3cret"
+			if !authenticated {
+				res = redis.NewErrorf("WRONGPASS invalid username-password pair or user is disabled.")
+			}
+		case !authenticated:
+			res = redis.NewErrorf("NOAUTH Authentication required.")
+		case strings.ToUpper(args[0]) == "PING":
+			res = redis.NewString([]byte("PONG"))
+		case strings.ToUpper(args[0]) == "HELLO" && !resp3:
+			res = redis.NewErrorf("NOPROTO sorry, this protocol version is not supported")
+		case strings.ToUpper(args[0]) == "HELLO":
+			res = &redis.Message{Type: redis.TypeMap, Array: []*redis.Message{redis.NewBulkBytes([]byte("proto")), redis.NewInt([]byte("3"))}}
+		}
+		if err := redis.Encode(conn, res); err != nil {
+			return
+		}
+	}
+}
+
+func (s *authServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *authServer) Address() string {
+	return s.li.Addr().String()
+}
+
+func TestPrepareConn(t *testing.T) {
+	s := newAuthServer(t)
+	prepare := func(credentials config.Credentials, db int) error {
+		conn, err := net.Dial("tcp", s.Address())
+		assert.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		return prepareConn(conn, s.Address(), credentials, db, false, time.Second)
+	}
+
+	assert.NoError(t, prepare(config.Credentials{User: "proxy", Password: "s3cret"}, 2))
+	assert.Equal(t, []string{"AUTH proxy s3cret", "SELECT 2"}, s.Commands())
+
+	err := prepare(config.Credentials{User: "proxy", Password: "wrong"}, 2)
+	assert.EqualError(t, err, "upstream "+s.Address()+" rejected the proxy's AUTH: WRONGPASS invalid username-password pair or user is disabled.")
+	assert.Equal(t, "wrongpass", err.(*UpstreamAuthError).reason())
+
+	err = prepare(config.Credentials{}, 2)
+	assert.EqualError(t, err, "upstream "+s.Address()+" rejected the proxy's SELECT: NOAUTH Authentication required.", "a failed SELECT fails the connection too")
+	assert.NoError(t, prepare(config.Credentials{}, -1), "nothing to prepare")
+	assert.Len(t, s.Commands(), 5)
+}
+
+func TestPrepareConnRESP3(t *testing.T) {
+	s := newAuthServer(t)
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, &config.Config{}, &config.Upstream{
+		UpstreamConfigHost: s.Address(),
+		Database:           2,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+		Credentials:        config.Credentials{User: "proxy", Password: "s3cret"},
+	})
+	assert.NoError(t, err)
+
+	assert.False(t, p.checkRESP3(zap.NewNop(), sd, s.Address()), "an upstream that answers HELLO 3 with NOPROTO")
+	assert.Equal(t, []string{"AUTH proxy s3cret", "HELLO 3", "SELECT 2"}, s.Commands())
+	conn, err := net.Dial("tcp", s.Address())
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	err = prepareConn(conn, s.Address(), p.credentials, 2, true, time.Second)
+	assert.Equal(t, ConnectHello, connectError(err).Stage)
+
+	s.mu.Lock()
+	s.resp3 = true
+	s.mu.Unlock()
+	assert.True(t, p.checkRESP3(zap.NewNop(), sd, s.Address()))
+	conn, err = net.Dial("tcp", s.Address())
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	assert.NoError(t, prepareConn(conn, s.Address(), p.credentials, 2, true, time.Second), "the map HELLO 3 replies with is read whole")
+}
+
+func TestUpstreamCredentials(t *testing.T) {
+	s := newAuthServer(t)
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	newProxy := func(credentials config.Credentials) *Proxy {
+		p, err := NewProxy(zap.NewNop(), sd, &config.Config{Network: "unix", LocalSocketPrefix: t.TempDir() + "/rb-", LocalSocketSuffix: ".sock"}, &config.Upstream{
+			UpstreamConfigHost: s.Address(),
+			Database:           -1,
+			MaxPoolSize:        1,
+			ReadTimeout:        time.Second,
+			WriteTimeout:       time.Second,
+			Credentials:        credentials,
+		})
+		assert.NoError(t, err)
+		return p
+	}
+
+	// pooled connections are authenticated before they are used
+	assert.NoError(t, newProxy(config.Credentials{User: "proxy", Password: "s3cret"}).Check())
+
+	err = newProxy(config.Credentials{User: "proxy", Password: "wrong"}).Run()
+	assert.EqualError(t, err, "init.auth_error: upstream "+s.Address()+" rejected the proxy's AUTH: WRONGPASS invalid username-password pair or user is disabled.", "rejected credentials fail the listener")
+
+	closed := newAuthServer(t)
+	_ = closed.li.Close()
+	p := newProxy(config.Credentials{User: "proxy", Password: "s3cret"})
+	assert.NoError(t, p.checkCredentials(zap.NewNop(), sd, closed.Address()), "an unreachable upstream is left to the pools")
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/handlers"
+)
+
+// ListenerWarnings are the warnings of a listener with warnings enabled
+type ListenerWarnings struct {
+	Upstream string `json:"upstream"`
+	Node     string `json:"node"`
+	*handlers.WarningsStats
+}
+
+// warningsRequest is a broadcast POST /warnings makes to the listeners of the
+// upstreams, or nodes, named, all of them if it names none
+type warningsRequest struct {
+	Upstreams []string `json:"upstreams"`
+	Type      string   `json:"type"`
+	Message   string   `json:"message"`
+	TTL       string   `json:"ttl"`
+}
+
+// broadcastWarning attaches w to the connections of the listeners with
+// warnings enabled of the upstreams or nodes named, that send a request within
+// ttl, returning the warnings of those listeners
+func broadcastWarning(proxies []*Proxy, names []string, w *handlers.Warning, ttl time.Duration) ([]ListenerWarnings, error) {
+	now := time.Now()
+	listeners := []ListenerWarnings{}
+	var broadcastErr error
+	err := eachListener(proxies, names, func(p *Proxy, l *upstreamListener) {
+		ws := l.options.Warnings
+		if ws == nil {
+			return
+		}
+		if w != nil && broadcastErr == nil {
+			broadcastErr = ws.Broadcast(*w, ttl, now)
+		}
+		listeners = append(listeners, ListenerWarnings{Upstream: p.Name(), Node: l.upstream, WarningsStats: ws.Stats()})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return listeners, broadcastErr
+}
+
+// WarningsHandler answers GET /warnings with the warnings of every listener
+// with warnings enabled, and POST /warnings, with a type, a message and a ttl,
+// by broadcasting the warning to the connections of the upstreams the body
+// names, all of them if it names none
+func WarningsHandler(proxies []*Proxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req warningsRequest
+		var warning *handlers.Warning
+		var ttl time.Duration
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				admin.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil {
+				admin.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid ttl: " + err.Error()})
+				return
+			}
+			warning = &handlers.Warning{Type: req.Type, Message: req.Message}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		listeners, err := broadcastWarning(proxies, req.Upstreams, warning, ttl)
+		switch {
+		case listeners == nil:
+			admin.WriteJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		case err != nil:
+			admin.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		default:
+			admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"listeners": listeners})
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func warningsRoute(t *testing.T, proxies []*Proxy, method, body string) (int, []ListenerWarnings) {
+	rec := httptest.NewRecorder()
+	WarningsHandler(proxies).ServeHTTP(rec, httptest.NewRequest(method, "/warnings", strings.NewReader(body)))
+	var res struct {
+		Listeners []ListenerWarnings `json:"listeners"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &res)
+	return rec.Code, res.Listeners
+}
+
+func TestWarningsHandler(t *testing.T) {
+	node := newDBNode(t)
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(t.TempDir(), "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{
+		UpstreamConfigHost: node.Address(),
+		Database:           -1,
+		MaxPoolSize:        4,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+		Warnings:           config.Warnings{Enabled: true, Interval: time.Minute},
+	})
+	assert.NoError(t, err)
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(p.localConfigHost)
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	code, listeners := warningsRoute(t, []*Proxy{p}, http.MethodPost, `{"upstreams": ["`+node.Address()+`"], "type": "maintenance", "message": "maintenance at 02:00 UTC", "ttl": "1h"}`)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, listeners, 1) && assert.Len(t, listeners[0].Broadcasts, 1) {
+		assert.Equal(t, node.Address(), listeners[0].Node)
+		assert.Equal(t, "maintenance", listeners[0].Broadcasts[0].Type)
+	}
+
+	client := setupStandaloneClient(t, p.localConfigHost)
+	assert.NoError(t, client.Set(context.Background(), "k", "v", 0).Err())
+	r, err := client.Do(context.Background(), "PROXY", "WARNINGS").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{[]interface{}{"maintenance", "maintenance at 02:00 UTC"}}, r)
+	assert.Equal(t, int64(1), p.Stats().Listeners[0].Warnings.Attached["maintenance"])
+
+	code, listeners = warningsRoute(t, []*Proxy{p}, http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, listeners, 1)
+
+	for body, want := range map[string]int{
+		`{"upstreams": ["10.0.0.1:6379"], "type": "maintenance", "message": "soon", "ttl": "1h"}`: http.StatusNotFound,
+		`{"type": "Maintenance!", "message": "soon", "ttl": "1h"}`:                                http.StatusBadRequest,
+		`{"type": "maintenance", "message": "soon", "ttl": "soon"}`:                               http.StatusBadRequest,
+		`{`: http.StatusBadRequest,
+	} {
+		code, _ := warningsRoute(t, []*Proxy{p}, http.MethodPost, body)
+		assert.Equal(t, want, code, body)
+	}
+	code, _ = warningsRoute(t, []*Proxy{p}, http.MethodDelete, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// heartbeat is PROXY PING, which the proxy answers itself
+var heartbeat = []byte("*2\r\n$5\r\nPROXY\r\n$4\r\nPING\r\n")
+
+// WatchdogOptions configures the watchdog. Every Interval, it connects to each
+// socket and sends a heartbeat, which fails if it isn't answered within
+// Timeout. After Failures failed heartbeats in a row on a socket, the process is
+// considered stalled, and exits with ExitCode unless it is 0.
+type WatchdogOptions struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Failures int
+	ExitCode int
+}
+
+// Watchdog detects a process that holds its sockets open but no longer answers
+// on them, through a stuck accept loop or a deadlocked handler, which nothing
+// outside the process notices since it is still alive
+type Watchdog struct {
+	log     *zap.Logger
+	sd      *statsd.Client
+	network string
+	opts    WatchdogOptions
+	proxies []*Proxy
+	exit    func(int)
+
+	mu       sync.Mutex
+	failures map[string]int
+	stalled  []string
+}
+
+func NewWatchdog(log *zap.Logger, sd *statsd.Client, network string, opts WatchdogOptions, proxies []*Proxy) *Watchdog {
+	return &Watchdog{
+		log:      log.With(zap.String("component", "watchdog")),
+		sd:       sd,
+		network:  network,
+		opts:     opts,
+		proxies:  proxies,
+		exit:     os.Exit,
+		failures: make(map[string]int),
+	}
+}
+
+// SetProxies replaces the proxies whose sockets are checked, after a reload
+func (w *Watchdog) SetProxies(proxies []*Proxy) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.proxies = proxies
+}
+
+// Run sends heartbeats until quit is closed
+func (w *Watchdog) Run(quit chan interface{}) {
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check sends a heartbeat to every socket at once, and updates the stall state
+// with their outcomes
+func (w *Watchdog) check() {
+	w.mu.Lock()
+	proxies := w.proxies
+	w.mu.Unlock()
+	var sockets []string
+	for _, p := range proxies {
+		for _, s := range p.Sockets() {
+			sockets = append(sockets, s.Local)
+		}
+	}
+	errs := make([]error, len(sockets))
+	var wg sync.WaitGroup
+	for i, local := range sockets {
+		wg.Add(1)
+		go func(i int, local string) {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = w.beat(local)
+			metrics.WatchdogHeartbeat.Record(w.sd, time.Since(start), strconv.FormatBool(errs[i] == nil))
+		}(i, local)
+	}
+	wg.Wait()
+
+	w.mu.Lock()
+	failures := make(map[string]int, len(sockets))
+	var stalled []string
+	for i, local := range sockets {
+		if errs[i] == nil {
+			continue
+		}
+		failures[local] = w.failures[local] + 1
+		w.log.Warn("Watchdog heartbeat failed", zap.String("local", local), zap.Int("failures", failures[local]), zap.Error(errs[i]))
+		if failures[local] >= w.opts.Failures {
+			stalled = append(stalled, local)
+		}
+	}
+	sort.Strings(stalled)
+	// sockets gone since are forgotten, so a node that left the cluster doesn't
+	// stay stalled
+	w.failures = failures
+	wasStalled := len(w.stalled) > 0
+	w.stalled = stalled
+	w.mu.Unlock()
+
+	if len(stalled) > 0 {
+		metrics.WatchdogStalled.Set(w.sd, 1)
+	} else {
+		metrics.WatchdogStalled.Set(w.sd, 0)
+	}
+	switch {
+	case len(stalled) > 0 && !wasStalled:
+		w.log.Error("Watchdog detected a stall, sockets are open but not answering",
+			zap.Strings("sockets", stalled), zap.Int("failures", w.opts.Failures), zap.String("goroutines", goroutineDump()))
+		if w.opts.ExitCode != 0 {
+			w.log.Error("Exiting so that the process is restarted", zap.Int("code", w.opts.ExitCode))
+			_ = w.log.Sync()
+			w.exit(w.opts.ExitCode)
+		}
+	case len(stalled) == 0 && wasStalled:
+		w.log.Info("Watchdog heartbeats are answered again")
+	}
+}
+
+// Stalled returns the sockets that failed too many heartbeats in a row
+func (w *Watchdog) Stalled() []string {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stalled
+}
+
+// beat connects to a socket and sends it a heartbeat, expecting PONG within the
+// timeout
+func (w *Watchdog) beat(local string) error {
+	return beat(w.network, local, w.opts.Timeout)
+}
+
+// beat sends a heartbeat to the socket at local, expecting PONG within timeout.
+// The connection is closed once answered, so after it was told apart from a
+// client's as it was accepted.
+func beat(network, local string, timeout time.Duration) error {
+	conn, err := dialHeartbeat(network, local, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(heartbeat); err != nil {
+		return err
+	}
+	m, err := redis.NewDecoder(conn).Decode()
+	if err != nil {
+		return err
+	}
+	if !m.IsString() || string(m.Value) != "PONG" {
+		return fmt.Errorf("unexpected heartbeat reply %s", m.String())
+	}
+	return nil
+}
+
+// HealthHandler answers GET /healthz with 200 once every proxy is listening, or
+// 503 while one is starting, the watchdog reports a stall, a listener was
+// drained through the admin server or a graceful shutdown is draining, along
+// with the drain report. With no watchdog, the
+// process is healthy from when it listens until it drains.
+func HealthHandler(w *Watchdog, d *DrainReport) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if s, ok := d.Status(); ok {
+			admin.WriteJSON(rw, http.StatusServiceUnavailable, map[string]interface{}{"status": "draining", "upstreams": s.Upstreams, "remaining_seconds": s.Remaining})
+			return
+		}
+		if drained := d.Drained(); len(drained) > 0 {
+			admin.WriteJSON(rw, http.StatusServiceUnavailable, map[string]interface{}{"status": "drained", "drained": drained})
+			return
+		}
+		if starting := d.Starting(); len(starting) > 0 {
+			admin.WriteJSON(rw, http.StatusServiceUnavailable, map[string]interface{}{"status": "starting", "starting": starting})
+			return
+		}
+		if stalled := w.Stalled(); len(stalled) > 0 {
+			admin.WriteJSON(rw, http.StatusServiceUnavailable, map[string]interface{}{"status": "stalled", "stalled": stalled})
+			return
+		}
+		admin.WriteJSON(rw, http.StatusOK, map[string]interface{}{"status": "ok"})
+	})
+}
+
+// Health is whether the process is healthy by the same measure as
+// HealthHandler, along with its status: ok, draining, drained, starting or
+// stalled
+func Health(w *Watchdog, d *DrainReport) (bool, string) {
+	if _, ok := d.Status(); ok {
+		return false, "draining"
+	}
+	if len(d.Drained()) > 0 {
+		return false, "drained"
+	}
+	if len(d.Starting()) > 0 {
+		return false, "starting"
+	}
+	if stalled := w.Stalled(); len(stalled) > 0 {
+		return false, "stalled"
+	}
+	return true, "ok"
+}
+
+func goroutineDump() string {
+	var b bytes.Buffer
+	_ = pprof.Lookup("goroutine").WriteTo(&b, 2)
+	return b.String()
+}
+
+// heartbeats are the client addresses of the watchdog's connections, so that
+// they are told apart from clients' as they are accepted: the path each one is
+// bound to for unix sockets, and the port for tcp
+var heartbeats sync.Map
+
+var heartbeatSeq uint64
+
+// dialHeartbeat connects to a socket from an address registered in heartbeats
+// before the connection is made, so that it is known by the time the listener
+// accepts it
+func dialHeartbeat(network, address string, timeout time.Duration) (net.Conn, error) {
+	if network == "unix" || network == "unixpacket" {
+		path := filepath.Join(os.TempDir(), fmt.Sprintf("redisbetween-watchdog-%d-%d.sock", os.Getpid(), atomic.AddUint64(&heartbeatSeq, 1)))
+		heartbeats.Store(path, true)
+		d := net.Dialer{Timeout: timeout, LocalAddr: &net.UnixAddr{Name: path, Net: network}}
+		conn, err := d.Dial(network, address)
+		if err != nil {
+			heartbeats.Delete(path)
+			_ = os.Remove(path)
+			return nil, err
+		}
+		return &heartbeatConn{Conn: conn, key: path, path: path}, nil
+	}
+
+	// the dialer may try several addresses, each from a socket of its own
+	var keys []string
+	d := net.Dialer{Timeout: timeout, Control: func(_, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			var key string
+			if key, err = bindHeartbeat(int(fd), address); err == nil {
+				keys = append(keys, key)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	conn, err := d.Dial(network, address)
+	for i, key := range keys {
+		if err != nil || i < len(keys)-1 {
+			heartbeats.Delete(key)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &heartbeatConn{Conn: conn, key: keys[len(keys)-1]}, nil
+}
+
+// bindHeartbeat binds a tcp socket to an ephemeral port ahead of its connect,
+// and registers the port
+func bindHeartbeat(fd int, address string) (string, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	var sa syscall.Sockaddr = &syscall.SockaddrInet6{}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		sa = &syscall.SockaddrInet4{}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return "", err
+	}
+	bound, err := syscall.Getsockname(fd)
+	if err != nil {
+		return "", err
+	}
+	var port int
+	switch a := bound.(type) {
+	case *syscall.SockaddrInet4:
+		port = a.Port
+	case *syscall.SockaddrInet6:
+		port = a.Port
+	}
+	key := ":" + strconv.Itoa(port)
+	heartbeats.Store(key, true)
+	return key, nil
+}
+
+// heartbeatConn forgets its address, and removes the path it was bound to, once
+// it is closed
+type heartbeatConn struct {
+	net.Conn
+	key  string
+	path string
+}
+
+func (c *heartbeatConn) Close() error {
+	err := c.Conn.Close()
+	heartbeats.Delete(c.key)
+	if c.path != "" {
+		_ = os.Remove(c.path)
+	}
+	return err
+}
+
+// isHeartbeat is whether an accepted connection is the watchdog's
+func isHeartbeat(conn net.Conn) bool {
+	var key string
+	switch a := conn.RemoteAddr().(type) {
+	case *net.UnixAddr:
+		key = a.Name
+	case *net.TCPAddr:
+		key = ":" + strconv.Itoa(a.Port)
+	}
+	if key == "" || key == ":0" {
+		return false
+	}
+	_, ok := heartbeats.Load(key)
+	return ok
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/auth"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func healthz(w *Watchdog, d *DrainReport) int {
+	rec := httptest.NewRecorder()
+	HealthHandler(w, d).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	return rec.Code
+}
+
+func TestWatchdog(t *testing.T) {
+	node := newDBNode(t)
+	dir := t.TempDir()
+	cfg := &config.Config{Network: "unix", LocalSocketPrefix: filepath.Join(dir, "rb-"), LocalSocketSuffix: ".sock", Unlink: true}
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, cfg, &config.Upstream{UpstreamConfigHost: node.Address(), MaxPoolSize: 4, ReadTimeout: time.Second, WriteTimeout: time.Second})
+	assert.NoError(t, err)
+	// heartbeats are exempt from the limits clients are held to
+	p.AuthenticateClients(auth.Static{"app": "secret"})
+	go func() { _ = p.Run() }()
+	t.Cleanup(p.Shutdown)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(p.localConfigHost)
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	w := NewWatchdog(zap.NewNop(), nil, "unix", WatchdogOptions{Interval: time.Second, Timeout: 100 * time.Millisecond, Failures: 2, ExitCode: 70}, []*Proxy{p})
+	exited := 0
+	w.exit = func(code int) { exited = code }
+	assert.NoError(t, w.beat(p.localConfigHost))
+	w.check()
+	assert.Empty(t, w.Stalled())
+	assert.Equal(t, http.StatusOK, healthz(w, nil))
+
+	// a socket that accepts connections but never answers them
+	stuck := filepath.Join(dir, "stuck.sock")
+	li, err := net.Listen("unix", stuck)
+	assert.NoError(t, err)
+	defer func() { _ = li.Close() }()
+	p.listenerLock.Lock()
+	p.listeners["stuck"] = &upstreamListener{upstream: "stuck", local: stuck}
+	p.listenerLock.Unlock()
+
+	w.check()
+	assert.Empty(t, w.Stalled(), "a single failed heartbeat is not a stall")
+	assert.Equal(t, 0, exited)
+	w.check()
+	assert.Equal(t, []string{stuck}, w.Stalled())
+	assert.Equal(t, http.StatusServiceUnavailable, healthz(w, nil))
+	assert.Equal(t, 70, exited)
+
+	p.listenerLock.Lock()
+	delete(p.listeners, "stuck")
+	p.listenerLock.Unlock()
+	w.check()
+	assert.Empty(t, w.Stalled())
+	assert.Equal(t, http.StatusOK, healthz(w, nil))
+	assert.Equal(t, http.StatusOK, healthz(nil, nil))
+}
+
+func TestHeartbeatTCP(t *testing.T) {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = li.Close() }()
+	accepted := make(chan bool, 2)
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- isHeartbeat(conn)
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := dialHeartbeat("tcp", li.Addr().String(), time.Second)
+	assert.NoError(t, err)
+	assert.True(t, <-accepted)
+	_ = conn.Close()
+
+	other, err := net.Dial("tcp", li.Addr().String())
+	assert.NoError(t, err)
+	defer func() { _ = other.Close() }()
+	assert.False(t, <-accepted)
+}
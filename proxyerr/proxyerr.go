@@ -0,0 +1,71 @@
+// Package proxyerr defines the codes that prefix the errors redisbetween answers
+// with itself, rather than relaying from upstream, so that clients can decide
+// whether to back off and retry without parsing their text. The error's detail
+// follows the code, e.g. "PROXYOVERLOADED circuit open for upstream node
+// 10.0.0.1:7001, failing fast".
+package proxyerr
+
+import "strings"
+
+// Code is the first word of an error synthesized by the proxy
+type Code string
+
+const (
+	// Timeout is returned when the upstream didn't answer in time. The command may
+	// or may not have run.
+	Timeout Code = "PROXYTIMEOUT"
+	// Overloaded is returned when a request is shed without being sent, because the
+	// upstream is unhealthy or has too much in flight
+	Overloaded Code = "PROXYOVERLOADED"
+	// Maintenance is returned while the upstream is in maintenance, e.g. read-only
+	// mode, and the command would change it
+	Maintenance Code = "PROXYMAINT"
+	// Blocked is returned for commands the proxy refuses to forward at all
+	Blocked Code = "PROXYBLOCKED"
+	// Auth is returned when the proxy itself refuses a client's credentials
+	Auth Code = "PROXYAUTH"
+	// Unavailable is returned when the connection to the upstream failed before
+	// the command's reply was read. The command may or may not have run.
+	Unavailable Code = "PROXYUNAVAILABLE"
+	// Checksum is returned for a value whose checksum frame doesn't match its
+	// payload, either written by the client or read from the upstream
+	Checksum Code = "PROXYCHECKSUM"
+)
+
+var codes = map[Code]bool{
+	Timeout:     true,
+	Overloaded:  true,
+	Maintenance: true,
+	Blocked:     false,
+	Auth:        false,
+	Unavailable: true,
+	Checksum:    false,
+}
+
+// IsRetryable reports whether a command that failed with code may succeed if it
+// is sent again after backing off
+func IsRetryable(code Code) bool {
+	return codes[code]
+}
+
+// CodeOf returns the code of an error message, with or without its leading "-".
+// Errors that didn't come from the proxy, including those from plain-error
+// proxies, have none.
+func CodeOf(msg string) (Code, bool) {
+	msg = strings.TrimPrefix(msg, "-")
+	if i := strings.IndexByte(msg, ' '); i >= 0 {
+		msg = msg[:i]
+	}
+	code := Code(msg)
+	_, ok := codes[code]
+	return code, ok
+}
+
+// Format returns the error message for code and detail. If plain is set, the
+// code is left out for clients that only understand ERR.
+func Format(code Code, plain bool, detail string) string {
+	if plain {
+		return "ERR redisbetween: " + detail
+	}
+	return string(code) + " " + detail
+}
@@ -0,0 +1,41 @@
+package proxyerr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeOf(t *testing.T) {
+	for _, code := range []Code{Timeout, Overloaded, Maintenance, Blocked, Auth, Unavailable, Checksum} {
+		c, ok := CodeOf(Format(code, false, "some detail"))
+		assert.True(t, ok)
+		assert.Equal(t, code, c)
+		c, ok = CodeOf("-" + string(code))
+		assert.True(t, ok)
+		assert.Equal(t, code, c)
+
+		_, ok = CodeOf(Format(code, true, "some detail"))
+		assert.False(t, ok)
+	}
+	_, ok := CodeOf("READONLY You can't write against a read only replica.")
+	assert.False(t, ok)
+	_, ok = CodeOf("")
+	assert.False(t, ok)
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, IsRetryable(Timeout))
+	assert.True(t, IsRetryable(Overloaded))
+	assert.True(t, IsRetryable(Maintenance))
+	assert.True(t, IsRetryable(Unavailable))
+	assert.False(t, IsRetryable(Blocked))
+	assert.False(t, IsRetryable(Auth))
+	assert.False(t, IsRetryable(Checksum))
+	assert.False(t, IsRetryable("ERR"))
+}
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, "PROXYTIMEOUT upstream did not answer", Format(Timeout, false, "upstream did not answer"))
+	assert.Equal(t, "ERR redisbetween: upstream did not answer", Format(Timeout, true, "upstream did not answer"))
+}
@@ -7,9 +7,9 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
-	"fmt"
 	"io"
 	"strconv"
+	"sync"
 )
 
 var (
@@ -60,8 +60,9 @@ func Btoi64(b []byte) (int64, error) {
 }
 
 type Decoder struct {
-	br  *bufio.Reader
-	Err error
+	br     *bufio.Reader
+	Err    error
+	pooled bool
 }
 
 func NewDecoder(r io.Reader) *Decoder {
@@ -76,6 +77,29 @@ func NewDecoderBuffer(br *bufio.Reader) *Decoder {
 	return &Decoder{br: br}
 }
 
+// readerPool recycles the read buffers of pooled decoders
+var readerPool = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, 8192) }}
+
+// NewPooledDecoder is NewDecoder with a read buffer from a pool, which Release
+// gives back. Decoded messages don't refer to the buffer, so they outlive it.
+func NewPooledDecoder(r io.Reader) *Decoder {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return &Decoder{br: br, pooled: true}
+}
+
+// Release gives the read buffer of a pooled decoder back, after which the
+// decoder fails. It does nothing for others.
+func (d *Decoder) Release() {
+	if !d.pooled || d.br == nil {
+		return
+	}
+	d.br.Reset(nil)
+	readerPool.Put(d.br)
+	d.br = nil
+	d.Err = ErrFailedDecoder
+}
+
 func (d *Decoder) Decode() (*Message, error) {
 	if d.Err != nil {
 		return nil, ErrFailedDecoder
@@ -119,7 +143,7 @@ func (d *Decoder) decodeResp() (*Message, error) {
 	r.Type = MsgType(b)
 	switch r.Type {
 	default:
-		return nil, fmt.Errorf("bad resp type %s", r.Type)
+		return nil, BadRespTypeError(r.Type)
 	case TypeString, TypeError, TypeInt:
 		r.Value, err = d.decodeTextBytes()
 	case TypeBulkBytes:
@@ -142,7 +166,9 @@ func (d *Decoder) decodeTextBytes() ([]byte, error) {
 	return b[:n], nil
 }
 
-func (d *Decoder) decodeInt() (int64, error) {
+// decodeInt reads the length of a bulk string or an array, failing with bad if
+// it isn't an integer
+func (d *Decoder) decodeInt(bad error) (int64, error) {
 	b, err := d.br.ReadSlice('\n')
 	if err != nil {
 		return 0, err
@@ -151,11 +177,15 @@ func (d *Decoder) decodeInt() (int64, error) {
 	if n < 0 || b[n] != '\r' {
 		return 0, ErrBadCRLFEnd
 	}
-	return Btoi64(b[:n])
+	i, err := Btoi64(b[:n])
+	if err != nil {
+		return 0, bad
+	}
+	return i, nil
 }
 
 func (d *Decoder) decodeBulkBytes() ([]byte, error) {
-	n, err := d.decodeInt()
+	n, err := d.decodeInt(ErrBadBulkBytesLen)
 	if err != nil {
 		return nil, err
 	}
@@ -180,7 +210,7 @@ func (d *Decoder) decodeBulkBytes() ([]byte, error) {
 }
 
 func (d *Decoder) decodeArray() ([]*Message, error) {
-	n, err := d.decodeInt()
+	n, err := d.decodeInt(ErrBadArrayLen)
 	if err != nil {
 		return nil, err
 	}
@@ -235,7 +265,7 @@ func (d *Decoder) decodeMultiBulk() ([]*Message, error) {
 	if _, err := d.br.ReadByte(); err != nil {
 		return nil, err
 	}
-	n, err := d.decodeInt()
+	n, err := d.decodeInt(ErrBadMultiBulkLen)
 	if err != nil {
 		return nil, err
 	}
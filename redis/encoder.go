@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"sync"
 )
 
 const (
@@ -44,7 +45,8 @@ func itoa(i int64) string {
 }
 
 type Encoder struct {
-	bw *bufio.Writer
+	bw     *bufio.Writer
+	pooled bool
 
 	Err error
 }
@@ -63,6 +65,29 @@ func NewEncoderBuffer(bw *bufio.Writer) *Encoder {
 	return &Encoder{bw: bw}
 }
 
+// writerPool recycles the write buffers of pooled encoders
+var writerPool = sync.Pool{New: func() interface{} { return bufio.NewWriterSize(nil, 8192) }}
+
+// NewPooledEncoder is NewEncoder with a write buffer from a pool, which Release
+// gives back. Whatever wasn't flushed by then is discarded.
+func NewPooledEncoder(w io.Writer) *Encoder {
+	bw := writerPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return &Encoder{bw: bw, pooled: true}
+}
+
+// Release gives the write buffer of a pooled encoder back, after which the
+// encoder fails. It does nothing for others.
+func (e *Encoder) Release() {
+	if !e.pooled || e.bw == nil {
+		return
+	}
+	e.bw.Reset(nil)
+	writerPool.Put(e.bw)
+	e.bw = nil
+	e.Err = ErrFailedEncoder
+}
+
 func (e *Encoder) Encode(r *Message, flush bool) error {
 	if e.Err != nil {
 		return ErrFailedEncoder
@@ -98,7 +123,9 @@ func (e *Encoder) Flush() error {
 }
 
 func Encode(w io.Writer, r *Message) error {
-	return NewEncoder(w).Encode(r, true)
+	e := NewPooledEncoder(w)
+	defer e.Release()
+	return e.Encode(r, true)
 }
 
 func EncodeToBytes(r *Message) ([]byte, error) {
@@ -110,18 +137,26 @@ func EncodeToBytes(r *Message) ([]byte, error) {
 }
 
 func (e *Encoder) encodeResp(r *Message) error {
+	if r.Raw != nil {
+		_, err := e.bw.Write(r.Raw)
+		return err
+	}
 	if err := e.bw.WriteByte(byte(r.Type)); err != nil {
 		return err
 	}
 	switch r.Type {
 	default:
 		return fmt.Errorf("bad resp type %s", r.Type)
-	case TypeString, TypeError, TypeInt:
+	case TypeString, TypeError, TypeInt, TypeBoolean, TypeDouble, TypeBigNumber:
 		return e.encodeTextBytes(r.Value)
-	case TypeBulkBytes:
+	case TypeNull:
+		return e.encodeTextString("")
+	case TypeBulkBytes, TypeVerbatim, TypeBlobError:
 		return e.encodeBulkBytes(r.Value)
-	case TypeArray:
+	case TypeArray, TypeSet, TypePush:
 		return e.encodeArray(r.Array)
+	case TypeMap, TypeAttribute:
+		return e.encodePairs(r.Array)
 	}
 }
 
@@ -180,3 +215,19 @@ func (e *Encoder) encodeArray(array []*Message) error {
 	}
 	return nil
 }
+
+// encodePairs encodes the alternating keys and values of a map or attribute
+func (e *Encoder) encodePairs(array []*Message) error {
+	if len(array)%2 != 0 {
+		return fmt.Errorf("odd number of map elements: %d", len(array))
+	}
+	if err := e.encodeInt(int64(len(array) / 2)); err != nil {
+		return err
+	}
+	for _, r := range array {
+		if err := e.encodeResp(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -42,6 +42,7 @@ func TestEncodeString(t *testing.T) {
 func TestEncodeError(t *testing.T) {
 	resp := NewError([]byte("Error"))
 	testEncodeAndCheck(t, resp, []byte("-Error\r\n"))
+	testEncodeAndCheck(t, NewErrorf("ERR unknown command '%s'", "A\nB\r\n"), []byte("-ERR unknown command 'A B  '\r\n"))
 }
 
 func TestEncodeInt(t *testing.T) {
@@ -74,6 +75,18 @@ func TestEncodeArray(t *testing.T) {
 	testEncodeAndCheck(t, resp, []byte("*3\r\n:0\r\n$-1\r\n$4\r\ntest\r\n"))
 }
 
+func TestPooledEncoder(t *testing.T) {
+	var b bytes.Buffer
+	e := NewPooledEncoder(&b)
+	assert.NoError(t, e.Encode(NewString([]byte("OK")), false))
+	assert.NoError(t, e.Encode(NewBulkBytes([]byte("v")), false))
+	assert.Equal(t, 0, b.Len(), "nothing is written before a flush")
+	assert.NoError(t, e.Flush())
+	assert.Equal(t, "+OK\r\n$1\r\nv\r\n", b.String())
+	e.Release()
+	assert.Equal(t, ErrFailedEncoder, e.Encode(NewString([]byte("OK")), true))
+}
+
 func testEncodeAndCheck(t *testing.T, resp *Message, expect []byte) {
 	b, err := EncodeToBytes(resp)
 	assert.NoError(t, err)
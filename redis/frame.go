@@ -0,0 +1,598 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// MaxNestingDepth bounds how deeply aggregates may nest in a frame
+const MaxNestingDepth = 1024
+
+var (
+	ErrNestingTooDeep  = errors.New("bad frame, nested too deeply")
+	ErrBadStreamedPart = errors.New("bad streamed string part")
+)
+
+// BadRespTypeError is the error of a message whose type byte is none of RESP's
+type BadRespTypeError MsgType
+
+func (e BadRespTypeError) Error() string {
+	return "bad resp type " + MsgType(e).String()
+}
+
+// IsProtocolError is whether err is that of decoding bytes that aren't valid
+// RESP, rather than one reading them
+func IsProtocolError(err error) bool {
+	if _, ok := err.(BadRespTypeError); ok {
+		return true
+	}
+	switch err {
+	case ErrBadCRLFEnd, ErrBadArrayLen, ErrBadArrayLenTooLong, ErrBadBulkBytesLen, ErrBadBulkBytesLenTooLong,
+		ErrBadMultiBulkLen, ErrBadMultiBulkContent, ErrNestingTooDeep, ErrBadStreamedPart:
+		return true
+	}
+	return false
+}
+
+// DecodeFrame decodes the next message, keeping its exact bytes in Raw. It reads
+// the message by its RESP framing alone, so any reply shape, including RESP3
+// types and those of commands the proxy knows nothing about, is read whole and
+// can be relayed unchanged. The parsed view of the message refers to Raw rather
+// than copying out of it.
+//
+// An attribute is part of the frame of the message it annotates, which is what
+// the parsed view holds.
+func (d *Decoder) DecodeFrame() (*Message, error) {
+	if d.Err != nil {
+		return nil, ErrFailedDecoder
+	}
+	scratch := getFrameBuffer()
+	raw, err := d.readFrame(*scratch, 0)
+	raw = keepFrame(scratch, raw, err)
+	if err != nil {
+		d.Err = err
+		return nil, err
+	}
+	m, _, err := parseFrame(raw, 0)
+	if err != nil {
+		d.Err = err
+		return nil, err
+	}
+	m.Raw = raw
+	return m, nil
+}
+
+// DecodeFrameUnparsed is DecodeFrame for a message that is only relayed: the
+// elements of an aggregate of known length are left in Raw rather than parsed,
+// which Unparsed tells, until Parsed is asked for them. Any other message is
+// parsed as DecodeFrame parses it.
+func (d *Decoder) DecodeFrameUnparsed() (*Message, error) {
+	if d.Err != nil {
+		return nil, ErrFailedDecoder
+	}
+	scratch := getFrameBuffer()
+	raw, err := d.readFrame(*scratch, 0)
+	raw = keepFrame(scratch, raw, err)
+	if err != nil {
+		d.Err = err
+		return nil, err
+	}
+	if m := unparsedFrame(raw); m != nil {
+		return m, nil
+	}
+	m, _, err := parseFrame(raw, 0)
+	if err != nil {
+		d.Err = err
+		return nil, err
+	}
+	m.Raw = raw
+	return m, nil
+}
+
+// unparsedFrame is the message of raw, a whole frame, with its elements left
+// unparsed, if it is an aggregate of known length that has any. An attribute,
+// whose parsed view is the message it annotates, is parsed as usual.
+func unparsedFrame(raw []byte) *Message {
+	t := MsgType(raw[0])
+	switch t {
+	case TypeArray, TypeSet, TypePush, TypeMap:
+	default:
+		return nil
+	}
+	eol := indexCRLF(raw)
+	if n, err := Btoi64(raw[1:eol]); err != nil || n <= 0 {
+		return nil
+	}
+	return &Message{Type: t, Raw: raw, unparsed: true}
+}
+
+// Parsed returns r with the elements DecodeFrameUnparsed left in Raw parsed, as
+// a new message, r itself being left as it is for whoever else shares it. Any
+// other message is returned as is.
+func (r *Message) Parsed() (*Message, error) {
+	if !r.unparsed {
+		return r, nil
+	}
+	m, _, err := parseFrame(r.Raw, 0)
+	if err != nil {
+		return nil, err
+	}
+	m.Raw = r.Raw
+	return m, nil
+}
+
+// Stream is a bulk string left unread by DecodeFrameOrStream: its Header line,
+// with the type byte and CRLF, and a Body reading its Len bytes of content and
+// their CRLF, which fails as the decoder would on a bad end
+type Stream struct {
+	Header []byte
+	Len    int64
+	Body   io.Reader
+}
+
+// DecodeFrameOrStream is DecodeFrame, unless the next message is a bulk string
+// of more than threshold bytes, which is not read but returned as a Stream. It
+// must be read whole before the decoder is used again, the decoder failing
+// once it is cut short.
+func (d *Decoder) DecodeFrameOrStream(threshold int64) (*Message, *Stream, error) {
+	if d.Err != nil {
+		return nil, nil, ErrFailedDecoder
+	}
+	b, err := d.br.Peek(1)
+	if err != nil {
+		d.Err = err
+		return nil, nil, err
+	}
+	if MsgType(b[0]) != TypeBulkBytes {
+		m, err := d.DecodeFrame()
+		return m, nil, err
+	}
+	scratch := getFrameBuffer()
+	raw, header, err := d.readLine(*scratch)
+	if err == nil && string(header) != "?" {
+		n, perr := Btoi64(header)
+		switch {
+		case perr != nil || n < -1:
+			err = ErrBadBulkBytesLen
+		case n > threshold:
+			return nil, &Stream{Header: keepFrame(scratch, raw, nil), Len: n, Body: &streamBody{d: d, left: n + 2}}, nil
+		case n >= 0:
+			raw, err = d.readBlob(raw, n)
+		}
+	} else if err == nil {
+		raw, err = d.readStreamedParts(raw)
+	}
+	raw = keepFrame(scratch, raw, err)
+	if err != nil {
+		d.Err = err
+		return nil, nil, err
+	}
+	m, _, err := parseFrame(raw, 0)
+	if err != nil {
+		d.Err = err
+		return nil, nil, err
+	}
+	m.Raw = raw
+	return m, nil, nil
+}
+
+// streamBody reads the rest of a Stream, keeping its last two bytes to check
+// they are CRLF
+type streamBody struct {
+	d    *Decoder
+	left int64
+	tail [2]byte
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	if b.left == 0 {
+		return 0, io.EOF
+	}
+	if b.d.Err != nil {
+		return 0, ErrFailedDecoder
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.d.br.Read(p)
+	b.left -= int64(n)
+	switch {
+	case n >= 2:
+		b.tail = [2]byte{p[n-2], p[n-1]}
+	case n == 1:
+		b.tail = [2]byte{b.tail[1], p[0]}
+	}
+	if err == io.EOF && b.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && b.left == 0 && b.tail != [2]byte{'\r', '\n'} {
+		err = ErrBadCRLFEnd
+	}
+	if err != nil && err != io.EOF {
+		b.d.Err = err
+	}
+	return n, err
+}
+
+// PeekFrame returns the next message if the decoder has already buffered it
+// whole, without consuming it, so that decoding it next won't block. The
+// message refers to the decoder's buffer, and is only valid until it decodes
+// again.
+func (d *Decoder) PeekFrame() (*Message, bool) {
+	if d.Err != nil || d.br == nil || d.br.Buffered() == 0 {
+		return nil, false
+	}
+	raw, err := d.br.Peek(d.br.Buffered())
+	if err != nil {
+		return nil, false
+	}
+	m, _, err := parseFrame(raw, 0)
+	return m, err == nil
+}
+
+// DecodeFrameFromBytes decodes the first message framed in p
+func DecodeFrameFromBytes(p []byte) (*Message, error) {
+	return NewDecoder(bytes.NewReader(p)).DecodeFrame()
+}
+
+// maxPooledFrame is the largest frame buffer kept in framePool. Buffers grown
+// past it by a larger frame are left to the garbage collector.
+const maxPooledFrame = 4 * 1024 * 1024
+
+// framePool recycles the scratch buffers frames are read into. A frame is
+// read into one, growing it as needed, and then copied out once at its exact
+// size, so that a frame of many parts costs a single allocation rather than
+// one per time its buffer doubles.
+var framePool = sync.Pool{New: func() interface{} {
+	b := make([]byte, 0, 512)
+	return &b
+}}
+
+func getFrameBuffer() *[]byte {
+	b := framePool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// keepFrame returns a copy of the frame read into the scratch buffer, which it
+// gives back to framePool, along with whatever it was grown to. Nothing is
+// copied if the frame failed to read, nor if the buffer grew past
+// maxPooledFrame, as it isn't pooled then: the frame is kept where it was read.
+func keepFrame(scratch *[]byte, raw []byte, err error) []byte {
+	if cap(raw) > maxPooledFrame {
+		if err != nil {
+			return nil
+		}
+		return raw
+	}
+	var frame []byte
+	if err == nil {
+		frame = make([]byte, len(raw))
+		copy(frame, raw)
+	}
+	*scratch = raw[:0]
+	framePool.Put(scratch)
+	return frame
+}
+
+// readLine appends the next CRLF terminated line to buf, returning the line's
+// contents without the type byte and CRLF
+func (d *Decoder) readLine(buf []byte) ([]byte, []byte, error) {
+	start := len(buf)
+	for {
+		b, err := d.br.ReadSlice('\n')
+		buf = append(buf, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return buf, nil, err
+		}
+		break
+	}
+	n := len(buf) - 2
+	if n <= start || buf[n] != '\r' {
+		return buf, nil, ErrBadCRLFEnd
+	}
+	return buf, buf[start+1 : n], nil
+}
+
+// blobChunk is how much of a blob is read at a time. A blob is grown as its
+// bytes arrive rather than allocated at the length its header claims, so that a
+// peer that sends the header and then trickles, or never sends, the bytes can't
+// hold that much memory.
+const blobChunk = 64 * 1024
+
+// readBlob appends n bytes of content and their CRLF to buf
+func (d *Decoder) readBlob(buf []byte, n int64) ([]byte, error) {
+	if n > MaxBulkBytesLen {
+		return buf, ErrBadBulkBytesLenTooLong
+	}
+	end := len(buf) + int(n) + 2
+	for len(buf) < end {
+		next := len(buf) + blobChunk
+		if next > end {
+			next = end
+		}
+		if next > cap(buf) {
+			size := 2 * cap(buf)
+			if size < next {
+				size = next
+			}
+			if size > end {
+				size = end
+			}
+			grown := make([]byte, len(buf), size)
+			copy(grown, buf)
+			buf = grown
+		}
+		at := len(buf)
+		buf = buf[:next]
+		if _, err := io.ReadFull(d.br, buf[at:]); err != nil {
+			return buf, err
+		}
+	}
+	if buf[end-2] != '\r' || buf[end-1] != '\n' {
+		return buf, ErrBadCRLFEnd
+	}
+	return buf, nil
+}
+
+// readFrame appends the bytes of the next message to buf
+func (d *Decoder) readFrame(buf []byte, depth int) ([]byte, error) {
+	if depth > MaxNestingDepth {
+		return buf, ErrNestingTooDeep
+	}
+	start := len(buf)
+	buf, header, err := d.readLine(buf)
+	if err != nil {
+		return buf, err
+	}
+	t := MsgType(buf[start])
+	switch t {
+	case TypeString, TypeError, TypeInt, TypeNull, TypeBoolean, TypeDouble, TypeBigNumber:
+		return buf, nil
+
+	case TypeBulkBytes, TypeVerbatim, TypeBlobError:
+		if string(header) == "?" {
+			return d.readStreamedParts(buf)
+		}
+		n, err := Btoi64(header)
+		switch {
+		case err != nil || n < -1:
+			return buf, ErrBadBulkBytesLen
+		case n == -1:
+			return buf, nil
+		}
+		return d.readBlob(buf, n)
+
+	case TypeArray, TypeSet, TypePush, TypeMap, TypeAttribute:
+		if string(header) == "?" {
+			return d.readStreamedElements(buf, depth)
+		}
+		n, err := Btoi64(header)
+		switch {
+		case err != nil || n < -1:
+			return buf, ErrBadArrayLen
+		case n > MaxArrayLen:
+			return buf, ErrBadArrayLenTooLong
+		case n == -1:
+			return buf, nil
+		}
+		if t == TypeMap || t == TypeAttribute {
+			n *= 2
+		}
+		for i := int64(0); i < n; i++ {
+			if buf, err = d.readFrame(buf, depth+1); err != nil {
+				return buf, err
+			}
+		}
+		// the message an attribute annotates counts as nested in it, so that a
+		// chain of attributes is bounded like any other nesting
+		if t == TypeAttribute {
+			return d.readFrame(buf, depth+1)
+		}
+		return buf, nil
+
+	default:
+		return buf, BadRespTypeError(t)
+	}
+}
+
+// readStreamedParts reads the ;<len> parts of a streamed string, up to ;0
+func (d *Decoder) readStreamedParts(buf []byte) ([]byte, error) {
+	for {
+		start := len(buf)
+		var header []byte
+		var err error
+		if buf, header, err = d.readLine(buf); err != nil {
+			return buf, err
+		}
+		if buf[start] != ';' {
+			return buf, ErrBadStreamedPart
+		}
+		n, err := Btoi64(header)
+		if err != nil || n < 0 {
+			return buf, ErrBadStreamedPart
+		}
+		if n == 0 {
+			return buf, nil
+		}
+		if buf, err = d.readBlob(buf, n); err != nil {
+			return buf, err
+		}
+	}
+}
+
+// readStreamedElements reads the elements of a streamed aggregate, up to its
+// terminating ".", alone on its line
+func (d *Decoder) readStreamedElements(buf []byte, depth int) ([]byte, error) {
+	for i := 0; ; i++ {
+		if i > MaxArrayLen*2 {
+			return buf, ErrBadArrayLenTooLong
+		}
+		b, err := d.br.Peek(1)
+		if err != nil {
+			return buf, err
+		}
+		if b[0] == '.' {
+			var end []byte
+			if buf, end, err = d.readLine(buf); err == nil && len(end) > 0 {
+				err = ErrBadArrayLen
+			}
+			return buf, err
+		}
+		if buf, err = d.readFrame(buf, depth+1); err != nil {
+			return buf, err
+		}
+	}
+}
+
+// parseFrame parses the message at the start of raw, returning it and the number
+// of bytes it took up. raw is either a frame readFrame has already validated
+// or, for PeekFrame, whatever is buffered, so that lengths are checked against
+// it before they are trusted.
+func parseFrame(raw []byte, depth int) (*Message, int, error) {
+	m := &Message{}
+	used, err := parseFrameInto(m, raw, depth)
+	if err != nil {
+		return nil, 0, err
+	}
+	return m, used, nil
+}
+
+// parseFrameInto is parseFrame, parsing into m. The elements of an aggregate of
+// known length are parsed into a single slice of messages, rather than each
+// allocated on its own.
+func parseFrameInto(m *Message, raw []byte, depth int) (int, error) {
+	if depth > MaxNestingDepth {
+		return 0, ErrNestingTooDeep
+	}
+	eol := indexCRLF(raw)
+	if eol < 1 {
+		return 0, ErrBadCRLFEnd
+	}
+	t, header, pos := MsgType(raw[0]), raw[1:eol], eol+2
+	*m = Message{Type: t}
+	switch t {
+	case TypeString, TypeError, TypeInt, TypeBoolean, TypeDouble, TypeBigNumber:
+		m.Value = header
+		return pos, nil
+
+	case TypeNull:
+		return pos, nil
+
+	case TypeBulkBytes, TypeVerbatim, TypeBlobError:
+		if string(header) == "?" {
+			return parseStreamedParts(m, raw, pos)
+		}
+		n, err := Btoi64(header)
+		if err == nil && n == -1 {
+			return pos, nil
+		}
+		if err != nil || n < 0 || n > int64(len(raw)-pos-2) {
+			return 0, ErrBadBulkBytesLen
+		}
+		m.Value = raw[pos : pos+int(n) : pos+int(n)]
+		return pos + int(n) + 2, nil
+
+	case TypeArray, TypeSet, TypePush, TypeMap, TypeAttribute:
+		streamed := string(header) == "?"
+		var n int64 = -1
+		if !streamed {
+			var err error
+			if n, err = Btoi64(header); err != nil || n < -1 {
+				return 0, ErrBadArrayLen
+			}
+			if n == -1 {
+				return pos, nil
+			}
+			if t == TypeMap || t == TypeAttribute {
+				n *= 2
+			}
+			// every element takes at least its type byte and CRLF
+			if n > int64(len(raw)-pos)/3 {
+				return 0, ErrBadArrayLen
+			}
+		}
+		var slab []Message
+		if streamed {
+			m.Array = make([]*Message, 0)
+		} else {
+			m.Array = make([]*Message, n)
+			slab = make([]Message, n)
+		}
+		for i := int64(0); streamed || i < n; i++ {
+			if streamed && pos < len(raw) && raw[pos] == '.' {
+				if pos+3 > len(raw) {
+					return 0, ErrBadArrayLen
+				}
+				pos += 3
+				break
+			}
+			if pos >= len(raw) {
+				return 0, ErrBadArrayLen
+			}
+			var e *Message
+			if streamed {
+				e = &Message{}
+				m.Array = append(m.Array, e)
+			} else {
+				e = &slab[i]
+				m.Array[i] = e
+			}
+			used, err := parseFrameInto(e, raw[pos:], depth+1)
+			if err != nil {
+				return 0, err
+			}
+			pos += used
+		}
+		if t == TypeAttribute {
+			// the parsed view is the annotated message
+			used, err := parseFrameInto(m, raw[pos:], depth+1)
+			if err != nil {
+				return 0, err
+			}
+			return pos + used, nil
+		}
+		return pos, nil
+	}
+	return 0, BadRespTypeError(t)
+}
+
+// parseStreamedParts joins the parts of a streamed string into m.Value. This is
+// the one place parsing copies out of the frame.
+func parseStreamedParts(m *Message, raw []byte, pos int) (int, error) {
+	m.Value = []byte{}
+	for {
+		eol := indexCRLF(raw[pos:])
+		if eol < 1 || raw[pos] != ';' {
+			return 0, ErrBadStreamedPart
+		}
+		n, err := Btoi64(raw[pos+1 : pos+eol])
+		if err != nil || n < 0 {
+			return 0, ErrBadStreamedPart
+		}
+		pos += eol + 2
+		if n == 0 {
+			return pos, nil
+		}
+		if n > int64(len(raw)-pos-2) {
+			return 0, ErrBadStreamedPart
+		}
+		m.Value = append(m.Value, raw[pos:pos+int(n)]...)
+		pos += int(n) + 2
+	}
+}
+
+func indexCRLF(b []byte) int {
+	for i := 0; i+1 < len(b); i++ {
+		if b[i] == '\r' && b[i+1] == '\n' {
+			return i
+		}
+	}
+	return -1
+}
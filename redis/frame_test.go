@@ -0,0 +1,376 @@
+package redis
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeFrameInvalid(t *testing.T) {
+	test := []string{
+		"*hello\r\n",
+		"*-100\r\n",
+		"*3\r\nhi",
+		"*3\r\nhi\r\n",
+		"*4\r\n$1",
+		"*2\r\n$3\r\nget\r\n$what?\r\nx\r\n",
+		"*2\r\n$3\r\nget\r\n$100\r\nx\r\n",
+		"$6\r\nfoobar\r",
+		"$0\rn\r\n",
+		"$-1\n",
+		"+OK\n",
+		"%1\r\n+key\r\n",
+		"|1\r\n+key\r\n+value\r\n",
+		"$?\r\n;4\r\nHell\r\n",
+		"$?\r\n:4\r\nHell\r\n;0\r\n",
+		"*?\r\n:1\r\n",
+		"@3\r\nfoo\r\n",
+	}
+	for _, s := range test {
+		_, err := DecodeFrameFromBytes([]byte(s))
+		assert.Error(t, err, "%q", s)
+	}
+}
+
+func TestIsProtocolError(t *testing.T) {
+	for _, s := range []string{"*hello\r\n", "*-100\r\n", "@3\r\nfoo\r\n", "$6\r\nfoobarx\n", "*2\r\n$3\r\nget\r\n$what?\r\nx\r\n"} {
+		_, err := DecodeFrameFromBytes([]byte(s))
+		assert.True(t, IsProtocolError(err), "%q: %v", s, err)
+	}
+	// bytes that are only cut short may be valid once the rest arrives
+	for _, s := range []string{"*3\r\nhi", "*4\r\n$1", "*2\r\n$3\r\nget\r\n$100\r\nx\r\n"} {
+		_, err := DecodeFrameFromBytes([]byte(s))
+		assert.Error(t, err)
+		assert.False(t, IsProtocolError(err), "%q: %v", s, err)
+	}
+}
+
+func TestDecodeFrameByteIdentical(t *testing.T) {
+	test := []string{
+		"+OK\r\n",
+		"-ERR unknown command 'JSON.GET'\r\n",
+		":-42\r\n",
+		"$-1\r\n",
+		"$0\r\n\r\n",
+		"*-1\r\n",
+		"*0\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nv\r\nv!\r\n",
+		"%2\r\n+first\r\n:1\r\n+second\r\n*2\r\n#t\r\n_\r\n",
+		"~3\r\n+a\r\n,3.14\r\n(3492890328409238509324850943850943825024385\r\n",
+		">3\r\n+message\r\n+channel\r\n$5\r\nhello\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		"!21\r\nSYNTAX invalid syntax\r\n",
+		",inf\r\n",
+		"#f\r\n",
+		"|1\r\n+key-popularity\r\n%2\r\n$1\r\na\r\n,0.1923\r\n$1\r\nb\r\n,0.0012\r\n*2\r\n:2039123\r\n:9543892\r\n",
+		"$?\r\n;4\r\nHell\r\n;5\r\no wor\r\n;1\r\nd\r\n;0\r\n",
+		"*?\r\n:1\r\n%?\r\n+a\r\n:2\r\n.\r\n~1\r\n_\r\n.\r\n",
+		"+" + strings.Repeat("long line ", 2000) + "\r\n",
+	}
+	for _, s := range test {
+		// a trailing message must be left for the next decode
+		d := NewDecoder(bytes.NewReader([]byte(s + "+NEXT\r\n")))
+		m, err := d.DecodeFrame()
+		if !assert.NoError(t, err, "%q", s) {
+			continue
+		}
+		assert.Equal(t, s, string(m.Raw))
+		b, err := EncodeToBytes(m)
+		assert.NoError(t, err)
+		assert.Equal(t, s, string(b))
+		next, err := d.DecodeFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, "NEXT", string(next.Value))
+	}
+}
+
+func TestDecodeFrameParsedView(t *testing.T) {
+	m, err := DecodeFrameFromBytes([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$-1\r\n"))
+	assert.NoError(t, err)
+	assert.True(t, m.IsArray())
+	assert.Equal(t, "SET", string(m.Array[0].Value))
+	assert.Equal(t, "k", string(m.Array[1].Value))
+	assert.Nil(t, m.Array[2].Value)
+	// only the whole frame carries Raw
+	assert.Nil(t, m.Array[0].Raw)
+
+	m, err = DecodeFrameFromBytes([]byte("%2\r\n+a\r\n:1\r\n+b\r\n=8\r\ntxt:text\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, TypeMap, m.Type)
+	assert.Len(t, m.Array, 4)
+	assert.Equal(t, "txt:text", string(m.Array[3].Value))
+
+	m, err = DecodeFrameFromBytes([]byte("|1\r\n+ttl\r\n:3600\r\n$5\r\nvalue\r\n"))
+	assert.NoError(t, err)
+	assert.True(t, m.IsBulkBytes(), "an attribute annotates the message after it")
+	assert.Equal(t, "value", string(m.Value))
+
+	m, err = DecodeFrameFromBytes([]byte("$?\r\n;4\r\nHell\r\n;1\r\no\r\n;0\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", string(m.Value))
+
+	m, err = DecodeFrameFromBytes([]byte("!5\r\nOOPS!\r\n"))
+	assert.NoError(t, err)
+	assert.True(t, m.IsError())
+}
+
+func TestDecodeFramePipelined(t *testing.T) {
+	// frames are read into reused buffers, so each decoded message must keep
+	// its bytes after those decoded after it
+	frames := []string{
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*3\r\n$1\r\n1\r\n*2\r\n$1\r\n2\r\n*1\r\n$1\r\n3\r\n$-1\r\n",
+		"+" + strings.Repeat("x", 4096) + "\r\n",
+		"*2\r\n*?\r\n:1\r\n.\r\n%1\r\n+k\r\n*1\r\n+v\r\n",
+		"$5\r\nlast!\r\n",
+	}
+	d := NewPooledDecoder(strings.NewReader(strings.Join(frames, "")))
+	defer d.Release()
+	var mm []*Message
+	for range frames {
+		m, err := d.DecodeFrame()
+		assert.NoError(t, err)
+		mm = append(mm, m)
+	}
+	for i, m := range mm {
+		assert.Equal(t, frames[i], string(m.Raw))
+	}
+	nested := mm[1]
+	assert.Len(t, nested.Array, 3)
+	assert.Equal(t, "1", string(nested.Array[0].Value))
+	assert.Equal(t, "2", string(nested.Array[1].Array[0].Value))
+	assert.Equal(t, "3", string(nested.Array[1].Array[1].Array[0].Value))
+	assert.Nil(t, nested.Array[2].Value)
+	assert.Equal(t, []*Message{{Type: TypeInt, Value: []byte("1")}}, mm[3].Array[0].Array)
+	assert.Equal(t, "v", string(mm[3].Array[1].Array[1].Array[0].Value))
+	assert.Equal(t, "last!", string(mm[4].Value))
+}
+
+func TestDecodeFrameUnparsed(t *testing.T) {
+	frames := []string{
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*3\r\n$1\r\n1\r\n*2\r\n$1\r\n2\r\n*1\r\n$1\r\n3\r\n$-1\r\n",
+		"%2\r\n+a\r\n:1\r\n+b\r\n*2\r\n#t\r\n_\r\n",
+		"*2\r\n*?\r\n:1\r\n.\r\n%1\r\n+k\r\n*1\r\n+v\r\n",
+		"*-1\r\n",
+		"*0\r\n",
+		"*?\r\n:1\r\n.\r\n",
+		"|1\r\n+ttl\r\n:3600\r\n*1\r\n$5\r\nvalue\r\n",
+		"$5\r\nlast!\r\n",
+	}
+	d := NewPooledDecoder(strings.NewReader(strings.Join(frames, "")))
+	defer d.Release()
+	var mm []*Message
+	for range frames {
+		m, err := d.DecodeFrameUnparsed()
+		assert.NoError(t, err)
+		mm = append(mm, m)
+	}
+	for i, m := range mm {
+		assert.Equal(t, frames[i], string(m.Raw))
+		b, err := EncodeToBytes(m)
+		assert.NoError(t, err)
+		assert.Equal(t, frames[i], string(b), "relayed byte for byte")
+
+		// parsed, it is the message DecodeFrame decodes
+		want, err := DecodeFrameFromBytes([]byte(frames[i]))
+		assert.NoError(t, err)
+		parsed, err := m.Parsed()
+		assert.NoError(t, err)
+		assert.Equal(t, want, parsed, "%q", frames[i])
+		assert.False(t, parsed.Unparsed())
+	}
+	for _, i := range []int{0, 1, 2, 3} {
+		assert.True(t, mm[i].Unparsed(), "%q", frames[i])
+		assert.Nil(t, mm[i].Array, "%q", frames[i])
+	}
+	for _, i := range []int{4, 5, 6, 7, 8} {
+		assert.False(t, mm[i].Unparsed(), "%q", frames[i])
+	}
+	assert.Nil(t, mm[4].Array, "a nil array is told apart from one unparsed")
+	assert.Equal(t, "value", string(mm[7].Array[0].Value), "an attribute is parsed")
+
+	// the message parsed is a new one, the unparsed one being shared
+	parsed, _ := mm[1].Parsed()
+	assert.Equal(t, "3", string(parsed.Array[1].Array[1].Array[0].Value))
+	assert.True(t, mm[1].Unparsed())
+	assert.Nil(t, mm[1].Array)
+}
+
+func TestDecodeFrameUnparsedLarge(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("*8\r\n")
+	for i := 0; i < 8; i++ {
+		blob := strings.Repeat(strconv.Itoa(i), 1<<20)
+		b.WriteString("$" + strconv.Itoa(len(blob)) + "\r\n" + blob + "\r\n")
+	}
+	d := NewPooledDecoder(bytes.NewReader(b.Bytes()))
+	defer d.Release()
+	m, err := d.DecodeFrameUnparsed()
+	assert.NoError(t, err)
+	assert.True(t, m.Unparsed())
+	assert.Equal(t, b.Bytes(), m.Raw)
+	parsed, err := m.Parsed()
+	assert.NoError(t, err)
+	assert.Len(t, parsed.Array, 8)
+	assert.Equal(t, strings.Repeat("7", 1<<20), string(parsed.Array[7].Value))
+}
+
+func TestDecodeFrameNesting(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat("*1\r\n", depth) + ":1\r\n"
+	}
+	m, err := DecodeFrameFromBytes([]byte(nested(MaxNestingDepth)))
+	assert.NoError(t, err)
+	assert.Equal(t, nested(MaxNestingDepth), string(m.Raw))
+
+	_, err = DecodeFrameFromBytes([]byte(nested(MaxNestingDepth + 1)))
+	assert.Equal(t, ErrNestingTooDeep, err)
+
+	_, err = DecodeFrameFromBytes([]byte(strings.Repeat("|0\r\n", MaxNestingDepth+1) + ":1\r\n"))
+	assert.Equal(t, ErrNestingTooDeep, err, "a chain of attributes")
+}
+
+func TestDecodeFrameLargeBlob(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("*2\r\n")
+	for i := 0; i < 2; i++ {
+		blob := strings.Repeat(strconv.Itoa(i), 1<<20)
+		b.WriteString("=" + strconv.Itoa(len(blob)+4) + "\r\ntxt:" + blob + "\r\n")
+	}
+	m, err := DecodeFrameFromBytes(b.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, b.Bytes(), m.Raw)
+	assert.Len(t, m.Array[1].Value, 1<<20+4)
+}
+
+func TestDecodeFrameTruncatedBlob(t *testing.T) {
+	// a header claiming 100MB, and a few bytes of them
+	d := NewPooledDecoder(strings.NewReader("*1\r\n$100000000\r\nabc"))
+	buf, err := d.readFrame(nil, 0)
+	assert.Error(t, err)
+	assert.LessOrEqual(t, cap(buf), 2*blobChunk, "a blob is grown as its bytes arrive")
+
+	d.Release()
+	_, err = d.DecodeFrame()
+	assert.Equal(t, ErrFailedDecoder, err, "a released decoder can't be used")
+}
+
+func TestPeekFrame(t *testing.T) {
+	d := NewDecoder(strings.NewReader("*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nGET"))
+	_, ok := d.PeekFrame()
+	assert.False(t, ok, "nothing is buffered before the first read")
+	m, err := d.DecodeFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, "PING", string(m.Array[0].Value))
+
+	peeked, ok := d.PeekFrame()
+	if assert.True(t, ok) {
+		assert.Equal(t, "a", string(peeked.Array[1].Value))
+	}
+	m, err = d.DecodeFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", string(m.Raw), "peeking consumes nothing")
+	_, ok = d.PeekFrame()
+	assert.False(t, ok, "the next message isn't buffered whole")
+
+	for _, s := range []string{"*1000000\r\n", "$9223372036854775807\r\nab", "*?\r\n:1\r\n.", "|?\r\n.\r"} {
+		d := NewDecoder(strings.NewReader(":1\r\n" + s))
+		_, err := d.DecodeFrame()
+		assert.NoError(t, err)
+		_, ok := d.PeekFrame()
+		assert.False(t, ok, "%q", s)
+	}
+}
+
+func TestEncodeRESP3(t *testing.T) {
+	m := &Message{Type: TypeMap, Array: []*Message{
+		NewString([]byte("a")), {Type: TypeBoolean, Value: []byte("t")},
+		NewString([]byte("b")), {Type: TypeNull},
+	}}
+	b, err := EncodeToBytes(m)
+	assert.NoError(t, err)
+	assert.Equal(t, "%2\r\n+a\r\n#t\r\n+b\r\n_\r\n", string(b))
+
+	_, err = EncodeToBytes(&Message{Type: TypeMap, Array: []*Message{NewString([]byte("a"))}})
+	assert.Error(t, err)
+}
+
+func TestDecodeFrameOrStream(t *testing.T) {
+	big := strings.Repeat("x", 100)
+	d := NewDecoder(strings.NewReader("+OK\r\n$3\r\nfoo\r\n$-1\r\n$100\r\n" + big + "\r\n:1\r\n$100\r\n" + big + "xx"))
+	for _, want := range []string{"+OK\r\n", "$3\r\nfoo\r\n", "$-1\r\n"} {
+		m, s, err := d.DecodeFrameOrStream(10)
+		assert.NoError(t, err)
+		assert.Nil(t, s)
+		assert.Equal(t, want, string(m.Raw))
+	}
+
+	// the stream is read from the decoder's buffer, leaving it at the next
+	// message once read whole
+	_, s, err := d.DecodeFrameOrStream(10)
+	assert.NoError(t, err)
+	assert.Equal(t, "$100\r\n", string(s.Header))
+	assert.Equal(t, int64(100), s.Len)
+	var body bytes.Buffer
+	_, err = body.ReadFrom(s.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, big+"\r\n", body.String())
+	m, _, err := d.DecodeFrameOrStream(10)
+	assert.NoError(t, err)
+	assert.Equal(t, ":1\r\n", string(m.Raw))
+
+	_, s, err = d.DecodeFrameOrStream(10)
+	assert.NoError(t, err)
+	_, err = body.ReadFrom(s.Body)
+	assert.Equal(t, ErrBadCRLFEnd, err)
+	_, _, err = d.DecodeFrameOrStream(10)
+	assert.Equal(t, ErrFailedDecoder, err, "a bad stream fails the decoder")
+
+	_, s, err = NewDecoder(strings.NewReader("$100\r\nxx")).DecodeFrameOrStream(10)
+	assert.NoError(t, err)
+	_, err = body.ReadFrom(s.Body)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func BenchmarkDecodeFrameMGet1M(b *testing.B) {
+	var reply bytes.Buffer
+	reply.WriteString("*1024\r\n")
+	for i := 0; i < 1024; i++ {
+		reply.WriteString("$1024\r\n" + strings.Repeat("v", 1024) + "\r\n")
+	}
+	r := bytes.NewReader(reply.Bytes())
+	d := NewPooledDecoder(r)
+	defer d.Release()
+	b.SetBytes(int64(reply.Len()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(reply.Bytes())
+		if _, err := d.DecodeFrame(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeFrameUnparsedMGet1M(b *testing.B) {
+	var reply bytes.Buffer
+	reply.WriteString("*1024\r\n")
+	for i := 0; i < 1024; i++ {
+		reply.WriteString("$1024\r\n" + strings.Repeat("v", 1024) + "\r\n")
+	}
+	r := bytes.NewReader(reply.Bytes())
+	d := NewPooledDecoder(r)
+	defer d.Release()
+	b.SetBytes(int64(reply.Len()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(reply.Bytes())
+		if _, err := d.DecodeFrameUnparsed(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
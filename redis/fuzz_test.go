@@ -0,0 +1,117 @@
+//go:build go1.18
+// +build go1.18
+
+package redis
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fuzzSeeds are whole messages of every type, the requests the integration tests
+// send, and the module replies under the handlers' testdata
+var fuzzSeeds = []string{
+	"+OK\r\n",
+	"-ERR unknown command 'JSON.GET'\r\n",
+	":-42\r\n",
+	"$-1\r\n",
+	"$0\r\n\r\n",
+	"*-1\r\n",
+	"*0\r\n",
+	"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nv\r\nv!\r\n",
+	"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	"*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*1\r\n$4\r\nEXEC\r\n",
+	"*2\r\n$9\r\nSUBSCRIBE\r\n$4\r\nnews\r\n",
+	"*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n",
+	"*1\r\n$4\r\nQUIT\r\n",
+	"%2\r\n+first\r\n:1\r\n+second\r\n*2\r\n#t\r\n_\r\n",
+	"~3\r\n+a\r\n,3.14\r\n(3492890328409238509324850943850943825024385\r\n",
+	">3\r\n+message\r\n+channel\r\n$5\r\nhello\r\n",
+	"=15\r\ntxt:Some string\r\n",
+	"!21\r\nSYNTAX invalid syntax\r\n",
+	"|1\r\n+key-popularity\r\n%2\r\n$1\r\na\r\n,0.1923\r\n$1\r\nb\r\n,0.0012\r\n*2\r\n:2039123\r\n:9543892\r\n",
+	"$?\r\n;4\r\nHell\r\n;5\r\no wor\r\n;1\r\nd\r\n;0\r\n",
+	"*?\r\n:1\r\n%?\r\n+a\r\n:2\r\n.\r\n~1\r\n_\r\n.\r\n",
+	"*3\r\n$8\r\nCLUSTER\r\n$5\r\nSLOTS\r\n*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$9\r\n127.0.0.1\r\n:7000\r\n",
+}
+
+func addFuzzSeeds(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	files, _ := filepath.Glob(filepath.Join("..", "handlers", "testdata", "modules", "*.resp"))
+	for _, file := range files {
+		if b, err := os.ReadFile(file); err == nil {
+			f.Add(b)
+		}
+	}
+}
+
+// checkDecodeError fails unless err is the end of the input, or that of bytes
+// that aren't RESP
+func checkDecodeError(t *testing.T, err error) {
+	t.Helper()
+	if err != io.EOF && err != io.ErrUnexpectedEOF && !IsProtocolError(err) {
+		t.Fatalf("unexpected error %v (%T)", err, err)
+	}
+}
+
+// FuzzDecodeFrame decodes arbitrary bytes as the messages clients and upstreams
+// send the proxy: each message read takes exactly the bytes of its frame, parses
+// as a whole, and encodes back to them, and whatever doesn't is a protocol error
+// or input cut short
+func FuzzDecodeFrame(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d := NewDecoder(bytes.NewReader(data))
+		read := 0
+		for {
+			m, err := d.DecodeFrame()
+			if err != nil {
+				checkDecodeError(t, err)
+				if _, again := d.DecodeFrame(); again != ErrFailedDecoder {
+					t.Fatalf("a failed decoder decoded again: %v", again)
+				}
+				return
+			}
+			if !bytes.HasPrefix(data[read:], m.Raw) {
+				t.Fatalf("frame %q isn't the next bytes of the input", m.Raw)
+			}
+			read += len(m.Raw)
+			if _, used, err := parseFrame(m.Raw, 0); err != nil || used != len(m.Raw) {
+				t.Fatalf("frame %q parsed to %d bytes: %v", m.Raw, used, err)
+			}
+			b, err := EncodeToBytes(m)
+			if err != nil || !bytes.Equal(b, m.Raw) {
+				t.Fatalf("frame %q encoded as %q: %v", m.Raw, b, err)
+			}
+		}
+	})
+}
+
+// FuzzDecode decodes arbitrary bytes as the RESP2 replies the proxy reads for
+// itself: decoded messages encode to bytes that decode to the same message
+func FuzzDecode(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d := NewDecoder(bytes.NewReader(data))
+		for {
+			m, err := d.Decode()
+			if err != nil {
+				checkDecodeError(t, err)
+				return
+			}
+			b, err := EncodeToBytes(m)
+			if err != nil {
+				t.Fatalf("message %s didn't encode: %v", m, err)
+			}
+			again, err := DecodeFromBytes(b)
+			if err != nil || again.String() != m.String() {
+				t.Fatalf("message %s encoded as %q, which decodes to %v: %v", m, b, again, err)
+			}
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 )
@@ -13,6 +14,21 @@ const (
 	TypeInt       MsgType = ':'
 	TypeBulkBytes MsgType = '$'
 	TypeArray     MsgType = '*'
+
+	// RESP3 types. The proxy only frames them, so they are relayed intact, but
+	// their parsed form is kept simple: maps and attributes hold their keys and
+	// values alternately in Array, and booleans, doubles and big numbers hold their
+	// text in Value.
+	TypeMap       MsgType = '%'
+	TypeSet       MsgType = '~'
+	TypePush      MsgType = '>'
+	TypeAttribute MsgType = '|'
+	TypeNull      MsgType = '_'
+	TypeBoolean   MsgType = '#'
+	TypeDouble    MsgType = ','
+	TypeBigNumber MsgType = '('
+	TypeVerbatim  MsgType = '='
+	TypeBlobError MsgType = '!'
 )
 
 func (t MsgType) String() string {
@@ -27,6 +43,26 @@ func (t MsgType) String() string {
 		return "<bulkbytes>"
 	case TypeArray:
 		return "<array>"
+	case TypeMap:
+		return "<map>"
+	case TypeSet:
+		return "<set>"
+	case TypePush:
+		return "<push>"
+	case TypeAttribute:
+		return "<attribute>"
+	case TypeNull:
+		return "<null>"
+	case TypeBoolean:
+		return "<boolean>"
+	case TypeDouble:
+		return "<double>"
+	case TypeBigNumber:
+		return "<bignumber>"
+	case TypeVerbatim:
+		return "<verbatim>"
+	case TypeBlobError:
+		return "<bloberror>"
 	default:
 		return fmt.Sprintf("<unknown-0x%02x>", byte(t))
 	}
@@ -37,6 +73,14 @@ type Message struct {
 
 	Value []byte
 	Array []*Message
+
+	// Raw, if set, is the exact wire encoding of the message, which the encoder
+	// writes as is. Messages decoded with DecodeFrame have it, so they are relayed
+	// byte for byte, and must not be modified in place: build a new message instead.
+	Raw []byte
+
+	// unparsed is whether the elements of the aggregate are only in Raw
+	unparsed bool
 }
 
 func (r *Message) IsString() bool {
@@ -44,7 +88,7 @@ func (r *Message) IsString() bool {
 }
 
 func (r *Message) IsError() bool {
-	return r.Type == TypeError
+	return r.Type == TypeError || r.Type == TypeBlobError
 }
 
 func (r *Message) IsInt() bool {
@@ -59,6 +103,12 @@ func (r *Message) IsArray() bool {
 	return r.Type == TypeArray
 }
 
+// Unparsed is whether r is an aggregate decoded by DecodeFrameUnparsed, whose
+// Array is nil until it is Parsed, though it has elements
+func (r *Message) Unparsed() bool {
+	return r.unparsed
+}
+
 // convenience function for testing only
 func (r *Message) String() string {
 	bytes, _ := EncodeToBytes(r)
@@ -72,7 +122,20 @@ func NewString(value []byte) *Message {
 	return r
 }
 
+// NewError returns an error of value, whose line breaks, which an error can't
+// hold, are made spaces as redis does, e.g. in a command a client sent back in
+// the error
 func NewError(value []byte) *Message {
+	if bytes.ContainsAny(value, "\r\n") {
+		clean := make([]byte, len(value))
+		for i, b := range value {
+			if b == '\r' || b == '\n' {
+				b = ' '
+			}
+			clean[i] = b
+		}
+		value = clean
+	}
 	r := &Message{}
 	r.Type = TypeError
 	r.Value = value
@@ -0,0 +1,42 @@
+package redis
+
+import "bytes"
+
+// SlotCount is the number of hash slots a redis cluster divides its keys into
+const SlotCount = 16384
+
+var crc16Table [256]uint16
+
+func init() {
+	for i := range crc16Table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum redis cluster hashes keys with
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^c]
+	}
+	return crc
+}
+
+// KeySlot returns the cluster slot of key. Only the part of the key inside the
+// first non-empty {hash tag} is hashed, so that related keys can share a slot.
+func KeySlot(key []byte) int {
+	if start := bytes.IndexByte(key, '{'); start >= 0 {
+		if end := bytes.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % SlotCount
+}
@@ -0,0 +1,19 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeySlot(t *testing.T) {
+	// slots as reported by CLUSTER KEYSLOT
+	assert.Equal(t, 12182, KeySlot([]byte("foo")))
+	assert.Equal(t, 5061, KeySlot([]byte("bar")))
+	assert.Equal(t, 0, KeySlot([]byte("")))
+	assert.Equal(t, KeySlot([]byte("user1000")), KeySlot([]byte("{user1000}.following")))
+	assert.Equal(t, KeySlot([]byte("user1000")), KeySlot([]byte("foo{user1000}{bar}")))
+	// an empty hash tag hashes the whole key
+	assert.Equal(t, int(crc16([]byte("foo{}{bar}"))%SlotCount), KeySlot([]byte("foo{}{bar}")))
+	assert.Equal(t, 0x31C3, int(crc16([]byte("123456789"))))
+}
@@ -1,12 +1,28 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/auth"
+	"github.com/coinbase/redisbetween/discovery"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/memwatch"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/overrides"
+	"github.com/coinbase/redisbetween/panics"
 	"github.com/coinbase/redisbetween/proxy"
+	"github.com/coinbase/redisbetween/session"
+	"github.com/coinbase/redisbetween/shutdown"
 	"github.com/DataDog/datadog-go/statsd"
 	"go.uber.org/zap/zapcore"
+	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -17,15 +33,10 @@ import (
 )
 
 func main() {
-	c := config.ParseFlags()
-	log := newLogger(c.Level, c.Pretty)
-	err := run(log, c)
-	if err != nil {
-		log.Panic("error", zap.Error(err))
-	}
+	os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
 }
 
-func newLogger(level zapcore.Level, pretty bool) *zap.Logger {
+func newLogger(level zapcore.Level, pretty bool) (*zap.Logger, zap.AtomicLevel) {
 	var c zap.Config
 	if pretty {
 		c = zap.NewDevelopmentConfig()
@@ -43,64 +54,453 @@ func newLogger(level zapcore.Level, pretty bool) *zap.Logger {
 		os.Exit(1)
 	}
 
-	return log
+	return log, c.Level
 }
 
-func run(log *zap.Logger, cfg *config.Config) error {
-	proxies, err := proxies(cfg, log)
+// newAccessLogger returns the logger of the access log, writing JSON lines to
+// path apart from the operational log. None of its entries are sampled away, as
+// the access log samples requests itself.
+func newAccessLogger(path string) (*zap.Logger, error) {
+	c := zap.NewProductionConfig()
+	c.EncoderConfig.MessageKey = "message"
+	c.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	c.OutputPaths = []string{path}
+	c.Sampling = nil
+	c.DisableCaller = true
+	c.DisableStacktrace = true
+	return c.Build()
+}
+
+func run(log *zap.Logger, level zap.AtomicLevel, cfg *config.Config) error {
+	started := time.Now()
+	if err := proxy.CheckSocketPaths(cfg); err != nil {
+		log.Fatal("Startup error", zap.Error(err))
+	}
+	sd, proxies, err := proxies(cfg, log)
 	if err != nil {
 		log.Fatal("Startup error", zap.Error(err))
 	}
+	sockets := proxy.NewDiscovery(log, cfg.DiscoveryFile)
+
+	// listeners of different databases of one upstream share their caches, which
+	// FLUSHALL and SWAPDB clear across databases
+	databases := handlers.NewDatabases()
+
+	var sessions *session.Recorder
+	if cfg.SessionDir != "" {
+		sessions = session.NewRecorder(cfg.SessionDir, cfg.SessionMaxBytes, cfg.SessionMaxFiles)
+	}
+
+	quit := make(chan interface{})
+	var memory *memwatch.Watchdog
+	if !cfg.MemorySoftLimit.IsZero() || !cfg.MemoryHardLimit.IsZero() {
+		memory, err = memwatch.New(log, sd, memwatch.Options{Soft: cfg.MemorySoftLimit, Hard: cfg.MemoryHardLimit, ShedBytes: cfg.MemoryShedBytes})
+		if err != nil {
+			log.Fatal("Startup error", zap.Error(err))
+		}
+		go memory.Run(quit)
+	}
+
+	var provider auth.Provider
+	if cfg.ClientAuth.Provider != "" {
+		provider, err = clientAuth(log, sd, cfg.ClientAuth)
+		if err != nil {
+			log.Fatal("Startup error", zap.Error(err))
+		}
+	}
+
+	var accessLog *zap.Logger
+	if cfg.AccessLog.Path != "" {
+		accessLog, err = newAccessLogger(cfg.AccessLog.Path)
+		if err != nil {
+			log.Fatal("Startup error", zap.Error(err))
+		}
+		defer func() { _ = accessLog.Sync() }()
+	}
+
+	// wire readies a proxy before it runs, both the first ones and those a
+	// reload starts
+	wire := func(p *proxy.Proxy) {
+		sockets.Register(p)
+		p.ShareDatabases(databases)
+		if sessions != nil {
+			p.RecordSessions(sessions)
+		}
+		if memory != nil {
+			p.WatchMemory(memory)
+		}
+		if provider != nil {
+			p.AuthenticateClients(provider)
+		}
+		if accessLog != nil {
+			p.LogAccess(accessLog, handlers.AccessLogOptions{SampleRate: cfg.AccessLog.SampleRate, Errors: cfg.AccessLog.Errors, KeyBytes: cfg.AccessLog.KeyBytes})
+		}
+	}
+	for _, p := range proxies {
+		wire(p)
+	}
+
+	store := runtimeOverrides(log, level, cfg, proxies)
+	go store.Run(time.Second, quit)
 
 	var wg sync.WaitGroup
 	defer func() {
 		wg.Wait()
 	}()
 
-	for _, p := range proxies {
-		p := p
+	live := &liveProxies{log: log, sd: sd, quit: quit, sockets: sockets, store: store, wire: wire, running: &wg, cfg: cfg, proxies: proxies}
+
+	var watchdog *proxy.Watchdog
+	if w := cfg.Watchdog; w.Interval > 0 {
+		watchdog = proxy.NewWatchdog(log, sd, cfg.Network, proxy.WatchdogOptions{Interval: w.Interval, Timeout: w.Timeout, Failures: w.Failures, ExitCode: w.ExitCode}, proxies)
+	}
+
+	drain := proxy.NewDrainReport(proxies)
+	live.watchdog, live.drain = watchdog, drain
+	// the admin server starts before the proxies, so that /healthz answers 503
+	// while they start, and stops last
+	var adminServer *admin.Server
+	if cfg.AdminAddress != "" {
+		opts, err := adminOptions(cfg.AdminAuth)
+		if err != nil {
+			log.Fatal("Startup error", zap.Error(err))
+		}
+		adminServer = admin.New(log, cfg.AdminAddress, opts)
+		adminServer.HandleJSON("/stats", func() interface{} {
+			proxies := live.All()
+			stats := make([]proxy.Stats, len(proxies))
+			for i, p := range proxies {
+				stats[i] = p.Stats()
+			}
+			res := map[string]interface{}{"proxies": stats}
+			if budget := proxy.ConnectionBudgetStats(); budget != nil {
+				res["connection_budget"] = budget
+			}
+			return res
+		})
+		adminServer.HandleJSON("/stats/schema", func() interface{} {
+			return proxy.StatsSchema()
+		})
+		adminServer.HandleJSON("/sockets", func() interface{} {
+			return map[string]interface{}{"sockets": sockets.Sockets()}
+		})
+		adminServer.HandleJSON("/config", func() interface{} {
+			res := map[string]interface{}{"settings": store.Settings()}
+			if pending := live.Pending(); pending != nil {
+				res["pending_reload"] = pending
+			}
+			return res
+		})
+		adminServer.Handle("/config/reload/cancel", pendingReloadHandler(live))
+		adminServer.Handle("/healthz", proxy.HealthHandler(watchdog, drain))
+		adminServer.Handle("/drain", proxy.DrainHandler(drain))
+		adminServer.Handle("/drain/status", proxy.DrainHandler(drain))
+		adminServer.Handle("/undrain", proxy.DrainHandler(drain))
+		adminServer.Handle("/readyz", liveHandler(live, func(proxies []*proxy.Proxy) http.Handler {
+			return proxy.ReadyHandler(proxies, watchdog, drain, cfg.ReadyTimeout)
+		}))
+		adminServer.Handle("/overrides", store.Handler())
+		adminServer.Handle("/traces", liveHandler(live, proxy.TracesHandler))
+		adminServer.Handle("/topology", liveHandler(live, proxy.TopologyHandler))
+		adminServer.Handle("/hotspots", liveHandler(live, proxy.HotspotsHandler))
+		adminServer.Handle("/slowlog", liveHandler(live, proxy.SlowLogHandler))
+		adminServer.Handle("/pooladvice", liveHandler(live, proxy.PoolAdviceHandler))
+		adminServer.Handle("/pooladvice/reset", liveHandler(live, proxy.PoolAdviceHandler))
+		adminServer.Handle("/warnings", liveHandler(live, proxy.WarningsHandler))
+		if sessions != nil {
+			adminServer.Handle("/sessions", sessions.Handler())
+		}
+		adminServer.Handle("/support-bundle", supportBundler(live, store, sockets, started).Handler())
+		if cfg.AdminPprof {
+			adminServer.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
+			adminServer.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+			adminServer.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+			adminServer.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+			adminServer.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+		}
 		wg.Add(1)
 		go func() {
-			err := p.Run()
+			err := adminServer.Run()
 			if err != nil {
-				log.Error("Error", zap.Error(err))
+				log.Error("Admin server error", zap.Error(err))
 			}
 			wg.Done()
 		}()
 	}
 
-	shutdown := func() {
-		for _, p := range proxies {
-			p.Shutdown()
-		}
+	for _, p := range proxies {
+		live.start(p)
 	}
+	if watchdog != nil {
+		go watchdog.Run(quit)
+	}
+	var publisher *discovery.Publisher
+	if cfg.Registrar.Backend != "" {
+		publisher = publishListeners(log, sd, cfg.Registrar, sockets, func() (bool, string) { return proxy.Health(watchdog, drain) })
+		go publisher.Run()
+	}
+
 	kill := func() {
-		for _, p := range proxies {
+		for _, p := range live.All() {
 			p.Kill()
 		}
+		if adminServer != nil {
+			_ = adminServer.Close()
+		}
+	}
+	// a signal and a hand off may both ask for the shutdown
+	var shutdownOnce sync.Once
+	gracefulShutdown := func() {
+		shutdownOnce.Do(func() {
+			phases := shutdownPhases(log, cfg, quit, live.Stopped, drain, publisher, sd, adminServer)
+			if err := shutdown.Run(log, cfg.ShutdownTimeout, kill, phases...); err != nil {
+				_ = log.Sync() // #nosec
+				os.Exit(1)
+			}
+		})
 	}
-	shutdownOnSignal(log, shutdown, kill)
+	shutdownOnSignal(log, gracefulShutdown, kill)
+	shutdownOnHandOff(log, live, quit, gracefulShutdown)
+	reloadOnSignal(log, live)
 
 	log.Info("Running")
 
 	return nil
 }
 
-func proxies(c *config.Config, log *zap.Logger) (proxies []*proxy.Proxy, err error) {
-	s, err := statsd.New(c.Statsd, statsd.WithNamespace("redisbetween"))
+// publishListeners registers every listener with the registrar, with a health
+// check passing while health does
+func publishListeners(log *zap.Logger, sd *statsd.Client, cfg config.Registrar, sockets *proxy.Discovery, health func() (bool, string)) *discovery.Publisher {
+	version := proxy.Version()
+	// the only backend so far
+	registrar := discovery.NewConsul(cfg.Address, os.Getenv("CONSUL_HTTP_TOKEN"))
+	publisher := discovery.NewPublisher(log.With(zap.String("registrar", cfg.Backend)), sd, registrar, cfg.TTL, func() []discovery.Registration {
+		return sockets.Registrations(version)
+	}, health)
+	sockets.OnChange(publisher.Refresh)
+	return publisher
+}
+
+// shutdownPhases stops the process in an order in which nothing waits on
+// something already stopped: listeners are deregistered from service discovery,
+// stop accepting, client connections drain, pools close, metrics are flushed,
+// and the admin server stops last so that it can be queried throughout. What
+// the drain waits for is reported by drain, and proxies returns the proxies
+// running once quit is closed.
+func shutdownPhases(log *zap.Logger, cfg *config.Config, quit chan interface{}, proxies func() []*proxy.Proxy, drain *proxy.DrainReport, publisher *discovery.Publisher, sd *statsd.Client, adminServer *admin.Server) []shutdown.Phase {
+	var phases []shutdown.Phase
+	if publisher != nil {
+		phases = append(phases, shutdown.Phase{Name: "deregister", Run: publisher.Close})
+	}
+	phases = append(phases, []shutdown.Phase{
+		{Name: "stop accepting", Run: func(context.Context) error {
+			close(quit)
+			for _, p := range proxies() {
+				p.Shutdown()
+			}
+			return nil
+		}},
+		{Name: "drain", Run: func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, cfg.DrainTimeout)
+			defer cancel()
+			deadline, _ := ctx.Deadline()
+			drain.Start(deadline)
+			done := make(chan struct{})
+			defer close(done)
+			go drain.LogUntil(log, done)
+			for _, p := range proxies() {
+				if err := p.Drain(ctx); err != nil {
+					log.Warn("Drain timed out, force closing client connections", zap.Duration("timeout", cfg.DrainTimeout))
+					for _, p := range proxies() {
+						p.Kill()
+					}
+					return err
+				}
+			}
+			return nil
+		}},
+		{Name: "close pools", Run: func(ctx context.Context) error {
+			for _, p := range proxies() {
+				if err := p.ClosePools(ctx); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{Name: "flush metrics", Run: func(context.Context) error {
+			for _, p := range proxies() {
+				if err := p.CloseMetrics(); err != nil {
+					return err
+				}
+			}
+			return sd.Close()
+		}},
+	}...)
+	if adminServer != nil {
+		phases = append(phases, shutdown.Phase{Name: "stop admin server", Run: adminServer.Shutdown})
+	}
+	return phases
+}
+
+// runtimeOverrides registers the settings that can be changed through the admin
+// server, and reapplies the overrides persisted by the previous run
+func runtimeOverrides(log *zap.Logger, level zap.AtomicLevel, cfg *config.Config, proxies []*proxy.Proxy) *overrides.Store {
+	store := overrides.New(log, cfg.StateFile)
+	store.Register("loglevel", cfg.Level.String(), func(value string) error {
+		var l zapcore.Level
+		if err := l.Set(value); err != nil {
+			return fmt.Errorf("invalid loglevel: %s", value)
+		}
+		level.SetLevel(l)
+		return nil
+	})
+	for _, p := range proxies {
+		registerProxyOverrides(store, p)
+	}
+
+	var err error
+	if cfg.IgnoreRuntimeState {
+		err = store.Discard()
+	} else {
+		err = store.Restore()
+	}
 	if err != nil {
-		return nil, err
+		log.Error("Failed to restore runtime state", zap.Error(err))
 	}
-	for _, u := range c.Upstreams {
-		p, err := proxy.NewProxy(log, s, c, u.Label, u.UpstreamConfigHost, u.Database, u.MinPoolSize, u.MaxPoolSize, u.ReadTimeout, u.WriteTimeout)
+	return store
+}
+
+// registerProxyOverrides registers the settings of a proxy that can be changed
+// through the admin server
+func registerProxyOverrides(store *overrides.Store, p *proxy.Proxy) {
+	store.Register("readonly."+p.Name(), strconv.FormatBool(p.ReadOnly()), func(value string) error {
+		enabled, err := strconv.ParseBool(value)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("invalid readonly: %s", value)
+		}
+		p.SetReadOnly(enabled)
+		return nil
+	})
+	if shares := p.Segments(); len(shares) > 0 {
+		store.Register("segments."+p.Name(), formatSegmentShares(shares), func(value string) error {
+			shares, err := config.ParseSegmentShares(value)
+			if err != nil {
+				return err
+			}
+			return p.SetSegmentShares(shares)
+		})
+	}
+}
+
+// unregisterProxyOverrides drops the settings of a proxy that was removed
+func unregisterProxyOverrides(store *overrides.Store, p *proxy.Proxy) {
+	store.Unregister("readonly." + p.Name())
+	store.Unregister("segments." + p.Name())
+}
+
+// formatSegmentShares formats percentages of the pool by segment as
+// config.ParseSegmentShares reads them
+func formatSegmentShares(shares map[string]float64) string {
+	names := make([]string, 0, len(shares))
+	for name := range shares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + ":" + strconv.FormatFloat(shares[name], 'g', -1, 64)
+	}
+	return strings.Join(parts, ",")
+}
+
+func proxies(c *config.Config, log *zap.Logger) (s *statsd.Client, proxies []*proxy.Proxy, err error) {
+	// the address resolves in the background, so neither startup nor the
+	// first requests wait on DNS for it
+	s, _, err = metrics.NewClient(c.Statsd, statsd.WithNamespace("redisbetween"))
+	if err != nil {
+		return nil, nil, err
+	}
+	proxy.SetWarmupConcurrency(c.WarmupConcurrency)
+	panics.SetCrash(c.CrashOnPanic)
+	proxy.SetConnectionBudget(log, s, c.ConnectionBudget)
+	for i := range c.Upstreams {
+		p, err := proxy.NewProxy(log, s, c, &c.Upstreams[i])
+		if err != nil {
+			return nil, nil, err
 		}
 		proxies = append(proxies, p)
 	}
+	proxy.LinkReadFallbacks(c, proxies, proxies)
 	return
 }
 
+// clientAuth builds the auth provider the config picks
+func clientAuth(log *zap.Logger, sd *statsd.Client, c config.ClientAuth) (auth.Provider, error) {
+	switch c.Provider {
+	case config.AuthStatic:
+		return auth.Static(c.Users), nil
+	case config.AuthFile:
+		return auth.NewFile(log, sd, c.File)
+	case config.AuthHTTP:
+		return auth.NewHTTP(log, sd, auth.HTTPOptions{
+			URL:         c.URL,
+			Timeout:     c.Timeout,
+			Retries:     c.Retries,
+			CacheTTL:    c.CacheTTL,
+			NegativeTTL: c.NegativeTTL,
+			FailOpen:    c.FailOpen,
+		}), nil
+	}
+	return nil, fmt.Errorf("invalid authprovider: %s", c.Provider)
+}
+
+// adminOptions loads the admin server's TLS certificates and opens its audit
+// file
+func adminOptions(c config.AdminAuth) (admin.Options, error) {
+	opts := admin.Options{Token: c.Token, AuthReads: c.Reads}
+	if c.TLSCert != "" {
+		tlsConfig, err := admin.TLSConfig(c.TLSCert, c.TLSKey, c.ClientCA)
+		if err != nil {
+			return opts, fmt.Errorf("admin TLS: %w", err)
+		}
+		opts.TLS = tlsConfig
+	}
+	if c.AuditFile != "" {
+		f, err := admin.OpenAuditFile(c.AuditFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.Audit = f
+	}
+	return opts, nil
+}
+
+// shutdownOnHandOff shuts the process down gracefully once successors took over
+// every socket of every proxy with PROXY HANDOFF
+func shutdownOnHandOff(log *zap.Logger, live *liveProxies, quit chan interface{}, shutdownFunc func()) {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			proxies := live.All()
+			handedOff := len(proxies) > 0
+			for _, p := range proxies {
+				handedOff = handedOff && p.HandedOff()
+			}
+			if handedOff {
+				log.Info("Every socket was handed off to a successor, shutting down")
+				shutdownFunc()
+				return
+			}
+		}
+	}()
+}
+
 func shutdownOnSignal(log *zap.Logger, shutdownFunc func(), killFunc func()) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
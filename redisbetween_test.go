@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/internal/workload"
+	"github.com/coinbase/redisbetween/proxy"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/coinbase/redisbetween/shutdown"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeRedis answers every command with +OK, or never answers if stuck is set
+func fakeRedis(t *testing.T, stuck bool) net.Listener {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				d := redis.NewDecoder(conn)
+				for {
+					if _, err := d.Decode(); err != nil {
+						return
+					}
+					if stuck {
+						continue
+					}
+					if _, err := conn.Write([]byte("+OK\r\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return li
+}
+
+type lifecycle struct {
+	cfg         *config.Config
+	proxies     []*proxy.Proxy
+	phases      []shutdown.Phase
+	adminServer *admin.Server
+	adminAddr   string
+	drain       *proxy.DrainReport
+	running     sync.WaitGroup
+}
+
+// startLifecycle runs a proxy for upstream and an admin server the way run does
+func startLifecycle(t *testing.T, dir, upstream string, shutdownTimeout, drainTimeout time.Duration) *lifecycle {
+	cfg := &config.Config{
+		Network:           "unix",
+		LocalSocketPrefix: filepath.Join(dir, "rb-"),
+		LocalSocketSuffix: ".sock",
+		Unlink:            true,
+		Statsd:            "localhost:8125",
+		WarmupConcurrency: config.DefaultWarmupConcurrency,
+		ShutdownTimeout:   shutdownTimeout,
+		DrainTimeout:      drainTimeout,
+		Upstreams: []config.Upstream{{
+			UpstreamConfigHost: upstream,
+			Database:           -1,
+			MinPoolSize:        1,
+			MaxPoolSize:        8,
+			ReadTimeout:        5 * time.Second,
+			WriteTimeout:       5 * time.Second,
+		}},
+	}
+	sd, proxies, err := proxies(cfg, zap.NewNop())
+	assert.NoError(t, err)
+	lc := &lifecycle{cfg: cfg, proxies: proxies}
+	for _, p := range proxies {
+		p := p
+		lc.running.Add(1)
+		go func() {
+			defer lc.running.Done()
+			assert.NoError(t, p.Run())
+		}()
+	}
+
+	lc.adminServer = admin.New(zap.NewNop(), "127.0.0.1:0", admin.Options{})
+	lc.adminServer.HandleJSON("/stats", func() interface{} { return proxies[0].Stats() })
+	lc.drain = proxy.NewDrainReport(proxies)
+	lc.adminServer.Handle("/healthz", proxy.HealthHandler(nil, lc.drain))
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	lc.adminAddr = li.Addr().String()
+	lc.running.Add(1)
+	go func() {
+		defer lc.running.Done()
+		assert.NoError(t, lc.adminServer.Serve(li))
+	}()
+
+	lc.phases = shutdownPhases(zap.NewNop(), cfg, make(chan interface{}), func() []*proxy.Proxy { return proxies }, lc.drain, nil, sd, lc.adminServer)
+	return lc
+}
+
+func (lc *lifecycle) socket() string {
+	return lc.cfg.LocalSocketPrefix + "127.0.0.1-" + lc.cfg.Upstreams[0].UpstreamConfigHost[len("127.0.0.1:"):] + lc.cfg.LocalSocketSuffix
+}
+
+func (lc *lifecycle) kill() {
+	for _, p := range lc.proxies {
+		p.Kill()
+	}
+	_ = lc.adminServer.Close()
+}
+
+func (lc *lifecycle) waitForSocket(t *testing.T) {
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("unix", lc.socket())
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestShutdownUnderLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lifecycle")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	upstream := fakeRedis(t, false)
+	defer func() { _ = upstream.Close() }()
+
+	lc := startLifecycle(t, dir, upstream.Addr().String(), 5*time.Second, 2*time.Second)
+	lc.waitForSocket(t)
+
+	cfg := workload.DefaultConfig()
+	cfg.Concurrency, cfg.Pipeline, cfg.Duration = 16, 4, 100*time.Millisecond
+	dial := func() (net.Conn, error) { return net.Dial("unix", lc.socket()) }
+	res, err := workload.Run(context.Background(), "proxy", dial, cfg)
+	assert.NoError(t, err)
+	assert.Greater(t, res.Ops, int64(0))
+	assert.Equal(t, int64(0), res.Errors)
+
+	// keep the proxy busy until the drain closes the workload's connections
+	cfg.Duration = time.Minute
+	loaded := make(chan error)
+	go func() {
+		_, err := workload.Run(context.Background(), "proxy", dial, cfg)
+		loaded <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	var names []string
+	var adminStatus int
+	for _, phase := range lc.phases {
+		names = append(names, phase.Name)
+	}
+	// the admin server is still queryable once everything before it has stopped
+	checkAdmin := shutdown.Phase{Name: "check admin", Run: func(context.Context) error {
+		res, err := http.Get("http://" + lc.adminAddr + "/stats")
+		if err == nil {
+			adminStatus = res.StatusCode
+			_ = res.Body.Close()
+		}
+		return err
+	}}
+	// the drain report counts the workload's connections, down to zero by the
+	// time the drain is over and before the listener closes its pools
+	var drained proxy.DrainStatus
+	var healthStatus int
+	checkDrained := shutdown.Phase{Name: "check drained", Run: func(context.Context) error {
+		drained, _ = lc.drain.Status()
+		res, err := http.Get("http://" + lc.adminAddr + "/healthz")
+		if err == nil {
+			healthStatus = res.StatusCode
+			_ = res.Body.Close()
+		}
+		return err
+	}}
+	var draining int64
+	stopWatching := make(chan struct{})
+	go func() {
+		for {
+			if s, ok := lc.drain.Status(); ok && s.Upstreams[0].Clients > atomic.LoadInt64(&draining) {
+				atomic.StoreInt64(&draining, s.Upstreams[0].Clients)
+			}
+			select {
+			case <-stopWatching:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	last := len(lc.phases) - 1
+	phases := append([]shutdown.Phase{lc.phases[0], lc.phases[1], checkDrained}, lc.phases[2:last]...)
+	phases = append(phases, checkAdmin, lc.phases[last])
+
+	start := time.Now()
+	assert.NoError(t, shutdown.Run(zap.NewNop(), lc.cfg.ShutdownTimeout, lc.kill, phases...))
+	assert.Less(t, int64(time.Since(start)), int64(lc.cfg.DrainTimeout), "busy connections close once their command is answered")
+	assert.Equal(t, []string{"stop accepting", "drain", "close pools", "flush metrics", "stop admin server"}, names)
+	assert.Equal(t, http.StatusOK, adminStatus)
+	close(stopWatching)
+	assert.Greater(t, atomic.LoadInt64(&draining), int64(0), "the workload's connections were drained")
+	assert.Equal(t, []proxy.UpstreamDrain{{
+		Upstream:      lc.cfg.Upstreams[0].UpstreamConfigHost,
+		Local:         lc.socket(),
+		ActivityStats: handlers.ActivityStats{Pinned: map[string]int64{"pipeline": 0}},
+	}}, drained.Upstreams)
+	assert.Greater(t, drained.Remaining, float64(0))
+	assert.Equal(t, http.StatusServiceUnavailable, healthStatus)
+
+	select {
+	case err := <-loaded:
+		assert.Error(t, err, "the workload's connections were closed")
+	case <-time.After(time.Second):
+		t.Fatal("workload connections were not closed")
+	}
+	done := make(chan struct{})
+	go func() {
+		lc.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("proxy and admin server did not stop")
+	}
+	_, err = net.Dial("unix", lc.socket())
+	assert.Error(t, err, "no longer accepting")
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lifecycle")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	upstream := fakeRedis(t, true)
+	defer func() { _ = upstream.Close() }()
+
+	lc := startLifecycle(t, dir, upstream.Addr().String(), time.Second, 300*time.Millisecond)
+	lc.waitForSocket(t)
+
+	// a command the upstream never answers holds its connection past the drain
+	// timeout, and its pool connection past the shutdown deadline
+	conn, err := net.Dial("unix", lc.socket())
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"))
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	assert.Equal(t, shutdown.ErrDeadline, shutdown.Run(zap.NewNop(), lc.cfg.ShutdownTimeout, lc.kill, lc.phases...))
+	assert.Less(t, int64(time.Since(start)), int64(lc.cfg.ShutdownTimeout+200*time.Millisecond))
+}
+
+func TestCheck(t *testing.T) {
+	upstream := fakeRedis(t, false)
+	defer func() { _ = upstream.Close() }()
+	closed := fakeRedis(t, false)
+	_ = closed.Close()
+
+	each := func(label, address string, identity config.Identity) config.Upstream {
+		return config.Upstream{
+			UpstreamConfigHost: address,
+			Label:              label,
+			Database:           -1,
+			MaxPoolSize:        1,
+			ReadTimeout:        time.Second,
+			WriteTimeout:       time.Second,
+			Identity:           identity,
+		}
+	}
+	cfg := &config.Config{
+		Statsd:            "localhost:8125",
+		WarmupConcurrency: config.DefaultWarmupConcurrency,
+		Upstreams: []config.Upstream{
+			each("reachable", upstream.Addr().String(), config.Identity{}),
+			// the fake answers the canary's GET with +OK, not the value
+			each("misconfigured", upstream.Addr().String(), config.Identity{Key: "cache-eu-1"}),
+			each("down", closed.Addr().String(), config.Identity{}),
+		},
+	}
+	var out strings.Builder
+	assert.Equal(t, 1, preflight(zap.NewNop(), cfg, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, "ok   reachable", lines[0])
+	assert.Equal(t, `FAIL misconfigured: identity key check failed, __redisbetween_identity__ is not set, expected "cache-eu-1"`, lines[1])
+	assert.Contains(t, lines[2], "FAIL down: ")
+
+	cfg.Upstreams = cfg.Upstreams[:1]
+	assert.Equal(t, 0, preflight(zap.NewNop(), cfg, &out))
+}
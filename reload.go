@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/admin"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/overrides"
+	"github.com/coinbase/redisbetween/proxy"
+	"go.uber.org/zap"
+)
+
+// liveProxies are the running proxies, one for each upstream of the config in
+// order, which a reload of the config file on SIGHUP changes
+type liveProxies struct {
+	log     *zap.Logger
+	sd      *statsd.Client
+	quit    chan interface{}
+	sockets *proxy.Discovery
+	store   *overrides.Store
+	// wire readies a new proxy the way run does the first ones, and running
+	// is what run waits on
+	wire    func(p *proxy.Proxy)
+	running *sync.WaitGroup
+
+	// watchdog and drain check and report on the proxies, and are told about
+	// those a reload starts
+	watchdog *proxy.Watchdog
+	drain    *proxy.DrainReport
+
+	reloadLock sync.Mutex
+	mu         sync.Mutex
+	cfg        *config.Config
+	proxies    []*proxy.Proxy
+	// pending is the reload received and waiting for its jitter, if any
+	pending *pendingReload
+}
+
+// pendingReload is a reload received on SIGHUP that waits for its jitter to be
+// applied, with the upstreams read from the config file as it was received and
+// how they differ from those running then
+type pendingReload struct {
+	ReceivedAt time.Time `json:"received_at"`
+	ApplyAt    time.Time `json:"apply_at"`
+	Added      []string  `json:"added"`
+	Removed    []string  `json:"removed"`
+	Changed    []string  `json:"changed"`
+	Unchanged  int       `json:"unchanged"`
+
+	upstreams []config.Upstream
+	timer     *time.Timer
+}
+
+// All returns the proxies running now
+func (l *liveProxies) All() []*proxy.Proxy {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.proxies
+}
+
+// Config returns the config the proxies running now were started with
+func (l *liveProxies) Config() *config.Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg
+}
+
+// Stopped returns the proxies running once quit is closed, waiting for a
+// reload in progress to finish, which none starts after
+func (l *liveProxies) Stopped() []*proxy.Proxy {
+	l.reloadLock.Lock()
+	defer l.reloadLock.Unlock()
+	return l.All()
+}
+
+// stopping is whether quit is closed, after which nothing is reloaded
+func (l *liveProxies) stopping() bool {
+	select {
+	case <-l.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// start runs a proxy, as part of what run waits on
+func (l *liveProxies) start(p *proxy.Proxy) {
+	l.running.Add(1)
+	go func() {
+		defer l.running.Done()
+		if err := p.Run(); err != nil {
+			l.log.Error("Error", zap.Error(err))
+		}
+	}()
+}
+
+// upstreamDiff is how a reloaded list of upstreams differs from the running
+// one. previous holds, for each reloaded upstream, the index of the running one
+// of the same address and database, or -1 for one that was added, and changed
+// whether its config differs from that one's. removed are the indices of the
+// running upstreams that are gone.
+type upstreamDiff struct {
+	previous []int
+	changed  []bool
+	removed  []int
+}
+
+// summary names the upstreams added, removed and changed, and counts those
+// unchanged
+func (d upstreamDiff) summary(running, reloaded []config.Upstream) (added, removed, changed []string, unchanged int) {
+	added, removed, changed = []string{}, []string{}, []string{}
+	for i, u := range reloaded {
+		switch {
+		case d.previous[i] < 0:
+			added = append(added, upstreamName(u))
+		case d.changed[i]:
+			changed = append(changed, upstreamName(u))
+		default:
+			unchanged++
+		}
+	}
+	for _, j := range d.removed {
+		removed = append(removed, upstreamName(running[j]))
+	}
+	return
+}
+
+// upstreamName is the name of the proxy of an upstream, by its label if it has
+// one
+func upstreamName(u config.Upstream) string {
+	if u.Label != "" {
+		return u.Label
+	}
+	return u.UpstreamConfigHost
+}
+
+func upstreamKey(u config.Upstream) string {
+	return u.UpstreamConfigHost + "/" + strconv.Itoa(u.Database)
+}
+
+func diffUpstreams(running, reloaded []config.Upstream) upstreamDiff {
+	index := make(map[string]int, len(running))
+	for i, u := range running {
+		index[upstreamKey(u)] = i
+	}
+	d := upstreamDiff{previous: make([]int, len(reloaded)), changed: make([]bool, len(reloaded))}
+	kept := make(map[int]bool, len(reloaded))
+	for i, u := range reloaded {
+		j, ok := index[upstreamKey(u)]
+		if !ok {
+			d.previous[i] = -1
+			continue
+		}
+		d.previous[i], d.changed[i] = j, !reflect.DeepEqual(running[j], u)
+		kept[j] = true
+	}
+	for i := range running {
+		if !kept[i] {
+			d.removed = append(d.removed, i)
+		}
+	}
+	return d
+}
+
+// received reads the upstreams from the config file again for a reload, which
+// is applied at once without -reloadjitter, and otherwise once its jitter is
+// up. A reload received while another is pending replaces it.
+func (l *liveProxies) received() error {
+	if l.stopping() {
+		return errors.New("shutting down")
+	}
+	cfg := l.Config()
+	upstreams, err := cfg.ReloadUpstreams()
+	if err != nil {
+		return l.reloadFailed(err)
+	}
+	s := cfg.StaggeredReload
+	if s.Jitter <= 0 {
+		return l.apply(upstreams)
+	}
+	now := time.Now()
+	r := &pendingReload{ReceivedAt: now, ApplyAt: now.Add(reloadJitter(s)), upstreams: upstreams}
+	d := diffUpstreams(cfg.Upstreams, upstreams)
+	r.Added, r.Removed, r.Changed, r.Unchanged = d.summary(cfg.Upstreams, upstreams)
+
+	l.mu.Lock()
+	if prev := l.pending; prev != nil {
+		prev.timer.Stop()
+	}
+	l.pending = r
+	r.timer = time.AfterFunc(r.ApplyAt.Sub(now), func() {
+		l.mu.Lock()
+		due := l.pending == r
+		if due {
+			l.pending = nil
+		}
+		l.mu.Unlock()
+		if due {
+			_ = l.apply(r.upstreams)
+		}
+	})
+	l.mu.Unlock()
+	l.log.Info("Reload received, waiting for its jitter", zap.Time("apply_at", r.ApplyAt), zap.Strings("added", r.Added), zap.Strings("removed", r.Removed), zap.Strings("changed", r.Changed))
+	return nil
+}
+
+// Pending returns the reload waiting for its jitter, nil if there is none
+func (l *liveProxies) Pending() *pendingReload {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pending
+}
+
+// Cancel drops the reload waiting for its jitter, and returns it, nil if there
+// was none
+func (l *liveProxies) Cancel() *pendingReload {
+	l.mu.Lock()
+	r := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	if r == nil {
+		return nil
+	}
+	r.timer.Stop()
+	l.log.Info("Cancelled pending reload", zap.Time("received_at", r.ReceivedAt))
+	metrics.ConfigReloads.Incr(l.sd, "cancelled")
+	return r
+}
+
+// reloadJitter is how long a reload waits before it is applied: from 0 up to
+// the jitter, at random, or derived from the host name with ByHost
+func reloadJitter(s config.StaggeredReload) time.Duration {
+	if s.ByHost {
+		if host, err := os.Hostname(); err == nil {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(host))
+			return time.Duration(h.Sum64() % uint64(s.Jitter))
+		}
+	}
+	return time.Duration(rand.Int63n(int64(s.Jitter)))
+}
+
+// reload reads the upstreams from the config file again and applies them
+func (l *liveProxies) reload() error {
+	if l.stopping() {
+		return errors.New("shutting down")
+	}
+	upstreams, err := l.Config().ReloadUpstreams()
+	if err != nil {
+		return l.reloadFailed(err)
+	}
+	return l.apply(upstreams)
+}
+
+// apply applies the difference of the upstreams to the running proxies.
+// Proxies are started for the upstreams added, and those of the upstreams
+// removed are shut down, once their clients are done or after draintimeout. A
+// changed upstream gets a new proxy, which takes over the sockets of the
+// running one, so that they stay up while its pools are rebuilt. Unchanged
+// upstreams are left alone. If the config is invalid nothing changes, and an
+// upstream whose new proxy fails to start keeps its running one.
+func (l *liveProxies) apply(upstreams []config.Upstream) error {
+	l.reloadLock.Lock()
+	defer l.reloadLock.Unlock()
+	if l.stopping() {
+		return errors.New("shutting down")
+	}
+
+	cfg, running := l.Config(), l.All()
+	next := *cfg
+	next.Upstreams = upstreams
+	d := diffUpstreams(cfg.Upstreams, upstreams)
+
+	proxies := make([]*proxy.Proxy, len(upstreams))
+	var fresh []int
+	for i := range upstreams {
+		if j := d.previous[i]; j >= 0 && !d.changed[i] {
+			proxies[i] = running[j]
+			continue
+		}
+		p, err := proxy.NewProxy(l.log, l.sd, &next, &next.Upstreams[i])
+		if err != nil {
+			for _, k := range fresh {
+				proxies[k].Shutdown()
+				_ = proxies[k].CloseMetrics()
+			}
+			return l.reloadFailed(fmt.Errorf("upstream %s: %w", next.Upstreams[i].UpstreamConfigHost, err))
+		}
+		proxies[i] = p
+		fresh = append(fresh, i)
+	}
+	// a changed upstream is only replaced once its new proxy took over
+	targets := append([]*proxy.Proxy(nil), proxies...)
+	for _, i := range fresh {
+		if j := d.previous[i]; j >= 0 {
+			targets[i] = running[j]
+		}
+	}
+	proxy.LinkReadFallbacks(&next, proxies, targets)
+
+	var added, removed, changed []string
+	var failed error
+	for _, i := range fresh {
+		p := proxies[i]
+		l.wire(p)
+		j := d.previous[i]
+		if j < 0 {
+			registerProxyOverrides(l.store, p)
+			l.start(p)
+			added = append(added, p.Name())
+			continue
+		}
+		if err := p.TakeOver(running[j], next.DrainTimeout, next.StaggeredReload.Prewarm); err != nil {
+			l.log.Error("Failed to reload upstream, keeping its running config", zap.String("upstream", running[j].Name()), zap.Error(err))
+			l.sockets.Deregister(p)
+			proxies[i], next.Upstreams[i] = running[j], cfg.Upstreams[j]
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		if running[j].Name() != p.Name() {
+			unregisterProxyOverrides(l.store, running[j])
+		}
+		registerProxyOverrides(l.store, p)
+		l.sockets.Deregister(running[j])
+		changed = append(changed, p.Name())
+	}
+	for _, j := range d.removed {
+		p := running[j]
+		l.sockets.Deregister(p)
+		unregisterProxyOverrides(l.store, p)
+		go l.retire(p, next.DrainTimeout)
+		removed = append(removed, p.Name())
+	}
+
+	l.mu.Lock()
+	l.cfg, l.proxies = &next, proxies
+	l.mu.Unlock()
+	if l.watchdog != nil {
+		l.watchdog.SetProxies(proxies)
+	}
+	l.drain.SetProxies(proxies)
+
+	l.log.Info("Reloaded upstreams", zap.Strings("added", added), zap.Strings("removed", removed), zap.Strings("changed", changed), zap.Int("unchanged", len(upstreams)-len(fresh)))
+	text := fmt.Sprintf("added: %s, removed: %s, changed: %s", names(added), names(removed), names(changed))
+	if failed != nil {
+		text += ", failed: " + failed.Error()
+		metrics.ConfigReloads.Incr(l.sd, "failed")
+		_ = l.sd.Event(&statsd.Event{Title: "redisbetween upstreams partially reloaded", Text: text, AlertType: statsd.Warning})
+		return failed
+	}
+	metrics.ConfigReloads.Incr(l.sd, "ok")
+	_ = l.sd.Event(&statsd.Event{Title: "redisbetween upstreams reloaded", Text: text, AlertType: statsd.Info})
+	return nil
+}
+
+func (l *liveProxies) reloadFailed(err error) error {
+	l.log.Error("Failed to reload upstreams, keeping the running config", zap.Error(err))
+	metrics.ConfigReloads.Incr(l.sd, "failed")
+	_ = l.sd.Event(&statsd.Event{Title: "redisbetween upstreams reload failed", Text: err.Error(), AlertType: statsd.Error})
+	return err
+}
+
+// retire stops the proxy of a removed upstream as the shutdown phases do
+func (l *liveProxies) retire(p *proxy.Proxy, drainTimeout time.Duration) {
+	p.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := p.Drain(ctx); err != nil {
+		l.log.Warn("Drain of removed upstream timed out, force closing client connections", zap.String("upstream", p.Name()), zap.Duration("timeout", drainTimeout))
+		p.Kill()
+	}
+	if err := p.ClosePools(context.Background()); err != nil {
+		l.log.Error("Failed to close pools of removed upstream", zap.String("upstream", p.Name()), zap.Error(err))
+	}
+	_ = p.CloseMetrics()
+	l.log.Info("Removed upstream", zap.String("upstream", p.Name()))
+}
+
+func names(n []string) string {
+	if len(n) == 0 {
+		return "none"
+	}
+	return strings.Join(n, " ")
+}
+
+// reloadOnSignal reloads the upstreams on every SIGHUP, once the jitter of
+// -reloadjitter is up
+func reloadOnSignal(log *zap.Logger, live *liveProxies) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for sig := range c {
+			log.Info("Signal", zap.String("signal", sig.String()))
+			_ = live.received()
+		}
+	}()
+}
+
+// pendingReloadHandler serves POST /config/reload/cancel, which cancels the
+// reload waiting for its jitter
+func pendingReloadHandler(live *liveProxies) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		cancelled := live.Cancel()
+		if cancelled == nil {
+			admin.WriteJSON(rw, http.StatusNotFound, map[string]string{"error": "no reload pending"})
+			return
+		}
+		admin.WriteJSON(rw, http.StatusOK, map[string]interface{}{"cancelled": cancelled})
+	})
+}
+
+// liveHandler serves each request with the handler of the proxies running then
+func liveHandler(live *liveProxies, handler func([]*proxy.Proxy) http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(live.All()).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/overrides"
+	"github.com/coinbase/redisbetween/proxy"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDiffUpstreams(t *testing.T) {
+	running := []config.Upstream{
+		{UpstreamConfigHost: "a:6379", Database: -1, MaxPoolSize: 4},
+		{UpstreamConfigHost: "b:6379", Database: -1},
+		{UpstreamConfigHost: "b:6379", Database: 1},
+	}
+	reloaded := []config.Upstream{
+		{UpstreamConfigHost: "c:6379", Database: -1},
+		{UpstreamConfigHost: "b:6379", Database: 1},
+		{UpstreamConfigHost: "a:6379", Database: -1, MaxPoolSize: 8},
+	}
+	d := diffUpstreams(running, reloaded)
+	assert.Equal(t, []int{-1, 2, 0}, d.previous)
+	assert.Equal(t, []bool{false, false, true}, d.changed)
+	assert.Equal(t, []int{1}, d.removed, "an upstream is the same only for the same database")
+}
+
+func writeUpstreams(t *testing.T, path string, upstreams ...string) {
+	contents := "upstreams:\n"
+	for _, u := range upstreams {
+		contents += "  - " + u + "\n"
+	}
+	assert.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+}
+
+func dials(local string) bool {
+	conn, err := net.Dial("unix", local)
+	if err == nil {
+		_ = conn.Close()
+	}
+	return err == nil
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c := fakeRedis(t, false), fakeRedis(t, false), fakeRedis(t, false)
+	defer func() { _, _, _ = a.Close(), b.Close(), c.Close() }()
+	path := filepath.Join(dir, "config.yaml")
+	writeUpstreams(t, path, fmt.Sprintf("{address: %s, maxpoolsize: 4}", a.Addr()), fmt.Sprintf("{address: %s}", b.Addr()))
+
+	cfg := &config.Config{
+		Network:           "unix",
+		LocalSocketPrefix: filepath.Join(dir, "rb-"),
+		LocalSocketSuffix: ".sock",
+		Unlink:            true,
+		Statsd:            "localhost:8125",
+		WarmupConcurrency: config.DefaultWarmupConcurrency,
+		DrainTimeout:      time.Second,
+		ConfigFile:        path,
+	}
+	upstreams, err := cfg.ReloadUpstreams()
+	assert.NoError(t, err)
+	cfg.Upstreams = upstreams
+	sd, proxies, err := proxies(cfg, zap.NewNop())
+	assert.NoError(t, err)
+
+	sockets := proxy.NewDiscovery(zap.NewNop(), "")
+	store := overrides.New(zap.NewNop(), "")
+	var wg sync.WaitGroup
+	live := &liveProxies{log: zap.NewNop(), sd: sd, quit: make(chan interface{}), sockets: sockets, store: store, wire: sockets.Register,
+		running: &wg, drain: proxy.NewDrainReport(proxies), cfg: cfg, proxies: proxies}
+	for _, p := range proxies {
+		sockets.Register(p)
+		registerProxyOverrides(store, p)
+		live.start(p)
+	}
+	defer func() {
+		for _, p := range live.All() {
+			p.Shutdown()
+		}
+		wg.Wait()
+	}()
+	assert.Eventually(t, func() bool { return len(sockets.Sockets()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	initial := sockets.Sockets()
+	for _, s := range initial {
+		assert.True(t, dials(s.Local))
+	}
+	local := func(upstream string) string {
+		for _, s := range sockets.Sockets() {
+			if s.Upstream == upstream {
+				return s.Local
+			}
+		}
+		return ""
+	}
+	aLocal, bLocal := local(a.Addr().String()), local(b.Addr().String())
+
+	// a changes, b is removed and c added
+	writeUpstreams(t, path, fmt.Sprintf("{address: %s, maxpoolsize: 8}", a.Addr()), fmt.Sprintf("{address: %s}", c.Addr()))
+	assert.NoError(t, live.reload())
+	reloaded := live.All()
+	assert.Len(t, reloaded, 2)
+	assert.NotSame(t, proxies[0], reloaded[0])
+	assert.Equal(t, aLocal, local(a.Addr().String()), "a changed upstream keeps its socket")
+	assert.True(t, dials(aLocal))
+	assert.Equal(t, 8, reloaded[0].Stats().Listeners[0].Pool.MaxSize)
+	assert.Eventually(t, func() bool { return local(c.Addr().String()) != "" && dials(local(c.Addr().String())) }, 2*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return !dials(bLocal) }, 2*time.Second, 10*time.Millisecond, "a removed upstream's socket closes")
+	assert.Equal(t, "", local(b.Addr().String()))
+	var keys []string
+	for _, s := range store.Settings() {
+		keys = append(keys, s.Key)
+	}
+	assert.ElementsMatch(t, []string{"readonly." + a.Addr().String(), "readonly." + c.Addr().String()}, keys)
+
+	// an invalid config changes nothing
+	writeUpstreams(t, path, "{address: nowhere}")
+	assert.EqualError(t, live.reload(), "invalid config "+path+", upstream 1 (nowhere): invalid address nowhere, expected host:port")
+	assert.Equal(t, reloaded, live.All())
+	assert.True(t, dials(aLocal))
+
+	close(live.quit)
+	assert.EqualError(t, live.reload(), "shutting down")
+}
+
+func TestStaggeredReload(t *testing.T) {
+	dir := t.TempDir()
+	a, b := fakeRedis(t, false), fakeRedis(t, false)
+	defer func() { _, _ = a.Close(), b.Close() }()
+	path := filepath.Join(dir, "config.yaml")
+	writeUpstreams(t, path, fmt.Sprintf("{address: %s}", a.Addr()))
+
+	cfg := &config.Config{
+		Network:           "unix",
+		LocalSocketPrefix: filepath.Join(dir, "rb-"),
+		LocalSocketSuffix: ".sock",
+		Unlink:            true,
+		Statsd:            "localhost:8125",
+		WarmupConcurrency: config.DefaultWarmupConcurrency,
+		DrainTimeout:      time.Second,
+		ConfigFile:        path,
+		StaggeredReload:   config.StaggeredReload{Jitter: time.Hour},
+	}
+	upstreams, err := cfg.ReloadUpstreams()
+	assert.NoError(t, err)
+	cfg.Upstreams = upstreams
+	sd, proxies, err := proxies(cfg, zap.NewNop())
+	assert.NoError(t, err)
+	sockets := proxy.NewDiscovery(zap.NewNop(), "")
+	var wg sync.WaitGroup
+	live := &liveProxies{log: zap.NewNop(), sd: sd, quit: make(chan interface{}), sockets: sockets, store: overrides.New(zap.NewNop(), ""), wire: sockets.Register,
+		running: &wg, drain: proxy.NewDrainReport(proxies), cfg: cfg, proxies: proxies}
+	for _, p := range proxies {
+		live.start(p)
+	}
+	defer func() {
+		for _, p := range live.All() {
+			p.Shutdown()
+		}
+		wg.Wait()
+	}()
+
+	// a reload waits for its jitter, showing what it will change
+	writeUpstreams(t, path, fmt.Sprintf("{address: %s}", a.Addr()), fmt.Sprintf("{address: %s}", b.Addr()))
+	assert.NoError(t, live.received())
+	pending := live.Pending()
+	if assert.NotNil(t, pending) {
+		assert.Equal(t, []string{b.Addr().String()}, pending.Added)
+		assert.Empty(t, pending.Changed)
+		assert.Equal(t, 1, pending.Unchanged)
+		assert.True(t, !pending.ApplyAt.Before(pending.ReceivedAt) && pending.ApplyAt.Before(pending.ReceivedAt.Add(time.Hour)))
+	}
+	assert.Len(t, live.All(), 1)
+
+	// and can be cancelled
+	handler := pendingReloadHandler(live)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config/reload/cancel", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/config/reload/cancel", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res struct {
+		Cancelled pendingReload `json:"cancelled"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, []string{b.Addr().String()}, res.Cancelled.Added)
+	assert.Nil(t, live.Pending())
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/config/reload/cancel", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// a reload received while one is pending replaces it, and is applied once
+	// its jitter is up
+	cfg.StaggeredReload.Jitter = time.Hour
+	assert.NoError(t, live.received())
+	first := live.Pending()
+	cfg.StaggeredReload.Jitter = 20 * time.Millisecond
+	assert.NoError(t, live.received())
+	assert.NotSame(t, first, live.Pending())
+	assert.Eventually(t, func() bool { return len(live.All()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	assert.Nil(t, live.Pending())
+}
+
+func TestReloadJitterByHost(t *testing.T) {
+	s := config.StaggeredReload{Jitter: 2 * time.Minute, ByHost: true}
+	d := reloadJitter(s)
+	assert.Equal(t, d, reloadJitter(s), "the jitter of a host is the same on every reload")
+	assert.True(t, d >= 0 && d < s.Jitter)
+}
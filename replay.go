@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coinbase/redisbetween/session"
+)
+
+// replaySession implements `redisbetween replay`, which replays a
+// recorded client session against a target and reports the first reply that
+// differs from the recorded one. It returns the process exit code: 0 if every
+// reply matched, 1 on a divergence or error.
+func replaySession(args []string, stdout, stderr io.Writer) int {
+	var network, target string
+	var opts session.ReplayOptions
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "Usage: redisbetween replay session.jsonl -target localhost:6379 [options]\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&network, "network", "tcp", "One of: tcp, tcp4, tcp6, unix or unixpacket")
+	fs.StringVar(&target, "target", "", "Address of the upstream, or socket of the proxy, to replay against")
+	fs.BoolVar(&opts.Fast, "fast", false, "Replay as fast as possible instead of at the recorded pace")
+	fs.BoolVar(&opts.Signals, "signals", false, "Wrap pipelines in redisbetween's signals, for replaying through a proxy")
+	fs.DurationVar(&opts.Timeout, "timeout", 5*time.Second, "How long to wait for the replies to each request")
+
+	// the file may come before the flags
+	var file string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		file, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if file == "" {
+		file = fs.Arg(0)
+	}
+	if file == "" || target == "" {
+		fs.Usage()
+		return 2
+	}
+
+	s, err := session.ReadFile(file)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "%s: %v\n", file, err)
+		return 1
+	}
+	conn, err := net.Dial(network, target)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer func() { _ = conn.Close() }()
+
+	d, err := session.Replay(conn, s, opts)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if d != nil {
+		_, _ = fmt.Fprintf(stdout, "Diverged at %s\n", d)
+		return 1
+	}
+	_, _ = fmt.Fprintf(stdout, "Replayed %d requests of %s's session on %s, all replies matched\n", len(s.Requests), s.Header.Client, s.Header.Upstream)
+	return 0
+}
@@ -1,6 +1,7 @@
 require 'redisbetween/version'
 require 'redis'
 require 'uri'
+require 'json'
 require 'set'
 
 module Redisbetween
@@ -8,6 +9,34 @@ module Redisbetween
 
   PIPELINE_START_SIGNAL = '🔜'
   PIPELINE_END_SIGNAL = '🔚'
+  DISCOVERY_FILE = '/var/tmp/redisbetween-sockets.json'
+
+  # the codes that prefix the errors redisbetween answers with itself
+  module ErrorCodes
+    PROXY_TIMEOUT = 'PROXYTIMEOUT'
+    PROXY_OVERLOADED = 'PROXYOVERLOADED'
+    PROXY_MAINT = 'PROXYMAINT'
+    PROXY_BLOCKED = 'PROXYBLOCKED'
+    PROXY_AUTH = 'PROXYAUTH'
+    PROXY_UNAVAILABLE = 'PROXYUNAVAILABLE'
+    PROXY_CHECKSUM = 'PROXYCHECKSUM'
+
+    ALL = Set.new([PROXY_TIMEOUT, PROXY_OVERLOADED, PROXY_MAINT, PROXY_BLOCKED, PROXY_AUTH, PROXY_UNAVAILABLE, PROXY_CHECKSUM])
+    RETRYABLE = Set.new([PROXY_TIMEOUT, PROXY_OVERLOADED, PROXY_MAINT, PROXY_UNAVAILABLE])
+
+    # the code of an error, or its message, or nil if it didn't come from the proxy
+    def self.code(error)
+      message = error.respond_to?(:message) ? error.message : error.to_s
+      code = message.delete_prefix('-').split(' ', 2).first
+      ALL.member?(code) ? code : nil
+    end
+
+    # whether a command that failed with code, or with an error carrying one, may
+    # succeed if it is sent again after backing off
+    def self.retryable?(code)
+      RETRYABLE.member?(ALL.member?(code) ? code : self.code(code))
+    end
+  end
 
   module ClientPatch
     attr_reader :redisbetween_enabled
@@ -108,6 +137,21 @@ module Redisbetween
   end
 
   def self.default_socket_path(host, port, path = nil)
+    discovered_socket_path(host, port, path) || derived_socket_path(host, port, path)
+  end
+
+  # the proxy lists the socket of each upstream in its discovery file. prefer that
+  # mapping, and only derive the path when the file is missing or has no entry
+  def self.discovered_socket_path(host, port, path = nil, file = DISCOVERY_FILE)
+    database = path.nil? || path.empty? ? -1 : Integer(path)
+    sockets = JSON.parse(File.read(file)).fetch('sockets')
+    entry = sockets.find { |s| s['upstream'] == "#{host}:#{port}" && s['database'] == database }
+    entry && entry['local']
+  rescue SystemCallError, JSON::ParserError, ArgumentError, KeyError, TypeError
+    nil
+  end
+
+  def self.derived_socket_path(host, port, path = nil)
     ['/var/tmp/redisbetween', host, port, path].compact.join('-') + '.sock'
   end
 end
@@ -45,6 +45,47 @@ RSpec.describe Redisbetween do
       expect(path).to eq("/var/tmp/redisbetween-h-p.sock")
     end
   end
+
+  describe Redisbetween::ErrorCodes do
+    it 'should find the code of a proxy error' do
+      error = Redis::CommandError.new('PROXYOVERLOADED circuit open for upstream node 10.0.0.1:7001, failing fast')
+      expect(Redisbetween::ErrorCodes.code(error)).to eq(Redisbetween::ErrorCodes::PROXY_OVERLOADED)
+      expect(Redisbetween::ErrorCodes.code('-PROXYBLOCKED SUBSCRIBE is unsupported')).to eq(Redisbetween::ErrorCodes::PROXY_BLOCKED)
+      expect(Redisbetween::ErrorCodes.code('ERR redisbetween: SUBSCRIBE is unsupported')).to be_nil
+    end
+
+    it 'should tell retryable codes apart' do
+      expect(Redisbetween::ErrorCodes.retryable?(Redisbetween::ErrorCodes::PROXY_TIMEOUT)).to be true
+      expect(Redisbetween::ErrorCodes.retryable?(Redisbetween::ErrorCodes::PROXY_MAINT)).to be true
+      expect(Redisbetween::ErrorCodes.retryable?(Redisbetween::ErrorCodes::PROXY_UNAVAILABLE)).to be true
+      expect(Redisbetween::ErrorCodes.retryable?(Redisbetween::ErrorCodes::PROXY_AUTH)).to be false
+      expect(Redisbetween::ErrorCodes.retryable?(Redis::CommandError.new('PROXYTIMEOUT upstream did not answer'))).to be true
+      expect(Redisbetween::ErrorCodes.retryable?(Redis::CommandError.new('READONLY You can\'t write against a read only replica.'))).to be false
+    end
+  end
+
+  describe '.discovered_socket_path' do
+    let(:file) do
+      f = Tempfile.new('sockets.json')
+      f.write(JSON.generate(sockets: [
+        { upstream: 'h:7000', database: -1, local: '/run/rb/h-7000.sock' },
+        { upstream: 'h:7000', database: 3, local: '/run/rb/h-7000-3.sock' },
+      ]))
+      f.close
+      f
+    end
+
+    it 'should find the socket of an upstream and db' do
+      expect(Redisbetween.discovered_socket_path('h', 7000, nil, file.path)).to eq('/run/rb/h-7000.sock')
+      expect(Redisbetween.discovered_socket_path('h', 7000, '3', file.path)).to eq('/run/rb/h-7000-3.sock')
+    end
+
+    it 'should return nil for unknown upstreams or a missing file' do
+      expect(Redisbetween.discovered_socket_path('h', 7001, nil, file.path)).to be_nil
+      expect(Redisbetween.discovered_socket_path('h', 7000, '4', file.path)).to be_nil
+      expect(Redisbetween.discovered_socket_path('h', 7000, nil, '/nonexistent/sockets.json')).to be_nil
+    end
+  end
   
   describe Redisbetween::ClientPatch do
     it 'should point the client to a socket when given a url' do
@@ -1,6 +1,7 @@
 require "bundler/setup"
 require "redisbetween"
 require 'logger'
+require 'tempfile'
 
 RSpec.configure do |config|
   # Enable flags like --only-failures and --next-failure
@@ -0,0 +1,86 @@
+// Package sanitize maps arbitrary strings (upstream labels, hosts, keys) onto the
+// restricted character sets accepted by statsd tags and filesystem paths.
+//
+// The mapping is deterministic: every byte outside the allowed set is replaced
+// with an underscore, and if anything was replaced (or the value was truncated)
+// a short FNV-1a hash of the original value is appended so that distinct inputs
+// such as "🔑:user:1" and "🔒:user:1" never collapse onto the same output.
+// Values that are already safe are returned unchanged.
+package sanitize
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// MaxTagValueLength caps the length of a sanitized tag value. statsd backends
+// silently truncate long tags, which would otherwise destroy the hash suffix.
+const MaxTagValueLength = 128
+
+const replacement = '_'
+
+// Tag returns "name:value" with value made safe for use as a statsd tag.
+func Tag(name, value string) string {
+	return name + ":" + TagValue(value)
+}
+
+// TagValue makes value safe for use as (part of) a statsd tag. Allowed
+// characters are ASCII letters, digits, '_', '-', ':', '.' and '/'.
+func TagValue(value string) string {
+	return clean(value, isTagByte, MaxTagValueLength)
+}
+
+// PathComponent makes value safe for use as part of a file name. Allowed
+// characters are ASCII letters, digits, '_', '-' and '.'.
+func PathComponent(value string) string {
+	return clean(value, isPathByte, 0)
+}
+
+func clean(value string, allowed func(byte) bool, max int) string {
+	var b strings.Builder
+	changed := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if allowed(c) {
+			b.WriteByte(c)
+			continue
+		}
+		changed = true
+		// collapse a multibyte rune into a single replacement character
+		if c >= 0x80 {
+			for i+1 < len(value) && value[i+1]&0xC0 == 0x80 {
+				i++
+			}
+		}
+		b.WriteByte(replacement)
+	}
+	out := b.String()
+
+	suffix := ""
+	if changed || (max > 0 && len(out) > max) {
+		suffix = fmt.Sprintf("%c%08x", replacement, hash(value))
+	}
+	if max > 0 && len(out)+len(suffix) > max {
+		out = out[:max-len(suffix)]
+	}
+	return out + suffix
+}
+
+func hash(value string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(value))
+	return h.Sum32()
+}
+
+func isAlphaNum(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func isTagByte(c byte) bool {
+	return isAlphaNum(c) || c == '_' || c == '-' || c == ':' || c == '.' || c == '/'
+}
+
+func isPathByte(c byte) bool {
+	return isAlphaNum(c) || c == '_' || c == '-' || c == '.'
+}
@@ -0,0 +1,46 @@
+package sanitize
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var validTag = regexp.MustCompile(`^[A-Za-z0-9_\-:./]+$`)
+var validPath = regexp.MustCompile(`^[A-Za-z0-9_\-.]+$`)
+
+func TestTagValueUnchangedWhenSafe(t *testing.T) {
+	assert.Equal(t, "127.0.0.1:7000", TagValue("127.0.0.1:7000"))
+	assert.Equal(t, "upstream:cluster-1", Tag("upstream", "cluster-1"))
+	assert.Equal(t, "/var/tmp/redisbetween-127.0.0.1-7006.sock", TagValue("/var/tmp/redisbetween-127.0.0.1-7006.sock"))
+}
+
+func TestTagValueMultibyte(t *testing.T) {
+	v := TagValue("🔑:user:1")
+	assert.Regexp(t, validTag, v)
+	assert.True(t, strings.HasPrefix(v, "_:user:1_"), v)
+	assert.Equal(t, v, TagValue("🔑:user:1"), "mapping must be stable")
+	assert.NotEqual(t, v, TagValue("🔒:user:1"), "distinct inputs must not collide")
+
+	assert.Regexp(t, validTag, TagValue("🔜"))
+	assert.Regexp(t, validTag, TagValue("a b,c|d#e@f"))
+}
+
+func TestTagValueTruncation(t *testing.T) {
+	long := strings.Repeat("a", 500)
+	v := TagValue(long)
+	assert.Len(t, v, MaxTagValueLength)
+	assert.NotEqual(t, v, TagValue(long+"b"))
+}
+
+func TestPathComponent(t *testing.T) {
+	assert.Equal(t, "example.com-6379", PathComponent("example.com-6379"))
+
+	v := PathComponent("🔑:user:1")
+	assert.Regexp(t, validPath, v)
+	assert.Equal(t, v, PathComponent("🔑:user:1"))
+	assert.NotEqual(t, v, PathComponent("🔒:user:1"))
+	assert.NotContains(t, PathComponent("../../etc/passwd"), "/")
+}
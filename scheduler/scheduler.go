@@ -0,0 +1,103 @@
+// Package scheduler runs periodic background work, such as metric flushes, for
+// every upstream on one goroutine, so that idle cost doesn't grow with the number
+// of upstreams.
+package scheduler
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultSlots is the number of slots an interval is divided into
+const DefaultSlots = 10
+
+// Default is the process wide scheduler, running each task once a second
+var Default = New(time.Second, DefaultSlots)
+
+type task struct {
+	fn func()
+}
+
+// Scheduler runs each task once per interval. The interval is divided into slots
+// and each task is placed in the least loaded one, ties broken at random, so that
+// hundreds of upstreams spread their work over the interval rather than all
+// waking at once.
+type Scheduler struct {
+	interval time.Duration
+	once     sync.Once
+	mu       sync.Mutex
+	slots    [][]*task
+}
+
+func New(interval time.Duration, slots int) *Scheduler {
+	if slots < 1 {
+		slots = 1
+	}
+	return &Scheduler{interval: interval, slots: make([][]*task, slots)}
+}
+
+// Add schedules fn to run once per interval until the returned remove is called.
+// The scheduler's goroutine starts with the first task and then runs for the
+// life of the process. fn runs on that goroutine, so it must not block.
+func (s *Scheduler) Add(fn func()) (remove func()) {
+	s.once.Do(func() { go s.run() })
+
+	t := &task{fn: fn}
+	s.mu.Lock()
+	slot := s.leastLoaded()
+	s.slots[slot] = append(s.slots[slot], t)
+	s.mu.Unlock()
+
+	var removeOnce sync.Once
+	return func() {
+		removeOnce.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			tasks := s.slots[slot]
+			for i := range tasks {
+				if tasks[i] == t {
+					s.slots[slot] = append(tasks[:i:i], tasks[i+1:]...)
+					return
+				}
+			}
+		})
+	}
+}
+
+// Len returns the number of scheduled tasks
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, tasks := range s.slots {
+		n += len(tasks)
+	}
+	return n
+}
+
+func (s *Scheduler) leastLoaded() int {
+	start := rand.Intn(len(s.slots)) // #nosec
+	best := start
+	for i := 1; i < len(s.slots); i++ {
+		j := (start + i) % len(s.slots)
+		if len(s.slots[j]) < len(s.slots[best]) {
+			best = j
+		}
+	}
+	return best
+}
+
+func (s *Scheduler) run() {
+	t := time.NewTicker(s.interval / time.Duration(len(s.slots)))
+	defer t.Stop()
+	for slot := 0; ; slot = (slot + 1) % len(s.slots) {
+		<-t.C
+		s.mu.Lock()
+		tasks := s.slots[slot]
+		s.mu.Unlock()
+		for _, task := range tasks {
+			task.fn()
+		}
+	}
+}
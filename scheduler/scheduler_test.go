@@ -0,0 +1,39 @@
+package scheduler
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	s := New(100*time.Millisecond, 4)
+	var a, b int64
+	removeA := s.Add(func() { atomic.AddInt64(&a, 1) })
+	s.Add(func() { atomic.AddInt64(&b, 1) })
+	assert.Equal(t, 2, s.Len())
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&a) >= 2 && atomic.LoadInt64(&b) >= 2 }, time.Second, 10*time.Millisecond)
+
+	removeA()
+	removeA()
+	assert.Equal(t, 1, s.Len())
+	time.Sleep(120 * time.Millisecond)
+	ranA := atomic.LoadInt64(&a)
+	ranB := atomic.LoadInt64(&b)
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, ranA, atomic.LoadInt64(&a), "a removed task no longer runs")
+	assert.True(t, atomic.LoadInt64(&b) > ranB)
+}
+
+func TestSchedulerSpreadsTasks(t *testing.T) {
+	s := New(time.Hour, 4)
+	for i := 0; i < 10; i++ {
+		s.Add(func() {})
+	}
+	for _, tasks := range s.slots {
+		assert.True(t, len(tasks) == 2 || len(tasks) == 3, "tasks are spread over the slots")
+	}
+}
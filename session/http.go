@@ -0,0 +1,55 @@
+package session
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/coinbase/redisbetween/admin"
+)
+
+type armRequest struct {
+	Addr string `json:"addr"`
+	Name string `json:"name"`
+}
+
+// Handler serves the admin route for session recording. GET lists the armed
+// rules, PUT arms one from a JSON body of a client addr or name, and DELETE
+// disarms the rule named by the id query param.
+func (r *Recorder) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"rules": r.Rules()})
+		case http.MethodPut, http.MethodPost:
+			var ar armRequest
+			if err := json.NewDecoder(req.Body).Decode(&ar); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			rule, err := r.Arm(ar.Addr, ar.Name)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, rule)
+		case http.MethodDelete:
+			id, err := strconv.ParseUint(req.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid id")
+				return
+			}
+			if !r.Disarm(id) {
+				writeError(w, http.StatusNotFound, "no rule "+strconv.FormatUint(id, 10))
+				return
+			}
+			admin.WriteJSON(w, http.StatusOK, map[string]interface{}{"rules": r.Rules()})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	admin.WriteJSON(w, status, map[string]string{"error": msg})
+}
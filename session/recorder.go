@@ -0,0 +1,152 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxBytes caps the requests recorded in each session file
+	DefaultMaxBytes = 64 << 20
+	// DefaultMaxFiles is how many session files are kept, the oldest being
+	// removed as new ones are started
+	DefaultMaxFiles = 20
+)
+
+// Rule arms the recording of the next session of a client that matches it, by the
+// address it connected from or by the name it announced with HELLO SETNAME. A
+// rule records a single session and is then disarmed.
+type Rule struct {
+	ID    uint64    `json:"id"`
+	Addr  string    `json:"addr,omitempty"`
+	Name  string    `json:"name,omitempty"`
+	Armed time.Time `json:"armed"`
+}
+
+func (r Rule) matches(client, name string) bool {
+	return (r.Addr != "" && r.Addr == client) || (r.Name != "" && r.Name == name)
+}
+
+// Recorder starts session recordings for the rules armed on it. A nil Recorder
+// records nothing.
+type Recorder struct {
+	dir      string
+	maxBytes int64
+	maxFiles int
+
+	armed  int32
+	mu     sync.Mutex
+	rules  []Rule
+	nextID uint64
+}
+
+// NewRecorder returns a recorder writing session files of at most maxBytes to
+// dir, keeping at most maxFiles of them
+func NewRecorder(dir string, maxBytes int64, maxFiles int) *Recorder {
+	return &Recorder{dir: dir, maxBytes: maxBytes, maxFiles: maxFiles}
+}
+
+// Arm adds a rule for the next session of the client with the given address or
+// name
+func (r *Recorder) Arm(addr, name string) (Rule, error) {
+	if addr == "" && name == "" {
+		return Rule{}, errors.New("a client addr or name is required")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	rule := Rule{ID: r.nextID, Addr: addr, Name: name, Armed: time.Now()}
+	r.rules = append(r.rules, rule)
+	atomic.StoreInt32(&r.armed, 1)
+	return rule, nil
+}
+
+// Disarm removes the rule with the given ID, returning false if there is none
+func (r *Recorder) Disarm(id uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, rule := range r.rules {
+		if rule.ID == id {
+			r.remove(i)
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Recorder) remove(i int) {
+	r.rules = append(r.rules[:i], r.rules[i+1:]...)
+	if len(r.rules) == 0 {
+		atomic.StoreInt32(&r.armed, 0)
+	}
+}
+
+// Rules returns the rules armed
+func (r *Recorder) Rules() []Rule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Rule{}, r.rules...)
+}
+
+// Armed reports whether any rule is armed. It is cheap enough to check on every
+// request.
+func (r *Recorder) Armed() bool {
+	return r != nil && atomic.LoadInt32(&r.armed) == 1
+}
+
+// Start starts recording the session of a client if a rule matches it,
+// disarming the rule. It returns nil if none does.
+func (r *Recorder) Start(client, name, upstream string) (*Writer, error) {
+	if !r.Armed() {
+		return nil, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, rule := range r.rules {
+		if !rule.matches(client, name) {
+			continue
+		}
+		r.remove(i)
+		h := Header{Version: Version, Rule: rule.ID, Client: client, Name: name, Upstream: upstream, Start: time.Now()}
+		if err := os.MkdirAll(r.dir, 0700); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(r.dir, fmt.Sprintf("session-%s-%d.jsonl", h.Start.UTC().Format("20060102-150405.000000000"), rule.ID))
+		w, err := create(path, h, r.maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		return w, r.rotate()
+	}
+	return nil, nil
+}
+
+// rotate removes the oldest session files beyond maxFiles
+func (r *Recorder) rotate() error {
+	infos, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), "session-") && strings.HasSuffix(info.Name(), ".jsonl") {
+			files = append(files, info.Name())
+		}
+	}
+	sort.Strings(files)
+	for len(files) > r.maxFiles {
+		if err := os.Remove(filepath.Join(r.dir, files[0])); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// the signals redisbetween expects around pipelines. A proxy strips them before
+// they are recorded, so they are added back when replaying through one.
+var (
+	pipelineStart = []byte("*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n")
+	pipelineEnd   = []byte("*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n")
+)
+
+// ReplayOptions controls how a session is replayed
+type ReplayOptions struct {
+	// Fast sends each request as soon as the previous one is answered, instead of
+	// at the pace it was recorded at
+	Fast bool
+	// Signals wraps pipelines in the signals redisbetween expects, for replaying
+	// through a proxy rather than against an upstream directly
+	Signals bool
+	// Timeout bounds the wait for each request's replies
+	Timeout time.Duration
+}
+
+// Divergence is the first reply of a replay that differs from the one recorded
+type Divergence struct {
+	Request  int
+	Reply    int
+	At       time.Duration
+	Command  string
+	Recorded string
+	Replayed string
+}
+
+func (d Divergence) String() string {
+	return fmt.Sprintf("request %d, reply %d (at %v): %s\n  recorded: %s\n  replayed: %s", d.Request, d.Reply, d.At, d.Command, d.Recorded, d.Replayed)
+}
+
+// Replay sends the requests of s over conn, comparing each reply with the one
+// recorded byte for byte. It stops at the first reply that differs, returning
+// it, or returns nil once every request has been replayed.
+func Replay(conn net.Conn, s *Session, opts ReplayOptions) (*Divergence, error) {
+	d := redis.NewDecoder(bufio.NewReader(conn))
+	start := time.Now()
+	for i, req := range s.Requests {
+		if !opts.Fast {
+			time.Sleep(time.Until(start.Add(req.At)))
+		}
+		wrap := opts.Signals && len(req.Commands) > 1
+		var buf bytes.Buffer
+		if wrap {
+			buf.Write(pipelineStart)
+		}
+		for _, c := range req.Commands {
+			buf.Write(c)
+		}
+		if wrap {
+			buf.Write(pipelineEnd)
+		}
+		if opts.Timeout > 0 {
+			if err := conn.SetDeadline(time.Now().Add(opts.Timeout)); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			return nil, fmt.Errorf("request %d: %w", i, err)
+		}
+
+		n := len(req.Replies)
+		if wrap {
+			n += 2
+		}
+		replies := make([][]byte, 0, n)
+		for j := 0; j < n; j++ {
+			m, err := d.DecodeFrame()
+			if err != nil {
+				return nil, fmt.Errorf("request %d: %w", i, err)
+			}
+			if wrap && (j == 0 || j == n-1) {
+				continue
+			}
+			replies = append(replies, m.Raw)
+		}
+		for j, recorded := range req.Replies {
+			if !bytes.Equal(recorded, replies[j]) {
+				return &Divergence{
+					Request:  i,
+					Reply:    j,
+					At:       req.At,
+					Command:  command(req.Commands, j),
+					Recorded: fmt.Sprintf("%q", recorded),
+					Replayed: fmt.Sprintf("%q", replies[j]),
+				}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// command is the readable form of the j-th command of cmds
+func command(cmds [][]byte, j int) string {
+	if j >= len(cmds) {
+		return "(missing)"
+	}
+	m, err := redis.DecodeFrameFromBytes(cmds[j])
+	if err != nil || !m.IsArray() {
+		return fmt.Sprintf("%q", cmds[j])
+	}
+	args := make([]string, len(m.Array))
+	for i, a := range m.Array {
+		args[i] = string(a.Value)
+	}
+	return strings.Join(args, " ")
+}
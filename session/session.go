@@ -0,0 +1,145 @@
+// Package session records the commands and replies of single client sessions to
+// files, and replays them against an upstream to reproduce what the client saw.
+//
+// A session file is JSON lines: a header, then one line per request the client
+// made, holding the exact bytes of its commands and of the replies it got, and a
+// last line saying why the recording ended.
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Version is the version of the session file format written
+const Version = 1
+
+// ErrFull is returned once a session file has reached its size limit
+var ErrFull = errors.New("session file size limit reached")
+
+// Header describes the recorded session
+type Header struct {
+	Version  int       `json:"version"`
+	Rule     uint64    `json:"rule"`
+	Client   string    `json:"client"`
+	Name     string    `json:"name,omitempty"`
+	Upstream string    `json:"upstream"`
+	Start    time.Time `json:"start"`
+}
+
+// Request is one request of the client, a command or a pipeline, At the time it
+// was read after the start of the session
+type Request struct {
+	At       time.Duration `json:"at"`
+	Commands [][]byte      `json:"commands"`
+	Replies  [][]byte      `json:"replies"`
+}
+
+type record struct {
+	Header  *Header  `json:"header,omitempty"`
+	Request *Request `json:"request,omitempty"`
+	End     string   `json:"end,omitempty"`
+}
+
+// Writer writes a session file whose requests take up at most a given size
+type Writer struct {
+	f     *os.File
+	size  int64
+	max   int64
+	start time.Time
+}
+
+func create(path string, h Header, max int64) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{f: f, max: max, start: h.Start}
+	if _, err := w.write(record{Header: &h}, false); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Path is the file being written
+func (w *Writer) Path() string {
+	return w.f.Name()
+}
+
+// Write records a request read at the given time. It returns ErrFull, without
+// writing the request, if that would take the file past its size limit.
+func (w *Writer) Write(at time.Time, commands, replies [][]byte) error {
+	n, err := w.write(record{Request: &Request{At: at.Sub(w.start), Commands: commands, Replies: replies}}, true)
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) write(r record, limited bool) (int, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+	b = append(b, '\n')
+	if limited && w.size+int64(len(b)) > w.max {
+		return 0, ErrFull
+	}
+	return w.f.Write(b)
+}
+
+// Close ends the file with why the recording ended
+func (w *Writer) Close(reason string) error {
+	_, err := w.write(record{End: reason}, false)
+	if e := w.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Session is a session file read back
+type Session struct {
+	Header   Header
+	Requests []Request
+	End      string
+}
+
+// Read reads a session file
+func Read(r io.Reader) (*Session, error) {
+	s := &Session{}
+	d := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var rec record
+		if err := d.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		switch {
+		case rec.Header != nil:
+			s.Header = *rec.Header
+		case rec.Request != nil:
+			s.Requests = append(s.Requests, *rec.Request)
+		default:
+			s.End = rec.End
+		}
+	}
+	if s.Header.Version != Version {
+		return nil, fmt.Errorf("unsupported session file version %d", s.Header.Version)
+	}
+	return s, nil
+}
+
+// ReadFile reads the session file at path
+func ReadFile(path string) (*Session, error) {
+	f, err := os.Open(path) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return Read(bufio.NewReader(f))
+}
@@ -0,0 +1,180 @@
+package session
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "session")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func cmd(args ...string) []byte {
+	m := make([]*redis.Message, len(args))
+	for i, a := range args {
+		m[i] = redis.NewBulkBytes([]byte(a))
+	}
+	b, _ := redis.EncodeToBytes(redis.NewArray(m))
+	return b
+}
+
+func TestRecordAndRead(t *testing.T) {
+	r := NewRecorder(tempDir(t), 1<<20, DefaultMaxFiles)
+	assert.False(t, r.Armed())
+	w, err := r.Start("10.0.0.1:5000", "", "redis:6379")
+	assert.NoError(t, err)
+	assert.Nil(t, w, "nothing is recorded until a rule is armed")
+
+	_, err = r.Arm("", "")
+	assert.Error(t, err)
+	rule, err := r.Arm("", "checkout-7")
+	assert.NoError(t, err)
+	assert.True(t, r.Armed())
+
+	w, err = r.Start("10.0.0.1:5000", "other", "redis:6379")
+	assert.NoError(t, err)
+	assert.Nil(t, w)
+	w, err = r.Start("10.0.0.1:5000", "checkout-7", "redis:6379")
+	assert.NoError(t, err)
+	assert.NotNil(t, w)
+	assert.False(t, r.Armed(), "a rule records a single session")
+
+	start := time.Now()
+	assert.NoError(t, w.Write(start.Add(time.Millisecond), [][]byte{cmd("GET", "k")}, [][]byte{[]byte("$1\r\nv\r\n")}))
+	assert.NoError(t, w.Write(start.Add(2*time.Millisecond), [][]byte{cmd("SET", "k", "w"), cmd("GET", "k")}, [][]byte{[]byte("+OK\r\n"), []byte("$1\r\nw\r\n")}))
+	assert.NoError(t, w.Close("client disconnected"))
+
+	s, err := ReadFile(w.Path())
+	assert.NoError(t, err)
+	assert.Equal(t, rule.ID, s.Header.Rule)
+	assert.Equal(t, "checkout-7", s.Header.Name)
+	assert.Equal(t, "redis:6379", s.Header.Upstream)
+	assert.Len(t, s.Requests, 2)
+	assert.Equal(t, "+OK\r\n", string(s.Requests[1].Replies[0]))
+	assert.True(t, s.Requests[1].At > s.Requests[0].At)
+	assert.Equal(t, "client disconnected", s.End)
+}
+
+func TestSizeLimit(t *testing.T) {
+	r := NewRecorder(tempDir(t), 200, DefaultMaxFiles)
+	_, _ = r.Arm("10.0.0.1:5000", "")
+	w, err := r.Start("10.0.0.1:5000", "", "redis:6379")
+	assert.NoError(t, err)
+	reply := [][]byte{[]byte("+OK\r\n")}
+	assert.NoError(t, w.Write(time.Now(), [][]byte{cmd("SET", "k", "v")}, reply))
+	err = w.Write(time.Now(), [][]byte{cmd("SET", "k", string(make([]byte, 200)))}, reply)
+	assert.Equal(t, ErrFull, err)
+	assert.NoError(t, w.Close(err.Error()))
+
+	s, err := ReadFile(w.Path())
+	assert.NoError(t, err)
+	assert.Len(t, s.Requests, 1)
+	assert.Equal(t, ErrFull.Error(), s.End)
+}
+
+func TestRotate(t *testing.T) {
+	dir := tempDir(t)
+	r := NewRecorder(dir, 1<<20, 2)
+	var paths []string
+	for i := 0; i < 3; i++ {
+		_, _ = r.Arm("10.0.0.1:5000", "")
+		w, err := r.Start("10.0.0.1:5000", "", "redis:6379")
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close("client disconnected"))
+		paths = append(paths, w.Path())
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "session-*.jsonl"))
+	assert.NoError(t, err)
+	assert.Equal(t, paths[1:], files)
+}
+
+func TestDisarm(t *testing.T) {
+	r := NewRecorder(tempDir(t), 1<<20, DefaultMaxFiles)
+	a, _ := r.Arm("10.0.0.1:5000", "")
+	b, _ := r.Arm("", "checkout-7")
+	assert.Len(t, r.Rules(), 2)
+	assert.True(t, r.Disarm(a.ID))
+	assert.False(t, r.Disarm(a.ID))
+	assert.True(t, r.Armed())
+	assert.True(t, r.Disarm(b.ID))
+	assert.False(t, r.Armed())
+
+	var nilRecorder *Recorder
+	assert.False(t, nilRecorder.Armed())
+	w, err := nilRecorder.Start("10.0.0.1:5000", "", "redis:6379")
+	assert.NoError(t, err)
+	assert.Nil(t, w)
+}
+
+// counter serves an upstream whose GETs reply with how many commands it has seen
+func counter(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = c.Close() }()
+				d := redis.NewDecoder(bufio.NewReader(c))
+				for n := 1; ; n++ {
+					if _, err := d.DecodeFrame(); err != nil {
+						return
+					}
+					b, _ := redis.EncodeToBytes(redis.NewInt([]byte(string(rune('0' + n)))))
+					if _, err := c.Write(b); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestReplay(t *testing.T) {
+	addr := counter(t)
+	s := &Session{
+		Header: Header{Version: Version},
+		Requests: []Request{
+			{Commands: [][]byte{cmd("GET", "a")}, Replies: [][]byte{[]byte(":1\r\n")}},
+			{At: 10 * time.Millisecond, Commands: [][]byte{cmd("GET", "b"), cmd("GET", "c")}, Replies: [][]byte{[]byte(":2\r\n"), []byte(":3\r\n")}},
+		},
+	}
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	start := time.Now()
+	d, err := Replay(conn, s, ReplayOptions{Timeout: time.Second})
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+	assert.True(t, time.Since(start) >= 10*time.Millisecond, "requests are sent at their recorded pace")
+	_ = conn.Close()
+
+	s.Requests[1].Replies[1] = []byte(":4\r\n")
+	conn, err = net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	d, err = Replay(conn, s, ReplayOptions{Fast: true, Timeout: time.Second})
+	assert.NoError(t, err)
+	if assert.NotNil(t, d) {
+		assert.Equal(t, 1, d.Request)
+		assert.Equal(t, 1, d.Reply)
+		assert.Equal(t, "GET c", d.Command)
+		assert.Equal(t, `":4\r\n"`, d.Recorded)
+		assert.Equal(t, `":3\r\n"`, d.Replayed)
+	}
+}
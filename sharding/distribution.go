@@ -0,0 +1,163 @@
+package sharding
+
+import (
+	"bytes"
+	"crypto/md5" // #nosec
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ketamaPointsPerServer = 160
+	ketamaPointsPerHash   = 4
+	ketamaMaxHostLength   = 86
+	// memcached's port, which twemproxy leaves out of ketama server names for
+	// compatibility with libmemcached
+	ketamaDefaultPort = "11211"
+)
+
+// Server is one entry of a twemproxy server list, "host:port:weight [name]"
+type Server struct {
+	Address string
+	Weight  int
+	Name    string
+}
+
+// ParseServer parses a server in twemproxy's "host:port:weight [name]" format.
+// As in twemproxy, a server without a name is named after its address, minus the
+// port if it is 11211.
+func ParseServer(s string) (Server, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Server{}, fmt.Errorf("invalid server: %q", s)
+	}
+	i := strings.LastIndex(fields[0], ":")
+	if i < 0 {
+		return Server{}, fmt.Errorf("invalid server, missing weight: %q", s)
+	}
+	weight, err := strconv.Atoi(fields[0][i+1:])
+	if err != nil || weight < 1 {
+		return Server{}, fmt.Errorf("invalid server weight: %q", s)
+	}
+	server := Server{Address: fields[0][:i], Weight: weight}
+	if len(fields) == 2 {
+		server.Name = fields[1]
+	} else if strings.HasSuffix(server.Address, ":"+ketamaDefaultPort) {
+		server.Name = strings.TrimSuffix(server.Address, ":"+ketamaDefaultPort)
+	} else {
+		server.Name = server.Address
+	}
+	return server, nil
+}
+
+// Ring places keys on a fixed list of servers. If HashTag is set to two
+// characters, such as "{}", only the part of a key between them is hashed.
+type Ring struct {
+	Servers      []Server
+	HashTag      string
+	hash         HashFunc
+	distribution string
+	continuum    []point
+}
+
+type point struct {
+	value uint32
+	index int
+}
+
+// NewRing builds the placement of keys on servers for one of twemproxy's
+// distributions: ketama, modula or random.
+func NewRing(distribution string, hash HashFunc, servers []Server) (*Ring, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers")
+	}
+	r := &Ring{Servers: servers, hash: hash, distribution: distribution}
+	switch distribution {
+	case "ketama":
+		r.continuum = ketamaContinuum(servers)
+	case "modula":
+		for i, s := range servers {
+			for w := 0; w < s.Weight; w++ {
+				r.continuum = append(r.continuum, point{index: i})
+			}
+		}
+	case "random":
+		for i := range servers {
+			r.continuum = append(r.continuum, point{index: i})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported distribution: %s", distribution)
+	}
+	return r, nil
+}
+
+// Server returns the server key is placed on
+func (r *Ring) Server(key []byte) Server {
+	return r.Servers[r.Index(key)]
+}
+
+// Index returns the position of key's server in r.Servers
+func (r *Ring) Index(key []byte) int {
+	switch r.distribution {
+	case "ketama":
+		h := r.hashKey(key)
+		i := sort.Search(len(r.continuum), func(i int) bool { return r.continuum[i].value >= h })
+		if i == len(r.continuum) {
+			i = 0
+		}
+		return r.continuum[i].index
+	case "modula":
+		return r.continuum[r.hashKey(key)%uint32(len(r.continuum))].index
+	default:
+		return r.continuum[rand.Intn(len(r.continuum))].index // #nosec
+	}
+}
+
+// hashKey mirrors twemproxy's server_pool_hash, which skips hashing when there
+// is only one server or the key is empty
+func (r *Ring) hashKey(key []byte) uint32 {
+	if len(r.Servers) == 1 || len(key) == 0 {
+		return 0
+	}
+	if len(r.HashTag) == 2 {
+		if start := bytes.IndexByte(key, r.HashTag[0]); start >= 0 {
+			if end := bytes.IndexByte(key[start+1:], r.HashTag[1]); end > 0 {
+				key = key[start+1 : start+1+end]
+			}
+		}
+	}
+	return r.hash(key)
+}
+
+// ketamaContinuum mirrors twemproxy's ketama_update, including its single
+// precision arithmetic for the number of points each server gets
+func ketamaContinuum(servers []Server) []point {
+	totalWeight := 0
+	for _, s := range servers {
+		totalWeight += s.Weight
+	}
+
+	var continuum []point
+	for i, s := range servers {
+		pct := float32(s.Weight) / float32(totalWeight)
+		points := float32(pct*ketamaPointsPerServer/4) * float32(len(servers))
+		pointsPerServer := int(math.Floor(float64(float32(float64(points)+0.0000000001)))) * 4
+
+		for p := 0; p < pointsPerServer/ketamaPointsPerHash; p++ {
+			host := s.Name + "-" + strconv.Itoa(p)
+			if len(host) > ketamaMaxHostLength-1 {
+				host = host[:ketamaMaxHostLength-1]
+			}
+			sum := md5.Sum([]byte(host)) // #nosec
+			for x := 0; x < ketamaPointsPerHash; x++ {
+				continuum = append(continuum, point{value: digestWord(sum, x), index: i})
+			}
+		}
+	}
+	sort.SliceStable(continuum, func(i, j int) bool { return continuum[i].value < continuum[j].value })
+	return continuum
+}
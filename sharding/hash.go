@@ -0,0 +1,57 @@
+// Package sharding places keys on servers the same way twemproxy does, so that a
+// deployment can move from twemproxy without reshuffling its keys.
+package sharding
+
+import (
+	"crypto/md5" // #nosec
+	"fmt"
+	"hash/crc32"
+)
+
+// HashFunc maps a key to a point that a Distribution turns into a server
+type HashFunc func(key []byte) uint32
+
+// Hashes are the supported twemproxy hash functions, by their twemproxy names
+var Hashes = map[string]HashFunc{
+	"fnv1a_64": FNV1a64,
+	"crc32a":   CRC32a,
+	"md5":      MD5,
+}
+
+// LookupHash returns the hash function with the given twemproxy name
+func LookupHash(name string) (HashFunc, error) {
+	h, ok := Hashes[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash: %s", name)
+	}
+	return h, nil
+}
+
+// FNV1a64 is twemproxy's fnv1a_64, which uses the 64 bit FNV-1a offset basis and
+// prime but truncates both, and the result, to 32 bits. twemproxy reads the key
+// as signed chars, so bytes of 0x80 and above are sign extended, as they are
+// here, for non-ASCII keys to land where it puts them.
+func FNV1a64(key []byte) uint32 {
+	hash := uint32(0xcbf29ce484222325 & 0xffffffff)
+	for _, b := range key {
+		hash ^= uint32(int32(int8(b)))
+		hash *= uint32(0x100000001b3 & 0xffffffff)
+	}
+	return hash
+}
+
+// CRC32a is the full 32 bit IEEE CRC32, twemproxy's crc32a.
+func CRC32a(key []byte) uint32 {
+	return crc32.ChecksumIEEE(key)
+}
+
+// MD5 is the first 4 bytes of the key's MD5 digest read as a little endian
+// integer, twemproxy's md5.
+func MD5(key []byte) uint32 {
+	sum := md5.Sum(key) // #nosec
+	return digestWord(sum, 0)
+}
+
+func digestWord(sum [md5.Size]byte, word int) uint32 {
+	return uint32(sum[3+word*4])<<24 | uint32(sum[2+word*4])<<16 | uint32(sum[1+word*4])<<8 | uint32(sum[word*4])
+}
@@ -0,0 +1,98 @@
+package sharding
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashes(t *testing.T) {
+	assert.Equal(t, uint32(0xcbf43926), CRC32a([]byte("123456789")))
+	assert.Equal(t, uint32(0xd98c1dd4), MD5([]byte("")))
+	assert.Equal(t, uint32(0x84222325), FNV1a64([]byte("")))
+	assert.Equal(t, uint32(0xfed9d577), FNV1a64([]byte("foo")))
+	// as twemproxy's C hashes them, its signed chars sign extending high bytes
+	assert.Equal(t, uint32(0x6b2c1fc1), FNV1a64([]byte("🔑:user:1")))
+	assert.Equal(t, uint32(0x65599e30), FNV1a64([]byte("café:9")))
+	assert.Equal(t, uint32(0x72001eb3), FNV1a64([]byte("\xff\x80k")))
+
+	_, err := LookupHash("murmur")
+	assert.EqualError(t, err, "unsupported hash: murmur")
+}
+
+func TestParseServer(t *testing.T) {
+	s, err := ParseServer("10.0.1.10:6379:2 cache-a")
+	assert.NoError(t, err)
+	assert.Equal(t, Server{Address: "10.0.1.10:6379", Weight: 2, Name: "cache-a"}, s)
+
+	s, err = ParseServer("10.0.1.10:6379:1")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.1.10:6379", s.Name)
+
+	s, err = ParseServer("10.0.1.10:11211:1")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.1.10", s.Name, "like libmemcached, the default port is not part of the ketama name")
+
+	for _, invalid := range []string{"", "10.0.1.10", "10.0.1.10:6379:0", "a:1:1 b c"} {
+		_, err = ParseServer(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// golden placements for the pools in testdata/nutcracker.yml, cross-checked
+// against a port of twemproxy's nc_ketama.c, nc_modula.c and hashkit
+func TestTwemproxyGoldenPlacement(t *testing.T) {
+	f, err := os.Open("testdata/nutcracker.yml")
+	assert.NoError(t, err)
+	defer func() { _ = f.Close() }()
+	rings, err := LoadTwemproxy(f)
+	assert.NoError(t, err)
+
+	keys := []string{"user:1000", "user:1001", "session:{u42}:cart", "session:{u42}:prefs", "foo", "bar", "baz", "product:77",
+		"🔑:user:1", "café:9", "ключ:42", "\xff\x80k", "{ü}:a"}
+	expected := map[string][]string{
+		"alpha": {"cache-a", "cache-a", "cache-b", "cache-b", "cache-c", "cache-a", "cache-a", "cache-b",
+			"cache-a", "cache-c", "cache-a", "cache-a", "cache-a"},
+		"beta": {"10.0.2.11:6379", "10.0.2.11:6379", "10.0.2.11:6379", "10.0.2.11:6379", "10.0.2.11:6379", "10.0.2.11:6379", "10.0.2.10:6379", "10.0.2.11:6379",
+			"10.0.2.10:6379", "10.0.2.11:6379", "10.0.2.10:6379", "10.0.2.10:6379", "10.0.2.10:6379"},
+		"gamma": {"10.0.3.10", "10.0.3.10", "10.0.3.11:6379", "10.0.3.11:6379", "10.0.3.11:6379", "10.0.3.11:6379", "10.0.3.11:6379", "10.0.3.11:6379",
+			"10.0.3.11:6379", "10.0.3.11:6379", "10.0.3.10", "10.0.3.11:6379", "10.0.3.10"},
+	}
+	for pool, servers := range expected {
+		for i, key := range keys {
+			assert.Equal(t, servers[i], rings[pool].Server([]byte(key)).Name, "%s %s", pool, key)
+		}
+	}
+	assert.Equal(t, 480, len(rings["alpha"].continuum), "160 points per server, split by weight")
+}
+
+func TestKetamaAddingServerMovesFewKeys(t *testing.T) {
+	servers := []Server{{Name: "a", Weight: 1}, {Name: "b", Weight: 1}, {Name: "c", Weight: 1}}
+	before, err := NewRing("ketama", FNV1a64, servers)
+	assert.NoError(t, err)
+	after, err := NewRing("ketama", FNV1a64, append(servers, Server{Name: "d", Weight: 1}))
+	assert.NoError(t, err)
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := []byte("key:" + strconv.Itoa(i))
+		if a, b := before.Server(key), after.Server(key); a.Name != b.Name {
+			assert.Equal(t, "d", b.Name, "keys only move to the new server")
+			moved++
+		}
+	}
+	assert.InDelta(t, 2500, moved, 500)
+}
+
+func TestNewRingErrors(t *testing.T) {
+	_, err := NewRing("ketama", MD5, nil)
+	assert.EqualError(t, err, "no servers")
+	_, err = NewRing("vnode", MD5, []Server{{Name: "a", Weight: 1}})
+	assert.EqualError(t, err, "unsupported distribution: vnode")
+
+	r, err := NewRing("random", MD5, []Server{{Name: "a", Weight: 1}, {Name: "b", Weight: 5}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(r.continuum), "random ignores weights, like twemproxy")
+}
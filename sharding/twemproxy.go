@@ -0,0 +1,64 @@
+package sharding
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// twemproxyPool is the subset of a twemproxy (nutcracker) server pool config that
+// affects key placement
+type twemproxyPool struct {
+	Hash         string   `yaml:"hash"`
+	HashTag      string   `yaml:"hash_tag"`
+	Distribution string   `yaml:"distribution"`
+	Servers      []string `yaml:"servers"`
+}
+
+// LoadTwemproxy reads the server pools of a twemproxy config file, with the same
+// defaults as twemproxy: fnv1a_64 and ketama.
+func LoadTwemproxy(r io.Reader) (map[string]*Ring, error) {
+	var pools map[string]twemproxyPool
+	if err := yaml.NewDecoder(r).Decode(&pools); err != nil {
+		return nil, err
+	}
+
+	rings := make(map[string]*Ring, len(pools))
+	for name, p := range pools {
+		ring, err := p.ring()
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %v", name, err)
+		}
+		rings[name] = ring
+	}
+	return rings, nil
+}
+
+func (p twemproxyPool) ring() (*Ring, error) {
+	if p.Hash == "" {
+		p.Hash = "fnv1a_64"
+	}
+	if p.Distribution == "" {
+		p.Distribution = "ketama"
+	}
+	if p.HashTag != "" && len(p.HashTag) != 2 {
+		return nil, fmt.Errorf("invalid hash_tag: %q", p.HashTag)
+	}
+	hash, err := LookupHash(p.Hash)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]Server, len(p.Servers))
+	for i, s := range p.Servers {
+		if servers[i], err = ParseServer(s); err != nil {
+			return nil, err
+		}
+	}
+	ring, err := NewRing(p.Distribution, hash, servers)
+	if err != nil {
+		return nil, err
+	}
+	ring.HashTag = p.HashTag
+	return ring, nil
+}
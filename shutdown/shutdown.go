@@ -0,0 +1,58 @@
+// Package shutdown runs the phases of a graceful shutdown in a fixed order, under
+// a hard overall deadline.
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrDeadline is returned by Run when the phases did not finish in time
+var ErrDeadline = errors.New("shutdown deadline exceeded")
+
+// Phase is one step of a shutdown. Run is given the context of the whole
+// shutdown, and should return once the phase is done or the context is.
+type Phase struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Run runs phases one after the other, logging the start, end and duration of
+// each. A phase that fails is logged and the next one still runs, since later
+// phases release resources regardless. If timeout passes before every phase has
+// returned, force is called and Run returns ErrDeadline without waiting for the
+// phase that is still running.
+func Run(log *zap.Logger, timeout time.Duration, force func(), phases ...Phase) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	for _, phase := range phases {
+		l := log.With(zap.String("phase", phase.Name))
+		l.Info("Shutdown phase starting")
+		phaseStart := time.Now()
+
+		done := make(chan error, 1)
+		go func(phase Phase) {
+			done <- phase.Run(ctx)
+		}(phase)
+
+		select {
+		case err := <-done:
+			if err != nil {
+				l.Warn("Shutdown phase failed", zap.Duration("duration", time.Since(phaseStart)), zap.Error(err))
+			} else {
+				l.Info("Shutdown phase finished", zap.Duration("duration", time.Since(phaseStart)))
+			}
+		case <-ctx.Done():
+			l.Error("Shutdown deadline exceeded, forcing", zap.Duration("duration", time.Since(phaseStart)), zap.Duration("timeout", timeout))
+			force()
+			return ErrDeadline
+		}
+	}
+	log.Info("Shutdown complete", zap.Duration("duration", time.Since(start)))
+	return nil
+}
@@ -0,0 +1,52 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRunInOrder(t *testing.T) {
+	var ran []string
+	phase := func(name string, err error) Phase {
+		return Phase{Name: name, Run: func(context.Context) error {
+			ran = append(ran, name)
+			return err
+		}}
+	}
+	forced := false
+	err := Run(zap.NewNop(), time.Second, func() { forced = true },
+		phase("stop accepting", nil),
+		phase("drain", errors.New("3 client connections still open")),
+		phase("close pools", nil),
+	)
+	assert.NoError(t, err)
+	assert.False(t, forced)
+	assert.Equal(t, []string{"stop accepting", "drain", "close pools"}, ran, "a failed phase doesn't stop the later ones")
+}
+
+func TestRunDeadline(t *testing.T) {
+	forced := make(chan struct{})
+	stuck := Phase{Name: "stuck", Run: func(context.Context) error {
+		<-forced
+		return nil
+	}}
+	next := false
+	start := time.Now()
+	err := Run(zap.NewNop(), 50*time.Millisecond, func() { close(forced) }, stuck, Phase{Name: "next", Run: func(context.Context) error {
+		next = true
+		return nil
+	}})
+	assert.Equal(t, ErrDeadline, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.False(t, next)
+	select {
+	case <-forced:
+	default:
+		t.Fatal("force was not called")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/coinbase/redisbetween/metrics"
+	"github.com/coinbase/redisbetween/overrides"
+	"github.com/coinbase/redisbetween/proxy"
+	"github.com/coinbase/redisbetween/support"
+)
+
+// supportBundler gathers the state served by the admin server's /support-bundle.
+// Every section is a snapshot of state already kept in memory, so generating a
+// bundle makes no requests to upstreams and takes no locks for longer than the
+// admin routes serving the same state do.
+// The config and proxies are those running when it is generated.
+func supportBundler(live *liveProxies, store *overrides.Store, discovery *proxy.Discovery, started time.Time) *support.Bundler {
+	stats := func() []proxy.Stats {
+		proxies := live.All()
+		stats := make([]proxy.Stats, len(proxies))
+		for i, p := range proxies {
+			stats[i] = p.Stats()
+		}
+		return stats
+	}
+	hosts := func() []string {
+		hosts := live.Config().Hosts()
+		for _, s := range stats() {
+			for _, l := range s.Listeners {
+				hosts = append(hosts, l.Upstream)
+			}
+		}
+		return hosts
+	}
+	return support.New(hosts,
+		support.Section{Name: "config.json", Collect: func() interface{} { return live.Config().Redacted() }},
+		support.Section{Name: "overrides.json", Collect: func() interface{} {
+			return map[string]interface{}{"settings": store.Settings()}
+		}},
+		support.Section{Name: "stats.json", Collect: func() interface{} {
+			return map[string]interface{}{"proxies": stats()}
+		}},
+		// the command mix again on its own, the artifact of capacity reviews
+		support.Section{Name: "command_mix.json", Collect: func() interface{} {
+			mixes := make(map[string]interface{})
+			for _, s := range stats() {
+				if s.Mix == nil {
+					continue
+				}
+				name := s.Label
+				if name == "" {
+					name = s.Upstream
+				}
+				mixes[name] = s.Mix
+			}
+			return map[string]interface{}{"command_mix": mixes}
+		}},
+		support.Section{Name: "sockets.json", Collect: func() interface{} {
+			return map[string]interface{}{"sockets": discovery.Sockets()}
+		}},
+		support.Section{Name: "build.json", Collect: func() interface{} { return buildInfo() }},
+		support.Section{Name: "runtime.json", Collect: func() interface{} { return runtimeStats(started) }},
+	)
+}
+
+func buildInfo() map[string]interface{} {
+	info := map[string]interface{}{
+		"go_version":     runtime.Version(),
+		"schema_version": metrics.SchemaVersion,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info["path"] = bi.Main.Path
+		info["version"] = bi.Main.Version
+		deps := make(map[string]string, len(bi.Deps))
+		for _, d := range bi.Deps {
+			deps[d.Path] = d.Version
+		}
+		info["deps"] = deps
+	}
+	return info
+}
+
+func runtimeStats(started time.Time) map[string]interface{} {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return map[string]interface{}{
+		"uptime":       time.Since(started).Round(time.Second).String(),
+		"goroutines":   runtime.NumGoroutine(),
+		"gomaxprocs":   runtime.GOMAXPROCS(0),
+		"num_cpu":      runtime.NumCPU(),
+		"heap_alloc":   m.HeapAlloc,
+		"heap_sys":     m.HeapSys,
+		"heap_objects": m.HeapObjects,
+		"sys":          m.Sys,
+		"num_gc":       m.NumGC,
+		"pause_total":  time.Duration(m.PauseTotalNs).String(),
+	}
+}
+
+// supportBundle implements `redisbetween bundle`, which downloads a
+// support bundle from a running process's admin server. It returns the process
+// exit code.
+func supportBundle(args []string, stdout, stderr io.Writer) int {
+	var admin, out string
+	var hashHosts bool
+	var timeout time.Duration
+	fs := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(stderr, "Usage: redisbetween bundle -admin localhost:8080 [options]\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&admin, "admin", "", "Address of the admin server of the process, as given to -adminaddr")
+	fs.StringVar(&out, "o", "", "File to write the bundle to. Defaults to the name the admin server suggests, in the current directory")
+	fs.BoolVar(&hashHosts, "hashhosts", false, "Replace every upstream, statsd and fallback host with a salted hash")
+	fs.DurationVar(&timeout, "timeout", 30*time.Second, "How long to wait for the bundle")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if admin == "" {
+		fs.Usage()
+		return 2
+	}
+	u := url.URL{Scheme: "http", Host: admin, Path: "/support-bundle", RawQuery: "hashhosts=" + strconv.FormatBool(hashHosts)}
+	resp, err := (&http.Client{Timeout: timeout}).Get(u.String())
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		_, _ = fmt.Fprintf(stderr, "%s: %s", resp.Status, msg)
+		return 1
+	}
+	if out == "" {
+		out = "redisbetween-support.tar.gz"
+		if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+			out = filepath.Base(params["filename"])
+		}
+	}
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	n, err := io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(stdout, "Wrote %s (%d bytes)\n", out, n)
+	return 0
+}
@@ -0,0 +1,41 @@
+package support
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Handler serves GET requests with a bundle, with hosts hashed if the hashhosts
+// query param is true. A request made while a bundle is being generated, or
+// within MinInterval of the last one, gets a 429 with a Retry-After.
+func (b *Bundler) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		hashHosts, _ := strconv.ParseBool(r.URL.Query().Get("hashhosts"))
+		wait, ok := b.acquire()
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, fmt.Sprintf("a support bundle was generated recently, retry in %v", wait.Round(time.Second)), http.StatusTooManyRequests)
+			return
+		}
+		defer b.release()
+
+		// generated in full before responding, so that a failure is an error
+		// response rather than a truncated archive
+		var buf bytes.Buffer
+		if err := b.Write(&buf, hashHosts); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "redisbetween-support-"+b.now().UTC().Format("20060102-150405")+".tar.gz"))
+		_, _ = w.Write(buf.Bytes())
+	})
+}
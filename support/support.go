@@ -0,0 +1,208 @@
+// Package support builds the support bundles of a running process: a tar.gz of
+// JSON snapshots of its config and state, for attaching to bug reports.
+//
+// Bundles follow a redaction policy, which is written into each one's
+// manifest.json: they never contain keys, values or credentials, only state the
+// process already keeps in memory, and with hashed hosts every host the process
+// knows of is replaced by a hash that is consistent within the bundle but salted
+// differently in every one.
+package support
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxBytes caps the uncompressed size of a bundle
+	DefaultMaxBytes = 8 << 20
+	// DefaultMinInterval is how long after a bundle the next one may be generated
+	DefaultMinInterval = time.Minute
+)
+
+// Policy describes what bundles leave out
+const Policy = "Bundles contain no keys, values or credentials: only the config, with credentials removed from URLs, " +
+	"and counters, states and settings the process already keeps in memory. With hashed hosts, every upstream, statsd " +
+	"and fallback host is replaced by host-<hash>, salted per bundle."
+
+// Section is a file of the bundle, whose content is Collect's return value
+// encoded as JSON
+type Section struct {
+	Name    string
+	Collect func() interface{}
+}
+
+// Bundler generates bundles, one at a time and at most once per MinInterval
+type Bundler struct {
+	sections    []Section
+	hosts       func() []string
+	maxBytes    int64
+	minInterval time.Duration
+	now         func() time.Time
+
+	mu   sync.Mutex
+	busy bool
+	last time.Time
+}
+
+// New returns a Bundler of the given sections. Hosts lists the hosts to hash in
+// bundles generated with hashed hosts.
+func New(hosts func() []string, sections ...Section) *Bundler {
+	return &Bundler{
+		sections:    sections,
+		hosts:       hosts,
+		maxBytes:    DefaultMaxBytes,
+		minInterval: DefaultMinInterval,
+		now:         time.Now,
+	}
+}
+
+// File is an entry of a bundle's manifest
+type File struct {
+	Name      string `json:"name"`
+	Bytes     int    `json:"bytes"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Manifest is the manifest.json of a bundle
+type Manifest struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	HashedHosts bool      `json:"hashed_hosts"`
+	Policy      string    `json:"policy"`
+	Files       []File    `json:"files"`
+}
+
+// acquire reserves the right to generate a bundle, or returns how long until one
+// may be generated
+func (b *Bundler) acquire() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.busy {
+		return b.minInterval, false
+	}
+	if wait := b.last.Add(b.minInterval).Sub(b.now()); !b.last.IsZero() && wait > 0 {
+		return wait, false
+	}
+	b.busy = true
+	return 0, true
+}
+
+func (b *Bundler) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.busy = false
+	b.last = b.now()
+}
+
+// Write generates a bundle into w. Each section is collected and encoded in turn,
+// and one that doesn't fit in what is left of the size cap is replaced by a
+// note that it was truncated.
+func (b *Bundler) Write(w io.Writer, hashHosts bool) error {
+	var replacer *strings.Replacer
+	if hashHosts {
+		replacer = hostReplacer(b.hosts())
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	m := Manifest{GeneratedAt: b.now().UTC(), HashedHosts: hashHosts, Policy: Policy}
+	remaining := b.maxBytes
+	for _, s := range b.sections {
+		f := File{Name: s.Name}
+		content, err := encode(s.Collect)
+		if err != nil {
+			f.Error = err.Error()
+			content = nil
+		}
+		if replacer != nil {
+			content = []byte(replacer.Replace(string(content)))
+		}
+		if int64(len(content)) > remaining {
+			f.Truncated = true
+			content, _ = json.Marshal(map[string]interface{}{"truncated": true, "bytes": len(content)})
+		}
+		remaining -= int64(len(content))
+		f.Bytes = len(content)
+		m.Files = append(m.Files, f)
+		if err := writeFile(tw, s.Name, m.GeneratedAt, content); err != nil {
+			return err
+		}
+	}
+	manifest, _ := json.MarshalIndent(m, "", "  ")
+	if err := writeFile(tw, "manifest.json", m.GeneratedAt, manifest); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// encode collects a section, recovering from a collector that panics so that
+// the rest of the bundle is still generated
+func encode(collect func() interface{}) (b []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError{r}
+		}
+	}()
+	return json.MarshalIndent(collect(), "", "  ")
+}
+
+type panicError struct{ value interface{} }
+
+func (e panicError) Error() string {
+	return fmt.Sprintf("collecting panicked: %v", e.value)
+}
+
+func writeFile(tw *tar.Writer, name string, modified time.Time, content []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), ModTime: modified, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, bytes.NewReader(content))
+	return err
+}
+
+// hostReplacer replaces every form a host takes in the process's state: the
+// host itself, which also covers host:port, and the host as it appears in
+// socket paths, with ":" replaced by "-"
+func hostReplacer(addrs []string) *strings.Replacer {
+	salt := make([]byte, 16)
+	_, _ = rand.Read(salt)
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, a := range addrs {
+		h := a
+		if host, _, err := net.SplitHostPort(a); err == nil {
+			h = host
+		}
+		if h != "" && !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	// longer hosts first, so that one containing another is replaced whole
+	sort.Slice(hosts, func(i, j int) bool { return len(hosts[i]) > len(hosts[j]) })
+	var pairs []string
+	for _, h := range hosts {
+		sum := sha256.Sum256(append(salt, h...))
+		hashed := "host-" + hex.EncodeToString(sum[:6])
+		pairs = append(pairs, h, hashed)
+		if dashed := strings.Replace(h, ":", "-", -1); dashed != h {
+			pairs = append(pairs, dashed, hashed)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
@@ -0,0 +1,119 @@
+package support
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readBundle(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	assert.NoError(t, err)
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			break
+		}
+		content, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		files[h.Name] = string(content)
+	}
+	return files
+}
+
+func testBundler() *Bundler {
+	hosts := func() []string { return []string{"cache-1.internal:6379", "2600:1f14::12", "statsd.internal:8125"} }
+	return New(hosts,
+		Section{Name: "stats.json", Collect: func() interface{} {
+			return map[string]string{
+				"upstream": "cache-1.internal:6379",
+				"local":    "/var/tmp/redisbetween-cache-1.internal-6379.sock",
+				"ipv6":     "/var/tmp/redisbetween-ipv6-2600-1f14--12-6379.sock",
+			}
+		}},
+		Section{Name: "broken.json", Collect: func() interface{} { panic("no state") }},
+		Section{Name: "big.json", Collect: func() interface{} { return strings.Repeat("x", 200) }},
+	)
+}
+
+func TestWrite(t *testing.T) {
+	b := testBundler()
+	b.maxBytes = 200
+
+	var buf bytes.Buffer
+	assert.NoError(t, b.Write(&buf, false))
+	files := readBundle(t, buf.Bytes())
+	assert.Contains(t, files["stats.json"], `"upstream": "cache-1.internal:6379"`)
+	assert.Equal(t, "", files["broken.json"])
+	assert.Equal(t, `{"bytes":202,"truncated":true}`, files["big.json"], "sections beyond the size cap are truncated")
+
+	var m Manifest
+	assert.NoError(t, json.Unmarshal([]byte(files["manifest.json"]), &m))
+	assert.False(t, m.HashedHosts)
+	assert.Equal(t, Policy, m.Policy)
+	if assert.Len(t, m.Files, 3) {
+		assert.Equal(t, "collecting panicked: no state", m.Files[1].Error, "a failing section doesn't prevent the others")
+		assert.True(t, m.Files[2].Truncated)
+	}
+}
+
+func TestWriteHashedHosts(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, testBundler().Write(&buf, true))
+	stats := readBundle(t, buf.Bytes())["stats.json"]
+	assert.NotContains(t, stats, "cache-1")
+	assert.NotContains(t, stats, "2600")
+
+	var s map[string]string
+	assert.NoError(t, json.Unmarshal([]byte(stats), &s))
+	host := strings.Split(s["upstream"], ":")[0]
+	assert.True(t, strings.HasPrefix(host, "host-"))
+	assert.Equal(t, host+":6379", s["upstream"])
+	assert.Equal(t, "/var/tmp/redisbetween-"+host+"-6379.sock", s["local"], "hosts are hashed the same way wherever they appear")
+	assert.Contains(t, s["ipv6"], "/var/tmp/redisbetween-ipv6-host-")
+
+	buf.Reset()
+	assert.NoError(t, testBundler().Write(&buf, true))
+	assert.NotContains(t, readBundle(t, buf.Bytes())["stats.json"], host, "hashes are salted per bundle")
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	b := testBundler()
+	now := time.Unix(1700000000, 0)
+	b.now = func() time.Time { return now }
+	srv := httptest.NewServer(b.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?hashhosts=true")
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `attachment; filename="redisbetween-support-20231114-221320.tar.gz"`, resp.Header.Get("Content-Disposition"))
+	assert.NotContains(t, readBundle(t, body)["stats.json"], "cache-1")
+
+	now = now.Add(20 * time.Second)
+	resp, err = http.Get(srv.URL)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "40", resp.Header.Get("Retry-After"))
+
+	now = now.Add(DefaultMinInterval)
+	resp, err = http.Get(srv.URL)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}